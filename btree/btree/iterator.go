@@ -0,0 +1,171 @@
+package btree
+
+/*
+Iterator walks the data items of a tree in key order, in both directions.
+Nodes don't point back to their parents, so the iterator keeps the path from the root to its
+current item as a stack of frames. The top frame holds the node and index of the current item.
+Every frame below it holds an ancestor and the index of the child pointer the path follows.
+Going forward, the next item of an ancestor is items[pos]; going backward, it is items[pos-1].
+The tree must not be changed while it is iterated over.
+*/
+type Iterator struct {
+	tree  *Btree
+	stack []frame
+}
+
+type frame struct {
+	n   *node
+	pos int
+}
+
+func (t *Btree) Iterator() *Iterator {
+	return &Iterator{tree: t}
+}
+
+// Valid reports whether the iterator is positioned at an item.
+func (it *Iterator) Valid() bool {
+	return len(it.stack) > 0
+}
+
+func (it *Iterator) Key() []byte {
+	top := it.stack[len(it.stack)-1]
+	return top.n.items[top.pos].key
+}
+
+func (it *Iterator) Value() []byte {
+	top := it.stack[len(it.stack)-1]
+	return top.n.items[top.pos].val
+}
+
+// First moves the iterator to the smallest key.
+func (it *Iterator) First() bool {
+	it.stack = it.stack[:0]
+	if it.tree.root != nil {
+		it.descendLeft(it.tree.root)
+	}
+	return it.Valid()
+}
+
+// Last moves the iterator to the largest key.
+func (it *Iterator) Last() bool {
+	it.stack = it.stack[:0]
+	if it.tree.root != nil {
+		it.descendRight(it.tree.root)
+	}
+	return it.Valid()
+}
+
+// SeekGE moves the iterator to the smallest key >= key.
+func (it *Iterator) SeekGE(key []byte) bool {
+	it.stack = it.stack[:0]
+	for n := it.tree.root; n != nil; {
+		pos, found := n.search(key, it.tree.cmp)
+		it.stack = append(it.stack, frame{n, pos})
+		if found {
+			return true
+		}
+		if n.isLeaf() {
+			// pos is where key would be inserted, past the last item if key is larger than all of them
+			if pos < n.numItems {
+				return true
+			}
+			it.stack = it.stack[:len(it.stack)-1]
+			return it.ascendForward()
+		}
+		n = n.children[pos]
+	}
+	return false
+}
+
+// SeekLT moves the iterator to the largest key < key.
+func (it *Iterator) SeekLT(key []byte) bool {
+	if !it.SeekGE(key) {
+		return it.Last()
+	}
+	return it.Prev()
+}
+
+// Next moves the iterator to the following key.
+func (it *Iterator) Next() bool {
+	if !it.Valid() {
+		return false
+	}
+	top := &it.stack[len(it.stack)-1]
+	if !top.n.isLeaf() {
+		// the successor is the smallest item of the subtree right of the current item
+		top.pos++
+		it.descendLeft(top.n.children[top.pos])
+		return true
+	}
+	if top.pos+1 < top.n.numItems {
+		top.pos++
+		return true
+	}
+	it.stack = it.stack[:len(it.stack)-1]
+	return it.ascendForward()
+}
+
+// Prev moves the iterator to the preceding key.
+func (it *Iterator) Prev() bool {
+	if !it.Valid() {
+		return false
+	}
+	top := &it.stack[len(it.stack)-1]
+	if !top.n.isLeaf() {
+		// the predecessor is the largest item of the subtree left of the current item
+		it.descendRight(top.n.children[top.pos])
+		return true
+	}
+	if top.pos > 0 {
+		top.pos--
+		return true
+	}
+	it.stack = it.stack[:len(it.stack)-1]
+	return it.ascendBackward()
+}
+
+// descendLeft pushes the path from n down to its smallest item.
+func (it *Iterator) descendLeft(n *node) {
+	for {
+		it.stack = append(it.stack, frame{n, 0})
+		if n.isLeaf() {
+			return
+		}
+		n = n.children[0]
+	}
+}
+
+// descendRight pushes the path from n down to its largest item.
+func (it *Iterator) descendRight(n *node) {
+	for !n.isLeaf() {
+		it.stack = append(it.stack, frame{n, n.numChildren - 1})
+		n = n.children[n.numChildren-1]
+	}
+	it.stack = append(it.stack, frame{n, n.numItems - 1})
+}
+
+// ascendForward pops the frames of the subtrees walked through entirely, up to the ancestor
+// whose next item comes after them.
+func (it *Iterator) ascendForward() bool {
+	for len(it.stack) > 0 {
+		top := it.stack[len(it.stack)-1]
+		if top.pos < top.n.numItems {
+			return true
+		}
+		it.stack = it.stack[:len(it.stack)-1]
+	}
+	return false
+}
+
+// ascendBackward is the counterpart of ascendForward, when walking backward.
+func (it *Iterator) ascendBackward() bool {
+	for len(it.stack) > 0 {
+		top := &it.stack[len(it.stack)-1]
+		if top.pos > 0 {
+			top.pos--
+			return true
+		}
+		it.stack = it.stack[:len(it.stack)-1]
+	}
+	return false
+}
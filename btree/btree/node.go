@@ -1,7 +1,5 @@
 package btree
 
-import "bytes"
-
 const (
 	degree      = 2               // min child pointers a non-leaf node can have
 	maxChildren = 2 * degree      // 4
@@ -38,18 +36,18 @@ Else, return the index j where the key would have resided if it was present in t
 Basically, lower bound of the key in the node -- this coincides with position of the child pointer !!
 So, we can continue the traversal down the tree if the returned boolean value is false.
 */
-func (n *node) search(key []byte) (int, bool) {
+func (n *node) search(key []byte, cmp Compare) (int, bool) {
 	low, high := 0, n.numItems
 	var mid int
 	for low < high {
 		mid = (low + high) / 2
-		cmp := bytes.Compare(key, n.items[mid].key)
+		c := cmp(key, n.items[mid].key)
 		switch {
-		case cmp > 0:
+		case c > 0:
 			low = mid + 1
-		case cmp < 0:
+		case c < 0:
 			high = mid
-		case cmp == 0:
+		case c == 0:
 			return mid, true
 		}
 	}
@@ -110,23 +108,24 @@ func (n *node) split() (*item, *node) {
 }
 
 /*
-Returned value is true if we performed insertion. If key already exists, we just update its value and return false.
+Returned value is the item replaced if key already exists, in which case we just update its value, and nil if we performed insertion.
 The algo will start traversing the tree from its root, recursively calling the insert() method until it reaches a
 leaf node suitable for insertion.
 */
-func (n *node) insert(item *item) bool {
-	pos, found := n.search(item.key)
+func (n *node) insert(item *item, cmp Compare) *item {
+	pos, found := n.search(item.key, cmp)
 
 	// The data item already exists, so just update its value.
 	if found {
+		old := n.items[pos]
 		n.items[pos] = item
-		return false
+		return old
 	}
 
 	// If we reach a leaf node -> it has sufficient space for the new item so, insert the new item
 	if n.isLeaf() {
 		n.insertItemAt(pos, item)
-		return true
+		return nil
 	}
 
 	// If the next node on the traversal path is already full, split it
@@ -136,23 +135,24 @@ func (n *node) insert(item *item) bool {
 		n.insertChildAt(pos+1, newNode)
 
 		// We may need to change our direction after promoting the middle item to the parent, depending on its key.
-		switch cmp := bytes.Compare(item.key, n.items[pos].key); {
-		case cmp < 0:
+		switch c := cmp(item.key, n.items[pos].key); {
+		case c < 0:
 			// The key we are looking for is still smaller than the key of the middle item that we took from the child,
 			// so we can continue following the same direction.
-		case cmp > 0:
+		case c > 0:
 			// The middle item that we took from the child has a key that is smaller than the one we are looking for,
 			// so we need to change our direction.
 			pos++
 		default:
 			// The middle item that we took from the child is the item we are searching for, so just update its value.
+			old := n.items[pos]
 			n.items[pos] = item
-			return true
+			return old
 		}
 	}
 
 	// Continue with the insertion process
-	return n.children[pos].insert(item)
+	return n.children[pos].insert(item, cmp)
 }
 
 func (n *node) removeItemAt(pos int) *item {
@@ -204,7 +204,7 @@ func (n *node) fillChildAt(pos int) {
 		right.numItems++
 		// For non-leaf nodes, make the right-most child of the left node the new left-most child of the right node.
 		if !right.isLeaf() {
-			right.insertChildAt(0, left.removeChildAt(left.numItems-1))
+			right.insertChildAt(0, left.removeChildAt(left.numChildren-1))
 		}
 		// Borrow the right-most item from the left node to replace the parent item.
 		n.items[pos-1] = left.removeItemAt(left.numItems - 1)
@@ -259,8 +259,8 @@ the preceding call in the call stack so that it can be used to for replacing the
 As we traverse the tree back up from the leaf to the root, we check whether we have caused an underflow with our deletion or
 with any subsequent merges and perform the respective repairs.
 */
-func (n *node) delete(key []byte, isSeekingSuccessor bool) *item {
-	pos, found := n.search(key)
+func (n *node) delete(key []byte, isSeekingSuccessor bool, cmp Compare) *item {
+	pos, found := n.search(key, cmp)
 
 	var next *node
 
@@ -287,7 +287,7 @@ func (n *node) delete(key []byte, isSeekingSuccessor bool) *item {
 	}
 
 	// Continue traversing the tree to find an item matching the supplied key.
-	deletedItem := next.delete(key, isSeekingSuccessor)
+	deletedItem := next.delete(key, isSeekingSuccessor, cmp)
 
 	// We found the inorder successor, and we are now back at the internal node containing the item
 	// matching the supplied key. Therefore, we replace the item with its inorder successor, effectively
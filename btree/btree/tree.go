@@ -1,29 +1,49 @@
 package btree
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+)
+
+// Compare returns -1, 0 or +1 depending on whether a is smaller than, equal to or larger than b.
+type Compare func(a, b []byte) int
 
 /*
-Btree only keeps a pointer to root node of the tree.
+Btree only keeps a pointer to root node of the tree and the order of its keys.
 A tree is made up of nodes. Each node contains data items.
 */
 type Btree struct {
 	root *node
+	cmp  Compare
 }
 
 func NewBTree() *Btree {
-	return &Btree{}
+	return NewBTreeWithCompare(bytes.Compare)
+}
+
+// NewBTreeWithCompare returns an empty tree ordering its keys by cmp.
+func NewBTreeWithCompare(cmp Compare) *Btree {
+	return &Btree{cmp: cmp}
 }
 
 // Searching the entire tree.
 func (t *Btree) Find(key []byte) ([]byte, error) {
+	if val, found := t.Get(key); found {
+		return val, nil
+	}
+	return nil, fmt.Errorf("key %s not found", key)
+}
+
+// Get is Find reporting a missing key with false rather than an error.
+func (t *Btree) Get(key []byte) ([]byte, bool) {
 	for next := t.root; next != nil; {
-		pos, found := next.search(key)
+		pos, found := next.search(key, t.cmp)
 		if found {
-			return next.items[pos].val, nil
+			return next.items[pos].val, true
 		}
 		next = next.children[pos]
 	}
-	return nil, fmt.Errorf("key %s not found", key)
+	return nil, false
 }
 
 /*
@@ -40,7 +60,8 @@ func (t *Btree) splitRoot() {
 	t.root = newRoot
 }
 
-func (t *Btree) Insert(key, val []byte) {
+// Insert sets the value of key, and returns the value it replaced if key already existed.
+func (t *Btree) Insert(key, val []byte) ([]byte, bool) {
 	i := &item{key, val}
 
 	// The tree is empty, so initialize a new node.
@@ -54,14 +75,17 @@ func (t *Btree) Insert(key, val []byte) {
 	}
 
 	// Begin insertion.
-	t.root.insert(i)
+	if old := t.root.insert(i, t.cmp); old != nil {
+		return old.val, true
+	}
+	return nil, false
 }
 
 func (t *Btree) Delete(key []byte) bool {
 	if t.root == nil {
 		return false
 	}
-	deletedItem := t.root.delete(key, false)
+	deletedItem := t.root.delete(key, false, t.cmp)
 
 	if t.root.numItems == 0 {
 		if t.root.isLeaf() {
@@ -0,0 +1,367 @@
+// Package bench runs YCSB-style workloads against a DB and reports their throughput and
+// latency percentiles. A run loads the records first, then runs the operations of the
+// workload on them from concurrent workers:
+//
+//	A  update heavy:       50% reads, 50% updates
+//	B  read mostly:        95% reads, 5% updates
+//	C  read only:          100% reads
+//	D  read latest:        95% reads, 5% inserts, reads favoring the keys inserted last
+//	E  short ranges:       95% scans, 5% inserts
+//	F  read-modify-write:  50% reads, 50% read-modify-writes
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"lsm/db"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Key distributions.
+const (
+	Uniform = "uniform"
+	Zipfian = "zipfian"
+	Latest  = "latest"
+)
+
+// operations of a workload
+const (
+	opRead = iota
+	opUpdate
+	opInsert
+	opScan
+	opReadModifyWrite
+	numOps
+)
+
+var opNames = [numOps]string{"READ", "UPDATE", "INSERT", "SCAN", "READ-MODIFY-WRITE"}
+
+// workload is the share of each operation, and the default key distribution.
+type workload struct {
+	mix          [numOps]float64
+	distribution string
+}
+
+var workloads = map[string]workload{
+	"a": {mix: [numOps]float64{opRead: 0.5, opUpdate: 0.5}, distribution: Zipfian},
+	"b": {mix: [numOps]float64{opRead: 0.95, opUpdate: 0.05}, distribution: Zipfian},
+	"c": {mix: [numOps]float64{opRead: 1}, distribution: Zipfian},
+	"d": {mix: [numOps]float64{opRead: 0.95, opInsert: 0.05}, distribution: Latest},
+	"e": {mix: [numOps]float64{opScan: 0.95, opInsert: 0.05}, distribution: Zipfian},
+	"f": {mix: [numOps]float64{opRead: 0.5, opReadModifyWrite: 0.5}, distribution: Zipfian},
+}
+
+// Config describes a run. Zero values are replaced by defaults.
+type Config struct {
+	// Workload is the letter of the workload, A to F.
+	Workload string
+	// Records is the number of records loaded before the workload runs.
+	Records int
+	// Operations is the number of operations of the workload, over all workers.
+	Operations int
+	// KeySize and ValueSize are the sizes of keys and values in bytes. Keys are "user"
+	// followed by their zero-padded number, so they may be longer if KeySize is too short to
+	// number every key.
+	KeySize   int
+	ValueSize int
+	// Distribution is how keys are picked for reads, updates and scans: Uniform, Zipfian or
+	// Latest. By default, that of the workload (Latest for D, Zipfian otherwise).
+	Distribution string
+	// Concurrency is the number of workers running operations concurrently.
+	Concurrency int
+	// MaxScanLength is the maximum number of keys a scan reads, the length of each scan being
+	// uniform between 1 and it.
+	MaxScanLength int
+	// SkipLoad skips the load phase, the records being in the DB already, e.g. from a
+	// previous run with the same Records and KeySize.
+	SkipLoad bool
+	Seed     int64
+}
+
+func (c *Config) ensureDefaults() {
+	if c.Workload == "" {
+		c.Workload = "a"
+	}
+	c.Workload = strings.ToLower(c.Workload)
+	if c.Records <= 0 {
+		c.Records = 100000
+	}
+	if c.Operations <= 0 {
+		c.Operations = 100000
+	}
+	if c.KeySize <= 0 {
+		c.KeySize = 24
+	}
+	if c.ValueSize <= 0 {
+		c.ValueSize = 100
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = 1
+	}
+	if c.MaxScanLength <= 0 {
+		c.MaxScanLength = 100
+	}
+}
+
+// Report is the outcome of a run.
+type Report struct {
+	Workload     string
+	Distribution string
+	Load         Phase // empty with Config.SkipLoad
+	Run          Phase
+}
+
+// Phase sums up the load or the run of a workload.
+type Phase struct {
+	Operations int
+	Duration   time.Duration
+	Stats      []OpStats // of the operations that ran at least once
+}
+
+// Throughput returns the operations per second.
+func (p Phase) Throughput() float64 {
+	if p.Duration == 0 {
+		return 0
+	}
+	return float64(p.Operations) / p.Duration.Seconds()
+}
+
+// OpStats are the latencies of an operation.
+type OpStats struct {
+	Name   string
+	Count  int
+	Misses int // reads (and reads before a write) of keys that weren't found
+	Mean   time.Duration
+	P50    time.Duration
+	P95    time.Duration
+	P99    time.Duration
+	P999   time.Duration
+	Max    time.Duration
+}
+
+// Run loads the records into d, then runs the workload described by cfg and reports on
+// both. It stops at the first error of an operation.
+func Run(d *db.DB, cfg Config) (*Report, error) {
+	cfg.ensureDefaults()
+	w, ok := workloads[cfg.Workload]
+	if !ok {
+		return nil, fmt.Errorf("unknown workload %q, expected a letter from A to F", cfg.Workload)
+	}
+	if cfg.Distribution == "" {
+		cfg.Distribution = w.distribution
+	}
+	if cfg.Distribution != Uniform && cfg.Distribution != Zipfian && cfg.Distribution != Latest {
+		return nil, fmt.Errorf("unknown distribution %q, expected %s, %s or %s", cfg.Distribution, Uniform, Zipfian, Latest)
+	}
+
+	// keys are numbered up to the records plus every operation being an insert
+	width := max(cfg.KeySize-len("user"), len(fmt.Sprint(cfg.Records+cfg.Operations)))
+	r := &runner{
+		d:       d,
+		cfg:     cfg,
+		w:       w,
+		keyFmt:  fmt.Sprintf("user%%0%dd", width),
+		choose:  newChooser(cfg.Distribution, uint64(cfg.Records)),
+		records: uint64(cfg.Records),
+	}
+	report := &Report{Workload: strings.ToUpper(cfg.Workload), Distribution: cfg.Distribution}
+	var err error
+	if !cfg.SkipLoad {
+		if report.Load, err = r.phase(cfg.Records, r.load); err != nil {
+			return report, fmt.Errorf("load: %w", err)
+		}
+	}
+	r.inserted.Store(r.records)
+	r.acked.Store(r.records)
+	report.Run, err = r.phase(cfg.Operations, r.operation)
+	return report, err
+}
+
+// runner holds the state workers share.
+type runner struct {
+	d       *db.DB
+	cfg     Config
+	w       workload
+	keyFmt  string
+	choose  chooser
+	records uint64
+
+	inserted atomic.Uint64 // keys numbered so far
+	acked    atomic.Uint64 // keys below which every insert completed
+	pending  sync.Map      // inserts completed out of order, by key number
+}
+
+// worker is the state of a worker: its random source and the latencies it measured.
+type worker struct {
+	rng       *rand.Rand
+	val       []byte
+	latencies [numOps][]time.Duration
+	misses    [numOps]int
+}
+
+// phase runs n operations over the workers, worker i running the ith share of them.
+func (r *runner) phase(n int, op func(w *worker, i int) error) (Phase, error) {
+	workers := make([]*worker, r.cfg.Concurrency)
+	errs := make([]error, len(workers))
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range workers {
+		w := &worker{
+			rng: rand.New(rand.NewSource(r.cfg.Seed + int64(i))),
+			val: make([]byte, r.cfg.ValueSize),
+		}
+		workers[i] = w
+		from, to := n*i/len(workers), n*(i+1)/len(workers)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := from; j < to && !failed.Load(); j++ {
+				if err := op(w, j); err != nil {
+					errs[i] = err
+					failed.Store(true)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	p := Phase{Operations: n, Duration: time.Since(start)}
+	if err := errors.Join(errs...); err != nil {
+		return p, err
+	}
+	for op := 0; op < numOps; op++ {
+		var latencies []time.Duration
+		misses := 0
+		for _, w := range workers {
+			latencies = append(latencies, w.latencies[op]...)
+			misses += w.misses[op]
+		}
+		if len(latencies) > 0 {
+			p.Stats = append(p.Stats, summarize(opNames[op], latencies, misses))
+		}
+	}
+	return p, nil
+}
+
+// load inserts the ith record.
+func (r *runner) load(w *worker, i int) error {
+	return w.timed(opInsert, func() error {
+		return r.d.Set(r.key(uint64(i)), w.value(), nil)
+	})
+}
+
+// operation runs an operation drawn from the mix of the workload.
+func (r *runner) operation(w *worker, _ int) error {
+	op, u := opRead, w.rng.Float64()
+	for i, share := range r.w.mix {
+		if u < share {
+			op = i
+			break
+		}
+		u -= share
+	}
+
+	if op == opInsert {
+		n := r.inserted.Add(1) - 1
+		err := w.timed(op, func() error {
+			return r.d.Set(r.key(n), w.value(), nil)
+		})
+		r.ack(n)
+		return err
+	}
+
+	// only pick keys whose insert completed, so that reads don't miss them
+	key := r.key(r.choose(w.rng, r.acked.Load()))
+	switch op {
+	case opRead:
+		return w.timed(op, func() error {
+			return w.miss(op, r.get(key))
+		})
+	case opUpdate:
+		return w.timed(op, func() error {
+			return r.d.Set(key, w.value(), nil)
+		})
+	case opScan:
+		length := 1 + w.rng.Intn(r.cfg.MaxScanLength)
+		return w.timed(op, func() error {
+			return r.scan(key, length)
+		})
+	default:
+		return w.timed(op, func() error {
+			if err := w.miss(op, r.get(key)); err != nil {
+				return err
+			}
+			return r.d.Set(key, w.value(), nil)
+		})
+	}
+}
+
+// ack records that the insert of key n completed, and moves acked past every key inserted
+// without a gap.
+func (r *runner) ack(n uint64) {
+	r.pending.Store(n, true)
+	for {
+		next := r.acked.Load()
+		if _, ok := r.pending.Load(next); !ok {
+			return
+		}
+		if r.acked.CompareAndSwap(next, next+1) {
+			r.pending.Delete(next)
+		}
+	}
+}
+
+func (r *runner) get(key []byte) error {
+	_, err := r.d.Get(key)
+	return err
+}
+
+// scan reads up to length kv-pairs starting at key.
+func (r *runner) scan(key []byte, length int) error {
+	it, err := r.d.NewIter(&db.IterOptions{LowerBound: key})
+	if err != nil {
+		return err
+	}
+	for valid, n := it.Seek(key), 0; valid && n < length; valid, n = it.Next(), n+1 {
+		_ = it.Value()
+	}
+	if err := it.Error(); err != nil {
+		it.Close()
+		return err
+	}
+	return it.Close()
+}
+
+func (r *runner) key(n uint64) []byte {
+	return []byte(fmt.Sprintf(r.keyFmt, n))
+}
+
+// timed runs fn, recording its latency as an op.
+func (w *worker) timed(op int, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	w.latencies[op] = append(w.latencies[op], time.Since(start))
+	if err != nil {
+		return fmt.Errorf("%s: %w", opNames[op], err)
+	}
+	return nil
+}
+
+// miss counts a read of a missing key for op instead of failing it.
+func (w *worker) miss(op int, err error) error {
+	if errors.Is(err, db.ErrKeyNotFound) {
+		w.misses[op]++
+		return nil
+	}
+	return err
+}
+
+// value returns a new random value, valid until the next call.
+func (w *worker) value() []byte {
+	w.rng.Read(w.val)
+	return w.val
+}
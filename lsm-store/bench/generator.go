@@ -0,0 +1,88 @@
+package bench
+
+import (
+	"math"
+	"math/rand"
+)
+
+// zipfianTheta is the skew of YCSB's zipfian distribution: the most popular key is drawn
+// about 10% of the time out of a million.
+const zipfianTheta = 0.99
+
+// zipfian draws integers in [0, n) following a zipfian distribution, 0 being the most
+// popular, as described in "Quickly Generating Billion-Record Synthetic Databases" (Gray et
+// al.) and used by YCSB. It is immutable once created, so workers share it, each with a
+// rand.Rand of its own.
+type zipfian struct {
+	n                 uint64
+	alpha, eta, zetan float64
+	half              float64 // 1 + 0.5^theta, the bound of the second item
+}
+
+func newZipfian(n uint64) *zipfian {
+	zetan := zeta(n, zipfianTheta)
+	return &zipfian{
+		n:     n,
+		alpha: 1 / (1 - zipfianTheta),
+		eta:   (1 - math.Pow(2/float64(n), 1-zipfianTheta)) / (1 - zeta(2, zipfianTheta)/zetan),
+		zetan: zetan,
+		half:  1 + math.Pow(0.5, zipfianTheta),
+	}
+}
+
+// zeta returns the sum of 1/i^theta for i in [1, n].
+func zeta(n uint64, theta float64) float64 {
+	var sum float64
+	for i := uint64(1); i <= n; i++ {
+		sum += 1 / math.Pow(float64(i), theta)
+	}
+	return sum
+}
+
+func (z *zipfian) next(rng *rand.Rand) uint64 {
+	u := rng.Float64()
+	uz := u * z.zetan
+	switch {
+	case uz < 1:
+		return 0
+	case uz < z.half:
+		return 1
+	}
+	return min(uint64(float64(z.n)*math.Pow(z.eta*u-z.eta+1, z.alpha)), z.n-1)
+}
+
+// chooser picks the index of the key an operation reads, updates or starts a scan at, among
+// the n keys inserted so far.
+type chooser func(rng *rand.Rand, n uint64) uint64
+
+// newChooser returns the chooser of distribution over the records loaded initially. Zipfian
+// popularity is scattered over the keyspace by hashing, rather than piling up at its start;
+// latest favors the keys inserted last.
+func newChooser(distribution string, records uint64) chooser {
+	switch distribution {
+	case Zipfian:
+		z := newZipfian(records)
+		return func(rng *rand.Rand, n uint64) uint64 {
+			return fnv64(z.next(rng)) % n
+		}
+	case Latest:
+		z := newZipfian(records)
+		return func(rng *rand.Rand, n uint64) uint64 {
+			return n - 1 - min(z.next(rng), n-1)
+		}
+	}
+	return func(rng *rand.Rand, n uint64) uint64 {
+		return uint64(rng.Int63n(int64(n)))
+	}
+}
+
+// fnv64 hashes v with 64-bit FNV-1a, byte by byte.
+func fnv64(v uint64) uint64 {
+	h := uint64(0xcbf29ce484222325)
+	for i := 0; i < 8; i++ {
+		h ^= v & 0xff
+		h *= 0x100000001b3
+		v >>= 8
+	}
+	return h
+}
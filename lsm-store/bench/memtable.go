@@ -0,0 +1,311 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"lsm/comparer"
+	"lsm/memtable"
+	"lsm/sstable"
+	"lsm/storage"
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"text/tabwriter"
+	"time"
+)
+
+// MemtableConfig describes a comparison of the memtable backends. Zero values are replaced by
+// defaults.
+type MemtableConfig struct {
+	// Backends are the backends compared, the skiplist and the B-tree by default.
+	Backends []memtable.BackendType
+	// Entries is the number of entries of a full memtable: the inserts start over with an
+	// empty memtable every Entries of them, and the gets, scans and flushes run on a memtable
+	// holding Entries entries.
+	Entries int
+	// KeySize and ValueSize are the sizes of keys and values in bytes.
+	KeySize   int
+	ValueSize int
+	// Sequential inserts the keys in increasing order rather than in random order.
+	Sequential bool
+	// ScanLength is the number of entries a scan reads.
+	ScanLength int
+	// Dir is the directory flushes write their table to, to time them against a real disk.
+	// Tables are written to memory if empty.
+	Dir  string
+	Seed int64
+}
+
+func (c *MemtableConfig) ensureDefaults() {
+	if len(c.Backends) == 0 {
+		c.Backends = []memtable.BackendType{memtable.SkipListBackend, memtable.BTreeBackend}
+	}
+	if c.Entries <= 0 {
+		c.Entries = 100000
+	}
+	if c.KeySize <= 0 {
+		c.KeySize = 24
+	}
+	if c.ValueSize <= 0 {
+		c.ValueSize = 100
+	}
+	if c.ScanLength <= 0 {
+		c.ScanLength = 100
+	}
+}
+
+// MemtableOps are the operations a memtable backend is benchmarked on, in the order they run.
+var MemtableOps = []string{"insert", "get", "scan", "flush"}
+
+// MemtableResult is the outcome of the benchmark of an operation on a backend.
+type MemtableResult struct {
+	Backend memtable.BackendType
+	Op      string
+	N       int           // operations run
+	T       time.Duration // time they took
+	Allocs  uint64        // heap allocations they made
+	Bytes   uint64        // bytes they allocated
+}
+
+// NsPerOp returns the time an operation took on average.
+func (r MemtableResult) NsPerOp() int64 {
+	if r.N == 0 {
+		return 0
+	}
+	return r.T.Nanoseconds() / int64(r.N)
+}
+
+// OpsPerSec returns the throughput of the operation.
+func (r MemtableResult) OpsPerSec() float64 {
+	if r.T == 0 {
+		return 0
+	}
+	return float64(r.N) / r.T.Seconds()
+}
+
+// AllocsPerOp returns the heap allocations an operation made on average.
+func (r MemtableResult) AllocsPerOp() uint64 {
+	if r.N == 0 {
+		return 0
+	}
+	return r.Allocs / uint64(r.N)
+}
+
+// AllocedBytesPerOp returns the bytes an operation allocated on average.
+func (r MemtableResult) AllocedBytesPerOp() uint64 {
+	if r.N == 0 {
+		return 0
+	}
+	return r.Bytes / uint64(r.N)
+}
+
+// MemtableOp is an operation (one of MemtableOps) a memtable backend is benchmarked on, set up
+// by NewMemtableOp: an insert, a get of an existing key, a scan of MemtableConfig.ScanLength
+// entries from an existing key, or the flush of a full memtable into a table. The Go
+// benchmarks of package memtable and RunMemtable both time its Run.
+type MemtableOp struct {
+	run func(i int) error
+	// after, if set, cleans up after the ith run, outside of the time measured
+	after func(i int) error
+}
+
+// Run runs the operation for the ith time. Runs are numbered from 0, one after the other.
+func (o *MemtableOp) Run(i int) error {
+	return o.run(i)
+}
+
+// After cleans up after the ith run, e.g. deletes the table a flush wrote. It isn't part of the
+// operation, and should be left out of the time measured.
+func (o *MemtableOp) After(i int) error {
+	if o.after == nil {
+		return nil
+	}
+	return o.after(i)
+}
+
+// HasAfter reports whether After has anything to do, so that timers aren't stopped for nothing.
+func (o *MemtableOp) HasAfter() bool {
+	return o.after != nil
+}
+
+// NewMemtableOp sets up the benchmark of op (one of MemtableOps) on backend: the memtable gets,
+// scans and flushes run on is filled here, rather than in the time measured.
+func NewMemtableOp(backend memtable.BackendType, op string, cfg MemtableConfig) (*MemtableOp, error) {
+	cfg.ensureDefaults()
+	keys := memtableKeys(cfg)
+	val := make([]byte, cfg.ValueSize)
+	rand.New(rand.NewSource(cfg.Seed)).Read(val)
+	// reads go through the keys in random order even if they were inserted in order
+	readKeys := append([][]byte(nil), keys...)
+	rand.New(rand.NewSource(cfg.Seed+1)).Shuffle(len(readKeys), func(i, j int) {
+		readKeys[i], readKeys[j] = readKeys[j], readKeys[i]
+	})
+
+	switch op {
+	case "insert":
+		var m *memtable.Memtable
+		return &MemtableOp{run: func(i int) error {
+			if i%len(keys) == 0 {
+				m = newMemtable(backend)
+			}
+			m.Insert(uint64(i+1), 0, keys[i%len(keys)], val)
+			return nil
+		}}, nil
+	case "get":
+		m := fillMemtable(backend, keys, val)
+		return &MemtableOp{run: func(i int) error {
+			if _, ok := m.Get(readKeys[i%len(readKeys)]); !ok {
+				return fmt.Errorf("bench: %s not found", readKeys[i%len(readKeys)])
+			}
+			return nil
+		}}, nil
+	case "scan":
+		m := fillMemtable(backend, keys, val)
+		return &MemtableOp{run: func(i int) error {
+			iter := m.Iterator(readKeys[i%len(readKeys)], nil)
+			for n := 0; n < cfg.ScanLength && iter.HasNext(); n++ {
+				iter.Next()
+			}
+			return nil
+		}}, nil
+	case "flush":
+		fs, dir := storage.Default, cfg.Dir
+		if dir == "" {
+			fs, dir = storage.NewMemFS(), "/"
+		}
+		m := fillMemtable(backend, keys, val)
+		name := filepath.Join(dir, fmt.Sprintf("bench-memtable-%s.sst", backend))
+		return &MemtableOp{
+			run:   func(int) error { return flushMemtable(fs, name, m) },
+			after: func(int) error { return fs.Remove(name) },
+		}, nil
+	}
+	return nil, fmt.Errorf("bench: unknown memtable operation %q", op)
+}
+
+// memtableBenchTime is the time RunMemtable runs an operation for, as go test -bench does.
+const memtableBenchTime = time.Second
+
+// RunMemtable runs the benchmark of every operation on every backend of cfg, for about a
+// second each, as go test -bench does.
+func RunMemtable(cfg MemtableConfig) ([]MemtableResult, error) {
+	cfg.ensureDefaults()
+	var results []MemtableResult
+	for _, op := range MemtableOps {
+		for _, backend := range cfg.Backends {
+			o, err := NewMemtableOp(backend, op, cfg)
+			if err != nil {
+				return nil, err
+			}
+			res, err := runMemtableOp(o)
+			if err != nil {
+				return results, fmt.Errorf("bench: %s on %s: %w", op, backend, err)
+			}
+			res.Backend, res.Op = backend, op
+			results = append(results, res)
+		}
+	}
+	return results, nil
+}
+
+// runMemtableOp runs o more and more times, as go test -bench does, until a round of runs takes
+// memtableBenchTime, and returns the measures of that round.
+func runMemtableOp(o *MemtableOp) (MemtableResult, error) {
+	n := 1
+	for {
+		res, err := timeMemtableOp(o, n)
+		if err != nil || res.T >= memtableBenchTime || n >= 1e9 {
+			return res, err
+		}
+		// aim for memtableBenchTime with some margin, growing at least a bit and at most 100x
+		next := int(1.2 * float64(memtableBenchTime) / float64(max(res.T, 1)) * float64(n))
+		n = min(max(next, n+1), 100*n, 1e9)
+	}
+}
+
+// timeMemtableOp runs o n times, and measures the time and the allocations of the runs, the
+// cleanups after them left out.
+func timeMemtableOp(o *MemtableOp, n int) (MemtableResult, error) {
+	res := MemtableResult{N: n}
+	var ms runtime.MemStats
+	start := func() time.Time {
+		runtime.ReadMemStats(&ms)
+		res.Allocs -= ms.Mallocs
+		res.Bytes -= ms.TotalAlloc
+		return time.Now()
+	}
+	stop := func(since time.Time) {
+		res.T += time.Since(since)
+		runtime.ReadMemStats(&ms)
+		res.Allocs += ms.Mallocs
+		res.Bytes += ms.TotalAlloc
+	}
+	runtime.GC()
+	began := start()
+	for i := 0; i < n; i++ {
+		if err := o.Run(i); err != nil {
+			return res, err
+		}
+		if o.HasAfter() {
+			stop(began)
+			if err := o.After(i); err != nil {
+				return res, err
+			}
+			began = start()
+		}
+	}
+	stop(began)
+	return res, nil
+}
+
+// PrintMemtable writes the results of RunMemtable to w as a table.
+func PrintMemtable(w io.Writer, results []MemtableResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "operation\tbackend\truns\tns/op\tops/s\tallocs/op\tB/op\t")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%v\t%.0f\t%d\t%d\t\n", r.Op, r.Backend, r.N,
+			round(time.Duration(r.NsPerOp())), r.OpsPerSec(), r.AllocsPerOp(), r.AllocedBytesPerOp())
+	}
+	tw.Flush()
+}
+
+// memtableKeys returns cfg.Entries distinct keys, in the order they are inserted.
+func memtableKeys(cfg MemtableConfig) [][]byte {
+	keys := make([][]byte, cfg.Entries)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("user%0*d", max(cfg.KeySize-4, 0), i))
+	}
+	if !cfg.Sequential {
+		rand.New(rand.NewSource(cfg.Seed)).Shuffle(len(keys), func(i, j int) {
+			keys[i], keys[j] = keys[j], keys[i]
+		})
+	}
+	return keys
+}
+
+func newMemtable(backend memtable.BackendType) *memtable.Memtable {
+	// the size limit only matters to HasRoomForWrite, which the benchmarks don't call
+	return memtable.NewMemtable(1<<62, nil, comparer.Default.Compare, backend)
+}
+
+func fillMemtable(backend memtable.BackendType, keys [][]byte, val []byte) *memtable.Memtable {
+	m := newMemtable(backend)
+	for i, key := range keys {
+		m.Insert(uint64(i+1), 0, key, val)
+	}
+	return m
+}
+
+// flushMemtable writes m to the table name and syncs it, as the DB flushes a memtable.
+func flushMemtable(fs storage.VFS, name string, m *memtable.Memtable) error {
+	f, err := fs.Create(name)
+	if err != nil {
+		return err
+	}
+	w := sstable.NewWriter(f, sstable.Options{})
+	if err := w.ConvertMemtableToSST(m); err != nil {
+		f.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,66 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+// summarize computes the stats of the latencies of an operation.
+func summarize(name string, latencies []time.Duration, misses int) OpStats {
+	slices.Sort(latencies)
+	var sum time.Duration
+	for _, l := range latencies {
+		sum += l
+	}
+	quantile := func(q float64) time.Duration {
+		return latencies[int(q*float64(len(latencies)-1))]
+	}
+	return OpStats{
+		Name:   name,
+		Count:  len(latencies),
+		Misses: misses,
+		Mean:   sum / time.Duration(len(latencies)),
+		P50:    quantile(0.5),
+		P95:    quantile(0.95),
+		P99:    quantile(0.99),
+		P999:   quantile(0.999),
+		Max:    latencies[len(latencies)-1],
+	}
+}
+
+// Print writes the report to w as tables, one per phase.
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "Workload %s, %s distribution\n", r.Workload, r.Distribution)
+	if r.Load.Operations > 0 {
+		r.Load.print(w, "Load")
+	}
+	r.Run.print(w, "Run")
+}
+
+func (p Phase) print(w io.Writer, name string) {
+	fmt.Fprintf(w, "\n%s: %d operations in %v, %.0f ops/s\n", name, p.Operations,
+		p.Duration.Round(time.Millisecond), p.Throughput())
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "operation\tcount\tmisses\tmean\tp50\tp95\tp99\tp99.9\tmax\t")
+	for _, s := range p.Stats {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%v\t%v\t%v\t%v\t%v\t%v\t\n", s.Name, s.Count, s.Misses,
+			round(s.Mean), round(s.P50), round(s.P95), round(s.P99), round(s.P999), round(s.Max))
+	}
+	tw.Flush()
+}
+
+// round keeps three significant digits or so of a latency.
+func round(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(time.Microsecond)
+	case d >= time.Microsecond:
+		return d.Round(100 * time.Nanosecond)
+	}
+	return d
+}
@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// identifies a block: the file it belongs to and its offset within that file
+type key struct {
+	fileNum int
+	offset  uint64
+}
+
+type entry struct {
+	key key
+	val []byte
+}
+
+// Cache is an LRU cache of blocks with a fixed capacity in bytes. It is safe for concurrent use,
+// so a single cache can be shared by all the readers of a DB. Cached blocks must not be modified.
+type Cache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64                 // total size of all cached blocks
+	ll       *list.List            // most recently used blocks at the front
+	items    map[key]*list.Element // block -> its element in ll
+	hits     int64
+	misses   int64
+}
+
+func New(capacity int64) *Cache {
+	return &Cache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[key]*list.Element),
+	}
+}
+
+// Get returns the cached block at offset of the given file and marks it as recently used.
+func (c *Cache) Get(fileNum int, offset uint64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key{fileNum, offset}]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.ll.MoveToFront(e)
+	return e.Value.(*entry).val, true
+}
+
+// Set adds a block to the cache, evicting the least recently used blocks until it fits.
+// Blocks larger than the whole cache are not cached.
+func (c *Cache) Set(fileNum int, offset uint64, block []byte) {
+	size := int64(len(block))
+	if size > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := key{fileNum, offset}
+	if e, ok := c.items[k]; ok {
+		c.size += size - int64(len(e.Value.(*entry).val))
+		e.Value.(*entry).val = block
+		c.ll.MoveToFront(e)
+	} else {
+		c.items[k] = c.ll.PushFront(&entry{key: k, val: block})
+		c.size += size
+	}
+	for c.size > c.capacity {
+		c.remove(c.ll.Back())
+	}
+}
+
+// EvictFile drops all cached blocks of a file, e.g. once the file has been deleted.
+func (c *Cache) EvictFile(fileNum int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.ll.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*entry).key.fileNum == fileNum {
+			c.remove(e)
+		}
+		e = next
+	}
+}
+
+// Size returns the total size of all cached blocks (in bytes).
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Stats returns the number of lookups that found their block in the cache and that didn't.
+func (c *Cache) Stats() (hits, misses int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+func (c *Cache) remove(e *list.Element) {
+	ent := c.ll.Remove(e).(*entry)
+	delete(c.items, ent.key)
+	c.size -= int64(len(ent.val))
+}
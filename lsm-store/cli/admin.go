@@ -0,0 +1,119 @@
+package cli
+
+import (
+	"fmt"
+	"lsm/db"
+	"time"
+)
+
+func (c *CLI) processStatsCommand() {
+	PrintStats(c.db)
+}
+
+// PrintStats prints the metrics and stats of d: bytes written, flushes, compactions, levels,
+// block cache, write stalls and latency percentiles.
+func PrintStats(d *db.DB) {
+	m := d.Metrics()
+	s := d.Stats()
+	fmt.Printf("Writes:      %s by the user, %s to the WAL, %s to the value log (write amp. %.2f)\n",
+		formatBytes(m.UserBytesWritten), formatBytes(m.WALBytesWritten), formatBytes(m.ValueLogBytesWritten), m.WriteAmplification)
+	fmt.Printf("Flushes:     %d, %s written\n", m.Flushes, formatBytes(m.FlushBytesWritten))
+	fmt.Printf("Compactions: %d, %s read, %s written (throttled for %v)\n",
+		m.Compactions, formatBytes(m.CompactionBytesRead), formatBytes(m.CompactionBytesWritten), m.BackgroundThrottle.Round(time.Millisecond))
+	fmt.Printf("Memtables:   %d, %s\n", m.Memtables, formatBytes(m.MemtableSize))
+	fmt.Printf("Block cache: %s, %.1f%% hits (%d/%d)\n",
+		formatBytes(m.BlockCacheSize), 100*m.BlockCacheHitRate(), m.BlockCacheHits, m.BlockCacheHits+m.BlockCacheMisses)
+	fmt.Printf("Write stall: %v", s.WriteStall)
+	if s.WriteStallCause != "" {
+		fmt.Printf(" (%s)", s.WriteStallCause)
+	}
+	fmt.Printf(", %d writes slowed, %d stopped, %v stalled\n", s.SlowedWrites, s.StoppedWrites, s.StallDuration.Round(time.Millisecond))
+	fmt.Printf("Seq. number: %d, read amp. %d\n", s.SeqNum, m.ReadAmplification)
+
+	fmt.Println("\nLevel  Files        Size")
+	for level, l := range m.Levels {
+		fmt.Printf("L%d    %6d  %10s\n", level, l.NumFiles, formatBytes(l.Size))
+	}
+
+	fmt.Println("\nOperation       Count        Mean         p50         p99")
+	for _, op := range []struct {
+		name string
+		h    db.Histogram
+	}{
+		{"GET", m.GetLatency},
+		{"SET", m.SetLatency},
+		{"DEL", m.DeleteLatency},
+		{"DELRANGE", m.DeleteRangeLatency},
+	} {
+		fmt.Printf("%-10s %10d  %10v  %10s  %10s\n", op.name, op.h.Count, op.h.Mean().Round(time.Microsecond),
+			formatQuantile(op.h, 0.5), formatQuantile(op.h, 0.99))
+	}
+}
+
+func (c *CLI) processFlushCommand() {
+	if err := c.db.Flush(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("OK.")
+}
+
+func (c *CLI) processCompactCommand(args []string) {
+	var start, end []byte
+	switch len(args) {
+	case 0:
+	case 2:
+		start, end = []byte(args[0]), []byte(args[1])
+	default:
+		fmt.Println("Usage: COMPACT [start end]")
+		return
+	}
+	if err := c.db.CompactRange(start, end); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("OK.")
+}
+
+func (c *CLI) processFilesCommand() {
+	files, err := c.db.LiveFiles()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	var total int64
+	for _, f := range files {
+		fmt.Printf("%06d.%-4s %10s", f.FileNum, f.Kind, formatBytes(f.Size))
+		if f.Kind == db.FileKindSSTable {
+			fmt.Printf("  %s L%d  %d entries  [%q, %q]", f.ColumnFamily, f.Level, f.NumEntries, f.SmallestKey, f.LargestKey)
+		}
+		fmt.Println()
+		total += f.Size
+	}
+	fmt.Printf("%d files, %s\n", len(files), formatBytes(total))
+}
+
+// formatQuantile prints the upper bound of the q-quantile of h, which is open-ended for the
+// slowest operations.
+func formatQuantile(h db.Histogram, q float64) string {
+	if h.Count == 0 {
+		return "-"
+	}
+	if d := h.Quantile(q); d < h.Buckets[len(h.Buckets)-1].UpperBound {
+		return "<" + d.String()
+	}
+	return ">" + h.Buckets[len(h.Buckets)-2].UpperBound.String()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
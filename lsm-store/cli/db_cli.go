@@ -1,7 +1,7 @@
 package cli
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"lsm/db"
 	"os"
@@ -9,46 +9,55 @@ import (
 )
 
 type CLI struct {
-	scanner *bufio.Scanner
-	db      *db.DB
+	*session
+	db *db.DB
 }
 
-func NewCLI(s *bufio.Scanner, b *db.DB) *CLI {
-	return &CLI{s, b}
+// NewCLI returns a CLI reading commands from in, with line editing if it is a terminal.
+func NewCLI(in *os.File, b *db.DB) *CLI {
+	commands := []string{"SET", "DEL", "UNDEL", "DELRANGE", "GET", "SCAN", "IMPORT", "EXPORT", "STATS", "FLUSH", "COMPACT", "FILES", "EXIT"}
+	return &CLI{newSession(in, commands), b}
 }
 
+// Start runs the session until EXIT, Ctrl-C or Ctrl-D. Closing the DB is up to the caller.
 func (c *CLI) Start() {
 	c.printHelp()
-	c.printPrompt()
-	for {
-		if c.scanner.Scan() {
-			c.processInput(c.scanner.Text())
-		}
-	}
+	c.run(c.processInput)
 }
 
 func (c *CLI) printHelp() {
-	fmt.Println(`
+	fmt.Print(`
 DB CLI
 
-Available Commands:
+Available Commands (Tab completes them, and the keys used recently):
   SET <key> <val> Insert a key-value pair into the DB
   DEL <key>       Remove a key-value pair from the DB
-  GET <key>       Retrieve the value for key from the DB
-  EXIT            Terminate this session
-`)
-}
+  UNDEL <key>     Restore a key removed by DEL (if the DB keeps deleted values, UndeleteWindow)
+  DELRANGE <start> <end>
+                  Remove all keys in [start, end) from the DB
+  GET [--hex] <key>
+                  Retrieve the value for key from the DB
+  SCAN [--hex] [prefix]
+                  List all key-value pairs (starting with prefix) in key order
+  IMPORT <file> [csv|jsonl]
+                  Bulk load the key-value pairs of file (format after its extension by default)
+  EXPORT <file> [csv|jsonl]
+                  Write all key-value pairs to the new file (format after its extension by default)
+  STATS           Print the metrics of the DB
+  FLUSH           Flush the memtables to SSTables
+  COMPACT [start end]
+                  Compact all keys (in [start, end]) down to the bottom level
+  FILES           List the live SSTables, WALs and value log files
+  EXIT            Terminate this session (or Ctrl-C, Ctrl-D)
 
-func (c *CLI) printPrompt() {
-	fmt.Print("> ")
-}
+Keys and values with spaces go in double quotes, and \xNN enters the byte NN (\" and \\
+a double quote and a backslash). --hex prints every byte as \xNN, to be entered as is.
 
-func (c *CLI) processInput(line string) {
-	fields := strings.Fields(line)
+`)
+}
 
-	if len(fields) < 1 {
-		return
-	}
+// processInput runs a command, and reports whether the session goes on.
+func (c *CLI) processInput(fields []string) bool {
 	command := strings.ToLower(fields[0])
 
 	switch command {
@@ -58,12 +67,30 @@ func (c *CLI) processInput(line string) {
 		c.processSetCommand(fields[1:])
 	case "del":
 		c.processDeleteCommand(fields[1:])
+	case "undel":
+		c.processUndeleteCommand(fields[1:])
+	case "delrange":
+		c.processDeleteRangeCommand(fields[1:])
 	case "get":
 		c.processGetCommand(fields[1:])
+	case "scan":
+		c.processScanCommand(fields[1:])
+	case "import":
+		c.processImportCommand(fields[1:])
+	case "export":
+		c.processExportCommand(fields[1:])
+	case "stats":
+		c.processStatsCommand()
+	case "flush":
+		c.processFlushCommand()
+	case "compact":
+		c.processCompactCommand(fields[1:])
+	case "files":
+		c.processFilesCommand()
 	case "exit":
-		os.Exit(0)
+		return false
 	}
-	c.printPrompt()
+	return true
 }
 
 func (c *CLI) processSetCommand(args []string) {
@@ -71,7 +98,11 @@ func (c *CLI) processSetCommand(args []string) {
 		fmt.Println("Usage: SET <key> <value>")
 		return
 	}
-	c.db.Set([]byte(args[0]), []byte(args[1]))
+	c.rememberKey(args[0])
+	if err := c.db.Set([]byte(args[0]), []byte(args[1]), nil); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
 	fmt.Println("OK.")
 }
 
@@ -80,20 +111,123 @@ func (c *CLI) processDeleteCommand(args []string) {
 		fmt.Println("Usage: DEL <key>")
 		return
 	}
-	c.db.Delete([]byte(args[0]))
+	c.rememberKey(args[0])
+	if err := c.db.Delete([]byte(args[0]), nil); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("OK.")
+}
+
+func (c *CLI) processUndeleteCommand(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: UNDEL <key>")
+		return
+	}
+	c.rememberKey(args[0])
+	if err := c.db.Undelete([]byte(args[0]), nil); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("OK.")
+}
+
+func (c *CLI) processDeleteRangeCommand(args []string) {
+	if len(args) != 2 {
+		fmt.Println("Usage: DELRANGE <start> <end>")
+		return
+	}
+	c.rememberKey(args[0])
+	c.rememberKey(args[1])
+	if err := c.db.DeleteRange([]byte(args[0]), []byte(args[1]), nil); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
 	fmt.Println("OK.")
 }
 
 func (c *CLI) processGetCommand(args []string) {
+	args, hex := hexFlag(args)
 	if len(args) != 1 {
-		fmt.Println("Usage: GET <key>")
+		fmt.Println("Usage: GET [--hex] <key>")
 		return
 	}
+	c.rememberKey(args[0])
 	val, err := c.db.Get([]byte(args[0]))
 
-	if err != nil {
+	if errors.Is(err, db.ErrKeyNotFound) {
 		fmt.Println("Key not found.")
 		return
 	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if hex {
+		fmt.Println(formatHex(val))
+		return
+	}
 	fmt.Println(string(val))
 }
+
+func (c *CLI) processScanCommand(args []string) {
+	args, hex := hexFlag(args)
+	if len(args) > 1 {
+		fmt.Println("Usage: SCAN [--hex] [prefix]")
+		return
+	}
+	var prefix []byte
+	if len(args) == 1 {
+		prefix = []byte(args[0])
+	}
+	iter, err := c.db.ScanPrefix(prefix)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer iter.Close()
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if hex {
+			fmt.Printf("%s %s\n", formatHex(iter.Key()), formatHex(iter.Value()))
+			continue
+		}
+		fmt.Printf("%s %s\n", iter.Key(), iter.Value())
+	}
+	if err = iter.Error(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+}
+
+func (c *CLI) processImportCommand(args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Println("Usage: IMPORT <file> [csv|jsonl]")
+		return
+	}
+	n, err := ImportFile(c.db, args[0], formatArg(args))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("Imported %d records.\n", n)
+}
+
+func (c *CLI) processExportCommand(args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Println("Usage: EXPORT <file> [csv|jsonl]")
+		return
+	}
+	n, err := ExportFile(c.db, args[0], formatArg(args))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("Exported %d records.\n", n)
+}
+
+// formatArg returns the format given after the file name, or the one of its extension.
+func formatArg(args []string) string {
+	if len(args) == 2 {
+		return strings.ToLower(args[1])
+	}
+	return FormatOf(args[0])
+}
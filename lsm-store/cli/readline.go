@@ -0,0 +1,380 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrInterrupted is returned by LineReader.ReadLine when Ctrl-C is pressed.
+var ErrInterrupted = errors.New("interrupted")
+
+const maxHistory = 1000
+
+// Completer returns the candidates completing the word at the end of line (which may be
+// empty), head being the start of the line up to that word.
+type Completer func(head, word string) []string
+
+/*
+LineReader reads lines from a terminal with a line editor in the spirit of readline:
+
+	Left/Right, Ctrl-B/Ctrl-F   move the cursor     Home/End, Ctrl-A/Ctrl-E   to the start/end
+	Up/Down, Ctrl-P/Ctrl-N      browse the history  Ctrl-R                    search the history
+	Backspace, Delete           delete a character  Ctrl-W                    delete a word
+	Ctrl-U/Ctrl-K               delete to the start/end of the line
+	Tab                         complete the word before the cursor, or list the candidates
+	Ctrl-L                      clear the screen    Ctrl-C/Ctrl-D             end the session
+
+If the input isn't a terminal, e.g. a pipe, lines are read as they are.
+*/
+type LineReader struct {
+	in        *os.File
+	r         *bufio.Reader
+	out       io.Writer
+	history   []string
+	completer Completer
+}
+
+func NewLineReader(in *os.File, out io.Writer) *LineReader {
+	return &LineReader{in: in, r: bufio.NewReader(in), out: out}
+}
+
+// SetCompleter sets the function completing words on Tab.
+func (l *LineReader) SetCompleter(c Completer) {
+	l.completer = c
+}
+
+// AddHistory appends line to the history, unless it is blank or repeats the last one.
+func (l *LineReader) AddHistory(line string) {
+	if strings.TrimSpace(line) == "" || (len(l.history) > 0 && l.history[len(l.history)-1] == line) {
+		return
+	}
+	if len(l.history) == maxHistory {
+		l.history = slices.Delete(l.history, 0, 1)
+	}
+	l.history = append(l.history, line)
+}
+
+// ReadLine prints prompt and returns the line entered, without its line break. It returns
+// io.EOF on Ctrl-D on an empty line (or at the end of the input), and ErrInterrupted on
+// Ctrl-C.
+func (l *LineReader) ReadLine(prompt string) (string, error) {
+	fmt.Fprint(l.out, prompt)
+	restore, err := makeRaw(l.in)
+	if err != nil {
+		// not a terminal
+		line, err := l.r.ReadString('\n')
+		if err != nil && (line == "" || !errors.Is(err, io.EOF)) {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	defer restore()
+	e := &editor{l: l, prompt: prompt, histPos: len(l.history)}
+	line, err := e.run()
+	fmt.Fprint(l.out, "\r\n")
+	return line, err
+}
+
+// editor is the state of the line being edited.
+type editor struct {
+	l       *LineReader
+	prompt  string
+	buf     []rune
+	pos     int // of the cursor in buf
+	histPos int // of the history entry shown, len(history) for the line being entered
+	saved   []rune
+	tabbed  bool // whether the previous key was a Tab
+}
+
+const (
+	keyCtrlA     = 1
+	keyCtrlB     = 2
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyCtrlF     = 6
+	keyCtrlG     = 7
+	keyCtrlH     = 8
+	keyTab       = 9
+	keyLF        = 10
+	keyCtrlK     = 11
+	keyCtrlL     = 12
+	keyCR        = 13
+	keyCtrlN     = 14
+	keyCtrlP     = 16
+	keyCtrlR     = 18
+	keyCtrlU     = 21
+	keyCtrlW     = 23
+	keyEsc       = 27
+	keyBackspace = 127
+
+	// escape sequences, mapped out of the range of runes
+	keyUp = unicode.MaxRune + 1 + iota
+	keyDown
+	keyLeft
+	keyRight
+	keyHome
+	keyEnd
+	keyDelete
+	keyUnknown
+)
+
+func (e *editor) run() (string, error) {
+	e.refresh()
+	for {
+		key, err := e.readKey()
+		if err != nil {
+			return "", err
+		}
+		tabbed := key == keyTab
+		done, err := e.handle(key)
+		e.tabbed = tabbed
+		if done || err != nil {
+			return string(e.buf), err
+		}
+	}
+}
+
+// handle applies a key, and reports whether the line is complete.
+func (e *editor) handle(key rune) (bool, error) {
+	switch key {
+	case keyCR, keyLF:
+		return true, nil
+	case keyCtrlC:
+		return false, ErrInterrupted
+	case keyCtrlD:
+		if len(e.buf) == 0 {
+			return false, io.EOF
+		}
+		e.delete()
+	case keyCtrlA, keyHome:
+		e.pos = 0
+	case keyCtrlE, keyEnd:
+		e.pos = len(e.buf)
+	case keyCtrlB, keyLeft:
+		e.pos = max(e.pos-1, 0)
+	case keyCtrlF, keyRight:
+		e.pos = min(e.pos+1, len(e.buf))
+	case keyCtrlP, keyUp:
+		e.browse(-1)
+	case keyCtrlN, keyDown:
+		e.browse(1)
+	case keyBackspace, keyCtrlH:
+		if e.pos > 0 {
+			e.pos--
+			e.delete()
+		}
+	case keyDelete:
+		e.delete()
+	case keyCtrlK:
+		e.buf = e.buf[:e.pos]
+	case keyCtrlU:
+		e.buf = slices.Delete(e.buf, 0, e.pos)
+		e.pos = 0
+	case keyCtrlW:
+		start := e.pos
+		for start > 0 && e.buf[start-1] == ' ' {
+			start--
+		}
+		for start > 0 && e.buf[start-1] != ' ' {
+			start--
+		}
+		e.buf = slices.Delete(e.buf, start, e.pos)
+		e.pos = start
+	case keyCtrlL:
+		fmt.Fprint(e.l.out, "\x1b[H\x1b[2J")
+	case keyTab:
+		e.complete()
+	case keyCtrlR:
+		return e.search()
+	default:
+		if key < ' ' || key > unicode.MaxRune {
+			return false, nil // unbound
+		}
+		e.insert(key)
+	}
+	e.refresh()
+	return false, nil
+}
+
+func (e *editor) insert(runes ...rune) {
+	e.buf = slices.Insert(e.buf, e.pos, runes...)
+	e.pos += len(runes)
+}
+
+// delete deletes the character under the cursor.
+func (e *editor) delete() {
+	if e.pos < len(e.buf) {
+		e.buf = slices.Delete(e.buf, e.pos, e.pos+1)
+	}
+}
+
+// browse moves through the history by delta entries, keeping the line being entered aside.
+func (e *editor) browse(delta int) {
+	n := e.histPos + delta
+	if n < 0 || n > len(e.l.history) {
+		return
+	}
+	if e.histPos == len(e.l.history) {
+		e.saved = slices.Clone(e.buf)
+	}
+	e.histPos = n
+	if n == len(e.l.history) {
+		e.buf = e.saved
+	} else {
+		e.buf = []rune(e.l.history[n])
+	}
+	e.pos = len(e.buf)
+}
+
+// complete completes the word before the cursor as far as all candidates agree, and lists
+// them on a second Tab in a row.
+func (e *editor) complete() {
+	if e.l.completer == nil {
+		return
+	}
+	start := e.pos
+	for start > 0 && e.buf[start-1] != ' ' {
+		start--
+	}
+	word := string(e.buf[start:e.pos])
+	candidates := e.l.completer(string(e.buf[:start]), word)
+	if len(candidates) == 0 {
+		return
+	}
+	if len(candidates) == 1 {
+		e.insert([]rune(candidates[0][len(word):] + " ")...)
+		return
+	}
+	prefix := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	for !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
+	}
+	if len(prefix) > len(word) {
+		e.insert([]rune(prefix[len(word):])...)
+		return
+	}
+	if e.tabbed {
+		fmt.Fprintf(e.l.out, "\r\n%s\r\n", strings.Join(candidates, "  "))
+	}
+}
+
+// search runs a reverse incremental search of the history (Ctrl-R): typing narrows it down,
+// Ctrl-R looks for an older match, Enter runs the match, Ctrl-G or Esc gives up, and any other
+// key goes back to editing the match.
+func (e *editor) search() (bool, error) {
+	var query []rune
+	match := e.histPos
+	found := ""
+	find := func(from int) {
+		for i := min(from, len(e.l.history)-1); i >= 0; i-- {
+			if strings.Contains(e.l.history[i], string(query)) {
+				match, found = i, e.l.history[i]
+				return
+			}
+		}
+	}
+	for {
+		fmt.Fprintf(e.l.out, "\r\x1b[K(reverse-i-search)`%s': %s", string(query), found)
+		key, err := e.readKey()
+		if err != nil {
+			return false, err
+		}
+		switch key {
+		case keyCtrlR:
+			find(match - 1)
+		case keyBackspace, keyCtrlH:
+			if len(query) > 0 {
+				query = query[:len(query)-1]
+				find(len(e.l.history) - 1)
+			}
+		case keyCtrlG, keyEsc:
+			e.refresh()
+			return false, nil
+		case keyCtrlC:
+			return false, ErrInterrupted
+		default:
+			if key >= ' ' && key <= unicode.MaxRune {
+				query = append(query, key)
+				find(match)
+				continue
+			}
+			if found != "" {
+				e.buf, e.pos, e.histPos = []rune(found), len([]rune(found)), match
+			}
+			if key == keyCR || key == keyLF {
+				e.refresh()
+				return true, nil
+			}
+			return e.handle(key)
+		}
+	}
+}
+
+// refresh redraws the line and puts the cursor back in place.
+func (e *editor) refresh() {
+	fmt.Fprintf(e.l.out, "\r\x1b[K%s%s", e.prompt, string(e.buf))
+	if n := len(e.buf) - e.pos; n > 0 {
+		fmt.Fprintf(e.l.out, "\x1b[%dD", n)
+	}
+}
+
+// readKey reads a key, decoding the escape sequences of the cursor and editing keys.
+func (e *editor) readKey() (rune, error) {
+	r, _, err := e.l.r.ReadRune()
+	if err != nil || r != keyEsc {
+		return r, err
+	}
+	// a lone Esc isn't followed by anything already buffered
+	if e.l.r.Buffered() == 0 {
+		return keyEsc, nil
+	}
+	b, err := e.l.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != '[' && b != 'O' {
+		return keyUnknown, nil
+	}
+	var seq []byte
+	for {
+		c, err := e.l.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		seq = append(seq, c)
+		// parameters are digits and semicolons, the final byte is anything else
+		if (c < '0' || c > '9') && c != ';' {
+			break
+		}
+	}
+	switch string(seq) {
+	case "A":
+		return keyUp, nil
+	case "B":
+		return keyDown, nil
+	case "C":
+		return keyRight, nil
+	case "D":
+		return keyLeft, nil
+	case "H", "1~", "7~":
+		return keyHome, nil
+	case "F", "4~", "8~":
+		return keyEnd, nil
+	case "3~":
+		return keyDelete, nil
+	}
+	return keyUnknown, nil
+}
@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+const maxRecentKeys = 100
+
+// session is the read-eval loop shared by the CLIs. Tab completes the commands, then the keys
+// used recently.
+type session struct {
+	lr       *LineReader
+	commands []string
+	keys     []string // recently used, the most recent last
+}
+
+func newSession(in *os.File, commands []string) *session {
+	s := &session{lr: NewLineReader(in, os.Stdout), commands: commands}
+	s.lr.SetCompleter(s.complete)
+	return s
+}
+
+// run hands the fields of every line read to process until it returns false (on EXIT), or the
+// session is ended with Ctrl-C, Ctrl-D or the end of the input.
+func (s *session) run(process func(fields []string) bool) {
+	for {
+		line, err := s.lr.ReadLine("> ")
+		if errors.Is(err, io.EOF) || errors.Is(err, ErrInterrupted) {
+			return
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		s.lr.AddHistory(line)
+		fields, err := tokenize(line)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			continue
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		if !process(fields) {
+			return
+		}
+	}
+}
+
+// rememberKey adds key to the keys completed.
+func (s *session) rememberKey(key string) {
+	if i := slices.Index(s.keys, key); i >= 0 {
+		s.keys = slices.Delete(s.keys, i, i+1)
+	} else if len(s.keys) == maxRecentKeys {
+		s.keys = slices.Delete(s.keys, 0, 1)
+	}
+	s.keys = append(s.keys, key)
+}
+
+// complete completes the first word with the commands, in the case it is typed in, and the
+// following ones with the recent keys.
+func (s *session) complete(head, word string) []string {
+	var candidates []string
+	if strings.TrimSpace(head) == "" {
+		lower := word != strings.ToUpper(word)
+		for _, c := range s.commands {
+			if lower {
+				c = strings.ToLower(c)
+			}
+			if strings.HasPrefix(c, word) {
+				candidates = append(candidates, c)
+			}
+		}
+		return candidates
+	}
+	for _, k := range s.keys {
+		if strings.HasPrefix(k, word) {
+			candidates = append(candidates, k)
+		}
+	}
+	slices.Sort(candidates)
+	return candidates
+}
@@ -1,7 +1,6 @@
 package cli
 
 import (
-	"bufio"
 	"fmt"
 	"lsm/skiplist"
 	"os"
@@ -9,46 +8,37 @@ import (
 )
 
 type SCLI struct {
-	scanner  *bufio.Scanner
+	*session
 	skipList *skiplist.SkipList
 }
 
-func NewSCLI(s *bufio.Scanner, sl *skiplist.SkipList) *SCLI {
-	return &SCLI{s, sl}
+// NewSCLI returns a CLI reading commands from in, with line editing if it is a terminal.
+func NewSCLI(in *os.File, sl *skiplist.SkipList) *SCLI {
+	return &SCLI{newSession(in, []string{"SET", "DEL", "GET", "STATS", "EXIT"}), sl}
 }
 
+// Start runs the session until EXIT, Ctrl-C or Ctrl-D.
 func (c *SCLI) Start() {
 	c.printHelp()
-	c.printPrompt()
-	for {
-		if c.scanner.Scan() {
-			c.processInput(c.scanner.Text())
-		}
-	}
+	c.run(c.processInput)
 }
 
 func (c *SCLI) printHelp() {
-	fmt.Println(`
+	fmt.Print(`
 SkipList CLI
 
-Available Commands:
+Available Commands (Tab completes them, and the keys used recently):
   SET <key> <val> Insert a key-value pair into the SkipList
   DEL <key>       Remove a key-value pair from the SkipList
   GET <key>       Retrieve the value for key from the SkipList
-  EXIT            Terminate this session
-`)
-}
+  STATS           Show the number of keys, memory and nodes per level of the SkipList
+  EXIT            Terminate this session (or Ctrl-C, Ctrl-D)
 
-func (c *SCLI) printPrompt() {
-	fmt.Print("> ")
+`)
 }
 
-func (c *SCLI) processInput(line string) {
-	fields := strings.Fields(line)
-
-	if len(fields) < 1 {
-		return
-	}
+// processInput runs a command, and reports whether the session goes on.
+func (c *SCLI) processInput(fields []string) bool {
 	command := strings.ToLower(fields[0])
 
 	switch command {
@@ -60,10 +50,12 @@ func (c *SCLI) processInput(line string) {
 		c.processDeleteCommand(fields[1:])
 	case "get":
 		c.processGetCommand(fields[1:])
+	case "stats":
+		c.processStatsCommand()
 	case "exit":
-		os.Exit(0)
+		return false
 	}
-	c.printPrompt()
+	return true
 }
 
 func (c *SCLI) processSetCommand(args []string) {
@@ -71,6 +63,7 @@ func (c *SCLI) processSetCommand(args []string) {
 		fmt.Println("Usage: SET <key> <value>")
 		return
 	}
+	c.rememberKey(args[0])
 	c.skipList.Insert([]byte(args[0]), []byte(args[1]))
 	fmt.Println(c.skipList)
 }
@@ -80,6 +73,7 @@ func (c *SCLI) processDeleteCommand(args []string) {
 		fmt.Println("Usage: DEL <key>")
 		return
 	}
+	c.rememberKey(args[0])
 	res := c.skipList.Delete([]byte(args[0]))
 
 	if !res {
@@ -94,6 +88,7 @@ func (c *SCLI) processGetCommand(args []string) {
 		fmt.Println("Usage: GET <key>")
 		return
 	}
+	c.rememberKey(args[0])
 	val, found := c.skipList.Get([]byte(args[0]))
 
 	if !found {
@@ -102,3 +97,13 @@ func (c *SCLI) processGetCommand(args []string) {
 	}
 	fmt.Println(string(val))
 }
+
+// processStatsCommand prints the nodes of every level next to the number expected with a
+// promotion probability of 1/2, for a look at how well the towers are distributed.
+func (c *SCLI) processStatsCommand() {
+	n := c.skipList.Len()
+	fmt.Printf("keys: %d, approx. bytes: %d\n", n, c.skipList.ApproxBytes())
+	for level, count := range c.skipList.LevelCounts() {
+		fmt.Printf("L%02d %6d nodes (expected %.1f)\n", level, count, float64(n)/float64(uint(1)<<level))
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package cli
+
+import (
+	"errors"
+	"os"
+)
+
+// makeRaw isn't supported: lines are read without editing.
+func makeRaw(f *os.File) (restore func(), err error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,74 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// tokenize splits line into fields on whitespace, as strings.Fields does, except within double
+// quotes, so that keys and values can hold spaces: SET "my key" "a value". Both in and out of
+// quotes, \xNN stands for the byte NN (so that binary data can be entered), \" for a double
+// quote and \\ for a backslash. Any other backslash is kept as is. "" is an empty field.
+func tokenize(line string) ([]string, error) {
+	var fields []string
+	var field []byte
+	inField, quoted := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && i+1 < len(line) && (line[i+1] == '\\' || line[i+1] == '"'):
+			field = append(field, line[i+1])
+			i++
+		case c == '\\' && strings.HasPrefix(line[i:], `\x`):
+			if i+4 > len(line) {
+				return nil, fmt.Errorf("incomplete escape %q", line[i:])
+			}
+			b, err := strconv.ParseUint(line[i+2:i+4], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid escape %q", line[i:i+4])
+			}
+			field = append(field, byte(b))
+			i += 3
+		case c == '"':
+			quoted = !quoted
+		case (c == ' ' || c == '\t') && !quoted:
+			if inField {
+				fields = append(fields, string(field))
+				field = field[:0]
+			}
+			inField = false
+			continue
+		default:
+			field = append(field, c)
+		}
+		inField = true
+	}
+	if quoted {
+		return nil, errors.New("unterminated quote")
+	}
+	if inField {
+		fields = append(fields, string(field))
+	}
+	return fields, nil
+}
+
+// hexFlag removes the --hex option from args, and reports whether it was there.
+func hexFlag(args []string) ([]string, bool) {
+	i := slices.Index(args, "--hex")
+	if i < 0 {
+		return args, false
+	}
+	return slices.Delete(slices.Clone(args), i, i+1), true
+}
+
+// formatHex escapes every byte of b as \xNN, the way tokenize reads it back.
+func formatHex(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		fmt.Fprintf(&sb, `\x%02x`, c)
+	}
+	return sb.String()
+}
@@ -0,0 +1,274 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"lsm/db"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+Files of kv-pairs come in two formats:
+
+  - csv: a key,value record per line, without a header. Quoting follows encoding/csv, and
+    bytes that aren't printable UTF-8 are escaped as \xNN, a backslash as \\.
+  - jsonl: a {"key": ..., "value": ...} object per line. As JSON strings can't hold invalid
+    UTF-8, such a key or value is written base64-encoded as "key_base64" or "value_base64"
+    instead.
+*/
+const (
+	FormatCSV   = "csv"
+	FormatJSONL = "jsonl"
+)
+
+// FormatOf returns the format of the file at path, after its extension: csv for *.csv,
+// jsonl otherwise.
+func FormatOf(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return FormatCSV
+	}
+	return FormatJSONL
+}
+
+// ImportFile bulk loads the kv-pairs of the file at path, in format, into d, and returns the
+// number of records read. Nothing is loaded if the file is malformed.
+func ImportFile(d *db.DB, path, format string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var src recordSource
+	switch format {
+	case FormatCSV:
+		r := csv.NewReader(bufio.NewReader(f))
+		r.FieldsPerRecord = 2
+		r.ReuseRecord = true
+		src = &csvSource{r: r}
+	case FormatJSONL:
+		src = &jsonlSource{d: json.NewDecoder(bufio.NewReader(f))}
+	default:
+		return 0, fmt.Errorf("unknown format %q", format)
+	}
+	err = d.BulkLoad(src, nil)
+	return src.count(), err
+}
+
+// ExportFile writes the kv-pairs of d to a new file at path, in format, and returns their
+// number.
+func ExportFile(d *db.DB, path, format string) (n int, err error) {
+	if format != FormatCSV && format != FormatJSONL {
+		return 0, fmt.Errorf("unknown format %q", format)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	iter, err := d.ScanPrefix(nil)
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+	w := bufio.NewWriter(f)
+	cw := csv.NewWriter(w)
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if format == FormatCSV {
+			err = cw.Write([]string{escape(iter.Key()), escape(iter.Value())})
+		} else {
+			err = writeJSONLRecord(w, iter.Key(), iter.Value())
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := iter.Error(); err != nil {
+		return n, err
+	}
+	if cw.Flush(); cw.Error() != nil {
+		return n, cw.Error()
+	}
+	return n, w.Flush()
+}
+
+// recordSource is a db.BulkSource over the records of a file.
+type recordSource interface {
+	db.BulkSource
+	count() int
+}
+
+type csvSource struct {
+	r        *csv.Reader
+	n        int
+	key, val []byte
+	err      error
+}
+
+func (s *csvSource) Next() bool {
+	if s.err != nil {
+		return false
+	}
+	record, err := s.r.Read()
+	if errors.Is(err, io.EOF) {
+		return false
+	}
+	if err == nil {
+		if s.key, err = unescape(record[0]); err == nil {
+			s.val, err = unescape(record[1])
+		}
+	}
+	if err != nil {
+		line, _ := s.r.FieldPos(0)
+		s.err = fmt.Errorf("record %d (line %d): %w", s.n+1, line, err)
+		return false
+	}
+	s.n++
+	return true
+}
+
+func (s *csvSource) Key() []byte   { return s.key }
+func (s *csvSource) Value() []byte { return s.val }
+func (s *csvSource) Error() error  { return s.err }
+func (s *csvSource) count() int    { return s.n }
+
+// jsonlRecord is a line of a jsonl file. Either of Key and KeyBase64 is set, as well as either
+// of Value and ValueBase64.
+type jsonlRecord struct {
+	Key         *string `json:"key,omitempty"`
+	KeyBase64   []byte  `json:"key_base64,omitempty"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 []byte  `json:"value_base64,omitempty"`
+}
+
+type jsonlSource struct {
+	d        *json.Decoder
+	n        int
+	key, val []byte
+	err      error
+}
+
+func (s *jsonlSource) Next() bool {
+	if s.err != nil {
+		return false
+	}
+	var r jsonlRecord
+	err := s.d.Decode(&r)
+	if errors.Is(err, io.EOF) {
+		return false
+	}
+	if err == nil {
+		switch {
+		case r.Key != nil:
+			s.key = []byte(*r.Key)
+		case r.KeyBase64 != nil:
+			s.key = r.KeyBase64
+		default:
+			err = errors.New("no key")
+		}
+		switch {
+		case r.Value != nil:
+			s.val = []byte(*r.Value)
+		case r.ValueBase64 != nil:
+			s.val = r.ValueBase64
+		default:
+			err = errors.New("no value")
+		}
+	}
+	if err != nil {
+		s.err = fmt.Errorf("record %d: %w", s.n+1, err)
+		return false
+	}
+	s.n++
+	return true
+}
+
+func (s *jsonlSource) Key() []byte   { return s.key }
+func (s *jsonlSource) Value() []byte { return s.val }
+func (s *jsonlSource) Error() error  { return s.err }
+func (s *jsonlSource) count() int    { return s.n }
+
+func writeJSONLRecord(w *bufio.Writer, key, val []byte) error {
+	var r jsonlRecord
+	if utf8.Valid(key) {
+		k := string(key)
+		r.Key = &k
+	} else {
+		r.KeyBase64 = key
+	}
+	if utf8.Valid(val) {
+		v := string(val)
+		r.Value = &v
+	} else {
+		r.ValueBase64 = val
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	w.Write(b)
+	return w.WriteByte('\n')
+}
+
+// escape turns b into printable UTF-8, escaping the other bytes as \xNN and backslashes as \\.
+func escape(b []byte) string {
+	var sb strings.Builder
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		switch {
+		case r == '\\':
+			sb.WriteString(`\\`)
+		case r == utf8.RuneError && size == 1, !unicode.IsPrint(r) && r != ' ':
+			for _, c := range b[:size] {
+				fmt.Fprintf(&sb, `\x%02x`, c)
+			}
+		default:
+			sb.Write(b[:size])
+		}
+		b = b[size:]
+	}
+	return sb.String()
+}
+
+// unescape reverses escape.
+func unescape(s string) ([]byte, error) {
+	if !strings.Contains(s, `\`) {
+		return []byte(s), nil
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(s[i:], `\\`):
+			b = append(b, '\\')
+			i++
+		case strings.HasPrefix(s[i:], `\x`) && i+4 <= len(s):
+			c, err := strconv.ParseUint(s[i+2:i+4], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid escape %q", s[i:i+4])
+			}
+			b = append(b, byte(c))
+			i += 3
+		default:
+			return nil, fmt.Errorf("invalid escape at %q", s[i:])
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"lsm/bench"
+	"lsm/db"
+	"lsm/memtable"
+	"os"
+	"strings"
+	"time"
+)
+
+// runBench runs the bench subcommand with the arguments following it, and returns the exit
+// code.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	workload := fs.String("workload", "a", "YCSB workload: a (50% reads, 50% updates), b (95% reads, 5% updates), c (reads), d (95% reads of the latest keys, 5% inserts), e (95% short scans, 5% inserts) or f (50% reads, 50% read-modify-writes).")
+	records := fs.Int("records", 100000, "Number of records loaded before the workload runs.")
+	ops := fs.Int("ops", 100000, "Number of operations of the workload.")
+	keySize := fs.Int("key-size", 24, "Size of the keys in bytes.")
+	valueSize := fs.Int("value-size", 100, "Size of the values in bytes.")
+	distribution := fs.String("distribution", "", "Distribution of the keys read, updated and scanned: uniform, zipfian or latest (default: zipfian, latest for workload d).")
+	concurrency := fs.Int("concurrency", 1, "Number of concurrent workers.")
+	scanLength := fs.Int("scan-length", 100, "Maximum number of keys read by a scan.")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "Seed of the keys and values.")
+	dir := fs.String("dir", "", "Data directory of the database (default: a temporary directory, deleted afterwards).")
+	config := fs.String("config", "", "YAML or TOML file setting the options of the database, like the -config of the CLI.")
+	skipLoad := fs.Bool("skip-load", false, "Skip loading the records, which -dir already holds from a previous run.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "\nUsage: bench [arguments]\n\nRuns a YCSB-style workload and reports its throughput and latency percentiles.\n\nArguments:")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	opts := &db.Options{}
+	if *config != "" {
+		var err error
+		if opts, err = loadConfig(*config); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	path := *dir
+	if path == "" {
+		tmp, err := os.MkdirTemp("", "lsm-bench-")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer os.RemoveAll(tmp)
+		path = tmp
+	}
+	d, err := db.Open(path, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "opening %s: %v\n", path, err)
+		return 1
+	}
+	defer d.Close()
+
+	report, err := bench.Run(d, bench.Config{
+		Workload:      *workload,
+		Records:       *records,
+		Operations:    *ops,
+		KeySize:       *keySize,
+		ValueSize:     *valueSize,
+		Distribution:  *distribution,
+		Concurrency:   *concurrency,
+		MaxScanLength: *scanLength,
+		SkipLoad:      *skipLoad,
+		Seed:          *seed,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	report.Print(os.Stdout)
+	return 0
+}
+
+// runBenchMemtable runs the bench-memtable subcommand with the arguments following it, and
+// returns the exit code.
+func runBenchMemtable(args []string) int {
+	fs := flag.NewFlagSet("bench-memtable", flag.ContinueOnError)
+	backends := fs.String("backends", "skiplist,btree", "Comma-separated memtable backends to compare: skiplist, btree or hash.")
+	entries := fs.Int("entries", 100000, "Number of entries of a full memtable.")
+	keySize := fs.Int("key-size", 24, "Size of the keys in bytes.")
+	valueSize := fs.Int("value-size", 100, "Size of the values in bytes.")
+	sequential := fs.Bool("sequential", false, "Insert the keys in increasing order rather than in random order.")
+	scanLength := fs.Int("scan-length", 100, "Number of entries read by a scan.")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "Seed of the keys and values.")
+	dir := fs.String("dir", "", "Directory flushes write their table to (default: a temporary directory, deleted afterwards).")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "\nUsage: bench-memtable [arguments]\n\nBenchmarks inserts, gets, scans and flushes of the memtable backends and reports their\nthroughput and allocations.\n\nArguments:")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg := bench.MemtableConfig{
+		Entries:    *entries,
+		KeySize:    *keySize,
+		ValueSize:  *valueSize,
+		Sequential: *sequential,
+		ScanLength: *scanLength,
+		Dir:        *dir,
+		Seed:       *seed,
+	}
+	for _, name := range strings.Split(*backends, ",") {
+		backend, ok := parseBackend(strings.TrimSpace(name))
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown memtable backend %q\n", name)
+			return 2
+		}
+		cfg.Backends = append(cfg.Backends, backend)
+	}
+	if cfg.Dir == "" {
+		tmp, err := os.MkdirTemp("", "lsm-bench-memtable-")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer os.RemoveAll(tmp)
+		cfg.Dir = tmp
+	}
+
+	results, err := bench.RunMemtable(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%d entries of %d+%d bytes, inserted in %s order, flushed to %s\n\n", *entries, *keySize, *valueSize,
+		map[bool]string{false: "random", true: "increasing"}[*sequential], cfg.Dir)
+	bench.PrintMemtable(os.Stdout, results)
+	return 0
+}
+
+// parseBackend returns the memtable backend named name.
+func parseBackend(name string) (memtable.BackendType, bool) {
+	for t := memtable.BackendType(0); !strings.HasPrefix(t.String(), "unknown"); t++ {
+		if t.String() == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"lsm/db"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+loadConfig reads the options of the DB from a YAML (*.yaml, *.yml) or TOML (*.toml) file.
+Keys are the fields of db.Options, in any case, with or without underscores:
+
+	memtable_size_limit: 4MiB
+	memtable_backend: btree
+	compression: zstd
+	wal_sync: periodic
+	wal_sync_interval: 100ms
+
+Sizes are numbers of bytes, or strings with a KiB, MiB or GiB suffix; durations are strings
+like "100ms"; enumerations are their names (see their String methods). Options the file leaves
+out keep their defaults. Every invalid key or value is reported, not only the first one.
+*/
+func loadConfig(path string) (*db.Options, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]any
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		_, err = toml.Decode(string(data), &values)
+	default:
+		return nil, fmt.Errorf("%s: unknown config format %q, expected .yaml, .yml or .toml", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	opts := &db.Options{}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	var errs []error
+	for _, key := range keys {
+		if err := setOption(opts, key, values[key]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %w", path, key, err))
+		}
+	}
+	return opts, errors.Join(errs...)
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	stringerType = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+)
+
+// setOption sets the field of opts named key to val, as decoded from YAML or TOML.
+func setOption(opts *db.Options, key string, val any) error {
+	name := strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(key))
+	v := reflect.ValueOf(opts).Elem()
+	field, ok := v.Type().FieldByNameFunc(func(f string) bool { return strings.ToLower(f) == name })
+	if !ok {
+		return errors.New("unknown option (see db.Options)")
+	}
+	f := v.FieldByIndex(field.Index)
+
+	switch {
+	case f.Type() == durationType:
+		s, ok := val.(string)
+		if !ok {
+			return fmt.Errorf("expected a duration like \"100ms\", got %v", val)
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+	case f.Kind() == reflect.Uint8 && f.Type().Implements(stringerType):
+		return setEnum(f, val)
+	case f.Kind() == reflect.Bool:
+		b, ok := val.(bool)
+		if !ok {
+			return fmt.Errorf("expected true or false, got %v", val)
+		}
+		f.SetBool(b)
+	case f.Kind() == reflect.Int || f.Kind() == reflect.Int64:
+		n, err := toInt(val)
+		if err != nil {
+			return err
+		}
+		if f.OverflowInt(n) {
+			return fmt.Errorf("%d is out of range", n)
+		}
+		f.SetInt(n)
+	case f.Kind() == reflect.Float64:
+		switch n := val.(type) {
+		case float64:
+			f.SetFloat(n)
+		case int:
+			f.SetFloat(float64(n))
+		case int64:
+			f.SetFloat(float64(n))
+		default:
+			return fmt.Errorf("expected a number, got %v", val)
+		}
+	case f.Kind() == reflect.String:
+		s, ok := val.(string)
+		if !ok {
+			return fmt.Errorf("expected a string, got %v", val)
+		}
+		f.SetString(s)
+	default:
+		return errors.New("can't be set in a config file")
+	}
+	return nil
+}
+
+// setEnum sets f, an enumeration with a String method, to the value named val.
+func setEnum(f reflect.Value, val any) error {
+	s, ok := val.(string)
+	if !ok {
+		return fmt.Errorf("expected a name, got %v", val)
+	}
+	var names []string
+	for i := 0; i < 256; i++ {
+		f.SetUint(uint64(i))
+		name := f.Interface().(fmt.Stringer).String()
+		if strings.HasPrefix(name, "unknown") {
+			break
+		}
+		if strings.EqualFold(name, s) {
+			return nil
+		}
+		names = append(names, name)
+	}
+	f.SetUint(0)
+	return fmt.Errorf("unknown value %q, expected one of %s", s, strings.Join(names, ", "))
+}
+
+// toInt converts a number, or a size with a KiB, MiB or GiB suffix, to an integer.
+func toInt(val any) (int64, error) {
+	switch n := val.(type) {
+	case int:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case uint64:
+		if n > 1<<63-1 {
+			return 0, fmt.Errorf("%d is out of range", n)
+		}
+		return int64(n), nil
+	case float64:
+		if n != float64(int64(n)) {
+			return 0, fmt.Errorf("expected an integer, got %v", n)
+		}
+		return int64(n), nil
+	case string:
+		s := strings.TrimSpace(n)
+		unit := int64(1)
+		for suffix, u := range map[string]int64{"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30} {
+			if strings.HasSuffix(s, suffix) {
+				s, unit = strings.TrimSpace(strings.TrimSuffix(s, suffix)), u
+			}
+		}
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || i > (1<<63-1)/unit || i < -(1<<63-1)/unit {
+			return 0, fmt.Errorf("expected a number or a size like \"4MiB\", got %q", n)
+		}
+		return i * unit, nil
+	}
+	return 0, fmt.Errorf("expected a number, got %v", val)
+}
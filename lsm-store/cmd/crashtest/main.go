@@ -0,0 +1,35 @@
+// Command crashtest runs the crash recovery test of package crashtest and reports whether the
+// DB lost any acknowledged write.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"lsm/crashtest"
+	"time"
+)
+
+func main() {
+	seed := flag.Int64("seed", time.Now().UnixNano(), "seed of the workload and the faults")
+	rounds := flag.Int("rounds", 20, "number of crashes")
+	ops := flag.Int("ops", 2000, "maximum number of writes between two crashes")
+	keys := flag.Int("keys", 500, "number of distinct keys")
+	ioCrashes := flag.Float64("io-crashes", 0.5, "probability of a crash right before a random write or sync rather than between two writes")
+	partialReads := flag.Float64("partial-reads", 0.05, "probability of a partial read during recovery")
+	flag.Parse()
+
+	res, err := crashtest.Run(crashtest.Config{
+		Seed:         *seed,
+		Rounds:       *rounds,
+		Ops:          *ops,
+		Keys:         *keys,
+		IOCrashes:    *ioCrashes,
+		PartialReads: *partialReads,
+	})
+	if err != nil {
+		log.Fatalf("seed %d: %v", *seed, err)
+	}
+	fmt.Printf("seed %d: ok, %d writes acknowledged, %d failed, %d faults injected, %d crashes in the middle of I/O\n",
+		*seed, res.Writes, res.FailedWrites, res.Faults, res.IOCrashes)
+}
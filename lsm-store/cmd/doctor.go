@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"lsm/db"
+	"os"
+	"slices"
+)
+
+// runDoctor runs the doctor subcommand with the arguments following it, and returns the exit
+// code: 0 if the DB is healthy (after the repairs, with -fix), 1 otherwise.
+func runDoctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	dir := fs.String("dir", "demo", "Data directory of the database, which must not be open.")
+	config := fs.String("config", "", "YAML or TOML file setting the options of the database, like the -config of the CLI.")
+	fix := fs.Bool("fix", false, "Apply the safe repairs, then open the database and run the integrity verifier.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "\nUsage: doctor [arguments]\n\nChecks the files of a database for leftovers, corruption and inconsistencies, and suggests repairs.\n\nArguments:")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	opts := &db.Options{}
+	if *config != "" {
+		var err error
+		if opts, err = loadConfig(*config); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	dg, err := db.Diagnose(*dir, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s: %d tables, %d WALs, %d value log files\n", dg.Dir, dg.Tables, dg.WALs, dg.ValueLogs)
+	printProblems(dg)
+	if !*fix {
+		if dg.OK() {
+			return 0
+		}
+		if slices.ContainsFunc(dg.Problems, func(p db.Problem) bool { return p.Repair != "" }) {
+			fmt.Println("\nRun with -fix to apply the repairs.")
+		}
+		return 1
+	}
+
+	repaired, err := dg.Repair()
+	for _, p := range repaired {
+		fmt.Printf("Repaired %s: %s\n", p.Path, p.Repair)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(repaired) > 0 {
+		if dg, err = db.Diagnose(*dir, opts); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println("\nAfter the repairs:")
+		printProblems(dg)
+	}
+	if !dg.OK() {
+		// opening the DB could make things worse, e.g. replay a WAL past a corrupt record
+		fmt.Println("\nNot running the integrity verifier until the problems left are solved.")
+		return 1
+	}
+
+	d, err := db.Open(*dir, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "opening %s: %v\n", *dir, err)
+		return 1
+	}
+	defer d.Close()
+	report, err := d.VerifyIntegrity()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := report.Err(); err != nil {
+		fmt.Printf("Integrity verifier: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Integrity verifier: %d tables intact.\n", len(report.Tables))
+	return 0
+}
+
+func printProblems(dg *db.Diagnosis) {
+	if dg.OK() {
+		fmt.Println("No problems found.")
+		return
+	}
+	for _, p := range dg.Problems {
+		fmt.Printf("\n%s %s\n  %s\n", p.Kind, p.Path, p.Detail)
+		if p.Repair != "" {
+			fmt.Printf("  repair: %s\n", p.Repair)
+		}
+		if p.Advice != "" {
+			fmt.Printf("  advice: %s\n", p.Advice)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Command lsm-server serves a DB over gRPC (see lsmpb/lsm.proto) and, with -resp-addr and
+// -http-addr, over the Redis protocol (see package resp) and HTTP (see package httpapi). On
+// SIGINT or SIGTERM it stops accepting requests, lets those in flight finish, and closes the DB.
+//
+//	lsm-server [-addr :50051] [-resp-addr :6379] [-http-addr :8080] [-dir data] [-timeout 10s]
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"log/slog"
+	"lsm/db"
+	"lsm/httpapi"
+	"lsm/resp"
+	"lsm/server"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+func main() {
+	addr := flag.String("addr", ":50051", "address to listen on")
+	respAddr := flag.String("resp-addr", "", "address to serve the Redis protocol on, none if empty")
+	httpAddr := flag.String("http-addr", "", "address to serve the HTTP API on, none if empty")
+	dir := flag.String("dir", "data", "data directory of the DB, created if it doesn't exist")
+	timeout := flag.Duration("timeout", 10*time.Second, "deadline of the requests that come without a shorter one")
+	drain := flag.Duration("shutdown-timeout", 10*time.Second, "time given to the requests in flight on shutdown, after which they are cancelled")
+	logLevel := flag.String("log", "", "log database events of this level or above to stderr (debug, info, warn or error)")
+	slowSpans := flag.Duration("slow-spans", 0, "log the steps of the DB (WAL appends, syncs, block reads, flushes, ...) taking at least this long, none if 0")
+	flag.Parse()
+
+	opts := &db.Options{}
+	if *logLevel != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+			log.Fatal(err)
+		}
+		handler := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+		opts.Logger = db.NewSlogLogger(slog.New(handler))
+	}
+	if *slowSpans > 0 {
+		opts.SpanHook = func(s db.Span) {
+			log.Printf("slow %s: %v (file %d, %d bytes)", s.Kind, s.Duration, s.FileNum, s.Bytes)
+		}
+		opts.SpanThreshold = *slowSpans
+	}
+	d, err := db.Open(*dir, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		d.Close()
+		log.Fatal(err)
+	}
+	g := grpc.NewServer(server.DefaultTimeout(*timeout)...)
+	server.New(d).Register(g)
+	var rs *resp.Server
+	if *respAddr != "" {
+		rln, err := net.Listen("tcp", *respAddr)
+		if err != nil {
+			ln.Close()
+			d.Close()
+			log.Fatal(err)
+		}
+		rs = resp.NewServer(d)
+		go rs.Serve(rln)
+		log.Printf("serving the Redis protocol on %s", rln.Addr())
+	}
+	var hs *http.Server
+	if *httpAddr != "" {
+		hln, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			ln.Close()
+			d.Close()
+			log.Fatal(err)
+		}
+		hs = &http.Server{Handler: http.TimeoutHandler(httpapi.NewHandler(d), *timeout, "timeout\n")}
+		go hs.Serve(hln)
+		log.Printf("serving HTTP on %s", hln.Addr())
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() {
+		served <- g.Serve(ln)
+	}()
+	log.Printf("serving %s on %s", *dir, ln.Addr())
+	select {
+	case err = <-served:
+	case <-ctx.Done():
+		log.Print("shutting down")
+		stopped := make(chan struct{})
+		go func() {
+			g.GracefulStop()
+			close(stopped)
+		}()
+		drained, cancel := context.WithTimeout(context.Background(), *drain)
+		if hs != nil {
+			hs.Shutdown(drained)
+		}
+		select {
+		case <-stopped:
+		case <-drained.Done():
+			g.Stop()
+		}
+		cancel()
+	}
+	if hs != nil {
+		hs.Close()
+	}
+	if rs != nil {
+		// commands are quick, those being run are waited for
+		rs.Close()
+	}
+	if cerr := d.Close(); cerr != nil {
+		log.Fatal(cerr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
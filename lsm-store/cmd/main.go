@@ -1,71 +1,214 @@
 package main
 
 import (
-	"bufio"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
+	"log/slog"
 	"lsm/cli"
 	"lsm/db"
 	"os"
-
-	"github.com/go-faker/faker/v4"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
 )
 
-const dataFolder = "demo"
-
 var shouldReset, shouldSeed *bool
 var seedNumRecords *int
+var seedOrder *string
+var seedRand *int64
+var seedKeySize = &sizeDist{kind: "fixed", min: 16, max: 16}
+var seedValueSize = &sizeDist{kind: "fixed", min: 100, max: 100}
+var logLevel *string
+var importFile, exportFile, fileFormat *string
+var dataDir, configFile *string
+var traceFile *string
 
-func eraseDataFolder() {
-	err := os.RemoveAll("demo")
+// traceOut is the -trace file, closed once the DB is
+var traceOut *os.File
+
+// eraseDataFolder deletes the data directory dir, refusing to if it holds files but no
+// MANIFEST: a mistyped -dir mustn't wipe a directory that isn't the DB's.
+func eraseDataFolder(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("can't reset %s: %w", dir, err)
 	}
-}
-
-func seedDatabaseWithTestRecords(d *db.DB) {
-	for i := 0; i < *seedNumRecords; i++ {
-		k := []byte(faker.Word() + faker.Word())
-		v := []byte(faker.Word() + faker.Word())
-		d.Set(k, v)
+	if len(entries) > 0 && !slices.ContainsFunc(entries, func(e fs.DirEntry) bool { return e.Name() == "MANIFEST" }) {
+		return fmt.Errorf("refusing to reset %s: it isn't a data directory (no MANIFEST)", dir)
 	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("can't reset %s: %w", dir, err)
+	}
+	return nil
 }
 
 func main() {
 	// // test skip list
-	// scanner := bufio.NewScanner(os.Stdin)
-	// sl := skiplist.NewSkipList()
-	// cli := cli.NewCLI(scanner, sl)
+	// sl := skiplist.NewSkipList(nil)
+	// cli := cli.NewSCLI(os.Stdin, sl)
 	// cli.Start()
 
-	setupFlags()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bench":
+			os.Exit(runBench(os.Args[2:]))
+		case "bench-memtable":
+			os.Exit(runBenchMemtable(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		case "doctor":
+			os.Exit(runDoctor(os.Args[2:]))
+		}
+	}
+
+	if err := setupFlags(); err != nil {
+		log.Fatal(err)
+	}
 
 	if *shouldReset {
-		eraseDataFolder()
+		if err := eraseDataFolder(*dataDir); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	opts := &db.Options{}
+	if *configFile != "" {
+		var err error
+		if opts, err = loadConfig(*configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *logLevel != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+			log.Fatal(err)
+		}
+		handler := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+		opts.Logger = db.NewSlogLogger(slog.New(handler))
 	}
 
-	d, err := db.Open(dataFolder)
+	if info, err := os.Stat(*dataDir); err == nil && !info.IsDir() {
+		log.Fatalf("%s isn't a directory, choose another data directory with -dir", *dataDir)
+	}
+	d, err := db.Open(*dataDir, opts)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("opening %s: %v", *dataDir, err)
+	}
+	if *traceFile != "" {
+		if traceOut, err = os.Create(*traceFile); err != nil {
+			log.Fatal(err)
+		}
+		if err := d.StartTrace(traceOut); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	if *shouldSeed {
-		seedDatabaseWithTestRecords(d)
+		if err := seedDatabase(d); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *importFile != "" || *exportFile != "" {
+		transferFiles(d)
+		return
 	}
 
-	scanner := bufio.NewScanner(os.Stdin)
-	demo := cli.NewCLI(scanner, d)
+	// Ctrl-C at the prompt ends the session, but while a command runs (or if stdin isn't a
+	// terminal) it raises SIGINT
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fmt.Println()
+		closeDB(d)
+		os.Exit(130)
+	}()
+
+	demo := cli.NewCLI(os.Stdin, d)
 	demo.Start()
+	closeDB(d)
 }
 
-func setupFlags() {
+func closeDB(d *db.DB) {
+	if err := d.Close(); err != nil && !errors.Is(err, db.ErrClosed) {
+		log.Fatal(err)
+	}
+	if traceOut != nil {
+		if err := traceOut.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// transferFiles runs the -import and -export flags.
+func transferFiles(d *db.DB) {
+	defer closeDB(d)
+	format := func(path string) string {
+		if *fileFormat != "" {
+			return *fileFormat
+		}
+		return cli.FormatOf(path)
+	}
+	if *importFile != "" {
+		n, err := cli.ImportFile(d, *importFile, format(*importFile))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Imported %d records from %s.\n", n, *importFile)
+	}
+	if *exportFile != "" {
+		n, err := cli.ExportFile(d, *exportFile, format(*exportFile))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Exported %d records to %s.\n", n, *exportFile)
+	}
+}
+
+// setupFlags parses the command line. Flags not given on it are taken from the environment
+// variables LSM_<NAME> (e.g. LSM_DIR for -dir, LSM_SEED_ORDER for -seed-order), if set.
+func setupFlags() error {
+	dataDir = flag.String("dir", "demo", "Data directory of the database.")
+	configFile = flag.String("config", "", "YAML (.yaml, .yml) or TOML (.toml) file setting the options of the database (fields of db.Options).")
 	shouldReset = flag.Bool("reset", false, "Reset the database by erasing its folder before startup.")
-	shouldSeed = flag.Bool("seed", false, "Seed the database using records created with go-faker.")
+	shouldSeed = flag.Bool("seed", false, "Seed the database with generated records upon startup.")
 	seedNumRecords = flag.Int("records", 1000, "Amount of records to seed the database with upon startup.")
+	flag.Var(seedKeySize, "seed-key-size", "Size of the seeded keys: N bytes, uniform:MIN-MAX or zipf:MIN-MAX.")
+	flag.Var(seedValueSize, "seed-value-size", "Size of the seeded values: N bytes, uniform:MIN-MAX or zipf:MIN-MAX.")
+	seedOrder = flag.String("seed-order", "random", "Order the seeded records are written in: sorted or random.")
+	seedRand = flag.Int64("seed-rand", 1, "Seed of the random generator of the seeded records, the same one generating the same records.")
+	importFile = flag.String("import", "", "Bulk load the key-value pairs of this file, then exit.")
+	exportFile = flag.String("export", "", "Write all key-value pairs to this new file (after -import, if given), then exit.")
+	fileFormat = flag.String("format", "", "Format of the -import and -export files (csv or jsonl), after their extension by default.")
+	traceFile = flag.String("trace", "", "Record every operation on the database to this file, to be run again with \"replay\".")
+	logLevel = flag.String("log", "", "Log database events of this level or above to stderr (debug, info, warn or error).")
 	flag.Usage = func() {
-		fmt.Println("\nDB CLI\n\nArguments:")
+		fmt.Println("\nDB CLI\n\nArguments (or environment variables LSM_<NAME>, e.g. LSM_DIR):")
 		flag.PrintDefaults()
+		fmt.Println("\nSubcommands (run with -h for their arguments): bench (benchmark), replay (of a trace), doctor (checks and repairs a data directory).")
 	}
 	flag.Parse()
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var errs []error
+	flag.VisitAll(func(f *flag.Flag) {
+		env := "LSM_" + strings.ReplaceAll(strings.ToUpper(f.Name), "-", "_")
+		val, ok := os.LookupEnv(env)
+		if !ok || given[f.Name] {
+			return
+		}
+		if err := f.Value.Set(val); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q for %s: %v", val, env, err))
+		}
+	})
+	return errors.Join(errs...)
 }
@@ -0,0 +1,47 @@
+// Command modeltest runs the model-based test of package modeltest and reports the first
+// result of the DB its model disagrees with.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"lsm/modeltest"
+	"sort"
+	"time"
+)
+
+func main() {
+	seed := flag.Int64("seed", time.Now().UnixNano(), "seed of the operations")
+	ops := flag.Int("ops", 10000, "number of operations")
+	keys := flag.Int("keys", 200, "number of distinct keys")
+	cfs := flag.Int("cfs", 2, "number of column families, the default one included")
+	history := flag.Int("history", 20, "number of operations listed along with a mismatch")
+	shrink := flag.Bool("shrink", false, "on a mismatch, look for a shorter run that fails too and list all of its operations")
+	flag.Parse()
+
+	cfg := modeltest.Config{
+		Seed:           *seed,
+		Ops:            *ops,
+		Keys:           *keys,
+		ColumnFamilies: *cfs,
+		History:        *history,
+	}
+	res, err := modeltest.Run(cfg)
+	if err != nil && *shrink {
+		err = modeltest.Shrink(cfg)
+	}
+	if err != nil {
+		log.Fatalf("seed %d: %v", *seed, err)
+	}
+	kinds := make([]string, 0, len(res.Ops))
+	for kind := range res.Ops {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	fmt.Printf("seed %d: ok, %d restarts", *seed, res.Restarts)
+	for _, kind := range kinds {
+		fmt.Printf(", %s %d", kind, res.Ops[kind])
+	}
+	fmt.Println()
+}
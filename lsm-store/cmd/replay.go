@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"lsm/cli"
+	"lsm/db"
+	"os"
+	"slices"
+	"time"
+)
+
+// runReplay runs the replay subcommand with the arguments following it, and returns the exit
+// code.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	speed := fs.Float64("speed", 0, "Pace of the replay: 1 for the timing of the trace, 2 for twice as fast, 0 for as fast as possible.")
+	dir := fs.String("dir", "", "Data directory of the database (default: a temporary directory, deleted afterwards).")
+	config := fs.String("config", "", "YAML or TOML file setting the options of the database, like the -config of the CLI.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "\nUsage: replay [arguments] trace\n\nRuns the operations of a trace recorded with -trace against a database, and reports its stats.\n\nArguments:")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+	opts := &db.Options{}
+	if *config != "" {
+		if opts, err = loadConfig(*config); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	path := *dir
+	if path == "" {
+		tmp, err := os.MkdirTemp("", "lsm-replay-")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer os.RemoveAll(tmp)
+		path = tmp
+	}
+	d, err := db.Open(path, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "opening %s: %v\n", path, err)
+		return 1
+	}
+	defer d.Close()
+
+	res, err := d.Replay(f, &db.ReplayOptions{Speed: *speed})
+	if res == nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	total := 0
+	ops := make([]db.TraceOp, 0, len(res.Ops))
+	for op, n := range res.Ops {
+		ops = append(ops, op)
+		total += n
+	}
+	slices.Sort(ops)
+	fmt.Printf("Replayed %d operations in %v", total, res.Duration.Round(time.Millisecond))
+	if *speed > 0 {
+		fmt.Printf(", at most %v behind the trace", res.MaxLag.Round(time.Millisecond))
+	}
+	fmt.Println()
+	for _, op := range ops {
+		fmt.Printf("  %-13s %d\n", op, res.Ops[op])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println()
+	cli.PrintStats(d)
+	return 0
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"lsm/db"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sizeDist is a distribution of sizes, set from a flag:
+//
+//	16               always 16 bytes
+//	uniform:8-32     uniformly between 8 and 32 bytes
+//	zipf:8-1024      between 8 and 1024 bytes, the smallest sizes being the most frequent
+type sizeDist struct {
+	kind     string // "fixed", "uniform" or "zipf"
+	min, max int
+}
+
+func (s *sizeDist) String() string {
+	if s.kind == "fixed" {
+		return strconv.Itoa(s.min)
+	}
+	return fmt.Sprintf("%s:%d-%d", s.kind, s.min, s.max)
+}
+
+func (s *sizeDist) Set(v string) error {
+	kind, bounds, ok := strings.Cut(v, ":")
+	if !ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("expected a size, uniform:MIN-MAX or zipf:MIN-MAX, got %q", v)
+		}
+		*s = sizeDist{kind: "fixed", min: n, max: n}
+		return nil
+	}
+	if kind != "uniform" && kind != "zipf" {
+		return fmt.Errorf("unknown distribution %q, expected uniform or zipf", kind)
+	}
+	from, to, ok := strings.Cut(bounds, "-")
+	lo, err1 := strconv.Atoi(from)
+	hi, err2 := strconv.Atoi(to)
+	if !ok || err1 != nil || err2 != nil || lo <= 0 || hi < lo {
+		return fmt.Errorf("expected %s:MIN-MAX with 0 < MIN <= MAX, got %q", kind, v)
+	}
+	*s = sizeDist{kind: kind, min: lo, max: hi}
+	return nil
+}
+
+// sampler returns a function drawing sizes from the distribution with rng.
+func (s *sizeDist) sampler(rng *rand.Rand) func() int {
+	switch s.kind {
+	case "uniform":
+		return func() int { return s.min + rng.Intn(s.max-s.min+1) }
+	case "zipf":
+		z := rand.NewZipf(rng, 1.1, 1, uint64(s.max-s.min))
+		return func() int { return s.min + int(z.Uint64()) }
+	}
+	return func() int { return s.min }
+}
+
+// seedDatabase writes -records generated records to d, deterministically for a given
+// -seed-rand. Every key starts with its zero-padded number, which keeps keys unique and makes
+// their order that of their numbers, followed by random letters up to its size: a key is
+// never shorter than the number of digits of -records. Records are written in key order with
+// -seed-order sorted, in a random order otherwise.
+func seedDatabase(d *db.DB) error {
+	rng := rand.New(rand.NewSource(*seedRand))
+	keySize, valueSize := seedKeySize.sampler(rng), seedValueSize.sampler(rng)
+	order := make([]int, *seedNumRecords)
+	switch *seedOrder {
+	case "sorted":
+		for i := range order {
+			order[i] = i
+		}
+	case "random":
+		order = rng.Perm(*seedNumRecords)
+	default:
+		return fmt.Errorf("unknown -seed-order %q, expected sorted or random", *seedOrder)
+	}
+
+	width := len(strconv.Itoa(max(*seedNumRecords-1, 0)))
+	var keyBytes, valBytes int
+	start := time.Now()
+	for _, i := range order {
+		key := fmt.Appendf(nil, "%0*d", width, i)
+		key = appendLetters(rng, key, keySize()-len(key))
+		val := appendLetters(rng, nil, valueSize())
+		if err := d.Set(key, val, nil); err != nil {
+			return fmt.Errorf("seeding: %w", err)
+		}
+		keyBytes += len(key)
+		valBytes += len(val)
+	}
+	if n := len(order); n > 0 {
+		fmt.Printf("Seeded %d records (keys of %d B, values of %d B on average) in %v.\n",
+			n, keyBytes/n, valBytes/n, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// appendLetters appends n random lowercase letters to b.
+func appendLetters(rng *rand.Rand, b []byte, n int) []byte {
+	for ; n > 0; n-- {
+		b = append(b, byte('a'+rng.Intn(26)))
+	}
+	return b
+}
@@ -0,0 +1,189 @@
+// Command sstdump prints the layout, properties and optionally the index entries and kv-pairs of
+// SSTable files, and can verify them. Tables whose keys are ordered by a comparer other than
+// the default one can't be read. With -repair, damaged tables are salvaged with sstable.Repair
+// first, and the repaired tables are dumped.
+//
+//	sstdump [-index] [-kv] [-verify] [-repair] file.sst...
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"lsm/encoder"
+	"lsm/sstable"
+	"lsm/vlog"
+	"os"
+	"slices"
+	"time"
+)
+
+var (
+	showIndex   = flag.Bool("index", false, "print the index entries, one per data block")
+	showKVs     = flag.Bool("kv", false, "print every kv-pair, with its sequence number and kind")
+	verify      = flag.Bool("verify", false, "read the whole table and check it for corruption")
+	repair      = flag.Bool("repair", false, "rewrite the table with what can be read of it, keeping the damaged one as file.sst.damaged")
+	maxValueLen = flag.Int("max-value", 64, "bytes of a value printed with -kv, 0 for all of them")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: sstdump [flags] file.sst...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	ok := true
+	for _, path := range flag.Args() {
+		if err := dump(path); err != nil {
+			log.Printf("%s: %v", path, err)
+			ok = false
+		}
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+func dump(path string) error {
+	if *repair {
+		stats, err := sstable.Repair(path, sstable.Options{})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: repaired: %d kv-pairs, %d range tombstones kept; %d kv-pairs, %d data blocks (%d bytes) dropped\n",
+			path, stats.Entries, stats.RangeTombstones, stats.DroppedEntries, stats.DroppedBlocks, stats.DroppedBytes)
+		if stats.IndexLost {
+			fmt.Printf("%s: the index was lost, the data blocks were found by their checksums\n", path)
+		}
+		if stats.RangeDelsLost {
+			fmt.Printf("%s: the range tombstones were lost, keys they deleted may reappear\n", path)
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	r, err := sstable.NewReader(f, sstable.Options{})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	defer r.Close()
+
+	l := r.Layout()
+	fmt.Printf("%s\n", path)
+	fmt.Printf("  format version: %d, size: %d bytes\n", l.Version, l.FileSize)
+	fmt.Printf("  data blocks:       %d\n", len(l.Data))
+	printHandle("range deletions", l.RangeDel)
+	if l.Filter != (sstable.BlockHandle{}) {
+		printHandle("filter", l.Filter)
+	}
+	printHandle("properties", l.Properties)
+	for i, h := range l.IndexPartitions {
+		printHandle(fmt.Sprintf("index partition %d", i), h)
+	}
+	printHandle("index", l.Index)
+
+	props, err := r.Properties()
+	if err != nil {
+		return err
+	}
+	printProperties(props)
+
+	if tombstones := r.RangeTombstones(); len(tombstones) > 0 {
+		fmt.Printf("  range tombstones:\n")
+		for _, t := range tombstones {
+			fmt.Printf("    [%q, %q) seq %d\n", t.Start, t.End, t.SeqNum)
+		}
+	}
+	if *showIndex {
+		fmt.Printf("  index:\n")
+		for i, e := range l.Data {
+			fmt.Printf("    %6d  offset %d length %d  <= %q\n", i, e.Block.Offset, e.Block.Length, e.Key)
+		}
+	}
+	if *showKVs {
+		if err := printKVs(r); err != nil {
+			return err
+		}
+	}
+	if *verify {
+		if err := r.Verify(); err != nil {
+			return err
+		}
+		fmt.Printf("  verify: ok\n")
+	}
+	return nil
+}
+
+func printHandle(name string, h sstable.BlockHandle) {
+	fmt.Printf("  %-18s offset %d length %d\n", name+":", h.Offset, h.Length)
+}
+
+func printProperties(p *sstable.Properties) {
+	fmt.Printf("  properties:\n")
+	fmt.Printf("    smallest key:    %q\n", p.SmallestKey)
+	fmt.Printf("    largest key:     %q\n", p.LargestKey)
+	fmt.Printf("    largest seqnum:  %d\n", p.LargestSeqNum)
+	fmt.Printf("    entries:         %d\n", p.NumEntries)
+	fmt.Printf("    comparer:        %s\n", p.Comparer)
+	fmt.Printf("    compression:     %s\n", p.Compression)
+	if p.CompressionDict != nil {
+		fmt.Printf("    compression dict: %d bytes\n", len(p.CompressionDict))
+	}
+	fmt.Printf("    checksums:       %t\n", p.Checksums)
+	fmt.Printf("    two-level index: %t\n", p.TwoLevelIndex)
+	if p.FilterPolicy != "" {
+		fmt.Printf("    filter:          %s (%s)\n", p.FilterPolicy, p.FilterType)
+	}
+	fileNums := make([]int, 0, len(p.ValueLogRefs))
+	for fileNum := range p.ValueLogRefs {
+		fileNums = append(fileNums, fileNum)
+	}
+	slices.Sort(fileNums)
+	for _, fileNum := range fileNums {
+		fmt.Printf("    value log %d:    %d bytes\n", fileNum, p.ValueLogRefs[fileNum])
+	}
+}
+
+func printKVs(r *sstable.Reader) error {
+	e := encoder.NewEncoder()
+	fmt.Printf("  kv-pairs:\n")
+	return r.ScanAll(func(key, val []byte) error {
+		ev := e.Parse(val)
+		if !ev.Valid() {
+			return errors.New("malformed value")
+		}
+		switch {
+		case ev.IsTombstone():
+			fmt.Printf("    %q seq %d%s DEL\n", key, ev.SeqNum(), at(ev))
+		case ev.IsValuePointer():
+			p, err := vlog.DecodePointer(ev.Value())
+			if err != nil {
+				return err
+			}
+			fmt.Printf("    %q seq %d%s SET -> value log %d offset %d length %d\n", key, ev.SeqNum(), at(ev), p.FileNum, p.Offset, p.Length)
+		default:
+			v := ev.Value()
+			suffix := ""
+			if *maxValueLen > 0 && len(v) > *maxValueLen {
+				v, suffix = v[:*maxValueLen], fmt.Sprintf("... (%d bytes)", len(ev.Value()))
+			}
+			fmt.Printf("    %q seq %d%s SET %q%s\n", key, ev.SeqNum(), at(ev), v, suffix)
+		}
+		return nil
+	})
+}
+
+// at returns the time a kv-pair was written at, if it has a timestamp.
+func at(ev *encoder.EncodedValue) string {
+	if ev.Timestamp() == 0 {
+		return ""
+	}
+	return " at " + time.Unix(0, ev.Timestamp()).Format(time.RFC3339Nano)
+}
@@ -0,0 +1,166 @@
+// Command waldump prints the records of WAL files with the chunks they are made of, and reports
+// where a log stops being readable, e.g. at a write torn by a crash. With -truncate, a log is cut
+// back to its last readable record.
+//
+//	waldump [-chunks] [-truncate] [-offset n] file.log...
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"lsm/encoder"
+	"lsm/vlog"
+	"lsm/wal"
+	"os"
+	"time"
+)
+
+var (
+	showChunks  = flag.Bool("chunks", false, "print the chunks of every record")
+	truncate    = flag.Bool("truncate", false, "truncate a log with a corrupt chunk to its last readable record")
+	maxValueLen = flag.Int("max-value", 64, "bytes of a value printed, 0 for all of them")
+	startOffset = flag.Int64("offset", 0, "offset of the record to start at, e.g. one printed before")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: waldump [flags] file.log...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	ok := true
+	for _, path := range flag.Args() {
+		if err := dump(path); err != nil {
+			log.Printf("%s: %v", path, err)
+			ok = false
+		}
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+func dump(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	fmt.Printf("%s: %d bytes\n", path, info.Size())
+	r := wal.NewReaderAt(f, *startOffset)
+	records := 0
+	for {
+		cfID, key, val, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			if !errors.Is(err, wal.ErrCorruptChunk) && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			return corrupt(path, r, err, records, info.Size())
+		}
+		records++
+		fmt.Printf("  %8d-%-8d cf %d seq %d%s %s\n", r.RecordOffset(), r.Offset(), cfID, val.SeqNum(), at(val), describe(key, val))
+		if *showChunks {
+			printChunks(r.Chunks())
+		}
+	}
+	f.Close()
+	fmt.Printf("  %d records, readable up to the end of the log\n", records)
+	return nil
+}
+
+// corrupt reports a log that stops being readable at a corrupt chunk, or ends in the middle of
+// a record, and truncates it with -truncate.
+func corrupt(path string, r *wal.Reader, err error, records int, size int64) error {
+	chunks := r.Chunks()
+	if err == io.ErrUnexpectedEOF {
+		fmt.Printf("  incomplete record at the end of the log, with the chunks:\n")
+		printChunks(chunks)
+		err = fmt.Errorf("incomplete record at offset %d", r.Offset())
+	} else {
+		bad := chunks[len(chunks)-1]
+		fmt.Printf("  corrupt %s chunk (%d bytes) at offset %d\n", bad.Type, bad.Length, bad.Offset)
+		if len(chunks) > 1 {
+			fmt.Printf("  earlier chunks of its record:\n")
+			printChunks(chunks[:len(chunks)-1])
+		}
+		err = fmt.Errorf("corrupt chunk at offset %d", bad.Offset)
+	}
+	lost := size - r.Offset()
+	fmt.Printf("  %d records, readable up to offset %d, the %d bytes after it are lost\n", records, r.Offset(), lost)
+	if !*truncate {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err = f.Truncate(r.Offset()); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("  truncated to %d bytes\n", r.Offset())
+	return nil
+}
+
+// at returns the time a record was written at, if it has a timestamp.
+func at(val *encoder.EncodedValue) string {
+	if val.Timestamp() == 0 {
+		return ""
+	}
+	return " at " + time.Unix(0, val.Timestamp()).Format(time.RFC3339Nano)
+}
+
+func printChunks(chunks []wal.Chunk) {
+	for _, c := range chunks {
+		fmt.Printf("      chunk at %d: %s, %d bytes", c.Offset, c.Type, c.Length)
+		if c.Compression != wal.NoCompression {
+			fmt.Printf(" (%s)", c.Compression)
+		}
+		fmt.Println()
+	}
+}
+
+// describe returns the op kind, key and value of a record.
+func describe(key []byte, val *encoder.EncodedValue) string {
+	switch {
+	case val.IsTombstone():
+		return fmt.Sprintf("DEL %q", key)
+	case val.IsRangeTombstone():
+		return fmt.Sprintf("DELRANGE [%q, %q)", key, val.Value())
+	case val.IsValuePointer():
+		p, err := vlog.DecodePointer(val.Value())
+		if err != nil {
+			return fmt.Sprintf("SET %q -> malformed value log pointer", key)
+		}
+		return fmt.Sprintf("SET %q -> value log %d offset %d length %d", key, p.FileNum, p.Offset, p.Length)
+	case !val.Valid():
+		return fmt.Sprintf("unknown op kind %q", key)
+	}
+	v, suffix := val.Value(), ""
+	if *maxValueLen > 0 && len(v) > *maxValueLen {
+		v, suffix = v[:*maxValueLen], fmt.Sprintf("... (%d bytes)", len(val.Value()))
+	}
+	return fmt.Sprintf("SET %q %q%s", key, v, suffix)
+}
@@ -0,0 +1,66 @@
+package comparer
+
+import "bytes"
+
+// Compare returns -1, 0 or +1 depending on whether a is smaller than, equal to or larger than b.
+type Compare func(a, b []byte) int
+
+// Comparer defines the order of keys. The same Comparer has to be used for the whole lifetime
+// of a data directory: it orders the memtables, the data and index blocks of SSTables and the
+// key ranges of the levels.
+type Comparer struct {
+	Compare Compare
+
+	// Separator appends to dst a key k with a <= k < b, given a < b. SSTable index blocks store
+	// such keys between adjacent data blocks, so a short k keeps the index small. Appending a
+	// itself is always correct.
+	Separator func(dst, a, b []byte) []byte
+
+	// Successor appends to dst a key k >= a. The index entry of the last data block of an
+	// SSTable is such a key. Appending a itself is always correct.
+	Successor func(dst, a []byte) []byte
+
+	// Name identifies the order. It is stored in every SSTable, which can't be opened
+	// with a Comparer of a different name.
+	Name string
+}
+
+// Default orders keys lexicographically by their bytes.
+var Default = &Comparer{
+	Compare:   bytes.Compare,
+	Separator: bytewiseSeparator,
+	Successor: bytewiseSuccessor,
+	Name:      "lsm.BytewiseComparator",
+}
+
+// bytewiseSeparator shortens a to its common prefix with b plus one incremented byte,
+// e.g. "abcd" and "abzz" give "abd".
+func bytewiseSeparator(dst, a, b []byte) []byte {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	// a is a prefix of b, nothing to shorten
+	if n >= len(a) || n >= len(b) {
+		return append(dst, a...)
+	}
+	if c := a[n]; c < 0xff && c+1 < b[n] {
+		dst = append(dst, a[:n+1]...)
+		dst[len(dst)-1]++
+		return dst
+	}
+	return append(dst, a...)
+}
+
+// bytewiseSuccessor shortens a to its first byte that isn't 0xff, incremented,
+// e.g. "abc" gives "b".
+func bytewiseSuccessor(dst, a []byte) []byte {
+	for i, c := range a {
+		if c != 0xff {
+			dst = append(dst, a[:i+1]...)
+			dst[len(dst)-1]++
+			return dst
+		}
+	}
+	return append(dst, a...)
+}
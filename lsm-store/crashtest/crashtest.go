@@ -0,0 +1,257 @@
+// Package crashtest checks that the DB never loses an acknowledged write, nor brings back a
+// deleted key. It runs random workloads against a DB on an in-memory file system with injected
+// faults, crashes it at a random point, between two writes or right before a random write or
+// sync of the file system, dropping every write that wasn't synced, reopens it and verifies the
+// data, over and over.
+//
+// The workload, the faults and the crash points are picked from the seed, so a failing seed
+// replays the same run, as long as flushes and compactions, which run in the background, are
+// scheduled the same way: a crash point is counted in writes and syncs, whichever goroutine
+// issues them.
+package crashtest
+
+import (
+	"errors"
+	"fmt"
+	"lsm/db"
+	"lsm/storage"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+const (
+	dataDir     = "/db"
+	openRetries = 20 // attempts to open the DB while reads are failing on purpose
+)
+
+// Config describes a run. Zero values are replaced by defaults.
+type Config struct {
+	Seed int64
+	// Rounds is the number of times the DB is crashed and reopened.
+	Rounds int
+	// Ops is the maximum number of writes per round. Every round crashes after a random
+	// number of them.
+	Ops int
+	// Keys is the size of the keyspace, small enough for keys to be overwritten often.
+	Keys int
+	// IOCrashes is the probability of a round crashing right before a random write or sync of
+	// the file system (see storage.FaultFS.CrashAt), in the middle of a write, a flush or a
+	// compaction, rather than after its last write.
+	IOCrashes float64
+	// PartialReads is the probability of a read returning less than asked for while the DB is
+	// reopened (see storage.FaultFS.SetPartialReads).
+	PartialReads float64
+	// Options are the options of the DB. FS is replaced, and writes have to be synced one by
+	// one (WALSync = wal.SyncPerCommit, the default) for every acknowledged write to be
+	// durable. By default, memtables are small so that flushes and compactions run often.
+	Options *db.Options
+}
+
+func (c *Config) ensureDefaults() {
+	if c.Rounds <= 0 {
+		c.Rounds = 20
+	}
+	if c.Ops <= 0 {
+		c.Ops = 2000
+	}
+	if c.Keys <= 0 {
+		c.Keys = 500
+	}
+	if c.Options == nil {
+		c.Options = &db.Options{MemtableSizeLimit: 8 << 10, ValueLogThreshold: 256, ValueLogFileSize: 64 << 10}
+	}
+}
+
+// Result sums up a successful run.
+type Result struct {
+	Writes       int // acknowledged writes
+	FailedWrites int // writes that returned an error, which may or may not have survived
+	Faults       int // faults injected
+	IOCrashes    int // rounds crashed in the middle of I/O
+}
+
+// version is a possible state of a key: its value, or deleted.
+type version struct {
+	val     string
+	deleted bool
+}
+
+// model tracks the states every key may be found in after a crash: the last acknowledged
+// write, and any failed writes after it.
+type model map[string][]version
+
+func (m model) ack(key string, v version) {
+	m[key] = []version{v}
+}
+
+func (m model) fail(key string, v version) {
+	if len(m[key]) == 0 {
+		m[key] = []version{{deleted: true}}
+	}
+	m[key] = append(m[key], v)
+}
+
+// record records a write that returned err.
+func (m model) record(key string, v version, err error) {
+	if err != nil {
+		m.fail(key, v)
+	} else {
+		m.ack(key, v)
+	}
+}
+
+// Run runs the workload described by cfg and returns an error describing the first write
+// the DB lost (or brought back), or the first failure to recover, and the crash before it.
+func Run(cfg Config) (*Result, error) {
+	cfg.ensureDefaults()
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	res := &Result{}
+	mem := storage.NewMemFS()
+	m := make(model)
+	crash := "no crash"
+
+	for round := 0; round < cfg.Rounds; round++ {
+		faults := storage.NewFaultFS(mem, rng.Int63())
+		opts := *cfg.Options
+		opts.FS = faults
+
+		d, err := open(&opts, faults, cfg.PartialReads)
+		if err != nil {
+			return res, fmt.Errorf("round %d, after %s: %w", round, crash, err)
+		}
+		if err := verify(d, m, cfg.Keys); err != nil {
+			d.Close()
+			return res, fmt.Errorf("round %d, after %s: %w", round, crash, err)
+		}
+
+		// the writes acknowledged from now on have to survive the crash of the round
+		ops := 1 + rng.Intn(cfg.Ops)
+		if rng.Intn(2) == 0 {
+			faults.FailSync(1 + rng.Intn(ops))
+		}
+		crashAt := 0
+		if rng.Float64() < cfg.IOCrashes {
+			// a write is a write and a sync of the WAL, plus its share of flushes and compactions
+			crashAt = 1 + rng.Intn(3*ops)
+			faults.CrashAt(crashAt)
+		}
+		for i := 0; i < ops && !faults.Crashed(); i++ {
+			if err := write(d, m, rng, cfg.Keys, round, i); err != nil {
+				res.FailedWrites++
+				continue
+			}
+			res.Writes++
+		}
+
+		crash = fmt.Sprintf("a crash after %d writes", ops)
+		if faults.Crashed() {
+			crash = fmt.Sprintf("a crash at write or sync %d", crashAt)
+			res.IOCrashes++
+		}
+		mem = faults.Crash()
+		res.Faults += faults.Injected()
+		// the crashed DB can't change the file system anymore, closing it only stops its goroutines
+		d.Close()
+	}
+	return res, nil
+}
+
+// write writes a random key, deletes it, or deletes a few keys in a row, and records the
+// outcome in m.
+func write(d *db.DB, m model, rng *rand.Rand, keys, round, op int) error {
+	k := rng.Intn(keys)
+	key := fmt.Sprintf("key%06d", k)
+	switch n := rng.Intn(20); {
+	case n == 0:
+		// deleted keys must not come back from older tables, WAL files or the value log
+		end := min(k+1+rng.Intn(10), keys)
+		err := d.DeleteRange([]byte(key), []byte(fmt.Sprintf("key%06d", end)), nil)
+		for ; k < end; k++ {
+			m.record(fmt.Sprintf("key%06d", k), version{deleted: true}, err)
+		}
+		return err
+	case n < 4:
+		err := d.Delete([]byte(key), nil)
+		m.record(key, version{deleted: true}, err)
+		return err
+	default:
+		v := version{val: randomValue(rng, round, op)}
+		err := d.Set([]byte(key), []byte(v.val), nil)
+		m.record(key, v, err)
+		return err
+	}
+}
+
+// open opens the DB while reads fail with probability partialReads, and retries as long as
+// it fails because of an injected fault. Opening reads every table, so the probability is
+// halved with every attempt for a large DB to open eventually.
+func open(opts *db.Options, faults *storage.FaultFS, partialReads float64) (d *db.DB, err error) {
+	defer faults.SetPartialReads(0)
+	for i := 0; i < openRetries; i++ {
+		faults.SetPartialReads(partialReads)
+		d, err = db.Open(dataDir, opts)
+		if !errors.Is(err, storage.ErrInjected) {
+			break
+		}
+		partialReads /= 2
+	}
+	if err != nil {
+		return nil, fmt.Errorf("recovery failed: %w", err)
+	}
+	return d, nil
+}
+
+// verify checks that every key is in one of the states the model allows, and collapses them
+// to the one found, which is durable from now on.
+func verify(d *db.DB, m model, keys int) error {
+	for k := 0; k < keys; k++ {
+		key := fmt.Sprintf("key%06d", k)
+		val, err := d.Get([]byte(key))
+		if err != nil && !errors.Is(err, db.ErrKeyNotFound) {
+			return fmt.Errorf("get %s: %w", key, err)
+		}
+		found := version{val: string(val), deleted: err != nil}
+		allowed := m[key]
+		if len(allowed) == 0 {
+			allowed = []version{{deleted: true}}
+		}
+		ok := false
+		for _, v := range allowed {
+			ok = ok || v == found
+		}
+		if !ok {
+			return fmt.Errorf("%s is %s, expected %s", key, found, describe(allowed))
+		}
+		if !found.deleted || len(m[key]) > 0 {
+			m.ack(key, found)
+		}
+	}
+	return nil
+}
+
+func (v version) String() string {
+	if v.deleted {
+		return "deleted"
+	}
+	return fmt.Sprintf("%.20q (%d bytes)", v.val, len(v.val))
+}
+
+func describe(versions []version) string {
+	s := make([]string, len(versions))
+	for i, v := range versions {
+		s[i] = v.String()
+	}
+	sort.Strings(s)
+	return strings.Join(s, " or ")
+}
+
+// randomValue returns a value unique to the write, some of them large enough for the value log.
+func randomValue(rng *rand.Rand, round, op int) string {
+	prefix := fmt.Sprintf("r%d-op%d-", round, op)
+	n := rng.Intn(64)
+	if rng.Intn(10) == 0 {
+		n = 256 + rng.Intn(1024)
+	}
+	return prefix + strings.Repeat("x", n)
+}
@@ -0,0 +1,31 @@
+package crashtest_test
+
+import (
+	"lsm/crashtest"
+	"testing"
+)
+
+// TestCrashRecovery runs the crash recovery test with fixed seeds: crashes in the middle of
+// I/O, failed syncs and partial reads during recovery, with the DB reopened and verified after
+// every crash. Short runs crash a few times, over fewer writes.
+func TestCrashRecovery(t *testing.T) {
+	rounds, ops := 20, 2000
+	if testing.Short() {
+		rounds, ops = 5, 300
+	}
+	for _, seed := range []int64{1, 2, 3} {
+		res, err := crashtest.Run(crashtest.Config{
+			Seed:         seed,
+			Rounds:       rounds,
+			Ops:          ops,
+			IOCrashes:    0.5,
+			PartialReads: 0.05,
+		})
+		if err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		if res.Writes == 0 {
+			t.Fatalf("seed %d: no write acknowledged", seed)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"lsm/encoder"
+)
+
+// ErrUnresolvedValuePointer is returned by ApplyWALRecord for a record pointing into the value
+// log of the DB it was read from, which ResolveValue has to turn into a value first.
+var ErrUnresolvedValuePointer = errors.New("db: WAL record points into the value log of another DB")
+
+// ApplyWALRecord applies a record read from the WAL of another DB (e.g. by a wal.Tailer), as a
+// follower replicating that DB does: the write is made like any other, but keeps the sequence
+// number and the timestamp of the record. A record that isn't newer than the last write is
+// skipped, as it has been applied already, and one of a column family that doesn't exist is
+// dropped, like during a replay. Writes of its own mixed with applied records would break the
+// order of the sequence numbers, so a DB records are applied to is only meant to be read.
+func (d *DB) ApplyWALRecord(cfID uint32, key []byte, val *encoder.EncodedValue, opts *WriteOptions) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.maybeStallWrite(context.Background()); err != nil {
+		return err
+	}
+	cf := d.columnFamily("", cfID)
+	if cf == nil || val.SeqNum() <= d.seqNum {
+		return nil
+	}
+	d.applying = val
+	defer func() { d.applying = nil }()
+	switch {
+	case val.IsTombstone():
+		if _, pointer, ok := val.DeletedValue(); ok && pointer {
+			return ErrUnresolvedValuePointer
+		}
+		return cf.delete(key, opts)
+	case val.IsRangeTombstone():
+		return cf.deleteRange(key, val.Value(), opts)
+	case val.IsValuePointer():
+		return ErrUnresolvedValuePointer
+	case val.IsMerge() || !val.Valid():
+		return fmt.Errorf("db: record of %q has a malformed value or an unknown op kind", key)
+	}
+	return cf.set(key, val.Value(), opts)
+}
+
+// ResolveValue returns the value of a record read from the WAL of the DB (e.g. by a
+// wal.Tailer), reading it from the value log if the record points to it. The value log file
+// may have been deleted by then, once the value was no longer needed.
+func (d *DB) ResolveValue(val *encoder.EncodedValue) ([]byte, error) {
+	if ptr, pointer, ok := val.DeletedValue(); ok && pointer {
+		// a tombstone keeping a pointer to the value it deleted keeps the value itself instead
+		deleted, err := d.readValue(ptr)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{encoder.SoftDeleteValue}, deleted...), nil
+	}
+	return d.resolveValue(val)
+}
@@ -0,0 +1,234 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"lsm/encoder"
+	"lsm/storage"
+	"lsm/vlog"
+	"math"
+	"slices"
+	"time"
+)
+
+var (
+	ErrNoWALArchive         = errors.New("db: Options.WALArchiveDir is not set")
+	ErrRecoveryTargetPassed = errors.New("db: the data directory is already past the recovery target")
+	ErrMissingValueLog      = errors.New("db: value log file missing from the data directory and the WAL archive")
+)
+
+// RecoveryTarget is the point in the history of a DB that RecoverToTime restores it to.
+// Without SeqNum and Time, every archived write is recovered.
+type RecoveryTarget struct {
+	// SeqNum is the sequence number of the last write to recover.
+	SeqNum uint64
+	// Time excludes the archived WAL files sealed after it. WAL records carry no timestamps,
+	// so writes are recovered with the granularity of WAL files: the writes made shortly
+	// before Time are missing if their WAL file was sealed after it.
+	Time time.Time
+}
+
+type recovery struct {
+	RecoveryTarget
+	dir string // WAL archive
+}
+
+// retireFile deletes a WAL or value log file that is no longer needed, or moves it to
+// Options.WALArchiveDir if archiving is enabled.
+//
+// A WAL file tailers still have to read is detached rather than deleted (see TailWAL), so
+// that it is no longer replayed, but can be read until they are done with it.
+func (d *DB) retireFile(fm *storage.FileMetadata) error {
+	retain := fm.IsWAL() && d.retainForTailers(fm)
+	if d.opts.WALArchiveDir == "" {
+		if retain {
+			return d.dataStorage.DetachFile(fm)
+		}
+		return d.dataStorage.DeleteFile(fm)
+	}
+	return d.dataStorage.ArchiveFile(fm, d.opts.WALArchiveDir)
+}
+
+// RecoverToTime performs a point-in-time recovery of the DB in dirname, usually restored
+// from a backup or checkpoint taken before the point to recover to. It replays the writes
+// in the WAL files archived to opts.WALArchiveDir since then, up to target, and closes the
+// DB again.
+//
+// Writes that didn't go through the WAL (ingested files), column families created after the
+// backup and writes whose WAL or value log file hasn't been archived yet aren't recovered. The DB goes on with sequence numbers the archived writes past
+// the target already used, so the archive should be moved aside before the recovered DB is
+// opened with archiving enabled.
+func RecoverToTime(dirname string, opts *Options, target RecoveryTarget) error {
+	o := *opts.ensureDefaults()
+	if o.WALArchiveDir == "" {
+		return ErrNoWALArchive
+	}
+	// the WAL files replayed from dirname are deleted rather than added to the archive
+	// being recovered from
+	r := &recovery{RecoveryTarget: target, dir: o.WALArchiveDir}
+	o.WALArchiveDir = ""
+	d, err := open(dirname, &o, r)
+	if err != nil {
+		return err
+	}
+	return d.Close()
+}
+
+// replayArchive applies the writes of the WAL files archived to dir that are newer than the
+// DB and fall within target.
+func (d *DB) replayArchive(dir string, target RecoveryTarget) error {
+	base := d.seqNum
+	if target.SeqNum > 0 && base > target.SeqNum {
+		return ErrRecoveryTargetPassed
+	}
+	archive, err := storage.NewProvider(d.opts.FS, dir)
+	if err != nil {
+		return err
+	}
+	files, err := archive.ListFiles()
+	if err != nil {
+		return err
+	}
+	var logs []*storage.FileMetadata
+	vlogs := make(map[int]*storage.FileMetadata)
+	for _, fm := range files {
+		switch {
+		case fm.IsWAL():
+			logs = append(logs, fm)
+		case fm.IsValueLog():
+			vlogs[fm.FileNum()] = fm
+		}
+		// files created from now on must not clash with the archived ones
+		d.dataStorage.MarkFileNumUsed(fm.FileNum())
+	}
+	slices.SortFunc(logs, func(a, b *storage.FileMetadata) int { return a.FileNum() - b.FileNum() })
+
+	keep := func(val *encoder.EncodedValue) (bool, error) {
+		if val.SeqNum() <= base || (target.SeqNum > 0 && val.SeqNum() > target.SeqNum) {
+			return false, nil
+		}
+		if ptr, ok := val.ValueLogPointer(); ok {
+			p, err := vlog.DecodePointer(ptr)
+			if err != nil {
+				return false, err
+			}
+			if err := d.restoreValueLog(archive, vlogs, p); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	for _, fm := range logs {
+		if !target.Time.IsZero() {
+			info, err := d.opts.FS.Stat(archive.FilePath(fm))
+			if err != nil {
+				return err
+			}
+			if info.ModTime().After(target.Time) {
+				break
+			}
+		}
+		f, err := archive.OpenFileForReading(fm)
+		if err != nil {
+			return err
+		}
+		if err := d.replayLog(fm, f, keep); err != nil {
+			return err
+		}
+		d.opts.Logger.Infof("replayed archived WAL %d", fm.FileNum())
+	}
+	return nil
+}
+
+// restoreValueLog makes sure the data directory holds the value log file p points into, up
+// to the end of the value. Missing or partial files (the active value log file at the time
+// of a backup) are copied from the archive.
+func (d *DB) restoreValueLog(archive *storage.Provider, archived map[int]*storage.FileMetadata, p vlog.Pointer) error {
+	end := int64(p.Offset) + int64(p.Length)
+	d.vlog.mu.Lock()
+	defer d.vlog.mu.Unlock()
+	if fm, ok := d.vlog.files[p.FileNum]; ok && fm.Size() >= end {
+		return nil
+	}
+	fm, ok := archived[p.FileNum]
+	if !ok || fm.Size() < end {
+		return fmt.Errorf("%w: %d", ErrMissingValueLog, p.FileNum)
+	}
+	dst := d.dataStorage.FilePath(fm)
+	if err := d.opts.FS.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if _, _, err := copyFile(d.opts.FS, archive.FilePath(fm), dst, -1); err != nil {
+		return err
+	}
+	d.vlog.files[p.FileNum] = fm
+	return nil
+}
+
+// queueForArchiver queues the WAL segment fm, which has just been sealed, to be passed to
+// Options.WALArchiver. Until it is, fm is held on to like by a tailer.
+func (d *DB) queueForArchiver(fm *storage.FileMetadata) {
+	if d.opts.WALArchiver == nil {
+		return
+	}
+	d.tail.mu.Lock()
+	if len(d.archiver.queue) == 0 {
+		d.archiver.src.fileNum = fm.FileNum()
+	}
+	d.archiver.queue = append(d.archiver.queue, fm)
+	d.tail.mu.Unlock()
+	select {
+	case d.archiver.queued <- struct{}{}:
+	default:
+	}
+}
+
+// walArchiverLoop passes the sealed WAL segments to Options.WALArchiver in the order they were
+// sealed, until the DB is closed and there are none left.
+func (d *DB) walArchiverLoop() {
+	defer d.bg.wg.Done()
+	for {
+		var fm *storage.FileMetadata
+		d.tail.mu.Lock()
+		if len(d.archiver.queue) > 0 {
+			fm = d.archiver.queue[0]
+		}
+		d.tail.mu.Unlock()
+		if fm == nil {
+			select {
+			case <-d.bg.closing:
+				return
+			case <-d.archiver.queued:
+				continue
+			}
+		}
+		d.archiveWAL(fm, d.archiver.src.OpenSegment)
+
+		d.tail.mu.Lock()
+		d.archiver.queue = d.archiver.queue[1:]
+		d.archiver.src.fileNum = math.MaxInt
+		if len(d.archiver.queue) > 0 {
+			d.archiver.src.fileNum = d.archiver.queue[0].FileNum()
+		}
+		d.tail.mu.Unlock()
+		if err := d.releaseTailedWALs(false); err != nil {
+			d.opts.Logger.Errorf("deleting WAL files passed to the archiver failed: %v", err)
+		}
+	}
+}
+
+// archiveWAL passes the sealed WAL segment fm, opened with open, to Options.WALArchiver.
+func (d *DB) archiveWAL(fm *storage.FileMetadata, open func(*storage.FileMetadata) (storage.File, error)) {
+	if d.opts.WALArchiver == nil {
+		return
+	}
+	f, err := open(fm)
+	if err == nil {
+		err = d.opts.WALArchiver(fm, f)
+		f.Close()
+	}
+	if err != nil {
+		d.opts.Logger.Errorf("archiving WAL %d failed: %v", fm.FileNum(), err)
+	}
+}
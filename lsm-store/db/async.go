@@ -0,0 +1,119 @@
+package db
+
+import (
+	"context"
+	"lsm/wal"
+	"time"
+)
+
+const (
+	asyncQueueSize = 1024 // writes queued for the async writer before SetAsync blocks
+	maxAsyncBatch  = 128  // writes committed together with a single WAL sync
+)
+
+// asyncWrite is a write queued by SetAsync.
+type asyncWrite struct {
+	cf       *ColumnFamily
+	key, val []byte
+	start    time.Time
+	done     chan error // receives the result of the write, buffered
+}
+
+// SetAsync queues a write of key to the default column family, see ColumnFamily.SetAsync.
+func (d *DB) SetAsync(key, val []byte) <-chan error {
+	return d.defaultCF.SetAsync(key, val)
+}
+
+// SetAsync queues a write of key for the async writer and returns right away. The returned
+// channel receives the result of the write once it has been committed: the WAL append, the
+// WAL sync (depending on Options.WALSync) and the memtable insert all happen on the async
+// writer goroutine. Writes queued together share a single WAL sync (group commit), so the
+// latency of the caller doesn't depend on fsync. key and val must not be modified until the
+// result is received. Writes still queued when the DB is closed fail with ErrClosed.
+func (cf *ColumnFamily) SetAsync(key, val []byte) <-chan error {
+	d := cf.db
+	cf.trace(TraceSet, key, val, nil)
+	w := &asyncWrite{cf: cf, key: key, val: val, start: time.Now(), done: make(chan error, 1)}
+	d.async.mu.RLock()
+	defer d.async.mu.RUnlock()
+	if d.async.closed {
+		w.done <- ErrClosed
+		return w.done
+	}
+	select {
+	case d.async.ch <- w:
+	case <-d.bg.closing:
+		w.done <- ErrClosed
+	}
+	return w.done
+}
+
+// asyncWriteLoop commits the writes queued by SetAsync in batches, until the DB is closed.
+func (d *DB) asyncWriteLoop() {
+	defer close(d.async.exited)
+	batch := make([]*asyncWrite, 0, maxAsyncBatch)
+	for {
+		select {
+		case <-d.bg.closing:
+			// wait for writers that are about to queue a write, then fail the rest
+			d.async.mu.Lock()
+			d.async.closed = true
+			d.async.mu.Unlock()
+			for {
+				select {
+				case w := <-d.async.ch:
+					w.done <- ErrClosed
+				default:
+					return
+				}
+			}
+		case w := <-d.async.ch:
+			batch = append(batch[:0], w)
+		more:
+			for len(batch) < maxAsyncBatch {
+				select {
+				case w := <-d.async.ch:
+					batch = append(batch, w)
+				default:
+					break more
+				}
+			}
+			d.commitAsync(batch)
+		}
+	}
+}
+
+// commitAsync applies a batch of queued writes and syncs the WAL once for all of them. A
+// failed sync fails every write of the batch.
+func (d *DB) commitAsync(batch []*asyncWrite) {
+	errs := make([]error, len(batch))
+	d.mu.Lock()
+	err := d.maybeStallWrite(context.Background())
+	// the records of the batch are synced at once below; if the WAL is rotated in between,
+	// the old WAL file is synced as it is sealed
+	w := d.wal.w
+	w.DeferSync(true)
+	for i, aw := range batch {
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		errs[i] = aw.cf.set(aw.key, aw.val, nil)
+	}
+	w.DeferSync(false)
+	if err == nil && d.opts.WALSync == wal.SyncPerCommit {
+		if err := d.syncLogs(); err != nil {
+			for i := range errs {
+				if errs[i] == nil {
+					errs[i] = err
+				}
+			}
+		}
+	}
+	d.mu.Unlock()
+
+	for i, aw := range batch {
+		d.metrics.latency[opSet].record(aw.start)
+		aw.done <- errs[i]
+	}
+}
@@ -0,0 +1,315 @@
+package db
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"lsm/storage"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	backupIndexFileName    = "BACKUP"
+	backupManifestFileName = "MANIFEST"
+	backupFormat           = "lsm-backup 1"
+)
+
+var (
+	ErrBackupExists  = errors.New("db: backup directory already holds a backup")
+	ErrCorruptBackup = errors.New("db: corrupt backup")
+	ErrNotEmpty      = errors.New("db: target directory is not empty")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// numbers the staging directories of snapshots
+var stagingDirSeq atomic.Uint64
+
+// snapshot is a consistent view of the files of the DB. The files are hard linked into a
+// staging directory inside the data directory, so that flushes and compactions can go on
+// deleting them while they are copied.
+type snapshot struct {
+	fs       storage.VFS
+	dir      string // staging directory
+	files    []snapshotFile
+	manifest []byte
+}
+
+type snapshotFile struct {
+	name string
+	size int64 // bytes of the file that belong to the snapshot, -1 for all of them (sealed files)
+}
+
+// takeSnapshot seals the active WAL and stages every SSTable, WAL and value log file the DB
+// needs to recover its current state. Writes are blocked while the files are linked.
+func (d *DB) takeSnapshot() (*snapshot, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+	// the sealed WALs may point into the value log, which has to be durable first
+	if err := d.vlog.w.Sync(); err != nil {
+		return nil, err
+	}
+	if err := d.rotateForFlush(); err != nil {
+		return nil, err
+	}
+
+	dir, err := d.makeStagingDir()
+	if err != nil {
+		return nil, err
+	}
+	s := &snapshot{fs: d.opts.FS, dir: dir, manifest: d.encodeManifest()}
+	add := func(fm *storage.FileMetadata, size int64) error {
+		src := d.dataStorage.FilePath(fm)
+		name := filepath.Base(src)
+		if err := s.fs.Link(src, filepath.Join(dir, name)); err != nil {
+			return err
+		}
+		s.files = append(s.files, snapshotFile{name: name, size: size})
+		return nil
+	}
+
+	var logs []*storage.FileMetadata
+	for _, cf := range d.columnFamilies {
+		for _, f := range slices.Concat(cf.levels[:]...) {
+			if err := add(f, -1); err != nil {
+				s.release()
+				return nil, err
+			}
+		}
+		// the new active WAL doesn't hold any records yet
+		for _, m := range cf.memtables.queue {
+			for _, fm := range m.LogFiles() {
+				if fm != d.wal.fm && !slices.Contains(logs, fm) {
+					logs = append(logs, fm)
+				}
+			}
+		}
+	}
+	for _, fm := range logs {
+		if err := add(fm, -1); err != nil {
+			s.release()
+			return nil, err
+		}
+	}
+	d.vlog.mu.Lock()
+	defer d.vlog.mu.Unlock()
+	for _, fm := range d.vlog.files {
+		size := int64(-1)
+		if fm == d.vlog.fm {
+			size = int64(d.vlog.w.Size())
+		}
+		if err := add(fm, size); err != nil {
+			s.release()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// makeStagingDir creates a new snapshot-N.tmp directory in the data directory. Leftovers of
+// a crash are deleted on open along with the other temporary files.
+func (d *DB) makeStagingDir() (string, error) {
+	for {
+		n := stagingDirSeq.Add(1)
+		dir := filepath.Join(d.dataStorage.Dir(), fmt.Sprintf("snapshot-%d.tmp", n))
+		err := d.opts.FS.Mkdir(dir)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		return dir, err
+	}
+}
+
+// release removes the staging directory.
+func (s *snapshot) release() error {
+	return s.fs.RemoveAll(s.dir)
+}
+
+// copyFile copies the first size bytes of src (all of them if size is negative) to the new
+// file dst and syncs it. Returns the number of bytes copied and their CRC-32C.
+func copyFile(vfs storage.VFS, src, dst string, size int64) (n int64, crc uint32, err error) {
+	in, err := vfs.Open(src)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer in.Close()
+	out, err := vfs.Create(dst)
+	if err != nil {
+		return 0, 0, err
+	}
+	var r io.Reader = in
+	if size >= 0 {
+		r = io.LimitReader(in, size)
+	}
+	h := crc32.New(crcTable)
+	if n, err = io.Copy(io.MultiWriter(out, h), r); err != nil {
+		out.Close()
+		return 0, 0, err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return 0, 0, err
+	}
+	return n, h.Sum32(), out.Close()
+}
+
+// checkEmptyDir fails with ErrNotEmpty unless dir is empty or doesn't exist.
+func checkEmptyDir(vfs storage.VFS, dir string) error {
+	entries, err := vfs.List(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrNotEmpty
+	}
+	return nil
+}
+
+// Checkpoint creates a consistent copy of the DB in dir that can be opened with Open right
+// away. Unlike a backup, the copy is a regular data directory. dir must not exist or be
+// empty. Sealed files are hard linked if dir is on the same file system as the data
+// directory, and copied otherwise; only the part of the active value log file written so far
+// is copied. Writes are blocked just for as long as it takes to link the live files into a
+// staging directory.
+func (d *DB) Checkpoint(dir string) error {
+	if err := checkEmptyDir(d.opts.FS, dir); err != nil {
+		return err
+	}
+	ds, err := storage.NewProvider(d.opts.FS, dir)
+	if err != nil {
+		return err
+	}
+	s, err := d.takeSnapshot()
+	if err != nil {
+		return err
+	}
+	defer s.release()
+
+	for _, f := range s.files {
+		src, dst := filepath.Join(s.dir, f.name), filepath.Join(dir, f.name)
+		if f.size < 0 && s.fs.Link(src, dst) == nil {
+			continue
+		}
+		if _, _, err := copyFile(s.fs, src, dst, f.size); err != nil {
+			return err
+		}
+	}
+	// without a manifest, Open would treat all SSTables as L0 tables of the default column family
+	return ds.WriteManifest(s.manifest)
+}
+
+// Backup copies a consistent snapshot of the DB to dir, without blocking writes for longer
+// than it takes to hard link the live files. The snapshot consists of every live SSTable,
+// the WAL files of the memtables not yet flushed (the active WAL is sealed first), the value
+// log and the manifest. An index of the copied files with their checksums is written last,
+// so an interrupted backup is never mistaken for a complete one. Use Restore to turn a
+// backup back into a data directory.
+func (d *DB) Backup(dir string) error {
+	vfs := d.opts.FS
+	if _, err := vfs.Stat(filepath.Join(dir, backupIndexFileName)); err == nil {
+		return ErrBackupExists
+	}
+	if err := vfs.MkdirAll(dir); err != nil {
+		return err
+	}
+	s, err := d.takeSnapshot()
+	if err != nil {
+		return err
+	}
+	defer s.release()
+
+	var index strings.Builder
+	fmt.Fprintln(&index, backupFormat)
+	for _, f := range s.files {
+		n, crc, err := copyFile(vfs, filepath.Join(s.dir, f.name), filepath.Join(dir, f.name), f.size)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&index, "%s %d %08x\n", f.name, n, crc)
+	}
+	if err := storage.WriteFile(vfs, filepath.Join(dir, backupManifestFileName), s.manifest); err != nil {
+		return err
+	}
+	fmt.Fprintf(&index, "%s %d %08x\n", backupManifestFileName, len(s.manifest), crc32.Checksum(s.manifest, crcTable))
+
+	tmp := filepath.Join(dir, backupIndexFileName+".tmp")
+	if err := storage.WriteFile(vfs, tmp, []byte(index.String())); err != nil {
+		return err
+	}
+	if err := vfs.Rename(tmp, filepath.Join(dir, backupIndexFileName)); err != nil {
+		return err
+	}
+	return vfs.Sync(dir)
+}
+
+// Restore turns a backup written by DB.Backup into a data directory that can be opened with
+// Open. targetDir must not exist or be empty. Every file is verified against the checksum
+// recorded in the backup. Both directories are on the local file system; RestoreFS takes
+// another one.
+func Restore(backupDir, targetDir string) error {
+	return RestoreFS(storage.Default, backupDir, targetDir)
+}
+
+// RestoreFS is Restore for a backup and data directory on vfs.
+func RestoreFS(vfs storage.VFS, backupDir, targetDir string) error {
+	if err := checkEmptyDir(vfs, targetDir); err != nil {
+		return err
+	}
+	f, err := vfs.Open(filepath.Join(backupDir, backupIndexFileName))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() || sc.Text() != backupFormat {
+		return fmt.Errorf("%w: unknown format", ErrCorruptBackup)
+	}
+	ds, err := storage.NewProvider(vfs, targetDir)
+	if err != nil {
+		return err
+	}
+
+	var manifest []byte
+	for sc.Scan() {
+		var name string
+		var size int64
+		var crc uint32
+		if _, err := fmt.Sscanf(sc.Text(), "%s %d %x", &name, &size, &crc); err != nil {
+			return fmt.Errorf("%w: %v", ErrCorruptBackup, err)
+		}
+		src := filepath.Join(backupDir, name)
+		if name == backupManifestFileName {
+			// installed last, so an interrupted restore can't be opened
+			if manifest, err = storage.ReadFile(vfs, src); err != nil {
+				return err
+			}
+			if int64(len(manifest)) != size || crc32.Checksum(manifest, crcTable) != crc {
+				return fmt.Errorf("%w: %s doesn't match its checksum", ErrCorruptBackup, name)
+			}
+			continue
+		}
+		n, c, err := copyFile(vfs, src, filepath.Join(targetDir, filepath.Base(name)), -1)
+		if err != nil {
+			return err
+		}
+		if n != size || c != crc {
+			return fmt.Errorf("%w: %s doesn't match its checksum", ErrCorruptBackup, name)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if manifest == nil {
+		return fmt.Errorf("%w: no manifest", ErrCorruptBackup)
+	}
+	return ds.WriteManifest(manifest)
+}
@@ -0,0 +1,277 @@
+package db
+
+import (
+	"bytes"
+	"io"
+	"lsm/encoder"
+	"lsm/sstable"
+	"lsm/storage"
+	"slices"
+)
+
+const defaultBulkLoadBufferSize = 4 << 20 // 4 MiB
+
+// BulkSource is the input of BulkLoad: a stream of kv-pairs in any order, which may repeat
+// keys (the last value of a key wins). It is walked as a bufio.Scanner: Next advances to the
+// following kv-pair and returns false at the end of the stream or on error, which Error returns.
+// Key and Value may reuse their buffers on the following call to Next.
+type BulkSource interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Error() error
+}
+
+type BulkLoadOptions struct {
+	// BufferSize is the number of bytes of kv-pairs sorted in memory at once. Larger inputs are
+	// sorted in runs of BufferSize bytes, merged at the end. Defaults to 4 MiB.
+	BufferSize int
+}
+
+// BulkLoad writes the kv-pairs of src to the default column family, bypassing the WAL and the
+// memtables.
+func (d *DB) BulkLoad(src BulkSource, opts *BulkLoadOptions) error {
+	return d.defaultCF.BulkLoad(src, opts)
+}
+
+// BulkLoad writes the kv-pairs of src to the column family, bypassing the WAL and the
+// memtables: they are sorted in memory in runs of BulkLoadOptions.BufferSize bytes, written to
+// temporary SSTables, then merged into the SSTables of the column family. These are installed
+// all at once, as by IngestExternalFile: reads either see none or all of the kv-pairs, which
+// are newer than every write so far. Writes are only paused while the memtables are flushed,
+// and the background worker is busy with the final merge until it is done.
+//
+// Nothing is installed before the end. If BulkLoad fails, or the process crashes meanwhile,
+// the temporary tables are deleted (on the following Open after a crash), and loading the same
+// input again starts over from a clean state. As the kv-pairs aren't logged, replicas tailing
+// the WAL (see TailWAL) don't receive them.
+func (cf *ColumnFamily) BulkLoad(src BulkSource, opts *BulkLoadOptions) error {
+	d := cf.db
+	bufferSize := defaultBulkLoadBufferSize
+	if opts != nil && opts.BufferSize > 0 {
+		bufferSize = opts.BufferSize
+	}
+	d.mu.Lock()
+	err := cf.checkWritable()
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	runs, err := d.writeBulkRuns(src, bufferSize)
+	defer func() {
+		for _, r := range runs {
+			d.dataStorage.DeleteTempFile(r)
+		}
+	}()
+	if err != nil || len(runs) == 0 {
+		return err
+	}
+	return d.runInBackground(func() error {
+		return d.bulkLoad(cf, runs)
+	})
+}
+
+type bulkKV struct {
+	key, val []byte
+}
+
+// writeBulkRuns sorts the kv-pairs of src in runs of about bufferSize bytes, each written to a
+// temporary SSTable. Run i has the sequence number i+1, so that the newer values of a key win
+// when the runs are merged. Returns the runs written, even on error, so that they can be
+// deleted.
+func (d *DB) writeBulkRuns(src BulkSource, bufferSize int) (runs []*storage.FileMetadata, err error) {
+	var buf []bulkKV
+	size := 0
+	flush := func() error {
+		if len(buf) == 0 {
+			return nil
+		}
+		run, err := d.writeBulkRun(buf, uint64(len(runs)+1))
+		if run != nil {
+			runs = append(runs, run)
+		}
+		buf, size = buf[:0], 0
+		return err
+	}
+	for src.Next() {
+		// src may reuse the buffers of its kv-pairs
+		kv := bulkKV{key: bytes.Clone(src.Key()), val: bytes.Clone(src.Value())}
+		if kv.val == nil {
+			kv.val = []byte{}
+		}
+		buf = append(buf, kv)
+		if size += len(kv.key) + len(kv.val); size >= bufferSize {
+			if err := flush(); err != nil {
+				return runs, err
+			}
+		}
+	}
+	if err := src.Error(); err != nil {
+		return runs, err
+	}
+	return runs, flush()
+}
+
+// writeBulkRun sorts kvs and writes them to a temporary SSTable, keeping the last value of
+// every key.
+func (d *DB) writeBulkRun(kvs []bulkKV, seqNum uint64) (meta *storage.FileMetadata, err error) {
+	// stable, so that the last of the values of a key comes last
+	slices.SortStableFunc(kvs, func(a, b bulkKV) int {
+		return d.cmp(a.key, b.key)
+	})
+	meta = d.dataStorage.PrepareNewSSTFile()
+	f, err := d.dataStorage.CreateTempFile(meta)
+	if err != nil {
+		return nil, err
+	}
+	w := sstable.NewWriter(d.throttle(f), d.opts.sstableOptions())
+	e := encoder.NewEncoder()
+	d.mu.Lock()
+	timestamp := d.timestamp()
+	d.mu.Unlock()
+	for i, kv := range kvs {
+		if i+1 < len(kvs) && d.cmp(kv.key, kvs[i+1].key) == 0 {
+			continue // overwritten
+		}
+		if err = w.Add(kv.key, e.EncodeTimestamped(encoder.OpKindSet, seqNum, timestamp, kv.val)); err != nil {
+			f.Close()
+			return meta, err
+		}
+	}
+	if err = w.Finish(); err != nil {
+		f.Close()
+		return meta, err
+	}
+	return meta, w.Close()
+}
+
+// bulkLoad runs on the background worker. As with ingest, the memtables are flushed first,
+// then the runs are merged into SSTables of the sequence number of the bulk load, installed at
+// the lowest level that keeps them below newer data.
+func (d *DB) bulkLoad(cf *ColumnFamily, runs []*storage.FileMetadata) error {
+	d.mu.Lock()
+	if err := cf.checkUsable(); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	d.bg.ingesting = true
+	err := d.rotateForFlush()
+	seqNum := d.nextSeqNum()
+	d.mu.Unlock()
+	if err == nil {
+		err = d.flushMemtables()
+	}
+	d.mu.Lock()
+	d.bg.ingesting = false
+	d.bg.cond.Broadcast()
+	d.mu.Unlock()
+	if err != nil {
+		return d.fail(err)
+	}
+
+	outputs, err := d.mergeBulkRuns(runs, seqNum)
+	if err != nil {
+		for _, f := range outputs {
+			d.dataStorage.DeleteFile(f)
+			d.dataStorage.DeleteTempFile(f)
+		}
+		return err
+	}
+	d.mu.Lock()
+	if err := cf.checkUsable(); err != nil {
+		d.mu.Unlock()
+		for _, f := range outputs {
+			d.dataStorage.DeleteFile(f)
+		}
+		return err
+	}
+	// the outputs don't overlap one another, and all go to the same level
+	smallest, largest := outputs[0].SmallestKey(), outputs[len(outputs)-1].LargestKey()
+	level := cf.ingestLevel(smallest, largest)
+	cf.levels[level] = append(cf.levels[level], outputs...)
+	if level > 0 {
+		slices.SortFunc(cf.levels[level], func(a, b *storage.FileMetadata) int {
+			return d.cmp(a.SmallestKey(), b.SmallestKey())
+		})
+	}
+	if err := d.writeManifest(); err != nil {
+		d.failLocked(err)
+		d.mu.Unlock()
+		return err
+	}
+	d.mu.Unlock()
+	d.opts.Logger.Infof("bulk loaded %d runs into column family %q as %d sstables of L%d", len(runs), cf.name, len(outputs), level)
+	d.offloadTables(level, outputs)
+	return nil
+}
+
+// mergeBulkRuns merges the runs into SSTables of about TargetFileSize bytes each, assigning
+// every kv-pair the sequence number seqNum.
+func (d *DB) mergeBulkRuns(runs []*storage.FileMetadata, seqNum uint64) (outputs []*storage.FileMetadata, err error) {
+	var iters []internalIterator
+	for _, run := range runs {
+		it, err := d.newBulkRunIter(run)
+		if err != nil {
+			for _, it := range iters {
+				it.Close()
+			}
+			return nil, err
+		}
+		iters = append(iters, it)
+	}
+	iter := newMergingIter(d.cmp, iters...)
+	defer iter.Close()
+
+	e := encoder.NewEncoder()
+	mw := sstable.NewMergeWriter(sstable.MergeWriterOptions{
+		Options:        d.opts.sstableOptions(),
+		TargetFileSize: d.opts.TargetFileSize,
+		Create: func() (io.Writer, error) {
+			meta := d.dataStorage.PrepareNewSSTFile()
+			f, err := d.dataStorage.CreateTempFile(meta)
+			if err != nil {
+				return nil, err
+			}
+			outputs = append(outputs, meta)
+			return d.throttle(f), nil
+		},
+		Finished: func(props sstable.Properties, size int64) error {
+			meta := outputs[len(outputs)-1]
+			if err := d.dataStorage.CommitTempFile(meta); err != nil {
+				return err
+			}
+			meta.SetKeyRange(props.SmallestKey, props.LargestKey)
+			meta.SetNumEntries(props.NumEntries)
+			meta.SetSize(size)
+			return nil
+		},
+		Filter: func(key, val []byte) ([]byte, bool, error) {
+			ev := iter.encoder.Parse(val)
+			return e.EncodeTimestamped(encoder.OpKindSet, seqNum, ev.Timestamp(), ev.Value()), true, nil
+		},
+	})
+	if err = mw.AddIter(iter); err != nil {
+		return outputs, err
+	}
+	return outputs, mw.Finish()
+}
+
+// newBulkRunIter opens a run, which is still a temporary file.
+func (d *DB) newBulkRunIter(run *storage.FileMetadata) (*tableIter, error) {
+	f, err := d.dataStorage.OpenDetachedFile(run)
+	if err != nil {
+		return nil, err
+	}
+	r, err := sstable.NewReader(f, d.opts.sstableOptions())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	it, err := r.NewIter()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &tableIter{Iterator: it, release: func() { r.Close() }}, nil
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrCASConflict is matched by the CASConflictError of a CAS finding another value than the
+// expected one.
+var ErrCASConflict = errors.New("db: compare-and-swap conflict")
+
+// CASConflictError is returned by CAS when the key doesn't hold the expected value.
+type CASConflictError struct {
+	Key []byte
+	// Current is the value the key holds, nil if Exists is false.
+	Current []byte
+	Exists  bool
+}
+
+func (e *CASConflictError) Error() string {
+	if !e.Exists {
+		return fmt.Sprintf("%v: key %q doesn't exist", ErrCASConflict, e.Key)
+	}
+	return fmt.Sprintf("%v: key %q holds another value", ErrCASConflict, e.Key)
+}
+
+func (e *CASConflictError) Is(target error) bool {
+	return target == ErrCASConflict
+}
+
+// CAS sets key to new in the default column family if it holds expectedOld.
+func (d *DB) CAS(key, expectedOld, new []byte, opts *WriteOptions) error {
+	return d.defaultCF.CAS(key, expectedOld, new, opts)
+}
+
+// CAS (compare-and-swap) sets key to new if its value is expectedOld, and returns a
+// *CASConflictError otherwise. A nil expectedOld expects the key not to exist, and a nil new
+// deletes it. The value is read and written under the lock of the writers, so no write falls
+// in between: CAS is enough for counters, locks and leases. The lock is held while the value
+// is looked up, which may mean reading SSTables, stalling the other writes meanwhile.
+func (cf *ColumnFamily) CAS(key, expectedOld, new []byte, opts *WriteOptions) error {
+	d := cf.db
+	cf.traceCAS(key, expectedOld, new, opts)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.maybeStallWrite(context.Background()); err != nil {
+		return err
+	}
+	if err := cf.checkUsable(); err != nil {
+		return err
+	}
+	// holding d.mu keeps the SSTables of the current version from being deleted, as the
+	// compactions replacing them have to install their outputs first
+	encodedVal, rangeDelSeqNum, i, found := cf.getFromMemtables(key)
+	cur, err := cf.lookup(key, encodedVal, rangeDelSeqNum, i, found, cf.sstablesForKey(key), nil)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return err
+	}
+	exists := err == nil
+	if exists != (expectedOld != nil) || !bytes.Equal(cur, expectedOld) {
+		return &CASConflictError{Key: key, Current: cur, Exists: exists}
+	}
+	if new == nil {
+		return cf.delete(key, opts)
+	}
+	return cf.set(key, new, opts)
+}
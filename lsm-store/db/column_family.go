@@ -0,0 +1,178 @@
+package db
+
+import (
+	"errors"
+	"lsm/memtable"
+	"lsm/storage"
+	"slices"
+)
+
+// DefaultColumnFamily is the name of the column family that the DB's own read and write
+// methods operate on. It always exists and can't be dropped.
+const DefaultColumnFamily = "default"
+
+var (
+	ErrColumnFamilyExists   = errors.New("db: column family already exists")
+	ErrColumnFamilyNotFound = errors.New("db: column family not found")
+	ErrColumnFamilyDropped  = errors.New("db: column family dropped")
+
+	errDropDefaultColumnFamily = errors.New("db: the default column family can't be dropped")
+)
+
+// ColumnFamily is an independent keyspace within the DB. Every column family has its own
+// memtables and SSTables, so the same key can hold different values in different column
+// families, and dropping a column family just deletes its files. All column families share
+// the DB's WAL, sequence numbers, caches and background worker.
+type ColumnFamily struct {
+	db        *DB
+	id        uint32 // identifies the column family in WAL records and the manifest
+	name      string
+	memtables MemTables
+	levels    [numLevels][]*storage.FileMetadata // L0 from oldest to newest, L1+ sorted by key range
+	dropped   bool
+}
+
+// Name returns the name of the column family.
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// newColumnFamily registers a column family without any memtable. Must be called with d.mu held.
+func (d *DB) newColumnFamily(id uint32, name string) *ColumnFamily {
+	cf := &ColumnFamily{db: d, id: id, name: name}
+	d.columnFamilies = append(d.columnFamilies, cf)
+	d.nextCFID = max(d.nextCFID, id+1)
+	if name == DefaultColumnFamily {
+		d.defaultCF = cf
+	}
+	return cf
+}
+
+// columnFamily returns the live column family with the given name or ID (if name is empty).
+// Must be called with d.mu held.
+func (d *DB) columnFamily(name string, id uint32) *ColumnFamily {
+	for _, cf := range d.columnFamilies {
+		if (name != "" && cf.name == name) || (name == "" && cf.id == id) {
+			return cf
+		}
+	}
+	return nil
+}
+
+// CreateColumnFamily creates a new, empty column family.
+func (d *DB) CreateColumnFamily(name string) (*ColumnFamily, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+	if name == "" || d.columnFamily(name, 0) != nil {
+		return nil, ErrColumnFamilyExists
+	}
+	cf := d.newColumnFamily(d.nextCFID, name)
+	cf.rotateMemtable()
+	if err := d.writeManifest(); err != nil {
+		d.columnFamilies = d.columnFamilies[:len(d.columnFamilies)-1]
+		return nil, err
+	}
+	return cf, nil
+}
+
+// ColumnFamily returns the column family with the given name.
+func (d *DB) ColumnFamily(name string) (*ColumnFamily, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cf := d.columnFamily(name, 0)
+	if cf == nil {
+		return nil, ErrColumnFamilyNotFound
+	}
+	return cf, nil
+}
+
+// ColumnFamilies returns the names of all column families, in the order they were created.
+func (d *DB) ColumnFamilies() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make([]string, 0, len(d.columnFamilies))
+	for _, cf := range d.columnFamilies {
+		names = append(names, cf.name)
+	}
+	return names
+}
+
+// DropColumnFamily removes a column family along with all its data. Handles of the column
+// family return ErrColumnFamilyDropped from then on.
+func (d *DB) DropColumnFamily(name string) error {
+	if name == DefaultColumnFamily {
+		return errDropDefaultColumnFamily
+	}
+	d.mu.Lock()
+	if err := d.checkWritable(); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	cf := d.columnFamily(name, 0)
+	if cf == nil {
+		d.mu.Unlock()
+		return ErrColumnFamilyNotFound
+	}
+	cf.dropped = true
+	d.columnFamilies = slices.DeleteFunc(d.columnFamilies, func(c *ColumnFamily) bool { return c == cf })
+	if err := d.writeManifest(); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	// WAL files only kept around for the memtables of the dropped column family are no
+	// longer needed, its records are skipped on replay
+	var logs []*storage.FileMetadata
+	for _, m := range cf.memtables.queue {
+		for _, fm := range m.LogFiles() {
+			if fm != d.wal.fm && !d.logInUse(fm) && !slices.Contains(logs, fm) {
+				logs = append(logs, fm)
+			}
+		}
+	}
+	files := slices.Concat(cf.levels[:]...)
+	cf.memtables = MemTables{}
+	cf.levels = [numLevels][]*storage.FileMetadata{}
+	d.mu.Unlock()
+
+	for _, fm := range logs {
+		if err := d.retireFile(fm); err != nil {
+			return err
+		}
+	}
+	// wait for in-flight reads before deleting the SSTables
+	d.readers.Lock()
+	defer d.readers.Unlock()
+	return d.deleteTables(files)
+}
+
+// logInUse reports whether any memtable is still backed by the WAL file fm.
+// Must be called with d.mu held.
+func (d *DB) logInUse(fm *storage.FileMetadata) bool {
+	for _, cf := range d.columnFamilies {
+		if slices.ContainsFunc(cf.memtables.queue, func(m *memtable.Memtable) bool {
+			return slices.Contains(m.LogFiles(), fm)
+		}) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUsable reports why the column family can't be used. Must be called with d.mu held.
+func (cf *ColumnFamily) checkUsable() error {
+	if cf.dropped {
+		return ErrColumnFamilyDropped
+	}
+	return nil
+}
+
+// rotateMemtable makes a new memtable backed by the active WAL the mutable one.
+// Must be called with d.mu held.
+func (cf *ColumnFamily) rotateMemtable() *memtable.Memtable {
+	cf.memtables.mutable = memtable.NewMemtable(cf.db.opts.MemtableSizeLimit, cf.db.wal.fm, cf.db.cmp, cf.db.opts.MemtableBackend)
+	cf.memtables.queue = append(cf.memtables.queue, cf.memtables.mutable)
+	return cf.memtables.mutable
+}
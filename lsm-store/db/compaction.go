@@ -0,0 +1,436 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"lsm/comparer"
+	"lsm/encoder"
+	"lsm/sstable"
+	"lsm/storage"
+	"slices"
+	"sort"
+)
+
+// numLevels is the number of levels in the LSM tree. L0 holds freshly flushed SSTables whose key
+// ranges may overlap, L1 and below hold SSTables with non-overlapping key ranges, each level being
+// LevelSizeMultiplier times larger than the one above it.
+const numLevels = 7
+
+// compaction merges the inputs of two adjacent levels into new SSTables on the lower one.
+type compaction struct {
+	cf     *ColumnFamily
+	level  int                        // level being compacted, outputs go to level+1
+	inputs [2][]*storage.FileMetadata // inputs from level and level+1
+}
+
+func (c *compaction) outputLevel() int {
+	return c.level + 1
+}
+
+// trivialMove reports whether the single input file can be moved down a level as is,
+// without rewriting it. Files are always rewritten into the bottom level to drop their tombstones.
+func (c *compaction) trivialMove() bool {
+	return c.level > 0 && c.outputLevel() < numLevels-1 && len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0
+}
+
+// olderLevels returns the levels below the output level, the only ones that can hold older
+// versions of the keys being compacted. Must be called with d.mu held.
+func (c *compaction) olderLevels() [][]*storage.FileMetadata {
+	return slices.Clone(c.cf.levels[c.outputLevel()+1:])
+}
+
+// containsKey reports whether any file of the levels (L1 and below, sorted by key range)
+// may contain key.
+func containsKey(cmp comparer.Compare, levels [][]*storage.FileMetadata, key []byte) bool {
+	for _, files := range levels {
+		i := sort.Search(len(files), func(i int) bool {
+			return files[i].LargestKey() != nil && cmp(files[i].LargestKey(), key) >= 0
+		})
+		if i < len(files) && files[i].MayContainKey(cmp, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// overlapsRange reports whether any file of the levels intersects [start, end].
+func overlapsRange(cmp comparer.Compare, levels [][]*storage.FileMetadata, start, end []byte) bool {
+	for _, files := range levels {
+		for _, f := range files {
+			if f.OverlapsRange(cmp, start, end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func totalSize(files []*storage.FileMetadata) int64 {
+	var size int64
+	for _, f := range files {
+		size += f.Size()
+	}
+	return size
+}
+
+// keyRange returns the smallest and largest key covered by files.
+func keyRange(cmp comparer.Compare, files []*storage.FileMetadata) (smallest, largest []byte) {
+	for _, f := range files {
+		if f.SmallestKey() == nil {
+			continue // empty table
+		}
+		if smallest == nil || cmp(f.SmallestKey(), smallest) < 0 {
+			smallest = f.SmallestKey()
+		}
+		if largest == nil || cmp(f.LargestKey(), largest) > 0 {
+			largest = f.LargestKey()
+		}
+	}
+	return smallest, largest
+}
+
+// overlappingFiles returns the files of a level whose key ranges intersect [start, end].
+func (cf *ColumnFamily) overlappingFiles(level int, start, end []byte) []*storage.FileMetadata {
+	var files []*storage.FileMetadata
+	for _, f := range cf.levels[level] {
+		if f.OverlapsRange(cf.db.cmp, start, end) {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// rangeCompaction returns the compaction of the files of a level overlapping [start, end]
+// into the next level, or nil if there are none. Must be called with d.mu held.
+func (cf *ColumnFamily) rangeCompaction(level int, start, end []byte) *compaction {
+	files := cf.overlappingFiles(level, start, end)
+	if len(files) == 0 {
+		return nil
+	}
+	c := &compaction{cf: cf, level: level, inputs: [2][]*storage.FileMetadata{files}}
+	if level == 0 {
+		// older L0 tables overlapping the chosen ones would end up above newer data
+		c.inputs[0] = slices.Clone(cf.levels[0])
+	}
+	if start, end := keyRange(cf.db.cmp, c.inputs[0]); start != nil {
+		c.inputs[1] = cf.overlappingFiles(level+1, start, end)
+	}
+	return c
+}
+
+// maybeCompact runs compactions until no level needs one anymore or the DB is closing.
+func (d *DB) maybeCompact() error {
+	for {
+		select {
+		case <-d.bg.closing:
+			return nil
+		default:
+		}
+
+		d.mu.Lock()
+		c := d.pickCompaction()
+		d.mu.Unlock()
+		if c == nil {
+			return nil
+		}
+		if err := d.runCompaction(c); err != nil {
+			return err
+		}
+	}
+}
+
+// CompactRange compacts every key of the default column family in [start, end] down to the
+// bottom level. A nil start or end leaves that side of the range unbounded.
+func (d *DB) CompactRange(start, end []byte) error {
+	return d.defaultCF.CompactRange(start, end)
+}
+
+// CompactRange flushes the memtables and compacts every key in [start, end] down to the bottom
+// level, dropping tombstones and shadowed versions on the way, e.g. to reclaim space right
+// after a bulk delete. A nil start or end leaves that side of the range unbounded. The
+// compaction is run by the background worker; CompactRange blocks until it is done.
+func (cf *ColumnFamily) CompactRange(start, end []byte) error {
+	d := cf.db
+	d.mu.Lock()
+	err := cf.checkWritable()
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return d.runInBackground(func() error {
+		return d.compactRange(cf, start, end)
+	})
+}
+
+// compactRange runs a manual compaction on the background worker: the memtables are flushed,
+// and the files of the column family overlapping [start, end] are compacted into the next
+// level, level by level.
+func (d *DB) compactRange(cf *ColumnFamily, start, end []byte) error {
+	d.mu.Lock()
+	if err := cf.checkUsable(); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	err := d.rotateForFlush()
+	d.mu.Unlock()
+	if err == nil {
+		err = d.flushMemtables()
+	}
+	if err != nil {
+		return d.fail(err)
+	}
+
+	for level := 0; level < numLevels-1; level++ {
+		select {
+		case <-d.bg.closing:
+			return ErrClosed
+		default:
+		}
+		d.mu.Lock()
+		if err := cf.checkUsable(); err != nil {
+			d.mu.Unlock()
+			return err
+		}
+		c := cf.rangeCompaction(level, start, end)
+		d.mu.Unlock()
+		if c == nil {
+			continue
+		}
+		if err := d.runCompaction(c); err != nil {
+			return d.fail(err)
+		}
+	}
+	return nil
+}
+
+func (d *DB) runCompaction(c *compaction) error {
+	if c.trivialMove() {
+		installed, err := d.installCompaction(c, c.inputs[0])
+		if installed && err == nil {
+			d.opts.Logger.Infof("moved sstable %d of column family %q from L%d to L%d", c.inputs[0][0].FileNum(), c.cf.name, c.level, c.outputLevel())
+			d.offloadTables(c.outputLevel(), c.inputs[0])
+		}
+		return err
+	}
+
+	start := d.spanStart()
+	outputs, err := d.writeCompactionOutputs(c)
+	if err != nil {
+		// don't leave partially written tables behind
+		for _, f := range outputs {
+			d.dataStorage.DeleteFile(f)
+			d.dataStorage.DeleteTempFile(f)
+		}
+		return err
+	}
+	d.endSpan(SpanCompaction, start, 0, totalSize(outputs))
+	installed, err := d.installCompaction(c, outputs)
+	if err != nil {
+		return err
+	}
+	if !installed {
+		// the column family was dropped during the compaction, which deleted the inputs
+		for _, f := range outputs {
+			if err = d.dataStorage.DeleteFile(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	d.opts.Logger.Infof("compacted %d+%d sstables of column family %q from L%d into %d sstables of L%d",
+		len(c.inputs[0]), len(c.inputs[1]), c.cf.name, c.level, len(outputs), c.outputLevel())
+	d.offloadTables(c.outputLevel(), outputs)
+
+	// the inputs are no longer referenced by any level, wait for in-flight reads
+	// to finish before deleting them
+	d.readers.Lock()
+	defer d.readers.Unlock()
+	return d.deleteTables(slices.Concat(c.inputs[:]...))
+}
+
+// writeCompactionOutputs merges the input files and writes the result into new SSTables of
+// roughly TargetFileSize each. Only the newest version of every key is kept, and dropped
+// altogether if a range tombstone of the inputs deletes it. The range tombstones themselves
+// are carried over, split between the outputs so that their key ranges don't overlap.
+// Tombstones are dropped once there is nothing left for them to shadow: the inputs hold the
+// newest versions of their keys, so only the levels below the output level can still contain
+// older ones. That is always the case in the bottom level.
+// Values kept in value log files that are mostly garbage are moved to the active one.
+func (d *DB) writeCompactionOutputs(c *compaction) (outputs []*storage.FileMetadata, err error) {
+	d.mu.Lock()
+	rewrite := d.valueLogsToRewrite()
+	// the levels below the output level only change on the background worker, which is
+	// busy running this compaction
+	older := c.olderLevels()
+	d.mu.Unlock()
+
+	var iters []internalIterator
+	var rangeDels []encoder.RangeTombstone
+	for _, files := range c.inputs {
+		for _, f := range files {
+			it, err := d.newTableIter(f)
+			if err != nil {
+				for _, it := range iters {
+					it.Close()
+				}
+				return nil, err
+			}
+			iters = append(iters, it)
+			rangeDels = append(rangeDels, it.rangeDels...)
+		}
+	}
+	iter := newMergingIter(d.cmp, iters...)
+	defer iter.Close()
+	var outRangeDels []encoder.RangeTombstone
+	for _, t := range rangeDels {
+		if overlapsRange(d.cmp, older, t.Start, t.End) {
+			outRangeDels = append(outRangeDels, t)
+		}
+	}
+
+	mw := sstable.NewMergeWriter(sstable.MergeWriterOptions{
+		Options:         d.opts.sstableOptions(),
+		TargetFileSize:  d.opts.TargetFileSize,
+		RangeTombstones: outRangeDels,
+		// outputs are written under a temporary name until they are finished
+		Create: func() (io.Writer, error) {
+			meta := d.dataStorage.PrepareNewSSTFile()
+			f, err := d.dataStorage.CreateTempFile(meta)
+			if err != nil {
+				return nil, err
+			}
+			outputs = append(outputs, meta)
+			return d.throttle(f), nil
+		},
+		Finished: func(props sstable.Properties, size int64) error {
+			meta := outputs[len(outputs)-1]
+			if err := d.dataStorage.CommitTempFile(meta); err != nil {
+				return err
+			}
+			meta.SetKeyRange(props.SmallestKey, props.LargestKey)
+			meta.SetValueLogRefs(props.ValueLogRefs)
+			meta.SetNumEntries(props.NumEntries)
+			meta.SetSize(size)
+			return nil
+		},
+		Filter: func(key, val []byte) ([]byte, bool, error) {
+			ev := iter.encoder.Parse(val)
+			if ev.SeqNum() < encoder.CoveringSeqNum(d.cmp, rangeDels, key) {
+				return nil, false, nil // deleted by a range tombstone
+			}
+			// a tombstone Undelete may still need is kept along with the value it kept, the
+			// others are dropped or stripped of the value
+			if ev.IsTombstone() && !d.undeletable(ev) {
+				if !containsKey(d.cmp, older, key) {
+					return nil, false, nil
+				}
+				if len(ev.Value()) > 0 {
+					val = iter.encoder.EncodeTimestamped(encoder.OpKindDelete, ev.SeqNum(), ev.Timestamp(), nil)
+				}
+			}
+			if len(rewrite) > 0 {
+				var err error
+				if val, err = d.relocateValue(key, val, rewrite); err != nil {
+					return nil, false, err
+				}
+			}
+			return val, true, nil
+		},
+	})
+	if err = mw.AddIter(iter); err != nil {
+		return outputs, err
+	}
+	if len(rewrite) > 0 {
+		// the outputs may point to moved values, which have to be durable before them
+		d.mu.Lock()
+		err = d.vlog.w.Sync()
+		d.mu.Unlock()
+		if err != nil {
+			return outputs, err
+		}
+	}
+	return outputs, mw.Finish()
+}
+
+// installCompaction replaces the inputs of the compaction with its outputs and persists the
+// new file set in the manifest. Reports false if the column family has been dropped in the
+// meantime, in which case nothing is installed.
+func (d *DB) installCompaction(c *compaction, outputs []*storage.FileMetadata) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cf := c.cf
+	if cf.dropped {
+		return false, nil
+	}
+
+	for i, files := range c.inputs {
+		level := c.level + i
+		cf.levels[level] = slices.DeleteFunc(cf.levels[level], func(f *storage.FileMetadata) bool {
+			return slices.Contains(files, f)
+		})
+	}
+	out := c.outputLevel()
+	cf.levels[out] = append(cf.levels[out], outputs...)
+	d.metrics.compactions++
+	if !c.trivialMove() {
+		for _, files := range c.inputs {
+			d.metrics.compactedBytesRead += totalSize(files)
+		}
+		d.metrics.compactedBytesWritten += totalSize(outputs)
+	}
+	slices.SortFunc(cf.levels[out], func(a, b *storage.FileMetadata) int {
+		return d.cmp(a.SmallestKey(), b.SmallestKey())
+	})
+	d.bg.cond.Broadcast()
+	return true, d.writeManifest()
+}
+
+// offloadTables moves tables just added to level to the object store of a tiered file system
+// (see storage.TieredFS), if the level is at or below Options.OffloadLevel. A table that
+// fails to upload stays on local disk, where it keeps working. Runs on the background worker.
+func (d *DB) offloadTables(level int, files []*storage.FileMetadata) {
+	if d.opts.OffloadLevel <= 0 || level < d.opts.OffloadLevel {
+		return
+	}
+	// keep the tables from being deleted (by DropColumnFamily) while they are uploaded
+	d.readers.RLock()
+	defer d.readers.RUnlock()
+	for _, f := range files {
+		offloaded, err := d.dataStorage.OffloadFile(f)
+		if err != nil {
+			d.opts.Logger.Warnf("offloading sstable %d failed: %v", f.FileNum(), err)
+			continue
+		}
+		if !offloaded {
+			return
+		}
+		d.opts.Logger.Debugf("offloaded sstable %d of L%d", f.FileNum(), level)
+	}
+}
+
+// tableIter iterates over an SSTable and releases its reader back to the table cache once done.
+// The range tombstones of the table are not applied by the iterator, but exposed separately.
+type tableIter struct {
+	*sstable.Iterator
+	rangeDels []encoder.RangeTombstone
+	release   func()
+}
+
+func (d *DB) newTableIter(meta *storage.FileMetadata) (*tableIter, error) {
+	r, release, err := d.tableCache.get(meta)
+	if err != nil {
+		return nil, err
+	}
+	it, err := r.NewIter()
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("reading index of sstable %d: %w", meta.FileNum(), err)
+	}
+	return &tableIter{Iterator: it, rangeDels: r.RangeTombstones(), release: release}, nil
+}
+
+func (t *tableIter) Close() error {
+	err := t.Iterator.Close()
+	t.release()
+	return err
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// compactLevel compacts the tables of the default column family in level into the next level,
+// on the background worker like any compaction.
+func compactLevel(t *testing.T, d *DB, level int) {
+	t.Helper()
+	err := d.runInBackground(func() error {
+		d.mu.Lock()
+		c := d.defaultCF.rangeCompaction(level, nil, nil)
+		d.mu.Unlock()
+		if c == nil {
+			return fmt.Errorf("nothing to compact in L%d", level)
+		}
+		return d.runCompaction(c)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTombstonesSurviveCompactions deletes keys, with a point or a range tombstone, whose value
+// is in L0 or in the bottom level, and compacts the tombstone from L0 into L1, then down to the
+// bottom level: the keys have to stay deleted all along, a tombstone being dropped only once
+// no level below can hold the value it deletes.
+func TestTombstonesSurviveCompactions(t *testing.T) {
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	for _, tc := range []struct {
+		name          string
+		valueAtBottom bool
+		rangeDelete   bool
+	}{
+		{"point tombstone over L0", false, false},
+		{"point tombstone over the bottom level", true, false},
+		{"range tombstone over L0", false, true},
+		{"range tombstone over the bottom level", true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, _ := openTestDB(t, nil)
+			deleted := func(step string) {
+				t.Helper()
+				for _, key := range keys {
+					if _, err := d.Get(key); !errors.Is(err, ErrKeyNotFound) {
+						t.Fatalf("%s: Get(%q) returned %v, want ErrKeyNotFound", step, key, err)
+					}
+				}
+			}
+
+			for _, key := range keys {
+				if err := d.Set(key, []byte("value"), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if tc.valueAtBottom {
+				if err := d.CompactRange(nil, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if tc.rangeDelete {
+				if err := d.DeleteRange([]byte("a"), []byte("d"), nil); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				for _, key := range keys {
+					if err := d.Delete(key, nil); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			deleted("in the memtable")
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			deleted("flushed to L0")
+			compactLevel(t, d, 0)
+			deleted("compacted into L1")
+			if err := d.CompactRange(nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			deleted("compacted into the bottom level")
+
+			// nothing is left to shadow: the tombstones are gone along with the values
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			for level, files := range d.defaultCF.levels {
+				if len(files) > 0 {
+					t.Fatalf("%d tables left in L%d", len(files), level)
+				}
+			}
+		})
+	}
+}
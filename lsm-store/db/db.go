@@ -1,21 +1,35 @@
 package db
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"lsm/cache"
+	"lsm/comparer"
 	"lsm/encoder"
 	"lsm/memtable"
+	"lsm/ratelimit"
 	"lsm/sstable"
 	"lsm/storage"
+	"lsm/vlog"
 	"lsm/wal"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-const (
-	memtableSizeLimit      = 4 << 10 // 4 KiB
-	memtableFlushThreshold = 8 << 10 // 8 KiB
-)
+var ErrClosed = errors.New("db: closed")
+
+// ErrKeyNotFound is returned by Get and MultiGet for a key that doesn't exist, or has been
+// deleted. It is sstable.ErrKeyNotFound, so that the error of every layer matches it.
+var ErrKeyNotFound = sstable.ErrKeyNotFound
+
+// ErrCorruptWAL is returned by Open for a WAL file that fails to replay cleanly, with
+// Options.ParanoidChecks or the wal.AbsoluteConsistency recovery mode.
+var ErrCorruptWAL = errors.New("db: corrupt WAL")
 
 type MemTables struct {
 	mutable *memtable.Memtable   // current mutable (read-write) memtable
@@ -23,203 +37,834 @@ type MemTables struct {
 }
 
 type DB struct {
-	memtables   MemTables
-	dataStorage *storage.Provider
+	opts *Options
+	cmp  comparer.Compare // opts.Comparer.Compare
+	// mu guards the column families (with their memtables and levels), the active WAL and
+	// seqNum. It is not held while the background worker writes SSTables to disk.
+	mu sync.Mutex
+	// readers is held (shared) by reads while they access SSTables, and exclusively while
+	// SSTables that were compacted away are deleted.
+	readers        sync.RWMutex
+	columnFamilies []*ColumnFamily // live column families, ordered by ID
+	defaultCF      *ColumnFamily
+	nextCFID       uint32
+	dataStorage    *storage.Provider
 	// DB interacts with currently active WAL file's writer
 	wal struct {
-		w  *wal.Writer
-		fm *storage.FileMetadata
+		w       *wal.Writer
+		fm      *storage.FileMetadata
+		created time.Time
+	}
+	// WAL segments sealed since Open, which tailers may follow (see TailWAL)
+	tail struct {
+		mu      sync.Mutex
+		sealed  map[int]*storage.FileMetadata // by file number
+		next    map[int]*storage.FileMetadata // the segment written after each of them, by file number
+		sources map[*walTailSource]struct{}
+		// retired segments not deleted (nor archived) before the tailers are done with them
+		retained []*storage.FileMetadata
+	}
+	// sealed WAL segments waiting to be passed to Options.WALArchiver
+	archiver struct {
+		src    *walTailSource // holds on to the first of them, guarded by tail.mu like queue
+		queue  []*storage.FileMetadata
+		queued chan struct{} // signals the archiver that queue grew
+	}
+	// decompressed data blocks shared by all SSTable readers
+	blockCache *cache.Cache
+	// open SSTable readers shared by all reads
+	tableCache *tableCache
+	// holds a token for every read worker busy searching an SSTable for a Get
+	readWorkers chan struct{}
+	vlog        valueLog
+	tables      tableRefs
+	logs        []*storage.FileMetadata
+	seqNum      uint64 // sequence number of the most recent write
+	// the record of another DB being applied by ApplyWALRecord, whose sequence number and
+	// timestamp the write takes
+	applying *encoder.EncodedValue
+
+	// paces the SSTable writes of flushes and compactions
+	limiter *ratelimit.Limiter
+
+	// background worker flushing memtables and compacting SSTables
+	bg struct {
+		ch     chan struct{} // wakes up the background worker
+		tasks  chan *bgTask
+		exited chan struct{} // closed once the background worker stops
+		// writes are paused while an ingestion flushes the memtables
+		ingesting bool
+		cond      *sync.Cond // signalled whenever a flush or compaction makes progress (stalled writers wait on it)
+		err       error      // first error hit by the background worker, returned by subsequent writes
+		closing   chan struct{}
+		closed    chan struct{} // closed once Close is done
+		wg        sync.WaitGroup
 	}
-	sstables []*storage.FileMetadata
-	logs     []*storage.FileMetadata
+	// counters behind Metrics, guarded by d.mu except for the latency histograms
+	metrics struct {
+		userBytes             int64
+		walBytes              int64 // written to WAL files that have been sealed
+		vlogBytes             int64 // written to value log files that have been sealed
+		flushes               int64
+		flushedBytes          int64
+		compactions           int64
+		compactedBytesRead    int64
+		compactedBytesWritten int64
+		latency               [numOps]latencyHistogram
+	}
+	// writes stalled so far, guarded by d.mu
+	stall struct {
+		slowed   uint64
+		stopped  uint64
+		duration time.Duration
+	}
+	// writes queued by SetAsync for the async writer
+	async struct {
+		mu     sync.RWMutex // held shared while a write is queued, exclusively once the queue is closed
+		closed bool
+		ch     chan *asyncWrite
+		exited chan struct{} // closed once the async writer stops
+	}
+	// records the operations between StartTrace and EndTrace
+	tracer atomic.Pointer[tracer]
+	closed bool
 }
 
 // After restarting our database storage engine, data previously stored on
 // disk becomes inaccessible. To prevent this, we need to load all SSTables & WAL on DB restarts.
 func (d *DB) loadFiles() error {
+	// a crash kept the WAL files detached for the archiver from being passed on, as far as
+	// they are still around
+	if d.opts.WALArchiver != nil {
+		detached, err := d.dataStorage.DetachedWALFiles()
+		if err != nil {
+			return err
+		}
+		for _, fm := range detached {
+			d.archiveWAL(fm, d.dataStorage.OpenDetachedFile)
+		}
+	}
+	// files still under a temporary name were interrupted by a crash before they were complete
+	if err := d.dataStorage.RemoveTempFiles(); err != nil {
+		return err
+	}
 	meta, err := d.dataStorage.ListFiles()
 	if err != nil {
 		return err
 	}
+	var sstables []*storage.FileMetadata
 	for _, f := range meta {
 		switch {
 		case f.IsSSTable():
-			d.sstables = append(d.sstables, f)
+			sstables = append(sstables, f)
 		case f.IsWAL():
 			d.logs = append(d.logs, f)
+		case f.IsValueLog():
+			d.vlog.files[f.FileNum()] = f
 		default:
 			continue
 		}
 	}
-	return nil
+	// the manifest tells which level each of the SSTables belongs to
+	return d.loadManifest(sstables)
+}
+
+// Open opens the database stored in dirname, creating it if necessary.
+// A nil opts uses DefaultOptions.
+func Open(dirname string, opts *Options) (*DB, error) {
+	return open(dirname, opts, nil)
 }
 
-func Open(dirname string) (*DB, error) {
-	dataStorage, err := storage.NewProvider(dirname)
+// open opens the database and, given a recovery target, replays the WAL archive up to it
+// before accepting writes.
+func open(dirname string, opts *Options, target *recovery) (*DB, error) {
+	opts = opts.ensureDefaults()
+	dataStorage, err := storage.NewProvider(opts.FS, dirname)
 	if err != nil {
 		return nil, err
 	}
-	db := &DB{dataStorage: dataStorage}
+	db := &DB{opts: opts, dataStorage: dataStorage}
+	if db.opts.DisableDirSync {
+		dataStorage.DisableDirSync()
+	}
+	db.cmp = db.opts.Comparer.Compare
+	db.blockCache = cache.New(db.opts.BlockCacheSize)
+	db.tableCache = newTableCache(db.opts.TableCacheSize, db.openTable)
+	db.readWorkers = make(chan struct{}, max(db.opts.ReadWorkers, 0))
+	db.limiter = ratelimit.NewLimiter(db.opts.BackgroundBytesPerSec)
+	db.bg.ch = make(chan struct{}, 1)
+	db.bg.tasks = make(chan *bgTask)
+	db.bg.exited = make(chan struct{})
+	db.bg.cond = sync.NewCond(&db.mu)
+	db.bg.closing = make(chan struct{})
+	db.bg.closed = make(chan struct{})
+	db.vlog.pinned = make(map[int]int)
+	db.tables.refs = make(map[int]int)
+	db.tables.obsolete = make(map[int]*storage.FileMetadata)
+	db.vlog.files = make(map[int]*storage.FileMetadata)
+	db.vlog.readers = make(map[int]storage.File)
+	db.async.ch = make(chan *asyncWrite, asyncQueueSize)
+	db.async.exited = make(chan struct{})
+	db.tail.sealed = make(map[int]*storage.FileMetadata)
+	db.tail.next = make(map[int]*storage.FileMetadata)
+	db.tail.sources = make(map[*walTailSource]struct{})
+	if db.opts.WALArchiver != nil {
+		// the archiver holds on to no segment until one is sealed
+		db.archiver.src = &walTailSource{d: db, fileNum: math.MaxInt}
+		db.tail.sources[db.archiver.src] = struct{}{}
+		db.archiver.queued = make(chan struct{}, 1)
+	}
 
 	if err = db.loadFiles(); err != nil {
 		return nil, err
 	}
 
+	// load the key ranges of all SSTables and resume the sequence numbers right after
+	// the largest one persisted to an SSTable
+	if err = db.loadSSTableProperties(); err != nil {
+		return nil, err
+	}
+
 	// replay WAL(s) right after DB loads the WAL file metadata, but before creating
 	// a write-ahead log file for the mutable memtable
 	if err = db.replayWALs(); err != nil {
 		return nil, err
 	}
+	if target != nil {
+		if err = db.replayArchive(target.dir, target.RecoveryTarget); err != nil {
+			return nil, err
+		}
+	}
 
 	// always called right before rotateMemtables, so d.wal.fm is guaranteed to
 	// contain metadata referencing the correct log file.
 	if err = db.createNewWAL(); err != nil {
 		return nil, err
 	}
+	if err = db.createNewValueLog(); err != nil {
+		return nil, err
+	}
 
 	db.rotateMemtables()
+
+	db.bg.wg.Add(1)
+	go db.backgroundLoop()
+	go db.asyncWriteLoop()
+	if db.opts.WALSync == wal.SyncPeriodic {
+		db.bg.wg.Add(1)
+		go db.periodicSyncLoop()
+	}
+	if db.opts.WALRotateInterval > 0 {
+		db.bg.wg.Add(1)
+		go db.walRotationLoop()
+	}
+	if db.opts.WALArchiver != nil {
+		db.bg.wg.Add(1)
+		go db.walArchiverLoop()
+	}
+	if db.opts.Context != nil {
+		go db.closeOnDone(db.opts.Context)
+	}
+	// levels might have outgrown their targets before the restart
+	db.scheduleFlush()
 	return db, nil
 }
 
-func (d *DB) rotateMemtables() *memtable.Memtable {
-	d.memtables.mutable = memtable.NewMemtable(memtableSizeLimit, d.wal.fm)
-	d.memtables.queue = append(d.memtables.queue, d.memtables.mutable)
-	return d.memtables.mutable
+// Close stops the background worker and seals the active WAL. Memtables that
+// haven't been flushed yet are recovered from their WAL files on the next Open.
+// Closing a DB again, or one Options.Context closed, waits for the first Close to be done
+// and returns ErrClosed.
+func (d *DB) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		<-d.bg.closed
+		return ErrClosed
+	}
+	d.closed = true
+	d.mu.Unlock()
+	defer close(d.bg.closed)
+	traceErr := d.EndTrace()
+
+	close(d.bg.closing)
+	d.bg.wg.Wait()
+
+	d.mu.Lock()
+	// wake up writers that are still stalled
+	d.bg.cond.Broadcast()
+	d.mu.Unlock()
+	<-d.async.exited
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tableCache.close()
+	// the WAL may point into the value log, which has to be durable first
+	if err := d.closeValueLog(); err != nil {
+		return err
+	}
+	if err := d.wal.w.Close(); err != nil {
+		return err
+	}
+	// tailers can't go on without the DB, they don't hold on to any segment anymore
+	return errors.Join(d.releaseTailedWALs(true), traceErr)
 }
 
-func (d *DB) prepMemtableForKV(key, val []byte) (*memtable.Memtable, error) {
-	m := d.memtables.mutable
-	if !m.HasRoomForWrite(key, val) {
-		if err := d.rotateWAL(); err != nil {
-			return nil, err
+// closeOnDone closes the DB once ctx is done (see Options.Context), unless it is closed first.
+func (d *DB) closeOnDone(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		d.opts.Logger.Infof("closing the DB: %v", context.Cause(ctx))
+		if err := d.Close(); err != nil && !errors.Is(err, ErrClosed) {
+			d.opts.Logger.Errorf("closing the DB: %v", err)
 		}
-		m = d.rotateMemtables()
+	case <-d.bg.closing:
 	}
-	return m, nil
 }
 
-func (d *DB) flushMemtables() error {
-	n := len(d.memtables.queue) - 1
-	flushable := d.memtables.queue[:n]
-	// update the queue to discard flushed memtables
-	d.memtables.queue = d.memtables.queue[n:]
-
-	for i := 0; i < len(flushable); i++ {
-		meta := d.dataStorage.PrepareNewSSTFile()
-		f, err := d.dataStorage.OpenFileForWriting(meta)
+func (d *DB) loadSSTableProperties() error {
+	var files []*storage.FileMetadata
+	for _, cf := range d.columnFamilies {
+		files = append(files, slices.Concat(cf.levels[:]...)...)
+	}
+	for _, meta := range files {
+		r, release, err := d.tableCache.get(meta)
 		if err != nil {
 			return err
 		}
-
-		w := sstable.NewWriter(f)
-		err = w.ConvertMemtableToSST(flushable[i])
+		props, err := r.Properties()
+		release()
 		if err != nil {
 			return err
 		}
+		meta.SetKeyRange(props.SmallestKey, props.LargestKey)
+		meta.SetValueLogRefs(props.ValueLogRefs)
+		meta.SetNumEntries(props.NumEntries)
+		d.seqNum = max(d.seqNum, props.LargestSeqNum)
+	}
+	return nil
+}
 
-		err = w.Close()
-		if err != nil {
-			return err
+// nextSeqNum assigns a new, monotonically increasing sequence number to a write, or the one of
+// the record being applied.
+func (d *DB) nextSeqNum() uint64 {
+	if d.applying != nil {
+		d.seqNum = d.applying.SeqNum()
+		return d.seqNum
+	}
+	d.seqNum++
+	return d.seqNum
+}
+
+// timestamp returns the timestamp recorded along with a write: the wall-clock time with
+// Options.Timestamps, 0 (none) otherwise, or the one of the record being applied.
+func (d *DB) timestamp() int64 {
+	if d.applying != nil {
+		return d.applying.Timestamp()
+	}
+	if !d.opts.Timestamps {
+		return 0
+	}
+	return time.Now().UnixNano()
+}
+
+// rotateMemtables rotates the WAL-backed memtables of all column families at once, so that
+// every memtable is backed by a single WAL file. Empty memtables are dropped rather than
+// queued for a flush. Must be called with d.mu held.
+func (d *DB) rotateMemtables() {
+	for _, cf := range d.columnFamilies {
+		if m := cf.memtables.mutable; m != nil && m.Size() == 0 {
+			cf.memtables.queue = cf.memtables.queue[:len(cf.memtables.queue)-1]
 		}
+		cf.rotateMemtable()
+	}
+}
 
-		// add the new sstable to the list of sstables
-		d.sstables = append(d.sstables, meta)
-		err = d.dataStorage.DeleteFile(flushable[i].LogFile())
-		if err != nil {
-			return err
+// prepMemtableForKV returns a memtable with enough room for the kv-pair. Must be called with d.mu held.
+func (cf *ColumnFamily) prepMemtableForKV(key, val []byte) (*memtable.Memtable, error) {
+	d := cf.db
+	if !cf.memtables.mutable.HasRoomForWrite(key, val) {
+		// stall the write if the flush worker can't keep up with the immutable memtables
+		if err := d.waitForFlushQueue(); err != nil {
+			return nil, err
+		}
+		if err := d.rotateWAL(); err != nil {
+			return nil, err
+		}
+		d.rotateMemtables()
+	} else if d.walSegmentDue() {
+		if err := d.rotateWALSegment(); err != nil {
+			return nil, err
 		}
 	}
-	return nil
+	return cf.memtables.mutable, nil
 }
 
-func (d *DB) maybeScheduleFlush() {
-	var totalSize int
-	for i := 0; i < len(d.memtables.queue); i++ {
-		totalSize += d.memtables.queue[i].Size()
+// checkWritable reports why the DB can't accept writes. Must be called with d.mu held.
+func (d *DB) checkWritable() error {
+	if d.closed {
+		return ErrClosed
 	}
-	fmt.Printf("Total size of memtables: %d\n", totalSize)
-	if totalSize > memtableFlushThreshold {
-		err := d.flushMemtables()
-		if err != nil {
-			log.Fatalf(err.Error())
-		}
+	return d.bg.err
+}
+
+// checkWritable reports why the column family can't accept writes. Must be called with d.mu held.
+func (cf *ColumnFamily) checkWritable() error {
+	if err := cf.checkUsable(); err != nil {
+		return err
+	}
+	return cf.db.checkWritable()
+}
+
+// Set inserts or overwrites the value of key in the default column family. Whether the write
+// is synced to stable storage before Set returns depends on Options.WALSync and opts.
+func (d *DB) Set(key, val []byte, opts *WriteOptions) error {
+	return d.defaultCF.Set(key, val, opts)
+}
+
+// SetContext is Set, giving up with the error of ctx if ctx is done before the write gets
+// through a write stall.
+func (d *DB) SetContext(ctx context.Context, key, val []byte, opts *WriteOptions) error {
+	return d.defaultCF.SetContext(ctx, key, val, opts)
+}
+
+// Set inserts or overwrites the value of key. Whether the write is synced to stable storage
+// before Set returns depends on Options.WALSync and opts.
+func (cf *ColumnFamily) Set(key, val []byte, opts *WriteOptions) error {
+	return cf.SetContext(context.Background(), key, val, opts)
+}
+
+// SetContext is Set, giving up with the error of ctx if ctx is done before the write gets
+// through a write stall. Once it has, the write is carried out regardless of ctx.
+func (cf *ColumnFamily) SetContext(ctx context.Context, key, val []byte, opts *WriteOptions) error {
+	d := cf.db
+	defer d.metrics.latency[opSet].record(time.Now())
+	cf.trace(TraceSet, key, val, opts)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.maybeStallWrite(ctx); err != nil {
+		return err
 	}
+	return cf.set(key, val, opts)
 }
 
-func (d *DB) Set(key, val []byte) error {
-	if err := d.wal.w.RecordInsertion(key, val); err != nil {
+// set writes a kv-pair once the write has passed the write stall. Must be called with d.mu held.
+func (cf *ColumnFamily) set(key, val []byte, opts *WriteOptions) error {
+	d := cf.db
+	if err := cf.checkWritable(); err != nil {
 		return err
 	}
-	m, err := d.prepMemtableForKV(key, val)
+	if d.separateValue(val) {
+		return cf.setSeparated(key, val, opts)
+	}
+	// the memtable (and with it the WAL) has to be rotated before the write is
+	// recorded, so that the record ends up in the log file backing its memtable
+	m, err := cf.prepMemtableForKV(key, val)
 	if err != nil {
 		return err
 	}
-	m.Insert(key, val)
+	seqNum, ts := d.nextSeqNum(), d.timestamp()
+	start, size := d.spanStart(), d.wal.w.Size()
+	if err := d.wal.w.RecordInsertion(cf.id, seqNum, ts, key, val); err != nil {
+		return err
+	}
+	d.endSpan(SpanWALAppend, start, d.wal.fm.FileNum(), d.wal.w.Size()-size)
+	if err := d.maybeSyncWAL(opts); err != nil {
+		return err
+	}
+	start = d.spanStart()
+	m.Insert(seqNum, ts, key, val)
+	d.endSpan(SpanMemtableInsert, start, 0, 0)
+	d.metrics.userBytes += int64(len(key) + len(val))
 	d.maybeScheduleFlush()
 	return nil
 }
 
-func (d *DB) Get(key []byte) ([]byte, error) {
-	// scan memtables from newest to oldest
-	for i := len(d.memtables.queue) - 1; i >= 0; i-- {
-		m := d.memtables.queue[i]
+// setSeparated appends a large value to the value log, and records only a pointer to it in
+// the WAL and the memtable. Must be called with d.mu held.
+func (cf *ColumnFamily) setSeparated(key, val []byte, opts *WriteOptions) error {
+	d := cf.db
+	// the value has to be in the value log before the WAL can point to it
+	p, err := d.appendValue(key, val)
+	if err != nil {
+		return err
+	}
+	ptr := p.Encode()
+	m, err := cf.prepMemtableForKV(key, ptr)
+	if err != nil {
+		return err
+	}
+	seqNum, ts := d.nextSeqNum(), d.timestamp()
+	start, size := d.spanStart(), d.wal.w.Size()
+	if err := d.wal.w.RecordValuePointer(cf.id, seqNum, ts, key, ptr); err != nil {
+		return err
+	}
+	d.endSpan(SpanWALAppend, start, d.wal.fm.FileNum(), d.wal.w.Size()-size)
+	if err := d.maybeSyncWAL(opts); err != nil {
+		return err
+	}
+	start = d.spanStart()
+	m.InsertValuePointer(seqNum, ts, key, p)
+	d.endSpan(SpanMemtableInsert, start, 0, 0)
+	d.metrics.userBytes += int64(len(key) + len(val))
+	d.maybeScheduleFlush()
+	return nil
+}
+
+// getFromMemtables scans memtables from newest to oldest. Besides the newest version of key
+// it returns the largest sequence number of the range tombstones covering key in the memtables
+// scanned so far; a version older than that is deleted. Must be called with d.mu held.
+func (cf *ColumnFamily) getFromMemtables(key []byte) (*encoder.EncodedValue, uint64, int, bool) {
+	var rangeDelSeqNum uint64
+	for i := len(cf.memtables.queue) - 1; i >= 0; i-- {
+		m := cf.memtables.queue[i]
+		rangeDelSeqNum = max(rangeDelSeqNum, encoder.CoveringSeqNum(cf.db.cmp, m.RangeTombstones(), key))
 		if encodedVal, ok := m.Get(key); ok {
-			if encodedVal.IsTombstone() {
-				log.Printf(`Found key "%s" marked as deleted in memtable "%d".\n`, key, i)
-				return nil, fmt.Errorf("key not found")
-			} else {
-				log.Printf(`Found key "%s" in memtable "%d" with value "%s"`, key, i, encodedVal.Value())
-				return encodedVal.Value(), nil
-			}
+			return encodedVal, rangeDelSeqNum, i, true
 		}
+	}
+	return nil, rangeDelSeqNum, 0, false
+}
 
+// sstablesForKey returns the SSTables that may contain key, ordered from newest to oldest:
+// all overlapping L0 tables first, followed by the tables of every level below. Tables of
+// the same level don't overlap, except for two neighbours sharing a boundary key, which a
+// range tombstone of the first one ends at. Must be called with d.mu held.
+func (cf *ColumnFamily) sstablesForKey(key []byte) []*storage.FileMetadata {
+	cmp := cf.db.cmp
+	var files []*storage.FileMetadata
+	for j := len(cf.levels[0]) - 1; j >= 0; j-- {
+		if cf.levels[0][j].MayContainKey(cmp, key) {
+			files = append(files, cf.levels[0][j])
+		}
+	}
+	for level := 1; level < numLevels; level++ {
+		tables := cf.levels[level]
+		// find the first table that ends at or after key
+		j, _ := slices.BinarySearchFunc(tables, key, func(f *storage.FileMetadata, key []byte) int {
+			return cmp(f.LargestKey(), key)
+		})
+		for ; j < len(tables) && tables[j].MayContainKey(cmp, key); j++ {
+			files = append(files, tables[j])
+		}
 	}
+	return files
+}
 
-	// scan sstables from newest to oldest
-	for j := len(d.sstables) - 1; j >= 0; j-- {
-		meta := d.sstables[j]
-		f, err := d.dataStorage.OpenFileForReading(meta)
-		if err != nil {
+// Get returns the value of key in the default column family.
+func (d *DB) Get(key []byte) ([]byte, error) {
+	return d.defaultCF.Get(key)
+}
+
+// GetContext is Get, giving up with the error of ctx if ctx is done before the SSTables are
+// searched.
+func (d *DB) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	return d.defaultCF.GetContext(ctx, key)
+}
+
+// GetWithOptions is GetContext, reading the SSTables as ro says.
+func (d *DB) GetWithOptions(ctx context.Context, key []byte, ro *ReadOptions) ([]byte, error) {
+	return d.defaultCF.GetWithOptions(ctx, key, ro)
+}
+
+// Get returns the value of key, or ErrKeyNotFound if it doesn't exist.
+func (cf *ColumnFamily) Get(key []byte) ([]byte, error) {
+	return cf.GetContext(context.Background(), key)
+}
+
+// GetContext is Get, giving up with the error of ctx if ctx is done before the SSTables are
+// searched, which may mean reading from disk.
+func (cf *ColumnFamily) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	return cf.GetWithOptions(ctx, key, nil)
+}
+
+// GetWithOptions is GetContext, reading the SSTables as ro says: a nil ro is the same as
+// GetContext.
+func (cf *ColumnFamily) GetWithOptions(ctx context.Context, key []byte, ro *ReadOptions) ([]byte, error) {
+	d := cf.db
+	defer d.metrics.latency[opGet].record(time.Now())
+	cf.trace(TraceGet, key, nil, nil)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// keep the SSTables from being deleted by a compaction while they are searched
+	d.readers.RLock()
+	defer d.readers.RUnlock()
+
+	d.mu.Lock()
+	if err := cf.checkUsable(); err != nil {
+		d.mu.Unlock()
+		return nil, err
+	}
+	encodedVal, rangeDelSeqNum, i, found := cf.getFromMemtables(key)
+	sstables := cf.sstablesForKey(key)
+	d.mu.Unlock()
+	if !found && len(sstables) > 0 {
+		if err := ctx.Err(); err != nil {
 			return nil, err
 		}
-		r, err := sstable.NewReader(f)
-		if err != nil {
-			log.Fatalf("unable to initialize reader")
+	}
+	return cf.lookup(key, encodedVal, rangeDelSeqNum, i, found, sstables, ro)
+}
+
+// lookup completes a Get with the outcome of getFromMemtables, searching the SSTables from
+// sstablesForKey if the memtables didn't settle it. The SSTables must be kept from being
+// deleted, by holding d.readers or d.mu.
+func (cf *ColumnFamily) lookup(key []byte, encodedVal *encoder.EncodedValue, rangeDelSeqNum uint64, i int, found bool, sstables []*storage.FileMetadata, ro *ReadOptions) ([]byte, error) {
+	d := cf.db
+	ev, source, err := cf.newestVersion(key, encodedVal, rangeDelSeqNum, i, found, sstables, ro)
+	switch {
+	case err != nil:
+		return nil, err
+	case ev == nil:
+		if source.rangeDeleted {
+			d.opts.Logger.Debugf(`Found key "%s" deleted by a range tombstone in %s.`, key, source)
 		}
-		defer r.Close()
+		return nil, ErrKeyNotFound
+	case ev.IsTombstone():
+		d.opts.Logger.Debugf(`Found key "%s" marked as deleted in %s.`, key, source)
+		return nil, ErrKeyNotFound
+	}
+	val, err := d.resolveValue(ev)
+	if err != nil {
+		return nil, err
+	}
+	d.opts.Logger.Debugf(`Found key "%s" in %s with value "%s"`, key, source, val)
+	return val, nil
+}
 
-		var encodedValue *encoder.EncodedValue
-		encodedValue, err = r.Get(key)
-		if err != nil {
-			if errors.Is(err, fmt.Errorf("key not found")) {
-				continue
-			}
-			log.Fatal(err)
+// versionSource tells where newestVersion settled a key, for the debug logs.
+type versionSource struct {
+	memtable     int  // the index of the memtable, -1 for all of them
+	fileNum      int  // the SSTable, 0 for the memtables
+	rangeDeleted bool // whether the key was deleted by a range tombstone found there
+}
+
+func (s versionSource) String() string {
+	switch {
+	case s.fileNum != 0:
+		return fmt.Sprintf(`sstable "%d"`, s.fileNum)
+	case s.memtable < 0:
+		return "memtables"
+	}
+	return fmt.Sprintf(`memtable "%d"`, s.memtable)
+}
+
+// newestVersion returns the newest version of key, tombstones included, settling it as lookup
+// does, along with where it was found. A nil version means that key doesn't exist, or was
+// deleted by a range tombstone (source.rangeDeleted).
+func (cf *ColumnFamily) newestVersion(key []byte, encodedVal *encoder.EncodedValue, rangeDelSeqNum uint64, i int, found bool, sstables []*storage.FileMetadata, ro *ReadOptions) (*encoder.EncodedValue, versionSource, error) {
+	d := cf.db
+	if found && encodedVal.SeqNum() > rangeDelSeqNum {
+		return encodedVal, versionSource{memtable: i}, nil
+	}
+	// every version of key in the SSTables is older than the range tombstone
+	if found || rangeDelSeqNum > 0 {
+		return nil, versionSource{memtable: -1, rangeDeleted: true}, nil
+	}
+
+	// settle the key from the newest sstable to the oldest
+	for _, s := range d.searchSSTables(key, sstables, ro) {
+		meta, encodedValue, rangeDelSeqNum, err := s.meta, s.encodedValue, s.rangeDelSeqNum, s.err
+		if err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return nil, versionSource{}, err
 		}
-		if encodedValue.IsTombstone() {
-			log.Printf(`Found key "%s" marked as deleted in sstable "%d".`, key, meta.FileNum())
-			return nil, errors.New("key not found")
+		source := versionSource{memtable: -1, fileNum: meta.FileNum()}
+		if err == nil && encodedValue.SeqNum() > rangeDelSeqNum {
+			return encodedValue, source, nil
 		}
-		log.Printf(`Found key "%s" in sstable "%d" with value "%s"`, key, meta.FileNum(), encodedValue.Value())
-		return encodedValue.Value(), nil
+		if err == nil || rangeDelSeqNum > 0 {
+			source.rangeDeleted = true
+			return nil, source, nil
+		}
+	}
+	return nil, versionSource{}, nil
+}
+
+// openTable opens an SSTable for reading. Its data blocks go through the shared block cache.
+// Readers are normally obtained through the table cache rather than opened directly.
+func (d *DB) openTable(meta *storage.FileMetadata) (*sstable.Reader, error) {
+	f, err := d.dataStorage.OpenFileForReading(meta)
+	if err != nil {
+		return nil, fmt.Errorf("opening sstable %d: %w", meta.FileNum(), err)
+	}
+	opts := d.opts.sstableOptions()
+	opts.BlockCache, opts.FileNum = d.blockCache, meta.FileNum()
+	if d.opts.SpanHook != nil {
+		opts.OnBlockRead = func(start time.Time, size int) {
+			d.endSpan(SpanBlockRead, start, meta.FileNum(), int64(size))
+		}
+	}
+	r, err := sstable.NewReader(f, opts)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("initializing reader for sstable %d: %w", meta.FileNum(), err)
 	}
+	return r, nil
+}
+
+// Delete removes key from the default column family.
+func (d *DB) Delete(key []byte, opts *WriteOptions) error {
+	return d.defaultCF.Delete(key, opts)
+}
+
+// DeleteContext is Delete, giving up with the error of ctx if ctx is done before the write
+// gets through a write stall.
+func (d *DB) DeleteContext(ctx context.Context, key []byte, opts *WriteOptions) error {
+	return d.defaultCF.DeleteContext(ctx, key, opts)
+}
+
+// Delete removes key by writing a tombstone for it.
+func (cf *ColumnFamily) Delete(key []byte, opts *WriteOptions) error {
+	return cf.DeleteContext(context.Background(), key, opts)
+}
 
-	return nil, fmt.Errorf("key not found")
+// DeleteContext is Delete, giving up with the error of ctx if ctx is done before the write
+// gets through a write stall. Once it has, the write is carried out regardless of ctx.
+func (cf *ColumnFamily) DeleteContext(ctx context.Context, key []byte, opts *WriteOptions) error {
+	d := cf.db
+	defer d.metrics.latency[opDelete].record(time.Now())
+	cf.trace(TraceDelete, key, nil, opts)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.maybeStallWrite(ctx); err != nil {
+		return err
+	}
+	return cf.delete(key, opts)
 }
 
-func (d *DB) Delete(key []byte) error {
-	if err := d.wal.w.RecordDeletion(key); err != nil {
+// delete writes a tombstone once the write has passed the write stall, keeping the deleted
+// value in it with Options.UndeleteWindow. Must be called with d.mu held.
+func (cf *ColumnFamily) delete(key []byte, opts *WriteOptions) error {
+	d := cf.db
+	if err := cf.checkWritable(); err != nil {
+		return err
+	}
+	m, err := cf.prepMemtableForKV(key, nil)
+	if err != nil {
 		return err
 	}
-	m, err := d.prepMemtableForKV(key, nil)
+	// preparing the memtable may release d.mu, so the value kept is looked up afterwards, and
+	// looked up again if the memtable has to be rotated to make room for it
+	payload, err := cf.undeletePayload(key)
 	if err != nil {
 		return err
 	}
-	m.InsertTombstone(key)
+	if !m.HasRoomForWrite(key, payload) {
+		if m, err = cf.prepMemtableForKV(key, payload); err != nil {
+			return err
+		}
+		if payload, err = cf.undeletePayload(key); err != nil {
+			return err
+		}
+	}
+	seqNum, ts := d.nextSeqNum(), d.timestamp()
+	if payload != nil && ts == 0 {
+		ts = time.Now().UnixNano()
+	}
+	start, size := d.spanStart(), d.wal.w.Size()
+	if err := d.wal.w.RecordSoftDeletion(cf.id, seqNum, ts, key, payload); err != nil {
+		return err
+	}
+	d.endSpan(SpanWALAppend, start, d.wal.fm.FileNum(), d.wal.w.Size()-size)
+	if err := d.maybeSyncWAL(opts); err != nil {
+		return err
+	}
+	start = d.spanStart()
+	m.InsertSoftTombstone(seqNum, ts, key, payload)
+	d.endSpan(SpanMemtableInsert, start, 0, 0)
+	d.metrics.userBytes += int64(len(key))
 	d.maybeScheduleFlush()
 	return nil
 }
 
+// DeleteRange removes every key in [start, end) from the default column family.
+func (d *DB) DeleteRange(start, end []byte, opts *WriteOptions) error {
+	return d.defaultCF.DeleteRange(start, end, opts)
+}
+
+// DeleteRange removes every key in [start, end) by writing a single range tombstone,
+// without having to look up the keys. It is a no-op if start isn't smaller than end.
+func (cf *ColumnFamily) DeleteRange(start, end []byte, opts *WriteOptions) error {
+	d := cf.db
+	defer d.metrics.latency[opDeleteRange].record(time.Now())
+	cf.trace(TraceDeleteRange, start, end, opts)
+	if d.cmp(start, end) >= 0 {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.maybeStallWrite(context.Background()); err != nil {
+		return err
+	}
+	return cf.deleteRange(start, end, opts)
+}
+
+// deleteRange writes a range tombstone once the write has passed the write stall. Must be
+// called with d.mu held.
+func (cf *ColumnFamily) deleteRange(start, end []byte, opts *WriteOptions) error {
+	d := cf.db
+	if err := cf.checkWritable(); err != nil {
+		return err
+	}
+	m, err := cf.prepMemtableForKV(start, end)
+	if err != nil {
+		return err
+	}
+	seqNum := d.nextSeqNum()
+	spanStart, size := d.spanStart(), d.wal.w.Size()
+	if err := d.wal.w.RecordRangeDeletion(cf.id, seqNum, start, end); err != nil {
+		return err
+	}
+	d.endSpan(SpanWALAppend, spanStart, d.wal.fm.FileNum(), d.wal.w.Size()-size)
+	if err := d.maybeSyncWAL(opts); err != nil {
+		return err
+	}
+	spanStart = d.spanStart()
+	m.DeleteRange(seqNum, start, end)
+	d.endSpan(SpanMemtableInsert, spanStart, 0, 0)
+	d.metrics.userBytes += int64(len(start) + len(end))
+	d.maybeScheduleFlush()
+	return nil
+}
+
+// maybeSyncWAL syncs the WAL for writes that ask for it, unless the WAL writer already
+// syncs every record on its own. Must be called with d.mu held.
+func (d *DB) maybeSyncWAL(opts *WriteOptions) error {
+	if !opts.sync() || d.opts.WALSync == wal.SyncPerCommit {
+		return nil
+	}
+	return d.syncLogs()
+}
+
+// syncLogs syncs the active value log file followed by the active WAL, so that the WAL never
+// durably points to values that aren't. Must be called with d.mu held.
+func (d *DB) syncLogs() error {
+	if err := d.vlog.w.Sync(); err != nil {
+		return err
+	}
+	return d.wal.w.Sync()
+}
+
+// periodicSyncLoop syncs the active WAL every WALSyncInterval (for wal.SyncPeriodic).
+func (d *DB) periodicSyncLoop() {
+	defer d.bg.wg.Done()
+	ticker := time.NewTicker(d.opts.WALSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.bg.closing:
+			return
+		case <-ticker.C:
+		}
+		d.mu.Lock()
+		err := d.syncLogs()
+		d.mu.Unlock()
+		if err != nil {
+			d.opts.Logger.Errorf("periodic WAL sync failed: %v", err)
+		}
+	}
+}
+
 func (d *DB) createNewWAL() error {
 	ds := d.dataStorage
 	fm := ds.PrepareNewWALFile()
@@ -227,21 +872,81 @@ func (d *DB) createNewWAL() error {
 	if err != nil {
 		return err
 	}
-	d.wal.w = wal.NewWriter(logFile)
+	d.wal.w = wal.NewWriter(d.withSyncSpans(logFile, SpanWALSync, fm.FileNum()), d.opts.WALSync)
+	d.wal.w.SetCompression(d.opts.WALCompression)
 	d.wal.fm = fm
+	d.wal.created = time.Now()
 	return nil
 }
 
+// rotateWAL seals the active WAL and starts a new one. If either fails, the DB is left
+// without a WAL to append to and stops accepting writes. Must be called with d.mu held.
 func (d *DB) rotateWAL() (err error) {
 	if err = d.wal.w.Close(); err != nil {
-		return err
+		return d.failLocked(err)
 	}
+	d.metrics.walBytes += d.wal.w.Size()
+	sealed := d.wal.fm
+	sealed.SetSize(d.wal.w.Size())
 	if err = d.createNewWAL(); err != nil {
+		return d.failLocked(err)
+	}
+	d.tail.mu.Lock()
+	d.tail.sealed[sealed.FileNum()] = sealed
+	d.tail.next[sealed.FileNum()] = d.wal.fm
+	d.tail.mu.Unlock()
+	d.queueForArchiver(sealed)
+	return nil
+}
+
+// walSegmentDue reports whether the active WAL has to be rotated before the memtables are
+// full: because it reached Options.WALMaxSize, or is older than Options.WALRotateInterval. An
+// empty WAL is never rotated. Must be called with d.mu held.
+func (d *DB) walSegmentDue() bool {
+	size := d.wal.w.Size()
+	if size == 0 {
+		return false
+	}
+	return (d.opts.WALMaxSize > 0 && size >= d.opts.WALMaxSize) ||
+		(d.opts.WALRotateInterval > 0 && time.Since(d.wal.created) >= d.opts.WALRotateInterval)
+}
+
+// rotateWALSegment seals the active WAL and starts a new one, which the mutable memtables log
+// their writes to from now on. Each of them keeps track of every WAL file it has writes in,
+// none of which is deleted before it is flushed. Must be called with d.mu held.
+func (d *DB) rotateWALSegment() error {
+	if err := d.rotateWAL(); err != nil {
 		return err
 	}
+	for _, cf := range d.columnFamilies {
+		cf.memtables.mutable.AddLogFile(d.wal.fm)
+	}
 	return nil
 }
 
+// walRotationLoop rotates the active WAL once it is older than WALRotateInterval, even if
+// there are no writes to do it, so that no write stays in an unsealed WAL file (e.g. one the
+// WAL archive doesn't have yet) for much longer.
+func (d *DB) walRotationLoop() {
+	defer d.bg.wg.Done()
+	ticker := time.NewTicker(max(d.opts.WALRotateInterval/4, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.bg.closing:
+			return
+		case <-ticker.C:
+		}
+		d.mu.Lock()
+		if d.checkWritable() == nil && d.walSegmentDue() {
+			if err := d.rotateWALSegment(); err != nil {
+				d.opts.Logger.Errorf("WAL rotation failed: %v", err)
+			}
+		}
+		d.mu.Unlock()
+	}
+}
+
 func (d *DB) replayWALs() error {
 	for _, fm := range d.logs {
 		if err := d.replayWAL(fm); err != nil {
@@ -258,46 +963,120 @@ func (d *DB) replayWAL(fm *storage.FileMetadata) error {
 	if err != nil {
 		return err
 	}
+	if err = d.replayLog(fm, f, func(*encoder.EncodedValue) (bool, error) { return true, nil }); err != nil {
+		return err
+	}
+	// the WAL file was still active, or not yet passed on, when the DB was closed
+	d.archiveWAL(fm, d.dataStorage.OpenFileForReading)
+	// every record of the WAL file is now persisted in an SSTable
+	return d.retireFile(fm)
+}
+
+// checkRecord verifies a replayed WAL record: its value has to parse, with a known op kind, its
+// sequence number has to be larger than the one of the record before it (lastSeqNum), and a
+// range deletion can't be empty.
+func (d *DB) checkRecord(key []byte, val *encoder.EncodedValue, lastSeqNum uint64) error {
+	switch {
+	case !val.Valid():
+		return fmt.Errorf("record of %q has a malformed value or an unknown op kind", key)
+	case val.SeqNum() <= lastSeqNum:
+		return fmt.Errorf("record of %q has sequence number %d after %d", key, val.SeqNum(), lastSeqNum)
+	case val.IsRangeTombstone() && d.cmp(key, val.Value()) >= 0:
+		return fmt.Errorf("range deletion [%q, %q) is empty", key, val.Value())
+	}
+	return nil
+}
+
+// replayLog applies the records of the WAL file f that keep accepts to fresh memtables and
+// flushes them, then closes f.
+func (d *DB) replayLog(fm *storage.FileMetadata, f storage.File, keep func(val *encoder.EncodedValue) (bool, error)) error {
+	defer f.Close()
 	// create a new reader for iterating the WAL file
 	r := wal.NewReader(f)
-	// prepare a new memtable to apply records to
+	// prepare new memtables to apply records to
 	d.wal.fm = fm
-	m := d.rotateMemtables()
+	d.rotateMemtables()
+	// only the newest WAL file can have been torn by a crash
+	tail := len(d.logs) > 0 && fm == d.logs[len(d.logs)-1]
+	var lastSeqNum uint64
+	skipped := 0 // corrupt chunks skipped with wal.SkipAnyCorruptRecord
 	// start processing records
 	for {
 		// fetch next record from WAL file
-		key, val, err := r.Next()
+		cfID, key, val, err := r.Next()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return err
+			corrupt := errors.Is(err, wal.ErrCorruptChunk)
+			if !corrupt && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			switch {
+			case d.opts.WALRecovery == wal.AbsoluteConsistency:
+				return fmt.Errorf("%w: %d: %v", ErrCorruptWAL, fm.FileNum(), err)
+			case d.opts.WALRecovery == wal.SkipAnyCorruptRecord && corrupt:
+				skipped++
+				continue
+			case d.opts.ParanoidChecks && !tail:
+				return fmt.Errorf("%w: %d: %v", ErrCorruptWAL, fm.FileNum(), err)
+			}
+			// a corrupt chunk is most likely a write torn by a crash, none of the
+			// records after it can be trusted
+			d.opts.Logger.Warnf("stopping replay of WAL %d at offset %d: %v", fm.FileNum(), r.Offset(), err)
+			break
+		}
+		if d.opts.ParanoidChecks {
+			if err := d.checkRecord(key, val, lastSeqNum); err != nil {
+				return fmt.Errorf("%w: %d: %v", ErrCorruptWAL, fm.FileNum(), err)
+			}
+			lastSeqNum = val.SeqNum()
 		}
 		// rotate memtable if it's full.
-		// In certain edge cases, you may end up having multiple memtables pointing to the same WAL 
-		// file. However, this is generally okay, as it's only likely to occur during a 
-		// replay operation, and memtables used during the replay process are only briefly 
+		// In certain edge cases, you may end up having multiple memtables pointing to the same WAL
+		// file. However, this is generally okay, as it's only likely to occur during a
+		// replay operation, and memtables used during the replay process are only briefly
 		// kept in memory.
+		cf := d.columnFamily("", cfID)
+		if cf == nil {
+			continue // the column family has been dropped
+		}
+		if ok, err := keep(val); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		m := cf.memtables.mutable
 		if !m.HasRoomForWrite(key, val.Value()) {
-			d.rotateMemtables()
+			m = cf.rotateMemtable()
 		}
 		// apply WAL record to memtable
 		if val.IsTombstone() {
-			m.InsertTombstone(key)
+			m.InsertSoftTombstone(val.SeqNum(), val.Timestamp(), key, val.Value())
+		} else if val.IsValuePointer() {
+			p, err := vlog.DecodePointer(val.Value())
+			if err != nil {
+				return err
+			}
+			m.InsertValuePointer(val.SeqNum(), val.Timestamp(), key, p)
+		} else if val.IsRangeTombstone() {
+			m.DeleteRange(val.SeqNum(), key, val.Value())
 		} else {
-			m.Insert(key, val.Value())
+			m.Insert(val.SeqNum(), val.Timestamp(), key, val.Value())
 		}
+		d.seqNum = max(d.seqNum, val.SeqNum())
+	}
+	if skipped > 0 {
+		d.opts.Logger.Warnf("skipped %d corrupt chunks replaying WAL %d", skipped, fm.FileNum())
 	}
 	// hacky way to create a new mutable memtable and make others replayable
 	d.rotateMemtables()
 	// flush all memtables to disk
-	if err = d.flushMemtables(); err != nil {
+	if err := d.flushMemtables(); err != nil {
 		return err
 	}
-	d.memtables.queue, d.memtables.mutable = nil, nil
-	// close WAL file
-	if err = f.Close(); err != nil {
-		return err
+	for _, cf := range d.columnFamilies {
+		cf.memtables = MemTables{}
 	}
 	return nil
 }
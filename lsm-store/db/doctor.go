@@ -0,0 +1,396 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"lsm/sstable"
+	"lsm/storage"
+	"lsm/wal"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ProblemKind classifies a Problem found by Diagnose.
+type ProblemKind int
+
+const (
+	ProblemTempFile        ProblemKind = iota + 1 // left behind by a write interrupted by a crash
+	ProblemOrphanedTable                          // an SSTable the manifest doesn't list
+	ProblemMissingTable                           // an SSTable the manifest lists, but that doesn't exist
+	ProblemCorruptTable                           // an SSTable failing sstable.Reader.Verify, or disagreeing with the manifest
+	ProblemMissingValueLog                        // a value log file an SSTable points into, but that doesn't exist
+	ProblemCorruptManifest                        // a manifest that can't be decoded, or is missing
+	ProblemTornWAL                                // the newest WAL ends with an incomplete or corrupt record
+	ProblemCorruptWAL                             // an older WAL has a corrupt record
+	ProblemFlushedWAL                             // a WAL whose records are all in SSTables already
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case ProblemTempFile:
+		return "temporary file"
+	case ProblemOrphanedTable:
+		return "orphaned table"
+	case ProblemMissingTable:
+		return "missing table"
+	case ProblemCorruptTable:
+		return "corrupt table"
+	case ProblemMissingValueLog:
+		return "missing value log"
+	case ProblemCorruptManifest:
+		return "corrupt manifest"
+	case ProblemTornWAL:
+		return "torn WAL"
+	case ProblemCorruptWAL:
+		return "corrupt WAL"
+	case ProblemFlushedWAL:
+		return "flushed WAL"
+	}
+	return fmt.Sprintf("unknown(%d)", int(k))
+}
+
+// Problem is something wrong with the files of a DB.
+type Problem struct {
+	Kind ProblemKind
+	// Path is the file at fault.
+	Path   string
+	Detail string
+	// Repair describes the repair Diagnosis.Repair applies, if there is a safe one: it only
+	// deletes or cuts off what the next Open would ignore or discard anyway, or what it
+	// shouldn't replay. Advice tells what can be done otherwise.
+	Repair string
+	Advice string
+	repair func() error
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s %s: %s", p.Kind, p.Path, p.Detail)
+}
+
+// Diagnosis is the outcome of Diagnose.
+type Diagnosis struct {
+	Dir       string
+	Tables    int // SSTables checked
+	WALs      int
+	ValueLogs int
+	Problems  []Problem
+}
+
+// OK reports whether no problem was found.
+func (dg *Diagnosis) OK() bool {
+	return len(dg.Problems) == 0
+}
+
+// Repair applies the safe repairs of the problems found, and returns those it repaired. It
+// stops at the first repair failing.
+func (dg *Diagnosis) Repair() ([]Problem, error) {
+	var repaired []Problem
+	for _, p := range dg.Problems {
+		if p.repair == nil {
+			continue
+		}
+		if err := p.repair(); err != nil {
+			return repaired, fmt.Errorf("repairing %s: %w", p, err)
+		}
+		repaired = append(repaired, p)
+	}
+	return repaired, nil
+}
+
+/*
+Diagnose checks the files of the closed DB in dirname without changing anything, reading them
+like Open would but without replaying the WALs or deleting leftovers:
+
+  - temporary files left behind by a crash (Open deletes them),
+  - the manifest, and SSTables it lists but that are missing (Open fails) or that it doesn't
+    list (Open deletes them),
+  - every live SSTable with sstable.Reader.Verify, its key range against its level, and the
+    value log files it points into,
+  - every WAL, for a corrupt or incomplete record (which the replay stops at, or fails on with
+    Options.ParanoidChecks), and for records that are all in SSTables already: such a WAL
+    should have been deleted, and replaying it may bring back keys deleted since.
+
+opts are the options the DB is opened with (the file system, comparer and table options
+matter). The error is only set if the check itself couldn't run.
+*/
+func Diagnose(dirname string, opts *Options) (*Diagnosis, error) {
+	opts = opts.ensureDefaults()
+	if _, err := opts.FS.Stat(dirname); err != nil {
+		return nil, err
+	}
+	dataStorage, err := storage.NewProvider(opts.FS, dirname)
+	if err != nil {
+		return nil, err
+	}
+	dg := &Diagnosis{Dir: dirname}
+	c := &doctor{opts: opts, dataStorage: dataStorage, dg: dg}
+	if err := c.tempFiles(); err != nil {
+		return nil, err
+	}
+	files, err := dataStorage.ListFiles()
+	if err != nil {
+		return nil, err
+	}
+	var sstables, logs []*storage.FileMetadata
+	vlogs := make(map[int]bool)
+	for _, f := range files {
+		switch {
+		case f.IsSSTable():
+			sstables = append(sstables, f)
+		case f.IsWAL():
+			logs = append(logs, f)
+		case f.IsValueLog():
+			vlogs[f.FileNum()] = true
+		}
+	}
+	dg.WALs, dg.ValueLogs = len(logs), len(vlogs)
+
+	cfs, err := c.manifest(sstables)
+	if err != nil {
+		return nil, err
+	}
+	// largest sequence number in the SSTables of each column family, by ID
+	persisted := make(map[uint32]uint64)
+	for _, cf := range cfs {
+		persisted[cf.id] = 0
+	}
+	for _, cf := range cfs {
+		var prev *sstable.Properties
+		for i, mf := range cf.files {
+			props := c.table(cf, mf, sstables, vlogs)
+			if props == nil {
+				prev = nil
+				continue
+			}
+			persisted[cf.id] = max(persisted[cf.id], props.LargestSeqNum)
+			if mf.level > 0 && prev != nil && cf.files[i-1].level == mf.level &&
+				opts.Comparer.Compare(prev.LargestKey, props.SmallestKey) >= 0 {
+				c.add(Problem{Kind: ProblemCorruptTable, Path: c.path(mf.fileNum, ".sst"),
+					Detail: fmt.Sprintf("key range overlaps table %d in L%d", cf.files[i-1].fileNum, mf.level),
+					Advice: "restore the DB from a backup"})
+			}
+			prev = props
+		}
+	}
+
+	slices.SortFunc(logs, func(a, b *storage.FileMetadata) int { return a.FileNum() - b.FileNum() })
+	for i, fm := range logs {
+		// without a manifest, no record is known to be in an SSTable
+		if err := c.wal(fm, i == len(logs)-1, persisted, cfs != nil); err != nil {
+			return nil, err
+		}
+	}
+	return dg, nil
+}
+
+// doctor holds the state of Diagnose.
+type doctor struct {
+	opts        *Options
+	dataStorage *storage.Provider
+	dg          *Diagnosis
+}
+
+func (c *doctor) add(p Problem) {
+	c.dg.Problems = append(c.dg.Problems, p)
+}
+
+func (c *doctor) path(fileNum int, ext string) string {
+	return filepath.Join(c.dg.Dir, fmt.Sprintf("%06d%s", fileNum, ext))
+}
+
+// tempFiles reports the files under a temporary name.
+func (c *doctor) tempFiles() error {
+	entries, err := c.opts.FS.List(c.dg.Dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".tmp") {
+			continue
+		}
+		path := filepath.Join(c.dg.Dir, e.Name())
+		p := Problem{Kind: ProblemTempFile, Path: path, Detail: "left behind by an interrupted write"}
+		switch {
+		case strings.HasSuffix(e.Name(), ".log.tmp") && c.opts.WALArchiver != nil:
+			// the next Open passes it on to the archiver before deleting it
+			p.Detail = "WAL detached for Options.WALArchiver"
+			p.Advice = "open the DB to pass it on to the archiver"
+		case strings.HasSuffix(e.Name(), ".log.tmp"):
+			p.Detail = "WAL detached while a tailer was reading it"
+			fallthrough
+		default:
+			p.Repair = "delete it"
+			p.repair = func() error { return c.opts.FS.RemoveAll(path) }
+		}
+		c.add(p)
+	}
+	return nil
+}
+
+// manifest decodes the manifest, reports the SSTables it lists that are missing and those it
+// doesn't list, and returns its column families (nil without a usable manifest).
+func (c *doctor) manifest(sstables []*storage.FileMetadata) ([]manifestCF, error) {
+	path := filepath.Join(c.dg.Dir, "MANIFEST")
+	data, err := c.dataStorage.ReadManifest()
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		if len(sstables) > 0 {
+			c.add(Problem{Kind: ProblemCorruptManifest, Path: path,
+				Detail: fmt.Sprintf("missing, Open would take the %d SSTables for L0 tables of the default column family", len(sstables)),
+				Advice: "restore the manifest from a backup"})
+		}
+		return nil, nil
+	}
+	cfs, _, err := parseManifest(data)
+	if err == nil && !slices.ContainsFunc(cfs, func(cf manifestCF) bool { return cf.name == DefaultColumnFamily }) {
+		err = errors.New("no default column family")
+	}
+	if err != nil {
+		c.add(Problem{Kind: ProblemCorruptManifest, Path: path, Detail: err.Error(),
+			Advice: "restore the manifest from a backup"})
+		return nil, nil
+	}
+
+	listed := make(map[int]bool)
+	for _, cf := range cfs {
+		for _, mf := range cf.files {
+			listed[mf.fileNum] = true
+		}
+	}
+	for _, f := range sstables {
+		if listed[f.FileNum()] {
+			continue
+		}
+		f := f
+		c.add(Problem{Kind: ProblemOrphanedTable, Path: c.dataStorage.FilePath(f),
+			Detail: "not listed in the manifest, left behind by a flush or compaction, or of a dropped column family",
+			Repair: "delete it",
+			repair: func() error { return c.dataStorage.DeleteFile(f) }})
+	}
+	return cfs, nil
+}
+
+// table verifies a live SSTable, and returns its properties if it could be read.
+func (c *doctor) table(cf manifestCF, mf manifestFile, sstables []*storage.FileMetadata, vlogs map[int]bool) *sstable.Properties {
+	path := c.path(mf.fileNum, ".sst")
+	i := slices.IndexFunc(sstables, func(f *storage.FileMetadata) bool { return f.FileNum() == mf.fileNum })
+	if i < 0 {
+		c.add(Problem{Kind: ProblemMissingTable, Path: path,
+			Detail: fmt.Sprintf("listed in the manifest (%s L%d), Open fails", cf.name, mf.level),
+			Advice: "restore the DB from a backup"})
+		return nil
+	}
+	c.dg.Tables++
+	corrupt := func(err error) {
+		c.add(Problem{Kind: ProblemCorruptTable, Path: path, Detail: err.Error(),
+			Advice: "salvage what can be read of it with sstdump -repair, or restore the DB from a backup"})
+	}
+	f, err := c.dataStorage.OpenFileForReading(sstables[i])
+	if err != nil {
+		corrupt(err)
+		return nil
+	}
+	r, err := sstable.NewReader(f, c.opts.sstableOptions())
+	if err != nil {
+		f.Close()
+		corrupt(err)
+		return nil
+	}
+	defer r.Close()
+	props, err := r.Properties()
+	if err == nil {
+		err = r.Verify()
+	}
+	if err != nil {
+		corrupt(err)
+		return nil
+	}
+	for fileNum := range props.ValueLogRefs {
+		if !vlogs[fileNum] {
+			c.add(Problem{Kind: ProblemMissingValueLog, Path: c.path(fileNum, ".vlog"),
+				Detail: fmt.Sprintf("table %d points into it, reading its values fails", mf.fileNum),
+				Advice: "restore the DB from a backup"})
+		}
+	}
+	return props
+}
+
+// wal reads a WAL, reporting a corrupt or incomplete record, or that all of its records are in
+// SSTables already (by the largest sequence number persisted of each column family).
+func (c *doctor) wal(fm *storage.FileMetadata, newest bool, persisted map[uint32]uint64, knowPersisted bool) error {
+	path := c.dataStorage.FilePath(fm)
+	f, err := c.dataStorage.OpenFileForReading(fm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := wal.NewReader(f)
+	records, needed := 0, 0
+	for {
+		cfID, _, val, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if !errors.Is(err, wal.ErrCorruptChunk) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				return err
+			}
+			lost := fm.Size() - r.Offset()
+			p := Problem{Path: path, Detail: fmt.Sprintf("%v after %d records, the replay stops at offset %d (%d bytes lost)",
+				err, records, r.Offset(), lost)}
+			if newest {
+				// most likely a write torn by a crash, which was never acknowledged
+				offset := r.Offset()
+				p.Kind = ProblemTornWAL
+				p.Repair = fmt.Sprintf("truncate it to %d bytes", offset)
+				p.repair = func() error { return truncateFile(c.opts.FS, path, offset) }
+			} else {
+				p.Kind = ProblemCorruptWAL
+				p.Advice = "open the DB with WALRecovery set to wal.SkipAnyCorruptRecord to replay the records after it"
+			}
+			c.add(p)
+			return nil
+		}
+		records++
+		if seqNum, ok := persisted[cfID]; !knowPersisted || (ok && val.SeqNum() > seqNum) {
+			needed++
+		}
+	}
+	if records > 0 && needed == 0 {
+		c.add(Problem{Kind: ProblemFlushedWAL, Path: path,
+			Detail: fmt.Sprintf("its %d records are all in SSTables (or of dropped column families)", records),
+			Repair: "delete it",
+			repair: func() error { return c.dataStorage.DeleteFile(fm) }})
+	}
+	return nil
+}
+
+// truncateFile cuts the file at path down to its first size bytes. As VFS files can't be
+// truncated, the bytes are written to a temporary file, which is renamed over the file.
+func truncateFile(vfs storage.VFS, path string, size int64) error {
+	f, err := vfs.Open(path)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, size)
+	_, err = f.ReadAt(data, 0)
+	f.Close()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := vfs.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := storage.WriteFile(vfs, tmp, data); err != nil {
+		return err
+	}
+	if err := vfs.Rename(tmp, path); err != nil {
+		return err
+	}
+	return vfs.Sync(filepath.Dir(path))
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"lsm/storage"
+	"slices"
+)
+
+// EstimateDiskUsage returns the approximate number of bytes the SSTables of the default
+// column family use for the keys in [start, end).
+func (d *DB) EstimateDiskUsage(start, end []byte) (int64, error) {
+	return d.defaultCF.EstimateDiskUsage(start, end)
+}
+
+// EstimateDiskUsage returns the approximate number of bytes the SSTables use for the keys in
+// [start, end). A nil start or end leaves that side of the range unbounded. Tables entirely
+// within the range count with their file size, the share of the others is estimated from
+// their index blocks, without reading any data block. Memtables and the value log aren't
+// included.
+func (cf *ColumnFamily) EstimateDiskUsage(start, end []byte) (int64, error) {
+	d := cf.db
+	// keep the SSTables from being deleted by a compaction while their index is consulted
+	d.readers.RLock()
+	defer d.readers.RUnlock()
+
+	d.mu.Lock()
+	if err := cf.checkUsable(); err != nil {
+		d.mu.Unlock()
+		return 0, err
+	}
+	files := slices.Concat(cf.levels[:]...)
+	d.mu.Unlock()
+
+	var size int64
+	for _, f := range files {
+		if !f.OverlapsRange(d.cmp, start, end) {
+			continue
+		}
+		if (start == nil || d.cmp(start, f.SmallestKey()) <= 0) && (end == nil || d.cmp(f.LargestKey(), end) < 0) {
+			size += f.Size()
+			continue
+		}
+		n, err := d.estimateTableUsage(f, start, end)
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+	return size, nil
+}
+
+// estimateTableUsage returns the approximate number of bytes of an SSTable between the data
+// blocks holding start and end.
+func (d *DB) estimateTableUsage(f *storage.FileMetadata, start, end []byte) (int64, error) {
+	r, release, err := d.tableCache.get(f)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	var lo, hi int64 = 0, f.Size()
+	if start != nil {
+		lo = r.ApproximateOffset(start)
+	}
+	if end != nil {
+		hi = r.ApproximateOffset(end)
+	}
+	return max(hi-lo, 0), nil
+}
+
+// ApproximateNumKeys returns the approximate number of keys in the default column family.
+func (d *DB) ApproximateNumKeys() (uint64, error) {
+	return d.defaultCF.ApproximateNumKeys()
+}
+
+// ApproximateNumKeys returns the approximate number of keys, taken from the properties of the
+// SSTables and the number of writes to the memtables. Versions of the same key in different
+// memtables and SSTables, overwrites within a memtable and tombstones are all counted, so the
+// estimate is on the high side until compactions merge them.
+func (cf *ColumnFamily) ApproximateNumKeys() (uint64, error) {
+	d := cf.db
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := cf.checkUsable(); err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, m := range cf.memtables.queue {
+		n += uint64(m.Inserts())
+	}
+	for _, files := range cf.levels {
+		for _, f := range files {
+			n += f.NumEntries()
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,217 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"slices"
+)
+
+const (
+	exportHeader = "lsm-export 1\n"
+
+	exportRecordEnd = 0
+	exportRecordKV  = 1
+
+	// keys and values longer than that are taken for a corrupt length
+	maxExportFieldLen = 1 << 30
+	// exportFieldChunk is the most a field buffer grows by before the bytes to fill it are read
+	exportFieldChunk = 64 << 10
+)
+
+var ErrCorruptExport = errors.New("db: corrupt export")
+
+/*
+Export writes the live kv-pairs of the default column family to w, in a format independent
+of the files of the DB:
+
+	header: "lsm-export 1\n"
+	record: 0x01 | key length (uvarint) | key | value length (uvarint) | value
+	end:    0x00 | number of records (uvarint) | CRC-32C of all preceding bytes (4B, little-endian)
+
+The kv-pairs come in key order, as of the call: later writes aren't exported. Values are
+exported as read, whether or not the DB keeps them in its value log.
+*/
+func (d *DB) Export(w io.Writer) error {
+	return d.defaultCF.Export(w)
+}
+
+// Export writes the live kv-pairs of the column family to w, in the format of DB.Export.
+func (cf *ColumnFamily) Export(w io.Writer) error {
+	it, err := cf.NewIter(nil)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	bw := bufio.NewWriter(w)
+	crc := crc32.New(crcTable)
+	out := io.MultiWriter(bw, crc)
+	if _, err := io.WriteString(out, exportHeader); err != nil {
+		return err
+	}
+	var buf []byte
+	var n uint64
+	for valid := it.First(); valid; valid = it.Next() {
+		buf = append(buf[:0], exportRecordKV)
+		buf = binary.AppendUvarint(buf, uint64(len(it.Key())))
+		buf = append(buf, it.Key()...)
+		buf = binary.AppendUvarint(buf, uint64(len(it.Value())))
+		buf = append(buf, it.Value()...)
+		if _, err := out.Write(buf); err != nil {
+			return err
+		}
+		n++
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	buf = append(buf[:0], exportRecordEnd)
+	buf = binary.AppendUvarint(buf, n)
+	if _, err := out.Write(buf); err != nil {
+		return err
+	}
+	if _, err := bw.Write(binary.LittleEndian.AppendUint32(nil, crc.Sum32())); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Import loads the kv-pairs written by Export to r into the default column family.
+func (d *DB) Import(r io.Reader) error {
+	return d.defaultCF.Import(r)
+}
+
+// Import loads the kv-pairs written by Export to r into the column family, through BulkLoad:
+// they overwrite the keys already stored, all at once. The export is verified along the way,
+// and nothing is loaded if it is corrupt or truncated (ErrCorruptExport).
+func (cf *ColumnFamily) Import(r io.Reader) error {
+	src := &exportReader{r: bufio.NewReader(r)}
+	header := make([]byte, len(exportHeader))
+	if _, err := io.ReadFull(src, header); err != nil {
+		return src.corrupt(err)
+	}
+	if string(header) != exportHeader {
+		return fmt.Errorf("%w: unknown header %q", ErrCorruptExport, header)
+	}
+	return cf.BulkLoad(src, nil)
+}
+
+// exportReader reads the records of an export as a BulkSource, checksumming the bytes read.
+type exportReader struct {
+	r        *bufio.Reader
+	crc      uint32
+	n        uint64 // records read
+	key, val []byte
+	err      error
+}
+
+func (e *exportReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	e.crc = crc32.Update(e.crc, crcTable, p[:n])
+	return n, err
+}
+
+func (e *exportReader) ReadByte() (byte, error) {
+	b, err := e.r.ReadByte()
+	if err == nil {
+		e.crc = crc32.Update(e.crc, crcTable, []byte{b})
+	}
+	return b, err
+}
+
+func (e *exportReader) Next() bool {
+	if e.err != nil {
+		return false
+	}
+	kind, err := e.ReadByte()
+	if err != nil {
+		e.err = e.corrupt(err)
+		return false
+	}
+	switch kind {
+	case exportRecordKV:
+		if e.key, err = e.readField(e.key); err == nil {
+			e.val, err = e.readField(e.val)
+		}
+		if err != nil {
+			e.err = e.corrupt(err)
+			return false
+		}
+		e.n++
+		return true
+	case exportRecordEnd:
+		e.err = e.readEnd()
+		return false
+	}
+	e.err = fmt.Errorf("%w: unknown record type %d", ErrCorruptExport, kind)
+	return false
+}
+
+// readField reads a length-prefixed field into buf. The field is read a chunk at a time, buf
+// growing as its bytes arrive, so that a corrupt length doesn't allocate up to
+// maxExportFieldLen bytes before the export turns out to be truncated.
+func (e *exportReader) readField(buf []byte) ([]byte, error) {
+	n, err := binary.ReadUvarint(e)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxExportFieldLen {
+		return nil, fmt.Errorf("%w: field of %d bytes", ErrCorruptExport, n)
+	}
+	buf = buf[:0]
+	for left := int(n); left > 0; {
+		chunk := min(left, exportFieldChunk)
+		buf = slices.Grow(buf, chunk)
+		read, err := io.ReadFull(e, buf[len(buf):len(buf)+chunk])
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[:len(buf)+read]
+		left -= read
+	}
+	return buf, nil
+}
+
+// readEnd checks the end record against the records read.
+func (e *exportReader) readEnd() error {
+	n, err := binary.ReadUvarint(e)
+	if err != nil {
+		return e.corrupt(err)
+	}
+	want := e.crc
+	var sum [4]byte
+	if _, err := io.ReadFull(e.r, sum[:]); err != nil {
+		return e.corrupt(err)
+	}
+	if n != e.n {
+		return fmt.Errorf("%w: %d records, %d expected", ErrCorruptExport, e.n, n)
+	}
+	if got := binary.LittleEndian.Uint32(sum[:]); got != want {
+		return fmt.Errorf("%w: checksum mismatch", ErrCorruptExport)
+	}
+	return nil
+}
+
+// corrupt reports an export ending early as corrupt, and other read errors as they are.
+func (e *exportReader) corrupt(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: truncated", ErrCorruptExport)
+	}
+	return err
+}
+
+func (e *exportReader) Key() []byte {
+	return e.key
+}
+
+func (e *exportReader) Value() []byte {
+	return e.val
+}
+
+func (e *exportReader) Error() error {
+	return e.err
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// TestImportExport exports a DB into another, and checks that truncated and corrupt exports are
+// rejected with ErrCorruptExport.
+func TestImportExport(t *testing.T) {
+	src, _ := openTestDB(t, nil)
+	for i := 0; i < 100; i++ {
+		val := bytes.Repeat([]byte{byte(i)}, i*100)
+		if err := src.Set([]byte(fmt.Sprintf("key%03d", i)), val, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var export bytes.Buffer
+	if err := src.Export(&export); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, _ := openTestDB(t, nil)
+	if err := dst.Import(bytes.NewReader(export.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		val, err := dst.Get([]byte(fmt.Sprintf("key%03d", i)))
+		if err != nil || !bytes.Equal(val, bytes.Repeat([]byte{byte(i)}, i*100)) {
+			t.Fatalf("key%03d imported as %d bytes: %v", i, len(val), err)
+		}
+	}
+
+	data := export.Bytes()
+	flipped := bytes.Clone(data)
+	flipped[len(exportHeader)+5] ^= 0xff
+	for name, buf := range map[string][]byte{
+		"truncated in the header": data[:5],
+		"truncated in a record":   data[:len(data)/2],
+		"truncated in the end":    data[:len(data)-2],
+		"flipped byte":            flipped,
+	} {
+		d, _ := openTestDB(t, nil)
+		if err := d.Import(bytes.NewReader(buf)); !errors.Is(err, ErrCorruptExport) {
+			t.Errorf("%s: got %v, want ErrCorruptExport", name, err)
+		}
+	}
+}
+
+// TestImportCorruptFieldLength reads a record whose key claims almost maxExportFieldLen bytes,
+// followed by a few: the export is truncated, which has to be found out without allocating a
+// buffer of the length claimed.
+func TestImportCorruptFieldLength(t *testing.T) {
+	record := binary.AppendUvarint([]byte{exportRecordKV}, maxExportFieldLen-1)
+	record = append(record, "abc"...)
+	e := &exportReader{r: bufio.NewReader(bytes.NewReader(record))}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	valid := e.Next()
+	runtime.ReadMemStats(&after)
+	if valid || !errors.Is(e.err, ErrCorruptExport) {
+		t.Fatalf("Next returned %t, %v, want ErrCorruptExport", valid, e.err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Fatalf("%d bytes allocated for a truncated field", allocated)
+	}
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"errors"
+	"io/fs"
+	"lsm/storage"
+	"slices"
+)
+
+// FileKind is the kind of a file of the DB.
+type FileKind string
+
+const (
+	FileKindSSTable  FileKind = "sst"
+	FileKindWAL      FileKind = "wal"
+	FileKindValueLog FileKind = "vlog"
+)
+
+// FileInfo describes a live file of the DB.
+type FileInfo struct {
+	Kind    FileKind
+	FileNum int
+	Size    int64
+	// ColumnFamily, Level, the key range and the number of entries (tombstones included) of
+	// an SSTable.
+	ColumnFamily            string
+	Level                   int
+	SmallestKey, LargestKey []byte
+	NumEntries              uint64
+}
+
+// tableInfo describes an SSTable of a level of cf.
+func tableInfo(cf *ColumnFamily, level int, f *storage.FileMetadata) FileInfo {
+	return FileInfo{
+		Kind:         FileKindSSTable,
+		FileNum:      f.FileNum(),
+		Size:         f.Size(),
+		ColumnFamily: cf.name,
+		Level:        level,
+		SmallestKey:  f.SmallestKey(),
+		LargestKey:   f.LargestKey(),
+		NumEntries:   f.NumEntries(),
+	}
+}
+
+// LiveFiles lists the files the DB needs to recover its current state: the SSTables of every
+// column family by level, the WALs backing the memtables (the active one included) and the
+// value log files.
+func (d *DB) LiveFiles() ([]FileInfo, error) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil, ErrClosed
+	}
+	var files []FileInfo
+	for _, cf := range d.columnFamilies {
+		for level, tables := range cf.levels {
+			for _, f := range tables {
+				files = append(files, tableInfo(cf, level, f))
+			}
+		}
+	}
+	// the sizes of the sealed files are looked up once d.mu is released
+	var sealed []*storage.FileMetadata
+	for _, cf := range d.columnFamilies {
+		for _, m := range cf.memtables.queue {
+			for _, fm := range m.LogFiles() {
+				if fm != d.wal.fm && !slices.Contains(sealed, fm) {
+					sealed = append(sealed, fm)
+				}
+			}
+		}
+	}
+	active := []FileInfo{{Kind: FileKindWAL, FileNum: d.wal.fm.FileNum(), Size: d.wal.w.Size()}}
+	activeVlog := d.vlog.fm
+	activeVlogSize := int64(d.vlog.w.Size())
+	d.vlog.mu.Lock()
+	for _, fm := range d.vlog.files {
+		if fm == activeVlog {
+			active = append(active, FileInfo{Kind: FileKindValueLog, FileNum: fm.FileNum(), Size: activeVlogSize})
+		} else {
+			sealed = append(sealed, fm)
+		}
+	}
+	d.vlog.mu.Unlock()
+	d.mu.Unlock()
+
+	logs := active
+	for _, fm := range sealed {
+		info, err := d.opts.FS.Stat(d.dataStorage.FilePath(fm))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // deleted since, by a flush or a compaction
+		}
+		if err != nil {
+			return nil, err
+		}
+		kind := FileKindWAL
+		if fm.IsValueLog() {
+			kind = FileKindValueLog
+		}
+		logs = append(logs, FileInfo{Kind: kind, FileNum: fm.FileNum(), Size: info.Size()})
+	}
+	// WALs, then value log files, oldest first
+	slices.SortFunc(logs, func(a, b FileInfo) int {
+		if a.Kind != b.Kind {
+			if a.Kind == FileKindWAL {
+				return -1
+			}
+			return 1
+		}
+		return a.FileNum - b.FileNum
+	})
+	return append(files, logs...), nil
+}
@@ -0,0 +1,425 @@
+package db
+
+import (
+	"context"
+	"io"
+	"lsm/encoder"
+	"lsm/memtable"
+	"lsm/sstable"
+	"lsm/storage"
+	"math"
+	"slices"
+	"time"
+)
+
+// backgroundLoop runs in the background and flushes immutable memtables to disk whenever
+// maybeScheduleFlush asks it to, so writers don't pay the flush latency themselves. Every flush
+// is followed by the compactions it made necessary. Tasks handed over by runInBackground are
+// run here as well.
+func (d *DB) backgroundLoop() {
+	defer d.bg.wg.Done()
+	defer close(d.bg.exited)
+	for {
+		var task *bgTask
+		select {
+		case <-d.bg.closing:
+			return
+		case <-d.bg.ch:
+		case task = <-d.bg.tasks:
+		}
+		var err error
+		if task != nil {
+			task.done <- task.run()
+		} else {
+			err = d.flushMemtables()
+		}
+		if err == nil {
+			err = d.maybeCompact()
+		}
+		if err == nil {
+			err = d.deleteObsoleteValueLogs()
+		}
+		if err != nil {
+			d.fail(err)
+		}
+		d.mu.Lock()
+		failed := d.bg.err != nil
+		d.mu.Unlock()
+		if failed {
+			return
+		}
+	}
+}
+
+// bgTask is work that must not run concurrently with flushes and compactions, such as
+// CompactRange, and is therefore run by the background worker.
+type bgTask struct {
+	run  func() error
+	done chan error
+}
+
+// runInBackground has the background worker run f and waits for its result. f has to call
+// fail for errors that leave the DB unusable.
+func (d *DB) runInBackground(f func() error) error {
+	t := &bgTask{run: f, done: make(chan error, 1)}
+	select {
+	case d.bg.tasks <- t:
+		return <-t.done
+	case <-d.bg.exited:
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.checkWritable()
+	}
+}
+
+// Flush writes the memtables of every column family to L0 SSTables, the mutable ones included,
+// and returns once they are installed. Writes made meanwhile go to new memtables.
+func (d *DB) Flush() error {
+	d.mu.Lock()
+	err := d.checkWritable()
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return d.runInBackground(func() error {
+		d.mu.Lock()
+		err := d.rotateForFlush()
+		d.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if err := d.flushMemtables(); err != nil {
+			return d.fail(err)
+		}
+		return nil
+	})
+}
+
+// fail stops the DB from accepting writes after a flush or compaction error, which may have
+// left the files out of sync with the in-memory state. Returns err.
+func (d *DB) fail(err error) error {
+	d.opts.Logger.Errorf("background flush/compaction failed: %v", err)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.failLocked(err)
+}
+
+// failLocked is fail for callers holding d.mu.
+func (d *DB) failLocked(err error) error {
+	if d.bg.err == nil {
+		d.bg.err = err
+	}
+	d.bg.cond.Broadcast()
+	return err
+}
+
+// maybeScheduleFlush wakes up the flush worker once the FlushPolicy asks for a flush.
+// Must be called with d.mu held.
+func (d *DB) maybeScheduleFlush() {
+	var totalSize int
+	for _, cf := range d.columnFamilies {
+		for _, m := range cf.memtables.queue {
+			totalSize += m.Size()
+		}
+	}
+	d.opts.Logger.Debugf("Total size of memtables: %d", totalSize)
+	imm, l0 := d.backlog()
+	if d.opts.FlushPolicy.ShouldFlush(FlushState{MemtableBytes: totalSize, ImmutableMemtables: imm, L0Tables: l0}) {
+		d.scheduleFlush()
+	}
+}
+
+func (d *DB) scheduleFlush() {
+	select {
+	case d.bg.ch <- struct{}{}:
+	default:
+		// a flush is already pending
+	}
+}
+
+// waitForFlushQueue stalls the calling writer for as long as the number of immutable
+// memtables of any column family is at its limit. Must be called with d.mu held.
+func (d *DB) waitForFlushQueue() error {
+	// the write got through maybeStallWrite already, it is carried out regardless of its context
+	return d.waitForBacklog(context.Background(), func(imm, _ int) bool {
+		return imm >= d.opts.MaxImmutableMemtables
+	})
+}
+
+// maybeStallWrite throttles the calling writer while flushes and compactions fall behind:
+// it blocks as long as there are too many L0 tables and is delayed while writes are slowed
+// down. Too many immutable memtables only block writes that need a new memtable (see
+// waitForFlushQueue). It gives up with the error of ctx once ctx is done.
+// Must be called with d.mu held.
+func (d *DB) maybeStallWrite(ctx context.Context) error {
+	stall, _ := d.writeStall()
+	if _, l0 := d.backlog(); l0 >= d.opts.L0StopWritesThreshold {
+		return d.waitForBacklog(ctx, func(_, l0 int) bool {
+			return l0 >= d.opts.L0StopWritesThreshold
+		})
+	}
+	if stall != WriteStallNone {
+		// sleep without holding d.mu, so that the background worker can install its results
+		start := time.Now()
+		d.stall.slowed++
+		d.scheduleFlush()
+		d.mu.Unlock()
+		timer := time.NewTimer(d.opts.WriteSlowdownDelay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+		d.mu.Lock()
+		d.stall.duration += time.Since(start)
+		d.endSpan(SpanWriteStall, start, 0, 0)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	// writes are also paused while an ingestion flushes the memtables
+	return d.waitForBacklog(ctx, func(int, int) bool { return false })
+}
+
+// waitForBacklog blocks the calling writer for as long as stalled reports true for the
+// backlog of immutable memtables and L0 tables, or an ingestion pauses writes, unless ctx is
+// done first. Must be called with d.mu held.
+func (d *DB) waitForBacklog(ctx context.Context, stalled func(immutableMemtables, l0Tables int) bool) error {
+	if stalled(d.backlog()) {
+		start := time.Now()
+		d.stall.stopped++
+		defer func() {
+			d.stall.duration += time.Since(start)
+			d.endSpan(SpanWriteStall, start, 0, 0)
+		}()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d.bg.ingesting || stalled(d.backlog()) {
+		// wake up the writer once ctx is done, as it would be by a flush or compaction
+		stop := context.AfterFunc(ctx, func() {
+			d.mu.Lock()
+			d.bg.cond.Broadcast()
+			d.mu.Unlock()
+		})
+		defer stop()
+	}
+	for d.bg.ingesting || stalled(d.backlog()) {
+		if err := d.checkWritable(); err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		d.scheduleFlush()
+		d.bg.cond.Wait()
+	}
+	return d.checkWritable()
+}
+
+// rotateForFlush makes the mutable memtables immutable, unless all of them are empty, so that
+// the next flush writes out every write so far. Must be called with d.mu held.
+func (d *DB) rotateForFlush() error {
+	if !slices.ContainsFunc(d.columnFamilies, func(cf *ColumnFamily) bool {
+		return cf.memtables.mutable.Size() > 0
+	}) {
+		return nil
+	}
+	if err := d.rotateWAL(); err != nil {
+		return err
+	}
+	d.rotateMemtables()
+	return nil
+}
+
+// flushMemtables writes every immutable memtable queued at the time of the call to its own
+// SSTable, or all of them of a column family to a single one with Options.MergeMemtablesOnFlush. Must be called without d.mu held; the lock is only taken to install the results.
+func (d *DB) flushMemtables() error {
+	d.mu.Lock()
+	columnFamilies := slices.Clone(d.columnFamilies)
+	d.mu.Unlock()
+
+	for _, cf := range columnFamilies {
+		if err := d.flushColumnFamily(cf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DB) flushColumnFamily(cf *ColumnFamily) error {
+	d.mu.Lock()
+	if cf.dropped {
+		d.mu.Unlock()
+		return nil
+	}
+	n := len(cf.memtables.queue) - 1
+	flushable := slices.Clone(cf.memtables.queue[:n])
+	d.mu.Unlock()
+
+	if d.opts.MergeMemtablesOnFlush && len(flushable) > 1 {
+		start := d.spanStart()
+		meta, err := d.writeMergedSSTable(flushable)
+		if err != nil {
+			return err
+		}
+		if meta != nil {
+			d.endSpan(SpanFlush, start, meta.FileNum(), meta.Size())
+		}
+		_, err = d.installFlush(cf, flushable, meta)
+		return err
+	}
+	for _, m := range flushable {
+		start := d.spanStart()
+		meta, err := d.writeSSTable(m)
+		if err != nil {
+			return err
+		}
+		d.endSpan(SpanFlush, start, meta.FileNum(), meta.Size())
+		if ok, err := d.installFlush(cf, []*memtable.Memtable{m}, meta); !ok || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// installFlush adds the SSTable the memtables were flushed to (if any) to L0, discards the
+// memtables, which are always at the front of the queue, and retires the WAL files no other
+// memtable needs. Reports false if the column family has been dropped in the meantime, in
+// which case the SSTable is deleted instead.
+func (d *DB) installFlush(cf *ColumnFamily, flushed []*memtable.Memtable, meta *storage.FileMetadata) (bool, error) {
+	d.mu.Lock()
+	if cf.dropped {
+		// the column family was dropped during the flush, along with its WAL files
+		d.mu.Unlock()
+		if meta == nil {
+			return false, nil
+		}
+		return false, d.dataStorage.DeleteFile(meta)
+	}
+	if meta != nil {
+		cf.levels[0] = append(cf.levels[0], meta)
+		d.metrics.flushes++
+		d.metrics.flushedBytes += meta.Size()
+	}
+	cf.memtables.queue = cf.memtables.queue[len(flushed):]
+	err := d.writeManifest()
+	// the memtables of all column families share their log files (as do memtables
+	// restored from the same WAL during replay), a log file can only be deleted once
+	// the last of them is flushed
+	var logs []*storage.FileMetadata
+	for _, m := range flushed {
+		for _, fm := range m.LogFiles() {
+			if !d.logInUse(fm) && !slices.Contains(logs, fm) {
+				logs = append(logs, fm)
+			}
+		}
+	}
+	switch {
+	case meta == nil:
+		d.opts.Logger.Infof("flushed %d memtables of column family %q, nothing was left to write", len(flushed), cf.name)
+	case len(flushed) > 1:
+		d.opts.Logger.Infof("flushed %d memtables of column family %q merged into sstable %d (%d bytes)", len(flushed), cf.name, meta.FileNum(), meta.Size())
+	default:
+		d.opts.Logger.Infof("flushed memtable of column family %q to sstable %d (%d bytes)", cf.name, meta.FileNum(), meta.Size())
+	}
+	d.bg.cond.Broadcast()
+	d.mu.Unlock()
+	if err != nil {
+		return true, err
+	}
+
+	for _, fm := range logs {
+		if err = d.retireFile(fm); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// writeMergedSSTable writes the memtables, oldest first, into a single SSTable through a
+// merging iterator, keeping only the newest version of every key: a key overwritten from one
+// memtable to the next is written once rather than once per memtable. Versions deleted by a
+// range tombstone of the memtables are dropped as well, the tombstone being written along.
+// Point tombstones are kept, as older versions of their keys may still be in the SSTables.
+// Returns a nil table if nothing is left to write.
+func (d *DB) writeMergedSSTable(memtables []*memtable.Memtable) (*storage.FileMetadata, error) {
+	var iters []internalIterator
+	var rangeDels []encoder.RangeTombstone
+	for _, m := range memtables {
+		iters = append(iters, newMemtableIter(m, nil, nil))
+		rangeDels = append(rangeDels, m.RangeTombstones()...)
+	}
+	iter := newMergingIter(d.cmp, iters...)
+	defer iter.Close()
+
+	var meta *storage.FileMetadata
+	mw := sstable.NewMergeWriter(sstable.MergeWriterOptions{
+		Options: d.opts.sstableOptions(),
+		// a single table, as a memtable flush writes
+		TargetFileSize:  math.MaxInt,
+		RangeTombstones: rangeDels,
+		Create: func() (io.Writer, error) {
+			meta = d.dataStorage.PrepareNewSSTFile()
+			f, err := d.dataStorage.CreateTempFile(meta)
+			if err != nil {
+				return nil, err
+			}
+			return d.throttle(f), nil
+		},
+		Finished: func(props sstable.Properties, size int64) error {
+			if err := d.dataStorage.CommitTempFile(meta); err != nil {
+				return err
+			}
+			meta.SetKeyRange(props.SmallestKey, props.LargestKey)
+			meta.SetValueLogRefs(props.ValueLogRefs)
+			meta.SetNumEntries(props.NumEntries)
+			meta.SetSize(size)
+			return nil
+		},
+		Filter: func(key, val []byte) ([]byte, bool, error) {
+			if iter.encoder.Parse(val).SeqNum() < encoder.CoveringSeqNum(d.cmp, rangeDels, key) {
+				return nil, false, nil
+			}
+			return val, true, nil
+		},
+	})
+	if err := mw.AddIter(iter); err != nil {
+		return nil, err
+	}
+	if err := mw.Finish(); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (d *DB) writeSSTable(m *memtable.Memtable) (*storage.FileMetadata, error) {
+	meta := d.dataStorage.PrepareNewSSTFile()
+	// the table only gets its final name once it is complete and synced, a crash mid-flush
+	// can't leave a truncated table behind
+	f, err := d.dataStorage.CreateTempFile(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	w := sstable.NewWriter(d.throttle(f), d.opts.sstableOptions())
+	err = w.ConvertMemtableToSST(m)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err = d.dataStorage.CommitTempFile(meta); err != nil {
+		return nil, err
+	}
+	props := w.Properties()
+	meta.SetKeyRange(props.SmallestKey, props.LargestKey)
+	meta.SetValueLogRefs(props.ValueLogRefs)
+	meta.SetNumEntries(props.NumEntries)
+	meta.SetSize(int64(w.EstimatedSize()))
+	return meta, nil
+}
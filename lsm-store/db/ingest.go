@@ -0,0 +1,224 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"lsm/encoder"
+	"lsm/sstable"
+	"lsm/storage"
+	"slices"
+)
+
+var ErrInvalidExternalFile = errors.New("db: invalid external sstable")
+
+// IngestExternalFile adds the kv-pairs of an *.sst file built by sstable.NewFileWriter (or any
+// other SSTable written with the same options as the DB) to the default column family.
+func (d *DB) IngestExternalFile(path string) error {
+	return d.defaultCF.IngestExternalFile(path)
+}
+
+// IngestExternalFile adds the kv-pairs of an *.sst file built by sstable.NewFileWriter (or any
+// other SSTable written with the same options as the DB) to the column family, all at once:
+// reads either see none or all of them. The ingested kv-pairs are newer than every write so
+// far, and overwrite or delete the keys already stored.
+//
+// The file is validated first, then copied into the data directory under a new file number,
+// with every entry assigned the sequence number of the ingestion. The copy is added to the
+// lowest level that keeps it below newer data, often the bottom one, so it isn't rewritten
+// by compactions soon after. The file at path (on Options.FS) is left as is.
+func (cf *ColumnFamily) IngestExternalFile(path string) error {
+	d := cf.db
+	smallest, largest, err := d.validateExternalFile(path)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	err = cf.checkWritable()
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return d.runInBackground(func() error {
+		return d.ingest(cf, path, smallest, largest)
+	})
+}
+
+// validateExternalFile checks that the file is an SSTable readable with the options of the DB,
+// holding only kv-pairs and tombstones in strictly increasing key order, and returns its key
+// range.
+func (d *DB) validateExternalFile(path string) (smallest, largest []byte, err error) {
+	f, err := d.opts.FS.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := sstable.NewReader(f, d.opts.sstableOptions())
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidExternalFile, err)
+	}
+	defer r.Close()
+	if len(r.RangeTombstones()) > 0 {
+		return nil, nil, fmt.Errorf("%w: range tombstones can't be ingested", ErrInvalidExternalFile)
+	}
+	it, err := r.NewIter()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidExternalFile, err)
+	}
+	defer it.Close()
+	e := encoder.NewEncoder()
+	for valid := it.First(); valid; valid = it.Next() {
+		key := it.Key()
+		if largest != nil && d.cmp(key, largest) <= 0 {
+			return nil, nil, fmt.Errorf("%w: key %q out of order", ErrInvalidExternalFile, key)
+		}
+		ev := e.Parse(it.Value())
+		if !ev.Valid() {
+			return nil, nil, fmt.Errorf("%w: malformed value of key %q", ErrInvalidExternalFile, key)
+		}
+		// value pointers refer to the value log of another DB
+		if _, ok := ev.ValueLogPointer(); ok || ev.IsRangeTombstone() || ev.IsMerge() {
+			return nil, nil, fmt.Errorf("%w: unsupported entry for key %q", ErrInvalidExternalFile, key)
+		}
+		if smallest == nil {
+			smallest = slices.Clone(key)
+		}
+		largest = slices.Clone(key)
+	}
+	if err := it.Error(); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidExternalFile, err)
+	}
+	if smallest == nil {
+		return nil, nil, fmt.Errorf("%w: empty table", ErrInvalidExternalFile)
+	}
+	return smallest, largest, nil
+}
+
+// ingest runs on the background worker. Writes are paused while the memtables are flushed, so
+// that no memtable (which reads consult before any SSTable) holds writes older than the
+// ingested kv-pairs, and they get a sequence number no write so far has.
+func (d *DB) ingest(cf *ColumnFamily, path string, smallest, largest []byte) error {
+	d.mu.Lock()
+	if err := cf.checkUsable(); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	d.bg.ingesting = true
+	err := d.rotateForFlush()
+	seqNum := d.nextSeqNum()
+	d.mu.Unlock()
+	if err == nil {
+		err = d.flushMemtables()
+	}
+	d.mu.Lock()
+	d.bg.ingesting = false
+	d.bg.cond.Broadcast()
+	d.mu.Unlock()
+	if err != nil {
+		return d.fail(err)
+	}
+
+	// from here on, only writes newer than the ingested kv-pairs reach the memtables, while
+	// the background worker is busy with the ingestion and can't flush them in the meantime
+	meta, err := d.writeIngestedTable(path, seqNum)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	if err := cf.checkUsable(); err != nil {
+		d.mu.Unlock()
+		d.dataStorage.DeleteFile(meta)
+		return err
+	}
+	level := cf.ingestLevel(smallest, largest)
+	cf.levels[level] = append(cf.levels[level], meta)
+	if level > 0 {
+		slices.SortFunc(cf.levels[level], func(a, b *storage.FileMetadata) int {
+			return d.cmp(a.SmallestKey(), b.SmallestKey())
+		})
+	}
+	if err := d.writeManifest(); err != nil {
+		d.failLocked(err)
+		d.mu.Unlock()
+		return err
+	}
+	d.mu.Unlock()
+	d.opts.Logger.Infof("ingested %s into column family %q as sstable %d of L%d", path, cf.name, meta.FileNum(), level)
+	d.offloadTables(level, []*storage.FileMetadata{meta})
+	return nil
+}
+
+// ingestLevel returns the lowest level a table with the key range [smallest, largest] can be
+// added to: no level above it, nor the level itself, may hold an overlapping table, as their
+// data is newer. Overlapping L0 tables are older, so L0 is always an option.
+// Must be called with d.mu held.
+func (cf *ColumnFamily) ingestLevel(smallest, largest []byte) int {
+	for level := 0; level < numLevels; level++ {
+		if len(cf.overlappingFiles(level, smallest, largest)) > 0 {
+			return max(level-1, 0)
+		}
+	}
+	return numLevels - 1
+}
+
+// writeIngestedTable copies an external SSTable into a new SSTable of the DB, assigning every
+// entry the sequence number seqNum.
+func (d *DB) writeIngestedTable(path string, seqNum uint64) (meta *storage.FileMetadata, err error) {
+	f, err := d.opts.FS.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := sstable.NewReader(f, d.opts.sstableOptions())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	defer r.Close()
+	it, err := r.NewIter()
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	meta = d.dataStorage.PrepareNewSSTFile()
+	out, err := d.dataStorage.CreateTempFile(meta)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			d.dataStorage.DeleteTempFile(meta)
+		}
+	}()
+	w := sstable.NewWriter(out, d.opts.sstableOptions())
+	e := encoder.NewEncoder()
+	for valid := it.First(); valid; valid = it.Next() {
+		ev := e.Parse(it.Value())
+		kind := encoder.OpKindSet
+		if ev.IsTombstone() {
+			kind = encoder.OpKindDelete
+		}
+		if err = w.Add(it.Key(), e.EncodeTimestamped(kind, seqNum, ev.Timestamp(), ev.Value())); err != nil {
+			out.Close()
+			return nil, err
+		}
+	}
+	if err = it.Error(); err != nil {
+		out.Close()
+		return nil, err
+	}
+	if err = w.Finish(); err != nil {
+		out.Close()
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	if err = d.dataStorage.CommitTempFile(meta); err != nil {
+		return nil, err
+	}
+	props := w.Properties()
+	meta.SetKeyRange(props.SmallestKey, props.LargestKey)
+	meta.SetNumEntries(props.NumEntries)
+	meta.SetSize(int64(w.EstimatedSize()))
+	return meta, nil
+}
@@ -0,0 +1,477 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"lsm/comparer"
+	"lsm/encoder"
+	"lsm/memtable"
+	"lsm/storage"
+	"slices"
+	"sort"
+)
+
+// IterOptions restrict the keys an Iterator visits to [LowerBound, UpperBound).
+// A nil bound leaves that side of the range open. The ReadOptions apply to the SSTables read.
+type IterOptions struct {
+	LowerBound []byte
+	UpperBound []byte
+	ReadOptions
+}
+
+// Iterator walks the live kv-pairs of the DB in key order, forward or backward. It sees the DB as of its
+// creation: writes made afterwards are not visible to it. The memtables and SSTables it
+// reads from stay alive until it is closed, even if a flush or a compaction replaces them.
+//
+// An Iterator is not positioned when created, call First, Last or one of the seek methods
+// before accessing any kv-pair.
+type Iterator struct {
+	db           *DB
+	ctx          context.Context // stops the iteration once done
+	iter         *mergingIter
+	cmp          comparer.Compare
+	rangeDels    []encoder.RangeTombstone
+	lower, upper []byte
+	reverse      bool         // whether iter was last positioned for backward iteration
+	unpin        func() error // releases the SSTables and value log files the iterator reads from
+	trace        *iterTrace
+
+	key, val []byte
+	err      error
+}
+
+// NewIter returns an iterator over the default column family. A nil opts iterates over all keys.
+func (d *DB) NewIter(opts *IterOptions) (*Iterator, error) {
+	return d.defaultCF.NewIter(opts)
+}
+
+// NewIterContext is NewIter for an iterator that stops once ctx is done: positioning it then
+// leaves it invalid, with the error of ctx.
+func (d *DB) NewIterContext(ctx context.Context, opts *IterOptions) (*Iterator, error) {
+	return d.defaultCF.NewIterContext(ctx, opts)
+}
+
+// NewIter returns an iterator over the column family. A nil opts iterates over all keys.
+func (cf *ColumnFamily) NewIter(opts *IterOptions) (*Iterator, error) {
+	return cf.NewIterContext(context.Background(), opts)
+}
+
+// NewIterContext is NewIter for an iterator that stops once ctx is done: positioning it then
+// leaves it invalid, with the error of ctx. Long scans, or seeks over many deleted keys, can
+// so be cancelled or given a deadline.
+func (cf *ColumnFamily) NewIterContext(ctx context.Context, opts *IterOptions) (*Iterator, error) {
+	d := cf.db
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var lower, upper []byte
+	var ro *ReadOptions
+	if opts != nil {
+		lower, upper, ro = opts.LowerBound, opts.UpperBound, &opts.ReadOptions
+	}
+	overlaps := func(t encoder.RangeTombstone) bool {
+		return (upper == nil || d.cmp(t.Start, upper) < 0) &&
+			(lower == nil || d.cmp(t.End, lower) > 0)
+	}
+
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if err := cf.checkUsable(); err != nil {
+		d.mu.Unlock()
+		return nil, err
+	}
+	var iters []internalIterator
+	var rangeDels []encoder.RangeTombstone
+	var vlogRefs []map[int]int64
+	for _, m := range cf.memtables.queue {
+		vlogRefs = append(vlogRefs, m.ValueLogRefs())
+		// the mutable memtable keeps changing underneath the iterator, take a copy of it
+		if m == cf.memtables.mutable {
+			iters = append(iters, newSliceIter(m, d.cmp, lower, upper))
+		} else {
+			iters = append(iters, newMemtableIter(m, lower, upper))
+		}
+		for _, t := range m.RangeTombstones() {
+			if overlaps(t) {
+				rangeDels = append(rangeDels, t)
+			}
+		}
+	}
+	var files []*storage.FileMetadata
+	for _, f := range slices.Concat(cf.levels[:]...) {
+		vlogRefs = append(vlogRefs, f.ValueLogRefs())
+		if f.OverlapsRange(d.cmp, lower, upper) {
+			files = append(files, f)
+		}
+	}
+	// a compaction replacing the tables from now on leaves them to the iterator
+	unpinValueLogs, unpinTables := d.pinValueLogs(vlogRefs), d.pinTables(files)
+	unpin := func() error {
+		unpinValueLogs()
+		return unpinTables()
+	}
+	d.mu.Unlock()
+
+	for _, f := range files {
+		it, err := d.newTableIter(f)
+		if err != nil {
+			for _, it := range iters {
+				it.Close()
+			}
+			unpin()
+			return nil, err
+		}
+		it.SetBounds(lower, upper)
+		it.SetReadOptions(ro.sstable())
+		iters = append(iters, it)
+		for _, t := range it.rangeDels {
+			if overlaps(t) {
+				rangeDels = append(rangeDels, t)
+			}
+		}
+	}
+	return &Iterator{
+		db:        d,
+		ctx:       ctx,
+		iter:      newMergingIter(d.cmp, iters...),
+		cmp:       d.cmp,
+		rangeDels: rangeDels,
+		lower:     lower,
+		upper:     upper,
+		unpin:     unpin,
+		trace:     cf.traceIter(lower, upper),
+	}, nil
+}
+
+// ScanPrefix returns an iterator over all keys of the default column family starting with prefix.
+func (d *DB) ScanPrefix(prefix []byte) (*Iterator, error) {
+	return d.defaultCF.ScanPrefix(prefix)
+}
+
+// ScanPrefixContext is ScanPrefix for an iterator that stops once ctx is done, see NewIterContext.
+func (d *DB) ScanPrefixContext(ctx context.Context, prefix []byte) (*Iterator, error) {
+	return d.defaultCF.ScanPrefixContext(ctx, prefix)
+}
+
+// ScanPrefix returns an iterator over all keys of the column family starting with prefix.
+// With a custom Comparer, this requires keys sharing a prefix to be ordered next to each other
+// and before any larger key not sharing it.
+func (cf *ColumnFamily) ScanPrefix(prefix []byte) (*Iterator, error) {
+	return cf.ScanPrefixContext(context.Background(), prefix)
+}
+
+// ScanPrefixContext is ScanPrefix for an iterator that stops once ctx is done, see
+// NewIterContext.
+func (cf *ColumnFamily) ScanPrefixContext(ctx context.Context, prefix []byte) (*Iterator, error) {
+	return cf.NewIterContext(ctx, &IterOptions{LowerBound: prefix, UpperBound: prefixSuccessor(prefix)})
+}
+
+// prefixSuccessor returns the smallest key larger than every key starting with prefix,
+// or nil if there is none (the prefix is empty or made of 0xff bytes only).
+func prefixSuccessor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			succ := slices.Clone(prefix[:i+1])
+			succ[i]++
+			return succ
+		}
+	}
+	return nil
+}
+
+// First positions the iterator at the smallest live key.
+func (i *Iterator) First() bool {
+	i.trace.position(nil, false)
+	if i.lower != nil {
+		return i.seekGE(i.lower)
+	}
+	i.reverse = false
+	i.iter.First()
+	return i.findNextEntry()
+}
+
+// Last positions the iterator at the largest live key.
+func (i *Iterator) Last() bool {
+	i.trace.position(nil, true)
+	if i.upper != nil {
+		return i.seekLT(i.upper)
+	}
+	i.reverse = true
+	i.iter.Last()
+	return i.findPrevEntry()
+}
+
+// Seek positions the iterator at the smallest live key >= key.
+func (i *Iterator) Seek(key []byte) bool {
+	i.trace.position(key, false)
+	return i.seekGE(key)
+}
+
+func (i *Iterator) seekGE(key []byte) bool {
+	if i.lower != nil && i.cmp(key, i.lower) < 0 {
+		key = i.lower
+	}
+	i.reverse = false
+	i.iter.SeekGE(key)
+	return i.findNextEntry()
+}
+
+// SeekLT positions the iterator at the largest live key < key.
+func (i *Iterator) SeekLT(key []byte) bool {
+	i.trace.position(key, true)
+	return i.seekLT(key)
+}
+
+func (i *Iterator) seekLT(key []byte) bool {
+	if i.upper != nil && i.cmp(key, i.upper) > 0 {
+		key = i.upper
+	}
+	i.reverse = true
+	i.iter.SeekLT(key)
+	return i.findPrevEntry()
+}
+
+// Next advances the iterator to the next live key.
+func (i *Iterator) Next() bool {
+	i.trace.step()
+	if !i.Valid() {
+		return false
+	}
+	if i.reverse {
+		// the merged iterator is positioned before the current key, move it past it
+		i.reverse = false
+		for valid := i.iter.SeekGE(i.key); valid && i.cmp(i.iter.Key(), i.key) == 0; valid = i.iter.Next() {
+		}
+	}
+	return i.findNextEntry()
+}
+
+// Prev moves the iterator to the previous live key.
+func (i *Iterator) Prev() bool {
+	i.trace.step()
+	if !i.Valid() {
+		return false
+	}
+	if !i.reverse {
+		// the merged iterator is positioned after the current key, move it before it
+		i.reverse = true
+		i.iter.SeekLT(i.key)
+	}
+	return i.findPrevEntry()
+}
+
+// findNextEntry moves to the first live key at or after the current position of the merged
+// iterator, skipping deleted keys as well as older versions of every key.
+func (i *Iterator) findNextEntry() bool {
+	return i.findEntry((*mergingIter).Next)
+}
+
+// findPrevEntry moves to the first live key at or before the current position of the merged
+// iterator, skipping deleted keys as well as older versions of every key.
+func (i *Iterator) findPrevEntry() bool {
+	return i.findEntry((*mergingIter).Prev)
+}
+
+func (i *Iterator) findEntry(step func(*mergingIter) bool) bool {
+	i.key, i.val = nil, nil
+	for i.iter.Valid() {
+		if err := i.ctx.Err(); err != nil {
+			i.err = err
+			return false
+		}
+		key := i.iter.Key()
+		// the newest version of a key comes first, in both directions
+		encodedVal := i.iter.encoder.Parse(i.iter.Value())
+		live := !encodedVal.IsTombstone() && encodedVal.SeqNum() > encoder.CoveringSeqNum(i.cmp, i.rangeDels, key)
+		for step(i.iter) && i.cmp(i.iter.Key(), key) == 0 {
+		}
+		if live {
+			val, err := i.db.resolveValue(encodedVal)
+			if err != nil {
+				i.err = err
+				return false
+			}
+			i.key, i.val = key, val
+			return true
+		}
+	}
+	i.err = i.iter.Error()
+	return false
+}
+
+// Valid reports whether the iterator is positioned at a live key.
+func (i *Iterator) Valid() bool {
+	return i.key != nil
+}
+
+// Key returns the key at the current position.
+func (i *Iterator) Key() []byte {
+	return i.key
+}
+
+// Value returns the value at the current position.
+func (i *Iterator) Value() []byte {
+	return i.val
+}
+
+// Error returns the error, if any, that stopped the iteration.
+func (i *Iterator) Error() error {
+	return i.err
+}
+
+// Close releases the memtables, SSTables and value log files held by the iterator.
+func (i *Iterator) Close() error {
+	i.key, i.val = nil, nil
+	i.trace.close()
+	err := i.iter.Close()
+	// the tables are deleted once unpinned if they are obsolete, their readers have to be
+	// released first
+	unpin := i.unpin
+	i.unpin = func() error { return nil }
+	return errors.Join(err, unpin())
+}
+
+// memtableIter iterates over an immutable memtable.
+type memtableIter struct {
+	iter     memtable.Iterator
+	key, val []byte
+}
+
+// newMemtableIter returns an iterator over the kv-pairs of m within [lower, upper). The
+// bounds are applied by the memtable, whose seeks don't walk the keys out of them.
+func newMemtableIter(m *memtable.Memtable, lower, upper []byte) *memtableIter {
+	return &memtableIter{iter: m.Iterator(lower, upper)}
+}
+
+func (m *memtableIter) First() bool {
+	m.iter.SeekToFirst()
+	return m.Next()
+}
+
+func (m *memtableIter) Last() bool {
+	return m.set(m.iter.Last())
+}
+
+func (m *memtableIter) SeekGE(key []byte) bool {
+	m.iter.SeekGE(key)
+	return m.Next()
+}
+
+func (m *memtableIter) SeekLT(key []byte) bool {
+	return m.set(m.iter.SeekLT(key))
+}
+
+func (m *memtableIter) Next() bool {
+	if !m.iter.HasNext() {
+		m.key, m.val = nil, nil
+		return false
+	}
+	return m.set(m.iter.Next())
+}
+
+func (m *memtableIter) Prev() bool {
+	return m.set(m.iter.Prev())
+}
+
+// set positions the iterator at the kv-pair the memtable iterator moved to, if any.
+func (m *memtableIter) set(key, val []byte) bool {
+	m.key, m.val = key, val
+	return key != nil
+}
+
+func (m *memtableIter) Key() []byte {
+	return m.key
+}
+
+func (m *memtableIter) Value() []byte {
+	return m.val
+}
+
+func (m *memtableIter) Error() error {
+	return nil
+}
+
+func (m *memtableIter) Close() error {
+	m.key, m.val = nil, nil
+	return nil
+}
+
+// sliceIter iterates over a copy of the kv-pairs of a memtable taken at its creation.
+type sliceIter struct {
+	keys, vals [][]byte
+	cmp        comparer.Compare
+	pos        int
+}
+
+// newSliceIter copies the kv-pairs of m within [lower, upper). Must be called with d.mu held.
+func newSliceIter(m *memtable.Memtable, cmp comparer.Compare, lower, upper []byte) *sliceIter {
+	s := &sliceIter{cmp: cmp}
+	for it := m.Iterator(lower, upper); it.HasNext(); {
+		key, val := it.Next()
+		s.keys, s.vals = append(s.keys, key), append(s.vals, val)
+	}
+	s.pos = len(s.keys)
+	return s
+}
+
+func (s *sliceIter) valid() bool {
+	return s.pos >= 0 && s.pos < len(s.keys)
+}
+
+func (s *sliceIter) First() bool {
+	s.pos = 0
+	return s.valid()
+}
+
+func (s *sliceIter) Last() bool {
+	s.pos = len(s.keys) - 1
+	return s.valid()
+}
+
+func (s *sliceIter) SeekGE(key []byte) bool {
+	s.pos = sort.Search(len(s.keys), func(i int) bool {
+		return s.cmp(s.keys[i], key) >= 0
+	})
+	return s.valid()
+}
+
+func (s *sliceIter) SeekLT(key []byte) bool {
+	s.pos = sort.Search(len(s.keys), func(i int) bool {
+		return s.cmp(s.keys[i], key) >= 0
+	}) - 1
+	return s.valid()
+}
+
+func (s *sliceIter) Next() bool {
+	if s.valid() {
+		s.pos++
+	}
+	return s.valid()
+}
+
+func (s *sliceIter) Prev() bool {
+	if s.valid() {
+		s.pos--
+	}
+	return s.valid()
+}
+
+func (s *sliceIter) Key() []byte {
+	return s.keys[s.pos]
+}
+
+func (s *sliceIter) Value() []byte {
+	return s.vals[s.pos]
+}
+
+func (s *sliceIter) Error() error {
+	return nil
+}
+
+func (s *sliceIter) Close() error {
+	s.keys, s.vals = nil, nil
+	return nil
+}
@@ -0,0 +1,49 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// Logger receives the log messages of the DB, each at one of four levels: Debug for the
+// lookups of individual reads and writes, Info for flushes and compactions, Warn for
+// problems the DB recovered from and Error for those it couldn't.
+type Logger interface {
+	Debugf(format string, args ...any)
+	Infof(format string, args ...any)
+	Warnf(format string, args ...any)
+	Errorf(format string, args ...any)
+}
+
+// DiscardLogger drops every message. It is the default Options.Logger.
+var DiscardLogger Logger = discardLogger{}
+
+type discardLogger struct{}
+
+func (discardLogger) Debugf(string, ...any) {}
+func (discardLogger) Infof(string, ...any)  {}
+func (discardLogger) Warnf(string, ...any)  {}
+func (discardLogger) Errorf(string, ...any) {}
+
+// NewSlogLogger returns a Logger writing to l at the matching slog levels. Messages below the
+// level enabled by the handler of l aren't even formatted.
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (s slogLogger) log(level slog.Level, format string, args []any) {
+	ctx := context.Background()
+	if s.l.Enabled(ctx, level) {
+		s.l.Log(ctx, level, fmt.Sprintf(format, args...))
+	}
+}
+
+func (s slogLogger) Debugf(format string, args ...any) { s.log(slog.LevelDebug, format, args) }
+func (s slogLogger) Infof(format string, args ...any)  { s.log(slog.LevelInfo, format, args) }
+func (s slogLogger) Warnf(format string, args ...any)  { s.log(slog.LevelWarn, format, args) }
+func (s slogLogger) Errorf(format string, args ...any) { s.log(slog.LevelError, format, args) }
@@ -0,0 +1,194 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"lsm/storage"
+)
+
+const (
+	manifestVersionV1 = 1 // a single keyspace, predates column families
+	manifestVersion   = 2
+)
+
+var errCorruptManifest = errors.New("db: corrupt manifest")
+
+// manifest = version|nextCFID|numCFs|{cfID|nameLen|name|numFiles|{level|fileNum}...}...
+// All fields but the names are uvarints. Files are listed level by level, in the order they
+// are kept in within each level (L0 from oldest to newest, L1+ by key range).
+//
+// A v1 manifest (version|numFiles|{level|fileNum}...) holds the files of the default column family.
+func (d *DB) encodeManifest() []byte {
+	buf := binary.AppendUvarint(nil, manifestVersion)
+	buf = binary.AppendUvarint(buf, uint64(d.nextCFID))
+	buf = binary.AppendUvarint(buf, uint64(len(d.columnFamilies)))
+	for _, cf := range d.columnFamilies {
+		buf = binary.AppendUvarint(buf, uint64(cf.id))
+		buf = binary.AppendUvarint(buf, uint64(len(cf.name)))
+		buf = append(buf, cf.name...)
+		var numFiles int
+		for level := range cf.levels {
+			numFiles += len(cf.levels[level])
+		}
+		buf = binary.AppendUvarint(buf, uint64(numFiles))
+		for level, files := range cf.levels {
+			for _, f := range files {
+				buf = binary.AppendUvarint(buf, uint64(level))
+				buf = binary.AppendUvarint(buf, uint64(f.FileNum()))
+			}
+		}
+	}
+	return buf
+}
+
+// writeManifest persists the current column families and their file sets. Must be called with d.mu held.
+func (d *DB) writeManifest() error {
+	start := d.spanStart()
+	manifest := d.encodeManifest()
+	err := d.dataStorage.WriteManifest(manifest)
+	d.endSpan(SpanManifestWrite, start, 0, int64(len(manifest)))
+	return err
+}
+
+// loadManifest restores the column families and assigns the SSTables found in the data
+// directory to their levels. SSTables that aren't part of the manifest are leftovers of an
+// interrupted flush or compaction, or belong to a dropped column family, and get deleted.
+// Without a manifest (a brand-new data directory) all SSTables are treated as L0 tables of
+// the default column family.
+func (d *DB) loadManifest(sstables []*storage.FileMetadata) error {
+	data, err := d.dataStorage.ReadManifest()
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		cf := d.newColumnFamily(0, DefaultColumnFamily)
+		cf.levels[0] = sstables
+		return d.writeManifest()
+	}
+
+	cfs, nextCFID, err := parseManifest(data)
+	if err != nil {
+		return err
+	}
+	byFileNum := make(map[int]*storage.FileMetadata, len(sstables))
+	for _, f := range sstables {
+		byFileNum[f.FileNum()] = f
+	}
+	for _, mcf := range cfs {
+		cf := d.newColumnFamily(mcf.id, mcf.name)
+		for _, mf := range mcf.files {
+			f, ok := byFileNum[mf.fileNum]
+			if !ok {
+				return fmt.Errorf("db: sstable %d listed in manifest is missing", mf.fileNum)
+			}
+			delete(byFileNum, mf.fileNum)
+			cf.levels[mf.level] = append(cf.levels[mf.level], f)
+		}
+	}
+	d.nextCFID = max(d.nextCFID, nextCFID)
+	if d.defaultCF == nil {
+		return errCorruptManifest
+	}
+
+	for _, f := range byFileNum {
+		if err = d.dataStorage.DeleteFile(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// manifestCF is a column family as listed in the manifest.
+type manifestCF struct {
+	id    uint32
+	name  string
+	files []manifestFile
+}
+
+// manifestFile is an SSTable as listed in the manifest.
+type manifestFile struct {
+	level   int
+	fileNum int
+}
+
+// parseManifest decodes a manifest into its column families, and returns the next column
+// family ID along with them.
+func parseManifest(data []byte) ([]manifestCF, uint32, error) {
+	m := manifestDecoder{data: data}
+	var cfs []manifestCF
+	var nextCFID uint64
+	switch m.uvarint() {
+	case manifestVersionV1:
+		cfs = append(cfs, manifestCF{id: 0, name: DefaultColumnFamily, files: m.files()})
+	case manifestVersion:
+		nextCFID = m.uvarint()
+		numCFs := m.uvarint()
+		for i := uint64(0); i < numCFs && m.err == nil; i++ {
+			id := m.uvarint()
+			name := m.bytes()
+			if id > nextCFID || nextCFID > 1<<32-1 || len(name) == 0 {
+				return nil, 0, errCorruptManifest
+			}
+			cfs = append(cfs, manifestCF{id: uint32(id), name: string(name), files: m.files()})
+		}
+	default:
+		return nil, 0, errCorruptManifest
+	}
+	if m.err != nil {
+		return nil, 0, m.err
+	}
+	return cfs, uint32(nextCFID), nil
+}
+
+// manifestDecoder reads the fields of a manifest, remembering the first error it runs into.
+type manifestDecoder struct {
+	data []byte
+	err  error
+}
+
+func (m *manifestDecoder) uvarint() uint64 {
+	if m.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(m.data)
+	if n <= 0 {
+		m.err = errCorruptManifest
+		return 0
+	}
+	m.data = m.data[n:]
+	return v
+}
+
+func (m *manifestDecoder) bytes() []byte {
+	n := m.uvarint()
+	if m.err != nil {
+		return nil
+	}
+	if uint64(len(m.data)) < n {
+		m.err = errCorruptManifest
+		return nil
+	}
+	b := m.data[:n]
+	m.data = m.data[n:]
+	return b
+}
+
+// files reads a file set (numFiles|{level|fileNum}...).
+func (m *manifestDecoder) files() []manifestFile {
+	numFiles := m.uvarint()
+	var files []manifestFile
+	for i := uint64(0); i < numFiles && m.err == nil; i++ {
+		level := m.uvarint()
+		fileNum := m.uvarint()
+		if m.err != nil {
+			return nil
+		}
+		if level >= numLevels {
+			m.err = errCorruptManifest
+			return nil
+		}
+		files = append(files, manifestFile{level: int(level), fileNum: int(fileNum)})
+	}
+	return files
+}
@@ -0,0 +1,169 @@
+package db
+
+import (
+	"container/heap"
+	"lsm/comparer"
+	"lsm/encoder"
+)
+
+// internalIterator walks sorted kv-pairs whose values are encoded values
+// (e.g. the contents of an SSTable).
+type internalIterator interface {
+	First() bool
+	Last() bool
+	SeekGE(key []byte) bool
+	SeekLT(key []byte) bool
+	Next() bool
+	Prev() bool
+	Key() []byte
+	Value() []byte
+	Error() error
+	Close() error
+}
+
+// mergingIter merges several sorted iterators into a single sorted stream. When more than one
+// iterator holds the same key, the entry with the larger sequence number (i.e. the newer one)
+// comes first, in either direction. The direction is set by the last positioning call: First
+// and SeekGE iterate forward (with Next), Last and SeekLT backward (with Prev).
+type mergingIter struct {
+	iters   []internalIterator
+	h       iterHeap
+	encoder *encoder.Encoder
+	err     error
+}
+
+func newMergingIter(cmp comparer.Compare, iters ...internalIterator) *mergingIter {
+	m := &mergingIter{iters: iters, encoder: encoder.NewEncoder()}
+	m.h.encoder, m.h.cmp = m.encoder, cmp
+	return m
+}
+
+func (m *mergingIter) First() bool {
+	return m.position(false, internalIterator.First)
+}
+
+func (m *mergingIter) Last() bool {
+	return m.position(true, internalIterator.Last)
+}
+
+// SeekGE positions the iterator at the smallest key >= key.
+func (m *mergingIter) SeekGE(key []byte) bool {
+	return m.position(false, func(it internalIterator) bool {
+		return it.SeekGE(key)
+	})
+}
+
+// SeekLT positions the iterator at the largest key < key.
+func (m *mergingIter) SeekLT(key []byte) bool {
+	return m.position(true, func(it internalIterator) bool {
+		return it.SeekLT(key)
+	})
+}
+
+// position repositions every iterator with fn and rebuilds the heap from the valid ones.
+func (m *mergingIter) position(reverse bool, fn func(it internalIterator) bool) bool {
+	m.h.iters = m.h.iters[:0]
+	m.h.reverse = reverse
+	m.err = nil
+	for _, it := range m.iters {
+		if fn(it) {
+			m.h.iters = append(m.h.iters, it)
+		} else if err := it.Error(); err != nil {
+			m.err = err
+			return false
+		}
+	}
+	heap.Init(&m.h)
+	return m.Valid()
+}
+
+// Next advances the iterator, which must have been positioned with First or SeekGE.
+func (m *mergingIter) Next() bool {
+	return m.step(internalIterator.Next)
+}
+
+// Prev moves the iterator back, which must have been positioned with Last or SeekLT.
+func (m *mergingIter) Prev() bool {
+	return m.step(internalIterator.Prev)
+}
+
+// step moves the iterator at the top of the heap with fn and restores the heap order.
+func (m *mergingIter) step(fn func(it internalIterator) bool) bool {
+	if !m.Valid() {
+		return false
+	}
+	it := m.h.iters[0]
+	if fn(it) {
+		heap.Fix(&m.h, 0)
+	} else {
+		if err := it.Error(); err != nil {
+			m.err = err
+			return false
+		}
+		heap.Pop(&m.h)
+	}
+	return m.Valid()
+}
+
+func (m *mergingIter) Valid() bool {
+	return m.err == nil && len(m.h.iters) > 0
+}
+
+func (m *mergingIter) Key() []byte {
+	return m.h.iters[0].Key()
+}
+
+func (m *mergingIter) Value() []byte {
+	return m.h.iters[0].Value()
+}
+
+func (m *mergingIter) Error() error {
+	return m.err
+}
+
+func (m *mergingIter) Close() error {
+	var err error
+	for _, it := range m.iters {
+		if cerr := it.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	m.iters, m.h.iters = nil, nil
+	return err
+}
+
+// iterHeap is a heap of iterators ordered by their current key, smallest first (or largest
+// first in reverse), and by descending sequence number for equal keys.
+type iterHeap struct {
+	iters   []internalIterator
+	encoder *encoder.Encoder
+	cmp     comparer.Compare
+	reverse bool
+}
+
+func (h *iterHeap) Len() int {
+	return len(h.iters)
+}
+
+func (h *iterHeap) Less(i, j int) bool {
+	cmp := h.cmp(h.iters[i].Key(), h.iters[j].Key())
+	if cmp != 0 {
+		return (cmp < 0) != h.reverse
+	}
+	return h.encoder.Parse(h.iters[i].Value()).SeqNum() > h.encoder.Parse(h.iters[j].Value()).SeqNum()
+}
+
+func (h *iterHeap) Swap(i, j int) {
+	h.iters[i], h.iters[j] = h.iters[j], h.iters[i]
+}
+
+func (h *iterHeap) Push(x any) {
+	h.iters = append(h.iters, x.(internalIterator))
+}
+
+func (h *iterHeap) Pop() any {
+	n := len(h.iters)
+	it := h.iters[n-1]
+	h.iters = h.iters[:n-1]
+	return it
+}
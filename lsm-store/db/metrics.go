@@ -0,0 +1,191 @@
+package db
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are counters and gauges describing the work done by the DB since it was opened,
+// meant for tuning the options and for exporting to monitoring.
+type Metrics struct {
+	// UserBytesWritten is the size of the keys and values passed to writes, and the other
+	// BytesWritten counters how much ended up on disk because of them.
+	UserBytesWritten     int64
+	WALBytesWritten      int64
+	ValueLogBytesWritten int64
+	// Flushes of memtables to L0 tables, and the size of the tables written by them.
+	Flushes           int64
+	FlushBytesWritten int64
+	// Compactions (including trivial moves, which only move tables to the next level) and
+	// the size of the tables they merged and wrote.
+	Compactions            int64
+	CompactionBytesRead    int64
+	CompactionBytesWritten int64
+	// BackgroundThrottle is the time flushes and compactions spent waiting for the rate
+	// limit of Options.BackgroundBytesPerSec.
+	BackgroundThrottle time.Duration
+	// Memtables counts the mutable and immutable memtables of all column families, and
+	// MemtableSize is their total size (in bytes).
+	Memtables    int
+	MemtableSize int64
+	// Levels holds the number of SSTables and their total size (in bytes) per level, summed
+	// over all column families.
+	Levels []LevelMetrics
+	// BlockCacheSize is the total size of the cached data blocks (in bytes).
+	BlockCacheSize   int64
+	BlockCacheHits   int64
+	BlockCacheMisses int64
+	// WriteAmplification estimates how many bytes are written to disk per byte written by
+	// the user: WAL, value log, flushes and compactions over UserBytesWritten.
+	WriteAmplification float64
+	// ReadAmplification is the number of memtables and SSTables a point lookup may have to
+	// consult in the worst case: every memtable and L0 table, plus one table per level below.
+	ReadAmplification int
+	// Latencies of the individual operations, over all column families.
+	GetLatency         Histogram
+	SetLatency         Histogram
+	DeleteLatency      Histogram
+	DeleteRangeLatency Histogram
+}
+
+// LevelMetrics describes the SSTables of a level.
+type LevelMetrics struct {
+	NumFiles int
+	Size     int64
+}
+
+// BlockCacheHitRate returns the share of data block reads served by the block cache.
+func (m *Metrics) BlockCacheHitRate() float64 {
+	if total := m.BlockCacheHits + m.BlockCacheMisses; total > 0 {
+		return float64(m.BlockCacheHits) / float64(total)
+	}
+	return 0
+}
+
+// Histogram is the distribution of operation latencies. Bucket i counts the operations that
+// took less than 2^i µs; the last bucket counts all slower ones.
+type Histogram struct {
+	Count   uint64
+	Sum     time.Duration
+	Buckets []HistogramBucket
+}
+
+// HistogramBucket is the number of operations that took less than UpperBound, but at least
+// as long as the UpperBound of the previous bucket (the counts are not cumulative).
+type HistogramBucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
+// Mean returns the average latency.
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Quantile returns an upper bound of the q-quantile (0 <= q <= 1) of the latencies, e.g. the
+// 99th percentile for q = 0.99.
+func (h Histogram) Quantile(q float64) time.Duration {
+	rank := uint64(math.Ceil(q * float64(h.Count)))
+	var n uint64
+	for _, b := range h.Buckets {
+		n += b.Count
+		if n >= rank && n > 0 {
+			return b.UpperBound
+		}
+	}
+	return 0
+}
+
+// numLatencyBuckets covers latencies of up to 2^24 µs (~17s) before the overflow bucket.
+const numLatencyBuckets = 25
+
+// operations whose latency is tracked
+const (
+	opGet = iota
+	opSet
+	opDelete
+	opDeleteRange
+	numOps
+)
+
+// latencyHistogram records latencies without any locking.
+type latencyHistogram struct {
+	count   atomic.Uint64
+	sum     atomic.Int64
+	buckets [numLatencyBuckets + 1]atomic.Uint64
+}
+
+// record adds the time elapsed since start to the histogram. Typically deferred at the start
+// of an operation.
+func (h *latencyHistogram) record(start time.Time) {
+	elapsed := time.Since(start)
+	i := min(bits.Len64(uint64(elapsed/time.Microsecond)), numLatencyBuckets)
+	h.buckets[i].Add(1)
+	h.sum.Add(int64(elapsed))
+	h.count.Add(1)
+}
+
+func (h *latencyHistogram) snapshot() Histogram {
+	s := Histogram{
+		Count:   h.count.Load(),
+		Sum:     time.Duration(h.sum.Load()),
+		Buckets: make([]HistogramBucket, len(h.buckets)),
+	}
+	for i := range h.buckets {
+		s.Buckets[i] = HistogramBucket{UpperBound: time.Microsecond << i, Count: h.buckets[i].Load()}
+	}
+	s.Buckets[numLatencyBuckets].UpperBound = math.MaxInt64
+	return s
+}
+
+// Metrics returns a snapshot of the metrics of the DB.
+func (d *DB) Metrics() Metrics {
+	d.mu.Lock()
+	m := Metrics{
+		UserBytesWritten:       d.metrics.userBytes,
+		WALBytesWritten:        d.metrics.walBytes + d.wal.w.Size(),
+		ValueLogBytesWritten:   d.metrics.vlogBytes + int64(d.vlog.w.Size()),
+		Flushes:                d.metrics.flushes,
+		FlushBytesWritten:      d.metrics.flushedBytes,
+		Compactions:            d.metrics.compactions,
+		CompactionBytesRead:    d.metrics.compactedBytesRead,
+		CompactionBytesWritten: d.metrics.compactedBytesWritten,
+		BackgroundThrottle:     d.limiter.Waited(),
+		Levels:                 make([]LevelMetrics, numLevels),
+	}
+	for _, cf := range d.columnFamilies {
+		for _, mt := range cf.memtables.queue {
+			m.Memtables++
+			m.MemtableSize += int64(mt.Size())
+		}
+		readAmp := len(cf.memtables.queue)
+		for level, files := range cf.levels {
+			m.Levels[level].NumFiles += len(files)
+			m.Levels[level].Size += totalSize(files)
+			if level == 0 {
+				readAmp += len(files)
+			} else if len(files) > 0 {
+				readAmp++
+			}
+		}
+		m.ReadAmplification = max(m.ReadAmplification, readAmp)
+	}
+	d.mu.Unlock()
+
+	if m.UserBytesWritten > 0 {
+		written := m.WALBytesWritten + m.ValueLogBytesWritten + m.FlushBytesWritten + m.CompactionBytesWritten
+		m.WriteAmplification = float64(written) / float64(m.UserBytesWritten)
+	}
+	m.BlockCacheSize = d.blockCache.Size()
+	m.BlockCacheHits, m.BlockCacheMisses = d.blockCache.Stats()
+	m.GetLatency = d.metrics.latency[opGet].snapshot()
+	m.SetLatency = d.metrics.latency[opSet].snapshot()
+	m.DeleteLatency = d.metrics.latency[opDelete].snapshot()
+	m.DeleteRangeLatency = d.metrics.latency[opDeleteRange].snapshot()
+	return m
+}
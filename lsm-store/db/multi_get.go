@@ -0,0 +1,130 @@
+package db
+
+import (
+	"fmt"
+	"lsm/encoder"
+	"lsm/storage"
+	"slices"
+)
+
+// MultiGet returns the values of several keys of the default column family.
+func (d *DB) MultiGet(keys [][]byte) ([][]byte, []error) {
+	return d.defaultCF.MultiGet(keys)
+}
+
+// pendingGet is a key of a MultiGet that hasn't been found in the memtables.
+type pendingGet struct {
+	i     int                     // position of the key in the request
+	files []*storage.FileMetadata // SSTables still to search, newest first
+}
+
+// MultiGet returns the values of several keys, with the same results as a Get of each of
+// them: vals[i] and errs[i] belong to keys[i], a missing key failing with
+// ErrKeyNotFound. The keys are searched in sorted order and grouped by SSTable, so a
+// table is only fetched from the table cache once per round, and keys falling into the same
+// data block share a single read of it.
+func (cf *ColumnFamily) MultiGet(keys [][]byte) (vals [][]byte, errs []error) {
+	d := cf.db
+	cf.traceMultiGet(keys)
+	vals, errs = make([][]byte, len(keys)), make([]error, len(keys))
+	found := make([]*encoder.EncodedValue, len(keys))
+	// keep the SSTables from being deleted by a compaction while they are searched
+	d.readers.RLock()
+	defer d.readers.RUnlock()
+
+	d.mu.Lock()
+	if err := cf.checkUsable(); err != nil {
+		d.mu.Unlock()
+		for i := range errs {
+			errs[i] = err
+		}
+		return vals, errs
+	}
+	var pending []*pendingGet
+	for i, key := range keys {
+		encodedVal, rangeDelSeqNum, _, ok := cf.getFromMemtables(key)
+		switch {
+		case ok && encodedVal.SeqNum() > rangeDelSeqNum && !encodedVal.IsTombstone():
+			found[i] = encodedVal
+		case ok || rangeDelSeqNum > 0:
+			errs[i] = ErrKeyNotFound
+		default:
+			pending = append(pending, &pendingGet{i: i, files: cf.sstablesForKey(key)})
+		}
+	}
+	d.mu.Unlock()
+
+	slices.SortStableFunc(pending, func(a, b *pendingGet) int { return d.cmp(keys[a.i], keys[b.i]) })
+	// every round searches the newest table left for each key
+	for len(pending) > 0 {
+		var tables []*storage.FileMetadata
+		byTable := make(map[*storage.FileMetadata][]*pendingGet)
+		for _, p := range pending {
+			if len(p.files) == 0 {
+				errs[p.i] = ErrKeyNotFound
+				continue
+			}
+			f := p.files[0]
+			if _, ok := byTable[f]; !ok {
+				tables = append(tables, f)
+			}
+			byTable[f] = append(byTable[f], p)
+		}
+		pending = pending[:0]
+		for _, f := range tables {
+			next, err := cf.multiGetFromSSTable(f, keys, byTable[f], found, errs)
+			if err != nil {
+				for _, p := range byTable[f] {
+					errs[p.i] = err
+				}
+				continue
+			}
+			pending = append(pending, next...)
+		}
+		// the keys of one table stay sorted, but not across tables
+		slices.SortStableFunc(pending, func(a, b *pendingGet) int { return d.cmp(keys[a.i], keys[b.i]) })
+	}
+
+	for i, encodedVal := range found {
+		if encodedVal != nil {
+			vals[i], errs[i] = d.resolveValue(encodedVal)
+		}
+	}
+	return vals, errs
+}
+
+// multiGetFromSSTable searches a single SSTable for the sorted keys of gets, recording the
+// result of every key it decides. Returns the gets that have to go on to older tables.
+func (cf *ColumnFamily) multiGetFromSSTable(f *storage.FileMetadata, keys [][]byte, gets []*pendingGet, found []*encoder.EncodedValue, errs []error) ([]*pendingGet, error) {
+	d := cf.db
+	r, release, err := d.tableCache.get(f)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	tableKeys := make([][]byte, len(gets))
+	for j, p := range gets {
+		tableKeys[j] = keys[p.i]
+	}
+	encodedVals, err := r.MultiGet(tableKeys)
+	if err != nil {
+		return nil, fmt.Errorf("searching sstable %d: %w", f.FileNum(), err)
+	}
+	var next []*pendingGet
+	for j, p := range gets {
+		ev := encodedVals[j]
+		rangeDelSeqNum := encoder.CoveringSeqNum(d.cmp, r.RangeTombstones(), tableKeys[j])
+		switch {
+		case ev != nil && ev.SeqNum() > rangeDelSeqNum && !ev.IsTombstone():
+			found[p.i] = ev
+		case ev != nil || rangeDelSeqNum > 0:
+			// deleted by a tombstone, or every older version is shadowed by a range tombstone
+			errs[p.i] = ErrKeyNotFound
+		default:
+			p.files = p.files[1:]
+			next = append(next, p)
+		}
+	}
+	return next, nil
+}
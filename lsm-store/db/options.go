@@ -0,0 +1,405 @@
+package db
+
+import (
+	"context"
+	"lsm/comparer"
+	"lsm/filter"
+	"lsm/memtable"
+	"lsm/sstable"
+	"lsm/storage"
+	"lsm/wal"
+	"time"
+)
+
+const (
+	defaultMemtableSizeLimit      = 4 << 10 // 4 KiB
+	defaultMemtableFlushThreshold = 8 << 10 // 8 KiB
+	defaultMaxImmutableMemtables  = 4
+	defaultL0CompactionThreshold  = 4
+	defaultL0SlowdownWrites       = 8
+	defaultL0StopWrites           = 12
+	defaultMemtableSlowdownWrites = 3
+	defaultWriteSlowdownDelay     = time.Millisecond
+	defaultLBaseMaxBytes          = 64 << 10 // 64 KiB
+	defaultLevelSizeMultiplier    = 10
+	defaultTargetFileSize         = 16 << 10 // 16 KiB
+	defaultWALSyncInterval        = 100 * time.Millisecond
+	defaultBlockCacheSize         = 8 << 20 // 8 MiB
+	defaultTableCacheSize         = 64
+	defaultReadWorkers            = 4
+	defaultValueLogThreshold      = 1 << 10 // 1 KiB
+	defaultFilterBitsPerKey       = filter.DefaultBitsPerKey
+	defaultValueLogFileSize       = 1 << 20 // 1 MiB
+	defaultValueLogGCRatio        = 0.5
+)
+
+// Options tune the behaviour of the storage engine. A nil *Options passed to
+// Open (or any zero-valued field) falls back to the defaults below.
+type Options struct {
+	// MemtableSizeLimit is the maximum size of a single memtable (in bytes)
+	// before it is rotated together with its WAL file.
+	MemtableSizeLimit int
+	// MemtableFlushThreshold is the total size of all queued memtables (in bytes)
+	// that triggers a flush of the immutable ones to disk.
+	MemtableFlushThreshold int
+	// FlushPolicy decides when the immutable memtables are flushed. By default, once the
+	// memtables take more than MemtableFlushThreshold bytes (ThresholdFlush).
+	FlushPolicy FlushPolicy
+	// MaxImmutableMemtables bounds the queue of memtables waiting to be flushed by the
+	// background worker. Writes that need a new memtable block once the queue is full until
+	// a flush catches up.
+	MaxImmutableMemtables int
+	// MergeMemtablesOnFlush writes the immutable memtables a flush finds queued into a single
+	// SSTable, through a merging iterator keeping only the newest version of every key, rather
+	// than one SSTable per memtable. Keys overwritten across memtables are then written once,
+	// and flushes add fewer L0 tables, so less is left for compactions to merge.
+	MergeMemtablesOnFlush bool
+	// MemtableSlowdownWritesThreshold is the number of immutable memtables (of any column
+	// family) from which on every write is delayed by WriteSlowdownDelay.
+	MemtableSlowdownWritesThreshold int
+	// MemtableBackend is the data structure of the memtables: a skiplist (the default), a
+	// B-tree, or a hash map sorted when flushed (see memtable.BackendType). All of them store
+	// the same entries, so it can be changed between restarts, e.g. to compare them.
+	MemtableBackend memtable.BackendType
+	// L0CompactionThreshold is the number of L0 SSTables that triggers their compaction into L1.
+	L0CompactionThreshold int
+	// CompactionPicker decides which compaction runs next: by default, the leveled compaction
+	// scoring the levels with L0CompactionThreshold, LBaseMaxBytes and LevelSizeMultiplier
+	// (LeveledCompaction).
+	CompactionPicker CompactionPicker
+	// L0SlowdownWritesThreshold is the number of L0 SSTables (of any column family) from which
+	// on every write is delayed by WriteSlowdownDelay. Once L0StopWritesThreshold is reached,
+	// writes block until compactions catch up.
+	L0SlowdownWritesThreshold int
+	L0StopWritesThreshold     int
+	// WriteSlowdownDelay is how long each write is delayed while writes are slowed down.
+	WriteSlowdownDelay time.Duration
+	// LBaseMaxBytes is the target size of L1 (in bytes). Every level below is LevelSizeMultiplier
+	// times larger than the one above it, and gets compacted into the next one once it outgrows
+	// its target size.
+	LBaseMaxBytes       int64
+	LevelSizeMultiplier int
+	// TargetFileSize is the size (in bytes) at which compactions start a new output SSTable.
+	TargetFileSize int
+	// BlockSize is the target size of an SSTable data block (in bytes).
+	BlockSize int
+	// BlockChunkSize is the restart interval of the data blocks: every key is incrementally
+	// encoded against the key before it, except every BlockChunkSize-th one, which is written
+	// in full so that lookups can binary search these restart points.
+	BlockChunkSize int
+	// BlockCacheSize is the capacity (in bytes) of the LRU cache holding decompressed
+	// SSTable data blocks, shared by all reads.
+	BlockCacheSize int64
+	// TableCacheSize is the maximum number of SSTable readers (open files with their
+	// index blocks pinned in memory) kept open at once.
+	TableCacheSize int
+	// ReadWorkers bounds the number of goroutines, shared by all Gets, reading the data blocks
+	// of SSTables for them: a Get that may find its key in several tables (overlapping L0
+	// tables, or tables of several levels) reads the newest one itself and hands the others
+	// to the workers free, so that their reads overlap rather than run one after the other.
+	// A negative value reads every table in the Get's goroutine.
+	ReadWorkers int
+	// FilterBitsPerKey is the size of the bloom filter of every SSTable, 10 bits per key by
+	// default (about 1% false positives, see filter.BitsPerKey). A point lookup only reads a
+	// data block of the tables whose filter may contain its key. A negative value disables
+	// the filters.
+	FilterBitsPerKey int
+	// FilterType is sstable.TableFilter (the default) for a filter over all keys of every
+	// SSTable, or sstable.BlockFilter for one filter per data block.
+	FilterType sstable.FilterType
+	// MmapReads memory-maps the SSTables held by the table cache, so that reads are served from
+	// the page cache without a system call and a copy per block. Uncompressed data blocks are
+	// then used in place rather than kept in the block cache. Keys and values of an Iterator
+	// have to be copied to be used after it is closed.
+	MmapReads bool
+	// Compression is the codec used for the SSTable data blocks written from now on (none,
+	// snappy, zstd or lz4). Every table records its codec, so the codec can be changed between
+	// restarts; only tables written before codecs were recorded are read with this one.
+	Compression sstable.Compression
+	// CompressionDictSize, if set, is the size of the dictionary trained on the first data
+	// blocks of every SSTable written with zstd during flushes and compactions. It is stored
+	// in the table, and pays off for small values sharing a lot of content (e.g. short JSON
+	// documents), which compress poorly one data block at a time. Tables only keep their
+	// dictionary if it saves more than it takes up.
+	CompressionDictSize int
+	// WALSync controls when WAL writes are forced to stable storage: after every write
+	// (default), every WALSyncInterval, or never. Individual writes can still ask to be
+	// synced through WriteOptions.
+	WALSync         wal.SyncPolicy
+	WALSyncInterval time.Duration
+	// WALMaxSize, if set, is the size (in bytes) from which on the active WAL is sealed and a
+	// new one started, and WALRotateInterval, if set, the age. Otherwise, WALs are only rotated
+	// along with the memtables, when these are full. Smaller WAL files are archived (see
+	// WALArchiveDir) and recovered to a point in time at a finer grain; a memtable is backed by
+	// all the WAL files it has writes in, so none is deleted before it is flushed.
+	WALMaxSize        int64
+	WALRotateInterval time.Duration
+	// WALCompression is the codec (none by default, snappy or zstd) every WAL record is
+	// compressed with before it is written, which pays off for compressible values when the
+	// WAL takes up most of the write bandwidth. Records are only kept compressed if they get
+	// smaller; each records its codec, so the codec can be changed between restarts.
+	WALCompression wal.Compression
+	// WALRecovery determines how the replay of the WAL files on open reacts to a chunk that
+	// can't be read, e.g. a write torn by a crash: by default (wal.TolerateCorruptedTail), the
+	// replay of the file stops there, and the records after it are lost. wal.AbsoluteConsistency
+	// fails Open instead, even for a torn write at the tail, so that nothing is dropped silently.
+	// wal.SkipAnyCorruptRecord skips the corrupt chunks and replays every record around them that
+	// can still be read, which salvages the most but may drop writes from the middle of the log.
+	WALRecovery wal.RecoveryMode
+	// DisableDirSync skips syncing the data directory after files are created, renamed or
+	// deleted. Only meant for tests: without it, a crash can lose a new WAL or SSTable, or
+	// bring back a deleted one, leaving recovery with an inconsistent set of files.
+	DisableDirSync bool
+	// WALArchiveDir, if set, is where WAL and value log files are moved once they are no
+	// longer needed, instead of deleting them. Together with a backup or checkpoint, the
+	// archived files allow RecoverToTime to restore the DB to any later point. It must be on
+	// the same file system as the data directory, and is never pruned by the DB.
+	WALArchiveDir string
+	// WALArchiver, if set, is called with every WAL segment once it is sealed, and the file to
+	// read it from, e.g. to upload it to an object store for point-in-time recovery. It runs on
+	// a goroutine of its own, one segment at a time in the order they were sealed, and the
+	// segment isn't deleted before it returns (it may be moved to WALArchiveDir, though). Close
+	// waits for it to be done with the segments sealed before. The segment active when the DB is
+	// closed is only sealed by the next Open, which passes it on before it returns, along with
+	// the segments a crash kept from being passed on. A segment may thus be passed on twice
+	// after a crash. Errors are logged, the segment being dropped all the same.
+	WALArchiver func(fm *storage.FileMetadata, f storage.File) error
+	// Timestamps records the wall-clock time of every write (but range deletions) along with
+	// it, in the WAL, the memtables and the SSTables, as encoder.EncodedValue.Timestamp. It
+	// takes 8 bytes per write, and is kept by flushes and compactions, e.g. for TTLs or
+	// last-modified queries. Writes made without it have no timestamp.
+	Timestamps bool
+	// UndeleteWindow makes Delete keep the value it deletes in its tombstone, so that Undelete
+	// can restore it for that long after the deletion, e.g. to take back a mistaken delete from
+	// an interactive client. Deletes look the value up first, like CAS, and their tombstones
+	// take up the size of the value, until the first compaction after the window drops the
+	// value. Tombstones record the time of the deletion even without Timestamps. 0 disables it.
+	UndeleteWindow time.Duration
+	// ValueLogThreshold is the size (in bytes) from which on values are appended to the value
+	// log, with only a pointer to them stored in the memtables and SSTables. A negative
+	// threshold keeps all values inline.
+	ValueLogThreshold int
+	// ValueLogFileSize is the size (in bytes) at which a new value log file is started.
+	ValueLogFileSize int
+	// ValueLogGCRatio is the share of a value log file no longer referenced by any SSTable
+	// from which on compactions move the values still in use to the active value log file,
+	// so that the old one can be deleted.
+	ValueLogGCRatio float64
+	// Comparer defines the order of keys, bytewise by default. A data directory must always
+	// be reopened with the same Comparer it was created with; SSTables written with another
+	// one are refused.
+	Comparer *comparer.Comparer
+	// ParanoidChecks turns silent corruption into errors at the cost of extra reads and CPU:
+	// the checksum of every SSTable block read from disk is verified, the index of every
+	// SSTable is validated when it is opened, and the records of the WAL files are checked
+	// during replay. A corrupt chunk fails the replay unless it is the torn tail of the newest
+	// WAL file, instead of silently dropping the records after it (unless WALRecovery is
+	// wal.SkipAnyCorruptRecord).
+	ParanoidChecks bool
+	// FS is the file system the data directory, the WAL archive, checkpoints and backups are
+	// on: the local one by default, or e.g. a storage.MemFS in tests.
+	FS storage.VFS
+	// OffloadLevel, if set, is the level from which on the SSTables written by compactions and
+	// ingestions are moved to the object store of FS, if it is a storage.TieredFS (rooted at
+	// the data directory). The WAL, the value log and the upper levels, where most reads and
+	// compactions happen, stay on local disk; offloaded tables are fetched into a local cache
+	// when they are opened.
+	OffloadLevel int
+	// BackgroundBytesPerSec, if set, limits the rate (in bytes per second) at which flushes and
+	// compactions write SSTables, so that they don't take all the disk bandwidth reads and WAL
+	// writes need. Throttled flushes can in turn stall writes (see L0SlowdownWritesThreshold),
+	// so it should stay well above the sustained write rate. It can be changed at runtime
+	// through DB.SetBackgroundBytesPerSec.
+	BackgroundBytesPerSec int64
+	// Logger receives the log messages of the DB. By default they are discarded.
+	Logger Logger
+	// SpanHook, if set, is called with the duration of the steps of reads, writes, flushes
+	// and compactions (see SpanKind) lasting at least SpanThreshold, e.g. to find out where
+	// slow writes spend their time, or to turn them into the spans of a tracing system. It is
+	// called synchronously, from any goroutine and possibly with the DB's lock held, so it
+	// has to be quick and must not call the DB.
+	SpanHook      func(Span)
+	SpanThreshold time.Duration
+	// Context, if set, shuts the DB down once done, as Close would: the background worker
+	// gives up the flush or compaction it is running, stalled writers are woken up, and every
+	// operation fails with ErrClosed from then on. It ties the DB to the lifetime of e.g. a
+	// server, which doesn't have to close it itself anymore.
+	Context context.Context
+}
+
+// WriteOptions control individual writes. A nil *WriteOptions is the same as NoSync.
+type WriteOptions struct {
+	// Sync forces the WAL to stable storage before the write is acknowledged,
+	// regardless of Options.WALSync.
+	Sync bool
+}
+
+var (
+	Sync   = &WriteOptions{Sync: true}
+	NoSync = &WriteOptions{Sync: false}
+)
+
+func (o *WriteOptions) sync() bool {
+	return o != nil && o.Sync
+}
+
+// ReadOptions control individual reads. A nil *ReadOptions is the same as the zero value:
+// the blocks read go into the block cache, and are verified with Options.ParanoidChecks only.
+type ReadOptions struct {
+	// DontFillCache leaves the data blocks read from disk out of the block cache, so that a
+	// scan of cold data, e.g. by an analytical query or an export, doesn't evict the hot set.
+	// Blocks already cached are still used.
+	DontFillCache bool
+	// VerifyChecksums verifies every data block read from disk against its checksum, as
+	// Options.ParanoidChecks does for every read, failing the read with sstable.ErrCorruption
+	// on a mismatch.
+	VerifyChecksums bool
+}
+
+func (o *ReadOptions) sstable() sstable.ReadOptions {
+	if o == nil {
+		return sstable.ReadOptions{}
+	}
+	return sstable.ReadOptions{DontFillCache: o.DontFillCache, VerifyChecksums: o.VerifyChecksums}
+}
+
+// DefaultOptions returns the options used when Open is called with nil.
+func DefaultOptions() *Options {
+	return &Options{
+		MemtableSizeLimit:               defaultMemtableSizeLimit,
+		MemtableFlushThreshold:          defaultMemtableFlushThreshold,
+		MaxImmutableMemtables:           defaultMaxImmutableMemtables,
+		FlushPolicy:                     ThresholdFlush{Threshold: defaultMemtableFlushThreshold},
+		L0CompactionThreshold:           defaultL0CompactionThreshold,
+		CompactionPicker:                LeveledCompaction{},
+		L0SlowdownWritesThreshold:       defaultL0SlowdownWrites,
+		L0StopWritesThreshold:           defaultL0StopWrites,
+		MemtableSlowdownWritesThreshold: defaultMemtableSlowdownWrites,
+		WriteSlowdownDelay:              defaultWriteSlowdownDelay,
+		LBaseMaxBytes:                   defaultLBaseMaxBytes,
+		LevelSizeMultiplier:             defaultLevelSizeMultiplier,
+		TargetFileSize:                  defaultTargetFileSize,
+		BlockSize:                       sstable.DefaultBlockSize,
+		BlockChunkSize:                  sstable.DefaultBlockChunkSize,
+		Compression:                     sstable.SnappyCompression,
+		BlockCacheSize:                  defaultBlockCacheSize,
+		TableCacheSize:                  defaultTableCacheSize,
+		ReadWorkers:                     defaultReadWorkers,
+		FilterBitsPerKey:                defaultFilterBitsPerKey,
+		WALSync:                         wal.SyncPerCommit,
+		WALSyncInterval:                 defaultWALSyncInterval,
+		ValueLogThreshold:               defaultValueLogThreshold,
+		ValueLogFileSize:                defaultValueLogFileSize,
+		ValueLogGCRatio:                 defaultValueLogGCRatio,
+		Comparer:                        comparer.Default,
+		FS:                              storage.Default,
+		Logger:                          DiscardLogger,
+	}
+}
+
+// ensureDefaults returns a copy of the options with every unset field
+// replaced by its default value.
+func (o *Options) ensureDefaults() *Options {
+	d := DefaultOptions()
+	if o == nil {
+		return d
+	}
+	opts := *o
+	if opts.MemtableSizeLimit <= 0 {
+		opts.MemtableSizeLimit = d.MemtableSizeLimit
+	}
+	if opts.MemtableFlushThreshold <= 0 {
+		opts.MemtableFlushThreshold = d.MemtableFlushThreshold
+	}
+	if opts.FlushPolicy == nil {
+		opts.FlushPolicy = ThresholdFlush{Threshold: opts.MemtableFlushThreshold}
+	}
+	if opts.MaxImmutableMemtables <= 0 {
+		opts.MaxImmutableMemtables = d.MaxImmutableMemtables
+	}
+	if opts.L0CompactionThreshold <= 0 {
+		opts.L0CompactionThreshold = d.L0CompactionThreshold
+	}
+	if opts.CompactionPicker == nil {
+		opts.CompactionPicker = d.CompactionPicker
+	}
+	if opts.MemtableSlowdownWritesThreshold <= 0 {
+		opts.MemtableSlowdownWritesThreshold = d.MemtableSlowdownWritesThreshold
+	}
+	if opts.L0SlowdownWritesThreshold <= 0 {
+		opts.L0SlowdownWritesThreshold = d.L0SlowdownWritesThreshold
+	}
+	if opts.L0StopWritesThreshold <= 0 {
+		opts.L0StopWritesThreshold = d.L0StopWritesThreshold
+	}
+	if opts.WriteSlowdownDelay <= 0 {
+		opts.WriteSlowdownDelay = d.WriteSlowdownDelay
+	}
+	if opts.LBaseMaxBytes <= 0 {
+		opts.LBaseMaxBytes = d.LBaseMaxBytes
+	}
+	if opts.LevelSizeMultiplier <= 1 {
+		opts.LevelSizeMultiplier = d.LevelSizeMultiplier
+	}
+	if opts.TargetFileSize <= 0 {
+		opts.TargetFileSize = d.TargetFileSize
+	}
+	if opts.BlockSize <= 0 {
+		opts.BlockSize = d.BlockSize
+	}
+	if opts.BlockChunkSize <= 0 {
+		opts.BlockChunkSize = d.BlockChunkSize
+	}
+	if opts.BlockCacheSize <= 0 {
+		opts.BlockCacheSize = d.BlockCacheSize
+	}
+	if opts.TableCacheSize <= 0 {
+		opts.TableCacheSize = d.TableCacheSize
+	}
+	if opts.ReadWorkers == 0 {
+		opts.ReadWorkers = d.ReadWorkers
+	}
+	if opts.FilterBitsPerKey == 0 {
+		opts.FilterBitsPerKey = d.FilterBitsPerKey
+	}
+	if opts.WALSyncInterval <= 0 {
+		opts.WALSyncInterval = d.WALSyncInterval
+	}
+	if opts.Compression == sstable.DefaultCompression {
+		opts.Compression = d.Compression
+	}
+	if opts.ValueLogThreshold == 0 {
+		opts.ValueLogThreshold = d.ValueLogThreshold
+	}
+	if opts.ValueLogFileSize <= 0 {
+		opts.ValueLogFileSize = d.ValueLogFileSize
+	}
+	if opts.ValueLogGCRatio <= 0 || opts.ValueLogGCRatio > 1 {
+		opts.ValueLogGCRatio = d.ValueLogGCRatio
+	}
+	if opts.Comparer == nil {
+		opts.Comparer = d.Comparer
+	}
+	if opts.FS == nil {
+		opts.FS = d.FS
+	}
+	if opts.Logger == nil {
+		opts.Logger = d.Logger
+	}
+	return &opts
+}
+
+// sstableOptions derives the options handed to SSTable writers and readers.
+func (o *Options) sstableOptions() sstable.Options {
+	return sstable.Options{
+		BlockSize:           o.BlockSize,
+		BlockChunkSize:      o.BlockChunkSize,
+		Compression:         o.Compression,
+		Comparer:            o.Comparer,
+		CompressionDictSize: o.CompressionDictSize,
+		FilterBitsPerKey:    o.FilterBitsPerKey,
+		FilterType:          o.FilterType,
+		ParanoidChecks:      o.ParanoidChecks,
+		Mmap:                o.MmapReads,
+	}
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"lsm/encoder"
+	"lsm/sstable"
+	"lsm/storage"
+	"sync"
+	"sync/atomic"
+)
+
+// tableSearch is the search of an SSTable for the key of a Get.
+type tableSearch struct {
+	meta *storage.FileMetadata
+	r    *sstable.Reader
+	// release hands r back to the table cache
+	release func()
+	// index is the position of the table among the tables searched, newest first
+	index int
+	// the outcome: the version of key found (ErrKeyNotFound if none), and the largest
+	// sequence number of the table's range tombstones covering key
+	encodedValue   *encoder.EncodedValue
+	rangeDelSeqNum uint64
+	err            error
+}
+
+// settles reports whether the outcome of the search settles the key, whatever the older
+// tables hold: the table has a version of it, a range tombstone covering it, or failed.
+func (s *tableSearch) settles() bool {
+	return !errors.Is(s.err, ErrKeyNotFound) || s.rangeDelSeqNum > 0
+}
+
+// searchSSTables searches the SSTables from sstablesForKey for key, returning the outcome of
+// the search of each, newest first, up to the first one that settles key.
+// The filters and range tombstones of the tables, which are in memory, are checked one table
+// after the other, up to the first table whose range tombstones cover key, and the data blocks
+// of those whose filter may contain key are read concurrently: the caller reads the newest of
+// them, and hands the others to the read workers free (see Options.ReadWorkers), reading
+// itself those none is free for, newest first. A read that hasn't started yet when a newer
+// table settles key is skipped, and the outcome of one already running ignored, so that a cold
+// Get waits for one block read rather than one per table, and a warm one reads no more than it
+// has to.
+func (d *DB) searchSSTables(key []byte, files []*storage.FileMetadata, ro *ReadOptions) []*tableSearch {
+	var searches, reads []*tableSearch
+	for _, meta := range files {
+		s := &tableSearch{meta: meta, index: len(searches)}
+		searches = append(searches, s)
+		r, release, err := d.tableCache.get(meta)
+		if err != nil {
+			s.err = err
+			break
+		}
+		s.rangeDelSeqNum = encoder.CoveringSeqNum(d.cmp, r.RangeTombstones(), key)
+		if !r.MayContain(key) {
+			release()
+			s.err = ErrKeyNotFound
+		} else {
+			s.r, s.release = r, release
+			reads = append(reads, s)
+		}
+		if s.rangeDelSeqNum > 0 {
+			break // the older tables only hold versions the range tombstone deletes
+		}
+	}
+
+	// settled is the index of the newest table known to settle key
+	var settled atomic.Int64
+	settled.Store(int64(len(searches)))
+	search := func(s *tableSearch) {
+		if int64(s.index) > settled.Load() {
+			s.release()
+			return
+		}
+		s.search(key, ro)
+		for s.settles() {
+			newest := settled.Load()
+			if int64(s.index) >= newest || settled.CompareAndSwap(newest, int64(s.index)) {
+				break
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	inline := make([]*tableSearch, 0, len(reads))
+	for i, s := range reads {
+		if i == 0 {
+			inline = append(inline, s)
+			continue
+		}
+		select {
+		case d.readWorkers <- struct{}{}:
+			wg.Add(1)
+			go func(s *tableSearch) {
+				defer func() { <-d.readWorkers }()
+				defer wg.Done()
+				search(s)
+			}(s)
+		default:
+			inline = append(inline, s)
+		}
+	}
+	for _, s := range inline {
+		search(s)
+	}
+	// the tables must not be released before every search is done, a compaction could
+	// delete them
+	wg.Wait()
+	if n := int(settled.Load()); n < len(searches) {
+		searches = searches[:n+1]
+	}
+	return searches
+}
+
+// search reads the data block of the table that may hold key, and releases the table.
+func (s *tableSearch) search(key []byte, ro *ReadOptions) {
+	defer s.release()
+	s.encodedValue, s.err = s.r.GetWithOptions(key, ro.sstable())
+	if s.err != nil && !errors.Is(s.err, ErrKeyNotFound) {
+		s.rangeDelSeqNum = 0
+		s.err = fmt.Errorf("searching sstable %d: %w", s.meta.FileNum(), s.err)
+	}
+}
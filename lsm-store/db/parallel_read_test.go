@@ -0,0 +1,63 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// TestSearchSSTablesNewestFirst searches overlapping L0 tables, with and without read
+// workers: the newest version of a key has to win, and the search has to stop at the newest
+// table that settles the key, be it with a version of it or a range tombstone covering it.
+func TestSearchSSTablesNewestFirst(t *testing.T) {
+	for _, workers := range []int{-1, 1, 4} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			d, _ := openTestDB(t, &Options{L0CompactionThreshold: 100, ReadWorkers: workers})
+			// five L0 tables, newest last: k and z in each of them, r in the first two and
+			// deleted by a range tombstone in the third
+			for table := 0; table < 5; table++ {
+				for _, key := range []string{"k", "z"} {
+					if err := d.Set([]byte(key), []byte(fmt.Sprintf("v%d", table)), nil); err != nil {
+						t.Fatal(err)
+					}
+				}
+				switch {
+				case table < 2:
+					err := d.Set([]byte("r"), []byte(fmt.Sprintf("v%d", table)), nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+				case table == 2:
+					if err := d.DeleteRange([]byte("r"), []byte("s"), nil); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := d.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, tc := range []struct {
+				key      string
+				want     string // "" for a deleted key
+				searched int    // tables whose outcome is returned
+			}{
+				{"k", "v4", 1},
+				{"r", "", 3},
+			} {
+				for i := 0; i < 10; i++ {
+					val, err := d.Get([]byte(tc.key))
+					if tc.want == "" && !errors.Is(err, ErrKeyNotFound) || tc.want != "" && string(val) != tc.want {
+						t.Fatalf("Get(%q) returned %q, %v, want %q", tc.key, val, err, tc.want)
+					}
+				}
+				d.mu.Lock()
+				searches := d.searchSSTables([]byte(tc.key), d.defaultCF.sstablesForKey([]byte(tc.key)), nil)
+				d.mu.Unlock()
+				if len(searches) != tc.searched {
+					t.Fatalf("%d outcomes of searches for %q, want %d", len(searches), tc.key, tc.searched)
+				}
+			}
+		})
+	}
+}
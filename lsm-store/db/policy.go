@@ -0,0 +1,212 @@
+package db
+
+import (
+	"lsm/comparer"
+	"slices"
+)
+
+// CompactionPicker decides which compaction the background worker runs next, so that other
+// heuristics than the leveled one (LeveledCompaction, the default) can be tried without
+// changing the DB: compacting L0 later or earlier, favoring some levels or some key ranges,
+// picking files by age or by tombstones, and so on. The DB keeps the invariants of the levels
+// whatever the picker chooses, see CompactionPick.
+type CompactionPicker interface {
+	// PickCompaction returns the compaction the column family described by s needs most, or
+	// nil if it needs none. It is called with the DB's lock held, after every flush and
+	// compaction, and must not call the DB.
+	PickCompaction(s *CompactionState) *CompactionPick
+}
+
+// CompactionState is the state of a column family handed to a CompactionPicker.
+type CompactionState struct {
+	ColumnFamily string
+	// Levels are the SSTables of every level: L0 from oldest to newest, L1 and below sorted by
+	// key range, which don't overlap within a level.
+	Levels [][]FileInfo
+	// Options are the options of the DB, defaults applied.
+	Options *Options
+}
+
+// CompactionPick is a compaction chosen by a CompactionPicker: the tables of Level whose file
+// numbers are Inputs are merged into Level+1, along with the tables of Level+1 they overlap,
+// which the DB adds so that the tables of L1 and below keep not overlapping. L0 tables may
+// overlap each other, so a compaction of L0 always takes all of them: an older L0 table left
+// behind would end up above newer versions of its keys.
+type CompactionPick struct {
+	Level  int
+	Inputs []int
+	// Score ranks the picks of the column families, the DB running the highest one first.
+	Score float64
+}
+
+// LeveledCompaction is the default CompactionPicker. It scores every level by how urgently it
+// needs compaction, L0 by its number of tables relative to Options.L0CompactionThreshold (each
+// of them has to be consulted on reads), every other level by its size relative to its target
+// size (Options.LBaseMaxBytes for L1, LevelSizeMultiplier times the level above for the others),
+// and compacts the level with the highest score of at least 1. Below L0, it compacts the table
+// that overlaps the fewest bytes of the next level relative to its own size, which pushes the
+// most data down for the least rewriting.
+type LeveledCompaction struct{}
+
+func (LeveledCompaction) PickCompaction(s *CompactionState) *CompactionPick {
+	level, bestScore := -1, 1.0
+	// the bottom level can't be compacted any further
+	for l := 0; l < len(s.Levels)-1; l++ {
+		if score := levelScore(s, l); score >= bestScore {
+			level, bestScore = l, score
+		}
+	}
+	if level < 0 {
+		return nil
+	}
+	pick := &CompactionPick{Level: level, Score: bestScore}
+	if level == 0 {
+		for _, f := range s.Levels[0] {
+			pick.Inputs = append(pick.Inputs, f.FileNum)
+		}
+		return pick
+	}
+	var best FileInfo
+	var bestRatio float64
+	for i, f := range s.Levels[level] {
+		overlap := totalFileSize(overlappingFileInfos(s.Options.Comparer.Compare, s.Levels[level+1], f.SmallestKey, f.LargestKey))
+		ratio := float64(overlap) / float64(max(f.Size, 1))
+		if i == 0 || ratio < bestRatio {
+			best, bestRatio = f, ratio
+		}
+	}
+	pick.Inputs = []int{best.FileNum}
+	return pick
+}
+
+// levelScore is the score of a level for LeveledCompaction; a score >= 1 means it needs
+// compaction.
+func levelScore(s *CompactionState, level int) float64 {
+	if level == 0 {
+		return float64(len(s.Levels[0])) / float64(s.Options.L0CompactionThreshold)
+	}
+	target := float64(s.Options.LBaseMaxBytes)
+	for l := 1; l < level; l++ {
+		target *= float64(s.Options.LevelSizeMultiplier)
+	}
+	return float64(totalFileSize(s.Levels[level])) / target
+}
+
+func totalFileSize(files []FileInfo) int64 {
+	var size int64
+	for _, f := range files {
+		size += f.Size
+	}
+	return size
+}
+
+// overlappingFileInfos returns the files whose key ranges intersect [start, end], as
+// storage.FileMetadata.OverlapsRange does: a nil start or end leaves that side of the range
+// unbounded, and empty tables (without a key range) don't overlap anything.
+func overlappingFileInfos(cmp comparer.Compare, files []FileInfo, start, end []byte) []FileInfo {
+	var overlapping []FileInfo
+	for _, f := range files {
+		if f.SmallestKey == nil || f.LargestKey == nil ||
+			start != nil && cmp(f.LargestKey, start) < 0 || end != nil && cmp(f.SmallestKey, end) > 0 {
+			continue
+		}
+		overlapping = append(overlapping, f)
+	}
+	return overlapping
+}
+
+// compactionState describes the levels of the column family to the CompactionPicker. Must be
+// called with d.mu held.
+func (cf *ColumnFamily) compactionState() *CompactionState {
+	s := &CompactionState{ColumnFamily: cf.name, Levels: make([][]FileInfo, numLevels), Options: cf.db.opts}
+	for level, files := range cf.levels {
+		for _, f := range files {
+			s.Levels[level] = append(s.Levels[level], tableInfo(cf, level, f))
+		}
+	}
+	return s
+}
+
+// compactionFromPick turns the pick of a CompactionPicker into a compaction, adding the tables
+// the levels' invariants require. Returns nil for a pick naming a level that can't be compacted
+// or no table of it. Must be called with d.mu held.
+func (cf *ColumnFamily) compactionFromPick(pick *CompactionPick) *compaction {
+	if pick.Level < 0 || pick.Level >= numLevels-1 {
+		return nil
+	}
+	c := &compaction{cf: cf, level: pick.Level}
+	if pick.Level == 0 {
+		c.inputs[0] = slices.Clone(cf.levels[0])
+	} else {
+		for _, f := range cf.levels[pick.Level] {
+			if slices.Contains(pick.Inputs, f.FileNum()) {
+				c.inputs[0] = append(c.inputs[0], f)
+			}
+		}
+		if len(c.inputs[0]) != len(pick.Inputs) {
+			return nil
+		}
+	}
+	if len(c.inputs[0]) == 0 {
+		return nil
+	}
+	// inputs without a key range are empty tables that don't overlap anything
+	if start, end := keyRange(cf.db.cmp, c.inputs[0]); start != nil {
+		c.inputs[1] = cf.overlappingFiles(pick.Level+1, start, end)
+	}
+	return c
+}
+
+// pickCompaction asks the CompactionPicker for the compaction every column family needs most,
+// and returns the one with the highest score. Returns nil if none needs compaction. Picks that
+// don't name tables of a level that can be compacted are logged and ignored.
+// Must be called with d.mu held.
+func (d *DB) pickCompaction() *compaction {
+	var best *compaction
+	var bestScore float64
+	for _, cf := range d.columnFamilies {
+		pick := d.opts.CompactionPicker.PickCompaction(cf.compactionState())
+		if pick == nil {
+			continue
+		}
+		c := cf.compactionFromPick(pick)
+		if c == nil {
+			d.opts.Logger.Errorf("ignoring the compaction of L%d tables %v of column family %q: no such tables to compact", pick.Level, pick.Inputs, cf.name)
+			continue
+		}
+		if best == nil || pick.Score > bestScore {
+			best, bestScore = c, pick.Score
+		}
+	}
+	return best
+}
+
+// FlushPolicy decides when the background worker flushes the memtables, e.g. to flush early
+// while L0 is small or late to write fewer, larger L0 tables. Whatever it decides, memtables
+// are made immutable once full (Options.MemtableSizeLimit), and flushed as soon as writers
+// stall on them (see Options.MaxImmutableMemtables).
+type FlushPolicy interface {
+	// ShouldFlush reports whether the immutable memtables should be flushed now. It is called
+	// with the DB's lock held after every write, and must not call the DB.
+	ShouldFlush(s FlushState) bool
+}
+
+// FlushState is the state of the memtables handed to a FlushPolicy.
+type FlushState struct {
+	// MemtableBytes is the size of all memtables of every column family, mutable ones included.
+	MemtableBytes int
+	// ImmutableMemtables and L0Tables are the largest numbers of immutable memtables and of L0
+	// tables of a column family.
+	ImmutableMemtables int
+	L0Tables           int
+}
+
+// ThresholdFlush is the default FlushPolicy: it flushes once the memtables take more than
+// Threshold bytes, Options.MemtableFlushThreshold unless the options set another FlushPolicy.
+type ThresholdFlush struct {
+	Threshold int
+}
+
+func (p ThresholdFlush) ShouldFlush(s FlushState) bool {
+	return s.MemtableBytes > p.Threshold
+}
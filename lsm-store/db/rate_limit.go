@@ -0,0 +1,27 @@
+package db
+
+import "lsm/storage"
+
+// SetBackgroundBytesPerSec changes the rate limit of flushes and compactions (see
+// Options.BackgroundBytesPerSec); bytesPerSec <= 0 lifts it. Writers currently throttled pick
+// up the new rate right away.
+func (d *DB) SetBackgroundBytesPerSec(bytesPerSec int64) {
+	d.limiter.SetRate(bytesPerSec)
+}
+
+// throttledFile is an SSTable written by a flush or a compaction, at the pace of the
+// background rate limit. Once the DB is closing, writes are no longer held back so that
+// Close doesn't wait for a slow compaction.
+type throttledFile struct {
+	storage.File
+	d *DB
+}
+
+func (d *DB) throttle(f storage.File) storage.File {
+	return throttledFile{File: f, d: d}
+}
+
+func (f throttledFile) Write(p []byte) (int, error) {
+	f.d.limiter.Wait(len(p), f.d.bg.closing)
+	return f.File.Write(p)
+}
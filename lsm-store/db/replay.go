@@ -0,0 +1,147 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ReplayOptions set the pace of Replay.
+type ReplayOptions struct {
+	// Speed scales the timing of the trace: 1 replays it at its original pace, 2 twice as fast.
+	// 0 replays every operation as soon as the previous one returns.
+	Speed float64
+}
+
+// ReplayResult sums up a replay.
+type ReplayResult struct {
+	Ops      map[TraceOp]int // operations replayed, by kind
+	Duration time.Duration
+	// MaxLag is how late the latest operation was started compared to the schedule of the
+	// trace, e.g. because the DB is slower than the one traced. Always 0 at full speed.
+	MaxLag time.Duration
+}
+
+// Replay runs the operations of a trace written by StartTrace against the DB, one after the
+// other, e.g. on a fresh DB to reproduce the workload of another one. Column families missing
+// from the DB are created. Reads of missing keys and CAS conflicts are part of the workload,
+// any other error stops the replay.
+//
+// Operations are run one at a time in the order of the trace (scans at the time their iterator
+// was created), so a trace of concurrent operations is replayed serially. Scans are replayed
+// from their first position, moving forward (or backward) as many times as the iterator moved.
+func (d *DB) Replay(r io.Reader, opts *ReplayOptions) (*ReplayResult, error) {
+	var speed float64
+	if opts != nil {
+		speed = opts.Speed
+	}
+	tr, err := NewTraceReader(r)
+	if err != nil {
+		return nil, err
+	}
+	res := &ReplayResult{Ops: make(map[TraceOp]int)}
+	start := time.Now()
+	defer func() { res.Duration = time.Since(start) }()
+	cfs := make(map[string]*ColumnFamily)
+	for {
+		rec, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return res, nil
+		}
+		if err != nil {
+			return res, err
+		}
+		if speed > 0 {
+			due := start.Add(time.Duration(float64(rec.Time) / speed))
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+			} else {
+				res.MaxLag = max(res.MaxLag, -wait)
+			}
+		}
+
+		cf, ok := cfs[rec.ColumnFamily]
+		if !ok {
+			if cf, err = d.replayColumnFamily(rec.ColumnFamily); err != nil {
+				return res, err
+			}
+			cfs[rec.ColumnFamily] = cf
+		}
+		if err := cf.replay(rec); err != nil {
+			return res, fmt.Errorf("replaying %s at %v: %w", rec.Op, rec.Time, err)
+		}
+		res.Ops[rec.Op]++
+	}
+}
+
+// replayColumnFamily returns the column family named name, creating it if needed.
+func (d *DB) replayColumnFamily(name string) (*ColumnFamily, error) {
+	cf, err := d.ColumnFamily(name)
+	if errors.Is(err, ErrColumnFamilyNotFound) {
+		cf, err = d.CreateColumnFamily(name)
+	}
+	return cf, err
+}
+
+// replay runs a recorded operation.
+func (cf *ColumnFamily) replay(rec *TraceRecord) error {
+	var err error
+	switch rec.Op {
+	case TraceSet:
+		err = cf.Set(rec.Key, rec.Value, rec.WriteOptions)
+	case TraceGet:
+		_, err = cf.Get(rec.Key)
+	case TraceDelete:
+		err = cf.Delete(rec.Key, rec.WriteOptions)
+	case TraceDeleteRange:
+		err = cf.DeleteRange(rec.Key, rec.End, rec.WriteOptions)
+	case TraceCAS:
+		err = cf.CAS(rec.Key, rec.Old, rec.Value, rec.WriteOptions)
+	case TraceMultiGet:
+		_, errs := cf.MultiGet(rec.Keys)
+		for _, e := range errs {
+			if e != nil && !errors.Is(e, ErrKeyNotFound) {
+				return e
+			}
+		}
+	case TraceScan:
+		err = cf.replayScan(rec)
+	case TraceUndelete:
+		err = cf.Undelete(rec.Key, rec.WriteOptions)
+	}
+	if errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrCASConflict) || errors.Is(err, ErrNotUndeletable) {
+		return nil
+	}
+	return err
+}
+
+func (cf *ColumnFamily) replayScan(rec *TraceRecord) error {
+	it, err := cf.NewIter(&IterOptions{LowerBound: rec.Lower, UpperBound: rec.Upper})
+	if err != nil {
+		return err
+	}
+	var valid bool
+	switch {
+	case rec.Key == nil && rec.Reverse:
+		valid = it.Last()
+	case rec.Key == nil:
+		valid = it.First()
+	case rec.Reverse:
+		valid = it.SeekLT(rec.Key)
+	default:
+		valid = it.Seek(rec.Key)
+	}
+	for n := 0; valid && n < rec.Steps; n++ {
+		if rec.Reverse {
+			valid = it.Prev()
+		} else {
+			valid = it.Next()
+		}
+	}
+	if err := it.Error(); err != nil {
+		it.Close()
+		return err
+	}
+	return it.Close()
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"fmt"
+	"lsm/storage"
+	"time"
+)
+
+// SpanKind is a step of the work of the DB timed for Options.SpanHook.
+type SpanKind uint8
+
+const (
+	// SpanWALAppend is the append of a record to the WAL. With wal.SyncPerCommit, it includes
+	// the sync of the record, which is reported as a SpanWALSync of its own.
+	SpanWALAppend SpanKind = iota
+	// SpanWALSync and SpanValueLogSync are the fsyncs of a WAL or value log file.
+	SpanWALSync
+	SpanValueLogSync
+	// SpanMemtableInsert is the insert of a write into the memtable.
+	SpanMemtableInsert
+	// SpanWriteStall is the time a write was slowed down or stopped by a write stall.
+	SpanWriteStall
+	// SpanBlockRead is the read of a data block from disk, decompression included. Blocks
+	// served by the block cache aren't reported.
+	SpanBlockRead
+	// SpanFlush is the write of an SSTable from memtables, and SpanCompaction the merge of
+	// the inputs of a compaction into its output tables, syncs included.
+	SpanFlush
+	SpanCompaction
+	// SpanManifestWrite is the write of the manifest, e.g. installing the tables written by a
+	// flush or a compaction.
+	SpanManifestWrite
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case SpanWALAppend:
+		return "wal-append"
+	case SpanWALSync:
+		return "wal-sync"
+	case SpanValueLogSync:
+		return "vlog-sync"
+	case SpanMemtableInsert:
+		return "memtable-insert"
+	case SpanWriteStall:
+		return "write-stall"
+	case SpanBlockRead:
+		return "block-read"
+	case SpanFlush:
+		return "flush"
+	case SpanCompaction:
+		return "compaction"
+	case SpanManifestWrite:
+		return "manifest-write"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(k))
+}
+
+// Span is a timed step of the work of the DB, handed to Options.SpanHook. Spans may nest: a
+// SpanWALSync falls within the SpanWALAppend of the record it syncs, SpanBlockReads within
+// a SpanCompaction, and so on, which Start and Duration tell.
+type Span struct {
+	Kind     SpanKind
+	Start    time.Time
+	Duration time.Duration
+	// FileNum is the file the step worked on: the WAL or value log file appended to or
+	// synced, the SSTable a block was read from or a flush wrote. 0 for the other steps.
+	FileNum int
+	// Bytes is the size of the record appended, of the block read, or of the tables written.
+	// 0 for the other steps.
+	Bytes int64
+}
+
+// spanStart returns the start of a span, the zero time if there is no SpanHook to report it
+// to, which saves reading the clock.
+func (d *DB) spanStart() time.Time {
+	if d.opts.SpanHook == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// endSpan reports the span of kind started at start to the SpanHook, if it lasted at least
+// Options.SpanThreshold.
+func (d *DB) endSpan(kind SpanKind, start time.Time, fileNum int, bytes int64) {
+	if d.opts.SpanHook == nil || start.IsZero() {
+		return
+	}
+	if elapsed := time.Since(start); elapsed >= d.opts.SpanThreshold {
+		d.opts.SpanHook(Span{Kind: kind, Start: start, Duration: elapsed, FileNum: fileNum, Bytes: bytes})
+	}
+}
+
+// spanFile reports the syncs of a WAL or value log file as spans of kind.
+type spanFile struct {
+	storage.File
+	d       *DB
+	kind    SpanKind
+	fileNum int
+}
+
+// withSyncSpans wraps f so that its syncs are reported as spans of kind, if there is a
+// SpanHook to report them to.
+func (d *DB) withSyncSpans(f storage.File, kind SpanKind, fileNum int) storage.File {
+	if d.opts.SpanHook == nil {
+		return f
+	}
+	return &spanFile{File: f, d: d, kind: kind, fileNum: fileNum}
+}
+
+func (f *spanFile) Sync() error {
+	start := time.Now()
+	err := f.File.Sync()
+	f.d.endSpan(f.kind, start, f.fileNum, 0)
+	return err
+}
@@ -0,0 +1,87 @@
+package db
+
+import "time"
+
+// WriteStall describes how writes are currently throttled to let flushes and compactions
+// catch up.
+type WriteStall uint8
+
+const (
+	WriteStallNone     WriteStall = iota
+	WriteStallSlowdown            // every write is delayed by Options.WriteSlowdownDelay
+	WriteStallStopped             // writes block until the backlog shrinks
+)
+
+func (s WriteStall) String() string {
+	switch s {
+	case WriteStallSlowdown:
+		return "slowdown"
+	case WriteStallStopped:
+		return "stopped"
+	default:
+		return "none"
+	}
+}
+
+// Stats is a snapshot of the state of the DB.
+type Stats struct {
+	// WriteStall is the current write stall state, and WriteStallCause what triggered it
+	// ("immutable memtables" or "L0 tables"; empty if writes aren't stalled).
+	WriteStall      WriteStall
+	WriteStallCause string
+	// ImmutableMemtables and L0Tables are the backlog of the column family furthest behind.
+	ImmutableMemtables int
+	L0Tables           int
+	// SlowedWrites and StoppedWrites count the writes that have been delayed or blocked since
+	// the DB was opened, and StallDuration the total time they spent stalled.
+	SlowedWrites  uint64
+	StoppedWrites uint64
+	StallDuration time.Duration
+	// SeqNum is the sequence number of the most recent write, e.g. to pass to RecoverToTime.
+	SeqNum uint64
+}
+
+// Stats returns a snapshot of the state of the DB.
+func (d *DB) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stall, cause := d.writeStall()
+	imm, l0 := d.backlog()
+	return Stats{
+		WriteStall:         stall,
+		WriteStallCause:    cause,
+		ImmutableMemtables: imm,
+		L0Tables:           l0,
+		SlowedWrites:       d.stall.slowed,
+		StoppedWrites:      d.stall.stopped,
+		StallDuration:      d.stall.duration,
+		SeqNum:             d.seqNum,
+	}
+}
+
+// backlog returns the largest number of immutable memtables and L0 tables of any column
+// family. Must be called with d.mu held.
+func (d *DB) backlog() (immutableMemtables, l0Tables int) {
+	for _, cf := range d.columnFamilies {
+		immutableMemtables = max(immutableMemtables, len(cf.memtables.queue)-1)
+		l0Tables = max(l0Tables, len(cf.levels[0]))
+	}
+	return immutableMemtables, l0Tables
+}
+
+// writeStall reports how writes have to be throttled given the backlog, and why.
+// Must be called with d.mu held.
+func (d *DB) writeStall() (WriteStall, string) {
+	imm, l0 := d.backlog()
+	switch {
+	case l0 >= d.opts.L0StopWritesThreshold:
+		return WriteStallStopped, "L0 tables"
+	case imm >= d.opts.MaxImmutableMemtables:
+		return WriteStallStopped, "immutable memtables"
+	case l0 >= d.opts.L0SlowdownWritesThreshold:
+		return WriteStallSlowdown, "L0 tables"
+	case imm >= d.opts.MemtableSlowdownWritesThreshold:
+		return WriteStallSlowdown, "immutable memtables"
+	}
+	return WriteStallNone, ""
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"container/list"
+	"lsm/sstable"
+	"lsm/storage"
+	"sync"
+)
+
+// tableCache keeps a bounded number of SSTable readers open, so that reads don't pay for
+// opening the file and loading its footer and index block every time. Readers are reference
+// counted: a reader evicted while in use is only closed once its last user releases it.
+type tableCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List            // most recently used tables at the front
+	tables   map[int]*list.Element // file number -> its element in ll
+	open     func(meta *storage.FileMetadata) (*sstable.Reader, error)
+}
+
+type tableCacheEntry struct {
+	fileNum int
+	r       *sstable.Reader
+	refs    int // users currently holding the reader, plus one while it is cached
+}
+
+func newTableCache(capacity int, open func(meta *storage.FileMetadata) (*sstable.Reader, error)) *tableCache {
+	return &tableCache{
+		capacity: capacity,
+		ll:       list.New(),
+		tables:   make(map[int]*list.Element),
+		open:     open,
+	}
+}
+
+// get returns the reader of an SSTable, opening it on a cache miss. The caller must call
+// release once done with the reader.
+func (c *tableCache) get(meta *storage.FileMetadata) (*sstable.Reader, func(), error) {
+	c.mu.Lock()
+	if e, ok := c.tables[meta.FileNum()]; ok {
+		c.ll.MoveToFront(e)
+		te := e.Value.(*tableCacheEntry)
+		te.refs++
+		c.mu.Unlock()
+		return te.r, func() { c.release(te) }, nil
+	}
+	c.mu.Unlock()
+
+	// open outside of the lock, a concurrent miss on the same table at worst opens it twice
+	r, err := c.open(meta)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.tables[meta.FileNum()]; ok {
+		r.Close()
+		c.ll.MoveToFront(e)
+		te := e.Value.(*tableCacheEntry)
+		te.refs++
+		return te.r, func() { c.release(te) }, nil
+	}
+	te := &tableCacheEntry{fileNum: meta.FileNum(), r: r, refs: 2}
+	c.tables[te.fileNum] = c.ll.PushFront(te)
+	for c.ll.Len() > c.capacity {
+		c.remove(c.ll.Back())
+	}
+	return r, func() { c.release(te) }, nil
+}
+
+func (c *tableCache) release(te *tableCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unref(te)
+}
+
+// unref drops a reference to the reader and closes it once it is no longer used.
+// Must be called with c.mu held.
+func (c *tableCache) unref(te *tableCacheEntry) {
+	te.refs--
+	if te.refs == 0 {
+		te.r.Close()
+	}
+}
+
+// remove drops a table from the cache. Must be called with c.mu held.
+func (c *tableCache) remove(e *list.Element) {
+	te := e.Value.(*tableCacheEntry)
+	c.ll.Remove(e)
+	delete(c.tables, te.fileNum)
+	c.unref(te)
+}
+
+// evict drops the reader of a file from the cache, e.g. once the file has been deleted.
+func (c *tableCache) evict(fileNum int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.tables[fileNum]; ok {
+		c.remove(e)
+	}
+}
+
+// close closes all cached readers. Readers still in use are closed once released.
+func (c *tableCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.ll.Len() > 0 {
+		c.remove(c.ll.Back())
+	}
+}
@@ -0,0 +1,81 @@
+package db
+
+import (
+	"errors"
+	"lsm/storage"
+)
+
+// tableRefs counts the references open iterators hold to SSTables, and keeps the SSTables a
+// compaction or a dropped column family made obsolete while they were referenced, until the
+// last reference is released: an iterator sees the DB as of its creation, and has to be able
+// to read its tables however long it stays open, whatever the file system does with deleted
+// files still open. Guarded by d.mu.
+type tableRefs struct {
+	refs     map[int]int                   // references to each table, by file number
+	obsolete map[int]*storage.FileMetadata // referenced tables to delete once released
+}
+
+// pinTables keeps the SSTables files from being deleted and returns a function unpinning
+// them, which deletes those that became obsolete in the meantime. Must be called with d.mu
+// held.
+func (d *DB) pinTables(files []*storage.FileMetadata) func() error {
+	for _, f := range files {
+		d.tables.refs[f.FileNum()]++
+	}
+	return func() error {
+		d.mu.Lock()
+		var obsolete []*storage.FileMetadata
+		for _, f := range files {
+			fileNum := f.FileNum()
+			if d.tables.refs[fileNum]--; d.tables.refs[fileNum] > 0 {
+				continue
+			}
+			delete(d.tables.refs, fileNum)
+			if fm, ok := d.tables.obsolete[fileNum]; ok {
+				obsolete = append(obsolete, fm)
+				delete(d.tables.obsolete, fileNum)
+			}
+		}
+		d.mu.Unlock()
+		// no read other than the iterator's can reach them: they left the levels before
+		// they were found pinned
+		var errs []error
+		for _, f := range obsolete {
+			errs = append(errs, d.deleteTable(f))
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// deleteTables deletes SSTables no level references anymore, once no iterator does either.
+// Must be called with d.readers held exclusively, for the reads that found the tables in their
+// levels to be done. The tables still pinned when the DB is closed are deleted by the next
+// Open, which doesn't find them in the manifest.
+func (d *DB) deleteTables(files []*storage.FileMetadata) error {
+	var unpinned []*storage.FileMetadata
+	d.mu.Lock()
+	for _, f := range files {
+		if d.tables.refs[f.FileNum()] > 0 {
+			d.tables.obsolete[f.FileNum()] = f
+		} else {
+			unpinned = append(unpinned, f)
+		}
+	}
+	d.mu.Unlock()
+	for _, f := range unpinned {
+		if err := d.deleteTable(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteTable deletes an SSTable and drops it from the caches.
+func (d *DB) deleteTable(f *storage.FileMetadata) error {
+	if err := d.dataStorage.DeleteFile(f); err != nil {
+		return err
+	}
+	d.tableCache.evict(f.FileNum())
+	d.blockCache.EvictFile(f.FileNum())
+	return nil
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"fmt"
+	"lsm/storage"
+	"path"
+	"slices"
+	"testing"
+)
+
+// openTestDB opens a DB in /db on a file system held in memory, closed at the end of the test.
+func openTestDB(t *testing.T, opts *Options) (*DB, storage.VFS) {
+	t.Helper()
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.FS == nil {
+		opts.FS = storage.NewMemFS()
+	}
+	d, err := Open("/db", opts)
+	if err != nil {
+		t.Fatalf("opening the DB: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d, opts.FS
+}
+
+// tableFiles returns the names of the SSTables of the DB in /db.
+func tableFiles(t *testing.T, fs storage.VFS) []string {
+	t.Helper()
+	entries, err := fs.List("/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if path.Ext(e.Name()) == ".sst" {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+func TestCompactedTablesOutliveIterators(t *testing.T) {
+	d, fs := openTestDB(t, nil)
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 100; i++ {
+			if err := d.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("v%d", round)), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := tableFiles(t, fs)
+	if len(before) < 2 {
+		t.Fatalf("%d SSTables after two flushes", len(before))
+	}
+
+	it, err := d.NewIter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	after := tableFiles(t, fs)
+	for _, name := range before {
+		if !slices.Contains(after, name) {
+			t.Fatalf("%s deleted by the compaction while an iterator reads from it", name)
+		}
+	}
+	n := 0
+	for valid := it.First(); valid; valid = it.Next() {
+		if want := fmt.Sprintf("key%03d", n); string(it.Key()) != want || string(it.Value()) != "v1" {
+			t.Fatalf("iterator at %q -> %q, want %q -> v1", it.Key(), it.Value(), want)
+		}
+		n++
+	}
+	if err := it.Error(); err != nil || n != 100 {
+		t.Fatalf("iterator read %d keys: %v", n, err)
+	}
+
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	after = tableFiles(t, fs)
+	for _, name := range before {
+		if slices.Contains(after, name) {
+			t.Fatalf("%s compacted away but not deleted once the iterator was closed", name)
+		}
+	}
+	if len(after) == 0 {
+		t.Fatal("the output of the compaction is missing")
+	}
+}
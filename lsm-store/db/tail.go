@@ -0,0 +1,215 @@
+package db
+
+import (
+	"errors"
+	"io/fs"
+	"lsm/storage"
+	"lsm/wal"
+)
+
+// ErrWALSegmentGone is returned for a WAL segment a tailer can't follow: one that has been
+// flushed and deleted (or removed from Options.WALArchiveDir), or was written before the DB
+// was opened.
+var ErrWALSegmentGone = errors.New("db: WAL segment no longer available")
+
+// TailWAL returns a tailer yielding every write to the DB from offset of the WAL segment fm
+// on, as soon as it is synced, across WAL rotations. Start it at WALPosition to get the writes
+// from now on. As long as the tailer isn't closed, the segments it has yet to read aren't
+// deleted once their memtables are flushed, but only detached from the data directory (or
+// archived, see Options.WALArchiveDir), so a tailer that is never closed keeps every WAL
+// segment written after its position on disk.
+func (d *DB) TailWAL(fm *storage.FileMetadata, offset int64) (*wal.Tailer, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+	d.tail.mu.Lock()
+	defer d.tail.mu.Unlock()
+	if fm != d.wal.fm && d.tail.next[fm.FileNum()] == nil {
+		return nil, ErrWALSegmentGone
+	}
+	src := &walTailSource{d: d, fileNum: fm.FileNum()}
+	d.tail.sources[src] = struct{}{}
+	return wal.NewTailer(src, fm, offset), nil
+}
+
+// TailWALFrom returns a tailer like TailWAL, started at the oldest WAL segment written since
+// Open that is still around, so that it yields every write from the sequence number seqNum on
+// (along with some older ones). It returns ErrWALSegmentGone if some of these writes are in no
+// such segment anymore, e.g. for a follower that fell too far behind. With WALArchiveDir set,
+// the segments archived since Open remain available (the DB keeps track of them all).
+func (d *DB) TailWALFrom(seqNum uint64) (*wal.Tailer, error) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil, ErrClosed
+	}
+	// the writes from now on are all in the segments from the oldest one on
+	first := d.seqNum + 1
+	d.tail.mu.Lock()
+	fm := d.wal.fm
+	for _, sealed := range d.tail.sealed {
+		if sealed.FileNum() < fm.FileNum() {
+			fm = sealed
+		}
+	}
+	src := &walTailSource{d: d, fileNum: fm.FileNum()}
+	d.tail.sources[src] = struct{}{}
+	d.tail.mu.Unlock()
+	d.mu.Unlock()
+
+	t := wal.NewTailer(src, fm, 0)
+	// the segment is held on to by now, it is safe to read its first record
+	f, err := src.OpenSegment(fm)
+	if err != nil {
+		t.Close()
+		if errors.Is(err, fs.ErrNotExist) {
+			err = ErrWALSegmentGone
+		}
+		return nil, err
+	}
+	if _, _, val, err := wal.NewReader(f).Next(); err == nil {
+		first = min(first, val.SeqNum())
+	}
+	f.Close()
+	if first > seqNum {
+		t.Close()
+		return nil, ErrWALSegmentGone
+	}
+	return t, nil
+}
+
+// WALPosition returns the active WAL segment and the number of bytes of it synced so far: a
+// tailer started there gets every write synced from now on.
+func (d *DB) WALPosition() (*storage.FileMetadata, int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	synced, _ := d.wal.w.Synced()
+	return d.wal.fm, synced
+}
+
+// retainForTailers reports whether a tailer still has to read the WAL segment fm being
+// retired, which is then kept track of until they are done with it.
+func (d *DB) retainForTailers(fm *storage.FileMetadata) bool {
+	d.tail.mu.Lock()
+	defer d.tail.mu.Unlock()
+	for src := range d.tail.sources {
+		if src.fileNum <= fm.FileNum() {
+			d.tail.retained = append(d.tail.retained, fm)
+			return true
+		}
+	}
+	d.forgetSealedWAL(fm)
+	return false
+}
+
+// releaseTailedWALs forgets about the retired WAL segments the tailers are done with (all of
+// them once the DB is closed), deleting those detached.
+func (d *DB) releaseTailedWALs(all bool) error {
+	d.tail.mu.Lock()
+	var release []*storage.FileMetadata
+	retained := d.tail.retained[:0]
+	for _, fm := range d.tail.retained {
+		held := false
+		for src := range d.tail.sources {
+			held = held || src.fileNum <= fm.FileNum()
+		}
+		if held && !all {
+			retained = append(retained, fm)
+		} else {
+			release = append(release, fm)
+			d.forgetSealedWAL(fm)
+		}
+	}
+	d.tail.retained = retained
+	if all {
+		clear(d.tail.sources)
+	}
+	d.tail.mu.Unlock()
+	if d.opts.WALArchiveDir != "" {
+		return nil
+	}
+	for _, fm := range release {
+		if err := d.dataStorage.DeleteTempFile(fm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forgetSealedWAL stops tailers from following the retired WAL segment fm, unless it is
+// archived, which keeps it around for tailers started later. Must be called with d.tail.mu held.
+func (d *DB) forgetSealedWAL(fm *storage.FileMetadata) {
+	if d.opts.WALArchiveDir != "" {
+		return
+	}
+	delete(d.tail.sealed, fm.FileNum())
+	delete(d.tail.next, fm.FileNum())
+}
+
+// walTailSource gives a tailer access to the WAL segments of the DB.
+type walTailSource struct {
+	d       *DB
+	fileNum int // of the segment the tailer reads, guarded by d.tail.mu
+}
+
+func (s *walTailSource) OpenSegment(fm *storage.FileMetadata) (storage.File, error) {
+	d := s.d
+	d.tail.mu.Lock()
+	_, ok := d.tail.sources[s]
+	if ok {
+		s.fileNum = fm.FileNum()
+	}
+	d.tail.mu.Unlock()
+	if !ok {
+		return nil, ErrClosed
+	}
+	if err := d.releaseTailedWALs(false); err != nil {
+		return nil, err
+	}
+	// the segment may have been retired since, then it is detached or archived
+	f, err := d.dataStorage.OpenFileForReading(fm)
+	if errors.Is(err, fs.ErrNotExist) {
+		f, err = d.dataStorage.OpenDetachedFile(fm)
+	}
+	if errors.Is(err, fs.ErrNotExist) && d.opts.WALArchiveDir != "" {
+		var archive *storage.Provider
+		if archive, err = storage.NewProvider(d.opts.FS, d.opts.WALArchiveDir); err == nil {
+			f, err = archive.OpenFileForReading(fm)
+		}
+	}
+	return f, err
+}
+
+func (s *walTailSource) SegmentState(fm *storage.FileMetadata) (wal.SegmentState, error) {
+	d := s.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return wal.SegmentState{}, ErrClosed
+	}
+	if fm == d.wal.fm {
+		synced, changed := d.wal.w.Synced()
+		return wal.SegmentState{Synced: synced, Changed: changed}, nil
+	}
+	d.tail.mu.Lock()
+	defer d.tail.mu.Unlock()
+	next := d.tail.next[fm.FileNum()]
+	if next == nil {
+		return wal.SegmentState{}, ErrWALSegmentGone
+	}
+	return wal.SegmentState{Synced: fm.Size(), Next: next}, nil
+}
+
+func (s *walTailSource) Close() error {
+	d := s.d
+	d.tail.mu.Lock()
+	_, ok := d.tail.sources[s]
+	delete(d.tail.sources, s)
+	d.tail.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return d.releaseTailedWALs(false)
+}
@@ -0,0 +1,411 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	traceHeader = "lsm-trace 1\n"
+
+	// keys, values and key lists longer than that are taken for a corrupt length
+	maxTraceFieldLen = 1 << 30
+)
+
+var (
+	ErrTraceRunning = errors.New("db: a trace is already running")
+	ErrCorruptTrace = errors.New("db: corrupt trace")
+)
+
+// TraceOp is the operation of a TraceRecord.
+type TraceOp uint8
+
+const (
+	TraceSet TraceOp = iota + 1
+	TraceGet
+	TraceDelete
+	TraceDeleteRange
+	TraceMultiGet
+	TraceCAS
+	TraceScan
+	TraceUndelete
+	numTraceOps
+)
+
+func (op TraceOp) String() string {
+	switch op {
+	case TraceSet:
+		return "set"
+	case TraceGet:
+		return "get"
+	case TraceDelete:
+		return "delete"
+	case TraceDeleteRange:
+		return "delete-range"
+	case TraceMultiGet:
+		return "multi-get"
+	case TraceCAS:
+		return "cas"
+	case TraceScan:
+		return "scan"
+	case TraceUndelete:
+		return "undelete"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(op))
+}
+
+// TraceRecord is an operation recorded by StartTrace.
+type TraceRecord struct {
+	Op TraceOp
+	// Time is when the operation was called, since the start of the trace.
+	Time         time.Duration
+	ColumnFamily string
+	// Key is the key of Set, Get, Delete, CAS and Undelete, the start of DeleteRange and the key a scan
+	// was positioned at first (nil for First and Last).
+	Key []byte
+	// Value is the value of Set and the new value of CAS (nil to delete).
+	Value []byte
+	// Old is the value CAS expected, nil for none.
+	Old []byte
+	// End is the end of DeleteRange.
+	End []byte
+	// Keys are the keys of MultiGet.
+	Keys [][]byte
+	// Lower and Upper are the bounds of a scan.
+	Lower, Upper []byte
+	// Reverse tells whether a scan was positioned backward first (Last or SeekLT), and Steps is
+	// how many times it moved afterwards.
+	Reverse bool
+	Steps   int
+	// WriteOptions are the options of a write, nil if none were given.
+	WriteOptions *WriteOptions
+}
+
+/*
+StartTrace records every read and write of the DB to w until EndTrace, along with the time it
+was called, e.g. to reproduce a workload with Replay. Set (SetAsync included), Get, Delete,
+DeleteRange, MultiGet, CAS and Undelete are recorded as they are called, in any column family.
+Iterators are recorded as scans when they are closed: their bounds, where they were positioned
+first and how many times they moved afterwards (seeks included). Bulk loads, ingestions and
+the writes of ApplyWALRecord aren't recorded.
+
+	header: "lsm-trace 1\n"
+	record: op (1B) | time since the start, ns (uvarint) | column family | fields of the op
+
+Byte fields are their length + 1 (uvarint) followed by their bytes, 0 standing for nil.
+Writes start with their options: 0 for none, 1 for NoSync, 2 for Sync.
+
+	set:          options | key | value
+	get:          key
+	delete:       options | key
+	delete-range: options | start | end
+	multi-get:    number of keys (uvarint) | keys
+	cas:          options | key | old | new
+	scan:         reverse (1B) | lower | upper | key | steps (uvarint)
+	undelete:     options | key
+
+Records are buffered, and written to w under a lock of their own: tracing slows down concurrent
+operations a little. If writing to w fails, the trace stops and EndTrace returns the error.
+*/
+func (d *DB) StartTrace(w io.Writer) error {
+	t := &tracer{w: bufio.NewWriter(w), start: time.Now()}
+	if !d.tracer.CompareAndSwap(nil, t) {
+		return ErrTraceRunning
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, t.err = t.w.WriteString(traceHeader)
+	return nil
+}
+
+// EndTrace stops the trace started by StartTrace and flushes it to its writer. Close ends a
+// trace still running.
+func (d *DB) EndTrace() error {
+	t := d.tracer.Swap(nil)
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil {
+		t.err = t.w.Flush()
+	}
+	t.done = true
+	return t.err
+}
+
+// tracer writes the records of a trace.
+type tracer struct {
+	mu    sync.Mutex
+	w     *bufio.Writer
+	start time.Time
+	buf   []byte
+	err   error // first error writing to w
+	done  bool  // whether EndTrace was called, operations in flight aren't recorded anymore
+}
+
+// record writes a record of op, called at, with the fields appended by fields.
+func (t *tracer) record(op TraceOp, cf *ColumnFamily, at time.Time, fields func(buf []byte) []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil || t.done {
+		return
+	}
+	buf := append(t.buf[:0], byte(op))
+	buf = binary.AppendUvarint(buf, uint64(max(at.Sub(t.start), 0)))
+	buf = appendTraceField(buf, []byte(cf.name))
+	buf = fields(buf)
+	_, t.err = t.w.Write(buf)
+	t.buf = buf
+}
+
+// trace records a single-key operation on the column family, if a trace is running.
+func (cf *ColumnFamily) trace(op TraceOp, key, val []byte, opts *WriteOptions) {
+	t := cf.db.tracer.Load()
+	if t == nil {
+		return
+	}
+	t.record(op, cf, time.Now(), func(buf []byte) []byte {
+		if op != TraceGet {
+			buf = appendTraceOptions(buf, opts)
+		}
+		buf = appendTraceField(buf, key)
+		if op != TraceGet && op != TraceDelete && op != TraceUndelete {
+			buf = appendTraceField(buf, val)
+		}
+		return buf
+	})
+}
+
+func (cf *ColumnFamily) traceMultiGet(keys [][]byte) {
+	t := cf.db.tracer.Load()
+	if t == nil {
+		return
+	}
+	t.record(TraceMultiGet, cf, time.Now(), func(buf []byte) []byte {
+		buf = binary.AppendUvarint(buf, uint64(len(keys)))
+		for _, key := range keys {
+			buf = appendTraceField(buf, key)
+		}
+		return buf
+	})
+}
+
+func (cf *ColumnFamily) traceCAS(key, old, new []byte, opts *WriteOptions) {
+	t := cf.db.tracer.Load()
+	if t == nil {
+		return
+	}
+	t.record(TraceCAS, cf, time.Now(), func(buf []byte) []byte {
+		buf = appendTraceOptions(buf, opts)
+		buf = appendTraceField(buf, key)
+		buf = appendTraceField(buf, old)
+		return appendTraceField(buf, new)
+	})
+}
+
+// iterTrace follows an Iterator while a trace is running, to record it as a scan once it is
+// closed. Its methods do nothing on a nil iterTrace, i.e. without a trace.
+type iterTrace struct {
+	t            *tracer
+	cf           *ColumnFamily
+	at           time.Time
+	lower, upper []byte
+	positioned   bool
+	key          []byte
+	reverse      bool
+	steps        int
+}
+
+func (cf *ColumnFamily) traceIter(lower, upper []byte) *iterTrace {
+	t := cf.db.tracer.Load()
+	if t == nil {
+		return nil
+	}
+	return &iterTrace{t: t, cf: cf, at: time.Now(), lower: slices.Clone(lower), upper: slices.Clone(upper)}
+}
+
+// position records a positioning of the iterator, at key (nil for First and Last).
+func (it *iterTrace) position(key []byte, reverse bool) {
+	if it == nil {
+		return
+	}
+	if it.positioned {
+		it.steps++
+		return
+	}
+	it.positioned, it.key, it.reverse = true, slices.Clone(key), reverse
+}
+
+func (it *iterTrace) step() {
+	if it != nil {
+		it.steps++
+	}
+}
+
+func (it *iterTrace) close() {
+	if it == nil || !it.positioned {
+		return
+	}
+	it.t.record(TraceScan, it.cf, it.at, func(buf []byte) []byte {
+		reverse := byte(0)
+		if it.reverse {
+			reverse = 1
+		}
+		buf = append(buf, reverse)
+		buf = appendTraceField(buf, it.lower)
+		buf = appendTraceField(buf, it.upper)
+		buf = appendTraceField(buf, it.key)
+		return binary.AppendUvarint(buf, uint64(it.steps))
+	})
+}
+
+func appendTraceField(buf, b []byte) []byte {
+	if b == nil {
+		return append(buf, 0)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(b))+1)
+	return append(buf, b...)
+}
+
+func appendTraceOptions(buf []byte, opts *WriteOptions) []byte {
+	switch {
+	case opts == nil:
+		return append(buf, 0)
+	case opts.Sync:
+		return append(buf, 2)
+	}
+	return append(buf, 1)
+}
+
+// TraceReader reads the records of a trace written by StartTrace.
+type TraceReader struct {
+	r *bufio.Reader
+}
+
+// NewTraceReader checks the header of the trace in r and returns a reader of its records.
+func NewTraceReader(r io.Reader) (*TraceReader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(traceHeader))
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("%w: no header", ErrCorruptTrace)
+	}
+	if string(header) != traceHeader {
+		return nil, fmt.Errorf("%w: unknown header %q", ErrCorruptTrace, header)
+	}
+	return &TraceReader{r: br}, nil
+}
+
+// Next returns the next record, or io.EOF at the end of the trace. A record cut short, e.g.
+// by a crash of the traced process, is reported as ErrCorruptTrace.
+func (t *TraceReader) Next() (*TraceRecord, error) {
+	op, err := t.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	rec := &TraceRecord{Op: TraceOp(op)}
+	if rec.Op == 0 || rec.Op >= numTraceOps {
+		return nil, fmt.Errorf("%w: unknown operation %d", ErrCorruptTrace, op)
+	}
+	ns, err := binary.ReadUvarint(t.r)
+	if err != nil {
+		return nil, t.corrupt(err)
+	}
+	rec.Time = time.Duration(ns)
+	cf, err := t.field()
+	if err != nil {
+		return nil, t.corrupt(err)
+	}
+	rec.ColumnFamily = string(cf)
+
+	switch rec.Op {
+	case TraceSet:
+		err = t.fields(&rec.WriteOptions, &rec.Key, &rec.Value)
+	case TraceGet:
+		err = t.fields(nil, &rec.Key)
+	case TraceDelete, TraceUndelete:
+		err = t.fields(&rec.WriteOptions, &rec.Key)
+	case TraceDeleteRange:
+		err = t.fields(&rec.WriteOptions, &rec.Key, &rec.End)
+	case TraceCAS:
+		err = t.fields(&rec.WriteOptions, &rec.Key, &rec.Old, &rec.Value)
+	case TraceMultiGet:
+		var n uint64
+		if n, err = binary.ReadUvarint(t.r); err == nil && n > maxTraceFieldLen {
+			err = fmt.Errorf("%w: %d keys", ErrCorruptTrace, n)
+		}
+		for i := uint64(0); i < n && err == nil; i++ {
+			var key []byte
+			key, err = t.field()
+			rec.Keys = append(rec.Keys, key)
+		}
+	case TraceScan:
+		var reverse byte
+		if reverse, err = t.r.ReadByte(); err == nil {
+			rec.Reverse = reverse == 1
+			err = t.fields(nil, &rec.Lower, &rec.Upper, &rec.Key)
+		}
+		var steps uint64
+		if err == nil {
+			steps, err = binary.ReadUvarint(t.r)
+			rec.Steps = int(steps)
+		}
+	}
+	if err != nil {
+		return nil, t.corrupt(err)
+	}
+	return rec, nil
+}
+
+// fields reads the options of a write into opts (unless nil), then byte fields.
+func (t *TraceReader) fields(opts **WriteOptions, fields ...*[]byte) error {
+	if opts != nil {
+		b, err := t.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch b {
+		case 0:
+		case 1:
+			*opts = NoSync
+		case 2:
+			*opts = Sync
+		default:
+			return fmt.Errorf("%w: unknown write options %d", ErrCorruptTrace, b)
+		}
+	}
+	for _, f := range fields {
+		var err error
+		if *f, err = t.field(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TraceReader) field() ([]byte, error) {
+	n, err := binary.ReadUvarint(t.r)
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	if n-1 > maxTraceFieldLen {
+		return nil, fmt.Errorf("%w: field of %d bytes", ErrCorruptTrace, n-1)
+	}
+	b := make([]byte, n-1)
+	_, err = io.ReadFull(t.r, b)
+	return b, err
+}
+
+// corrupt reports a trace ending within a record as corrupt, and other read errors as they are.
+func (t *TraceReader) corrupt(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: truncated record", ErrCorruptTrace)
+	}
+	return err
+}
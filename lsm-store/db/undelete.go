@@ -0,0 +1,99 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"lsm/encoder"
+	"time"
+)
+
+// ErrNotUndeletable is matched by the errors of Undelete when the deletion of the key can't be
+// undone.
+var ErrNotUndeletable = errors.New("db: key can't be undeleted")
+
+// Undelete restores the value key had in the default column family before it was deleted.
+func (d *DB) Undelete(key []byte, opts *WriteOptions) error {
+	return d.defaultCF.Undelete(key, opts)
+}
+
+// Undelete restores the value key had before it was deleted, writing it anew, as long as the
+// deletion was made with Options.UndeleteWindow less than that long ago. Only the last deletion
+// can be undone, and only if key hasn't been written since: otherwise, or if the value wasn't
+// kept, an error matching ErrNotUndeletable tells why. Like CAS, the lock of the writers is held
+// while the tombstone is looked up.
+func (cf *ColumnFamily) Undelete(key []byte, opts *WriteOptions) error {
+	d := cf.db
+	cf.trace(TraceUndelete, key, nil, opts)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.maybeStallWrite(context.Background()); err != nil {
+		return err
+	}
+	if err := cf.checkUsable(); err != nil {
+		return err
+	}
+	// holding d.mu keeps the SSTables of the current version from being deleted
+	encodedVal, rangeDelSeqNum, i, found := cf.getFromMemtables(key)
+	ev, _, err := cf.newestVersion(key, encodedVal, rangeDelSeqNum, i, found, cf.sstablesForKey(key), nil)
+	if err != nil {
+		return err
+	}
+	switch {
+	case ev == nil:
+		return fmt.Errorf("%w: key %q doesn't exist or was deleted by a range deletion", ErrNotUndeletable, key)
+	case !ev.IsTombstone():
+		return fmt.Errorf("%w: key %q isn't deleted", ErrNotUndeletable, key)
+	}
+	val, pointer, ok := ev.DeletedValue()
+	switch {
+	case !ok:
+		return fmt.Errorf("%w: key %q was deleted without keeping its value", ErrNotUndeletable, key)
+	case !d.undeletable(ev):
+		return fmt.Errorf("%w: key %q was deleted more than %v ago", ErrNotUndeletable, key, d.opts.UndeleteWindow)
+	case pointer:
+		// the tombstone keeps the value log file from being deleted
+		if val, err = d.readValue(val); err != nil {
+			return err
+		}
+	}
+	return cf.set(key, val, opts)
+}
+
+// undeletePayload returns the payload of the tombstone of key with Options.UndeleteWindow: the
+// value it deletes, or the pointer to it for a value kept in the value log (see
+// encoder.EncodedValue.DeletedValue). Returns nil if key doesn't exist or the option is off.
+// Must be called with d.mu held, which has to be held until the tombstone is written so that
+// no other write of key falls in between.
+func (cf *ColumnFamily) undeletePayload(key []byte) ([]byte, error) {
+	d := cf.db
+	if d.applying != nil {
+		// the tombstone is the one of the record, which kept the value or not
+		return d.applying.Value(), nil
+	}
+	if d.opts.UndeleteWindow <= 0 {
+		return nil, nil
+	}
+	encodedVal, rangeDelSeqNum, i, found := cf.getFromMemtables(key)
+	ev, _, err := cf.newestVersion(key, encodedVal, rangeDelSeqNum, i, found, cf.sstablesForKey(key), nil)
+	if err != nil || ev == nil || ev.IsTombstone() {
+		return nil, err
+	}
+	if ptr, ok := ev.ValueLogPointer(); ok {
+		return append([]byte{encoder.SoftDeletePointer}, ptr...), nil
+	}
+	val, err := d.resolveValue(ev)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{encoder.SoftDeleteValue}, val...), nil
+}
+
+// undeletable reports whether the deletion ev can still be undone: it kept the deleted value,
+// and was made less than Options.UndeleteWindow ago.
+func (d *DB) undeletable(ev *encoder.EncodedValue) bool {
+	if _, _, ok := ev.DeletedValue(); !ok {
+		return false
+	}
+	return time.Since(time.Unix(0, ev.Timestamp())) < d.opts.UndeleteWindow
+}
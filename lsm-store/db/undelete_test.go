@@ -0,0 +1,55 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestUndeleteValueLogValue deletes a value kept in the value log, then flushes, compacts and
+// reopens the DB, rewriting the value log files that are mostly garbage: the tombstone keeps a
+// pointer to the value, which has to stay readable for Undelete.
+func TestUndeleteValueLogValue(t *testing.T) {
+	opts := &Options{UndeleteWindow: time.Hour, ValueLogThreshold: 16, ValueLogFileSize: 1 << 10, ValueLogGCRatio: 0.01}
+	d, fs := openTestDB(t, opts)
+	val := bytes.Repeat([]byte("x"), 300)
+	if err := d.Set([]byte("key"), val, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete([]byte("key"), nil); err != nil {
+		t.Fatal(err)
+	}
+	// garbage filling the value log file of the value and the next ones
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("garbage%02d", i))
+		if err := d.Set(key, val, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Delete(key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := d.CompactRange(nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := *opts
+	reopened.FS = fs
+	d, _ = openTestDB(t, &reopened)
+	if err := d.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Undelete([]byte("key"), nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.Get([]byte("key"))
+	if err != nil || !bytes.Equal(got, val) {
+		t.Fatalf("Get after Undelete returned %d bytes, %v, want %d bytes", len(got), err, len(val))
+	}
+}
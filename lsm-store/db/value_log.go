@@ -0,0 +1,254 @@
+package db
+
+import (
+	"lsm/encoder"
+	"lsm/storage"
+	"lsm/vlog"
+	"lsm/wal"
+	"sync"
+)
+
+// valueLog keeps values of at least Options.ValueLogThreshold bytes out of the LSM tree
+// (WiscKey-style key/value separation). Such values are appended to the active value log file
+// and the memtables and SSTables only store a vlog.Pointer to them, so large values neither
+// fill up memtables nor get rewritten by every compaction.
+//
+// A value log file is deleted once no memtable, SSTable or open iterator points into it
+// anymore. Compactions move the values still in use out of files that are mostly garbage.
+type valueLog struct {
+	// guarded by d.mu
+	w      *vlog.Writer
+	fm     *storage.FileMetadata // active value log file
+	pinned map[int]int           // value log files in use by open iterators
+
+	mu      sync.Mutex                    // guards files and readers, taken after d.mu (if at all)
+	files   map[int]*storage.FileMetadata // every value log file, including the active one
+	readers map[int]storage.File          // value log files opened for reading
+}
+
+// separateValue reports whether val is large enough to be kept in the value log.
+func (d *DB) separateValue(val []byte) bool {
+	return d.opts.ValueLogThreshold >= 0 && len(val) >= d.opts.ValueLogThreshold
+}
+
+func (d *DB) createNewValueLog() error {
+	ds := d.dataStorage
+	fm := ds.PrepareNewValueLogFile()
+	f, err := ds.OpenFileForWriting(fm)
+	if err != nil {
+		return err
+	}
+	d.vlog.w = vlog.NewWriter(d.withSyncSpans(f, SpanValueLogSync, fm.FileNum()), fm.FileNum(), d.opts.WALSync == wal.SyncPerCommit)
+	d.vlog.fm = fm
+	d.vlog.mu.Lock()
+	d.vlog.files[fm.FileNum()] = fm
+	d.vlog.mu.Unlock()
+	return nil
+}
+
+// appendValue appends a kv-pair to the active value log file, starting a new one once it is
+// full. Must be called with d.mu held.
+func (d *DB) appendValue(key, val []byte) (vlog.Pointer, error) {
+	if d.vlog.w.Size() >= d.opts.ValueLogFileSize {
+		// like the WAL, the DB can't go on without an active value log file
+		if err := d.vlog.w.Close(); err != nil {
+			return vlog.Pointer{}, d.failLocked(err)
+		}
+		d.vlog.fm.SetSize(int64(d.vlog.w.Size()))
+		d.metrics.vlogBytes += int64(d.vlog.w.Size())
+		if err := d.createNewValueLog(); err != nil {
+			return vlog.Pointer{}, d.failLocked(err)
+		}
+	}
+	return d.vlog.w.Append(key, val)
+}
+
+// resolveValue returns the actual value of a live encoded value, reading it from the value log
+// if the encoded value points to it.
+func (d *DB) resolveValue(ev *encoder.EncodedValue) ([]byte, error) {
+	if !ev.IsValuePointer() {
+		return ev.Value(), nil
+	}
+	return d.readValue(ev.Value())
+}
+
+// readValue reads the value the encoded vlog.Pointer ptr points to from the value log.
+func (d *DB) readValue(ptr []byte) ([]byte, error) {
+	p, err := vlog.DecodePointer(ptr)
+	if err != nil {
+		return nil, err
+	}
+	f, err := d.valueLogReader(p.FileNum)
+	if err != nil {
+		return nil, err
+	}
+	_, val, err := vlog.Read(f, p)
+	return val, err
+}
+
+// valueLogReader returns the value log file fileNum opened for reading.
+func (d *DB) valueLogReader(fileNum int) (storage.File, error) {
+	d.vlog.mu.Lock()
+	defer d.vlog.mu.Unlock()
+	if f, ok := d.vlog.readers[fileNum]; ok {
+		return f, nil
+	}
+	fm, ok := d.vlog.files[fileNum]
+	if !ok {
+		return nil, vlog.ErrCorruptRecord
+	}
+	f, err := d.dataStorage.OpenFileForReading(fm)
+	if err != nil {
+		return nil, err
+	}
+	d.vlog.readers[fileNum] = f
+	return f, nil
+}
+
+// valueLogRefs returns the number of bytes of each value log file the memtables and SSTables
+// of all column families point to. Must be called with d.mu held.
+func (d *DB) valueLogRefs() map[int]int64 {
+	refs := make(map[int]int64)
+	for _, cf := range d.columnFamilies {
+		for _, m := range cf.memtables.queue {
+			for fileNum, n := range m.ValueLogRefs() {
+				refs[fileNum] += n
+			}
+		}
+		for _, files := range cf.levels {
+			for _, f := range files {
+				for fileNum, n := range f.ValueLogRefs() {
+					refs[fileNum] += n
+				}
+			}
+		}
+	}
+	return refs
+}
+
+// valueLogsToRewrite returns the value log files whose share of unreferenced bytes reached
+// Options.ValueLogGCRatio. Compactions move the values they still hold to the active value
+// log file. Must be called with d.mu held.
+func (d *DB) valueLogsToRewrite() map[int]bool {
+	refs := d.valueLogRefs()
+	rewrite := make(map[int]bool)
+	d.vlog.mu.Lock()
+	defer d.vlog.mu.Unlock()
+	for fileNum, fm := range d.vlog.files {
+		if fm == d.vlog.fm || fm.Size() <= 0 {
+			continue
+		}
+		garbage := 1 - float64(refs[fileNum])/float64(fm.Size())
+		if garbage >= d.opts.ValueLogGCRatio {
+			rewrite[fileNum] = true
+		}
+	}
+	return rewrite
+}
+
+// relocateValue moves a value out of a value log file about to be rewritten to the active
+// value log file, and returns the encoded value pointing to its new location, be it a value
+// pointer or a tombstone keeping a pointer to the value it deleted. Any other encoded value is
+// returned as is.
+func (d *DB) relocateValue(key, encodedVal []byte, rewrite map[int]bool) ([]byte, error) {
+	e := encoder.NewEncoder()
+	ev := e.Parse(encodedVal)
+	ptr, ok := ev.ValueLogPointer()
+	if !ok {
+		return encodedVal, nil
+	}
+	p, err := vlog.DecodePointer(ptr)
+	if err != nil {
+		return nil, err
+	}
+	if !rewrite[p.FileNum] {
+		return encodedVal, nil
+	}
+	f, err := d.valueLogReader(p.FileNum)
+	if err != nil {
+		return nil, err
+	}
+	_, val, err := vlog.Read(f, p)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	p, err = d.appendValue(key, val)
+	d.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if ev.IsTombstone() {
+		payload := append([]byte{encoder.SoftDeletePointer}, p.Encode()...)
+		return e.EncodeTimestamped(encoder.OpKindDelete, ev.SeqNum(), ev.Timestamp(), payload), nil
+	}
+	return e.EncodeTimestamped(encoder.OpKindValuePointer, ev.SeqNum(), ev.Timestamp(), p.Encode()), nil
+}
+
+// pinValueLogs keeps the value log files referenced by the given memtables and SSTables from
+// being deleted and returns a function unpinning them. Must be called with d.mu held.
+func (d *DB) pinValueLogs(refs []map[int]int64) func() {
+	var pinned []int
+	for _, r := range refs {
+		for fileNum := range r {
+			pinned = append(pinned, fileNum)
+			d.vlog.pinned[fileNum]++
+		}
+	}
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for _, fileNum := range pinned {
+			if d.vlog.pinned[fileNum]--; d.vlog.pinned[fileNum] == 0 {
+				delete(d.vlog.pinned, fileNum)
+			}
+		}
+	}
+}
+
+// deleteObsoleteValueLogs deletes (or archives) the value log files no memtable, SSTable or
+// open iterator points into anymore.
+func (d *DB) deleteObsoleteValueLogs() error {
+	d.mu.Lock()
+	refs := d.valueLogRefs()
+	var obsolete []*storage.FileMetadata
+	d.vlog.mu.Lock()
+	for fileNum, fm := range d.vlog.files {
+		if fm != d.vlog.fm && refs[fileNum] == 0 && d.vlog.pinned[fileNum] == 0 {
+			obsolete = append(obsolete, fm)
+			delete(d.vlog.files, fileNum)
+		}
+	}
+	d.vlog.mu.Unlock()
+	d.mu.Unlock()
+	if len(obsolete) == 0 {
+		return nil
+	}
+
+	// wait for in-flight reads, which may still follow pointers into the files
+	d.readers.Lock()
+	defer d.readers.Unlock()
+	for _, fm := range obsolete {
+		d.vlog.mu.Lock()
+		if f, ok := d.vlog.readers[fm.FileNum()]; ok {
+			f.Close()
+			delete(d.vlog.readers, fm.FileNum())
+		}
+		d.vlog.mu.Unlock()
+		if err := d.retireFile(fm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeValueLog seals the active value log file and closes all readers. Must be called with d.mu held.
+func (d *DB) closeValueLog() error {
+	d.vlog.mu.Lock()
+	for fileNum, f := range d.vlog.readers {
+		f.Close()
+		delete(d.vlog.readers, fileNum)
+	}
+	d.vlog.mu.Unlock()
+	return d.vlog.w.Close()
+}
@@ -0,0 +1,175 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"lsm/storage"
+	"slices"
+)
+
+// IntegrityReport is the outcome of VerifyIntegrity.
+type IntegrityReport struct {
+	// Tables holds the result for every SSTable of every column family, level by level.
+	Tables []TableIntegrity
+	// Orphans are the file numbers of the SSTables in the data directory that no column
+	// family accounts for.
+	Orphans []int
+	// ManifestErr tells why the manifest on disk doesn't match the live file set (nil if it does).
+	ManifestErr error
+}
+
+// TableIntegrity is the result of verifying a single SSTable.
+type TableIntegrity struct {
+	ColumnFamily string
+	Level        int
+	FileNum      int
+	Size         int64
+	NumEntries   uint64
+	Err          error // what is wrong with the table, nil if it is intact
+}
+
+// OK reports whether no problem was found.
+func (r *IntegrityReport) OK() bool {
+	if len(r.Orphans) > 0 || r.ManifestErr != nil {
+		return false
+	}
+	for _, t := range r.Tables {
+		if t.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Err returns the problems found as a single error, nil if there are none.
+func (r *IntegrityReport) Err() error {
+	var errs []error
+	for _, t := range r.Tables {
+		if t.Err != nil {
+			errs = append(errs, fmt.Errorf("%s L%d table %d: %w", t.ColumnFamily, t.Level, t.FileNum, t.Err))
+		}
+	}
+	if len(r.Orphans) > 0 {
+		errs = append(errs, fmt.Errorf("orphaned tables %v", r.Orphans))
+	}
+	if r.ManifestErr != nil {
+		errs = append(errs, r.ManifestErr)
+	}
+	return errors.Join(errs...)
+}
+
+// VerifyIntegrity checks every SSTable of the DB for corruption (see sstable.Reader.Verify)
+// and for agreement with the DB's view of it: its file has to be as large as recorded, its
+// properties have to match the key range and number of entries it was added with, the value
+// log files it points into have to exist, and the tables of L1+ have to be sorted by key
+// range without overlapping. Besides, every SSTable in the data directory has to belong to a
+// column family, and the manifest on disk has to list the live file set.
+//
+// The check runs online, reading every table in full. Compactions can't delete tables while it
+// runs, so writes may stall on a large DB. Problems found are part of the report; the error is
+// only set if the check itself couldn't run.
+func (d *DB) VerifyIntegrity() (*IntegrityReport, error) {
+	report := &IntegrityReport{}
+	var levels [][numLevels][]*storage.FileMetadata
+	var cfNames []string
+	var vlogs map[int]bool
+	// the background worker creates every SSTable, so while it runs this task, each SSTable
+	// in the data directory either belongs to a column family or is an orphan
+	err := d.runInBackground(func() error {
+		files, err := d.dataStorage.ListFiles()
+		if err != nil {
+			return err
+		}
+		manifest, err := d.dataStorage.ReadManifest()
+		if err != nil {
+			return err
+		}
+		// keep the tables from being deleted until they are verified
+		d.readers.RLock()
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		live := make(map[int]bool)
+		for _, cf := range d.columnFamilies {
+			var cfLevels [numLevels][]*storage.FileMetadata
+			for level, files := range cf.levels {
+				cfLevels[level] = slices.Clone(files)
+				for _, f := range files {
+					live[f.FileNum()] = true
+				}
+			}
+			levels = append(levels, cfLevels)
+			cfNames = append(cfNames, cf.name)
+		}
+		for _, f := range files {
+			if f.IsSSTable() && !live[f.FileNum()] {
+				report.Orphans = append(report.Orphans, f.FileNum())
+			}
+		}
+		// a v1 manifest is only rewritten with the first change after opening the DB
+		if len(manifest) > 0 && manifest[0] != manifestVersionV1 && !bytes.Equal(manifest, d.encodeManifest()) {
+			report.ManifestErr = fmt.Errorf("%w: doesn't match the live file set", errCorruptManifest)
+		}
+		d.vlog.mu.Lock()
+		vlogs = make(map[int]bool, len(d.vlog.files))
+		for fileNum := range d.vlog.files {
+			vlogs[fileNum] = true
+		}
+		d.vlog.mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer d.readers.RUnlock()
+
+	for i, cfLevels := range levels {
+		for level, files := range cfLevels {
+			for j, f := range files {
+				t := TableIntegrity{ColumnFamily: cfNames[i], Level: level, FileNum: f.FileNum(), Size: f.Size()}
+				t.NumEntries, t.Err = d.verifyTable(f, vlogs)
+				if t.Err == nil && level > 0 && j > 0 && d.cmp(files[j-1].LargestKey(), f.SmallestKey()) >= 0 {
+					t.Err = fmt.Errorf("key range overlaps table %d", files[j-1].FileNum())
+				}
+				report.Tables = append(report.Tables, t)
+			}
+		}
+	}
+	return report, nil
+}
+
+// verifyTable checks a single SSTable against its file and the DB's view of it, and returns its
+// number of entries.
+func (d *DB) verifyTable(f *storage.FileMetadata, vlogs map[int]bool) (uint64, error) {
+	r, release, err := d.tableCache.get(f)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	props, err := r.Properties()
+	if err != nil {
+		return 0, err
+	}
+	if err = r.Verify(); err != nil {
+		return props.NumEntries, err
+	}
+	info, err := d.opts.FS.Stat(d.dataStorage.FilePath(f))
+	if err != nil {
+		return props.NumEntries, err
+	}
+	switch {
+	case info.Size() != f.Size():
+		return props.NumEntries, fmt.Errorf("file has %d bytes, expected %d", info.Size(), f.Size())
+	case !bytes.Equal(props.SmallestKey, f.SmallestKey()) || !bytes.Equal(props.LargestKey, f.LargestKey()):
+		return props.NumEntries, fmt.Errorf("key range [%q, %q] doesn't match [%q, %q]",
+			props.SmallestKey, props.LargestKey, f.SmallestKey(), f.LargestKey())
+	case props.NumEntries != f.NumEntries():
+		return props.NumEntries, fmt.Errorf("%d entries, expected %d", props.NumEntries, f.NumEntries())
+	}
+	for fileNum := range props.ValueLogRefs {
+		if !vlogs[fileNum] {
+			return props.NumEntries, fmt.Errorf("points into missing value log file %d", fileNum)
+		}
+	}
+	return props.NumEntries, nil
+}
@@ -1,12 +1,39 @@
 package encoder
 
+import "encoding/binary"
+
 type OpKind uint8
 
 const (
 	OpKindDelete OpKind = iota
 	OpKindSet
+	OpKindRangeDelete  // the key is the start of the deleted range, the value its (exclusive) end
+	OpKindValuePointer // a set whose value is kept in the value log, the value is a vlog.Pointer to it
+	// OpKindMerge is an operand to be merged with the older versions of the key rather than
+	// replacing them. It is part of the format only: nothing writes it yet.
+	OpKindMerge
 )
 
+// opKindInvalid is the op kind of a value Parse can't make sense of.
+const opKindInvalid OpKind = 0xff
+
+const (
+	// valueFormatV1 starts every encoded value without a timestamp. Its high bit tells it apart
+	// from the op kind the legacy encoding starts with, so that both can be parsed.
+	valueFormatV1 = 0x80 | 1
+	// valueFormatV2 starts the encoded values with a timestamp, which follows the seqNum.
+	valueFormatV2 = 0x80 | 2
+	// legacyHeaderSize is the header of the values encoded before the format byte: opKind (1B)
+	// + seqNum (8B).
+	legacyHeaderSize = 1 + 8
+	timestampSize    = 8
+)
+
+// MaxHeaderSize is the largest number of bytes an encoded value occupies in addition to the
+// raw value: format (1B) + opKind (1B) + seqNum (uvarint, up to 10B) + timestamp (8B). Small
+// sequence numbers take less, and values without a timestamp don't have one.
+const MaxHeaderSize = 2 + binary.MaxVarintLen64 + timestampSize
+
 type Encoder struct{}
 
 func NewEncoder() *Encoder {
@@ -14,22 +41,65 @@ func NewEncoder() *Encoder {
 }
 
 type EncodedValue struct {
-	val    []byte
-	opKind OpKind
+	val       []byte
+	opKind    OpKind
+	seqNum    uint64
+	timestamp int64
+}
+
+// encoded value = format (1B)|opKind (1B)|seqNum (uvarint)|val
+func (e *Encoder) Encode(opKind OpKind, seqNum uint64, val []byte) []byte {
+	return e.EncodeTimestamped(opKind, seqNum, 0, val)
 }
 
-func (e *Encoder) Encode(opKind OpKind, val []byte) []byte {
-	buf := make([]byte, len(val)+1)
-	buf[0] = byte(opKind)
-	copy(buf[1:], val)
-	return buf
+// EncodeTimestamped encodes a value along with the wall-clock time of the write producing it
+// (timestamp, in Unix nanoseconds). A timestamp of 0 isn't recorded, the value is encoded as
+// by Encode.
+// encoded value = format (1B)|opKind (1B)|seqNum (uvarint)|timestamp (8B)|val
+func (e *Encoder) EncodeTimestamped(opKind OpKind, seqNum uint64, timestamp int64, val []byte) []byte {
+	buf := make([]byte, 2, MaxHeaderSize+len(val))
+	buf[0], buf[1] = valueFormatV1, byte(opKind)
+	buf = binary.AppendUvarint(buf, seqNum)
+	if timestamp != 0 {
+		buf[0] = valueFormatV2
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(timestamp))
+	}
+	return append(buf, val...)
 }
 
+// Parse decodes a value encoded by Encode or EncodeTimestamped, or in the legacy encoding:
+// opKind (1B)|seqNum (8B)|val. A value that is too short or of an unknown format isn't Valid.
 func (e *Encoder) Parse(val []byte) *EncodedValue {
-	buf := make([]byte, len(val)-1)
-	opKind := val[0]
-	copy(buf, val[1:])
-	return &EncodedValue{val: buf, opKind: OpKind(opKind)}
+	var opKind OpKind
+	var seqNum uint64
+	var timestamp int64
+	var header int
+	switch {
+	case len(val) > 0 && (val[0] == valueFormatV1 || val[0] == valueFormatV2):
+		var n int
+		if len(val) > 2 {
+			seqNum, n = binary.Uvarint(val[2:])
+		}
+		if n <= 0 {
+			return &EncodedValue{opKind: opKindInvalid}
+		}
+		opKind, header = OpKind(val[1]), 2+n
+		if val[0] == valueFormatV2 {
+			if len(val) < header+timestampSize {
+				return &EncodedValue{opKind: opKindInvalid}
+			}
+			timestamp = int64(binary.LittleEndian.Uint64(val[header:]))
+			header += timestampSize
+		}
+	case len(val) >= legacyHeaderSize && val[0]&0x80 == 0:
+		opKind, seqNum = OpKind(val[0]), binary.LittleEndian.Uint64(val[1:legacyHeaderSize])
+		header = legacyHeaderSize
+	default:
+		return &EncodedValue{opKind: opKindInvalid}
+	}
+	buf := make([]byte, len(val)-header)
+	copy(buf, val[header:])
+	return &EncodedValue{val: buf, opKind: opKind, seqNum: seqNum, timestamp: timestamp}
 }
 
 func (ev *EncodedValue) Value() []byte {
@@ -39,3 +109,70 @@ func (ev *EncodedValue) Value() []byte {
 func (ev *EncodedValue) IsTombstone() bool {
 	return ev.opKind == OpKindDelete
 }
+
+// IsRangeTombstone reports whether the value records a range deletion.
+func (ev *EncodedValue) IsRangeTombstone() bool {
+	return ev.opKind == OpKindRangeDelete
+}
+
+// IsValuePointer reports whether the value points to the actual value in the value log.
+func (ev *EncodedValue) IsValuePointer() bool {
+	return ev.opKind == OpKindValuePointer
+}
+
+// The value of a tombstone (OpKindDelete) is empty, or holds the value the deletion deleted so
+// that it can be undone: SoftDeleteValue followed by the value, or SoftDeletePointer followed
+// by the encoded vlog.Pointer to it, for a value kept in the value log.
+const (
+	SoftDeleteValue   = 0x01
+	SoftDeletePointer = 0x02
+)
+
+// DeletedValue returns the value a tombstone kept of the value it deleted, or the encoded
+// vlog.Pointer to it if pointer is true. ok is false for tombstones that kept nothing, and any
+// other encoded value.
+func (ev *EncodedValue) DeletedValue() (val []byte, pointer, ok bool) {
+	if !ev.IsTombstone() || len(ev.val) == 0 {
+		return nil, false, false
+	}
+	switch ev.val[0] {
+	case SoftDeleteValue:
+		return ev.val[1:], false, true
+	case SoftDeletePointer:
+		return ev.val[1:], true, true
+	}
+	return nil, false, false
+}
+
+// ValueLogPointer returns the encoded vlog.Pointer the value holds, be it a value pointer or a
+// tombstone keeping a pointer to the value it deleted.
+func (ev *EncodedValue) ValueLogPointer() ([]byte, bool) {
+	if ev.IsValuePointer() {
+		return ev.val, true
+	}
+	if val, pointer, ok := ev.DeletedValue(); ok && pointer {
+		return val, true
+	}
+	return nil, false
+}
+
+// IsMerge reports whether the value is a merge operand.
+func (ev *EncodedValue) IsMerge() bool {
+	return ev.opKind == OpKindMerge
+}
+
+// SeqNum returns the sequence number assigned to the write that produced this value.
+func (ev *EncodedValue) SeqNum() uint64 {
+	return ev.seqNum
+}
+
+// Timestamp returns the wall-clock time (in Unix nanoseconds) of the write that produced this
+// value, 0 if it wasn't recorded.
+func (ev *EncodedValue) Timestamp() int64 {
+	return ev.timestamp
+}
+
+// Valid reports whether the value could be parsed, and was encoded with one of the known op kinds.
+func (ev *EncodedValue) Valid() bool {
+	return ev.opKind <= OpKindMerge
+}
@@ -0,0 +1,39 @@
+package encoder
+
+import "lsm/comparer"
+
+// RangeTombstone deletes every key in [Start, End) written before it, i.e. with a
+// sequence number smaller than SeqNum.
+type RangeTombstone struct {
+	Start, End []byte
+	SeqNum     uint64
+}
+
+// Contains reports whether key falls into [Start, End).
+func (t RangeTombstone) Contains(cmp comparer.Compare, key []byte) bool {
+	return cmp(key, t.Start) >= 0 && cmp(key, t.End) < 0
+}
+
+// Clip narrows the tombstone down to [lo, hi), a nil lo or hi leaving that side unbounded.
+// It reports false if nothing of the tombstone is left.
+func (t RangeTombstone) Clip(cmp comparer.Compare, lo, hi []byte) (RangeTombstone, bool) {
+	if lo != nil && cmp(t.Start, lo) < 0 {
+		t.Start = lo
+	}
+	if hi != nil && cmp(t.End, hi) > 0 {
+		t.End = hi
+	}
+	return t, cmp(t.Start, t.End) < 0
+}
+
+// CoveringSeqNum returns the largest sequence number of the tombstones containing key,
+// or 0 if none of them does. Any version of key older than that is deleted.
+func CoveringSeqNum(cmp comparer.Compare, tombstones []RangeTombstone, key []byte) uint64 {
+	var seqNum uint64
+	for _, t := range tombstones {
+		if t.SeqNum > seqNum && t.Contains(cmp, key) {
+			seqNum = t.SeqNum
+		}
+	}
+	return seqNum
+}
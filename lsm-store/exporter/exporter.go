@@ -0,0 +1,167 @@
+// Package exporter makes the metrics of a DB available to monitoring systems, either as an
+// expvar variable (served on /debug/vars by the expvar package) or in the Prometheus text
+// exposition format, so that an embedding service gets flush, compaction and latency
+// dashboards without writing any glue code.
+package exporter
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"lsm/db"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// snapshot is what Publish exposes through expvar.
+type snapshot struct {
+	Metrics         db.Metrics
+	WriteStall      string
+	WriteStallCause string
+	SlowedWrites    uint64
+	StoppedWrites   uint64
+	StallSeconds    float64
+}
+
+// Publish registers the metrics and write stall state of d as the expvar variable name. Like
+// expvar.Publish, it panics if a variable of that name is already registered.
+func Publish(name string, d *db.DB) {
+	expvar.Publish(name, expvar.Func(func() any {
+		stats := d.Stats()
+		return snapshot{
+			Metrics:         d.Metrics(),
+			WriteStall:      stats.WriteStall.String(),
+			WriteStallCause: stats.WriteStallCause,
+			SlowedWrites:    stats.SlowedWrites,
+			StoppedWrites:   stats.StoppedWrites,
+			StallSeconds:    stats.StallDuration.Seconds(),
+		}
+	}))
+}
+
+// Handler serves the metrics of d in the Prometheus text exposition format, to be registered
+// as the scrape endpoint (usually /metrics).
+func Handler(d *db.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := WritePrometheus(w, d); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// WritePrometheus writes the metrics of d in the Prometheus text exposition format. All metric
+// names are prefixed with "lsm_".
+func WritePrometheus(w io.Writer, d *db.DB) error {
+	m, stats := d.Metrics(), d.Stats()
+	p := &promWriter{w: bufio.NewWriter(w)}
+
+	p.counter("user_bytes_written_total", "Size of the keys and values written by the user.", m.UserBytesWritten)
+	p.counter("wal_bytes_written_total", "Bytes written to WAL files.", m.WALBytesWritten)
+	p.counter("value_log_bytes_written_total", "Bytes written to value log files.", m.ValueLogBytesWritten)
+	p.counter("flushes_total", "Memtables flushed to L0.", m.Flushes)
+	p.counter("flush_bytes_written_total", "Bytes of SSTables written by flushes.", m.FlushBytesWritten)
+	p.counter("compactions_total", "Compactions, including trivial moves.", m.Compactions)
+	p.counter("compaction_bytes_read_total", "Bytes of SSTables merged by compactions.", m.CompactionBytesRead)
+	p.counter("compaction_bytes_written_total", "Bytes of SSTables written by compactions.", m.CompactionBytesWritten)
+	p.header("background_throttle_seconds_total", "counter", "Total time flushes and compactions waited for the background rate limit.")
+	p.sample("background_throttle_seconds_total", "", m.BackgroundThrottle.Seconds())
+	p.gauge("memtables", "Mutable and immutable memtables of all column families.", float64(m.Memtables))
+	p.gauge("memtable_size_bytes", "Total size of all memtables.", float64(m.MemtableSize))
+
+	p.header("level_files", "gauge", "SSTables per level.")
+	for level, l := range m.Levels {
+		p.sample("level_files", label("level", strconv.Itoa(level)), float64(l.NumFiles))
+	}
+	p.header("level_size_bytes", "gauge", "Total size of the SSTables per level.")
+	for level, l := range m.Levels {
+		p.sample("level_size_bytes", label("level", strconv.Itoa(level)), float64(l.Size))
+	}
+
+	p.gauge("block_cache_size_bytes", "Total size of the cached data blocks.", float64(m.BlockCacheSize))
+	p.counter("block_cache_hits_total", "Data block reads served by the block cache.", m.BlockCacheHits)
+	p.counter("block_cache_misses_total", "Data block reads that missed the block cache.", m.BlockCacheMisses)
+	p.gauge("write_amplification", "Bytes written to disk per byte written by the user.", m.WriteAmplification)
+	p.gauge("read_amplification", "Memtables and SSTables a point lookup may have to consult.", float64(m.ReadAmplification))
+
+	p.gauge("write_stall", "Current write stall state (0 = none, 1 = slowdown, 2 = stopped).", float64(stats.WriteStall))
+	p.header("stalled_writes_total", "counter", "Writes delayed or blocked to let flushes and compactions catch up.")
+	p.sample("stalled_writes_total", label("kind", "slowdown"), float64(stats.SlowedWrites))
+	p.sample("stalled_writes_total", label("kind", "stop"), float64(stats.StoppedWrites))
+	p.header("write_stall_seconds_total", "counter", "Total time writes spent stalled.")
+	p.sample("write_stall_seconds_total", "", stats.StallDuration.Seconds())
+
+	p.header("operation_duration_seconds", "histogram", "Latency of DB operations.")
+	for _, op := range []struct {
+		name string
+		h    db.Histogram
+	}{
+		{"get", m.GetLatency},
+		{"set", m.SetLatency},
+		{"delete", m.DeleteLatency},
+		{"delete_range", m.DeleteRangeLatency},
+	} {
+		p.histogram("operation_duration_seconds", label("op", op.name), op.h)
+	}
+	return p.flush()
+}
+
+type promWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func label(name, value string) string {
+	return fmt.Sprintf("%s=%q", name, value)
+}
+
+func (p *promWriter) printf(format string, args ...any) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, format, args...)
+	}
+}
+
+func (p *promWriter) header(name, typ, help string) {
+	p.printf("# HELP lsm_%s %s\n# TYPE lsm_%s %s\n", name, help, name, typ)
+}
+
+func (p *promWriter) sample(name, labels string, v float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	p.printf("lsm_%s%s %s\n", name, labels, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func (p *promWriter) counter(name, help string, v int64) {
+	p.header(name, "counter", help)
+	p.sample(name, "", float64(v))
+}
+
+func (p *promWriter) gauge(name, help string, v float64) {
+	p.header(name, "gauge", help)
+	p.sample(name, "", v)
+}
+
+// histogram writes h with cumulative buckets, as Prometheus expects them.
+func (p *promWriter) histogram(name, labels string, h db.Histogram) {
+	var n uint64
+	for _, b := range h.Buckets {
+		n += b.Count
+		le := "+Inf"
+		if b.UpperBound != math.MaxInt64 {
+			le = strconv.FormatFloat(b.UpperBound.Seconds(), 'g', -1, 64)
+		}
+		p.sample(name+"_bucket", labels+","+label("le", le), float64(n))
+	}
+	p.sample(name+"_sum", labels, h.Sum.Seconds())
+	p.sample(name+"_count", labels, float64(h.Count))
+}
+
+func (p *promWriter) flush() error {
+	if p.err != nil {
+		return p.err
+	}
+	return p.w.Flush()
+}
@@ -0,0 +1,140 @@
+// Package filter implements blocked bloom filters: compact, serializable sets of keys answering
+// "definitely not in the set" or "maybe in the set". SSTables carry one so that a lookup can
+// skip a table without reading any of its data blocks, but a filter can be built over any keys.
+package filter
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// DefaultBitsPerKey is about 1% false positives.
+const DefaultBitsPerKey = 10
+
+const (
+	blockBits  = 512 // a cache line, every key only touches one
+	blockBytes = blockBits / 8
+	maxProbes  = 12
+)
+
+// BitsPerKey returns the bits per key for a false positive rate fpRate (e.g. 0.01) of a
+// standard bloom filter. Confining the bits of a key to a block costs a little accuracy, more
+// so with more bits per key: at 10 bits per key, about 1% of the absent keys pass rather than
+// 0.8%, at 20 bits per key 0.02% rather than 0.007%.
+func BitsPerKey(fpRate float64) int {
+	if fpRate <= 0 || fpRate >= 1 {
+		return DefaultBitsPerKey
+	}
+	return int(math.Ceil(-math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+}
+
+// Builder collects the keys of a filter. The size of the filter depends on the number of keys,
+// so only their hashes are kept until Finish lays it out.
+type Builder struct {
+	bitsPerKey int
+	hashes     []uint64
+}
+
+// NewBuilder returns a Builder for a filter of bitsPerKey bits per key
+// (DefaultBitsPerKey if bitsPerKey <= 0).
+func NewBuilder(bitsPerKey int) *Builder {
+	if bitsPerKey <= 0 {
+		bitsPerKey = DefaultBitsPerKey
+	}
+	return &Builder{bitsPerKey: bitsPerKey}
+}
+
+// Add adds a key to the filter. Adding the same key twice in a row only counts it once.
+func (b *Builder) Add(key []byte) {
+	h := hash(key)
+	if n := len(b.hashes); n > 0 && b.hashes[n-1] == h {
+		return
+	}
+	b.hashes = append(b.hashes, h)
+}
+
+// NumKeys returns the number of keys added since the last Finish.
+func (b *Builder) NumKeys() int {
+	return len(b.hashes)
+}
+
+// Finish appends the filter of the keys added so far to dst and resets the Builder.
+//
+// filter = {block of 512 bits}...|numProbes (1B)
+func (b *Builder) Finish(dst []byte) []byte {
+	numProbes := min(max(int(math.Round(float64(b.bitsPerKey)*math.Ln2)), 1), maxProbes)
+	numBlocks := (len(b.hashes)*b.bitsPerKey + blockBits - 1) / blockBits
+	start := len(dst)
+	dst = append(dst, make([]byte, numBlocks*blockBytes)...)
+	blocks := dst[start:]
+	for _, h := range b.hashes {
+		block := blocks[blockOf(h, numBlocks)*blockBytes:][:blockBytes]
+		for i, x := 0, uint32(h); i < numProbes; i++ {
+			bit := probe(&x)
+			block[bit/8] |= 1 << (bit % 8)
+		}
+	}
+	b.hashes = b.hashes[:0]
+	return append(dst, byte(numProbes))
+}
+
+// Filter is a serialized filter, as returned by Builder.Finish.
+type Filter []byte
+
+// MayContain reports whether key may have been added to the filter. False positives are
+// possible, false negatives aren't. A malformed filter may contain any key.
+func (f Filter) MayContain(key []byte) bool {
+	if len(f) == 0 || (len(f)-1)%blockBytes != 0 {
+		return true
+	}
+	numBlocks := (len(f) - 1) / blockBytes
+	numProbes := int(f[len(f)-1])
+	if numBlocks == 0 {
+		return false // no keys were added
+	}
+	if numProbes == 0 || numProbes > maxProbes {
+		return true
+	}
+	h := hash(key)
+	block := f[blockOf(h, numBlocks)*blockBytes:][:blockBytes]
+	for i, x := 0, uint32(h); i < numProbes; i++ {
+		bit := probe(&x)
+		if block[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// blockOf maps the upper half of a hash onto one of numBlocks blocks.
+func blockOf(h uint64, numBlocks int) int {
+	return int((h >> 32) * uint64(numBlocks) >> 32)
+}
+
+// probe returns the next bit of a block to set or test for a key, taking the top bits of the
+// lower half of its hash multiplied by the golden ratio once more.
+func probe(x *uint32) uint32 {
+	*x *= 0x9e3779b9
+	return *x >> (32 - 9)
+}
+
+// hash is FNV-1a (over 8-byte words) followed by the finalizer of MurmurHash3, which spreads the few bits of
+// similar keys over the whole hash. Filters are persisted, so it must never change.
+func hash(key []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for len(key) >= 8 {
+		h ^= binary.LittleEndian.Uint64(key)
+		h *= 1099511628211
+		key = key[8:]
+	}
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
@@ -3,8 +3,27 @@ module lsm
 go 1.22.4
 
 require (
-	github.com/go-faker/faker/v4 v4.5.0
+	btree v0.0.0-00010101000000-000000000000
+	github.com/BurntSushi/toml v1.5.0
 	github.com/golang/snappy v0.0.4
+	github.com/klauspost/compress v1.18.0
+	github.com/pierrec/lz4/v4 v4.1.30
+	google.golang.org/grpc v1.66.3
+	google.golang.org/protobuf v1.34.2
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require golang.org/x/text v0.16.0 // indirect
+require (
+	github.com/fatih/color v1.17.0 // indirect
+	github.com/mattn/go-colorable v0.1.13 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+)
+
+require (
+	golang.org/x/net v0.26.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240604185151-ef581f913117 // indirect
+)
+
+replace btree => ../btree
@@ -0,0 +1,163 @@
+// Package hashring maps keys to nodes (shards, DB instances, servers) with consistent hashing:
+// nodes and keys are hashed onto the same ring of 64-bit values, and a key belongs to the first
+// node clockwise from it. Adding or removing a node only moves the keys between it and its
+// neighbours, about 1/N of them, rather than almost all of them as hashing modulo N does.
+//
+// Every node is placed on the ring many times, as virtual nodes, which evens out the share of
+// the keys each node gets.
+package hashring
+
+import (
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultVirtualNodes is the number of virtual nodes of a node when New is passed 0. The
+// standard deviation of the share of keys of a node is about 1/sqrt(virtual nodes) of the mean.
+const DefaultVirtualNodes = 128
+
+// Ring is a consistent-hash ring. It is safe for concurrent use.
+type Ring struct {
+	vnodes int
+	mu     sync.RWMutex
+	points []point // sorted by hash
+	nodes  map[string]struct{}
+}
+
+// point is a virtual node.
+type point struct {
+	hash uint64
+	node string
+}
+
+// New returns an empty ring placing every node at vnodes points.
+func New(vnodes int) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	return &Ring{vnodes: vnodes, nodes: make(map[string]struct{})}
+}
+
+// Hash returns the position of key on the ring. FNV-1a spreads similar keys poorly on its own,
+// so its result goes through the finalizer of MurmurHash3.
+func Hash(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Add places the nodes on the ring. Adding a node already on it does nothing.
+func (r *Ring) Add(nodes ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, node := range nodes {
+		if _, ok := r.nodes[node]; ok {
+			continue
+		}
+		r.nodes[node] = struct{}{}
+		for i := 0; i < r.vnodes; i++ {
+			r.points = append(r.points, point{hash: vnodeHash(node, i), node: node})
+		}
+	}
+	// ties between virtual nodes are broken by name, so that every ring agrees on the owner
+	slices.SortFunc(r.points, func(a, b point) int {
+		if a.hash != b.hash {
+			if a.hash < b.hash {
+				return -1
+			}
+			return 1
+		}
+		switch {
+		case a.node < b.node:
+			return -1
+		case a.node > b.node:
+			return 1
+		}
+		return 0
+	})
+}
+
+// vnodeHash returns the position of the i-th virtual node of node.
+func vnodeHash(node string, i int) uint64 {
+	buf := append([]byte(node), '#')
+	buf = strconv.AppendInt(buf, int64(i), 10)
+	return Hash(buf)
+}
+
+// Remove takes node off the ring. Its keys go to the nodes following its virtual nodes.
+func (r *Ring) Remove(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.nodes[node]; !ok {
+		return
+	}
+	delete(r.nodes, node)
+	r.points = slices.DeleteFunc(r.points, func(p point) bool { return p.node == node })
+}
+
+// Get returns the node key belongs to, false if the ring is empty.
+func (r *Ring) Get(key []byte) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.points) == 0 {
+		return "", false
+	}
+	return r.points[r.search(Hash(key))].node, true
+}
+
+// GetN returns the n distinct nodes following key clockwise, the node it belongs to first: the
+// replicas of the key, with a replication factor of n. It returns every node if there are
+// fewer than n.
+func (r *Ring) GetN(key []byte, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	n = min(n, len(r.nodes))
+	if n <= 0 {
+		return nil
+	}
+	nodes := make([]string, 0, n)
+	for i, start := 0, r.search(Hash(key)); len(nodes) < n; i++ {
+		node := r.points[(start+i)%len(r.points)].node
+		if !slices.Contains(nodes, node) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// search returns the index of the first point at or after h, wrapping around.
+func (r *Ring) search(h uint64) int {
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return i
+}
+
+// Nodes returns the nodes on the ring, sorted.
+func (r *Ring) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	slices.Sort(nodes)
+	return nodes
+}
+
+// Len returns the number of nodes on the ring.
+func (r *Ring) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.nodes)
+}
@@ -0,0 +1,260 @@
+// Package httpapi serves a DB over HTTP with JSON responses, to be poked at with curl and
+// called from scripts:
+//
+//	PUT    /keys/{key}                           sets key to the request body
+//	GET    /keys/{key}                           {"key": ..., "value": ...}
+//	DELETE /keys/{key}
+//	GET    /keys?prefix=&start=&limit=           {"items": [{"key": ..., "value": ...}], "next": ...}
+//
+// Keys and values are text by default. With ?encoding=base64, the key in the path, ?prefix,
+// ?start and the keys, values and "next" of the response are base64, for binary data: the URL
+// alphabet without padding (base64.RawURLEncoding), which needs no escaping in a path or a
+// query, where a '/' or '+' of the standard alphabet would be mangled. The body of a PUT is
+// always the raw value. A key or value that isn't valid UTF-8 can only be read with base64.
+package httpapi
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"lsm/db"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+)
+
+const (
+	// defaultLimit is the number of kv-pairs a listing returns without ?limit.
+	defaultLimit = 100
+	// maxLimit bounds ?limit.
+	maxLimit = 10000
+	// maxValueSize bounds the body of a PUT.
+	maxValueSize = 64 << 20
+)
+
+// errNotText is returned for a key or value that can't be returned as a JSON string.
+var errNotText = errors.New("httpapi: not valid UTF-8, use ?encoding=base64")
+
+// NewHandler returns the handler serving the API for d.
+func NewHandler(d *db.DB) http.Handler {
+	h := &handler{d: d}
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /keys/{key...}", h.put)
+	mux.HandleFunc("GET /keys/{key...}", h.get)
+	mux.HandleFunc("DELETE /keys/{key...}", h.delete)
+	mux.HandleFunc("GET /keys", h.list)
+	return mux
+}
+
+type handler struct {
+	d *db.DB
+}
+
+type item struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type listing struct {
+	Items []item `json:"items"`
+	// Next is the start of the next page, empty on the last one.
+	Next string `json:"next,omitempty"`
+}
+
+// codec converts keys and values from and to the strings of the API.
+type codec bool // base64
+
+func codecOf(r *http.Request) (codec, error) {
+	switch enc := r.URL.Query().Get("encoding"); enc {
+	case "", "text":
+		return false, nil
+	case "base64":
+		return true, nil
+	default:
+		return false, fmt.Errorf("httpapi: unknown encoding %q", enc)
+	}
+}
+
+func (c codec) decode(s string) ([]byte, error) {
+	if c {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+	return []byte(s), nil
+}
+
+func (c codec) encode(b []byte) (string, error) {
+	if c {
+		return base64.RawURLEncoding.EncodeToString(b), nil
+	}
+	if !utf8.Valid(b) {
+		return "", errNotText
+	}
+	return string(b), nil
+}
+
+// pathKey returns the key of the path, decoded, along with the codec of the request.
+func pathKey(r *http.Request) ([]byte, codec, error) {
+	c, err := codecOf(r)
+	if err != nil {
+		return nil, c, err
+	}
+	key, err := c.decode(r.PathValue("key"))
+	if err != nil {
+		return nil, c, fmt.Errorf("httpapi: key: %w", err)
+	}
+	if len(key) == 0 {
+		return nil, c, errors.New("httpapi: empty key")
+	}
+	return key, c, nil
+}
+
+func (h *handler) put(w http.ResponseWriter, r *http.Request) {
+	key, _, err := pathKey(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	val, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValueSize))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	if err := h.d.SetContext(r.Context(), key, val, writeOptions(r)); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) get(w http.ResponseWriter, r *http.Request) {
+	key, c, err := pathKey(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	val, err := h.d.GetContext(r.Context(), key)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	var it item
+	if it.Value, err = c.encode(val); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	it.Key = r.PathValue("key")
+	writeJSON(w, http.StatusOK, it)
+}
+
+func (h *handler) delete(w http.ResponseWriter, r *http.Request) {
+	key, _, err := pathKey(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := h.d.DeleteContext(r.Context(), key, writeOptions(r)); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// list returns the kv-pairs of the keys starting with ?prefix, from ?start on, in key order.
+// A page holds ?limit of them; the next one starts at its "next".
+func (h *handler) list(w http.ResponseWriter, r *http.Request) {
+	c, err := codecOf(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	q := r.URL.Query()
+	prefix, err := c.decode(q.Get("prefix"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("httpapi: prefix: %w", err))
+		return
+	}
+	start, err := c.decode(q.Get("start"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("httpapi: start: %w", err))
+		return
+	}
+	limit := defaultLimit
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > maxLimit {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("httpapi: limit must be in [1, %d]", maxLimit))
+			return
+		}
+	}
+	it, err := h.d.ScanPrefixContext(r.Context(), prefix)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	defer it.Close()
+	if len(start) > 0 {
+		it.Seek(start)
+	} else {
+		it.First()
+	}
+	res := listing{Items: []item{}}
+	for ; it.Valid(); it.Next() {
+		key, err := c.encode(it.Key())
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		if len(res.Items) == limit {
+			res.Next = key
+			break
+		}
+		val, err := c.encode(it.Value())
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		res.Items = append(res.Items, item{Key: key, Value: val})
+	}
+	if err := it.Error(); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// writeOptions returns the options of a write, synced with ?sync=true.
+func writeOptions(r *http.Request) *db.WriteOptions {
+	if sync, _ := strconv.ParseBool(r.URL.Query().Get("sync")); sync {
+		return db.Sync
+	}
+	return db.NoSync
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeDBError maps the errors of the DB to status codes.
+func writeDBError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, db.ErrKeyNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, db.ErrClosed):
+		writeError(w, http.StatusServiceUnavailable, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, http.StatusGatewayTimeout, err)
+	case errors.Is(err, context.Canceled):
+		// the client went away, nobody reads the response
+		writeError(w, http.StatusRequestTimeout, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
@@ -0,0 +1,101 @@
+package httpapi_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"lsm/db"
+	"lsm/httpapi"
+	"lsm/storage"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// TestBinaryKeys writes, reads, lists and deletes keys made of 0xff bytes, which encode to
+// "/" and "+" in the standard base64 alphabet, through a real server with ?encoding=base64.
+func TestBinaryKeys(t *testing.T) {
+	d, err := db.Open("/db", &db.Options{FS: storage.NewMemFS()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	srv := httptest.NewServer(httpapi.NewHandler(d))
+	defer srv.Close()
+
+	enc := base64.RawURLEncoding.EncodeToString
+	do := func(method, path string, query url.Values, body []byte) (int, []byte) {
+		t.Helper()
+		query.Set("encoding", "base64")
+		req, err := http.NewRequest(method, srv.URL+path+"?"+query.Encode(), bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		out, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, out
+	}
+
+	keys := [][]byte{{0xff, 0xff, 0xff}, {0xff, 0xfb, 0xef}, {0xff, 0xff, 0xff, 0xff}}
+	for i, key := range keys {
+		if status, out := do(http.MethodPut, "/keys/"+enc(key), url.Values{}, []byte{byte(i), 0xff}); status != http.StatusNoContent {
+			t.Fatalf("PUT %x: %d %s", key, status, out)
+		}
+	}
+	for i, key := range keys {
+		status, out := do(http.MethodGet, "/keys/"+enc(key), url.Values{}, nil)
+		var got struct{ Key, Value string }
+		if status != http.StatusOK || json.Unmarshal(out, &got) != nil {
+			t.Fatalf("GET %x: %d %s", key, status, out)
+		}
+		if got.Key != enc(key) || got.Value != enc([]byte{byte(i), 0xff}) {
+			t.Fatalf("GET %x returned %+v", key, got)
+		}
+	}
+
+	// page through the keys starting with 0xff one at a time, following the cursor
+	var listed []string
+	query := url.Values{"prefix": {enc([]byte{0xff})}, "limit": {"1"}}
+	for {
+		status, out := do(http.MethodGet, "/keys", query, nil)
+		var page struct {
+			Items []struct{ Key, Value string }
+			Next  string
+		}
+		if status != http.StatusOK || json.Unmarshal(out, &page) != nil {
+			t.Fatalf("listing %v: %d %s", query, status, out)
+		}
+		for _, it := range page.Items {
+			listed = append(listed, it.Key)
+		}
+		if page.Next == "" {
+			break
+		}
+		query.Set("start", page.Next)
+	}
+	want := []string{enc(keys[1]), enc(keys[0]), enc(keys[2])}
+	if len(listed) != len(want) {
+		t.Fatalf("listed %q, want %q", listed, want)
+	}
+	for i := range want {
+		if listed[i] != want[i] {
+			t.Fatalf("listed %q, want %q", listed, want)
+		}
+	}
+
+	if status, out := do(http.MethodDelete, "/keys/"+enc(keys[0]), url.Values{}, nil); status != http.StatusNoContent {
+		t.Fatalf("DELETE %x: %d %s", keys[0], status, out)
+	}
+	if status, _ := do(http.MethodGet, "/keys/"+enc(keys[0]), url.Values{}, nil); status != http.StatusNotFound {
+		t.Fatalf("GET %x after DELETE: %d", keys[0], status)
+	}
+}
@@ -0,0 +1,242 @@
+package lsmclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"lsm/db"
+	"lsm/lsmpb"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultPoolSize     = 4
+	defaultMaxRetries   = 3
+	defaultRetryBackoff = 100 * time.Millisecond
+	defaultTimeout      = 10 * time.Second
+)
+
+// Options configure a Client. The zero value of a field leaves its default.
+type Options struct {
+	// PoolSize is the number of connections to the server, used in turn. A connection
+	// multiplexes concurrent calls already; more of them spread the load of many goroutines
+	// (default 4).
+	PoolSize int
+	// MaxRetries is how many times a call failing with UNAVAILABLE (the server is down or
+	// restarting) is tried again (default 3). Every write can be made twice without harm, so
+	// writes are retried too. A negative value disables retries.
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry, doubled before every next one
+	// (default 100ms).
+	RetryBackoff time.Duration
+	// Timeout is the deadline of a call, retries included, and of a whole Scan (default 10s).
+	Timeout time.Duration
+	// DialOptions are passed to grpc.NewClient, e.g. for TLS. The default is a plaintext
+	// connection.
+	DialOptions []grpc.DialOption
+}
+
+// Client is a KV served by lsm-server. It is safe for concurrent use.
+type Client struct {
+	opts  Options
+	conns []*grpc.ClientConn
+	lsm   []lsmpb.LSMClient
+	next  atomic.Uint32
+}
+
+// Dial returns a client of the server at addr. Connections are made lazily, so an error is
+// only returned for a malformed address or options.
+func Dial(addr string, opts *Options) (*Client, error) {
+	c := &Client{}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.PoolSize <= 0 {
+		c.opts.PoolSize = defaultPoolSize
+	}
+	if c.opts.MaxRetries == 0 {
+		c.opts.MaxRetries = defaultMaxRetries
+	}
+	if c.opts.RetryBackoff <= 0 {
+		c.opts.RetryBackoff = defaultRetryBackoff
+	}
+	if c.opts.Timeout <= 0 {
+		c.opts.Timeout = defaultTimeout
+	}
+	dialOpts := c.opts.DialOptions
+	if dialOpts == nil {
+		dialOpts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	for i := 0; i < c.opts.PoolSize; i++ {
+		conn, err := grpc.NewClient(addr, dialOpts...)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.conns = append(c.conns, conn)
+		c.lsm = append(c.lsm, lsmpb.NewLSMClient(conn))
+	}
+	return c, nil
+}
+
+// Close closes the connections.
+func (c *Client) Close() error {
+	var errs []error
+	for _, conn := range c.conns {
+		errs = append(errs, conn.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// pick returns the next connection of the pool.
+func (c *Client) pick() lsmpb.LSMClient {
+	return c.lsm[int(c.next.Add(1))%len(c.lsm)]
+}
+
+// call calls fn until it succeeds, fails with another code than UNAVAILABLE, runs out of
+// retries or the deadline passes. Every attempt goes to the next connection of the pool.
+func (c *Client) call(fn func(ctx context.Context, lsm lsmpb.LSMClient) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
+	defer cancel()
+	backoff := c.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn(ctx, c.pick())
+		if status.Code(err) != codes.Unavailable || attempt >= c.opts.MaxRetries {
+			return fromStatus(err)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fromStatus(err)
+		}
+		backoff *= 2
+	}
+}
+
+// fromStatus maps NOT_FOUND back to db.ErrKeyNotFound, so that errors.Is works the same with
+// an embedded DB.
+func fromStatus(err error) error {
+	if status.Code(err) == codes.NotFound {
+		return db.ErrKeyNotFound
+	}
+	return err
+}
+
+func (c *Client) Get(key []byte) ([]byte, error) {
+	var val []byte
+	err := c.call(func(ctx context.Context, lsm lsmpb.LSMClient) error {
+		res, err := lsm.Get(ctx, &lsmpb.GetRequest{Key: key})
+		val = res.GetValue()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+func (c *Client) Set(key, val []byte, opts *db.WriteOptions) error {
+	return c.call(func(ctx context.Context, lsm lsmpb.LSMClient) error {
+		_, err := lsm.Set(ctx, &lsmpb.SetRequest{Key: key, Value: val, Sync: opts != nil && opts.Sync})
+		return err
+	})
+}
+
+func (c *Client) Delete(key []byte, opts *db.WriteOptions) error {
+	return c.call(func(ctx context.Context, lsm lsmpb.LSMClient) error {
+		_, err := lsm.Delete(ctx, &lsmpb.DeleteRequest{Key: key, Sync: opts != nil && opts.Sync})
+		return err
+	})
+}
+
+func (c *Client) Apply(b *Batch, opts *db.WriteOptions) error {
+	return c.call(func(ctx context.Context, lsm lsmpb.LSMClient) error {
+		_, err := lsm.Batch(ctx, &lsmpb.BatchRequest{Writes: b.writes, Sync: opts != nil && opts.Sync})
+		return err
+	})
+}
+
+// Scan streams the kv-pairs of the range from the server. Only opening the stream is retried:
+// an iterator failing midway stops, with the error in Error.
+func (c *Client) Scan(start, end []byte) (Iterator, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
+	var stream grpc.ServerStreamingClient[lsmpb.KeyValue]
+	var first *lsmpb.KeyValue
+	backoff := c.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		var err error
+		// the stream only fails to open on the first Recv
+		stream, err = c.pick().Scan(ctx, &lsmpb.ScanRequest{Start: start, End: end})
+		if err == nil {
+			first, err = stream.Recv()
+		}
+		if err == nil || err == io.EOF {
+			break
+		}
+		if status.Code(err) != codes.Unavailable || attempt >= c.opts.MaxRetries {
+			cancel()
+			return nil, fromStatus(err)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			cancel()
+			return nil, fromStatus(err)
+		}
+		backoff *= 2
+	}
+	return &iterator{stream: stream, cancel: cancel, cur: first}, nil
+}
+
+// iterator walks the kv-pairs streamed by Scan.
+type iterator struct {
+	stream grpc.ServerStreamingClient[lsmpb.KeyValue]
+	cancel context.CancelFunc
+	cur    *lsmpb.KeyValue // nil once the stream ended
+	err    error
+}
+
+func (i *iterator) Valid() bool {
+	return i.cur != nil
+}
+
+func (i *iterator) Next() bool {
+	if i.cur == nil {
+		return false
+	}
+	var err error
+	if i.cur, err = i.stream.Recv(); err != nil {
+		i.cur = nil
+		if err != io.EOF {
+			i.err = err
+		}
+	}
+	return i.Valid()
+}
+
+func (i *iterator) Key() []byte {
+	return i.cur.GetKey()
+}
+
+func (i *iterator) Value() []byte {
+	return i.cur.GetValue()
+}
+
+func (i *iterator) Error() error {
+	return i.err
+}
+
+// Close cancels the stream if it hasn't ended.
+func (i *iterator) Close() error {
+	i.cur = nil
+	i.cancel()
+	return nil
+}
+
+var _ KV = (*Client)(nil)
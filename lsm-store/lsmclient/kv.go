@@ -0,0 +1,100 @@
+// Package lsmclient is the Go client of lsm-server. A Client and an embedded DB wrapped with
+// Embedded are both a KV, so an application written against KV switches between the two
+// modes by changing how it gets its KV.
+package lsmclient
+
+import (
+	"lsm/db"
+	"lsm/lsmpb"
+)
+
+// KV is the API common to a Client and an embedded DB.
+type KV interface {
+	// Get returns the value of key, or db.ErrKeyNotFound.
+	Get(key []byte) ([]byte, error)
+	// Set writes key, synced before returning if opts says so. A nil opts doesn't sync.
+	Set(key, val []byte, opts *db.WriteOptions) error
+	Delete(key []byte, opts *db.WriteOptions) error
+	// Scan returns an iterator over the keys in [start, end), positioned at the first of them.
+	// A nil bound leaves that side of the range open.
+	Scan(start, end []byte) (Iterator, error)
+	// Apply applies the writes of b in order, syncing them once at the end if opts says so.
+	// It isn't atomic: a write failing leaves those before it applied.
+	Apply(b *Batch, opts *db.WriteOptions) error
+	Close() error
+}
+
+// Iterator walks kv-pairs in key order, forward only. *db.Iterator is one.
+type Iterator interface {
+	Valid() bool
+	Next() bool
+	Key() []byte
+	Value() []byte
+	// Error returns the error, if any, that stopped the iteration.
+	Error() error
+	Close() error
+}
+
+// Batch collects writes applied together by KV.Apply.
+type Batch struct {
+	writes []*lsmpb.Write
+}
+
+func (b *Batch) Set(key, val []byte) {
+	b.writes = append(b.writes, &lsmpb.Write{Op: &lsmpb.Write_Set{Set: &lsmpb.SetRequest{Key: key, Value: val}}})
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.writes = append(b.writes, &lsmpb.Write{Op: &lsmpb.Write_Delete{Delete: &lsmpb.DeleteRequest{Key: key}}})
+}
+
+// DeleteRange deletes the keys in [start, end).
+func (b *Batch) DeleteRange(start, end []byte) {
+	b.writes = append(b.writes, &lsmpb.Write{Op: &lsmpb.Write_DeleteRange{DeleteRange: &lsmpb.DeleteRangeRequest{Start: start, End: end}}})
+}
+
+// Len returns the number of writes in the batch.
+func (b *Batch) Len() int {
+	return len(b.writes)
+}
+
+// Embedded returns d as a KV. Closing it closes d.
+func Embedded(d *db.DB) KV {
+	return embedded{d}
+}
+
+type embedded struct {
+	*db.DB
+}
+
+func (e embedded) Scan(start, end []byte) (Iterator, error) {
+	it, err := e.NewIter(&db.IterOptions{LowerBound: start, UpperBound: end})
+	if err != nil {
+		return nil, err
+	}
+	it.First()
+	return it, nil
+}
+
+// Apply syncs the last write only, which syncs those before it in the WAL too.
+func (e embedded) Apply(b *Batch, opts *db.WriteOptions) error {
+	for i, w := range b.writes {
+		wopts := db.NoSync
+		if i == len(b.writes)-1 {
+			wopts = opts
+		}
+		var err error
+		switch op := w.Op.(type) {
+		case *lsmpb.Write_Set:
+			err = e.DB.Set(op.Set.Key, op.Set.Value, wopts)
+		case *lsmpb.Write_Delete:
+			err = e.DB.Delete(op.Delete.Key, wopts)
+		case *lsmpb.Write_DeleteRange:
+			err = e.DB.DeleteRange(op.DeleteRange.Start, op.DeleteRange.End, wopts)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
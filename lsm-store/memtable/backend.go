@@ -0,0 +1,189 @@
+package memtable
+
+import (
+	"fmt"
+	"lsm/comparer"
+	"lsm/skiplist"
+)
+
+// Backend is the sorted map holding the point entries of a Memtable, keyed by user key with
+// encoded values. The Memtable keeps the rest (range tombstones, WAL files, size accounting)
+// on top of it, so backends only differ in how they store and order the entries.
+type Backend interface {
+	// Insert sets the value of key, replacing the previous one.
+	Insert(key, val []byte)
+	Get(key []byte) ([]byte, bool)
+	// Iterator returns an iterator over the entries in [lower, upper) in key order,
+	// positioned before the first of them. A nil bound leaves that side of the range open.
+	// Writes to the backend invalidate it.
+	Iterator(lower, upper []byte) Iterator
+	// Size returns the number of bytes taken by the keys and values held, overwritten values
+	// excluded.
+	Size() int
+}
+
+// Iterator walks the entries of a Backend, as skiplist.Iterator does: SeekToFirst and SeekGE
+// position it right before an entry, returned by the following call to Next, while SeekLT,
+// Last and Prev move it onto an entry and return it (nil if there is none within the bounds).
+type Iterator interface {
+	HasNext() bool
+	Next() ([]byte, []byte)
+	SeekToFirst()
+	SeekGE(key []byte)
+	SeekLT(key []byte) ([]byte, []byte)
+	Last() ([]byte, []byte)
+	Prev() ([]byte, []byte)
+}
+
+// BackendType selects the data structure of the memtables.
+type BackendType uint8
+
+const (
+	// SkipListBackend is a skiplist: O(log n) inserts and lookups, entries always in order.
+	SkipListBackend BackendType = iota
+	// BTreeBackend is a B-tree (see the btree module of this repository): O(log n) inserts and
+	// lookups as well, with fewer, larger nodes than a skiplist.
+	BTreeBackend
+	// HashBackend is a hash map: O(1) inserts and lookups, its entries being sorted only when
+	// iterated over, e.g. by the flush. Sorting takes O(n log n) for every iterator opened on the
+	// mutable memtable, which changes in between, but only once for an immutable one. Keys
+	// are hashed by their bytes, so the Comparer has to consider keys equal only if their bytes
+	// are.
+	HashBackend
+)
+
+func (t BackendType) String() string {
+	switch t {
+	case SkipListBackend:
+		return "skiplist"
+	case BTreeBackend:
+		return "btree"
+	case HashBackend:
+		return "hash"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(t))
+}
+
+// NewBackend returns an empty backend of type t ordering its keys by cmp.
+func NewBackend(t BackendType, cmp comparer.Compare) Backend {
+	switch t {
+	case BTreeBackend:
+		return newBTreeBackend(cmp)
+	case HashBackend:
+		return newHashBackend(cmp)
+	default:
+		return skiplistBackend{skiplist.NewSkipList(cmp)}
+	}
+}
+
+type skiplistBackend struct {
+	*skiplist.SkipList
+}
+
+func (b skiplistBackend) Iterator(lower, upper []byte) Iterator {
+	return b.SkipList.BoundedIterator(lower, upper)
+}
+
+// cursor is an iterator moving onto entries in both directions, which cursorIter turns into
+// an Iterator.
+type cursor interface {
+	Valid() bool
+	First() bool
+	Last() bool
+	SeekGE(key []byte) bool
+	SeekLT(key []byte) bool
+	Next() bool
+	Prev() bool
+	Key() []byte
+	Value() []byte
+}
+
+// cursorIter implements Iterator over a cursor kept on the entry the next call to Next
+// returns (past the last one if there is none), rather than on the one last returned (or
+// sought before). Bounds are applied as by skiplist.BoundedIterator.
+type cursorIter struct {
+	c            cursor
+	cmp          comparer.Compare
+	lower, upper []byte
+	key, val     []byte // the entry the iterator is on, nil if before the first one
+}
+
+func newCursorIter(c cursor, cmp comparer.Compare, lower, upper []byte) *cursorIter {
+	i := &cursorIter{c: c, cmp: cmp, lower: lower, upper: upper}
+	i.SeekToFirst()
+	return i
+}
+
+func (i *cursorIter) HasNext() bool {
+	return i.c.Valid() && (i.upper == nil || i.cmp(i.c.Key(), i.upper) < 0)
+}
+
+func (i *cursorIter) Next() ([]byte, []byte) {
+	if !i.HasNext() {
+		return nil, nil
+	}
+	i.key, i.val = i.c.Key(), i.c.Value()
+	i.c.Next()
+	return i.key, i.val
+}
+
+func (i *cursorIter) SeekToFirst() {
+	if i.lower != nil {
+		i.SeekGE(i.lower)
+		return
+	}
+	i.onto(false)
+}
+
+// SeekGE moves onto the largest entry < key, as a skiplist does, so that Prev works from there.
+func (i *cursorIter) SeekGE(key []byte) {
+	if i.lower != nil && i.cmp(key, i.lower) < 0 {
+		key = i.lower
+	}
+	i.onto(i.c.SeekLT(key))
+}
+
+func (i *cursorIter) SeekLT(key []byte) ([]byte, []byte) {
+	if i.upper != nil && i.cmp(key, i.upper) > 0 {
+		key = i.upper
+	}
+	return i.back(i.c.SeekLT(key))
+}
+
+func (i *cursorIter) Last() ([]byte, []byte) {
+	if i.upper != nil {
+		return i.SeekLT(i.upper)
+	}
+	return i.back(i.c.Last())
+}
+
+func (i *cursorIter) Prev() ([]byte, []byte) {
+	if i.key == nil {
+		return nil, nil
+	}
+	return i.SeekLT(i.key)
+}
+
+// onto moves the iterator onto the entry the cursor moved onto, and steps the cursor to the
+// following one for Next. With no entry to move onto, the iterator is positioned before the
+// first one.
+func (i *cursorIter) onto(ok bool) {
+	if !ok {
+		i.key, i.val = nil, nil
+		i.c.First()
+		return
+	}
+	i.key, i.val = i.c.Key(), i.c.Value()
+	i.c.Next()
+}
+
+// back returns the entry a backward move of the cursor landed on, unless it falls below the
+// lower bound, in which case the iterator starts over from the lower bound.
+func (i *cursorIter) back(ok bool) ([]byte, []byte) {
+	if !ok || (i.lower != nil && i.cmp(i.c.Key(), i.lower) < 0) {
+		i.SeekToFirst()
+		return nil, nil
+	}
+	i.onto(true)
+	return i.key, i.val
+}
@@ -0,0 +1,48 @@
+package memtable_test
+
+import (
+	"lsm/bench"
+	"lsm/memtable"
+	"testing"
+)
+
+// BenchmarkMemtable compares the memtable backends on inserts, gets and scans of a full
+// memtable, and flushes of it into a table held in memory (see bench.NewMemtableOp), e.g.
+//
+//	go test ./memtable -bench Memtable/btree
+//
+// go run ./cmd bench-memtable runs the same operations, with flags for their sizes.
+func BenchmarkMemtable(b *testing.B) {
+	cfg := bench.MemtableConfig{Seed: 1}
+	for _, backend := range []memtable.BackendType{memtable.SkipListBackend, memtable.BTreeBackend, memtable.HashBackend} {
+		b.Run(backend.String(), func(b *testing.B) {
+			for _, op := range bench.MemtableOps {
+				// the function of b.Run is called again for every b.N, the memtable is only
+				// filled once
+				var o *bench.MemtableOp
+				b.Run(op, func(b *testing.B) {
+					if o == nil {
+						var err error
+						if o, err = bench.NewMemtableOp(backend, op, cfg); err != nil {
+							b.Fatal(err)
+						}
+					}
+					b.ReportAllocs()
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						if err := o.Run(i); err != nil {
+							b.Fatal(err)
+						}
+						if o.HasAfter() {
+							b.StopTimer()
+							if err := o.After(i); err != nil {
+								b.Fatal(err)
+							}
+							b.StartTimer()
+						}
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package memtable
+
+import (
+	"btree/btree"
+	"lsm/comparer"
+)
+
+// btreeBackend stores the entries in the B-tree of the btree module.
+type btreeBackend struct {
+	tree *btree.Btree
+	cmp  comparer.Compare
+	size int
+}
+
+func newBTreeBackend(cmp comparer.Compare) *btreeBackend {
+	return &btreeBackend{tree: btree.NewBTreeWithCompare(btree.Compare(cmp)), cmp: cmp}
+}
+
+func (b *btreeBackend) Insert(key, val []byte) {
+	if old, ok := b.tree.Insert(key, val); ok {
+		b.size += len(val) - len(old)
+		return
+	}
+	b.size += len(key) + len(val)
+}
+
+func (b *btreeBackend) Get(key []byte) ([]byte, bool) {
+	return b.tree.Get(key)
+}
+
+func (b *btreeBackend) Iterator(lower, upper []byte) Iterator {
+	return newCursorIter(b.tree.Iterator(), b.cmp, lower, upper)
+}
+
+func (b *btreeBackend) Size() int {
+	return b.size
+}
+
+// DeleteRange removes the keys in [start, end) one by one, the B-tree having no way to unlink
+// a run of items at once.
+func (b *btreeBackend) DeleteRange(start, end []byte) int {
+	var keys [][]byte
+	it := b.tree.Iterator()
+	for ok := it.SeekGE(start); ok && b.cmp(it.Key(), end) < 0; ok = it.Next() {
+		keys = append(keys, it.Key())
+		b.size -= len(it.Key()) + len(it.Value())
+	}
+	for _, key := range keys {
+		b.tree.Delete(key)
+	}
+	return len(keys)
+}
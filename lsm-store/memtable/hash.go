@@ -0,0 +1,114 @@
+package memtable
+
+import (
+	"lsm/comparer"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// hashBackend stores the entries in a map, and sorts them when iterated over.
+type hashBackend struct {
+	cmp     comparer.Compare
+	entries map[string][]byte
+	size    int
+
+	// the keys in order, nil once an insert adds a key. Iterators over an immutable memtable
+	// are opened concurrently, so sorting is guarded.
+	mu     sync.Mutex
+	sorted [][]byte
+}
+
+func newHashBackend(cmp comparer.Compare) *hashBackend {
+	return &hashBackend{cmp: cmp, entries: make(map[string][]byte)}
+}
+
+func (b *hashBackend) Insert(key, val []byte) {
+	if old, ok := b.entries[string(key)]; ok {
+		b.size += len(val) - len(old)
+		b.entries[string(key)] = val
+		return
+	}
+	b.entries[string(key)] = val
+	b.size += len(key) + len(val)
+	b.sorted = nil
+}
+
+func (b *hashBackend) Get(key []byte) ([]byte, bool) {
+	val, ok := b.entries[string(key)]
+	return val, ok
+}
+
+func (b *hashBackend) Iterator(lower, upper []byte) Iterator {
+	b.mu.Lock()
+	if b.sorted == nil {
+		b.sorted = make([][]byte, 0, len(b.entries))
+		for key := range b.entries {
+			b.sorted = append(b.sorted, []byte(key))
+		}
+		slices.SortFunc(b.sorted, b.cmp)
+	}
+	keys := b.sorted
+	b.mu.Unlock()
+	return newCursorIter(&sliceCursor{b: b, keys: keys}, b.cmp, lower, upper)
+}
+
+func (b *hashBackend) Size() int {
+	return b.size
+}
+
+// sliceCursor walks sorted keys, looking their values up in the map.
+type sliceCursor struct {
+	b    *hashBackend
+	keys [][]byte
+	pos  int
+}
+
+func (c *sliceCursor) Valid() bool {
+	return c.pos >= 0 && c.pos < len(c.keys)
+}
+
+func (c *sliceCursor) First() bool {
+	c.pos = 0
+	return c.Valid()
+}
+
+func (c *sliceCursor) Last() bool {
+	c.pos = len(c.keys) - 1
+	return c.Valid()
+}
+
+func (c *sliceCursor) SeekGE(key []byte) bool {
+	c.pos = sort.Search(len(c.keys), func(i int) bool {
+		return c.b.cmp(c.keys[i], key) >= 0
+	})
+	return c.Valid()
+}
+
+func (c *sliceCursor) SeekLT(key []byte) bool {
+	c.SeekGE(key)
+	c.pos--
+	return c.Valid()
+}
+
+func (c *sliceCursor) Next() bool {
+	if c.Valid() {
+		c.pos++
+	}
+	return c.Valid()
+}
+
+func (c *sliceCursor) Prev() bool {
+	if c.Valid() {
+		c.pos--
+	}
+	return c.Valid()
+}
+
+func (c *sliceCursor) Key() []byte {
+	return c.keys[c.pos]
+}
+
+func (c *sliceCursor) Value() []byte {
+	return c.b.entries[string(c.keys[c.pos])]
+}
@@ -1,25 +1,31 @@
 package memtable
 
 import (
+	"lsm/comparer"
 	"lsm/encoder"
-	"lsm/skiplist"
 	"lsm/storage"
+	"lsm/vlog"
 )
 
 type Memtable struct {
-	sl        *skiplist.SkipList
+	entries   Backend
 	sizeUsed  int // The approximate amount of space used by the Memtable so far (in bytes).
+	inserts   int // The number of point entries inserted so far, overwritten ones included.
 	sizeLimit int // The maximum allowed size of the Memtable (in bytes).
 	encoder   *encoder.Encoder
-	logMeta   *storage.FileMetadata
+	logs      []*storage.FileMetadata  // the WAL files holding the writes, oldest first
+	rangeDels []encoder.RangeTombstone // kept apart from the point entries, in insertion order
+	vlogRefs  map[int]int64            // bytes of each value log file pointed to by inserted values
+	maxSeqNum uint64                   // the largest seqNum of the point entries
 }
 
-func NewMemtable(sizeLimit int, logMeta *storage.FileMetadata) *Memtable {
+// NewMemtable returns an empty memtable storing its entries in a backend of type backend.
+func NewMemtable(sizeLimit int, logMeta *storage.FileMetadata, cmp comparer.Compare, backend BackendType) *Memtable {
 	m := &Memtable{
-		sl:        skiplist.NewSkipList(),
+		entries:   NewBackend(backend, cmp),
 		sizeLimit: sizeLimit,
 		encoder:   encoder.NewEncoder(),
-		logMeta:   logMeta,
+		logs:      []*storage.FileMetadata{logMeta},
 	}
 	return m
 }
@@ -27,39 +33,120 @@ func NewMemtable(sizeLimit int, logMeta *storage.FileMetadata) *Memtable {
 // check if memtable has room for new kv-pair
 func (m *Memtable) HasRoomForWrite(key, val []byte) bool {
 	sizeAvailable := m.sizeLimit - m.sizeUsed
-	// +1 for OpKind
-	return (len(key) + len(val) + 1) <= sizeAvailable
+	// + header for OpKind and seqNum
+	return (len(key) + len(val) + encoder.MaxHeaderSize) <= sizeAvailable
 }
 
-func (m *Memtable) Insert(key, val []byte) {
-	encodedVal := m.encoder.Encode(encoder.OpKindSet, val)
-	m.sl.Insert(key, encodedVal)
-	// +1 for OpKind
-	m.sizeUsed += (len(key) + len(val) + 1)
+// Insert records a write of key. A timestamp other than 0 is kept along with it (see
+// encoder.EncodeTimestamped), as with the other writes.
+func (m *Memtable) Insert(seqNum uint64, timestamp int64, key, val []byte) {
+	encodedVal := m.encoder.EncodeTimestamped(encoder.OpKindSet, seqNum, timestamp, val)
+	m.entries.Insert(key, encodedVal)
+	m.inserts++
+	m.maxSeqNum = max(m.maxSeqNum, seqNum)
+	m.sizeUsed += (len(key) + len(encodedVal))
 }
 
-func (m *Memtable) InsertTombstone(key []byte) {
-	encodedVal := m.encoder.Encode(encoder.OpKindDelete, nil)
-	m.sl.Insert(key, encodedVal)
-	m.sizeUsed += 1
+// InsertValuePointer records a write of key whose value was appended to the value log.
+func (m *Memtable) InsertValuePointer(seqNum uint64, timestamp int64, key []byte, p vlog.Pointer) {
+	encodedVal := m.encoder.EncodeTimestamped(encoder.OpKindValuePointer, seqNum, timestamp, p.Encode())
+	m.entries.Insert(key, encodedVal)
+	m.inserts++
+	m.maxSeqNum = max(m.maxSeqNum, seqNum)
+	m.sizeUsed += (len(key) + len(encodedVal))
+	m.addValueLogRef(p)
+}
+
+func (m *Memtable) addValueLogRef(p vlog.Pointer) {
+	if m.vlogRefs == nil {
+		m.vlogRefs = make(map[int]int64)
+	}
+	m.vlogRefs[p.FileNum] += int64(p.Length)
+}
+
+// ValueLogRefs returns the number of bytes of each value log file the values (and tombstones)
+// inserted into the memtable point to, including values overwritten since.
+func (m *Memtable) ValueLogRefs() map[int]int64 {
+	return m.vlogRefs
+}
+
+func (m *Memtable) InsertTombstone(seqNum uint64, timestamp int64, key []byte) {
+	m.InsertSoftTombstone(seqNum, timestamp, key, nil)
+}
+
+// InsertSoftTombstone records a deletion of key whose tombstone carries payload, the deleted
+// value kept so that the deletion can be undone (see encoder.EncodedValue.DeletedValue). A
+// pointer into the value log counts as a reference to the value, like InsertValuePointer's.
+func (m *Memtable) InsertSoftTombstone(seqNum uint64, timestamp int64, key, payload []byte) {
+	encodedVal := m.encoder.EncodeTimestamped(encoder.OpKindDelete, seqNum, timestamp, payload)
+	m.entries.Insert(key, encodedVal)
+	m.inserts++
+	m.maxSeqNum = max(m.maxSeqNum, seqNum)
+	m.sizeUsed += len(encodedVal)
+	if len(payload) > 0 && payload[0] == encoder.SoftDeletePointer {
+		if p, err := vlog.DecodePointer(payload[1:]); err == nil {
+			m.addValueLogRef(p)
+		}
+	}
+}
+
+// rangeDeleter is implemented by the backends able to remove a range of keys at once.
+type rangeDeleter interface {
+	DeleteRange(start, end []byte) int
+}
+
+// DeleteRange records a range tombstone deleting every key in [start, end) written before it.
+// The point entries of the range are removed from the backend too, if it supports it: being
+// older than the tombstone, they are deleted anyway, and would only take up memory and be
+// flushed for nothing.
+func (m *Memtable) DeleteRange(seqNum uint64, start, end []byte) {
+	if d, ok := m.entries.(rangeDeleter); ok && seqNum > m.maxSeqNum {
+		d.DeleteRange(start, end)
+	}
+	m.rangeDels = append(m.rangeDels, encoder.RangeTombstone{
+		Start:  append([]byte(nil), start...),
+		End:    append([]byte(nil), end...),
+		SeqNum: seqNum,
+	})
+	m.sizeUsed += (len(start) + len(end) + encoder.MaxHeaderSize)
+}
+
+// RangeTombstones returns the range tombstones recorded in the memtable.
+func (m *Memtable) RangeTombstones() []encoder.RangeTombstone {
+	return m.rangeDels
 }
 
 func (m *Memtable) Get(key []byte) (*encoder.EncodedValue, bool) {
-	encodedVal, found := m.sl.Get(key)
+	encodedVal, found := m.entries.Get(key)
 	if !found {
 		return nil, false
 	}
 	return m.encoder.Parse(encodedVal), true
 }
 
+// Inserts returns the number of point entries (tombstones included) inserted into the
+// memtable, counting overwrites of the same key separately.
+func (m *Memtable) Inserts() int {
+	return m.inserts
+}
+
 func (m *Memtable) Size() int {
 	return m.sizeUsed
 }
 
-func (m *Memtable) Iterator() *skiplist.Iterator {
-	return m.sl.Iterator()
+// Iterator returns an iterator over the point entries in [lower, upper), positioned before the
+// first of them. A nil bound leaves that side of the range open.
+func (m *Memtable) Iterator(lower, upper []byte) Iterator {
+	return m.entries.Iterator(lower, upper)
+}
+
+// LogFiles returns the WAL files holding the writes of the memtable, oldest first: the one it
+// was created with, and those the WAL was rotated to since (see AddLogFile).
+func (m *Memtable) LogFiles() []*storage.FileMetadata {
+	return m.logs
 }
 
-func (m *Memtable) LogFile() *storage.FileMetadata {
-	return m.logMeta
+// AddLogFile records that the writes from now on are logged to the WAL file fm.
+func (m *Memtable) AddLogFile(fm *storage.FileMetadata) {
+	m.logs = append(m.logs, fm)
 }
@@ -0,0 +1,21 @@
+package modeltest_test
+
+import (
+	"lsm/modeltest"
+	"testing"
+)
+
+// TestModel runs the model-based test with fixed seeds, reporting the first disagreement of
+// the DB with its model along with the shrunk operations leading to it.
+func TestModel(t *testing.T) {
+	ops := 10000
+	if testing.Short() {
+		ops = 2000
+	}
+	for _, seed := range []int64{1, 2, 3} {
+		cfg := modeltest.Config{Seed: seed, Ops: ops}
+		if _, err := modeltest.Run(cfg); err != nil {
+			t.Fatalf("seed %d: %v\n%v", seed, err, modeltest.Shrink(cfg))
+		}
+	}
+}
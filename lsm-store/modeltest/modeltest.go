@@ -0,0 +1,654 @@
+// Package modeltest checks the DB against a model of it. It runs random interleavings of
+// writes, reads, scans (some of them across flushes and compactions), flushes, compactions
+// and restarts against a DB on an in-memory file
+// system and against a map per column family, and compares the result of every operation with
+// the one the model predicts, and the whole contents of the DB with the model whenever it is
+// flushed, compacted or reopened.
+package modeltest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"lsm/db"
+	"lsm/storage"
+	"math"
+	"math/rand"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+const dataDir = "/db"
+
+// maxShrinkRuns bounds the runs of Shrink, every one of which may take as long as the run
+// being shrunk.
+const maxShrinkRuns = 500
+
+// Config describes a run. Zero values are replaced by defaults.
+type Config struct {
+	Seed int64
+	// Ops is the number of operations run.
+	Ops int
+	// Keys is the size of the keyspace, small enough for keys to be overwritten and deleted often.
+	Keys int
+	// ColumnFamilies is the number of column families the operations are spread over, the
+	// default one included.
+	ColumnFamilies int
+	// History is the number of operations listed along with a mismatch, the last ones run.
+	History int
+	// Options are the options of the DB. FS is replaced. By default, memtables are small so
+	// that flushes and compactions run often, larger values go to the value log, and deletes
+	// can be undone for longer than a run lasts.
+	Options *db.Options
+}
+
+func (c *Config) ensureDefaults() {
+	if c.Ops <= 0 {
+		c.Ops = 10000
+	}
+	if c.Keys <= 0 {
+		c.Keys = 200
+	}
+	if c.ColumnFamilies <= 0 {
+		c.ColumnFamilies = 2
+	}
+	if c.History <= 0 {
+		c.History = 20
+	}
+	if c.Options == nil {
+		c.Options = &db.Options{MemtableSizeLimit: 8 << 10, ValueLogThreshold: 256, ValueLogFileSize: 64 << 10, UndeleteWindow: time.Hour}
+	}
+}
+
+// Result sums up a successful run.
+type Result struct {
+	Ops      map[string]int // operations run, by kind
+	Restarts int
+}
+
+// model is the expected contents of a column family.
+type model map[string]string
+
+// sortedKeys returns the keys of the model within [lower, upper) in order, a nil bound leaving
+// that side of the range unbounded.
+func (m model) sortedKeys(lower, upper []byte) []string {
+	var keys []string
+	for key := range m {
+		if (lower == nil || key >= string(lower)) && (upper == nil || key < string(upper)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// operation is an operation of a run. Its keys and values are drawn from a generator seeded
+// with seed, so that it does the same whatever operations are run before it, as long as they
+// leave the models the same: Shrink can drop operations from a run.
+type operation struct {
+	index int // position in the run, numbering the operation in the history and its values
+	kind  string
+	cf    int
+	seed  int64
+}
+
+// operations returns the operations described by cfg.
+func operations(cfg Config) []operation {
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	ops := make([]operation, cfg.Ops)
+	for i := range ops {
+		o := operation{index: i, cf: rng.Intn(cfg.ColumnFamilies)}
+		switch n := rng.Intn(100); {
+		case n < 30:
+			o.kind = "set"
+		case n < 38:
+			o.kind = "delete"
+		case n < 40:
+			o.kind = "undelete"
+		case n < 43:
+			o.kind = "delete-range"
+		case n < 48:
+			o.kind = "cas"
+		case n < 70:
+			o.kind = "get"
+		case n < 75:
+			o.kind = "multi-get"
+		case n < 95:
+			o.kind = "scan"
+		case n < 97:
+			o.kind = "scan-compact"
+		case n < 98:
+			o.kind = "flush"
+		case n < 99:
+			o.kind = "compact"
+		default:
+			o.kind = "restart"
+		}
+		o.seed = rng.Int63()
+		ops[i] = o
+	}
+	return ops
+}
+
+// runner runs the operations of a Run, keeping the last ones for the error of a mismatch.
+type runner struct {
+	cfg     Config
+	rng     *rand.Rand // of the operation running
+	opts    db.Options
+	d       *db.DB
+	cfs     []*db.ColumnFamily
+	models  []model
+	deleted []model // values Undelete restores, of the keys last deleted by a point deletion
+	res     *Result
+	op      int
+	history []string
+}
+
+// Run runs the operations described by cfg and returns an error describing the first result
+// of the DB the model disagrees with. A panic of the DB is reported the same way, leaving the
+// DB open: it may have panicked holding its locks.
+func Run(cfg Config) (*Result, error) {
+	cfg.ensureDefaults()
+	res, _, err := run(cfg, operations(cfg))
+	return res, err
+}
+
+// Shrink runs the operations described by cfg like Run and, if the model disagrees with the
+// DB, looks for a shorter run that fails too: it drops the operations after the failing one,
+// then drops chunks of operations, halving their size down to single operations, for as long
+// as the run keeps failing, and for at most maxShrinkRuns runs. It returns the error of the
+// shortest failing run found, listing all of its operations, or nil if the run succeeds. The
+// run found isn't always minimal.
+func Shrink(cfg Config) error {
+	cfg.ensureDefaults()
+	ops := operations(cfg)
+	_, failed, err := run(cfg, ops)
+	if err == nil {
+		return nil
+	}
+	ops = ops[:min(failed+1, len(ops))]
+	runs := 0
+	for size := len(ops) / 2; size > 0 && runs < maxShrinkRuns; size /= 2 {
+		for start := 0; start < len(ops) && runs < maxShrinkRuns; runs++ {
+			shorter := append(ops[:start:start], ops[min(start+size, len(ops)):]...)
+			if _, failed, err := run(cfg, shorter); err != nil {
+				ops = shorter[:min(failed+1, len(shorter))]
+				continue
+			}
+			start += size
+		}
+	}
+	// run the shortest failing run again, keeping all of its operations in the history
+	cfg.History = math.MaxInt
+	_, _, err = run(cfg, ops)
+	return fmt.Errorf("shrunk to %d operations: %w", len(ops), err)
+}
+
+// run runs ops against a fresh DB, and returns the position in ops of the operation the model
+// disagreed with the DB on, along with the error describing it.
+func run(cfg Config, ops []operation) (_ *Result, failed int, err error) {
+	r := &runner{
+		cfg:     cfg,
+		opts:    *cfg.Options,
+		models:  make([]model, cfg.ColumnFamilies),
+		deleted: make([]model, cfg.ColumnFamilies),
+		res:     &Result{Ops: make(map[string]int)},
+	}
+	r.opts.FS = storage.NewMemFS()
+	for i := range r.models {
+		r.models[i], r.deleted[i] = make(model), make(model)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			err = r.mismatch(fmt.Errorf("panic: %v\n%s", p, debug.Stack()))
+		}
+	}()
+	if err := r.open(); err != nil {
+		return r.res, 0, err
+	}
+
+	for failed = range ops {
+		o := ops[failed]
+		r.op, r.rng = o.index, rand.New(rand.NewSource(o.seed))
+		var err error
+		switch o.kind {
+		case "set":
+			err = r.set(o.cf)
+		case "delete":
+			err = r.delete(o.cf)
+		case "undelete":
+			err = r.undelete(o.cf)
+		case "delete-range":
+			err = r.deleteRange(o.cf)
+		case "cas":
+			err = r.cas(o.cf)
+		case "get":
+			err = r.get(o.cf)
+		case "multi-get":
+			err = r.multiGet(o.cf)
+		case "scan":
+			err = r.scan(o.cf)
+		case "scan-compact":
+			err = r.scanCompact(o.cf)
+		case "flush":
+			err = r.flush()
+		case "compact":
+			err = r.compact(o.cf)
+		case "restart":
+			err = r.restart()
+		}
+		if err != nil {
+			r.d.Close()
+			return r.res, failed, r.mismatch(err)
+		}
+		r.res.Ops[o.kind]++
+	}
+	return r.res, len(ops), r.d.Close()
+}
+
+// open opens the DB, creating the column families on the first run, and checks every column
+// family against its model.
+func (r *runner) open() error {
+	d, err := db.Open(dataDir, &r.opts)
+	if err != nil {
+		return fmt.Errorf("opening the DB: %w", err)
+	}
+	r.d, r.cfs = d, r.cfs[:0]
+	for i := range r.models {
+		name := db.DefaultColumnFamily
+		if i > 0 {
+			name = fmt.Sprintf("cf%d", i)
+		}
+		cf, err := d.ColumnFamily(name)
+		if errors.Is(err, db.ErrColumnFamilyNotFound) {
+			cf, err = d.CreateColumnFamily(name)
+		}
+		if err != nil {
+			return err
+		}
+		r.cfs = append(r.cfs, cf)
+	}
+	return r.checkAll()
+}
+
+// record adds the description of the current operation to the history.
+func (r *runner) record(format string, args ...any) {
+	r.history = append(r.history, fmt.Sprintf("%d: "+format, append([]any{r.op}, args...)...))
+	if len(r.history) > r.cfg.History {
+		r.history = r.history[1:]
+	}
+}
+
+func (r *runner) mismatch(err error) error {
+	return fmt.Errorf("op %d: %w\nlast operations:\n  %s", r.op, err, strings.Join(r.history, "\n  "))
+}
+
+func (r *runner) key() []byte {
+	return []byte(fmt.Sprintf("key%06d", r.rng.Intn(r.cfg.Keys)))
+}
+
+// value returns a value unique to the operation, some of them empty or large enough for the
+// value log.
+func (r *runner) value() []byte {
+	switch r.rng.Intn(20) {
+	case 0:
+		return []byte{}
+	case 1:
+		return []byte(fmt.Sprintf("op%d-%s", r.op, strings.Repeat("x", 256+r.rng.Intn(1024))))
+	}
+	return []byte(fmt.Sprintf("op%d-%s", r.op, strings.Repeat("x", r.rng.Intn(64))))
+}
+
+func (r *runner) set(cf int) error {
+	key, val := r.key(), r.value()
+	r.record("set %s %q (%d bytes) in cf %d", key, truncate(val), len(val), cf)
+	if err := r.cfs[cf].Set(key, val, nil); err != nil {
+		return fmt.Errorf("set %s: %w", key, err)
+	}
+	r.models[cf][string(key)] = string(val)
+	delete(r.deleted[cf], string(key))
+	return nil
+}
+
+func (r *runner) delete(cf int) error {
+	key := r.key()
+	r.record("delete %s in cf %d", key, cf)
+	if err := r.cfs[cf].Delete(key, nil); err != nil {
+		return fmt.Errorf("delete %s: %w", key, err)
+	}
+	r.deleteKey(cf, string(key))
+	return nil
+}
+
+// deleteKey updates the models for a point deletion of key, which keeps its value for Undelete
+// if it exists.
+func (r *runner) deleteKey(cf int, key string) {
+	if val, ok := r.models[cf][key]; ok && r.opts.UndeleteWindow > 0 {
+		r.deleted[cf][key] = val
+	} else {
+		delete(r.deleted[cf], key)
+	}
+	delete(r.models[cf], key)
+}
+
+// undelete restores a key, which succeeds if the last write of the key was a point deletion
+// of an existing value.
+func (r *runner) undelete(cf int) error {
+	key := r.key()
+	val, succeeds := r.deleted[cf][string(key)]
+	r.record("undelete %s in cf %d", key, cf)
+	err := r.cfs[cf].Undelete(key, nil)
+	switch {
+	case succeeds && err != nil:
+		return fmt.Errorf("undelete %s: %w", key, err)
+	case !succeeds && !errors.Is(err, db.ErrNotUndeletable):
+		return fmt.Errorf("undelete %s: %v, expected it not to be undeletable", key, err)
+	case succeeds:
+		r.models[cf][string(key)] = val
+		delete(r.deleted[cf], string(key))
+	}
+	return nil
+}
+
+func (r *runner) deleteRange(cf int) error {
+	start, end := r.key(), r.key()
+	if bytes.Compare(start, end) > 0 {
+		start, end = end, start
+	}
+	r.record("delete-range [%s, %s) in cf %d", start, end, cf)
+	if err := r.cfs[cf].DeleteRange(start, end, nil); err != nil {
+		return fmt.Errorf("delete-range [%s, %s): %w", start, end, err)
+	}
+	for _, key := range r.models[cf].sortedKeys(start, end) {
+		delete(r.models[cf], key)
+	}
+	for _, key := range r.deleted[cf].sortedKeys(start, end) {
+		delete(r.deleted[cf], key)
+	}
+	return nil
+}
+
+// cas expects the value the key holds, the one it doesn't or a value it doesn't hold, and
+// sets the key or deletes it.
+func (r *runner) cas(cf int) error {
+	key := r.key()
+	cur, exists := r.models[cf][string(key)]
+	var old []byte
+	switch r.rng.Intn(3) {
+	case 0:
+		if exists {
+			old = []byte(cur)
+		}
+	case 1:
+		old = []byte(fmt.Sprintf("op%d-not-a-value", r.op))
+	}
+	var new []byte
+	if r.rng.Intn(4) > 0 {
+		new = r.value()
+	}
+	succeeds := exists == (old != nil) && cur == string(old)
+	r.record("cas %s from %s to %s in cf %d", key, describe(old), describe(new), cf)
+	err := r.cfs[cf].CAS(key, old, new, nil)
+	switch {
+	case succeeds && err != nil:
+		return fmt.Errorf("cas %s from the value it holds: %w", key, err)
+	case !succeeds && !errors.Is(err, db.ErrCASConflict):
+		return fmt.Errorf("cas %s from a value it doesn't hold: %v, expected a conflict", key, err)
+	case !succeeds:
+		return nil
+	case new == nil:
+		r.deleteKey(cf, string(key))
+	default:
+		r.models[cf][string(key)] = string(new)
+		delete(r.deleted[cf], string(key))
+	}
+	return nil
+}
+
+func (r *runner) get(cf int) error {
+	key, ro := r.key(), r.readOptions()
+	r.record("get %s in cf %d, %+v", key, cf, ro)
+	val, err := r.cfs[cf].GetWithOptions(context.Background(), key, &ro)
+	return r.compare(cf, key, val, err)
+}
+
+// readOptions returns random ReadOptions: whether blocks are cached or verified mustn't
+// change what a read returns.
+func (r *runner) readOptions() db.ReadOptions {
+	return db.ReadOptions{DontFillCache: r.rng.Intn(4) == 0, VerifyChecksums: r.rng.Intn(4) == 0}
+}
+
+// checkKey checks the value of key in a column family against its model.
+func (r *runner) checkKey(cf int, key []byte) error {
+	val, err := r.cfs[cf].Get(key)
+	return r.compare(cf, key, val, err)
+}
+
+// compare compares the value of key read from a column family (or the error reading it)
+// with its model.
+func (r *runner) compare(cf int, key, val []byte, err error) error {
+	expected, ok := r.models[cf][string(key)]
+	switch {
+	case err != nil && !errors.Is(err, db.ErrKeyNotFound):
+		return fmt.Errorf("get %s in cf %d: %w", key, cf, err)
+	case err != nil && ok:
+		return fmt.Errorf("%s not found in cf %d, expected %q", key, cf, truncate([]byte(expected)))
+	case err == nil && !ok:
+		return fmt.Errorf("%s is %q in cf %d, expected it not to exist", key, truncate(val), cf)
+	case err == nil && string(val) != expected:
+		return fmt.Errorf("%s is %q in cf %d, expected %q", key, truncate(val), cf, truncate([]byte(expected)))
+	}
+	return nil
+}
+
+func (r *runner) multiGet(cf int) error {
+	keys := make([][]byte, 1+r.rng.Intn(8))
+	for i := range keys {
+		keys[i] = r.key()
+	}
+	r.record("multi-get %s in cf %d", bytes.Join(keys, []byte(" ")), cf)
+	vals, errs := r.cfs[cf].MultiGet(keys)
+	for i, key := range keys {
+		if err := r.compare(cf, key, vals[i], errs[i]); err != nil {
+			return fmt.Errorf("multi-get: %w", err)
+		}
+	}
+	return nil
+}
+
+// scan positions an iterator with random bounds (or none) at its first or last key or at a
+// random key, moves it a few times in the same direction, and compares every key and value
+// it is positioned at with the model.
+func (r *runner) scan(cf int) error {
+	var lower, upper, seek []byte
+	if r.rng.Intn(2) == 0 {
+		lower = r.key()
+	}
+	if r.rng.Intn(2) == 0 {
+		upper = r.key()
+	}
+	if r.rng.Intn(2) == 0 {
+		seek = r.key()
+	}
+	reverse := r.rng.Intn(2) == 0
+	steps := r.rng.Intn(20)
+	ro := r.readOptions()
+	r.record("scan [%s, %s) from %s, reverse %v, %d steps in cf %d, %+v", describe(lower), describe(upper), describe(seek), reverse, steps, cf, ro)
+	it, err := r.cfs[cf].NewIter(&db.IterOptions{LowerBound: lower, UpperBound: upper, ReadOptions: ro})
+	if err != nil {
+		return fmt.Errorf("scan: %w", err)
+	}
+	defer it.Close()
+	return r.compareScan(r.models[cf], it, r.models[cf].sortedKeys(lower, upper), seek, reverse, steps)
+}
+
+// scanCompact opens an iterator, then overwrites and deletes keys, flushes and compacts the
+// column family, which replaces every table the iterator reads from, and only then scans all
+// the keys: the iterator has to see them as they were when it was created, from tables that
+// must outlive the compaction until it is closed.
+func (r *runner) scanCompact(cf int) error {
+	r.record("open an iterator over cf %d", cf)
+	it, err := r.cfs[cf].NewIter(nil)
+	if err != nil {
+		return fmt.Errorf("scan: %w", err)
+	}
+	snapshot := make(model, len(r.models[cf]))
+	for key, val := range r.models[cf] {
+		snapshot[key] = val
+	}
+	for n := r.rng.Intn(20); n >= 0; n-- {
+		if r.rng.Intn(4) == 0 {
+			err = r.deleteRange(cf)
+		} else {
+			err = r.set(cf)
+		}
+		if err != nil {
+			it.Close()
+			return err
+		}
+	}
+	if err := r.flush(); err != nil {
+		it.Close()
+		return err
+	}
+	if err := r.compact(cf); err != nil {
+		it.Close()
+		return err
+	}
+	r.record("scan the iterator opened before")
+	keys := snapshot.sortedKeys(nil, nil)
+	if err := r.compareScan(snapshot, it, keys, nil, false, len(keys)); err != nil {
+		it.Close()
+		return err
+	}
+	// closing it deletes the tables compacted away
+	if err := it.Close(); err != nil {
+		return fmt.Errorf("closing the iterator: %w", err)
+	}
+	return nil
+}
+
+// compareScan compares the keys an iterator is positioned at with keys, all the keys of the
+// model m within the bounds of the iterator.
+func (r *runner) compareScan(m model, it *db.Iterator, keys []string, seek []byte, reverse bool, steps int) error {
+	// the position of the first key expected
+	var pos int
+	var valid bool
+	switch {
+	case seek == nil && !reverse:
+		pos, valid = 0, it.First()
+	case seek == nil:
+		pos, valid = len(keys)-1, it.Last()
+	case !reverse:
+		pos, valid = sort.SearchStrings(keys, string(seek)), it.Seek(seek)
+	default:
+		pos, valid = sort.SearchStrings(keys, string(seek))-1, it.SeekLT(seek)
+	}
+	for step := 0; ; step++ {
+		if pos < 0 || pos >= len(keys) {
+			if valid {
+				return fmt.Errorf("scan at step %d: positioned at %s, expected the end", step, it.Key())
+			}
+			break
+		}
+		if !valid {
+			return fmt.Errorf("scan at step %d: ended (%v), expected %s", step, it.Error(), keys[pos])
+		}
+		if string(it.Key()) != keys[pos] {
+			return fmt.Errorf("scan at step %d: positioned at %s, expected %s", step, it.Key(), keys[pos])
+		}
+		if expected := m[keys[pos]]; string(it.Value()) != expected {
+			return fmt.Errorf("scan at step %d: %s is %q, expected %q", step, it.Key(), truncate(it.Value()), truncate([]byte(expected)))
+		}
+		if step == steps {
+			break
+		}
+		if reverse {
+			pos, valid = pos-1, it.Prev()
+		} else {
+			pos, valid = pos+1, it.Next()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return fmt.Errorf("scan: %w", err)
+	}
+	return nil
+}
+
+func (r *runner) flush() error {
+	r.record("flush")
+	if err := r.d.Flush(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+	return r.checkAll()
+}
+
+func (r *runner) compact(cf int) error {
+	r.record("compact cf %d", cf)
+	if err := r.cfs[cf].CompactRange(nil, nil); err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	return r.checkAll()
+}
+
+// restart closes the DB and opens it again, which has to bring back everything written.
+func (r *runner) restart() error {
+	r.record("restart")
+	if err := r.d.Close(); err != nil {
+		return fmt.Errorf("closing the DB: %w", err)
+	}
+	r.res.Restarts++
+	// every table compacted away has been deleted, if need be once the last iterator reading
+	// it was closed
+	dg, err := db.Diagnose(dataDir, &r.opts)
+	if err != nil {
+		return fmt.Errorf("diagnosing the DB: %w", err)
+	}
+	for _, p := range dg.Problems {
+		if p.Kind == db.ProblemOrphanedTable {
+			return fmt.Errorf("left behind: %s", p)
+		}
+	}
+	return r.open()
+}
+
+// checkAll checks every column family against its model, with a full scan and a get of
+// every key of the keyspace.
+func (r *runner) checkAll() error {
+	for cf := range r.cfs {
+		it, err := r.cfs[cf].NewIter(nil)
+		if err != nil {
+			return err
+		}
+		keys := r.models[cf].sortedKeys(nil, nil)
+		err = r.compareScan(r.models[cf], it, keys, nil, false, len(keys))
+		it.Close()
+		if err != nil {
+			return fmt.Errorf("full %w", err)
+		}
+		for k := 0; k < r.cfg.Keys; k++ {
+			if err := r.checkKey(cf, []byte(fmt.Sprintf("key%06d", k))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func describe(b []byte) string {
+	if b == nil {
+		return "nil"
+	}
+	return fmt.Sprintf("%q", truncate(b))
+}
+
+// truncate shortens a value for an error message.
+func truncate(val []byte) []byte {
+	if len(val) > 20 {
+		return val[:20]
+	}
+	return val
+}
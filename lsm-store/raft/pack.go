@@ -0,0 +1,93 @@
+package raft
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// packDir packs the files of dir (and its subdirectories) into a single buffer, for a snapshot
+// to be sent in an InstallSnapshotRequest: path length (uvarint)|path|size (uvarint)|contents
+// for each file, the path being relative to dir with forward slashes.
+func packDir(dir string) ([]byte, error) {
+	var buf []byte
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		buf = binary.AppendUvarint(buf, uint64(len(rel)))
+		buf = append(buf, rel...)
+		buf = binary.AppendUvarint(buf, uint64(len(data)))
+		buf = append(buf, data...)
+		return nil
+	})
+	return buf, err
+}
+
+// unpackDir writes the files packed by packDir to dir, which is created, and syncs them.
+func unpackDir(data []byte, dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	dirs := map[string]bool{dir: true}
+	for len(data) > 0 {
+		n, m := binary.Uvarint(data)
+		if m <= 0 || uint64(len(data)-m) < n {
+			return fmt.Errorf("%w: malformed snapshot", ErrCorruptLog)
+		}
+		rel := string(data[m : m+int(n)])
+		data = data[m+int(n):]
+		size, m := binary.Uvarint(data)
+		if m <= 0 || uint64(len(data)-m) < size {
+			return fmt.Errorf("%w: malformed snapshot", ErrCorruptLog)
+		}
+		contents := data[m : m+int(size)]
+		data = data[m+int(size):]
+		if !fs.ValidPath(rel) || strings.Contains(rel, `\`) {
+			return fmt.Errorf("%w: snapshot file %q", ErrCorruptLog, rel)
+		}
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+		if parent := filepath.Dir(path); !dirs[parent] {
+			if err := os.MkdirAll(parent, 0o755); err != nil {
+				return err
+			}
+			dirs[parent] = true
+		}
+		if err := writeFile(path, contents); err != nil {
+			return err
+		}
+	}
+	for d := range dirs {
+		if err := syncDir(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFile creates the file path with data and syncs it.
+func writeFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,872 @@
+// Package raft is a compact implementation of the Raft consensus algorithm, written to be read
+// along with the paper ("In Search of an Understandable Consensus Algorithm", Ongaro and
+// Ousterhout): leader election, log replication, and log compaction with snapshots that are
+// sent whole to lagging followers. A cluster has a fixed set of members; membership changes
+// aren't supported.
+//
+// A Node replicates commands, opaque byte slices proposed on the leader, and applies them, once
+// committed, to its StateMachine in log order. Package raftdb makes a DB the state machine.
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"lsm/db"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultElectionTimeout   = 300 * time.Millisecond
+	defaultHeartbeatInterval = 50 * time.Millisecond
+	defaultSnapshotThreshold = 1024
+	// maxEntrySize bounds the entries read back from LOG, so that a garbled length doesn't
+	// make the node allocate unbounded memory.
+	maxEntrySize = 64 << 20
+	// maxAppendEntries is the number of entries sent in an AppendEntriesRequest at most.
+	maxAppendEntries = 256
+	// tickInterval is how often a node checks whether its election timeout has expired.
+	tickInterval = 10 * time.Millisecond
+)
+
+var (
+	ErrClosed = errors.New("raft: node closed")
+	// ErrNotLeader is returned for a command proposed on a node that isn't the leader, which
+	// Node.Leader may tell.
+	ErrNotLeader = errors.New("raft: not the leader")
+	// ErrLeadershipLost is returned for a command proposed on a leader that was deposed before
+	// the command was applied. It may still be committed by the next leader.
+	ErrLeadershipLost = errors.New("raft: leadership lost")
+)
+
+// EntryKind tells what an entry of the log holds.
+type EntryKind uint8
+
+const (
+	EntryCommand EntryKind = iota // a command for the state machine
+	EntryNoop                     // appended by a new leader to commit the entries of earlier terms
+)
+
+// Entry is an entry of the replicated log.
+type Entry struct {
+	Index uint64
+	Term  uint64 // of the leader that appended it
+	Kind  EntryKind
+	Data  []byte
+}
+
+// StateMachine is what the log is applied to.
+type StateMachine interface {
+	// Apply applies the committed command of the entry at index. Entries are applied in log
+	// order, once each since the last call to Restore. The result is returned by Propose on
+	// the leader the command was proposed on.
+	Apply(index uint64, cmd []byte) any
+	// Snapshot writes the state after the entries applied so far to dir, which doesn't exist
+	// yet. Apply isn't called while it runs.
+	Snapshot(dir string) error
+	// Restore replaces the state with the one written to dir by Snapshot (on this node or
+	// another one), or with the empty state if dir is "". The node restores its last snapshot
+	// when it starts, and applies the entries after it again.
+	Restore(dir string) error
+}
+
+// Config configures a Node.
+type Config struct {
+	// ID names the node, and Peers every member of the cluster, the node included. The
+	// transport delivers the messages to the nodes by their ID.
+	ID    string
+	Peers []string
+	// Dir is where the node keeps the state that has to survive a crash: its term and vote,
+	// its log and its last snapshot.
+	Dir       string
+	Transport Transport
+	// ElectionTimeout is how long a follower waits without hearing from a leader before it
+	// stands for election, randomized between ElectionTimeout and twice as much (300ms by
+	// default). A leader that hasn't heard from a majority for as long steps down.
+	ElectionTimeout time.Duration
+	// HeartbeatInterval is how often the leader sends AppendEntries to idle followers (50ms by
+	// default). It has to be well below ElectionTimeout.
+	HeartbeatInterval time.Duration
+	// SnapshotThreshold is the number of entries applied after the last snapshot from which on
+	// a new one is taken and the log compacted (1024 by default).
+	SnapshotThreshold uint64
+	Logger            db.Logger
+}
+
+func (c *Config) ensureDefaults() {
+	if c.ElectionTimeout == 0 {
+		c.ElectionTimeout = defaultElectionTimeout
+	}
+	if c.HeartbeatInterval == 0 {
+		c.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if c.SnapshotThreshold == 0 {
+		c.SnapshotThreshold = defaultSnapshotThreshold
+	}
+	if c.Logger == nil {
+		c.Logger = db.DiscardLogger
+	}
+}
+
+// Role is the part a node plays in its current term.
+type Role uint8
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+func (r Role) String() string {
+	switch r {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(r))
+}
+
+// result is what a proposal waits for: the result of Apply, or why it won't get it.
+type result struct {
+	val any
+	err error
+}
+
+// waiter is a proposal of the leader, waiting for its entry to be applied.
+type waiter struct {
+	term uint64
+	ch   chan result
+}
+
+// Node is a member of a Raft cluster.
+type Node struct {
+	cfg     Config
+	sm      StateMachine
+	storage *storage
+	rng     *rand.Rand // guarded by mu
+
+	// applyMu serializes the calls to the state machine, and guards the snapshot on disk.
+	// It is taken before mu.
+	applyMu sync.Mutex
+
+	mu       sync.Mutex
+	role     Role
+	term     uint64
+	votedFor string
+	leaderID string
+	log      []Entry      // after the snapshot: log[i] has the index snap.index+1+i
+	snap     snapshotMeta // the entries compacted into the last snapshot
+	// commitIndex is the last entry known to be committed, lastApplied the last one applied
+	commitIndex, lastApplied uint64
+	// the leader's view of the followers: the next entry to send, and the last one they have
+	nextIndex, matchIndex map[string]uint64
+	lastContact           map[string]time.Time // the last response of each follower
+	electionDeadline      time.Time
+	waiters               map[uint64]waiter // by index
+	applyCond             *sync.Cond        // signaled when commitIndex grows, or once closed
+	replicate             map[string]chan struct{}
+	closed                bool
+	closing               chan struct{}
+	wg                    sync.WaitGroup
+}
+
+// StartNode starts a node, with the state it left in cfg.Dir: sm is restored to the last
+// snapshot, and the committed entries after it are applied again as the node learns they are.
+func StartNode(cfg Config, sm StateMachine) (*Node, error) {
+	cfg.ensureDefaults()
+	if !slices.Contains(cfg.Peers, cfg.ID) {
+		return nil, fmt.Errorf("raft: node %q isn't one of its peers %q", cfg.ID, cfg.Peers)
+	}
+	s, hs, snap, entries, err := openStorage(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	restore := ""
+	if snap.index > 0 {
+		restore = filepath.Join(s.snapshotDir(snap.index), snapshotStateDir)
+	}
+	if err = sm.Restore(restore); err != nil {
+		s.close()
+		return nil, err
+	}
+	n := &Node{
+		cfg:         cfg,
+		sm:          sm,
+		storage:     s,
+		rng:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		term:        hs.term,
+		votedFor:    hs.votedFor,
+		log:         entries,
+		snap:        snap,
+		commitIndex: snap.index,
+		lastApplied: snap.index,
+		waiters:     make(map[uint64]waiter),
+		replicate:   make(map[string]chan struct{}),
+		closing:     make(chan struct{}),
+	}
+	n.applyCond = sync.NewCond(&n.mu)
+	n.resetElectionDeadline()
+	n.wg.Add(2)
+	go n.tickLoop()
+	go n.applyLoop()
+	for _, peer := range cfg.Peers {
+		if peer != cfg.ID {
+			n.replicate[peer] = make(chan struct{}, 1)
+		}
+	}
+	for peer, wake := range n.replicate {
+		n.wg.Add(1)
+		go n.replicateLoop(peer, wake)
+	}
+	return n, nil
+}
+
+// snapshotStateDir is the subdirectory of a snapshot the state machine writes its state to.
+const snapshotStateDir = "state"
+
+// Close stops the node. Pending proposals fail with ErrClosed.
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return ErrClosed
+	}
+	n.closed = true
+	close(n.closing)
+	n.failWaiters(ErrClosed)
+	n.applyCond.Broadcast()
+	n.mu.Unlock()
+	n.wg.Wait()
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.storage.close()
+}
+
+// ID returns the ID of the node.
+func (n *Node) ID() string {
+	return n.cfg.ID
+}
+
+// Role returns the part the node plays, and the term it is in.
+func (n *Node) Role() (Role, uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role, n.term
+}
+
+// Leader returns the ID of the leader the node knows of, "" if it knows of none.
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leaderID
+}
+
+// Propose replicates cmd and applies it once committed, returning the result of Apply. It
+// fails with ErrNotLeader on a node that isn't the leader.
+func (n *Node) Propose(cmd []byte) (any, error) {
+	return n.propose(EntryCommand, cmd)
+}
+
+// Barrier returns once every entry committed before it was called has been applied on the
+// node, which must be the leader: reads of the state machine that follow it are linearizable.
+func (n *Node) Barrier() error {
+	_, err := n.propose(EntryNoop, nil)
+	return err
+}
+
+func (n *Node) propose(kind EntryKind, data []byte) (any, error) {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if n.role != Leader {
+		n.mu.Unlock()
+		return nil, ErrNotLeader
+	}
+	e := Entry{Index: n.lastIndex() + 1, Term: n.term, Kind: kind, Data: data}
+	if err := n.appendLocked(e); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	ch := make(chan result, 1)
+	n.waiters[e.Index] = waiter{term: e.Term, ch: ch}
+	n.mu.Unlock()
+	r := <-ch
+	return r.val, r.err
+}
+
+// appendLocked appends e to the log of the leader and sends it to the followers. Must be called
+// with n.mu held.
+func (n *Node) appendLocked(e Entry) error {
+	if err := n.storage.appendEntries([]Entry{e}); err != nil {
+		n.cfg.Logger.Errorf("raft %s: appending entry %d failed: %v", n.cfg.ID, e.Index, err)
+		return err
+	}
+	n.log = append(n.log, e)
+	n.matchIndex[n.cfg.ID] = e.Index
+	n.advanceCommitIndex()
+	for _, ch := range n.replicate {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// lastIndex returns the index of the last entry of the log. Must be called with n.mu held, like
+// the other helpers below.
+func (n *Node) lastIndex() uint64 {
+	return n.snap.index + uint64(len(n.log))
+}
+
+func (n *Node) lastTerm() uint64 {
+	if len(n.log) == 0 {
+		return n.snap.term
+	}
+	return n.log[len(n.log)-1].Term
+}
+
+// termAt returns the term of the entry at index, which mustn't be before the snapshot or past
+// the end of the log.
+func (n *Node) termAt(index uint64) uint64 {
+	if index == n.snap.index {
+		return n.snap.term
+	}
+	return n.log[index-n.snap.index-1].Term
+}
+
+func (n *Node) resetElectionDeadline() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(n.rng.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// setTerm moves on to a term, forgetting the vote cast in the one before.
+func (n *Node) setTerm(term uint64) error {
+	n.term, n.votedFor = term, ""
+	return n.persistHardState()
+}
+
+func (n *Node) persistHardState() error {
+	err := n.storage.saveHardState(hardState{term: n.term, votedFor: n.votedFor})
+	if err != nil {
+		n.cfg.Logger.Errorf("raft %s: saving term %d failed: %v", n.cfg.ID, n.term, err)
+	}
+	return err
+}
+
+// becomeFollower turns the node into a follower of term. A leader deposed that way fails its
+// pending proposals.
+func (n *Node) becomeFollower(term uint64) error {
+	if n.role == Leader {
+		n.cfg.Logger.Infof("raft %s: stepping down in term %d", n.cfg.ID, term)
+		n.failWaiters(ErrLeadershipLost)
+	}
+	n.role = Follower
+	if term > n.term {
+		n.leaderID = ""
+		return n.setTerm(term)
+	}
+	return nil
+}
+
+func (n *Node) failWaiters(err error) {
+	for index, w := range n.waiters {
+		w.ch <- result{err: err}
+		delete(n.waiters, index)
+	}
+}
+
+// tickLoop starts elections when no leader is heard from, and deposes a leader that no longer
+// hears from a majority.
+func (n *Node) tickLoop() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.closing:
+			return
+		case <-ticker.C:
+		}
+		n.mu.Lock()
+		switch {
+		case n.role != Leader && time.Now().After(n.electionDeadline):
+			n.startElection()
+		case n.role == Leader && !n.hasQuorumContact():
+			n.cfg.Logger.Warnf("raft %s: lost contact with a majority in term %d", n.cfg.ID, n.term)
+			n.becomeFollower(n.term)
+			n.leaderID = ""
+			n.resetElectionDeadline()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// hasQuorumContact reports whether the leader heard from a majority of the cluster (itself
+// included) within the election timeout.
+func (n *Node) hasQuorumContact() bool {
+	count := 1
+	for peer, t := range n.lastContact {
+		if peer != n.cfg.ID && time.Since(t) < n.cfg.ElectionTimeout {
+			count++
+		}
+	}
+	return count > len(n.cfg.Peers)/2
+}
+
+// startElection makes the node a candidate in the next term, asking the others for their vote.
+func (n *Node) startElection() {
+	n.resetElectionDeadline()
+	n.term, n.votedFor = n.term+1, n.cfg.ID
+	if err := n.persistHardState(); err != nil {
+		return
+	}
+	n.role, n.leaderID = Candidate, ""
+	n.cfg.Logger.Debugf("raft %s: standing for election in term %d", n.cfg.ID, n.term)
+	votes := 1
+	if votes > len(n.cfg.Peers)/2 {
+		n.becomeLeader()
+		return
+	}
+	req := &RequestVoteRequest{
+		Term:         n.term,
+		CandidateID:  n.cfg.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+	for _, peer := range n.cfg.Peers {
+		if peer == n.cfg.ID {
+			continue
+		}
+		go func(peer string) {
+			resp, err := n.cfg.Transport.RequestVote(peer, req)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if n.closed {
+				return
+			}
+			if resp.Term > n.term {
+				n.becomeFollower(resp.Term)
+				return
+			}
+			if n.role != Candidate || n.term != req.Term || !resp.VoteGranted {
+				return
+			}
+			votes++
+			if votes > len(n.cfg.Peers)/2 {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader makes the candidate the leader of its term. It appends an entry of its own, as
+// it can only tell that the entries of earlier terms are committed once one of its term is.
+func (n *Node) becomeLeader() {
+	n.cfg.Logger.Infof("raft %s: elected leader in term %d", n.cfg.ID, n.term)
+	n.role, n.leaderID = Leader, n.cfg.ID
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.lastContact = make(map[string]time.Time)
+	now := time.Now()
+	for _, peer := range n.cfg.Peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+		n.lastContact[peer] = now
+	}
+	n.matchIndex[n.cfg.ID] = n.lastIndex()
+	if err := n.appendLocked(Entry{Index: n.lastIndex() + 1, Term: n.term, Kind: EntryNoop}); err != nil {
+		n.becomeFollower(n.term)
+	}
+}
+
+// advanceCommitIndex commits the entries of the current term a majority has, along with
+// every entry before them.
+func (n *Node) advanceCommitIndex() {
+	if n.role != Leader {
+		return
+	}
+	for index := n.lastIndex(); index > n.commitIndex && index > n.snap.index; index-- {
+		if n.termAt(index) != n.term {
+			break
+		}
+		count := 0
+		for _, match := range n.matchIndex {
+			if match >= index {
+				count++
+			}
+		}
+		if count > len(n.cfg.Peers)/2 {
+			n.commitIndex = index
+			n.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+// replicateLoop sends the entries the follower peer lacks, or the snapshot if they have been
+// compacted, whenever the log grows and at every heartbeat, as long as the node is the leader.
+func (n *Node) replicateLoop(peer string, wake <-chan struct{}) {
+	defer n.wg.Done()
+	heartbeat := time.NewTimer(n.cfg.HeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-n.closing:
+			return
+		case <-wake:
+		case <-heartbeat.C:
+		}
+		more := n.replicateTo(peer)
+		if !heartbeat.Stop() {
+			select {
+			case <-heartbeat.C:
+			default:
+			}
+		}
+		if more {
+			heartbeat.Reset(0)
+		} else {
+			heartbeat.Reset(n.cfg.HeartbeatInterval)
+		}
+	}
+}
+
+// replicateTo sends a single message to peer, reporting whether there is more to send.
+func (n *Node) replicateTo(peer string) (more bool) {
+	n.mu.Lock()
+	if n.role != Leader || n.closed {
+		n.mu.Unlock()
+		return false
+	}
+	if n.nextIndex[peer] <= n.snap.index {
+		n.mu.Unlock()
+		return n.sendSnapshot(peer)
+	}
+	prev := n.nextIndex[peer] - 1
+	last := min(n.lastIndex(), prev+maxAppendEntries)
+	req := &AppendEntriesRequest{
+		Term:         n.term,
+		LeaderID:     n.cfg.ID,
+		PrevLogIndex: prev,
+		PrevLogTerm:  n.termAt(prev),
+		Entries:      slices.Clone(n.log[prev-n.snap.index : last-n.snap.index]),
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	resp, err := n.cfg.Transport.AppendEntries(peer, req)
+	if err != nil {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term)
+		return false
+	}
+	if n.role != Leader || n.term != req.Term || n.closed {
+		return false
+	}
+	n.lastContact[peer] = time.Now()
+	if resp.Success {
+		match := req.PrevLogIndex + uint64(len(req.Entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+			n.advanceCommitIndex()
+		}
+		n.nextIndex[peer] = max(n.nextIndex[peer], match+1)
+	} else {
+		n.nextIndex[peer] = max(1, min(resp.ConflictIndex, req.PrevLogIndex))
+	}
+	return n.nextIndex[peer] <= n.lastIndex()
+}
+
+// sendSnapshot sends the last snapshot to peer, reporting whether there is more to send.
+func (n *Node) sendSnapshot(peer string) (more bool) {
+	n.applyMu.Lock()
+	n.mu.Lock()
+	req := &InstallSnapshotRequest{
+		Term:              n.term,
+		LeaderID:          n.cfg.ID,
+		LastIncludedIndex: n.snap.index,
+		LastIncludedTerm:  n.snap.term,
+	}
+	dir := filepath.Join(n.storage.snapshotDir(n.snap.index), snapshotStateDir)
+	n.mu.Unlock()
+	data, err := packDir(dir)
+	n.applyMu.Unlock()
+	if err != nil {
+		n.cfg.Logger.Errorf("raft %s: reading snapshot %d failed: %v", n.cfg.ID, req.LastIncludedIndex, err)
+		return false
+	}
+	req.Data = data
+
+	resp, err := n.cfg.Transport.InstallSnapshot(peer, req)
+	if err != nil {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term)
+		return false
+	}
+	if n.role != Leader || n.term != req.Term || n.closed {
+		return false
+	}
+	n.lastContact[peer] = time.Now()
+	n.matchIndex[peer] = max(n.matchIndex[peer], req.LastIncludedIndex)
+	n.nextIndex[peer] = max(n.nextIndex[peer], req.LastIncludedIndex+1)
+	n.advanceCommitIndex()
+	return n.nextIndex[peer] <= n.lastIndex()
+}
+
+// HandleRequestVote handles a RequestVoteRequest sent by a candidate.
+func (n *Node) HandleRequestVote(req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil, ErrClosed
+	}
+	if req.Term > n.term {
+		if err := n.becomeFollower(req.Term); err != nil {
+			return nil, err
+		}
+	}
+	resp := &RequestVoteResponse{Term: n.term}
+	if req.Term < n.term || (n.votedFor != "" && n.votedFor != req.CandidateID) {
+		return resp, nil
+	}
+	// only a candidate with every committed entry may win, which it has if its log is at
+	// least as up to date as the one of a majority
+	upToDate := req.LastLogTerm > n.lastTerm() ||
+		(req.LastLogTerm == n.lastTerm() && req.LastLogIndex >= n.lastIndex())
+	if !upToDate {
+		return resp, nil
+	}
+	n.votedFor = req.CandidateID
+	if err := n.persistHardState(); err != nil {
+		return nil, err
+	}
+	n.resetElectionDeadline()
+	resp.VoteGranted = true
+	return resp, nil
+}
+
+// HandleAppendEntries handles an AppendEntriesRequest sent by the leader.
+func (n *Node) HandleAppendEntries(req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil, ErrClosed
+	}
+	if req.Term < n.term {
+		return &AppendEntriesResponse{Term: n.term}, nil
+	}
+	if err := n.becomeFollower(req.Term); err != nil {
+		return nil, err
+	}
+	n.leaderID = req.LeaderID
+	n.resetElectionDeadline()
+	resp := &AppendEntriesResponse{Term: n.term}
+
+	// the entries compacted into the snapshot are committed, and thus the same
+	prev, prevTerm, entries := req.PrevLogIndex, req.PrevLogTerm, req.Entries
+	if prev < n.snap.index {
+		skip := min(uint64(len(entries)), n.snap.index-prev)
+		prev, prevTerm, entries = n.snap.index, n.snap.term, entries[skip:]
+	}
+	if prev > n.lastIndex() {
+		resp.ConflictIndex = n.lastIndex() + 1
+		return resp, nil
+	}
+	if term := n.termAt(prev); term != prevTerm {
+		// skip every entry of the conflicting term
+		resp.ConflictIndex = prev
+		for resp.ConflictIndex > n.snap.index+1 && n.termAt(resp.ConflictIndex-1) == term {
+			resp.ConflictIndex--
+		}
+		return resp, nil
+	}
+	for i, e := range entries {
+		if e.Index <= n.lastIndex() {
+			if n.termAt(e.Index) == e.Term {
+				continue
+			}
+			// a conflicting entry can't be committed, it and those after it are dropped
+			pos := int(e.Index - n.snap.index - 1)
+			if err := n.storage.truncateEntries(pos); err != nil {
+				return nil, err
+			}
+			n.log = n.log[:pos]
+		}
+		if err := n.storage.appendEntries(entries[i:]); err != nil {
+			return nil, err
+		}
+		n.log = append(n.log, entries[i:]...)
+		break
+	}
+	if req.LeaderCommit > n.commitIndex {
+		// a heartbeat or a stale request may only vouch for the entries up to prev+len(entries),
+		// which must not take back the commitment of the entries after them
+		n.commitIndex = max(n.commitIndex, min(req.LeaderCommit, prev+uint64(len(entries))))
+		n.applyCond.Broadcast()
+	}
+	resp.Success = true
+	return resp, nil
+}
+
+// HandleInstallSnapshot handles an InstallSnapshotRequest sent by the leader.
+func (n *Node) HandleInstallSnapshot(req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if req.Term < n.term {
+		defer n.mu.Unlock()
+		return &InstallSnapshotResponse{Term: n.term}, nil
+	}
+	if err := n.becomeFollower(req.Term); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	n.leaderID = req.LeaderID
+	n.resetElectionDeadline()
+	resp := &InstallSnapshotResponse{Term: n.term}
+	stale := req.LastIncludedIndex <= n.lastApplied
+	n.mu.Unlock()
+	if stale {
+		return resp, nil
+	}
+
+	meta := snapshotMeta{index: req.LastIncludedIndex, term: req.LastIncludedTerm}
+	tmp, err := n.storage.stagingDir()
+	if err == nil {
+		err = unpackDir(req.Data, filepath.Join(tmp, snapshotStateDir))
+	}
+	if err == nil {
+		err = n.storage.installSnapshot(tmp, meta)
+	}
+	if err == nil {
+		err = n.sm.Restore(filepath.Join(n.storage.snapshotDir(meta.index), snapshotStateDir))
+	}
+	if err != nil {
+		n.cfg.Logger.Errorf("raft %s: installing snapshot %d failed: %v", n.cfg.ID, meta.index, err)
+		return nil, err
+	}
+	n.cfg.Logger.Infof("raft %s: installed snapshot %d from %s", n.cfg.ID, meta.index, req.LeaderID)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// the entries after the snapshot are kept if the log agrees with it
+	var rest []Entry
+	if meta.index < n.lastIndex() && meta.index > n.snap.index && n.termAt(meta.index) == meta.term {
+		rest = n.log[meta.index-n.snap.index:]
+	}
+	if err := n.storage.compactEntries(rest); err != nil {
+		return nil, err
+	}
+	n.log, n.snap = slices.Clone(rest), meta
+	n.commitIndex = max(n.commitIndex, meta.index)
+	n.lastApplied = meta.index
+	return resp, nil
+}
+
+// applyLoop applies the committed entries to the state machine, and takes a snapshot every
+// SnapshotThreshold entries.
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+	for {
+		n.mu.Lock()
+		for n.commitIndex <= n.lastApplied && !n.closed {
+			n.applyCond.Wait()
+		}
+		if n.closed {
+			n.mu.Unlock()
+			return
+		}
+		n.mu.Unlock()
+
+		n.applyMu.Lock()
+		n.mu.Lock()
+		// a snapshot may have been installed in the meantime
+		var entries []Entry
+		if first, last := n.lastApplied+1, min(n.commitIndex, n.lastIndex()); first <= last {
+			entries = slices.Clone(n.log[first-n.snap.index-1 : last-n.snap.index])
+		}
+		n.mu.Unlock()
+		for _, e := range entries {
+			var val any
+			if e.Kind == EntryCommand {
+				val = n.sm.Apply(e.Index, e.Data)
+			}
+			n.mu.Lock()
+			n.lastApplied = e.Index
+			if w, ok := n.waiters[e.Index]; ok {
+				delete(n.waiters, e.Index)
+				if w.term == e.Term {
+					w.ch <- result{val: val}
+				} else {
+					w.ch <- result{err: ErrLeadershipLost}
+				}
+			}
+			n.mu.Unlock()
+		}
+		n.mu.Lock()
+		due := n.lastApplied-n.snap.index >= n.cfg.SnapshotThreshold
+		n.mu.Unlock()
+		if due {
+			n.takeSnapshot()
+		}
+		n.applyMu.Unlock()
+	}
+}
+
+// takeSnapshot snapshots the state machine and compacts the log. Must be called with
+// n.applyMu held.
+func (n *Node) takeSnapshot() {
+	n.mu.Lock()
+	meta := snapshotMeta{index: n.lastApplied, term: n.termAt(n.lastApplied)}
+	n.mu.Unlock()
+	tmp, err := n.storage.stagingDir()
+	if err == nil {
+		err = os.MkdirAll(tmp, 0o755)
+	}
+	if err == nil {
+		err = n.sm.Snapshot(filepath.Join(tmp, snapshotStateDir))
+	}
+	if err == nil {
+		err = n.storage.installSnapshot(tmp, meta)
+	}
+	if err != nil {
+		n.cfg.Logger.Errorf("raft %s: taking snapshot %d failed: %v", n.cfg.ID, meta.index, err)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	rest := n.log[meta.index-n.snap.index:]
+	if err := n.storage.compactEntries(rest); err != nil {
+		n.cfg.Logger.Errorf("raft %s: compacting the log failed: %v", n.cfg.ID, err)
+		return
+	}
+	n.log, n.snap = slices.Clone(rest), meta
+	n.cfg.Logger.Debugf("raft %s: took snapshot %d", n.cfg.ID, meta.index)
+}
@@ -0,0 +1,60 @@
+package raft
+
+// The messages nodes exchange, as described in the Raft paper ("In Search of an Understandable
+// Consensus Algorithm", Ongaro and Ousterhout, figure 2). Their fields are exported so that
+// transports can encode them, e.g. with encoding/gob.
+
+// RequestVoteRequest is sent by a candidate to gather votes.
+type RequestVoteRequest struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64 // index and term of the last entry of the candidate, whose log must be
+	LastLogTerm  uint64 // at least as up to date as the one of the voter
+}
+
+type RequestVoteResponse struct {
+	Term        uint64 // of the voter, for the candidate to update itself
+	VoteGranted bool
+}
+
+// AppendEntriesRequest is sent by the leader to replicate entries, and as a heartbeat without
+// any.
+type AppendEntriesRequest struct {
+	Term         uint64
+	LeaderID     string
+	PrevLogIndex uint64 // index and term of the entry right before Entries, which the follower
+	PrevLogTerm  uint64 // must have for them to be appended
+	Entries      []Entry
+	LeaderCommit uint64 // commit index of the leader
+}
+
+type AppendEntriesResponse struct {
+	Term    uint64
+	Success bool
+	// ConflictIndex is where the leader goes on from after a failure: the first index of the
+	// term of the conflicting entry, or the end of the log of the follower if it is too short.
+	// It spares the leader from backing up one entry per round trip.
+	ConflictIndex uint64
+}
+
+// InstallSnapshotRequest is sent by the leader to a follower lagging behind so far that the
+// entries it needs have been compacted into a snapshot. The snapshot is sent whole.
+type InstallSnapshotRequest struct {
+	Term              uint64
+	LeaderID          string
+	LastIncludedIndex uint64 // the snapshot replaces every entry up to it
+	LastIncludedTerm  uint64
+	Data              []byte // the files of the snapshot, as packed by packDir
+}
+
+type InstallSnapshotResponse struct {
+	Term uint64
+}
+
+// Transport carries the messages of a node to its peers. Its methods are called concurrently,
+// and return an error for a message that didn't get through (which is retried).
+type Transport interface {
+	RequestVote(peer string, req *RequestVoteRequest) (*RequestVoteResponse, error)
+	AppendEntries(peer string, req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	InstallSnapshot(peer string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+}
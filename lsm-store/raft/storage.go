@@ -0,0 +1,391 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	stateFileName   = "STATE"
+	logFileName     = "LOG"
+	snapshotPrefix  = "snapshot-"
+	snapshotMetaKey = "SNAPSHOT" // file of a snapshot directory holding its index and term
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruptLog is returned when the persistent state of a node can't be read back.
+var ErrCorruptLog = errors.New("raft: corrupt log")
+
+// storage keeps the state of a node that has to survive a crash in its directory: the current
+// term and vote (STATE), the log entries after the last snapshot (LOG) and the last snapshot
+// (snapshot-<index>/). Every change is synced before it is acknowledged to another node.
+type storage struct {
+	dir     string
+	log     *os.File
+	offsets []int64 // where each entry in LOG starts, the size of the file last
+}
+
+// hardState is what a node must not forget: the term it is in and whom it voted for in it.
+type hardState struct {
+	term     uint64
+	votedFor string
+}
+
+// snapshotMeta tells which entries a snapshot replaces: all of them up to index.
+type snapshotMeta struct {
+	index, term uint64
+}
+
+// openStorage loads the persistent state from dir, created if it doesn't exist. The entries
+// returned are those after the snapshot.
+func openStorage(dir string) (*storage, hardState, snapshotMeta, []Entry, error) {
+	var hs hardState
+	var snap snapshotMeta
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, hs, snap, nil, err
+	}
+	s := &storage{dir: dir}
+	var err error
+	if hs, err = s.loadHardState(); err != nil {
+		return nil, hs, snap, nil, err
+	}
+	if snap, err = s.loadSnapshotMeta(); err != nil {
+		return nil, hs, snap, nil, err
+	}
+	if s.log, err = os.OpenFile(filepath.Join(dir, logFileName), os.O_RDWR|os.O_CREATE, 0o644); err != nil {
+		return nil, hs, snap, nil, err
+	}
+	entries, err := s.loadEntries()
+	if err != nil {
+		s.log.Close()
+		return nil, hs, snap, nil, err
+	}
+	// entries covered by the snapshot are left behind by a crash while the log was compacted
+	for len(entries) > 0 && entries[0].Index <= snap.index {
+		entries = entries[1:]
+		s.offsets = s.offsets[1:]
+	}
+	if len(entries) > 0 && entries[0].Index != snap.index+1 {
+		s.log.Close()
+		return nil, hs, snap, nil, fmt.Errorf("%w: log starts at entry %d, after a snapshot up to %d", ErrCorruptLog, entries[0].Index, snap.index)
+	}
+	return s, hs, snap, entries, nil
+}
+
+func (s *storage) close() error {
+	return s.log.Close()
+}
+
+// loadHardState reads STATE: term (uvarint)|votedFor, with a CRC-32C of both in front.
+func (s *storage) loadHardState() (hardState, error) {
+	var hs hardState
+	buf, err := os.ReadFile(filepath.Join(s.dir, stateFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return hs, nil
+	}
+	if err != nil {
+		return hs, err
+	}
+	if len(buf) < 4 || crc32.Checksum(buf[4:], crcTable) != binary.LittleEndian.Uint32(buf) {
+		return hs, fmt.Errorf("%w: %s", ErrCorruptLog, stateFileName)
+	}
+	term, n := binary.Uvarint(buf[4:])
+	if n <= 0 {
+		return hs, fmt.Errorf("%w: %s", ErrCorruptLog, stateFileName)
+	}
+	return hardState{term: term, votedFor: string(buf[4+n:])}, nil
+}
+
+// saveHardState replaces STATE, atomically.
+func (s *storage) saveHardState(hs hardState) error {
+	payload := binary.AppendUvarint(nil, hs.term)
+	payload = append(payload, hs.votedFor...)
+	buf := binary.LittleEndian.AppendUint32(nil, crc32.Checksum(payload, crcTable))
+	return writeFileAtomic(filepath.Join(s.dir, stateFileName), append(buf, payload...))
+}
+
+// An entry in LOG is checksum (CRC-32C of the rest, 4B)|length of the rest (uvarint)|index
+// (uvarint)|term (uvarint)|kind (1B)|data.
+func encodeEntry(e Entry) []byte {
+	body := binary.AppendUvarint(nil, e.Index)
+	body = binary.AppendUvarint(body, e.Term)
+	body = append(body, byte(e.Kind))
+	body = append(body, e.Data...)
+	buf := binary.LittleEndian.AppendUint32(nil, crc32.Checksum(body, crcTable))
+	buf = binary.AppendUvarint(buf, uint64(len(body)))
+	return append(buf, body...)
+}
+
+// loadEntries reads LOG. A crash may leave a torn entry at its end, which is cut off.
+func (s *storage) loadEntries() ([]Entry, error) {
+	if _, err := s.log.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(s.log)
+	var entries []Entry
+	var offset int64
+	s.offsets = s.offsets[:0]
+	for {
+		e, n, err := readEntry(r)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF || errors.Is(err, ErrCorruptLog) {
+				break
+			}
+			return nil, err
+		}
+		if len(entries) > 0 && e.Index != entries[len(entries)-1].Index+1 {
+			return nil, fmt.Errorf("%w: entry %d follows entry %d", ErrCorruptLog, e.Index, entries[len(entries)-1].Index)
+		}
+		entries = append(entries, e)
+		s.offsets = append(s.offsets, offset)
+		offset += n
+	}
+	// drop what follows the last entry read in full
+	if err := s.log.Truncate(offset); err != nil {
+		return nil, err
+	}
+	if _, err := s.log.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	s.offsets = append(s.offsets, offset)
+	return entries, nil
+}
+
+func readEntry(r *bufio.Reader) (Entry, int64, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Entry{}, 0, err
+	}
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return Entry{}, 0, io.ErrUnexpectedEOF
+	}
+	if length > maxEntrySize {
+		return Entry{}, 0, ErrCorruptLog
+	}
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return Entry{}, 0, io.ErrUnexpectedEOF
+	}
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(header[:]) {
+		return Entry{}, 0, ErrCorruptLog
+	}
+	var e Entry
+	var n, m int
+	e.Index, n = binary.Uvarint(body)
+	if n > 0 {
+		e.Term, m = binary.Uvarint(body[n:])
+	}
+	if n <= 0 || m <= 0 || len(body) < n+m+1 {
+		return Entry{}, 0, ErrCorruptLog
+	}
+	e.Kind = EntryKind(body[n+m])
+	e.Data = body[n+m+1:]
+	return e, int64(4+uvarintLen(length)) + int64(length), nil
+}
+
+func uvarintLen(x uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], x)
+}
+
+// appendEntries appends entries to LOG and syncs it.
+func (s *storage) appendEntries(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	offset := s.offsets[len(s.offsets)-1]
+	var buf []byte
+	for _, e := range entries {
+		enc := encodeEntry(e)
+		buf = append(buf, enc...)
+		offset += int64(len(enc))
+		s.offsets = append(s.offsets, offset)
+	}
+	if _, err := s.log.Write(buf); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// truncateEntries drops the entries of LOG from the i-th (counting from 0) on.
+func (s *storage) truncateEntries(i int) error {
+	offset := s.offsets[i]
+	if err := s.log.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := s.log.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	s.offsets = s.offsets[:i+1]
+	return s.log.Sync()
+}
+
+// compactEntries replaces LOG with the entries left after a snapshot.
+func (s *storage) compactEntries(entries []Entry) error {
+	path := filepath.Join(s.dir, logFileName)
+	var buf []byte
+	offsets := []int64{0}
+	for _, e := range entries {
+		buf = append(buf, encodeEntry(e)...)
+		offsets = append(offsets, int64(len(buf)))
+	}
+	if err := writeFileAtomic(path, buf); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return err
+	}
+	s.log.Close()
+	s.log, s.offsets = f, offsets
+	return nil
+}
+
+// snapshotDir returns the directory of the snapshot up to index.
+func (s *storage) snapshotDir(index uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%020d", snapshotPrefix, index))
+}
+
+// loadSnapshotMeta returns the index and term of the last snapshot, zero if there is none.
+func (s *storage) loadSnapshotMeta() (snapshotMeta, error) {
+	dirs, err := s.snapshots()
+	if err != nil || len(dirs) == 0 {
+		return snapshotMeta{}, err
+	}
+	buf, err := os.ReadFile(filepath.Join(dirs[len(dirs)-1], snapshotMetaKey))
+	if err != nil {
+		return snapshotMeta{}, err
+	}
+	return decodeSnapshotMeta(buf)
+}
+
+func encodeSnapshotMeta(meta snapshotMeta) []byte {
+	buf := binary.AppendUvarint(nil, meta.index)
+	return binary.AppendUvarint(buf, meta.term)
+}
+
+func decodeSnapshotMeta(buf []byte) (snapshotMeta, error) {
+	index, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return snapshotMeta{}, fmt.Errorf("%w: snapshot metadata", ErrCorruptLog)
+	}
+	term, m := binary.Uvarint(buf[n:])
+	if m <= 0 {
+		return snapshotMeta{}, fmt.Errorf("%w: snapshot metadata", ErrCorruptLog)
+	}
+	return snapshotMeta{index: index, term: term}, nil
+}
+
+// snapshots returns the directories of the complete snapshots, oldest first.
+func (s *storage) snapshots() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() || !strings.HasPrefix(name, snapshotPrefix) {
+			continue
+		}
+		if _, err := strconv.ParseUint(strings.TrimPrefix(name, snapshotPrefix), 10, 64); err != nil {
+			continue
+		}
+		dirs = append(dirs, filepath.Join(s.dir, name))
+	}
+	// the zero padded indexes sort like numbers
+	slices.Sort(dirs)
+	return dirs, nil
+}
+
+// installSnapshot makes the snapshot staged in tmp, which holds the state up to meta, the
+// last one, and deletes those before it.
+func (s *storage) installSnapshot(tmp string, meta snapshotMeta) error {
+	if err := writeFileAtomic(filepath.Join(tmp, snapshotMetaKey), encodeSnapshotMeta(meta)); err != nil {
+		return err
+	}
+	dir := s.snapshotDir(meta.index)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+	dirs, err := s.snapshots()
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		if d != dir {
+			if err := os.RemoveAll(d); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// stagingDir returns a new, empty directory to stage a snapshot in, removing those left by a
+// crash.
+func (s *storage) stagingDir() (string, error) {
+	tmp := filepath.Join(s.dir, snapshotPrefix+"staging.tmp")
+	if err := os.RemoveAll(tmp); err != nil {
+		return "", err
+	}
+	return tmp, nil
+}
+
+// writeFileAtomic replaces the file at path with data: it is written to a temporary file,
+// synced and renamed over path.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
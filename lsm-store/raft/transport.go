@@ -0,0 +1,222 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// ErrUnreachable is returned by a transport for a peer a message can't be delivered to.
+var ErrUnreachable = errors.New("raft: peer unreachable")
+
+// LocalNetwork connects the nodes of a single process, e.g. to try out a cluster, or to see how
+// it copes with a node cut off from the others.
+type LocalNetwork struct {
+	mu           sync.Mutex
+	nodes        map[string]*Node
+	disconnected map[string]bool
+}
+
+func NewLocalNetwork() *LocalNetwork {
+	return &LocalNetwork{nodes: make(map[string]*Node), disconnected: make(map[string]bool)}
+}
+
+// Transport returns the transport of the node id, to pass in its Config.
+func (n *LocalNetwork) Transport(id string) Transport {
+	return localTransport{network: n, from: id}
+}
+
+// Register makes node reachable under id, replacing the node registered before, e.g. by a
+// node restarted after a crash.
+func (n *LocalNetwork) Register(id string, node *Node) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nodes[id] = node
+}
+
+// Disconnect cuts the node id off from the others, until Reconnect is called: the messages it
+// sends or is sent are lost.
+func (n *LocalNetwork) Disconnect(id string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.disconnected[id] = true
+}
+
+func (n *LocalNetwork) Reconnect(id string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.disconnected, id)
+}
+
+// route returns the node a message from from to to is delivered to.
+func (n *LocalNetwork) route(from, to string) (*Node, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	node := n.nodes[to]
+	if node == nil || n.disconnected[from] || n.disconnected[to] {
+		return nil, fmt.Errorf("%w: %s", ErrUnreachable, to)
+	}
+	return node, nil
+}
+
+type localTransport struct {
+	network *LocalNetwork
+	from    string
+}
+
+func (t localTransport) RequestVote(peer string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	node, err := t.network.route(t.from, peer)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandleRequestVote(req)
+}
+
+func (t localTransport) AppendEntries(peer string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	node, err := t.network.route(t.from, peer)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandleAppendEntries(req)
+}
+
+func (t localTransport) InstallSnapshot(peer string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	node, err := t.network.route(t.from, peer)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandleInstallSnapshot(req)
+}
+
+// ServeRPC serves the messages sent to node by the RPCTransport of its peers on ln, until ln
+// fails, e.g. once it is closed.
+func ServeRPC(ln net.Listener, node *Node) error {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Raft", &rpcHandler{node}); err != nil {
+		return err
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.ServeConn(conn)
+	}
+}
+
+// rpcHandler exposes the handlers of a node in the form net/rpc expects.
+type rpcHandler struct {
+	node *Node
+}
+
+func (h *rpcHandler) RequestVote(req *RequestVoteRequest, resp *RequestVoteResponse) error {
+	r, err := h.node.HandleRequestVote(req)
+	if err == nil {
+		*resp = *r
+	}
+	return err
+}
+
+func (h *rpcHandler) AppendEntries(req *AppendEntriesRequest, resp *AppendEntriesResponse) error {
+	r, err := h.node.HandleAppendEntries(req)
+	if err == nil {
+		*resp = *r
+	}
+	return err
+}
+
+func (h *rpcHandler) InstallSnapshot(req *InstallSnapshotRequest, resp *InstallSnapshotResponse) error {
+	r, err := h.node.HandleInstallSnapshot(req)
+	if err == nil {
+		*resp = *r
+	}
+	return err
+}
+
+// RPCTransport sends messages over TCP with net/rpc to the peers served by ServeRPC, the IDs of
+// the peers being their addresses (host:port).
+type RPCTransport struct {
+	timeout time.Duration // of a message, a snapshot getting ten times as long
+	mu      sync.Mutex
+	clients map[string]*rpc.Client
+}
+
+// NewRPCTransport returns a transport giving up on a message after timeout.
+func NewRPCTransport(timeout time.Duration) *RPCTransport {
+	return &RPCTransport{timeout: timeout, clients: make(map[string]*rpc.Client)}
+}
+
+func (t *RPCTransport) RequestVote(peer string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	resp := &RequestVoteResponse{}
+	return resp, t.call(peer, "Raft.RequestVote", req, resp, t.timeout)
+}
+
+func (t *RPCTransport) AppendEntries(peer string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	resp := &AppendEntriesResponse{}
+	return resp, t.call(peer, "Raft.AppendEntries", req, resp, t.timeout)
+}
+
+func (t *RPCTransport) InstallSnapshot(peer string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	resp := &InstallSnapshotResponse{}
+	return resp, t.call(peer, "Raft.InstallSnapshot", req, resp, 10*t.timeout)
+}
+
+// call sends a message, dropping the connection if it fails, so that the next one redials.
+func (t *RPCTransport) call(peer, method string, req, resp any, timeout time.Duration) error {
+	t.mu.Lock()
+	c := t.clients[peer]
+	t.mu.Unlock()
+	if c == nil {
+		conn, err := net.DialTimeout("tcp", peer, timeout)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrUnreachable, err)
+		}
+		c = rpc.NewClient(conn)
+		t.mu.Lock()
+		if other := t.clients[peer]; other != nil {
+			c.Close()
+			c = other
+		} else {
+			t.clients[peer] = c
+		}
+		t.mu.Unlock()
+	}
+	call := c.Go(method, req, resp, make(chan *rpc.Call, 1))
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-call.Done:
+		if call.Error == nil {
+			return nil
+		}
+		// an error returned by the handler doesn't break the connection
+		if _, ok := call.Error.(rpc.ServerError); ok {
+			return call.Error
+		}
+		err = call.Error
+	case <-timer.C:
+		err = fmt.Errorf("%s timed out", method)
+	}
+	t.mu.Lock()
+	if t.clients[peer] == c {
+		delete(t.clients, peer)
+	}
+	t.mu.Unlock()
+	c.Close()
+	return fmt.Errorf("%w: %v", ErrUnreachable, err)
+}
+
+// Close closes the connections to the peers.
+func (t *RPCTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for peer, c := range t.clients {
+		c.Close()
+		delete(t.clients, peer)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+// Package raftdb replicates a DB across a Raft cluster: Set, Delete, DeleteRange and batches
+// of them are proposed to the leader as commands of the replicated log, and every node applies
+// the committed commands to its own DB, in the same order. Snapshots of the state machine are
+// checkpoints of the DB (see DB.Checkpoint).
+//
+// The Raft log is what makes the writes durable: a node restarting restores its last snapshot
+// and applies the commands after it again, so its DB is written without syncing the WAL. The
+// data directory, Raft state and snapshots are on the local file system.
+package raftdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"lsm/db"
+	"lsm/raft"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	raftDirName = "raft"
+	dataDirName = "db"
+)
+
+// ErrMalformedCommand is returned by a node for a command it can't decode.
+var ErrMalformedCommand = errors.New("raftdb: malformed command")
+
+type opKind uint8
+
+const (
+	opSet opKind = iota + 1
+	opDelete
+	opDeleteRange
+)
+
+// Batch collects writes proposed as a single command: no other command is applied between
+// them. They aren't isolated from reads, though, and a write failing (on every node alike)
+// leaves those before it applied.
+type Batch struct {
+	buf   []byte // kind (1B)|key length (uvarint)|key|value length (uvarint)|value for each write
+	count int
+}
+
+func (b *Batch) Set(key, val []byte) {
+	b.add(opSet, key, val)
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.add(opDelete, key, nil)
+}
+
+// DeleteRange deletes the keys in [start, end).
+func (b *Batch) DeleteRange(start, end []byte) {
+	b.add(opDeleteRange, start, end)
+}
+
+// Len returns the number of writes in the batch.
+func (b *Batch) Len() int {
+	return b.count
+}
+
+func (b *Batch) add(kind opKind, key, val []byte) {
+	b.buf = append(b.buf, byte(kind))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(key)))
+	b.buf = append(b.buf, key...)
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(val)))
+	b.buf = append(b.buf, val...)
+	b.count++
+}
+
+// DB is a node of a replicated DB.
+type DB struct {
+	node *raft.Node
+	sm   *stateMachine
+}
+
+// Open starts the node cfg describes, keeping its Raft state in cfg.Dir/raft and its DB,
+// opened with opts, in cfg.Dir/db.
+func Open(cfg raft.Config, opts *db.Options) (*DB, error) {
+	sm := &stateMachine{dir: filepath.Join(cfg.Dir, dataDirName), opts: opts}
+	cfg.Dir = filepath.Join(cfg.Dir, raftDirName)
+	node, err := raft.StartNode(cfg, sm)
+	if err != nil {
+		if sm.d != nil {
+			sm.d.Close()
+		}
+		return nil, err
+	}
+	return &DB{node: node, sm: sm}, nil
+}
+
+// Node returns the Raft node, e.g. to find out which node is the leader.
+func (d *DB) Node() *raft.Node {
+	return d.node
+}
+
+// Close stops the node and closes its DB.
+func (d *DB) Close() error {
+	if err := d.node.Close(); err != nil {
+		return err
+	}
+	d.sm.mu.Lock()
+	defer d.sm.mu.Unlock()
+	return d.sm.d.Close()
+}
+
+// Set proposes a write, returning once it is applied on the node, which must be the leader
+// (raft.ErrNotLeader otherwise).
+func (d *DB) Set(key, val []byte) error {
+	b := &Batch{}
+	b.Set(key, val)
+	return d.Apply(b)
+}
+
+func (d *DB) Delete(key []byte) error {
+	b := &Batch{}
+	b.Delete(key)
+	return d.Apply(b)
+}
+
+func (d *DB) DeleteRange(start, end []byte) error {
+	b := &Batch{}
+	b.DeleteRange(start, end)
+	return d.Apply(b)
+}
+
+// Apply proposes the writes of b as a single command, returning once it is applied on the
+// node, which must be the leader.
+func (d *DB) Apply(b *Batch) error {
+	res, err := d.node.Propose(b.buf)
+	if err != nil {
+		return err
+	}
+	if err, ok := res.(error); ok {
+		return err
+	}
+	return nil
+}
+
+// Get reads key from the DB of the node, which may lag behind the leader. On the leader, a
+// read after Node().Barrier() sees every write committed before.
+func (d *DB) Get(key []byte) ([]byte, error) {
+	d.sm.mu.RLock()
+	defer d.sm.mu.RUnlock()
+	return d.sm.d.Get(key)
+}
+
+// View calls fn with the DB of the node, e.g. to iterate over it, which no snapshot installed
+// by the leader replaces before fn returns. fn must not write to it.
+func (d *DB) View(fn func(*db.DB) error) error {
+	d.sm.mu.RLock()
+	defer d.sm.mu.RUnlock()
+	return fn(d.sm.d)
+}
+
+// stateMachine applies the commands to the DB of the node.
+type stateMachine struct {
+	dir  string
+	opts *db.Options
+	mu   sync.RWMutex // held for writing while the DB is replaced by a snapshot
+	d    *db.DB
+}
+
+// Apply applies a batch, returning the error of the write that failed, if any.
+func (sm *stateMachine) Apply(index uint64, cmd []byte) any {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	for len(cmd) > 0 {
+		kind := opKind(cmd[0])
+		key, rest, ok := cutBytes(cmd[1:])
+		if !ok {
+			return fmt.Errorf("%w at index %d", ErrMalformedCommand, index)
+		}
+		val, rest, ok := cutBytes(rest)
+		if !ok {
+			return fmt.Errorf("%w at index %d", ErrMalformedCommand, index)
+		}
+		cmd = rest
+		var err error
+		switch kind {
+		case opSet:
+			err = sm.d.Set(key, val, db.NoSync)
+		case opDelete:
+			err = sm.d.Delete(key, db.NoSync)
+		case opDeleteRange:
+			err = sm.d.DeleteRange(key, val, db.NoSync)
+		default:
+			err = fmt.Errorf("%w at index %d: op kind %d", ErrMalformedCommand, index, kind)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cutBytes cuts a length-prefixed byte slice off buf.
+func cutBytes(buf []byte) (b, rest []byte, ok bool) {
+	n, m := binary.Uvarint(buf)
+	if m <= 0 || uint64(len(buf)-m) < n {
+		return nil, nil, false
+	}
+	return buf[m : m+int(n)], buf[m+int(n):], true
+}
+
+func (sm *stateMachine) Snapshot(dir string) error {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.d.Checkpoint(dir)
+}
+
+// Restore replaces the data directory with a copy of the snapshot, and reopens the DB.
+func (sm *stateMachine) Restore(dir string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.d != nil {
+		if err := sm.d.Close(); err != nil {
+			return err
+		}
+		sm.d = nil
+	}
+	if err := os.RemoveAll(sm.dir); err != nil {
+		return err
+	}
+	if dir != "" {
+		if err := linkDir(dir, sm.dir); err != nil {
+			return err
+		}
+	}
+	d, err := db.Open(sm.dir, sm.opts)
+	if err != nil {
+		return err
+	}
+	sm.d = d
+	return nil
+}
+
+// linkDir fills the new directory dst with the files of src, hard linked or, if they can't be,
+// copied. The DB never changes a file of a checkpoint in place, the links are as good as copies.
+func linkDir(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dst, 0o755); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		from, to := filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())
+		if os.Link(from, to) == nil {
+			continue
+		}
+		if err = copyFile(from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
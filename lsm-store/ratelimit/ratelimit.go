@@ -0,0 +1,116 @@
+// Package ratelimit paces writes with a token bucket, so that background work such as flushes
+// and compactions doesn't take all the disk bandwidth foreground reads and writes need.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// burstDuration is how much unused rate a Limiter saves up, so that the writes of a short
+// pause can be caught up on at once.
+const burstDuration = 100 * time.Millisecond
+
+// Limiter is a token bucket filled at a rate of bytes per second: every byte written takes a
+// token. Its rate can be changed at any time, which wakes up the writers waiting on it. It is
+// safe for concurrent use.
+type Limiter struct {
+	mu      sync.Mutex
+	rate    int64   // bytes per second, unlimited if <= 0
+	tokens  float64 // negative after a write larger than the bucket, which later writes pay for
+	last    time.Time
+	changed chan struct{} // closed (and replaced) whenever the rate changes
+	waited  time.Duration
+}
+
+// NewLimiter returns a Limiter allowing bytesPerSec bytes per second, or any number of them
+// if bytesPerSec <= 0.
+func NewLimiter(bytesPerSec int64) *Limiter {
+	l := &Limiter{changed: make(chan struct{})}
+	l.SetRate(bytesPerSec)
+	return l
+}
+
+// SetRate changes the rate to bytesPerSec bytes per second (unlimited if <= 0).
+func (l *Limiter) SetRate(bytesPerSec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate > 0 {
+		l.refill(time.Now())
+	} else {
+		// starts with a full bucket
+		l.tokens, l.last = float64(burst(bytesPerSec)), time.Now()
+	}
+	l.rate = bytesPerSec
+	l.tokens = min(l.tokens, float64(burst(l.rate)))
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Rate returns the current rate in bytes per second, 0 or less if unlimited.
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// Waited returns the total time Wait has blocked for.
+func (l *Limiter) Waited() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.waited
+}
+
+func burst(rate int64) int64 {
+	return max(rate*int64(burstDuration)/int64(time.Second), 1)
+}
+
+// refill adds the tokens accrued since the last refill. Must be called with l.mu held.
+func (l *Limiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	l.tokens = min(l.tokens, float64(burst(l.rate)))
+	l.last = now
+}
+
+// Wait blocks until n bytes may be written, or until cancel is closed. Writes larger than the
+// bucket only wait for it to be full, and are paid for by the following ones.
+func (l *Limiter) Wait(n int, cancel <-chan struct{}) {
+	var start time.Time
+wait:
+	for {
+		l.mu.Lock()
+		if l.rate <= 0 {
+			l.mu.Unlock()
+			break wait
+		}
+		now := time.Now()
+		l.refill(now)
+		need := float64(min(int64(n), burst(l.rate)))
+		if l.tokens >= need {
+			l.tokens -= float64(n)
+			l.mu.Unlock()
+			break wait
+		}
+		delay := time.Duration((need - l.tokens) / float64(l.rate) * float64(time.Second))
+		changed := l.changed
+		l.mu.Unlock()
+
+		if start.IsZero() {
+			start = now
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-changed:
+			t.Stop()
+		case <-cancel:
+			t.Stop()
+			break wait
+		}
+	}
+	if !start.IsZero() {
+		l.mu.Lock()
+		l.waited += time.Since(start)
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,302 @@
+package replication
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"lsm/db"
+	"lsm/encoder"
+	"lsm/storage"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dialTimeout = 10 * time.Second
+	// a follower that lost the leader reconnects after minBackoff, doubling the wait on every
+	// failed attempt up to maxBackoff
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 5 * time.Second
+)
+
+// Follower keeps a DB up to date with the leader it follows.
+type Follower struct {
+	addr    string
+	d       *db.DB
+	encoder *encoder.Encoder
+
+	mu      sync.Mutex
+	conn    net.Conn // to the leader, nil while disconnected
+	err     error    // that stopped the follower for good
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// Follow opens the DB in dir, like db.Open, and keeps it up to date with the leader listening
+// on addr from then on, reconnecting whenever the connection is lost. If dir is empty or doesn't
+// exist, the DB is bootstrapped from a checkpoint of the leader first, which Follow waits for.
+func Follow(addr, dir string, opts *db.Options) (*Follower, error) {
+	vfs := storage.Default
+	if opts != nil && opts.FS != nil {
+		vfs = opts.FS
+	}
+	f := &Follower{
+		addr:    addr,
+		encoder: encoder.NewEncoder(),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	entries, err := vfs.List(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	var c *conn
+	if len(entries) == 0 {
+		if c, err = f.bootstrap(vfs, dir); err != nil {
+			return nil, err
+		}
+	}
+	if f.d, err = db.Open(dir, opts); err != nil {
+		if c != nil {
+			c.Close()
+		}
+		return nil, err
+	}
+	go f.run(c)
+	return f, nil
+}
+
+// DB returns the DB kept up to date, which is only meant to be read.
+func (f *Follower) DB() *db.DB {
+	return f.d
+}
+
+// Err returns the error that made the follower stop following the leader for good, e.g.
+// ErrTooFarBehind, nil as long as it goes on.
+func (f *Follower) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// Close stops following the leader and closes the DB.
+func (f *Follower) Close() error {
+	f.mu.Lock()
+	select {
+	case <-f.closing:
+		f.mu.Unlock()
+		return ErrClosed
+	default:
+	}
+	close(f.closing)
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	f.mu.Unlock()
+	<-f.done
+	return f.d.Close()
+}
+
+// bootstrap receives a checkpoint of the leader into a staging directory next to dir, which
+// then takes the place of dir. It returns the connection the records after the checkpoint
+// come through.
+func (f *Follower) bootstrap(vfs storage.VFS, dir string) (*conn, error) {
+	staging := filepath.Clean(dir) + ".bootstrap"
+	if err := vfs.RemoveAll(staging); err != nil {
+		return nil, err
+	}
+	if err := vfs.MkdirAll(staging); err != nil {
+		return nil, err
+	}
+	c, err := f.dial(true, 0)
+	if err != nil {
+		vfs.RemoveAll(staging)
+		return nil, err
+	}
+	if err = receiveCheckpoint(c, vfs, staging); err == nil {
+		// dir is empty if it exists
+		if err = vfs.Remove(dir); errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = vfs.Rename(staging, dir)
+	}
+	if err == nil {
+		err = vfs.Sync(filepath.Dir(filepath.Clean(dir)))
+	}
+	if err != nil {
+		c.Close()
+		vfs.RemoveAll(staging)
+		return nil, err
+	}
+	return c, nil
+}
+
+// receiveCheckpoint writes the files of the checkpoint the leader sends to dir, and syncs them.
+func receiveCheckpoint(c *conn, vfs storage.VFS, dir string) error {
+	var out storage.File
+	var buf []byte
+	closeFile := func() error {
+		if out == nil {
+			return nil
+		}
+		err := out.Sync()
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		out = nil
+		return err
+	}
+	defer closeFile()
+	for {
+		t, payload, err := c.readFrame(buf)
+		if err != nil {
+			return err
+		}
+		buf = payload
+		switch t {
+		case frameFile:
+			name := string(payload)
+			if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+				return fmt.Errorf("%w: checkpoint file %q", errProtocol, name)
+			}
+			if err = closeFile(); err != nil {
+				return err
+			}
+			if out, err = vfs.Create(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		case frameData:
+			if out == nil {
+				return fmt.Errorf("%w: checkpoint data before a file", errProtocol)
+			}
+			if _, err = out.Write(payload); err != nil {
+				return err
+			}
+		case frameCheckpointDone:
+			if err = closeFile(); err != nil {
+				return err
+			}
+			return vfs.Sync(dir)
+		case frameError:
+			return fmt.Errorf("replication: leader failed: %s", payload)
+		default:
+			return fmt.Errorf("%w: unexpected frame %d during the checkpoint", errProtocol, t)
+		}
+	}
+}
+
+// dial connects to the leader and says hello.
+func (f *Follower) dial(bootstrap bool, lastSeq uint64) (*conn, error) {
+	nc, err := net.DialTimeout("tcp", f.addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := newConn(nc)
+	hello := append([]byte(magic), 0)
+	if bootstrap {
+		hello[len(magic)] = 1
+	}
+	hello = binary.AppendUvarint(hello, lastSeq)
+	if err = c.writeFrame(frameHello, hello); err == nil {
+		err = c.w.Flush()
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// run applies the records the leader streams, reconnecting until the follower is closed or
+// runs into an error it can't recover from. c is the connection to start with, if any.
+func (f *Follower) run(c *conn) {
+	defer close(f.done)
+	backoff := minBackoff
+	for {
+		if c == nil {
+			var err error
+			if c, err = f.dial(false, f.d.Stats().SeqNum); err != nil {
+				select {
+				case <-f.closing:
+					return
+				case <-time.After(backoff):
+				}
+				backoff = min(2*backoff, maxBackoff)
+				continue
+			}
+		}
+		f.mu.Lock()
+		select {
+		case <-f.closing:
+			f.mu.Unlock()
+			c.Close()
+			return
+		default:
+		}
+		f.conn = c
+		f.mu.Unlock()
+
+		applied, err := f.apply(c)
+		c.Close()
+		f.mu.Lock()
+		f.conn = nil
+		select {
+		case <-f.closing:
+			f.mu.Unlock()
+			return
+		default:
+		}
+		if !isNetError(err) {
+			f.err = err
+			f.mu.Unlock()
+			return
+		}
+		f.mu.Unlock()
+		c = nil
+		if applied {
+			backoff = minBackoff
+		}
+	}
+}
+
+// apply applies the records coming through c until it fails, reporting whether any was.
+func (f *Follower) apply(c *conn) (applied bool, err error) {
+	var buf []byte
+	for {
+		t, payload, err := c.readFrame(buf)
+		if err != nil {
+			return applied, err
+		}
+		buf = payload
+		switch t {
+		case frameRecord:
+			cfID, n := binary.Uvarint(payload)
+			if n <= 0 {
+				return applied, errProtocol
+			}
+			keyLen, m := binary.Uvarint(payload[n:])
+			if m <= 0 || uint64(len(payload)-n-m) < keyLen {
+				return applied, errProtocol
+			}
+			// the payload is overwritten by the next frame, the memtable keeps the key
+			key := append([]byte(nil), payload[n+m:n+m+int(keyLen)]...)
+			val := f.encoder.Parse(payload[n+m+int(keyLen):])
+			if err = f.d.ApplyWALRecord(uint32(cfID), key, val, nil); err != nil {
+				return applied, err
+			}
+			applied = true
+		case frameTooFarBehind:
+			return applied, ErrTooFarBehind
+		case frameError:
+			return applied, fmt.Errorf("replication: leader failed: %s", payload)
+		default:
+			return applied, fmt.Errorf("%w: unexpected frame %d", errProtocol, t)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package replication
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"lsm/db"
+	"lsm/encoder"
+	"lsm/storage"
+	"lsm/wal"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// helloTimeout is how long a leader waits for a follower to say hello once connected.
+const helloTimeout = 10 * time.Second
+
+// numbers the checkpoint directories of the bootstraps
+var checkpointSeq atomic.Uint64
+
+// Leader serves the WAL of a DB to the followers connecting to it.
+type Leader struct {
+	d          *db.DB
+	fs         storage.VFS
+	scratchDir string
+	encoder    *encoder.Encoder
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup // of the connections being served
+}
+
+// NewLeader returns a leader serving the WAL of d. The checkpoints followers bootstrap from are
+// made in scratchDir, on fs (Options.FS of d, nil for the local file system), and deleted once
+// sent; scratchDir is best on the file system of the data directory, so that the checkpoints
+// link the files rather than copy them.
+func NewLeader(d *db.DB, fs storage.VFS, scratchDir string) *Leader {
+	if fs == nil {
+		fs = storage.Default
+	}
+	return &Leader{
+		d:          d,
+		fs:         fs,
+		scratchDir: scratchDir,
+		encoder:    encoder.NewEncoder(),
+		listeners:  make(map[net.Listener]struct{}),
+		conns:      make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts the connections of followers on ln, serving each of them in a goroutine of its
+// own, until ln fails or the leader is closed, which makes it return ErrClosed.
+func (l *Leader) Serve(ln net.Listener) error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return ErrClosed
+	}
+	l.listeners[ln] = struct{}{}
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		delete(l.listeners, ln)
+		l.mu.Unlock()
+	}()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			l.mu.Lock()
+			closed := l.closed
+			l.mu.Unlock()
+			if closed {
+				return ErrClosed
+			}
+			return err
+		}
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			c.Close()
+			return ErrClosed
+		}
+		l.conns[c] = struct{}{}
+		l.wg.Add(1)
+		l.mu.Unlock()
+		go l.serve(c)
+	}
+}
+
+// Close stops serving: it closes the listeners and the connections, and waits until the
+// followers are no longer served. The DB is left open.
+func (l *Leader) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return ErrClosed
+	}
+	l.closed = true
+	for ln := range l.listeners {
+		ln.Close()
+	}
+	for c := range l.conns {
+		c.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+	return nil
+}
+
+// serve streams the WAL to the follower connected on nc, after a checkpoint if it bootstraps.
+func (l *Leader) serve(nc net.Conn) {
+	defer l.wg.Done()
+	defer func() {
+		l.mu.Lock()
+		delete(l.conns, nc)
+		l.mu.Unlock()
+		nc.Close()
+	}()
+	c := newConn(nc)
+	bootstrap, lastSeq, err := l.readHello(c)
+	if err != nil {
+		return
+	}
+	t, err := l.startTailer(c, bootstrap, lastSeq)
+	if err != nil {
+		if err != errStop {
+			c.writeFrame(frameError, []byte(err.Error()))
+			c.w.Flush()
+		}
+		return
+	}
+	// the follower says nothing after its hello, the tailer is stopped once it hangs up
+	go func() {
+		io.Copy(io.Discard, c.r)
+		t.Close()
+	}()
+	defer t.Close()
+
+	for {
+		cfID, key, val, err := t.Next()
+		if err == nil {
+			err = l.sendRecord(c, cfID, key, val)
+		}
+		if err != nil {
+			if !errors.Is(err, wal.ErrClosed) && !errors.Is(err, db.ErrClosed) && !isNetError(err) {
+				c.writeFrame(frameError, []byte(err.Error()))
+				c.w.Flush()
+			}
+			return
+		}
+	}
+}
+
+// errStop tells serve the follower has been answered already.
+var errStop = errors.New("replication: stop serving")
+
+func (l *Leader) readHello(c *conn) (bootstrap bool, lastSeq uint64, err error) {
+	c.SetReadDeadline(time.Now().Add(helloTimeout))
+	t, payload, err := c.readFrame(nil)
+	if err != nil {
+		return false, 0, err
+	}
+	c.SetReadDeadline(time.Time{})
+	if t != frameHello || len(payload) < len(magic)+1 || string(payload[:len(magic)]) != magic {
+		return false, 0, errProtocol
+	}
+	payload = payload[len(magic):]
+	lastSeq, n := binary.Uvarint(payload[1:])
+	if n <= 0 {
+		return false, 0, errProtocol
+	}
+	return payload[0] != 0, lastSeq, nil
+}
+
+// startTailer returns a tailer yielding the records the follower needs, having sent it a
+// checkpoint first if it bootstraps.
+func (l *Leader) startTailer(c *conn, bootstrap bool, lastSeq uint64) (*wal.Tailer, error) {
+	if !bootstrap {
+		if lastSeq > l.d.Stats().SeqNum {
+			return nil, fmt.Errorf("replication: follower at seqNum %d is ahead of the leader", lastSeq)
+		}
+		t, err := l.d.TailWALFrom(lastSeq + 1)
+		if errors.Is(err, db.ErrWALSegmentGone) {
+			c.writeFrame(frameTooFarBehind)
+			c.w.Flush()
+			return nil, errStop
+		}
+		return t, err
+	}
+	// the tailer is started before the checkpoint, so that no write falls in between: the
+	// follower skips the records the checkpoint holds already
+	var t *wal.Tailer
+	for {
+		fm, offset := l.d.WALPosition()
+		var err error
+		t, err = l.d.TailWAL(fm, offset)
+		if err == nil {
+			break
+		}
+		// the segment has just been sealed and retired
+		if !errors.Is(err, db.ErrWALSegmentGone) {
+			return nil, err
+		}
+	}
+	if err := l.sendCheckpoint(c); err != nil {
+		t.Close()
+		if isNetError(err) {
+			return nil, errStop
+		}
+		return nil, err
+	}
+	return t, nil
+}
+
+// sendCheckpoint makes a checkpoint of the DB and sends its files.
+func (l *Leader) sendCheckpoint(c *conn) error {
+	dir := filepath.Join(l.scratchDir, fmt.Sprintf("checkpoint-%d.tmp", checkpointSeq.Add(1)))
+	if err := l.fs.MkdirAll(l.scratchDir); err != nil {
+		return err
+	}
+	defer l.fs.RemoveAll(dir)
+	if err := l.d.Checkpoint(dir); err != nil {
+		return err
+	}
+	entries, err := l.fs.List(dir)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, fileChunkSize)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if err = l.sendFile(c, filepath.Join(dir, e.Name()), e.Name(), buf); err != nil {
+			return err
+		}
+	}
+	if err = c.writeFrame(frameCheckpointDone); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (l *Leader) sendFile(c *conn, path, name string, buf []byte) error {
+	f, err := l.fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = c.writeFrame(frameFile, []byte(name)); err != nil {
+		return err
+	}
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if err := c.writeFrame(frameData, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sendRecord sends a record of the WAL. A record pointing into the value log is sent along
+// with its value, as the value log of the follower doesn't have it; so is a tombstone keeping
+// a pointer to the value it deleted, or without it once the value log file is gone.
+func (l *Leader) sendRecord(c *conn, cfID uint32, key []byte, val *encoder.EncodedValue) error {
+	var kind encoder.OpKind
+	value := val.Value()
+	switch {
+	case val.IsTombstone():
+		if _, ok := val.ValueLogPointer(); ok {
+			var err error
+			if value, err = l.d.ResolveValue(val); err != nil {
+				value = nil // the deletion can't be undone on the follower
+			}
+		}
+		kind = encoder.OpKindDelete
+	case val.IsRangeTombstone():
+		kind = encoder.OpKindRangeDelete
+	case val.IsValuePointer():
+		var err error
+		if value, err = l.d.ResolveValue(val); err != nil {
+			return err
+		}
+		kind = encoder.OpKindSet
+	case val.IsMerge() || !val.Valid():
+		return fmt.Errorf("replication: record of %q has a malformed value or an unknown op kind", key)
+	default:
+		kind = encoder.OpKindSet
+	}
+	header := binary.AppendUvarint(nil, uint64(cfID))
+	header = binary.AppendUvarint(header, uint64(len(key)))
+	encoded := l.encoder.EncodeTimestamped(kind, val.SeqNum(), val.Timestamp(), value)
+	if err := c.writeFrame(frameRecord, header, key, encoded); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// isNetError reports whether err comes from the connection, e.g. once the follower hung up.
+func isNetError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
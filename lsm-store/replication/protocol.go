@@ -0,0 +1,114 @@
+// Package replication keeps follower DBs up to date with a leader DB by shipping its WAL over
+// TCP. A follower joining with an empty data directory first receives a checkpoint of the
+// leader; from then on, the leader streams every record of its WAL as soon as it is synced,
+// across WAL rotations, and the follower applies them with DB.ApplyWALRecord, keeping their
+// sequence numbers. A follower that reconnects, e.g. after a restart, resumes with the record
+// after the last one it applied, as long as the leader still has the WAL segment holding it.
+//
+// Only the writes recorded in the WAL are replicated: the column families created on the
+// leader after a follower bootstrapped, and the SSTables ingested with IngestExternalFile,
+// don't reach it. A follower is only meant to be read, writes of its own would break the order
+// of the sequence numbers.
+package replication
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// magic starts the hello a follower sends once connected, naming the protocol version.
+const magic = "lsm-replication 1"
+
+// maxFrameSize bounds the payload of a frame, so that a garbled length doesn't make the reader
+// allocate unbounded memory.
+const maxFrameSize = 1 << 30
+
+// the bytes of a checkpoint file are sent in frames of up to fileChunkSize bytes
+const fileChunkSize = 64 << 10
+
+var (
+	ErrClosed = errors.New("replication: closed")
+	// ErrTooFarBehind is returned by a follower whose next record is no longer in any WAL
+	// segment of the leader. It has to be bootstrapped again, from an empty data directory.
+	ErrTooFarBehind = errors.New("replication: follower too far behind the leader")
+	errProtocol     = errors.New("replication: protocol error")
+)
+
+// A frame is a type (1B)|payload length (uvarint)|payload.
+type frameType uint8
+
+const (
+	frameHello          frameType = iota + 1 // magic|bootstrap (1B)|last applied seqNum (uvarint)
+	frameFile                                // name of a checkpoint file, its bytes follow in frameData
+	frameData                                // bytes of the checkpoint file named last
+	frameCheckpointDone                      // every checkpoint file has been sent
+	frameRecord                              // cfID (uvarint)|key length (uvarint)|key|encoded value
+	frameTooFarBehind                        // the records the follower needs next are gone
+	frameError                               // the leader can't go on, the payload tells why
+)
+
+// conn frames the messages exchanged by a leader and a follower.
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func newConn(c net.Conn) *conn {
+	return &conn{Conn: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}
+}
+
+// writeFrame buffers a frame, whose payload is the concatenation of parts.
+func (c *conn) writeFrame(t frameType, parts ...[]byte) error {
+	n := 0
+	for _, p := range parts {
+		n += len(p)
+	}
+	var header [1 + binary.MaxVarintLen64]byte
+	header[0] = byte(t)
+	m := binary.PutUvarint(header[1:], uint64(n))
+	if _, err := c.w.Write(header[:1+m]); err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if _, err := c.w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFrame reads the next frame. The payload is only valid until the next call.
+func (c *conn) readFrame(buf []byte) (frameType, []byte, error) {
+	t, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	if n > maxFrameSize {
+		return 0, nil, fmt.Errorf("%w: frame of %d bytes", errProtocol, n)
+	}
+	if uint64(cap(buf)) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	if _, err = io.ReadFull(c.r, buf); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	return frameType(t), buf, nil
+}
+
+// unexpectedEOF turns io.EOF in the middle of a frame into io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
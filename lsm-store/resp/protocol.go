@@ -0,0 +1,186 @@
+// Package resp serves a DB over RESP, the protocol of Redis, so that redis-cli, redis-benchmark
+// and the Redis client libraries can talk to it. The commands are the few a key-value store
+// without data types can answer: GET, SET, DEL, EXISTS, SCAN and TTL, plus PING, ECHO and the
+// handful of housekeeping commands clients send on connecting.
+//
+// The DB has no expiry, so TTL answers -1 for every existing key and SET refuses EX and PX.
+// SCAN walks the keys in order; its cursors are only valid on the connection they were
+// returned on.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	// maxBulkLen bounds the length of a bulk string, like proto-max-bulk-len in Redis, so that
+	// a garbled length doesn't make the reader allocate unbounded memory.
+	maxBulkLen = 512 << 20
+	// maxArgs bounds the number of arguments of a command.
+	maxArgs = 1 << 20
+	// maxInlineLen bounds the length of an inline command.
+	maxInlineLen = 64 << 10
+)
+
+var (
+	ErrClosed   = errors.New("resp: closed")
+	errProtocol = errors.New("resp: protocol error")
+)
+
+// readCommand reads a command: an array of bulk strings, as clients send them, or an inline
+// command, a line of space-separated words, as typed in telnet. An empty inline command is
+// returned as no arguments.
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != '*' {
+		line, err := readLine(r, maxInlineLen)
+		if err != nil {
+			return nil, err
+		}
+		return splitWords(line), nil
+	}
+	line, err := readLine(r, 32)
+	if err != nil {
+		return nil, err
+	}
+	n, err := parseLen(line[1:], maxArgs)
+	if err != nil {
+		return nil, err
+	}
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r, 32)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got %q", errProtocol, line)
+		}
+		m, err := parseLen(line[1:], maxBulkLen)
+		if err != nil {
+			return nil, err
+		}
+		arg := make([]byte, m+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		if arg[m] != '\r' || arg[m+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", errProtocol)
+		}
+		args = append(args, arg[:m])
+	}
+	return args, nil
+}
+
+// readLine reads a line terminated by CRLF, or by LF alone, returned without it.
+func readLine(r *bufio.Reader, maxLen int) ([]byte, error) {
+	var line []byte
+	for {
+		frag, err := r.ReadSlice('\n')
+		line = append(line, frag...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		if len(line) > maxLen {
+			return nil, fmt.Errorf("%w: line too long", errProtocol)
+		}
+	}
+	if len(line) > maxLen+2 {
+		return nil, fmt.Errorf("%w: line too long", errProtocol)
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+func parseLen(b []byte, maxLen int) (int, error) {
+	n, err := strconv.Atoi(string(b))
+	if err != nil || n < 0 || n > maxLen {
+		return 0, fmt.Errorf("%w: invalid length %q", errProtocol, b)
+	}
+	return n, nil
+}
+
+// splitWords splits an inline command into words, separated by spaces or tabs. A word may be
+// quoted with double quotes, in which \" and \\ are escapes, to hold spaces.
+func splitWords(line []byte) [][]byte {
+	var words [][]byte
+	for i := 0; i < len(line); {
+		if line[i] == ' ' || line[i] == '\t' {
+			i++
+			continue
+		}
+		var word []byte
+		if line[i] == '"' {
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				word = append(word, line[i])
+			}
+			i++
+		} else {
+			for ; i < len(line) && line[i] != ' ' && line[i] != '\t'; i++ {
+				word = append(word, line[i])
+			}
+		}
+		words = append(words, word)
+	}
+	return words
+}
+
+// writer buffers the replies to a client.
+type writer struct {
+	*bufio.Writer
+}
+
+func (w writer) simple(s string) {
+	w.WriteByte('+')
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+// error writes an error reply. By convention, msg starts with an error code such as ERR.
+func (w writer) error(msg string) {
+	w.WriteByte('-')
+	w.WriteString(msg)
+	w.WriteString("\r\n")
+}
+
+func (w writer) integer(n int64) {
+	w.WriteByte(':')
+	w.WriteString(strconv.FormatInt(n, 10))
+	w.WriteString("\r\n")
+}
+
+func (w writer) bulk(b []byte) {
+	w.WriteByte('$')
+	w.WriteString(strconv.Itoa(len(b)))
+	w.WriteString("\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+// null writes the null bulk string, the reply of GET for a missing key.
+func (w writer) null() {
+	w.WriteString("$-1\r\n")
+}
+
+// array writes the header of an array of n elements, which the caller writes next.
+func (w writer) array(n int) {
+	w.WriteByte('*')
+	w.WriteString(strconv.Itoa(n))
+	w.WriteString("\r\n")
+}
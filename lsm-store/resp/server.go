@@ -0,0 +1,500 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"lsm/db"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// defaultScanCount is the number of keys a SCAN looks at without a COUNT option.
+	defaultScanCount = 10
+	// maxCursors bounds the SCAN cursors kept per connection; the oldest is forgotten first.
+	maxCursors = 1024
+)
+
+// Server serves a DB to the RESP clients connecting to it.
+type Server struct {
+	d *db.DB
+	// ctx is cancelled once the server is closed, which stops the commands being run
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup // of the connections being served
+}
+
+// NewServer returns a server for d. Writes are acknowledged without syncing the WAL, unless
+// Options.WALSync of d syncs every write.
+func NewServer(d *db.DB) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		d:         d,
+		ctx:       ctx,
+		cancel:    cancel,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts the connections of clients on ln, serving each of them in a goroutine of its
+// own, until ln fails or the server is closed, which makes it return ErrClosed.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.listeners[ln] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, ln)
+		s.mu.Unlock()
+	}()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrClosed
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Close()
+			return ErrClosed
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serve(c)
+	}
+}
+
+// Close stops serving: it closes the listeners and the connections, and waits until the
+// commands being run return, which gives up on scans and on writes stalled by the DB.
+// The DB is left open.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.closed = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.cancel()
+	s.wg.Wait()
+	return nil
+}
+
+// session is the state of a connection.
+type session struct {
+	s *Server
+	w writer
+	// cursors holds the key each SCAN cursor resumes at, and cursorIDs the cursors from
+	// oldest to newest
+	cursors    map[uint64][]byte
+	cursorIDs  []uint64
+	nextCursor uint64
+	quit       bool
+}
+
+// serve runs the commands of the client connected on c, one after the other. The replies are
+// flushed once no command is left to read, so that pipelined commands are answered together.
+func (s *Server) serve(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+	}()
+	r := bufio.NewReader(c)
+	ss := &session{s: s, w: writer{bufio.NewWriter(c)}, cursors: make(map[uint64][]byte), nextCursor: 1}
+	for !ss.quit {
+		args, err := readCommand(r)
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				ss.w.error("ERR Protocol error: " + strings.TrimPrefix(err.Error(), errProtocol.Error()+": "))
+				ss.w.Flush()
+			}
+			return
+		}
+		if len(args) > 0 {
+			ss.run(args)
+		}
+		if r.Buffered() == 0 {
+			if err := ss.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+	ss.w.Flush()
+}
+
+// command runs a command in a session, with its arguments but the name.
+type command struct {
+	fn       func(ss *session, args [][]byte)
+	min, max int // numbers of arguments, max -1 for no limit
+}
+
+var commands = map[string]command{
+	"ping":    {(*session).ping, 0, 1},
+	"echo":    {(*session).echo, 1, 1},
+	"quit":    {(*session).quitCmd, 0, 0},
+	"get":     {(*session).get, 1, 1},
+	"set":     {(*session).set, 2, -1},
+	"del":     {(*session).del, 1, -1},
+	"exists":  {(*session).exists, 1, -1},
+	"scan":    {(*session).scan, 1, -1},
+	"ttl":     {(*session).ttl, 1, 1},
+	"pttl":    {(*session).ttl, 1, 1},
+	"select":  {(*session).selectCmd, 1, 1},
+	"command": {(*session).emptyArray, 0, -1},
+	"config":  {(*session).emptyArray, 1, -1},
+	"client":  {(*session).ok, 1, -1},
+}
+
+func (ss *session) run(args [][]byte) {
+	name := strings.ToLower(string(args[0]))
+	cmd, ok := commands[name]
+	if !ok {
+		var quoted []string
+		for _, a := range args[1:] {
+			quoted = append(quoted, fmt.Sprintf("'%s'", a))
+		}
+		ss.w.error(fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", args[0], strings.Join(quoted, " ")))
+		return
+	}
+	if n := len(args) - 1; n < cmd.min || (cmd.max >= 0 && n > cmd.max) {
+		ss.w.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return
+	}
+	cmd.fn(ss, args[1:])
+}
+
+// dbError replies with an error of the DB.
+func (ss *session) dbError(err error) {
+	ss.w.error("ERR " + err.Error())
+}
+
+func (ss *session) ping(args [][]byte) {
+	if len(args) == 0 {
+		ss.w.simple("PONG")
+		return
+	}
+	ss.w.bulk(args[0])
+}
+
+func (ss *session) echo(args [][]byte) {
+	ss.w.bulk(args[0])
+}
+
+func (ss *session) quitCmd([][]byte) {
+	ss.w.simple("OK")
+	ss.quit = true
+}
+
+func (ss *session) ok([][]byte) {
+	ss.w.simple("OK")
+}
+
+func (ss *session) emptyArray([][]byte) {
+	ss.w.array(0)
+}
+
+// selectCmd only selects DB 0, the one DB served.
+func (ss *session) selectCmd(args [][]byte) {
+	if string(args[0]) != "0" {
+		ss.w.error("ERR DB index is out of range")
+		return
+	}
+	ss.w.simple("OK")
+}
+
+func (ss *session) get(args [][]byte) {
+	val, err := ss.s.d.GetContext(ss.s.ctx, args[0])
+	switch {
+	case errors.Is(err, db.ErrKeyNotFound):
+		ss.w.null()
+	case err != nil:
+		ss.dbError(err)
+	default:
+		ss.w.bulk(val)
+	}
+}
+
+// set takes none of the options of SET: those setting an expiry have nothing to map to, and
+// NX, XX and GET would need a read and a write the DB can't make atomic.
+func (ss *session) set(args [][]byte) {
+	if len(args) > 2 {
+		switch strings.ToLower(string(args[2])) {
+		case "ex", "px", "exat", "pxat", "keepttl":
+			ss.w.error("ERR expiry is not supported")
+		default:
+			ss.w.error("ERR syntax error")
+		}
+		return
+	}
+	if err := ss.s.d.SetContext(ss.s.ctx, args[0], args[1], nil); err != nil {
+		ss.dbError(err)
+		return
+	}
+	ss.w.simple("OK")
+}
+
+// del replies with the number of keys that existed.
+func (ss *session) del(args [][]byte) {
+	// a key repeated is only counted once
+	args = slices.Clone(args)
+	slices.SortFunc(args, bytes.Compare)
+	args = slices.CompactFunc(args, bytes.Equal)
+	n, err := ss.count(args)
+	if err != nil {
+		ss.dbError(err)
+		return
+	}
+	for _, key := range args {
+		if err := ss.s.d.DeleteContext(ss.s.ctx, key, nil); err != nil {
+			ss.dbError(err)
+			return
+		}
+	}
+	ss.w.integer(n)
+}
+
+// exists replies with the number of keys that exist, counting a key as many times as it is
+// repeated.
+func (ss *session) exists(args [][]byte) {
+	n, err := ss.count(args)
+	if err != nil {
+		ss.dbError(err)
+		return
+	}
+	ss.w.integer(n)
+}
+
+func (ss *session) count(keys [][]byte) (int64, error) {
+	var n int64
+	for _, key := range keys {
+		_, err := ss.s.d.GetContext(ss.s.ctx, key)
+		if errors.Is(err, db.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// ttl replies -2 for a missing key, -1 for one that exists: keys never expire.
+func (ss *session) ttl(args [][]byte) {
+	n, err := ss.count(args)
+	if err != nil {
+		ss.dbError(err)
+		return
+	}
+	ss.w.integer(n - 2)
+}
+
+// scan looks at COUNT keys from the cursor on, in key order, replying with those matching the
+// MATCH pattern and the cursor to resume at, 0 once every key has been looked at. A key
+// written during the scan may or may not be returned, like in Redis.
+func (ss *session) scan(args [][]byte) {
+	var start []byte
+	if cursor, err := strconv.ParseUint(string(args[0]), 10, 64); err != nil {
+		ss.w.error("ERR invalid cursor")
+		return
+	} else if cursor != 0 {
+		var ok bool
+		if start, ok = ss.cursors[cursor]; !ok {
+			ss.w.error("ERR invalid cursor")
+			return
+		}
+	}
+	var pattern []byte
+	count := defaultScanCount
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			ss.w.error("ERR syntax error")
+			return
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || n < 1 {
+				ss.w.error("ERR syntax error")
+				return
+			}
+			count = n
+		case "type":
+			// every value is a string
+			if !strings.EqualFold(string(args[i+1]), "string") {
+				count = 0
+			}
+		default:
+			ss.w.error("ERR syntax error")
+			return
+		}
+	}
+	it, err := ss.s.d.NewIterContext(ss.s.ctx, &db.IterOptions{LowerBound: start})
+	if err != nil {
+		ss.dbError(err)
+		return
+	}
+	defer it.Close()
+	var keys [][]byte
+	it.First()
+	for i := 0; i < count && it.Valid(); i++ {
+		if pattern == nil || matchGlob(pattern, it.Key()) {
+			keys = append(keys, it.Key())
+		}
+		it.Next()
+	}
+	if err := it.Error(); err != nil {
+		ss.dbError(err)
+		return
+	}
+	var next uint64
+	if it.Valid() && count > 0 {
+		next = ss.saveCursor(slices.Clone(it.Key()))
+	}
+	ss.w.array(2)
+	ss.w.bulk(strconv.AppendUint(nil, next, 10))
+	ss.w.array(len(keys))
+	for _, key := range keys {
+		ss.w.bulk(key)
+	}
+}
+
+// saveCursor returns a new cursor resuming at key.
+func (ss *session) saveCursor(key []byte) uint64 {
+	if len(ss.cursorIDs) == maxCursors {
+		delete(ss.cursors, ss.cursorIDs[0])
+		ss.cursorIDs = ss.cursorIDs[1:]
+	}
+	id := ss.nextCursor
+	ss.nextCursor++
+	ss.cursors[id] = key
+	ss.cursorIDs = append(ss.cursorIDs, id)
+	return id
+}
+
+// matchGlob reports whether s matches the glob-style pattern of Redis: * matches any run of
+// bytes, ? any byte, [abc], [^abc] and [a-z] a byte in, or not in, a set, and \ escapes the
+// byte after it.
+func matchGlob(pattern, s []byte) bool {
+	// on a mismatch, go back to the last *, which absorbs one more byte
+	starP, starS := -1, 0
+	p, i := 0, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch c := pattern[p]; c {
+			case '*':
+				starP, starS = p, i
+				p++
+				continue
+			case '?':
+				p++
+				i++
+				continue
+			case '[':
+				if end, ok := matchClass(pattern[p+1:], s[i]); end >= 0 {
+					if ok {
+						p += 2 + end
+						i++
+						continue
+					}
+				} else if s[i] == '[' {
+					p++
+					i++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) {
+					c = pattern[p+1]
+					if s[i] == c {
+						p += 2
+						i++
+						continue
+					}
+					break
+				}
+				fallthrough
+			default:
+				if s[i] == c {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+		if starP < 0 {
+			return false
+		}
+		starS++
+		p, i = starP+1, starS
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass matches c against the set of the bracket expression class starts, after its '['.
+// It returns the index of the closing ']' in class, -1 if there is none, and whether c is in
+// the set.
+func matchClass(class []byte, c byte) (int, bool) {
+	negate := len(class) > 0 && class[0] == '^'
+	j := 0
+	if negate {
+		j++
+	}
+	in := false
+	for ; j < len(class) && class[j] != ']'; j++ {
+		switch {
+		case class[j] == '\\' && j+1 < len(class):
+			j++
+			in = in || class[j] == c
+		case j+2 < len(class) && class[j+1] == '-' && class[j+2] != ']':
+			lo, hi := class[j], class[j+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			in = in || (lo <= c && c <= hi)
+			j += 2
+		default:
+			in = in || class[j] == c
+		}
+	}
+	if j == len(class) {
+		return -1, false
+	}
+	return j, in != negate
+}
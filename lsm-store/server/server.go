@@ -0,0 +1,154 @@
+// Package server serves a DB over gRPC, implementing the LSM service of lsmpb/lsm.proto.
+package server
+
+import (
+	"context"
+	"errors"
+	"lsm/db"
+	"lsm/lsmpb"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Server implements lsmpb.LSMServer on top of a DB.
+type Server struct {
+	lsmpb.UnimplementedLSMServer
+	d *db.DB
+}
+
+// New returns a server for d, which the caller still closes, once the gRPC server is stopped.
+func New(d *db.DB) *Server {
+	return &Server{d: d}
+}
+
+// Register registers the LSM service with g.
+func (s *Server) Register(g *grpc.Server) {
+	lsmpb.RegisterLSMServer(g, s)
+}
+
+func (s *Server) Get(ctx context.Context, req *lsmpb.GetRequest) (*lsmpb.GetResponse, error) {
+	val, err := s.d.GetContext(ctx, req.Key)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &lsmpb.GetResponse{Value: val}, nil
+}
+
+func (s *Server) Set(ctx context.Context, req *lsmpb.SetRequest) (*lsmpb.SetResponse, error) {
+	if err := s.d.SetContext(ctx, req.Key, req.Value, writeOptions(req.Sync)); err != nil {
+		return nil, toStatus(err)
+	}
+	return &lsmpb.SetResponse{}, nil
+}
+
+func (s *Server) Delete(ctx context.Context, req *lsmpb.DeleteRequest) (*lsmpb.DeleteResponse, error) {
+	if err := s.d.DeleteContext(ctx, req.Key, writeOptions(req.Sync)); err != nil {
+		return nil, toStatus(err)
+	}
+	return &lsmpb.DeleteResponse{}, nil
+}
+
+// Scan streams the kv-pairs of the range, stopping early if the deadline of the request passes
+// or the client goes away.
+func (s *Server) Scan(req *lsmpb.ScanRequest, stream grpc.ServerStreamingServer[lsmpb.KeyValue]) error {
+	ctx := stream.Context()
+	it, err := s.d.NewIterContext(ctx, &db.IterOptions{LowerBound: openBound(req.Start), UpperBound: openBound(req.End)})
+	if err != nil {
+		return toStatus(err)
+	}
+	defer it.Close()
+	sent := uint32(0)
+	// the iterator stops with the error of ctx once it is done
+	for it.First(); it.Valid() && (req.Limit == 0 || sent < req.Limit); it.Next() {
+		if err := stream.Send(&lsmpb.KeyValue{Key: it.Key(), Value: it.Value()}); err != nil {
+			return err
+		}
+		sent++
+	}
+	return toStatus(it.Error())
+}
+
+// Batch applies the writes one after the other. Only the last one is synced, if req.Sync is
+// set, which syncs those before it in the WAL too.
+func (s *Server) Batch(ctx context.Context, req *lsmpb.BatchRequest) (*lsmpb.BatchResponse, error) {
+	for i, w := range req.Writes {
+		if err := ctx.Err(); err != nil {
+			return nil, toStatus(err)
+		}
+		opts := writeOptions(req.Sync && i == len(req.Writes)-1)
+		var err error
+		switch op := w.Op.(type) {
+		case *lsmpb.Write_Set:
+			err = s.d.SetContext(ctx, op.Set.Key, op.Set.Value, opts)
+		case *lsmpb.Write_Delete:
+			err = s.d.DeleteContext(ctx, op.Delete.Key, opts)
+		case *lsmpb.Write_DeleteRange:
+			err = s.d.DeleteRange(op.DeleteRange.Start, op.DeleteRange.End, opts)
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "write %d: no op", i)
+		}
+		if err != nil {
+			return nil, toStatus(err)
+		}
+	}
+	return &lsmpb.BatchResponse{}, nil
+}
+
+func writeOptions(sync bool) *db.WriteOptions {
+	if sync {
+		return db.Sync
+	}
+	return db.NoSync
+}
+
+// openBound returns nil for an empty bound, which leaves that side of the range open.
+func openBound(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return b
+}
+
+// toStatus maps the errors of the DB to status codes. A nil err stays nil.
+func toStatus(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, db.ErrKeyNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, db.ErrClosed):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// DefaultTimeout returns the server options giving the requests that come without a deadline,
+// or with a later one, a deadline of timeout.
+func DefaultTimeout(timeout time.Duration) []grpc.ServerOption {
+	unary := func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return handler(ctx, req)
+	}
+	stream := func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, cancel := context.WithTimeout(ss.Context(), timeout)
+		defer cancel()
+		return handler(srv, &timeoutStream{ServerStream: ss, ctx: ctx})
+	}
+	return []grpc.ServerOption{grpc.UnaryInterceptor(unary), grpc.StreamInterceptor(stream)}
+}
+
+// timeoutStream is a server stream with the context of DefaultTimeout.
+type timeoutStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *timeoutStream) Context() context.Context {
+	return s.ctx
+}
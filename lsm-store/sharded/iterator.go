@@ -0,0 +1,138 @@
+package sharded
+
+import (
+	"container/heap"
+	"errors"
+	"lsm/comparer"
+	"lsm/db"
+)
+
+// Iterator walks the live kv-pairs of every shard in key order, merging the iterators of the
+// shards. As a key lives in a single shard, no two of them yield the same key. Each shard is
+// seen as of the creation of its iterator, which isn't the same instant for all of them.
+//
+// Like a db.Iterator, it isn't positioned when created: call First or Seek first.
+type Iterator struct {
+	iters []*db.Iterator
+	heap  iterHeap // of the iterators positioned at a key, smallest key on top
+	err   error
+}
+
+// NewIter returns an iterator over the keys of every shard. A nil opts iterates over all keys.
+// It must be closed before a shard is removed.
+func (d *DB) NewIter(opts *db.IterOptions) (*Iterator, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	it := &Iterator{heap: iterHeap{cmp: d.cmp}}
+	for _, s := range d.shards {
+		if s == nil {
+			continue
+		}
+		si, err := s.NewIter(opts)
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		it.iters = append(it.iters, si)
+	}
+	return it, nil
+}
+
+// Scan returns an iterator over the keys in [start, end) of every shard, positioned at the
+// first of them. A nil bound leaves that side of the range open.
+func (d *DB) Scan(start, end []byte) (*Iterator, error) {
+	it, err := d.NewIter(&db.IterOptions{LowerBound: start, UpperBound: end})
+	if err != nil {
+		return nil, err
+	}
+	it.First()
+	return it, nil
+}
+
+// First positions the iterator at the smallest live key.
+func (i *Iterator) First() bool {
+	return i.position((*db.Iterator).First)
+}
+
+// Seek positions the iterator at the smallest live key >= key.
+func (i *Iterator) Seek(key []byte) bool {
+	return i.position(func(si *db.Iterator) bool { return si.Seek(key) })
+}
+
+// position positions every shard iterator with fn and rebuilds the heap.
+func (i *Iterator) position(fn func(*db.Iterator) bool) bool {
+	i.heap.iters = i.heap.iters[:0]
+	i.err = nil
+	for _, si := range i.iters {
+		if fn(si) {
+			i.heap.iters = append(i.heap.iters, si)
+		} else if err := si.Error(); err != nil {
+			i.err = err
+		}
+	}
+	heap.Init(&i.heap)
+	return i.Valid()
+}
+
+// Next advances the iterator to the next live key.
+func (i *Iterator) Next() bool {
+	if !i.Valid() {
+		return false
+	}
+	top := i.heap.iters[0]
+	if top.Next() {
+		heap.Fix(&i.heap, 0)
+	} else {
+		if err := top.Error(); err != nil {
+			i.err = err
+		}
+		heap.Pop(&i.heap)
+	}
+	return i.Valid()
+}
+
+// Valid reports whether the iterator is positioned at a live key. It isn't once a shard failed.
+func (i *Iterator) Valid() bool {
+	return i.err == nil && len(i.heap.iters) > 0
+}
+
+// Key returns the key at the current position.
+func (i *Iterator) Key() []byte {
+	return i.heap.iters[0].Key()
+}
+
+// Value returns the value at the current position.
+func (i *Iterator) Value() []byte {
+	return i.heap.iters[0].Value()
+}
+
+// Error returns the error, if any, that stopped the iteration.
+func (i *Iterator) Error() error {
+	return i.err
+}
+
+// Close closes the iterators of the shards.
+func (i *Iterator) Close() error {
+	var errs []error
+	for _, si := range i.iters {
+		errs = append(errs, si.Close())
+	}
+	i.iters, i.heap.iters = nil, nil
+	return errors.Join(errs...)
+}
+
+// iterHeap orders the shard iterators by their current key.
+type iterHeap struct {
+	iters []*db.Iterator
+	cmp   comparer.Compare
+}
+
+func (h *iterHeap) Len() int           { return len(h.iters) }
+func (h *iterHeap) Less(a, b int) bool { return h.cmp(h.iters[a].Key(), h.iters[b].Key()) < 0 }
+func (h *iterHeap) Swap(a, b int)      { h.iters[a], h.iters[b] = h.iters[b], h.iters[a] }
+func (h *iterHeap) Push(x any)         { h.iters = append(h.iters, x.(*db.Iterator)) }
+func (h *iterHeap) Pop() any {
+	last := h.iters[len(h.iters)-1]
+	h.iters = h.iters[:len(h.iters)-1]
+	return last
+}
@@ -0,0 +1,295 @@
+package sharded
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"lsm/db"
+	"lsm/hashring"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// ringFileName is the file in the directory of a DB opened with OpenRing recording its layout.
+const ringFileName = "RING"
+
+// ErrLastShard is returned by RemoveShard for the only shard left.
+var ErrLastShard = errors.New("sharded: can't remove the last shard")
+
+// layout is the content of the RING file: the shards on the ring, and whether keys may have to
+// move between them, AddShard or RemoveShard having been interrupted.
+type layout struct {
+	vnodes      int
+	shards      []int // on the ring
+	draining    []int // off the ring, but keys yet to move out of them
+	rebalancing bool
+}
+
+// OpenRing opens the sharded DB in dir, routing keys with a consistent-hash ring placing every
+// shard at vnodes points (hashring.DefaultVirtualNodes if 0). The DB is created with n shards
+// if it doesn't exist; otherwise n and vnodes are ignored, and the shards are those the DB was
+// left with. A rebalance interrupted by a crash is resumed before OpenRing returns.
+func OpenRing(dir string, n, vnodes int, opts *db.Options) (*DB, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("sharded: %d shards", n)
+	}
+	if vnodes <= 0 {
+		vnodes = hashring.DefaultVirtualNodes
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, shardsFileName)); err == nil {
+		return nil, fmt.Errorf("%w: hashing modulo the number of shards, open it with Open", ErrRoutingMismatch)
+	}
+	l, err := readLayout(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		l = &layout{vnodes: vnodes}
+		for i := 0; i < n; i++ {
+			l.shards = append(l.shards, i)
+		}
+		err = writeLayout(dir, l)
+	}
+	if err != nil {
+		return nil, err
+	}
+	d := newDB(dir, opts)
+	d.layout = l
+	d.ring = hashring.New(l.vnodes)
+	d.nodes = make(map[string]int)
+	if err = d.openShards(append(slices.Clone(l.shards), l.draining...)); err != nil {
+		return nil, err
+	}
+	for _, num := range l.shards {
+		d.addToRing(num)
+	}
+	if l.rebalancing {
+		if err = d.rebalance(); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func readLayout(dir string) (*layout, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, ringFileName))
+	if err != nil {
+		return nil, err
+	}
+	corrupt := fmt.Errorf("sharded: corrupt %s file", ringFileName)
+	next := func() (int, bool) {
+		v, m := binary.Uvarint(buf)
+		if m <= 0 {
+			return 0, false
+		}
+		buf = buf[m:]
+		return int(v), true
+	}
+	nums := func() ([]int, bool) {
+		count, ok := next()
+		if !ok || count > len(buf) {
+			return nil, false
+		}
+		nums := make([]int, count)
+		for i := range nums {
+			if nums[i], ok = next(); !ok {
+				return nil, false
+			}
+		}
+		return nums, true
+	}
+	l := &layout{}
+	var flag int
+	var ok bool
+	if l.vnodes, ok = next(); !ok || l.vnodes == 0 {
+		return nil, corrupt
+	}
+	if flag, ok = next(); !ok {
+		return nil, corrupt
+	}
+	l.rebalancing = flag != 0
+	if l.shards, ok = nums(); !ok || len(l.shards) == 0 {
+		return nil, corrupt
+	}
+	if l.draining, ok = nums(); !ok {
+		return nil, corrupt
+	}
+	return l, nil
+}
+
+// writeLayout records l: vnodes, rebalancing, shards and draining, as uvarints, each list
+// preceded by its length.
+func writeLayout(dir string, l *layout) error {
+	buf := binary.AppendUvarint(nil, uint64(l.vnodes))
+	var flag uint64
+	if l.rebalancing {
+		flag = 1
+	}
+	buf = binary.AppendUvarint(buf, flag)
+	for _, nums := range [][]int{l.shards, l.draining} {
+		buf = binary.AppendUvarint(buf, uint64(len(nums)))
+		for _, num := range nums {
+			buf = binary.AppendUvarint(buf, uint64(num))
+		}
+	}
+	return writeFileAtomic(filepath.Join(dir, ringFileName), buf)
+}
+
+func (d *DB) addToRing(num int) {
+	name := shardName(num)
+	d.nodes[name] = num
+	d.ring.Add(name)
+}
+
+// shardNum returns the number of the shard node names on the ring.
+func (d *DB) shardNum(node string) int {
+	return d.nodes[node]
+}
+
+// AddShard adds a shard to a DB opened with OpenRing, returning its number, and moves to it
+// the keys it now owns, about 1/N of them. Other operations wait until it returns.
+func (d *DB) AddShard() (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ring == nil {
+		return 0, fmt.Errorf("%w: shards can only be added to a DB opened with OpenRing", ErrRoutingMismatch)
+	}
+	num := len(d.shards)
+	// recorded first, so that a crash is followed by a rebalance, whatever the shard holds
+	l := *d.layout
+	l.shards = append(slices.Clone(l.shards), num)
+	l.rebalancing = true
+	if err := writeLayout(d.dir, &l); err != nil {
+		return 0, err
+	}
+	d.layout = &l
+	if err := d.openShards([]int{num}); err != nil {
+		return 0, err
+	}
+	d.addToRing(num)
+	return num, d.rebalance()
+}
+
+// RemoveShard moves the keys of the shard num of a DB opened with OpenRing to the other shards,
+// then deletes it. Other operations wait until it returns. Iterators over the DB must be closed
+// first.
+func (d *DB) RemoveShard(num int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ring == nil {
+		return fmt.Errorf("%w: shards can only be removed from a DB opened with OpenRing", ErrRoutingMismatch)
+	}
+	if !slices.Contains(d.layout.shards, num) {
+		return fmt.Errorf("sharded: no shard %d", num)
+	}
+	if len(d.layout.shards) == 1 {
+		return ErrLastShard
+	}
+	l := *d.layout
+	l.shards = slices.DeleteFunc(slices.Clone(l.shards), func(n int) bool { return n == num })
+	l.draining = append(slices.Clone(l.draining), num)
+	l.rebalancing = true
+	if err := writeLayout(d.dir, &l); err != nil {
+		return err
+	}
+	d.layout = &l
+	name := shardName(num)
+	d.ring.Remove(name)
+	delete(d.nodes, name)
+	return d.rebalance()
+}
+
+// rebalance moves every key to the shard the ring routes it to, then deletes the draining
+// shards and records that the layout is settled. It is idempotent, so that one interrupted by
+// a crash can be run again. Must be called with d.mu held for writing.
+//
+// A key is first written to its new shard, then deleted from its old one. The last write to
+// every shard is synced, syncing the writes before it in that shard's WAL, and the copies
+// are all synced before any of the deletes: a crash never loses a key, and may at worst leave
+// keys in both shards until the rebalance is resumed.
+func (d *DB) rebalance() error {
+	pending := make(map[int][2][]byte) // by destination, the last write not yet made
+	for num, s := range d.shards {
+		if s == nil {
+			continue
+		}
+		err := d.movedKeys(num, s, func(dst int, key, val []byte) error {
+			prev, ok := pending[dst]
+			pending[dst] = [2][]byte{slices.Clone(key), slices.Clone(val)}
+			if !ok {
+				return nil
+			}
+			return d.shards[dst].Set(prev[0], prev[1], db.NoSync)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for dst, kv := range pending {
+		if err := d.shards[dst].Set(kv[0], kv[1], db.Sync); err != nil {
+			return err
+		}
+	}
+	err := d.forEach(func(num int, s *db.DB) error {
+		var last []byte
+		err := d.movedKeys(num, s, func(_ int, key, _ []byte) error {
+			// the memtable keeps the key passed to a write, last can't be reused
+			prev := last
+			last = slices.Clone(key)
+			if prev == nil {
+				return nil
+			}
+			return s.Delete(prev, db.NoSync)
+		})
+		if err != nil || last == nil {
+			return err
+		}
+		return s.Delete(last, db.Sync)
+	})
+	if err != nil {
+		return err
+	}
+	for _, num := range d.layout.draining {
+		if err = d.shards[num].Close(); err != nil {
+			return err
+		}
+		d.shards[num] = nil
+		if err = os.RemoveAll(shardDir(d.dir, num)); err != nil {
+			return err
+		}
+	}
+	for len(d.shards) > 0 && d.shards[len(d.shards)-1] == nil {
+		d.shards = d.shards[:len(d.shards)-1]
+	}
+	l := *d.layout
+	l.draining, l.rebalancing = nil, false
+	if err = writeLayout(d.dir, &l); err != nil {
+		return err
+	}
+	d.layout = &l
+	return nil
+}
+
+// movedKeys calls fn for every key of the shard num that the ring routes to another shard.
+func (d *DB) movedKeys(num int, s *db.DB, fn func(dst int, key, val []byte) error) error {
+	it, err := s.NewIter(nil)
+	if err != nil {
+		return err
+	}
+	for it.First(); it.Valid(); it.Next() {
+		if dst := d.route(it.Key()); dst != num {
+			if err = fn(dst, it.Key(), it.Value()); err != nil {
+				it.Close()
+				return err
+			}
+		}
+	}
+	if err = it.Error(); err != nil {
+		it.Close()
+		return err
+	}
+	return it.Close()
+}
@@ -0,0 +1,270 @@
+// Package sharded partitions the keyspace across independent DBs, the shards, each with a data
+// directory, WAL, memtables and compactions of its own, routing every key to a shard by its
+// hash. A single DB serializes its writes; writes to different shards go on in parallel, so
+// a sharded DB scales with the cores writing to it.
+//
+// A DB opened with Open routes a key to the shard its hash modulo the number of shards
+// designates, which can't change. One opened with OpenRing routes keys with a consistent-hash
+// ring (see package hashring), so that shards can be added and removed, moving only the keys
+// that change shards.
+//
+// Writes to several shards, such as DeleteRange, aren't atomic: a crash may leave some of the
+// shards written and others not.
+package sharded
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"lsm/comparer"
+	"lsm/db"
+	"lsm/hashring"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// shardsFileName is the file in the directory of a sharded DB recording its number of shards,
+// which can't change, as the keys would be routed to other shards.
+const shardsFileName = "SHARDS"
+
+var (
+	// ErrShardCountMismatch is returned by Open for a number of shards other than the one the
+	// DB was created with.
+	ErrShardCountMismatch = errors.New("sharded: number of shards differs from the one the DB was created with")
+	// ErrRoutingMismatch is returned by Open for a DB created by OpenRing, and the other way
+	// around.
+	ErrRoutingMismatch = errors.New("sharded: DB created with another routing")
+)
+
+// DB is a sharded DB.
+type DB struct {
+	dir  string
+	opts *db.Options
+	cmp  comparer.Compare
+	// mu is held for writing while shards are added or removed, and for reading by every
+	// other operation
+	mu     sync.RWMutex
+	shards []*db.DB // by shard number, nil for the shards removed
+	// for a DB opened with OpenRing, the ring of the shards, their numbers by name on it and
+	// the layout recorded in the RING file; a nil ring routes keys by hash modulo the number
+	// of shards
+	ring   *hashring.Ring
+	nodes  map[string]int
+	layout *layout
+}
+
+// Open opens the sharded DB in dir, creating it with n shards if it doesn't exist. Each shard
+// is a DB in the subdirectory shard-NNN of dir, opened with opts. The shards are opened in
+// parallel, each replaying its own WAL.
+func Open(dir string, n int, opts *db.Options) (*DB, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("sharded: %d shards", n)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, ringFileName)); err == nil {
+		return nil, fmt.Errorf("%w: a hash ring, open it with OpenRing", ErrRoutingMismatch)
+	}
+	if err := checkShardCount(dir, n); err != nil {
+		return nil, err
+	}
+	d := newDB(dir, opts)
+	nums := make([]int, n)
+	for i := range nums {
+		nums[i] = i
+	}
+	if err := d.openShards(nums); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func newDB(dir string, opts *db.Options) *DB {
+	d := &DB{dir: dir, opts: opts, cmp: comparer.Default.Compare}
+	if opts != nil && opts.Comparer != nil {
+		d.cmp = opts.Comparer.Compare
+	}
+	return d
+}
+
+// openShards opens the shards nums, in parallel. If one fails, those opened are closed.
+func (d *DB) openShards(nums []int) error {
+	shards := make([]*db.DB, len(nums))
+	errs := make([]error, len(nums))
+	var wg sync.WaitGroup
+	for i, num := range nums {
+		wg.Add(1)
+		go func(i, num int) {
+			defer wg.Done()
+			shards[i], errs[i] = db.Open(shardDir(d.dir, num), d.opts)
+		}(i, num)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		for _, s := range shards {
+			if s != nil {
+				s.Close()
+			}
+		}
+		return err
+	}
+	for i, num := range nums {
+		if num >= len(d.shards) {
+			d.shards = append(d.shards, make([]*db.DB, num+1-len(d.shards))...)
+		}
+		d.shards[num] = shards[i]
+	}
+	return nil
+}
+
+func shardDir(dir string, num int) string {
+	return filepath.Join(dir, shardName(num))
+}
+
+func shardName(num int) string {
+	return fmt.Sprintf("shard-%03d", num)
+}
+
+// checkShardCount records the number of shards of a new DB, and makes sure it is the one of
+// an existing DB.
+func checkShardCount(dir string, n int) error {
+	path := filepath.Join(dir, shardsFileName)
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return writeFileAtomic(path, binary.AppendUvarint(nil, uint64(n)))
+	}
+	if err != nil {
+		return err
+	}
+	if count, m := binary.Uvarint(buf); m <= 0 || count != uint64(n) {
+		return fmt.Errorf("%w: %d rather than %d", ErrShardCountMismatch, n, count)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with data, through a synced temporary file.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	return err
+}
+
+// forEach calls fn for every shard in parallel, returning the errors joined.
+func (d *DB) forEach(fn func(num int, shard *db.DB) error) error {
+	errs := make([]error, len(d.shards))
+	var wg sync.WaitGroup
+	for num, s := range d.shards {
+		if s == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(num int, s *db.DB) {
+			defer wg.Done()
+			errs[num] = fn(num, s)
+		}(num, s)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Close closes every shard.
+func (d *DB) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.forEach(func(_ int, s *db.DB) error {
+		return s.Close()
+	})
+}
+
+// NumShards returns the number of shards.
+func (d *DB) NumShards() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	n := 0
+	for _, s := range d.shards {
+		if s != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Shard returns the shard num, e.g. to read its metrics, nil if there is no such shard.
+func (d *DB) Shard(num int) *db.DB {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if num < 0 || num >= len(d.shards) {
+		return nil
+	}
+	return d.shards[num]
+}
+
+// ShardFor returns the number of the shard key is routed to.
+func (d *DB) ShardFor(key []byte) int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.route(key)
+}
+
+// route returns the number of the shard key is routed to. Must be called with d.mu held.
+func (d *DB) route(key []byte) int {
+	if d.ring != nil {
+		node, _ := d.ring.Get(key)
+		return d.shardNum(node)
+	}
+	h := fnv.New64a()
+	h.Write(key)
+	return int(h.Sum64() % uint64(len(d.shards)))
+}
+
+func (d *DB) Set(key, val []byte, opts *db.WriteOptions) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.shards[d.route(key)].Set(key, val, opts)
+}
+
+func (d *DB) Get(key []byte) ([]byte, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.shards[d.route(key)].Get(key)
+}
+
+func (d *DB) Delete(key []byte, opts *db.WriteOptions) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.shards[d.route(key)].Delete(key, opts)
+}
+
+// DeleteRange deletes the keys in [start, end), which may be in any shard: the range deletion
+// is written to every shard, in parallel.
+func (d *DB) DeleteRange(start, end []byte, opts *db.WriteOptions) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.forEach(func(_ int, s *db.DB) error {
+		return s.DeleteRange(start, end, opts)
+	})
+}
+
+// CompactRange compacts the keys in [start, end) in every shard, in parallel.
+func (d *DB) CompactRange(start, end []byte) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.forEach(func(_ int, s *db.DB) error {
+		return s.CompactRange(start, end)
+	})
+}
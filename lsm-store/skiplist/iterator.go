@@ -1,22 +1,108 @@
 package skiplist
 
 type Iterator struct {
+	sl      *SkipList
 	current *node
+	// lower and upper bound the keys returned to [lower, upper), if not nil
+	lower, upper []byte
 }
 
 func (sl *SkipList) Iterator() *Iterator {
-	return &Iterator{sl.head}
+	return &Iterator{sl: sl, current: sl.head}
+}
+
+// BoundedIterator returns an iterator over the keys in [lower, upper), positioned right
+// before the first of them. A nil bound leaves that side of the range open. Seeks out of the
+// range are clamped to it, so that a bounded scan doesn't walk the keys outside of it.
+func (sl *SkipList) BoundedIterator(lower, upper []byte) *Iterator {
+	i := &Iterator{sl: sl, lower: lower, upper: upper}
+	i.SeekToFirst()
+	return i
 }
 
 func (i *Iterator) HasNext() bool {
-	return i.current.tower[0] != nil
+	next := i.current.tower[0]
+	return next != nil && i.belowUpper(next.key)
 }
 
+// Next moves the iterator to the following key and returns it, or nil if there is none
+// within the bounds, in which case the iterator doesn't move.
 func (i *Iterator) Next() ([]byte, []byte) {
+	if !i.HasNext() {
+		return nil, nil
+	}
 	i.current = i.current.tower[0]
+	return i.current.key, i.current.val
+}
 
-	if i.current == nil {
+// SeekToFirst positions the iterator right before the smallest key (>= the lower bound),
+// so that the following call to Next returns it.
+func (i *Iterator) SeekToFirst() {
+	if i.lower != nil {
+		i.SeekGE(i.lower)
+		return
+	}
+	i.current = i.sl.head
+}
+
+// SeekGE positions the iterator right before the smallest key >= key,
+// so that the following call to Next returns it.
+func (i *Iterator) SeekGE(key []byte) {
+	if i.lower != nil && i.sl.cmp(key, i.lower) < 0 {
+		key = i.lower
+	}
+	_, journey := i.sl.search(key)
+	// journey[0] is the largest node with a key < key on the lowest level (or the head)
+	i.current = journey[0]
+}
+
+// SeekLT moves the iterator to the largest key < key and returns it,
+// or nil if there is none within the bounds.
+func (i *Iterator) SeekLT(key []byte) ([]byte, []byte) {
+	if i.upper != nil && i.sl.cmp(key, i.upper) > 0 {
+		key = i.upper
+	}
+	_, journey := i.sl.search(key)
+	i.current = journey[0]
+	return i.currentKV()
+}
+
+// Last moves the iterator to the largest key and returns it, or nil if there is none
+// within the bounds.
+func (i *Iterator) Last() ([]byte, []byte) {
+	if i.upper != nil {
+		return i.SeekLT(i.upper)
+	}
+	n := i.sl.head
+	// top to bottom level, follow each level to its end
+	for level := i.sl.height - 1; level >= 0; level-- {
+		for n.tower[level] != nil {
+			n = n.tower[level]
+		}
+	}
+	i.current = n
+	return i.currentKV()
+}
+
+// Prev moves the iterator to the key preceding the one last returned and returns it,
+// or nil if there is none. Nodes only link forward, so this takes a search from the head.
+func (i *Iterator) Prev() ([]byte, []byte) {
+	if i.current == i.sl.head || (i.lower != nil && i.sl.cmp(i.current.key, i.lower) < 0) {
+		return nil, nil
+	}
+	return i.SeekLT(i.current.key)
+}
+
+// currentKV returns the kv-pair the iterator is on, or nil if it is before the first one
+// within the bounds, in which case Next starts over from the lower bound.
+func (i *Iterator) currentKV() ([]byte, []byte) {
+	if i.current == i.sl.head || (i.lower != nil && i.sl.cmp(i.current.key, i.lower) < 0) {
+		i.SeekToFirst()
 		return nil, nil
 	}
 	return i.current.key, i.current.val
 }
+
+func (i *Iterator) belowUpper(key []byte) bool {
+	return i.upper == nil || i.sl.cmp(key, i.upper) < 0
+}
@@ -2,8 +2,11 @@ package skiplist
 
 import (
 	"bytes"
+	"lsm/comparer"
 	"lsm/fastrand"
 	"math"
+	"slices"
+	"unsafe"
 )
 
 const (
@@ -20,8 +23,12 @@ type node struct {
 }
 
 type SkipList struct {
-	head   *node // starting head node
-	height int   // current height
+	head   *node          // starting head node
+	height int            // current height
+	size   int            // bytes of the keys and values
+	levels [MaxHeight]int // number of nodes on every level, levels[0] counting all of them
+	cmp    comparer.Compare
+	rand   Rand // nil for fastrand
 }
 
 func init() {
@@ -33,9 +40,20 @@ func init() {
 	}
 }
 
-func randomHeight() int {
-	//runtime.fastrand is faster than math/rand
-	seed := fastrand.Uint32()
+// Rand is a source of random numbers for the heights of the towers, e.g. a seeded *rand.Rand
+// of math/rand.
+type Rand interface {
+	Uint32() uint32
+}
+
+func (sl *SkipList) randomHeight() int {
+	var seed uint32
+	if sl.rand != nil {
+		seed = sl.rand.Uint32()
+	} else {
+		//runtime.fastrand is faster than math/rand
+		seed = fastrand.Uint32()
+	}
 
 	height := 1
 	for height < MaxHeight && seed <= probabilities[height] {
@@ -50,10 +68,23 @@ func (sl *SkipList) String() string {
 	return v.visualize()
 }
 
-func NewSkipList() *SkipList {
+// NewSkipList returns an empty skiplist ordering its keys by cmp, or by their bytes if cmp is nil.
+func NewSkipList(cmp comparer.Compare) *SkipList {
+	return NewSkipListWithRand(cmp, nil)
+}
+
+// NewSkipListWithRand is NewSkipList drawing the heights of the towers from rng rather than
+// fastrand. With a seeded rng, the same inserts build the same towers on every run, so that
+// tests are reproducible and the visualizer shows the same list. A nil rng uses fastrand.
+func NewSkipListWithRand(cmp comparer.Compare, rng Rand) *SkipList {
+	if cmp == nil {
+		cmp = bytes.Compare
+	}
 	return &SkipList{
 		head:   &node{},
 		height: 1,
+		cmp:    cmp,
+		rand:   rng,
 	}
 }
 
@@ -67,7 +98,7 @@ func (sl *SkipList) search(key []byte) (*node, [MaxHeight]*node) {
 	for level := sl.height - 1; level >= 0; level-- {
 		for next = prev.tower[level]; next != nil; next = prev.tower[level] {
 			// key <= next.key
-			if bytes.Compare(key, next.key) <= 0 {
+			if sl.cmp(key, next.key) <= 0 {
 				break
 			}
 			// key > next.key
@@ -76,7 +107,7 @@ func (sl *SkipList) search(key []byte) (*node, [MaxHeight]*node) {
 		journey[level] = prev
 	}
 
-	if next != nil && bytes.Equal(key, next.key) {
+	if next != nil && sl.cmp(key, next.key) == 0 {
 		return next, journey
 	}
 	return nil, journey
@@ -91,16 +122,42 @@ func (sl *SkipList) Get(key []byte) ([]byte, bool) {
 	return nil, false
 }
 
+// Size returns the number of bytes taken by the keys and values of the list, not counting
+// its nodes.
+func (sl *SkipList) Size() int {
+	return sl.size
+}
+
+// Len returns the number of keys in the list.
+func (sl *SkipList) Len() int {
+	return sl.levels[0]
+}
+
+// ApproxBytes returns the memory taken by the list: its keys and values, and its nodes. Every
+// node has a tower of MaxHeight pointers, whatever its height.
+func (sl *SkipList) ApproxBytes() int {
+	return sl.size + (sl.Len()+1)*int(unsafe.Sizeof(node{}))
+}
+
+// LevelCounts returns the number of nodes on every level, from the lowest one up to the
+// current height. A node makes it to the next level with probability p, so every level should
+// hold about half the nodes of the one below; much more or less points to bad randomness.
+func (sl *SkipList) LevelCounts() []int {
+	return slices.Clone(sl.levels[:sl.height])
+}
+
 func (sl *SkipList) Insert(key, val []byte) {
 	n, journey := sl.search(key)
 
 	//update value of existing key
 	if n != nil {
+		sl.size += len(val) - len(n.val)
 		n.val = val
 		return
 	}
+	sl.size += len(key) + len(val)
 
-	height := randomHeight()
+	height := sl.randomHeight()
 	new_node := &node{
 		key: key,
 		val: val,
@@ -116,6 +173,7 @@ func (sl *SkipList) Insert(key, val []byte) {
 		}
 		new_node.tower[level] = prev.tower[level]
 		prev.tower[level] = new_node
+		sl.levels[level]++
 	}
 
 	// update current height of skiplist
@@ -124,8 +182,10 @@ func (sl *SkipList) Insert(key, val []byte) {
 	}
 }
 
+// shrink lowers the height of the list to its highest non-empty level, but never below 1,
+// the height of an empty list: searches start from the head on the levels below the height.
 func (sl *SkipList) shrink() {
-	for level := sl.height - 1; level >= 0; level-- {
+	for level := sl.height - 1; level > 0; level-- {
 		if sl.head.tower[level] == nil {
 			sl.height--
 		} else {
@@ -152,11 +212,38 @@ func (sl *SkipList) Delete(key []byte) bool {
 
 		prev.tower[level] = n.tower[level]
 		n.tower[level] = nil
+		sl.levels[level]--
 	}
 
+	sl.size -= len(n.key) + len(n.val)
 	n = nil
 	// shrink height if  the removed node was the only node residing on
 	// that particular level of the skip list.
 	sl.shrink()
 	return true
 }
+
+// DeleteRange removes the keys in [start, end) and returns how many there were. The run of
+// nodes is unlinked at once: every level is spliced from the last node before start to the
+// first one at or after end, rather than searching for and unlinking every node on its own.
+func (sl *SkipList) DeleteRange(start, end []byte) int {
+	if sl.cmp(start, end) >= 0 {
+		return 0
+	}
+	_, journey := sl.search(start)
+	removed := 0
+	for level := 0; level < sl.height; level++ {
+		prev := journey[level]
+		next := prev.tower[level]
+		for ; next != nil && sl.cmp(next.key, end) < 0; next = next.tower[level] {
+			sl.levels[level]--
+			if level == 0 {
+				removed++
+				sl.size -= len(next.key) + len(next.val)
+			}
+		}
+		prev.tower[level] = next
+	}
+	sl.shrink()
+	return removed
+}
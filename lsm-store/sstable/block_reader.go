@@ -1,8 +1,8 @@
 package sstable
 
 import (
-	"bytes"
 	"encoding/binary"
+	"lsm/comparer"
 )
 
 type searchCondition int
@@ -19,6 +19,45 @@ type blockReader struct {
 	numOffsets int
 }
 
+// validate checks that the offsets of the block are in order and point to entries that fit
+// before them, the only entries fetchDataFor reads: the rest of a chunk is bounds checked by
+// whoever decodes it.
+func (b *blockReader) validate() error {
+	entriesEnd := len(b.buf) - len(b.offsets)
+	prev := 0
+	for pos := 0; pos < b.numOffsets; pos++ {
+		offset := int(binary.LittleEndian.Uint32(b.offsets[pos*4:]))
+		if offset < prev || offset >= entriesEnd {
+			return errCorruptBlock
+		}
+		if _, _, ok := decodeEntry(b.buf[offset:entriesEnd]); !ok {
+			return errCorruptBlock
+		}
+		prev = offset
+	}
+	return nil
+}
+
+// decodeEntry decodes the header of the entry buf starts with (sharedLen|keyLen|valLen),
+// and returns its key and value, unless they don't fit in buf.
+func decodeEntry(buf []byte) (key, val []byte, ok bool) {
+	var lens [3]uint64
+	offset := 0
+	for i := range lens {
+		var n int
+		if lens[i], n = binary.Uvarint(buf[offset:]); n <= 0 {
+			return nil, nil, false
+		}
+		offset += n
+	}
+	keyLen, valLen := lens[1], lens[2]
+	if keyLen > uint64(len(buf)-offset) || valLen > uint64(len(buf)-offset)-keyLen {
+		return nil, nil, false
+	}
+	key = buf[offset : offset+int(keyLen)]
+	return key, buf[offset+int(keyLen) : offset+int(keyLen)+int(valLen)], true
+}
+
 func (b *blockReader) fetchDataFor(pos int) (kvOffset int, key, val []byte) {
 	var keyLen, valLen uint64
 	var n int
@@ -42,7 +81,7 @@ func (b *blockReader) readOffsetAt(pos int) int {
 	return offset
 }
 
-// largest key of data block at pos
+// index key of data block at pos: a key >= its largest key and < the smallest key of the next data block
 func (b *blockReader) readKeyAt(pos int) []byte {
 	_, key, _ := b.fetchDataFor(pos)
 	return key
@@ -54,14 +93,13 @@ func (b *blockReader) readValAt(pos int) []byte {
 	return val
 }
 
-func (b *blockReader) search(searchKey []byte, condition searchCondition) int {
+func (b *blockReader) search(cmp comparer.Compare, searchKey []byte, condition searchCondition) int {
 	low, high := 0, b.numOffsets
 	var mid int
 	for low < high {
 		mid = (low + high) / 2
 		key := b.readKeyAt(mid)
-		cmp := bytes.Compare(searchKey, key)
-		if cmp >= int(condition) {
+		if cmp(searchKey, key) >= int(condition) {
 			low = mid + 1
 		} else {
 			high = mid
@@ -0,0 +1,114 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"lsm/cache"
+	"math/rand"
+	"testing"
+)
+
+// TestValuesAroundBlockSize writes values just under, at and just above the block size, which
+// fill a data block on their own or overflow it, and reads them back with every compression.
+func TestValuesAroundBlockSize(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var keys, vals [][]byte
+	for i, size := range []int{10, DefaultBlockSize - 1, DefaultBlockSize, 10, DefaultBlockSize + 1, DefaultBlockSize, 0, 3 * DefaultBlockSize} {
+		val := make([]byte, size)
+		rng.Read(val) // incompressible, so that compressed blocks stay as large
+		keys = append(keys, []byte(fmt.Sprintf("key%02d", i)))
+		vals = append(vals, val)
+	}
+	for _, tc := range []struct {
+		name string
+		opts Options
+	}{
+		{"uncompressed", Options{}},
+		{"snappy", Options{Compression: SnappyCompression}},
+		{"zstd", Options{Compression: ZstdCompression}},
+		{"zstd dictionary", Options{Compression: ZstdCompression, CompressionDictSize: 1 << 10}},
+		{"lz4", Options{Compression: LZ4Compression}},
+		{"block cache", Options{BlockCache: cache.New(1 << 20), ParanoidChecks: true}},
+	} {
+		opts := tc.opts
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := openTestTable(writeTestTable(t, opts, keys, vals, nil), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			if err := r.Verify(); err != nil {
+				t.Fatal(err)
+			}
+			for i, key := range keys {
+				ev, err := r.Get(key)
+				if err != nil {
+					t.Fatalf("Get(%q): %v", key, err)
+				}
+				if !bytes.Equal(ev.Value(), vals[i]) {
+					t.Fatalf("Get(%q) returned %d bytes, %d written", key, len(ev.Value()), len(vals[i]))
+				}
+			}
+			it, err := r.NewIter()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer it.Close()
+			i := 0
+			for valid := it.First(); valid; valid = it.Next() {
+				if i >= len(keys) || !bytes.Equal(it.Key(), keys[i]) {
+					t.Fatalf("iterator at %q, want kv-pair %d", it.Key(), i)
+				}
+				if val := r.encoder.Parse(it.Value()).Value(); !bytes.Equal(val, vals[i]) {
+					t.Fatalf("iterator returned %d bytes for %q, %d written", len(val), keys[i], len(vals[i]))
+				}
+				i++
+			}
+			if err := it.Error(); err != nil || i != len(keys) {
+				t.Fatalf("iterator returned %d of %d kv-pairs: %v", i, len(keys), err)
+			}
+		})
+	}
+}
+
+// TestCorruptBlockTrailer feeds blocks whose trailer doesn't fit them to prepareBlockReader,
+// which has to reject them instead of slicing past their end.
+func TestCorruptBlockTrailer(t *testing.T) {
+	w := newBlockWriter(1, DefaultBlockSize)
+	for i := 0; i < 3; i++ {
+		if _, err := w.add([]byte(fmt.Sprintf("key%d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.finish(); err != nil {
+		t.Fatal(err)
+	}
+	block := w.buf.Bytes()
+	r := &Reader{}
+	if _, err := r.prepareBlockReader(block); err != nil {
+		t.Fatalf("valid block rejected: %v", err)
+	}
+
+	// trailer rewrites the {#offsets, block length} trailer of a copy of the block
+	trailer := func(numOffsets, length uint32) []byte {
+		buf := bytes.Clone(block)
+		binary.LittleEndian.PutUint32(buf[len(buf)-8:], numOffsets)
+		binary.LittleEndian.PutUint32(buf[len(buf)-4:], length)
+		return buf
+	}
+	for name, buf := range map[string][]byte{
+		"empty":                  nil,
+		"shorter than a trailer": block[len(block)-blockTrailerSizeInBytes+1:],
+		"truncated":              block[:len(block)-1],
+		"length past the end":    trailer(3, uint32(len(block)+1)),
+		"huge length":            trailer(3, 1<<31),
+		"too many offsets":       trailer(uint32(len(block)), uint32(len(block))),
+		"huge offset count":      trailer(1<<32-1, uint32(len(block))),
+	} {
+		if _, err := r.prepareBlockReader(buf); !errors.Is(err, errCorruptBlock) {
+			t.Errorf("%s: got %v, want errCorruptBlock", name, err)
+		}
+	}
+}
@@ -5,11 +5,6 @@ import (
 	"encoding/binary"
 )
 
-// maxBlockSize is the maximum size of a data block and index block.
-const (
-	maxBlockSize = 4096
-)
-
 // encapsulate operations that are common to preparing both index blocks
 // and data blocks for writing to disk
 type blockWriter struct {
@@ -18,14 +13,14 @@ type blockWriter struct {
 	currOffset uint32 // starting offset of the current data chunk
 	nextOffset uint32
 
-	chunkSize  int    // desired numEntries in each data chunk
+	chunkSize  int    // desired numEntries in each data chunk (restart interval)
 	numEntries int    // numEntries in the current data chunk
-	prefixKey  []byte // prefixKey of the current data chunk
+	prevKey    []byte // key of the previous data entry
 }
 
-func newBlockWriter(chunkSize int) *blockWriter {
+func newBlockWriter(chunkSize, blockSize int) *blockWriter {
 	bw := &blockWriter{}
-	bw.buf = bytes.NewBuffer(make([]byte, 0, maxBlockSize))
+	bw.buf = bytes.NewBuffer(make([]byte, 0, blockSize))
 	bw.chunkSize = chunkSize
 	return bw
 }
@@ -46,24 +41,19 @@ func (b *blockWriter) trackOffset(n uint32) {
 		b.offsets = append(b.offsets, b.currOffset)
 		b.currOffset = b.nextOffset
 		b.numEntries = 0
-		b.prefixKey = nil
 	}
 }
 
+// calculateSharedLength returns the length of the prefix key shares with the previous key.
+// Every chunk starts with a full key (a restart point), so that it can be decoded on its own.
 func (b *blockWriter) calculateSharedLength(key []byte) int {
 	sharedLen := 0
-	if b.prefixKey == nil {
-		b.prefixKey = key
-		return sharedLen
-	}
-
-	for i := 0; i < min(len(key), len(b.prefixKey)); i++ {
-		if key[i] != b.prefixKey[i] {
-			break
+	if b.numEntries > 0 {
+		for sharedLen < min(len(key), len(b.prevKey)) && key[sharedLen] == b.prevKey[sharedLen] {
+			sharedLen++
 		}
-		sharedLen++
 	}
-
+	b.prevKey = append(b.prevKey[:0], key...)
 	return sharedLen
 }
 
@@ -96,7 +86,6 @@ func (b *blockWriter) reset() {
 	b.currOffset = 0
 	b.offsets = b.offsets[:0]
 	b.numEntries = 0
-	b.prefixKey = nil
 }
 
 // This method is only for index block.
@@ -104,7 +93,7 @@ func (b *blockWriter) reset() {
 // Along with that it also records the total length of the index block, and the total number of offsets that were recorded
 // So, our footer size is 8 bytes.
 func (b *blockWriter) finish() error {
-	if b.prefixKey != nil {
+	if b.numEntries > 0 {
 		// Force flush of last prefix key offset.
 		b.offsets = append(b.offsets, b.currOffset)
 	}
@@ -0,0 +1,50 @@
+package sstable
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// TestCompressionRoundTrip compresses compressible, incompressible and empty blocks with every
+// codec, and decompresses them back.
+func TestCompressionRoundTrip(t *testing.T) {
+	random := make([]byte, 3*DefaultBlockSize)
+	rand.New(rand.NewSource(1)).Read(random)
+	blocks := map[string][]byte{
+		"empty":          {},
+		"compressible":   bytes.Repeat([]byte("key0001 value value value "), 200),
+		"incompressible": random,
+		"one byte":       {0xff},
+	}
+	for _, c := range []Compression{NoCompression, SnappyCompression, ZstdCompression, LZ4Compression} {
+		for name, block := range blocks {
+			encoded := c.compress(nil, block)
+			decoded, err := c.decompress(nil, encoded)
+			if err != nil || !bytes.Equal(decoded, block) {
+				t.Fatalf("%s, %s block: decoded %d of %d bytes: %v", c, name, len(decoded), len(block), err)
+			}
+			if name == "compressible" && c != NoCompression && len(encoded) >= len(block) {
+				t.Fatalf("%s: compressible block of %d bytes encoded to %d", c, len(block), len(encoded))
+			}
+		}
+	}
+}
+
+// TestCorruptLZ4Block decodes lz4 blocks with a damaged length prefix or a truncated body, which
+// have to be rejected before a buffer of the length they claim is allocated.
+func TestCorruptLZ4Block(t *testing.T) {
+	block := LZ4Compression.compress(nil, bytes.Repeat([]byte("value "), 500))
+	for name, buf := range map[string][]byte{
+		"empty":            nil,
+		"unterminated":     {0x80},
+		"huge length":      {0xff, 0xff, 0xff, 0xff, 0x0f, 0x10},
+		"length past 255x": append([]byte{0x80, 0x20}, 0x10),
+		"truncated":        block[:len(block)-3],
+		"longer length":    append([]byte{0xb9, 0x17}, block[2:]...), // 3001 bytes claimed
+	} {
+		if _, err := LZ4Compression.decompress(nil, buf); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package sstable
+
+import (
+	"container/heap"
+	"encoding/binary"
+)
+
+const (
+	dictID           = 1   // ID of the raw-content zstd dictionary of a table, each table has its own
+	dictSampleFactor = 8   // data blocks are sampled until they add up to this many times the dictionary size
+	dictDmerSize     = 8   // length of the substrings whose occurrences are counted
+	dictSegmentSize  = 256 // length of the pieces the dictionary is assembled from
+)
+
+// trainDict assembles a raw-content zstd dictionary of at most size bytes from samples (data
+// blocks), in the spirit of zstd's COVER trainer: the samples are cut into segments, which are
+// scored by how many other samples share their substrings, and the best segments are picked
+// greedily. Substrings repeating within a single sample are left alone, zstd finds those on
+// its own. Returns nil if the samples have nothing in common.
+func trainDict(samples [][]byte, size int) []byte {
+	// freq holds the number of samples every dmer occurs in
+	freq := make(map[uint64]int)
+	seen := make(map[uint64]bool)
+	for _, s := range samples {
+		clear(seen)
+		for i := 0; i+dictDmerSize <= len(s); i++ {
+			dmer := binary.LittleEndian.Uint64(s[i:])
+			if !seen[dmer] {
+				seen[dmer] = true
+				freq[dmer]++
+			}
+		}
+	}
+	score := func(seg []byte) int {
+		n := 0
+		for i := 0; i+dictDmerSize <= len(seg); i++ {
+			n += max(freq[binary.LittleEndian.Uint64(seg[i:])]-1, 0)
+		}
+		return n
+	}
+
+	// segments overlap by half, so a common substring is rarely cut in two
+	h := &segmentHeap{}
+	for _, s := range samples {
+		for i := 0; i < len(s); i += dictSegmentSize / 2 {
+			seg := s[i:min(i+dictSegmentSize, len(s))]
+			if sc := score(seg); sc > 0 {
+				*h = append(*h, segment{seg, sc})
+			}
+		}
+	}
+	heap.Init(h)
+
+	var picked [][]byte
+	total := 0
+	for h.Len() > 0 && total < size {
+		top := (*h)[0]
+		// the substrings of a picked segment don't count anymore, so scores only ever drop:
+		// rescore the best segment and only pick it if it is still the best one
+		if sc := score(top.data); sc < top.score {
+			if sc <= 0 {
+				heap.Pop(h)
+			} else {
+				(*h)[0].score = sc
+				heap.Fix(h, 0)
+			}
+			continue
+		}
+		heap.Pop(h)
+		picked = append(picked, top.data)
+		total += len(top.data)
+		for i := 0; i+dictDmerSize <= len(top.data); i++ {
+			freq[binary.LittleEndian.Uint64(top.data[i:])] = 0
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	// matches at the end of the dictionary have the shortest offsets, so the best segments
+	// go last, and the worst ones are cut off if the dictionary is too large
+	dict := make([]byte, 0, total)
+	for i := len(picked) - 1; i >= 0; i-- {
+		dict = append(dict, picked[i]...)
+	}
+	return dict[max(len(dict)-size, 0):]
+}
+
+type segment struct {
+	data  []byte
+	score int
+}
+
+// segmentHeap is a max-heap of segments by their score.
+type segmentHeap []segment
+
+func (h segmentHeap) Len() int           { return len(h) }
+func (h segmentHeap) Less(i, j int) bool { return h[i].score > h[j].score }
+func (h segmentHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *segmentHeap) Push(x any)        { *h = append(*h, x.(segment)) }
+func (h *segmentHeap) Pop() any {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return s
+}
@@ -0,0 +1,56 @@
+package sstable
+
+import (
+	"errors"
+	"lsm/encoder"
+	"os"
+)
+
+var ErrKeyOrder = errors.New("sstable: keys must be added in strictly increasing order")
+
+// FileWriter builds a standalone *.sst file from plain kv-pairs, without a DB, e.g. to bulk
+// load it with DB.IngestExternalFile. Every entry is written with sequence number 0; the DB
+// assigns the entries a sequence number of its own once the file is ingested.
+type FileWriter struct {
+	w       *Writer
+	encoder *encoder.Encoder
+	opts    Options
+	lastKey []byte
+}
+
+// NewFileWriter creates the file at path, which must not exist yet. The options have to match
+// the ones of the DB the file is ingested into.
+func NewFileWriter(path string, opts Options) (*FileWriter, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	opts = opts.ensureDefaults()
+	return &FileWriter{w: NewWriter(f, opts), encoder: encoder.NewEncoder(), opts: opts}, nil
+}
+
+// Set adds a kv-pair. Keys must be added in strictly increasing order.
+func (fw *FileWriter) Set(key, val []byte) error {
+	return fw.add(key, fw.encoder.Encode(encoder.OpKindSet, 0, val))
+}
+
+// Delete adds a tombstone for key, which deletes it from the DB the file is ingested into.
+func (fw *FileWriter) Delete(key []byte) error {
+	return fw.add(key, fw.encoder.Encode(encoder.OpKindDelete, 0, nil))
+}
+
+func (fw *FileWriter) add(key, val []byte) error {
+	if fw.w.NumEntries() > 0 && fw.opts.Comparer.Compare(key, fw.lastKey) <= 0 {
+		return ErrKeyOrder
+	}
+	fw.lastKey = append(fw.lastKey[:0], key...)
+	return fw.w.Add(key, val)
+}
+
+// Close finishes the table and syncs it to stable storage.
+func (fw *FileWriter) Close() error {
+	if err := fw.w.Finish(); err != nil {
+		return err
+	}
+	return fw.w.Close()
+}
@@ -0,0 +1,115 @@
+package sstable
+
+import (
+	"fmt"
+	"lsm/comparer"
+	"sort"
+)
+
+// indexReader maps the index keys of the data blocks to their handles. It is a single block,
+// or for tables with a two-level index, partitions found through a top-level index block mapping the last
+// index key of every partition to its handle. The partitions are loaded along with the reader,
+// so that either way, the data blocks are numbered from 0 to numOffsets-1 without any IO.
+type indexReader struct {
+	top        *blockReader // nil for a single-level index
+	partitions []*blockReader
+	starts     []int // position of the first data block of every partition
+	numOffsets int   // data blocks
+}
+
+func singleLevelIndex(b *blockReader) *indexReader {
+	return &indexReader{partitions: []*blockReader{b}, starts: []int{0}, numOffsets: b.numOffsets}
+}
+
+// readIndex loads the index of the table, the index block in the footer and, if the table has
+// a two-level index, its partitions.
+func (r *Reader) readIndex() (*indexReader, error) {
+	top, err := r.readMetaBlock(r.footer[16:24])
+	if err != nil {
+		return nil, err
+	}
+	if err = checkHandles(top); err != nil {
+		return nil, err
+	}
+	if r.version != FormatV2 && !r.props.TwoLevelIndex {
+		return singleLevelIndex(top), nil
+	}
+	index := &indexReader{top: top}
+	for pos := 0; pos < top.numOffsets; pos++ {
+		p, err := r.readMetaBlock(top.readValAt(pos))
+		if err != nil {
+			return nil, err
+		}
+		if p.numOffsets == 0 {
+			return nil, fmt.Errorf("%w: empty index partition %d", ErrCorruption, pos)
+		}
+		if err = checkHandles(p); err != nil {
+			return nil, err
+		}
+		index.partitions = append(index.partitions, p)
+		index.starts = append(index.starts, index.numOffsets)
+		index.numOffsets += p.numOffsets
+	}
+	return index, nil
+}
+
+// checkHandles checks that every value of an index block is a block handle, which readers of
+// the index slice without checking.
+func checkHandles(b *blockReader) error {
+	for pos := 0; pos < b.numOffsets; pos++ {
+		if len(b.readValAt(pos)) != 8 {
+			return fmt.Errorf("%w: malformed index entry %d", ErrCorruption, pos)
+		}
+	}
+	return nil
+}
+
+// locate returns the partition holding the data block at pos, and its position in there.
+func (x *indexReader) locate(pos int) (*blockReader, int) {
+	i := sort.Search(len(x.starts), func(i int) bool { return x.starts[i] > pos }) - 1
+	return x.partitions[i], pos - x.starts[i]
+}
+
+func (x *indexReader) fetchDataFor(pos int) (kvOffset int, key, val []byte) {
+	p, pos := x.locate(pos)
+	return p.fetchDataFor(pos)
+}
+
+// index key of data block at pos: a key >= its largest key and < the smallest key of the next data block
+func (x *indexReader) readKeyAt(pos int) []byte {
+	_, key, _ := x.fetchDataFor(pos)
+	return key
+}
+
+// {offset of data block entry, length of data block} at pos
+func (x *indexReader) readValAt(pos int) []byte {
+	_, _, val := x.fetchDataFor(pos)
+	return val
+}
+
+// search returns the position of the first data block whose index key satisfies condition,
+// numOffsets if there is none. The top-level index picks the partition: the last index key of
+// a partition satisfies the condition if any of its index keys does.
+func (x *indexReader) search(cmp comparer.Compare, searchKey []byte, condition searchCondition) int {
+	if x.top == nil {
+		return x.partitions[0].search(cmp, searchKey, condition)
+	}
+	i := x.top.search(cmp, searchKey, condition)
+	if i >= len(x.partitions) {
+		return x.numOffsets
+	}
+	return x.starts[i] + x.partitions[i].search(cmp, searchKey, condition)
+}
+
+// partitionHandles returns the handles of the partitions of a two-level index, in the order
+// they are stored in.
+func (x *indexReader) partitionHandles() [][]byte {
+	if x.top == nil {
+		return nil
+	}
+	handles := make([][]byte, x.top.numOffsets)
+	for pos := range handles {
+		handles[pos] = x.top.readValAt(pos)
+	}
+	return handles
+}
@@ -0,0 +1,266 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"lsm/comparer"
+	"sort"
+)
+
+var errCorruptBlock = errors.New("sstable: corrupt data block")
+
+// Iterator walks the kv-pairs of an SSTable in either direction using the index block pinned
+// by its Reader. Data blocks are loaded lazily, one at a time. Prefix compression only lets
+// a data block be decoded front to back, so every loaded block is decoded in full into an
+// index of its entries, which can then be walked (and searched) both ways.
+type Iterator struct {
+	r     *Reader
+	index *indexReader
+	cmp   comparer.Compare
+	pos   int // position of the current data block in the index block
+
+	entries []blockEntry // decoded entries of the current data block
+	idx     int          // position of the current entry in entries
+
+	key, val []byte
+	err      error
+
+	lower, upper []byte // bounds of the iteration: [lower, upper), nil leaves a side unbounded
+	ro           ReadOptions
+}
+
+type blockEntry struct {
+	key, val []byte
+}
+
+// NewIter returns an iterator over the whole table. The iterator is not positioned,
+// call First, Last or one of the seek methods before accessing any kv-pair.
+func (r *Reader) NewIter() (*Iterator, error) {
+	return &Iterator{r: r, index: r.index, cmp: r.opts.Comparer.Compare}, nil
+}
+
+// SetBounds restricts the iteration to keys in [lower, upper). A nil lower or upper leaves
+// that side unbounded. Data blocks entirely outside of the bounds are never loaded. It takes
+// effect with the next positioning call.
+func (i *Iterator) SetBounds(lower, upper []byte) {
+	i.lower, i.upper = lower, upper
+}
+
+// SetReadOptions sets how the data blocks are loaded from then on.
+func (i *Iterator) SetReadOptions(ro ReadOptions) {
+	i.ro = ro
+}
+
+// First positions the iterator at the smallest key of the table (within bounds).
+func (i *Iterator) First() bool {
+	if i.lower != nil {
+		return i.SeekGE(i.lower)
+	}
+	i.err = nil
+	if !i.loadDataBlock(0) {
+		return false
+	}
+	i.idx = 0
+	return i.settleForward()
+}
+
+// Last positions the iterator at the largest key of the table (within bounds).
+func (i *Iterator) Last() bool {
+	if i.upper != nil {
+		return i.SeekLT(i.upper)
+	}
+	i.err = nil
+	if !i.loadDataBlock(i.index.numOffsets - 1) {
+		return false
+	}
+	i.idx = len(i.entries) - 1
+	return i.settleBackward()
+}
+
+// SeekGE positions the iterator at the smallest key that is >= key (and within bounds).
+func (i *Iterator) SeekGE(key []byte) bool {
+	i.err = nil
+	if i.lower != nil && i.cmp(key, i.lower) < 0 {
+		key = i.lower
+	}
+	// the first data block whose index key is >= key
+	if !i.loadDataBlock(i.index.search(i.cmp, key, moveUpWhenKeyGT)) {
+		return false
+	}
+	i.idx = i.searchEntries(key)
+	return i.settleForward()
+}
+
+// SeekLT positions the iterator at the largest key that is < key (and within bounds).
+func (i *Iterator) SeekLT(key []byte) bool {
+	i.err = nil
+	if i.upper != nil && i.cmp(key, i.upper) > 0 {
+		key = i.upper
+	}
+	// the first data block whose index key is >= key, the key preceding it is either
+	// in that block or the last one of the block before
+	pos := min(i.index.search(i.cmp, key, moveUpWhenKeyGT), i.index.numOffsets-1)
+	if !i.loadDataBlock(pos) {
+		return false
+	}
+	i.idx = i.searchEntries(key) - 1
+	return i.settleBackward()
+}
+
+// Next advances the iterator to the next kv-pair, loading the next data block when needed.
+func (i *Iterator) Next() bool {
+	if !i.Valid() {
+		return false
+	}
+	i.idx++
+	return i.settleForward()
+}
+
+// Prev moves the iterator to the previous kv-pair, loading the previous data block when needed.
+func (i *Iterator) Prev() bool {
+	if !i.Valid() {
+		return false
+	}
+	i.idx--
+	return i.settleBackward()
+}
+
+// Valid reports whether the iterator is positioned at a kv-pair.
+func (i *Iterator) Valid() bool {
+	return i.key != nil
+}
+
+// Key returns the key at the current position.
+func (i *Iterator) Key() []byte {
+	return i.key
+}
+
+// Value returns the encoded value at the current position.
+func (i *Iterator) Value() []byte {
+	return i.val
+}
+
+// Error returns the error, if any, that stopped the iteration.
+func (i *Iterator) Error() error {
+	return i.err
+}
+
+// Close releases the iterator. The underlying reader has to be closed separately.
+func (i *Iterator) Close() error {
+	i.index, i.entries, i.key, i.val = nil, nil, nil, nil
+	return nil
+}
+
+// settleForward moves on to the following data blocks once the current one is exhausted
+// and checks the current entry against the upper bound.
+func (i *Iterator) settleForward() bool {
+	for i.idx >= len(i.entries) {
+		// the index key of the current data block already reached the upper bound,
+		// every key of the following data blocks is larger
+		if i.upper != nil && i.cmp(i.index.readKeyAt(i.pos), i.upper) >= 0 {
+			return i.invalidate()
+		}
+		if !i.loadDataBlock(i.pos + 1) {
+			return false
+		}
+		i.idx = 0
+	}
+	e := i.entries[i.idx]
+	if i.upper != nil && i.cmp(e.key, i.upper) >= 0 {
+		return i.invalidate()
+	}
+	i.key, i.val = e.key, e.val
+	return true
+}
+
+// settleBackward moves on to the preceding data blocks once the current one is exhausted
+// and checks the current entry against the lower bound.
+func (i *Iterator) settleBackward() bool {
+	for i.idx < 0 {
+		// every key of the preceding data block is below the lower bound
+		if i.pos == 0 || (i.lower != nil && i.cmp(i.index.readKeyAt(i.pos-1), i.lower) < 0) {
+			return i.invalidate()
+		}
+		if !i.loadDataBlock(i.pos - 1) {
+			return false
+		}
+		i.idx = len(i.entries) - 1
+	}
+	e := i.entries[i.idx]
+	if i.lower != nil && i.cmp(e.key, i.lower) < 0 {
+		return i.invalidate()
+	}
+	i.key, i.val = e.key, e.val
+	return true
+}
+
+// searchEntries returns the position of the first entry of the current data block >= key.
+func (i *Iterator) searchEntries(key []byte) int {
+	return sort.Search(len(i.entries), func(j int) bool {
+		return i.cmp(i.entries[j].key, key) >= 0
+	})
+}
+
+func (i *Iterator) invalidate() bool {
+	i.key, i.val, i.entries = nil, nil, nil
+	return false
+}
+
+func (i *Iterator) loadDataBlock(pos int) bool {
+	i.invalidate()
+	i.pos = pos
+	if pos < 0 || pos >= i.index.numOffsets {
+		return false
+	}
+	data, err := i.r.readDataBlock(i.index.readValAt(pos), i.ro)
+	if err != nil {
+		i.err = err
+		return false
+	}
+	if i.entries, err = i.r.decodeEntries(data); err != nil {
+		i.err = err
+		return false
+	}
+	return true
+}
+
+// decodeEntries decodes every data entry of a data block.
+// data entry = sharedLen|keyLen|valLen|key|val
+func (r *Reader) decodeEntries(data *blockReader) ([]blockEntry, error) {
+	var entries []blockEntry
+	// the previous key, or the first key of the current data chunk before FormatV3
+	var prefixKey []byte
+	buf := data.buf[:len(data.buf)-len(data.offsets)]
+	for offset := 0; offset < len(buf); {
+		sharedLen, n := binary.Uvarint(buf[offset:])
+		if n <= 0 {
+			return nil, errCorruptBlock
+		}
+		offset += n
+		keyLen, n := binary.Uvarint(buf[offset:])
+		if n <= 0 {
+			return nil, errCorruptBlock
+		}
+		offset += n
+		valLen, n := binary.Uvarint(buf[offset:])
+		if n <= 0 {
+			return nil, errCorruptBlock
+		}
+		offset += n
+		if rest := uint64(len(buf) - offset); keyLen > rest || valLen > rest-keyLen || sharedLen > uint64(len(prefixKey)) {
+			return nil, errCorruptBlock
+		}
+
+		// keys are handed out to callers, so every key gets its own buffer
+		key := make([]byte, sharedLen+keyLen)
+		copy(key, prefixKey[:sharedLen])
+		copy(key[sharedLen:], buf[offset:offset+int(keyLen)])
+		offset += int(keyLen)
+		if sharedLen == 0 || r.version >= FormatV3 {
+			prefixKey = key
+		}
+		entries = append(entries, blockEntry{key: key, val: buf[offset : offset+int(valLen)]})
+		offset += int(valLen)
+	}
+	return entries, nil
+}
@@ -0,0 +1,63 @@
+package sstable
+
+import "encoding/binary"
+
+// BlockHandle locates a block of a table. The checksum following the block isn't included
+// in its length.
+type BlockHandle struct {
+	Offset uint32
+	Length uint32
+}
+
+func decodeBlockHandle(handle []byte) BlockHandle {
+	return BlockHandle{
+		Offset: binary.LittleEndian.Uint32(handle[:4]),
+		Length: binary.LittleEndian.Uint32(handle[4:8]),
+	}
+}
+
+// IndexEntry is an entry of the index of a table: the data block holding the keys up to Key
+// (and above the key of the entry before).
+type IndexEntry struct {
+	Key   []byte
+	Block BlockHandle
+}
+
+// Layout describes how a table is laid out on disk, for tools like sstdump.
+type Layout struct {
+	Version  FormatVersion
+	FileSize int64
+	// Data are the data blocks, by index entry.
+	Data     []IndexEntry
+	RangeDel BlockHandle
+	// Filter is the filter block, zero if the table has none.
+	Filter     BlockHandle
+	Properties BlockHandle
+	// IndexPartitions are the partitions of a two-level index, and Index the top-level index
+	// block pointing to them. A single-level index has no partitions.
+	IndexPartitions []BlockHandle
+	Index           BlockHandle
+}
+
+// Layout returns the location of every block of the table. It doesn't read anything from disk.
+func (r *Reader) Layout() Layout {
+	l := Layout{
+		Version:    r.version,
+		FileSize:   r.fileSize,
+		RangeDel:   decodeBlockHandle(r.footer[0:8]),
+		Properties: decodeBlockHandle(r.footer[8:16]),
+		Index:      decodeBlockHandle(r.footer[16:24]),
+	}
+	if r.props.filterHandle != nil {
+		l.Filter = decodeBlockHandle(r.props.filterHandle)
+	}
+	for _, handle := range r.index.partitionHandles() {
+		l.IndexPartitions = append(l.IndexPartitions, decodeBlockHandle(handle))
+	}
+	l.Data = make([]IndexEntry, r.index.numOffsets)
+	for pos := range l.Data {
+		_, key, handle := r.index.fetchDataFor(pos)
+		l.Data[pos] = IndexEntry{Key: append([]byte(nil), key...), Block: decodeBlockHandle(handle)}
+	}
+	return l
+}
@@ -0,0 +1,152 @@
+package sstable
+
+import (
+	"bytes"
+	"io"
+	"lsm/encoder"
+)
+
+// InternalIterator is the part of an iterator a MergeWriter consumes: encoded kv-pairs in
+// key order, the versions of a key from newest to oldest, like a merge of table iterators.
+type InternalIterator interface {
+	First() bool
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Error() error
+}
+
+// MergeWriterOptions configure a MergeWriter.
+type MergeWriterOptions struct {
+	// Options are the options of the tables written.
+	Options
+	// TargetFileSize is the size (in bytes) from which on a table is finished, and the next
+	// kv-pair starts a new one.
+	TargetFileSize int
+	// RangeTombstones are written along with the kv-pairs. Every table gets the part of them
+	// falling into its key range, so that the key ranges of the tables don't overlap. If no
+	// kv-pair is written, they get a table of their own. They don't delete any kv-pair (see
+	// Filter).
+	RangeTombstones []encoder.RangeTombstone
+	// Create returns the file of a new table, which has to be a syncCloser, like *os.File.
+	Create func() (io.Writer, error)
+	// Finished, if set, is called with the properties and the size of every table once it
+	// has been synced and closed.
+	Finished func(props Properties, size int64) error
+	// Filter, if set, is called by AddIter with the newest version of every key, and decides
+	// whether to write it (keep), with the value it returns. Returning false drops the key
+	// altogether, the older versions being shadowed by the newest one anyway.
+	Filter func(key, val []byte) (newVal []byte, keep bool, err error)
+}
+
+// MergeWriter writes a sorted stream of kv-pairs, e.g. the merged tables of a compaction, into
+// a sequence of tables of about TargetFileSize bytes each, with non-overlapping key ranges.
+// Unlike ConvertMemtableToSST, it isn't limited to a single table nor to a memtable.
+type MergeWriter struct {
+	opts    MergeWriterOptions
+	w       *Writer
+	lo      []byte // the key the current table starts at (nil for the first one)
+	lastKey []byte
+}
+
+// NewMergeWriter returns a MergeWriter. The first table is only created along with its first
+// kv-pair.
+func NewMergeWriter(opts MergeWriterOptions) *MergeWriter {
+	opts.Options = opts.Options.ensureDefaults()
+	return &MergeWriter{opts: opts}
+}
+
+// Add writes a kv-pair. Keys must be added in strictly increasing order. A table that reached
+// the target size is only finished once the first key of the next one is known, as that's
+// where its share of the range tombstones ends.
+func (m *MergeWriter) Add(key, val []byte) error {
+	if m.lastKey != nil && m.opts.Comparer.Compare(key, m.lastKey) <= 0 {
+		return ErrKeyOrder
+	}
+	m.lastKey = append(m.lastKey[:0], key...)
+	if m.w != nil && m.w.EstimatedSize() >= m.opts.TargetFileSize {
+		if err := m.finishTable(key); err != nil {
+			return err
+		}
+		m.lo = bytes.Clone(key)
+	}
+	if m.w == nil {
+		if err := m.newTable(); err != nil {
+			return err
+		}
+	}
+	return m.w.Add(key, val)
+}
+
+// AddIter writes the newest version of every key of it that passes Filter, skipping the older
+// versions shadowed by it.
+func (m *MergeWriter) AddIter(it InternalIterator) error {
+	var prevKey []byte
+	seen := false
+	for valid := it.First(); valid; valid = it.Next() {
+		key := it.Key()
+		if seen && m.opts.Comparer.Compare(key, prevKey) == 0 {
+			continue // shadowed by a newer version of the key
+		}
+		prevKey, seen = append(prevKey[:0], key...), true
+		val, keep := it.Value(), true
+		if m.opts.Filter != nil {
+			var err error
+			if val, keep, err = m.opts.Filter(key, val); err != nil {
+				return err
+			}
+		}
+		if !keep {
+			continue
+		}
+		if err := m.Add(key, val); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+// Finish finishes the last table. No more kv-pairs can be added afterwards.
+func (m *MergeWriter) Finish() error {
+	if m.w == nil && len(m.opts.RangeTombstones) > 0 {
+		// every key was deleted, but the tombstones are still written
+		if err := m.newTable(); err != nil {
+			return err
+		}
+	}
+	if m.w == nil {
+		return nil
+	}
+	return m.finishTable(nil)
+}
+
+func (m *MergeWriter) newTable() error {
+	f, err := m.opts.Create()
+	if err != nil {
+		return err
+	}
+	m.w = NewWriter(f, m.opts.Options)
+	return nil
+}
+
+// finishTable writes the parts of the range tombstones falling into [m.lo, hi) to the current
+// table, seals it and closes it. A nil hi leaves that side unbounded.
+func (m *MergeWriter) finishTable(hi []byte) error {
+	w := m.w
+	m.w = nil
+	for _, t := range m.opts.RangeTombstones {
+		if t, ok := t.Clip(m.opts.Comparer.Compare, m.lo, hi); ok {
+			w.AddRangeTombstone(t)
+		}
+	}
+	if err := w.Finish(); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if m.opts.Finished == nil {
+		return nil
+	}
+	return m.opts.Finished(w.Properties(), int64(w.EstimatedSize()))
+}
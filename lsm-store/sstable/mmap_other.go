@@ -0,0 +1,13 @@
+//go:build !unix
+
+package sstable
+
+import "errors"
+
+func mmap(file any, size int64) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -0,0 +1,34 @@
+//go:build unix
+
+package sstable
+
+import (
+	"errors"
+	"syscall"
+)
+
+// mmap maps the first size bytes of file read-only into memory. Only files exposing their
+// descriptor (syscall.Conn, like *os.File) can be mapped.
+func mmap(file any, size int64) ([]byte, error) {
+	sc, ok := file.(syscall.Conn)
+	if !ok || size <= 0 || int64(int(size)) != size {
+		return nil, errors.ErrUnsupported
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	var mapErr error
+	err = rc.Control(func(fd uintptr) {
+		data, mapErr = syscall.Mmap(int(fd), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, mapErr
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
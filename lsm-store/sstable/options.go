@@ -0,0 +1,250 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"lsm/cache"
+	"lsm/comparer"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+const (
+	DefaultBlockSize      = 4096 // match the OS page size and the block size on disk
+	DefaultBlockChunkSize = 16
+)
+
+// Compression selects the codec applied to data blocks before they are written to disk.
+// The codec is recorded in the properties of the table, so a reader always decodes a
+// table with the codec it was written with.
+type Compression uint8
+
+const (
+	DefaultCompression Compression = iota
+	NoCompression
+	SnappyCompression
+	ZstdCompression
+	// LZ4Compression decodes faster than snappy for about the same ratio. An LZ4 block
+	// doesn't record its decoded length, so each compressed block is prefixed with it.
+	LZ4Compression
+)
+
+func (c Compression) String() string {
+	switch c {
+	case DefaultCompression:
+		return "default"
+	case NoCompression:
+		return "none"
+	case SnappyCompression:
+		return "snappy"
+	case ZstdCompression:
+		return "zstd"
+	case LZ4Compression:
+		return "lz4"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(c))
+}
+
+// ParseCompression returns the codec with the given name, as returned by String.
+func ParseCompression(name string) (Compression, error) {
+	for _, c := range []Compression{NoCompression, SnappyCompression, ZstdCompression, LZ4Compression} {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return DefaultCompression, fmt.Errorf("sstable: unknown compression %q", name)
+}
+
+// errCorruptLZ4 is returned for a block that doesn't decode with LZ4Compression.
+var errCorruptLZ4 = errors.New("sstable: corrupt lz4 block")
+
+// FilterType selects what the filters of a table cover. The type is recorded in the properties
+// of the table, so a reader always uses the filters the way they were written.
+type FilterType uint8
+
+const (
+	// TableFilter is a single filter over all keys of the table. It is consulted before the
+	// index, and takes the least memory.
+	TableFilter FilterType = iota
+	// BlockFilter is a filter per data block, consulted once the index has pointed a lookup to
+	// a data block. It costs an index search per lookup, but every filter only has to rule out
+	// the keys falling into its block.
+	BlockFilter
+)
+
+func (t FilterType) String() string {
+	switch t {
+	case TableFilter:
+		return "table"
+	case BlockFilter:
+		return "block"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(t))
+}
+
+// zstd encoders and decoders are expensive to create, but safe for concurrent use through
+// EncodeAll and DecodeAll, so all tables share one of each
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		e, _ := zstd.NewWriter(nil)
+		return e
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		d, _ := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecodedSize))
+		return d
+	})
+	// an lz4 compressor holds the hash table of a compression, and isn't safe for concurrent
+	// use
+	lz4Compressors = sync.Pool{New: func() any { return new(lz4.Compressor) }}
+)
+
+const (
+	// maxDecodedSize bounds the size of a decompressed block: a length read from a corrupt
+	// header mustn't be allocated before decoding fails.
+	maxDecodedSize = 1 << 30
+	// maxSnappyExpansion bounds how much larger than its encoding a snappy block can be, the
+	// longest copy (64 bytes) taking 3 bytes to encode.
+	maxSnappyExpansion = 32
+	// maxLZ4Expansion bounds how much larger than its encoding an lz4 block can be, a byte of
+	// a match length extending it by up to 255 bytes.
+	maxLZ4Expansion = 255
+)
+
+// Options shared by the SSTable writer and reader.
+type Options struct {
+	BlockSize      int         // target size of a data block
+	BlockChunkSize int         // numEntries in each data chunk (restart interval)
+	Compression    Compression // codec for data blocks
+	// Comparer orders the keys of the table, defaults to comparer.Default. A table can only
+	// be read with a Comparer of the same name as the one it was written with.
+	Comparer *comparer.Comparer
+
+	// writer only: with zstd, a dictionary of up to CompressionDictSize bytes (0 disables it) is
+	// trained on the first data blocks of the table and stored along with it. Every block is
+	// compressed with it, so small blocks of similar entries compress well on their own.
+	CompressionDictSize int
+	// writer only: with FilterBitsPerKey > 0, a bloom filter of that many bits per key (see
+	// package filter) is stored along with the table, which lets lookups of most absent keys
+	// skip it without reading a data block. 10 bits per key let about 1% of them through.
+	FilterBitsPerKey int
+	// writer only: FilterType picks a filter over the whole table or one per data block.
+	FilterType FilterType
+
+	// reader only: ParanoidChecks verifies the checksum of every block read from disk, and
+	// that the index of the table is ordered and covers its data blocks when it is opened
+	ParanoidChecks bool
+
+	// reader only: decompressed data blocks are kept in BlockCache (if set) under FileNum,
+	// which has to identify the table among all tables sharing the cache
+	BlockCache *cache.Cache
+	FileNum    int
+
+	// reader only: OnBlockRead, if set, is called after every data block read from disk (but
+	// not from BlockCache) and decompressed, with the time the read started and the size of
+	// the block as stored, e.g. to trace slow reads
+	OnBlockRead func(start time.Time, size int)
+
+	// reader only: Mmap memory-maps the file and reads blocks straight from the mapping instead
+	// of copying them in with a system call each. Uncompressed data blocks are used in place and
+	// bypass BlockCache. Files that can't be mapped, e.g. those of a storage.MemFS, are read as
+	// usual. Values returned by Get are copies; those of an iterator are only valid until the
+	// reader is closed.
+	Mmap bool
+}
+
+// ReadOptions control how a Get or an Iterator of a Reader loads data blocks, overriding the
+// Options of the Reader for that read.
+type ReadOptions struct {
+	// DontFillCache leaves the data blocks read from disk out of BlockCache, so that a read
+	// touching much cold data doesn't evict hot blocks. Blocks already cached are still used.
+	DontFillCache bool
+	// VerifyChecksums verifies the checksum of every data block read from disk, as
+	// ParanoidChecks does. Blocks served from BlockCache aren't read again.
+	VerifyChecksums bool
+}
+
+func (o Options) ensureDefaults() Options {
+	if o.BlockSize <= 0 {
+		o.BlockSize = DefaultBlockSize
+	}
+	if o.BlockChunkSize <= 0 {
+		o.BlockChunkSize = DefaultBlockChunkSize
+	}
+	if o.Compression == DefaultCompression {
+		o.Compression = SnappyCompression
+	}
+	if o.Comparer == nil {
+		o.Comparer = comparer.Default
+	}
+	return o
+}
+
+// compress encodes src using the configured codec, reusing dst where possible.
+func (c Compression) compress(dst, src []byte) []byte {
+	switch c {
+	case SnappyCompression:
+		return snappy.Encode(dst[:cap(dst)], src)
+	case ZstdCompression:
+		return zstdEncoder().EncodeAll(src, dst[:0])
+	case LZ4Compression:
+		return lz4Compress(dst, src)
+	default:
+		return append(dst[:0], src...)
+	}
+}
+
+// lz4Compress encodes src as its decoded length (uvarint) followed by the lz4 block, or by src
+// itself if it doesn't compress: the encoding is then exactly as long as the decoded length.
+func lz4Compress(dst, src []byte) []byte {
+	dst = binary.AppendUvarint(dst[:0], uint64(len(src)))
+	header := len(dst)
+	dst = slices.Grow(dst, lz4.CompressBlockBound(len(src)))
+	c := lz4Compressors.Get().(*lz4.Compressor)
+	n, err := c.CompressBlock(src, dst[header:cap(dst)])
+	lz4Compressors.Put(c)
+	if err != nil || n == 0 || n >= len(src) {
+		return append(dst[:header], src...)
+	}
+	return dst[:header+n]
+}
+
+// lz4Decompress decodes a block encoded by lz4Compress.
+func lz4Decompress(dst, src []byte) ([]byte, error) {
+	n, header := binary.Uvarint(src)
+	src = src[max(header, 0):]
+	switch {
+	case header <= 0 || n > maxDecodedSize || n > uint64(len(src))*maxLZ4Expansion:
+		return nil, errCorruptLZ4
+	case n == uint64(len(src)):
+		return append(dst[:0], src...), nil // stored as is
+	}
+	dst = slices.Grow(dst[:0], int(n))[:n]
+	m, err := lz4.UncompressBlock(src, dst)
+	if err != nil || m != len(dst) {
+		return nil, errCorruptLZ4
+	}
+	return dst, nil
+}
+
+// decompress decodes src using the configured codec, reusing dst where possible.
+func (c Compression) decompress(dst, src []byte) ([]byte, error) {
+	switch c {
+	case SnappyCompression:
+		if n, err := snappy.DecodedLen(src); err != nil || n > len(src)*maxSnappyExpansion {
+			return nil, snappy.ErrCorrupt
+		}
+		return snappy.Decode(dst[:cap(dst)], src)
+	case ZstdCompression:
+		return zstdDecoder().DecodeAll(src, dst[:0])
+	case LZ4Compression:
+		return lz4Decompress(dst, src)
+	default:
+		return append(dst[:0], src...), nil
+	}
+}
@@ -0,0 +1,241 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"lsm/comparer"
+	"lsm/encoder"
+	"slices"
+)
+
+// bloomFilterPolicy names the filters built by package filter.
+const bloomFilterPolicy = "blocked-bloom"
+
+// property names, kept in sorted order
+const (
+	propChecksums       = "lsm.checksums"
+	propComparer        = "lsm.comparer"
+	propCompression     = "lsm.compression"
+	propCompressionDict = "lsm.compression.dict"
+	propFilter          = "lsm.filter"
+	propFilterHandle    = "lsm.filter.handle"
+	propFilterType      = "lsm.filter.type"
+	propIndexType       = "lsm.index.type"
+	propLargestKey      = "lsm.largest.key"
+	propLargestSeqNum   = "lsm.largest.seqnum"
+	propNumEntries      = "lsm.num.entries"
+	propSmallestKey     = "lsm.smallest.key"
+	propValueLogRefs    = "lsm.vlog.refs"
+)
+
+// Properties describe an SSTable as a whole. They are written to a dedicated
+// properties block that sits between the data blocks and the index block.
+// The key range of a table covers its range tombstones as well: the end of a range
+// tombstone is exclusive, but still counts as the largest key of the table.
+type Properties struct {
+	SmallestKey   []byte // smallest key in the table (nil if the table is empty)
+	LargestKey    []byte // largest key in the table (nil if the table is empty)
+	LargestSeqNum uint64 // largest sequence number of any entry in the table
+	Comparer      string // name of the comparer ordering the keys (empty for tables predating it)
+	NumEntries    uint64 // number of kv-pairs (tombstones included) in the table (0 for tables predating it)
+	// Checksums tells whether every block is followed by its checksum (false for tables
+	// predating them).
+	Checksums bool
+	// Compression is the codec of the data blocks (DefaultCompression for tables predating
+	// it, which are read with the codec of the reader's Options)
+	Compression Compression
+	// CompressionDict is the raw-content zstd dictionary the data blocks are compressed
+	// with (nil if they aren't).
+	CompressionDict []byte
+	// TwoLevelIndex tells whether the index is partitioned, with the index block pointing to
+	// the partitions (only recorded from FormatV3 on, FormatV2 tables always have one).
+	TwoLevelIndex bool
+	// FilterPolicy is the kind of filter the table has over its keys (empty if it has none).
+	FilterPolicy string
+	// FilterType tells whether the filter covers the whole table or is split by data block.
+	FilterType FilterType
+	// ValueLogRefs is the number of bytes of each value log file (by file number) the
+	// values of the table point to, tombstones keeping the value they deleted included.
+	ValueLogRefs map[int]int64
+
+	filterHandle []byte // {offset, length} of the filter block
+}
+
+// extendByRangeDels widens the key range and the largest sequence number to cover tombstones.
+func (p *Properties) extendByRangeDels(cmp comparer.Compare, tombstones []encoder.RangeTombstone) {
+	for _, t := range tombstones {
+		if p.SmallestKey == nil || cmp(t.Start, p.SmallestKey) < 0 {
+			p.SmallestKey = t.Start
+		}
+		if p.LargestKey == nil || cmp(t.End, p.LargestKey) > 0 {
+			p.LargestKey = t.End
+		}
+		p.LargestSeqNum = max(p.LargestSeqNum, t.SeqNum)
+	}
+}
+
+// properties block = regular block with a chunkSize of 1 (name -> value),
+// entries are added in sorted order of their names.
+func (p *Properties) encode(b *blockWriter) error {
+	seqNum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(seqNum, p.LargestSeqNum)
+	numEntries := make([]byte, 8)
+	binary.LittleEndian.PutUint64(numEntries, p.NumEntries)
+	var cmpName []byte
+	if p.Comparer != "" {
+		cmpName = []byte(p.Comparer)
+	}
+	var checksums []byte
+	if p.Checksums {
+		checksums = []byte("crc32c")
+	}
+	var compression []byte
+	if p.Compression != DefaultCompression {
+		compression = []byte(p.Compression.String())
+	}
+	var filterPolicy []byte
+	if p.FilterPolicy != "" {
+		filterPolicy = []byte(p.FilterPolicy)
+	}
+	var filterType []byte
+	if p.FilterPolicy != "" && p.FilterType != TableFilter {
+		filterType = []byte(p.FilterType.String())
+	}
+	var indexType []byte
+	if p.TwoLevelIndex {
+		indexType = []byte("two-level")
+	}
+	props := []struct {
+		name string
+		val  []byte
+	}{
+		{propChecksums, checksums},
+		{propComparer, cmpName},
+		{propCompression, compression},
+		{propCompressionDict, p.CompressionDict},
+		{propFilter, filterPolicy},
+		{propFilterHandle, p.filterHandle},
+		{propFilterType, filterType},
+		{propIndexType, indexType},
+		{propLargestKey, p.LargestKey},
+		{propLargestSeqNum, seqNum},
+		{propNumEntries, numEntries},
+		{propSmallestKey, p.SmallestKey},
+		{propValueLogRefs, p.encodeValueLogRefs()},
+	}
+	for _, prop := range props {
+		if prop.val == nil {
+			continue
+		}
+		if _, err := b.add([]byte(prop.name), prop.val); err != nil {
+			return err
+		}
+	}
+	return b.finish()
+}
+
+func (p *Properties) decode(b *blockReader) error {
+	for pos := 0; pos < b.numOffsets; pos++ {
+		_, key, val := b.fetchDataFor(pos)
+		switch string(key) {
+		case propChecksums:
+			if string(val) != "crc32c" {
+				return fmt.Errorf("unknown checksum type %q", val)
+			}
+			p.Checksums = true
+		case propComparer:
+			p.Comparer = string(val)
+		case propCompression:
+			c, err := ParseCompression(string(val))
+			if err != nil {
+				return err
+			}
+			p.Compression = c
+		case propCompressionDict:
+			p.CompressionDict = append([]byte(nil), val...)
+		case propFilter:
+			// a reader not knowing the policy can still read the table, just without the filter
+			p.FilterPolicy = string(val)
+		case propFilterHandle:
+			if len(val) != 8 {
+				return fmt.Errorf("malformed property %q", key)
+			}
+			p.filterHandle = append([]byte(nil), val...)
+		case propFilterType:
+			switch string(val) {
+			case TableFilter.String():
+				p.FilterType = TableFilter
+			case BlockFilter.String():
+				p.FilterType = BlockFilter
+			default:
+				return fmt.Errorf("unknown filter type %q", val)
+			}
+		case propIndexType:
+			if string(val) != "two-level" {
+				return fmt.Errorf("unknown index type %q", val)
+			}
+			p.TwoLevelIndex = true
+		case propLargestKey:
+			p.LargestKey = append([]byte(nil), val...)
+		case propLargestSeqNum:
+			if len(val) != 8 {
+				return fmt.Errorf("malformed property %q", key)
+			}
+			p.LargestSeqNum = binary.LittleEndian.Uint64(val)
+		case propNumEntries:
+			if len(val) != 8 {
+				return fmt.Errorf("malformed property %q", key)
+			}
+			p.NumEntries = binary.LittleEndian.Uint64(val)
+		case propSmallestKey:
+			p.SmallestKey = append([]byte(nil), val...)
+		case propValueLogRefs:
+			if err := p.decodeValueLogRefs(val); err != nil {
+				return fmt.Errorf("malformed property %q", key)
+			}
+		}
+	}
+	return nil
+}
+
+// value log refs = numFiles|{fileNum|bytes}...
+// All fields are uvarints, files are sorted by their file number.
+func (p *Properties) encodeValueLogRefs() []byte {
+	if len(p.ValueLogRefs) == 0 {
+		return nil
+	}
+	fileNums := make([]int, 0, len(p.ValueLogRefs))
+	for fileNum := range p.ValueLogRefs {
+		fileNums = append(fileNums, fileNum)
+	}
+	slices.Sort(fileNums)
+	buf := binary.AppendUvarint(nil, uint64(len(fileNums)))
+	for _, fileNum := range fileNums {
+		buf = binary.AppendUvarint(buf, uint64(fileNum))
+		buf = binary.AppendUvarint(buf, uint64(p.ValueLogRefs[fileNum]))
+	}
+	return buf
+}
+
+func (p *Properties) decodeValueLogRefs(buf []byte) error {
+	numFiles, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return errCorruptBlock
+	}
+	buf = buf[n:]
+	p.ValueLogRefs = make(map[int]int64, numFiles)
+	for i := uint64(0); i < numFiles; i++ {
+		fileNum, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return errCorruptBlock
+		}
+		buf = buf[n:]
+		size, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return errCorruptBlock
+		}
+		buf = buf[n:]
+		p.ValueLogRefs[int(fileNum)] = int64(size)
+	}
+	return nil
+}
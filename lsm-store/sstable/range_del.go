@@ -0,0 +1,43 @@
+package sstable
+
+import (
+	"cmp"
+	"lsm/comparer"
+	"lsm/encoder"
+	"slices"
+)
+
+// range deletion block = regular block with a chunkSize of 1 (start -> encoded end),
+// tombstones are sorted by their start key and, for the same start key, newest first.
+func encodeRangeDels(b *blockWriter, tombstones []encoder.RangeTombstone, e *encoder.Encoder, compare comparer.Compare) error {
+	tombstones = slices.Clone(tombstones)
+	slices.SortFunc(tombstones, func(a, b encoder.RangeTombstone) int {
+		if c := compare(a.Start, b.Start); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.SeqNum, a.SeqNum)
+	})
+	for _, t := range tombstones {
+		if _, err := b.add(t.Start, e.Encode(encoder.OpKindRangeDelete, t.SeqNum, t.End)); err != nil {
+			return err
+		}
+	}
+	return b.finish()
+}
+
+func decodeRangeDels(b *blockReader, e *encoder.Encoder) ([]encoder.RangeTombstone, error) {
+	var tombstones []encoder.RangeTombstone
+	for pos := 0; pos < b.numOffsets; pos++ {
+		_, key, val := b.fetchDataFor(pos)
+		ev := e.Parse(val)
+		if !ev.IsRangeTombstone() {
+			return nil, errCorruptBlock
+		}
+		tombstones = append(tombstones, encoder.RangeTombstone{
+			Start:  append([]byte(nil), key...),
+			End:    ev.Value(),
+			SeqNum: ev.SeqNum(),
+		})
+	}
+	return tombstones, nil
+}
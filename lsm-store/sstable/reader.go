@@ -4,20 +4,28 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/fs"
 	"lsm/encoder"
+	"lsm/filter"
+	"time"
 
-	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
 )
 
 const (
-	footerSizeInBytes = 8 // no.of offsets (4B) + len of index block (4B)
+	blockTrailerSizeInBytes = 8 // no.of offsets (4B) + len of block (4B)
 )
 
 var (
-	ErrKeyNotFound = fmt.Errorf("key not found")
+	// ErrKeyNotFound is returned by Get for a key the table doesn't hold.
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrCorruption is returned by readers with Options.ParanoidChecks for a block failing its
+	// checksum or an index out of order.
+	ErrCorruption = errors.New("sstable: corruption")
 )
 
 type statReaderAtCloser interface {
@@ -26,31 +34,99 @@ type statReaderAtCloser interface {
 	io.Closer
 }
 
+// Reader reads an *.sst file. The footer and the index block are loaded once, when the
+// reader is created, and stay pinned in memory until it is closed. Gets and iterators
+// don't share any scratch buffers, so a Reader is safe for concurrent use.
 type Reader struct {
 	file     statReaderAtCloser
 	br       *bufio.Reader
-	buf      []byte
 	encoder  *encoder.Encoder
 	fileSize int64 //.sst file size
+	opts     Options
 
-	compressionBuf []byte //read compressed data block into this buffer
+	footer    []byte // the block handles of the footer
+	index     *indexReader
+	rangeDels []encoder.RangeTombstone
+	props     Properties
+	// the filter of the whole table, or those of its data blocks (by index position), nil if
+	// the table has no filter the reader knows
+	filter       filter.Filter
+	blockFilters []filter.Filter
+
+	version    FormatVersion
+	footerSize int64 // shorter for FormatLegacy tables
+
+	dictDecoder *zstd.Decoder // zstd with the dictionary of the table (nil if it has none)
+
+	mapping []byte // the whole file with Options.Mmap (nil if it isn't mapped)
 }
 
-func NewReader(file io.Reader) (*Reader, error) {
-	r := &Reader{}
+func NewReader(file io.Reader, opts Options) (_ *Reader, err error) {
+	r := &Reader{opts: opts.ensureDefaults()}
 	r.file, _ = file.(statReaderAtCloser)
 	r.br = bufio.NewReader(file)
-	r.buf = make([]byte, 0, maxBlockSize)
 
 	// retrieve file size immediately
-	err := r.initFileSize()
+	err = r.initFileSize()
+	if err != nil {
+		return nil, err
+	}
+	if r.opts.Mmap {
+		// files that can't be mapped are read with ReadAt as usual
+		if r.mapping, err = mmap(file, r.fileSize); err != nil {
+			r.mapping = nil
+		}
+		defer func() {
+			if err != nil && r.mapping != nil {
+				munmap(r.mapping)
+			}
+		}()
+	}
+	if r.footer, err = r.readFooter(); err != nil {
+		return nil, err
+	}
+	if r.props, err = r.readProperties(); err != nil {
+		return nil, err
+	}
+	// the blocks of the table are only searchable in the order they were written in
+	if r.props.Comparer != "" && r.props.Comparer != r.opts.Comparer.Name {
+		return nil, fmt.Errorf("sstable: keys ordered by comparer %q, not %q", r.props.Comparer, r.opts.Comparer.Name)
+	}
+	if r.props.Compression != DefaultCompression {
+		r.opts.Compression = r.props.Compression
+	}
+	if r.index, err = r.readIndex(); err != nil {
+		return nil, err
+	}
+	if r.opts.ParanoidChecks {
+		if err = r.checkIndex(); err != nil {
+			return nil, err
+		}
+	}
+	// range tombstones are consulted by every read, keep them in memory as well
+	rangeDelBlock, err := r.readMetaBlock(r.footer[0:8])
 	if err != nil {
 		return nil, err
 	}
-	return r, err
+	if r.rangeDels, err = decodeRangeDels(rangeDelBlock, r.encoder); err != nil {
+		return nil, err
+	}
+	if r.props.FilterPolicy == bloomFilterPolicy && r.props.filterHandle != nil {
+		if err = r.readFilter(); err != nil {
+			return nil, err
+		}
+	}
+	if r.props.CompressionDict != nil {
+		r.dictDecoder, err = zstd.NewReader(nil, zstd.WithDecoderDictRaw(dictID, r.props.CompressionDict), zstd.WithDecoderMaxMemory(maxDecodedSize))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
 }
 
 func (r *Reader) sequentialSearch(searchKey []byte) (*encoder.EncodedValue, error) {
+	var scratch []byte
 	for {
 		keyLen, err := binary.ReadUvarint(r.br)
 		if err != nil {
@@ -65,10 +141,10 @@ func (r *Reader) sequentialSearch(searchKey []byte) (*encoder.EncodedValue, erro
 		}
 		needed := int(keyLen + valLen)
 
-		if cap(r.buf) < needed {
-			r.buf = make([]byte, needed)
+		if cap(scratch) < needed {
+			scratch = make([]byte, needed)
 		}
-		buf := r.buf[:needed]
+		buf := scratch[:needed]
 		_, err = io.ReadFull(r.br, buf)
 		if err != nil {
 			return nil, err
@@ -76,7 +152,7 @@ func (r *Reader) sequentialSearch(searchKey []byte) (*encoder.EncodedValue, erro
 		key := buf[:keyLen]
 		val := buf[keyLen:]
 
-		if bytes.Equal(searchKey, key) {
+		if r.opts.Comparer.Compare(searchKey, key) == 0 {
 			return r.encoder.Parse(val), nil
 		}
 	}
@@ -94,43 +170,225 @@ func (r *Reader) initFileSize() error {
 	return nil
 }
 
-// Read the *.sst footer into the supplied buffer -- this takes one disk IO.
+// Read the *.sst footer -- this takes one disk IO -- and return its block handles. The
+// footer ends with the magic number, preceded by the format version the rest of the table
+// is read according to.
 func (r *Reader) readFooter() ([]byte, error) {
-	buf := r.buf[:footerSizeInBytes]
-	footerOffset := r.fileSize - footerSizeInBytes
-	_, err := r.file.ReadAt(buf, footerOffset)
+	if r.fileSize < legacyFooterSizeInBytes {
+		return nil, fmt.Errorf("sstable: file too small (%d bytes) to hold a footer", r.fileSize)
+	}
+	buf := make([]byte, min(r.fileSize, footerSizeInBytes))
+	_, err := r.file.ReadAt(buf, r.fileSize-int64(len(buf)))
 	if err != nil {
 		return nil, err
 	}
-	return buf, nil
+	if len(buf) < footerSizeInBytes || string(buf[footerHandlesSize+4:]) != tableMagic {
+		return r.readLegacyFooter(buf[len(buf)-legacyFooterSizeInBytes:])
+	}
+	r.version = FormatVersion(binary.LittleEndian.Uint32(buf[footerHandlesSize:]))
+	switch r.version {
+	case FormatV1, FormatV2, FormatV3, FormatV4:
+		r.footerSize = footerSizeInBytes
+		return buf[:footerHandlesSize], nil
+	default:
+		return nil, fmt.Errorf("sstable: unsupported format version %d", r.version)
+	}
 }
 
-// initialize it with {#offsets in index block, total length of index block} from the footer.
-// helps with loading entire index block in memory.
-func (r *Reader) prepareBlockReader(buf, footer []byte) *blockReader {
-	numOffsets := int(binary.LittleEndian.Uint32(footer[:4]))
-	indexLength := int(binary.LittleEndian.Uint32(footer[4:]))
-	buf = buf[:indexLength]
-	return &blockReader{
+// readLegacyFooter accepts the last bytes of a file without a magic number as the footer of a
+// FormatLegacy table if the blocks it points to follow each other up to it, the way Finish
+// writes them. Whether the blocks are followed by checksums is only known from the properties,
+// so both layouts are allowed.
+func (r *Reader) readLegacyFooter(handles []byte) ([]byte, error) {
+	end := r.fileSize - legacyFooterSizeInBytes
+	for _, gap := range []int64{0, blockChecksumSize} {
+		expected := int64(binary.LittleEndian.Uint32(handles[0:4]))
+		for i := 0; i < footerHandlesSize; i += 8 {
+			if int64(binary.LittleEndian.Uint32(handles[i:i+4])) != expected {
+				expected = -1
+				break
+			}
+			expected += int64(binary.LittleEndian.Uint32(handles[i+4:i+8])) + gap
+		}
+		if expected == end {
+			r.version, r.footerSize = FormatLegacy, legacyFooterSizeInBytes
+			return handles, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: not an sstable, no magic number in the footer", ErrCorruption)
+}
+
+// FormatVersion returns the format version of the table, read from its footer.
+func (r *Reader) FormatVersion() FormatVersion {
+	return r.version
+}
+
+// initialize it with {#offsets in block, total length of block} from the block trailer. The
+// trailer holds the uncompressed length of the block, whereas the handle pointing to it holds
+// the length on disk, so a trailer that doesn't fit the decoded block is corruption rather than
+// a reason to slice past its end. So are offsets pointing out of the block.
+func (r *Reader) prepareBlockReader(buf []byte) (*blockReader, error) {
+	if len(buf) < blockTrailerSizeInBytes {
+		return nil, errCorruptBlock
+	}
+	trailer := buf[len(buf)-blockTrailerSizeInBytes:]
+	numOffsets := uint64(binary.LittleEndian.Uint32(trailer[:4]))
+	blockLength := uint64(binary.LittleEndian.Uint32(trailer[4:]))
+	if blockLength > uint64(len(buf)) || (numOffsets+2)*4 > blockLength {
+		return nil, errCorruptBlock
+	}
+	buf = buf[:blockLength]
+	b := &blockReader{
 		buf:        buf,
-		offsets:    buf[indexLength-(numOffsets+2)*4:],
-		numOffsets: numOffsets,
+		offsets:    buf[blockLength-(numOffsets+2)*4:],
+		numOffsets: int(numOffsets),
 	}
+	if err := b.validate(); err != nil {
+		return nil, err
+	}
+	return b, nil
 }
 
-// load entire index block into memory.
-func (r *Reader) readIndexBlock(footer []byte) (*blockReader, error) {
-	b := r.prepareBlockReader(r.buf, footer)
-	indexOffset := r.fileSize - int64(len(b.buf))
-	_, err := r.file.ReadAt(b.buf, indexOffset)
+// load an uncompressed block ({offset, length} stored in the footer) into memory.
+func (r *Reader) readMetaBlock(handle []byte) (*blockReader, error) {
+	buf, err := r.readBlock(handle)
 	if err != nil {
 		return nil, err
 	}
-	return b, nil
+	// the properties decoded from a meta block may outlive the mapping of the file
+	return r.prepareBlockReader(r.detach(buf))
+}
+
+// readBlock reads the block at handle ({offset, length}) from disk as it is stored. With
+// ParanoidChecks, it is verified against the checksum following it (if the table has checksums).
+func (r *Reader) readBlock(handle []byte) ([]byte, error) {
+	return r.readBlockVerified(handle, r.opts.ParanoidChecks)
+}
+
+// readBlockVerified reads the block at handle, verifying its checksum if asked to. Every block
+// is followed by at least the footer, so reading the checksum along with the block never runs
+// past the end of the file, even for tables without checksums. The block of a mapped file is
+// a slice of the mapping rather than a copy.
+func (r *Reader) readBlockVerified(handle []byte, verify bool) ([]byte, error) {
+	if len(handle) != 8 {
+		return nil, fmt.Errorf("%w: malformed block handle", ErrCorruption)
+	}
+	offset := binary.LittleEndian.Uint32(handle[:4])
+	length := binary.LittleEndian.Uint32(handle[4:8])
+	n := int64(length)
+	if verify {
+		n += blockChecksumSize
+	}
+	if int64(offset)+int64(length) > r.fileSize-r.footerSize {
+		return nil, fmt.Errorf("%w: block at offset %d runs past the end of the file", ErrCorruption, offset)
+	}
+	var buf []byte
+	if r.mapping != nil {
+		buf = r.mapping[offset : int64(offset)+n : int64(offset)+n]
+	} else {
+		buf = make([]byte, n)
+		if _, err := r.file.ReadAt(buf, int64(offset)); err != nil {
+			return nil, err
+		}
+	}
+	if !verify {
+		return buf, nil
+	}
+	return r.verifyBlock(buf, offset)
+}
+
+// verifyBlock verifies the block at offset, read along with the checksum following it, and
+// returns it without the checksum.
+func (r *Reader) verifyBlock(buf []byte, offset uint32) ([]byte, error) {
+	buf, sum := buf[:len(buf)-blockChecksumSize], buf[len(buf)-blockChecksumSize:]
+	if r.props.Checksums && crc32.Checksum(buf, crcTable) != binary.LittleEndian.Uint32(sum) {
+		return nil, fmt.Errorf("%w: checksum mismatch of block at offset %d", ErrCorruption, offset)
+	}
+	return buf, nil
+}
+
+// checkIndex verifies that the index keys are in increasing order and that the data blocks
+// they point to follow each other up to the range deletion block, and that the top-level index
+// of a two-level index agrees with its partitions.
+func (r *Reader) checkIndex() error {
+	var prevKey []byte
+	var expected uint32
+	for pos := 0; pos < r.index.numOffsets; pos++ {
+		_, key, handle := r.index.fetchDataFor(pos)
+		if len(handle) != 8 {
+			return fmt.Errorf("%w: malformed index entry %d", ErrCorruption, pos)
+		}
+		if pos > 0 && r.opts.Comparer.Compare(prevKey, key) >= 0 {
+			return fmt.Errorf("%w: index key %q out of order", ErrCorruption, key)
+		}
+		if offset := binary.LittleEndian.Uint32(handle[:4]); offset != expected {
+			return fmt.Errorf("%w: data block at offset %d, expected %d", ErrCorruption, offset, expected)
+		}
+		expected += binary.LittleEndian.Uint32(handle[4:8])
+		if r.props.Checksums {
+			expected += blockChecksumSize
+		}
+		prevKey = key
+	}
+	if rangeDelOffset := binary.LittleEndian.Uint32(r.footer[0:4]); rangeDelOffset != expected {
+		return fmt.Errorf("%w: data blocks end at offset %d, expected %d", ErrCorruption, expected, rangeDelOffset)
+	}
+	// the top-level index has to hold the last index key of every partition
+	for i := 0; r.index.top != nil && i < len(r.index.partitions); i++ {
+		last := r.index.readKeyAt(r.index.starts[i] + r.index.partitions[i].numOffsets - 1)
+		if key := r.index.top.readKeyAt(i); r.opts.Comparer.Compare(key, last) != 0 {
+			return fmt.Errorf("%w: top-level index key %q of partition %d, expected %q", ErrCorruption, key, i, last)
+		}
+	}
+	return nil
+}
+
+// ApproximateOffset returns the approximate offset in the *.sst file of the data for key,
+// i.e. the offset of the data block that holds key (or would hold it), found through the
+// index block without any disk IO. Keys past the last data block map to the end of the data.
+func (r *Reader) ApproximateOffset(key []byte) int64 {
+	pos := r.index.search(r.opts.Comparer.Compare, key, moveUpWhenKeyGT)
+	if pos >= r.index.numOffsets {
+		// the range deletion block directly follows the data blocks
+		return int64(binary.LittleEndian.Uint32(r.footer[0:4]))
+	}
+	return int64(binary.LittleEndian.Uint32(r.index.readValAt(pos)[:4]))
+}
+
+// Properties returns the properties of the *.sst file, loaded along with the reader.
+func (r *Reader) Properties() (*Properties, error) {
+	props := r.props
+	return &props, nil
+}
+
+// load the properties block of the *.sst file.
+func (r *Reader) readProperties() (Properties, error) {
+	var props Properties
+	b, err := r.readMetaBlock(r.footer[8:16])
+	if err != nil {
+		return props, err
+	}
+	if err = props.decode(b); err != nil {
+		return props, err
+	}
+	// whether the block has a checksum to verify is only known after decoding it
+	if r.opts.ParanoidChecks && props.Checksums {
+		r.props.Checksums = true
+		if _, err = r.readBlock(r.footer[8:16]); err != nil {
+			return props, err
+		}
+	}
+	return props, nil
+}
+
+// RangeTombstones returns the range tombstones of the table, sorted by start key.
+// They are not applied by Get or the Iterator, which only see kv-pairs.
+func (r *Reader) RangeTombstones() []encoder.RangeTombstone {
+	return r.rangeDels
 }
 
 func (r *Reader) sequentialSearchChunk(chunk []byte, searchKey []byte) (*encoder.EncodedValue, error) {
-	var prefixKey []byte
+	var prefixKey, scratch []byte
 	var offset int
 	for {
 		var keyLen, valLen uint64
@@ -140,21 +398,34 @@ func (r *Reader) sequentialSearchChunk(chunk []byte, searchKey []byte) (*encoder
 		}
 		offset += n
 		keyLen, n = binary.Uvarint(chunk[offset:])
+		if n <= 0 {
+			return nil, errCorruptBlock
+		}
 		offset += n
 		valLen, n = binary.Uvarint(chunk[offset:])
+		if n <= 0 {
+			return nil, errCorruptBlock
+		}
 		offset += n
+		if rest := uint64(len(chunk) - offset); keyLen > rest || valLen > rest-keyLen || sharedLen > uint64(len(prefixKey)) {
+			return nil, errCorruptBlock
+		}
 
-		key := r.buf[:sharedLen+keyLen]
-		if sharedLen == 0 {
-			prefixKey = key
+		// prefixKey keeps pointing at the previous buffer when scratch has to grow
+		if needed := int(sharedLen + keyLen); cap(scratch) < needed {
+			scratch = make([]byte, needed)
 		}
+		key := scratch[:sharedLen+keyLen]
 		copy(key[:sharedLen], prefixKey[:sharedLen])
+		if sharedLen == 0 || r.version >= FormatV3 {
+			prefixKey = key
+		}
 		copy(key[sharedLen:sharedLen+keyLen], chunk[offset:offset+int(keyLen)])
 		val := chunk[offset+int(keyLen) : offset+int(keyLen)+int(valLen)]
 
-		cmp := bytes.Compare(searchKey, key)
+		cmp := r.opts.Comparer.Compare(searchKey, key)
 		if cmp == 0 {
-			return r.encoder.Parse(val), nil
+			return r.encoder.Parse(r.detach(val)), nil
 		}
 		if cmp < 0 {
 			break // Key is not present in this data block.
@@ -165,69 +436,221 @@ func (r *Reader) sequentialSearchChunk(chunk []byte, searchKey []byte) (*encoder
 }
 
 // load data block into memory.
-func (r *Reader) readDataBlock(indexEntry []byte) (*blockReader, error) {
-	var err error
-	val := r.encoder.Parse(indexEntry).Value()
-	offset := binary.LittleEndian.Uint32(val[:4]) // data block offset in *.sst file
-	length := binary.LittleEndian.Uint32(val[4:]) // data block length
-	buf := r.buf[:length]
-	_, err = r.file.ReadAt(buf, int64(offset))
+func (r *Reader) readDataBlock(indexEntry []byte, ro ReadOptions) (*blockReader, error) {
+	offset := binary.LittleEndian.Uint32(indexEntry[:4]) // data block offset in *.sst file
+	// an uncompressed block of a mapped file is used in place, so it mustn't outlive the reader
+	// in the cache. The page cache keeps it anyway.
+	cached := r.opts.BlockCache != nil && (r.mapping == nil || r.compressed())
+	// serve hot data blocks straight from the cache, without any disk IO or decompression
+	if cached {
+		if buf, ok := r.opts.BlockCache.Get(r.opts.FileNum, uint64(offset)); ok {
+			return r.prepareBlockReader(buf)
+		}
+	}
+	var start time.Time
+	if r.opts.OnBlockRead != nil {
+		start = time.Now()
+	}
+	buf, err := r.readBlockVerified(indexEntry, r.opts.ParanoidChecks || ro.VerifyChecksums)
 	if err != nil {
 		return nil, err
 	}
-	buf, err = snappy.Decode(r.compressionBuf, buf)
+	size := len(buf)
+	if buf, err = r.decompress(buf); err != nil {
+		return nil, err
+	}
+	if r.opts.OnBlockRead != nil {
+		r.opts.OnBlockRead(start, size)
+	}
+	b, err := r.prepareBlockReader(buf)
 	if err != nil {
 		return nil, err
 	}
-	b := r.prepareBlockReader(buf, buf[len(buf)-footerSizeInBytes:])
+	if cached && !ro.DontFillCache {
+		r.opts.BlockCache.Set(r.opts.FileNum, uint64(offset), buf)
+	}
 	return b, nil
 }
 
-func (r *Reader) binarySearch(searchKey []byte) (*encoder.EncodedValue, error) {
-	footer, err := r.readFooter()
-	if err != nil {
-		return nil, err
+// decompress decodes a data block read from disk, with the dictionary of the table if it has one.
+// An uncompressed block is returned as it is, the buffer it was read into being its own.
+func (r *Reader) decompress(buf []byte) ([]byte, error) {
+	if r.dictDecoder != nil {
+		return r.dictDecoder.DecodeAll(buf, nil)
 	}
+	if !r.compressed() {
+		return buf, nil
+	}
+	return r.opts.Compression.decompress(nil, buf)
+}
 
-	// Search index block for data block.
-	index, err := r.readIndexBlock(footer)
-	if err != nil {
-		return nil, err
+// compressed reports whether the data blocks of the table are compressed.
+func (r *Reader) compressed() bool {
+	return r.opts.Compression != NoCompression
+}
+
+// detach copies b if it is a slice of the mapping of the file, which it would otherwise not
+// be allowed to outlive.
+func (r *Reader) detach(b []byte) []byte {
+	if r.mapping == nil {
+		return b
+	}
+	return bytes.Clone(b)
+}
+
+func (r *Reader) binarySearch(searchKey []byte, ro ReadOptions) (*encoder.EncodedValue, error) {
+	if r.filter != nil && !r.filter.MayContain(searchKey) {
+		return nil, ErrKeyNotFound
 	}
-	pos := index.search(searchKey, moveUpWhenKeyGT)
+	// Search the pinned index block for data block.
+	index := r.index
+	pos := index.search(r.opts.Comparer.Compare, searchKey, moveUpWhenKeyGT)
 	if pos >= index.numOffsets {
 		// searchKey is greater than the largest key in the current *.sst
 		return nil, ErrKeyNotFound
 	}
+	if !r.blockMayContain(pos, searchKey) {
+		return nil, ErrKeyNotFound
+	}
 	indexEntry := index.readValAt(pos)
 
 	// Search data block for data chunk.
-	data, err := r.readDataBlock(indexEntry)
+	data, err := r.readDataBlock(indexEntry, ro)
 	if err != nil {
 		return nil, err
 	}
-	offset := data.search(searchKey, moveUpWhenKeyGTE)
+	return r.searchDataBlock(data, searchKey)
+}
+
+// searchDataBlock searches a loaded data block for key.
+func (r *Reader) searchDataBlock(data *blockReader, searchKey []byte) (*encoder.EncodedValue, error) {
+	offset := data.search(r.opts.Comparer.Compare, searchKey, moveUpWhenKeyGTE)
 	if offset <= 0 {
 		return nil, ErrKeyNotFound
 	}
 	chunkStart := data.readOffsetAt(offset - 1)
-	chunkEnd := data.readOffsetAt(offset)
+	// the last data chunk ends where the offsets of the data block begin
+	chunkEnd := len(data.buf) - len(data.offsets)
+	if offset < data.numOffsets {
+		chunkEnd = data.readOffsetAt(offset)
+	}
 	chunk := data.buf[chunkStart:chunkEnd]
 
 	// Search data chunk for key.
 	return r.sequentialSearchChunk(chunk, searchKey)
 }
 
+// MayContain reports whether the table may contain key according to its filters, without any
+// IO. Tables without a filter may contain any key.
+func (r *Reader) MayContain(key []byte) bool {
+	if r.filter != nil {
+		return r.filter.MayContain(key)
+	}
+	if r.blockFilters == nil {
+		return true
+	}
+	pos := r.index.search(r.opts.Comparer.Compare, key, moveUpWhenKeyGT)
+	return pos < r.index.numOffsets && r.blockMayContain(pos, key)
+}
+
+// blockMayContain reports whether the data block at index position pos may contain key
+// according to its filter (true without block filters).
+func (r *Reader) blockMayContain(pos int, key []byte) bool {
+	return r.blockFilters == nil || r.blockFilters[pos].MayContain(key)
+}
+
+// readFilter loads the filter block, the filter of the whole table or those of its data blocks.
+func (r *Reader) readFilter() error {
+	buf, err := r.readBlock(r.props.filterHandle)
+	if err != nil {
+		return err
+	}
+	buf = r.detach(buf)
+	if r.props.FilterType != BlockFilter {
+		r.filter = filter.Filter(buf)
+		return nil
+	}
+	if len(buf) < 4 {
+		return fmt.Errorf("%w: malformed filter block", ErrCorruption)
+	}
+	numFilters := int(binary.LittleEndian.Uint32(buf[len(buf)-4:]))
+	if numFilters != r.index.numOffsets || (numFilters+1)*4 > len(buf) {
+		return fmt.Errorf("%w: %d block filters for %d data blocks", ErrCorruption, numFilters, r.index.numOffsets)
+	}
+	ends := buf[len(buf)-(numFilters+1)*4 : len(buf)-4]
+	filters := buf[:len(buf)-len(ends)-4]
+	r.blockFilters = make([]filter.Filter, numFilters)
+	start := uint32(0)
+	for i := range r.blockFilters {
+		end := binary.LittleEndian.Uint32(ends[i*4:])
+		if end < start || int(end) > len(filters) {
+			return fmt.Errorf("%w: malformed filter block", ErrCorruption)
+		}
+		r.blockFilters[i] = filter.Filter(filters[start:end:end])
+		start = end
+	}
+	return nil
+}
+
 func (r *Reader) Get(searchKey []byte) (*encoder.EncodedValue, error) {
-	return r.binarySearch(searchKey)
+	return r.binarySearch(searchKey, ReadOptions{})
+}
+
+// GetWithOptions is Get, loading the data block of searchKey as ro says.
+func (r *Reader) GetWithOptions(searchKey []byte, ro ReadOptions) (*encoder.EncodedValue, error) {
+	return r.binarySearch(searchKey, ro)
+}
+
+// MultiGet looks up several keys, which have to be sorted. Neighbouring keys falling into the
+// same data block share a single read of it. Returns the encoded value of every key, nil for
+// the keys that aren't in the table.
+func (r *Reader) MultiGet(keys [][]byte) ([]*encoder.EncodedValue, error) {
+	vals := make([]*encoder.EncodedValue, len(keys))
+	var data *blockReader
+	loaded := -1 // index position of the data block loaded
+	for i, key := range keys {
+		if r.filter != nil && !r.filter.MayContain(key) {
+			continue
+		}
+		pos := r.index.search(r.opts.Comparer.Compare, key, moveUpWhenKeyGT)
+		if pos >= r.index.numOffsets {
+			break // this and all following keys are greater than the largest key in the table
+		}
+		if !r.blockMayContain(pos, key) {
+			continue
+		}
+		if pos != loaded {
+			var err error
+			if data, err = r.readDataBlock(r.index.readValAt(pos), ReadOptions{}); err != nil {
+				return nil, err
+			}
+			loaded = pos
+		}
+		val, err := r.searchDataBlock(data, key)
+		if err != nil && err != ErrKeyNotFound {
+			return nil, err
+		}
+		vals[i] = val
+	}
+	return vals, nil
 }
 
 func (r *Reader) Close() error {
+	if r.dictDecoder != nil {
+		r.dictDecoder.Close()
+	}
+	if r.mapping != nil {
+		if err := munmap(r.mapping); err != nil {
+			return err
+		}
+		r.mapping = nil
+	}
 	err := r.file.Close()
 	if err != nil {
 		return err
 	}
 	r.file = nil
 	r.br = nil
+	r.index = nil
 	return nil
 }
@@ -0,0 +1,276 @@
+package sstable
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"lsm/encoder"
+	"lsm/storage"
+	"slices"
+	"testing"
+)
+
+// writeTestTable writes the kv-pairs keys[i] -> vals[i] (raw values, encoded as sets) and the
+// range tombstones to a table held in memory.
+func writeTestTable(t testing.TB, opts Options, keys, vals [][]byte, tombstones []encoder.RangeTombstone) []byte {
+	e := encoder.NewEncoder()
+	encoded := make([][]byte, len(vals))
+	for i, val := range vals {
+		encoded[i] = e.Encode(encoder.OpKindSet, uint64(i+1), val)
+	}
+	data, err := writeEncodedTable(opts, keys, encoded, tombstones)
+	if err != nil {
+		t.Fatalf("writing the table: %v", err)
+	}
+	return data
+}
+
+// writeEncodedTable writes the kv-pairs keys[i] -> vals[i], vals being encoded values, and the
+// range tombstones to a table held in memory.
+func writeEncodedTable(opts Options, keys, vals [][]byte, tombstones []encoder.RangeTombstone) ([]byte, error) {
+	fs := storage.NewMemFS()
+	f, err := fs.Create("/table")
+	if err != nil {
+		return nil, err
+	}
+	w := NewWriter(f, opts)
+	for i, key := range keys {
+		if err := w.Add(key, vals[i]); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	for _, rt := range tombstones {
+		w.AddRangeTombstone(rt)
+	}
+	if err := w.Finish(); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if f, err = fs.Open("/table"); err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// openTestTable opens a table held in memory.
+func openTestTable(data []byte, opts Options) (*Reader, error) {
+	fs := storage.NewMemFS()
+	f, err := fs.Create("/table")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Write(data); err != nil {
+		return nil, err
+	}
+	if err = f.Close(); err != nil {
+		return nil, err
+	}
+	if f, err = fs.Open("/table"); err != nil {
+		return nil, err
+	}
+	r, err := NewReader(f, opts)
+	if err != nil {
+		f.Close()
+	}
+	return r, err
+}
+
+// fuzzTables returns tables written with the various options a table can be written with.
+func fuzzTables(t testing.TB) [][]byte {
+	var keys, vals [][]byte
+	for i := 0; i < 200; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key%04d", i)))
+		vals = append(vals, bytes.Repeat([]byte{byte(i)}, i%50))
+	}
+	tombstones := []encoder.RangeTombstone{{Start: []byte("key0010"), End: []byte("key0020"), SeqNum: 500}}
+	var tables [][]byte
+	for _, opts := range []Options{
+		{},
+		{BlockSize: 256, BlockChunkSize: 1},
+		{Compression: SnappyCompression, FilterBitsPerKey: 10},
+		{Compression: ZstdCompression, CompressionDictSize: 1 << 10, FilterBitsPerKey: 10, FilterType: BlockFilter},
+		{Compression: LZ4Compression, BlockSize: 512},
+	} {
+		tables = append(tables, writeTestTable(t, opts, keys, vals, tombstones))
+	}
+	tables = append(tables, writeTestTable(t, Options{}, nil, nil, nil))
+	return tables
+}
+
+// FuzzSSTableReader opens arbitrary files as tables, with and without ParanoidChecks, and reads
+// them every way a table can be read: damaged tables have to be rejected with an error rather
+// than a panic. The kv-pairs of a table passing Verify are written to a new table, which has to
+// read back the same kv-pairs.
+func FuzzSSTableReader(f *testing.F) {
+	for _, table := range fuzzTables(f) {
+		f.Add(table)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, paranoid := range []bool{false, true} {
+			keys, vals, ok := readFuzzTable(t, data, Options{ParanoidChecks: paranoid})
+			if !ok || !strictlyIncreasing(keys) {
+				continue
+			}
+			table, err := writeEncodedTable(Options{}, keys, vals, nil)
+			if err != nil {
+				continue // values the writer can't make sense of, e.g. malformed pointers
+			}
+			again, againVals, ok := readFuzzTable(t, table, Options{ParanoidChecks: true})
+			if !ok || len(again) != len(keys) {
+				t.Fatalf("%d kv-pairs written, %d read back", len(keys), len(again))
+			}
+			for i := range keys {
+				if !bytes.Equal(again[i], keys[i]) || !bytes.Equal(againVals[i], vals[i]) {
+					t.Fatalf("kv-pair %d read back as %q, written as %q", i, again[i], keys[i])
+				}
+			}
+		}
+	})
+}
+
+func strictlyIncreasing(keys [][]byte) bool {
+	for i := 1; i < len(keys); i++ {
+		if bytes.Compare(keys[i-1], keys[i]) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// readFuzzTable reads data as a table every way a table can be read, and returns its kv-pairs
+// in the order the iterator returned them. It reports whether the table opened, passed Verify
+// and was read without errors. An iterator and ScanAll have to agree.
+func readFuzzTable(t *testing.T, data []byte, opts Options) (keys, vals [][]byte, ok bool) {
+	r, err := openTestTable(data, opts)
+	if err != nil {
+		return nil, nil, false
+	}
+	defer r.Close()
+	verifyErr := r.Verify()
+	_ = r.Layout()
+	_ = r.RangeTombstones()
+
+	it, err := r.NewIter()
+	if err != nil {
+		return nil, nil, false
+	}
+	defer it.Close()
+	for valid := it.First(); valid; valid = it.Next() {
+		keys = append(keys, bytes.Clone(it.Key()))
+		vals = append(vals, bytes.Clone(it.Value()))
+	}
+	iterErr := it.Error()
+	for valid := it.Last(); valid; valid = it.Prev() {
+	}
+	for _, key := range keys {
+		_, _ = r.Get(key)
+		_ = r.MayContain(key)
+		_ = r.ApproximateOffset(key)
+		it.SeekGE(key)
+		it.SeekLT(key)
+	}
+	if slices.IsSortedFunc(keys, bytes.Compare) {
+		_, _ = r.MultiGet(keys)
+	}
+
+	i := 0
+	scanErr := r.ScanAll(func(key, val []byte) error {
+		if i >= len(keys) || !bytes.Equal(key, keys[i]) || !bytes.Equal(val, vals[i]) {
+			return fmt.Errorf("ScanAll returned %q at position %d, not what the iterator returned", key, i)
+		}
+		i++
+		return nil
+	})
+	if iterErr == nil && scanErr == nil && i != len(keys) {
+		t.Fatalf("ScanAll returned %d kv-pairs, the iterator %d", i, len(keys))
+	}
+	if iterErr == nil && scanErr != nil && !errors.Is(scanErr, ErrCorruption) {
+		t.Fatal(scanErr)
+	}
+	if verifyErr != nil || iterErr != nil || scanErr != nil {
+		return nil, nil, false
+	}
+	// the kv-pairs of a valid table in key order are found by lookups too
+	for i := 0; i < len(keys) && strictlyIncreasing(keys); i++ {
+		if ev, err := r.Get(keys[i]); err != nil || !bytes.Equal(ev.Value(), r.encoder.Parse(vals[i]).Value()) {
+			t.Fatalf("Get(%q) of a key of the table: %v", keys[i], err)
+		}
+	}
+	return keys, vals, true
+}
+
+// FuzzBlockReader decodes arbitrary blocks, of the format version their first byte picks: a
+// malformed block has to be rejected with an error rather than a panic. The entries of a block
+// decoded without errors are written to a new block, which has to decode to the same entries.
+func FuzzBlockReader(f *testing.F) {
+	for _, table := range fuzzTables(f) {
+		r, err := openTestTable(table, Options{})
+		if err != nil {
+			f.Fatal(err)
+		}
+		l := r.Layout()
+		if r.compressed() {
+			r.Close()
+			continue
+		}
+		for _, e := range l.Data {
+			f.Add(append([]byte{byte(l.Version)}, table[e.Block.Offset:e.Block.Offset+e.Block.Length]...))
+		}
+		r.Close()
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) == 0 {
+			return
+		}
+		version := FormatVersion(data[0] % (uint8(FormatV4) + 1))
+		if _, err := CheckBlock(data[1:], version); err != nil {
+			return
+		}
+		entries := decodeFuzzBlock(t, data[1:], version)
+		keys := make([][]byte, len(entries))
+		for i, e := range entries {
+			keys[i] = e.key
+		}
+		if !strictlyIncreasing(keys) {
+			return
+		}
+		w := newBlockWriter(1+int(data[0]>>4), 4096)
+		for _, e := range entries {
+			if _, err := w.add(e.key, e.val); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.finish(); err != nil {
+			t.Fatal(err)
+		}
+		again := decodeFuzzBlock(t, w.buf.Bytes(), FormatV4)
+		if len(again) != len(entries) {
+			t.Fatalf("%d entries written, %d read back", len(entries), len(again))
+		}
+		for i := range entries {
+			if !bytes.Equal(again[i].key, entries[i].key) || !bytes.Equal(again[i].val, entries[i].val) {
+				t.Fatalf("entry %d read back as %q, written as %q", i, again[i].key, entries[i].key)
+			}
+		}
+	})
+}
+
+// decodeFuzzBlock decodes a block CheckBlock accepted, and returns its entries.
+func decodeFuzzBlock(t *testing.T, buf []byte, version FormatVersion) []blockEntry {
+	b, err := parseBlock(buf)
+	if err != nil {
+		t.Fatalf("parsing a valid block: %v", err)
+	}
+	r := &Reader{opts: Options{}.ensureDefaults(), encoder: encoder.NewEncoder(), version: version}
+	entries, err := r.decodeEntries(b)
+	if err != nil {
+		t.Fatalf("decoding a valid block: %v", err)
+	}
+	return entries
+}
@@ -0,0 +1,247 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// RepairStats tells what Repair salvaged from a damaged table, and what it had to drop.
+type RepairStats struct {
+	Entries         int // kv-pairs written to the repaired table
+	RangeTombstones int
+	DroppedEntries  int   // decoded, but malformed or out of order
+	DroppedBlocks   int   // data blocks failing their checksum or not decoding
+	DroppedBytes    int64 // of the dropped data blocks
+	// RangeDelsLost is set if the range deletion block couldn't be read: whatever its range
+	// tombstones deleted is visible again once the repaired table is used.
+	RangeDelsLost bool
+	// IndexLost is set if the index couldn't be read, and the data blocks were found by
+	// scanning the table for their checksums instead.
+	IndexLost bool
+}
+
+// maxScannedBlockSize bounds the length of a data block found by scanning a table whose index is
+// lost. Only blocks holding oversized kv-pairs are longer than that.
+const maxScannedBlockSize = 1 << 20
+
+// Repair salvages the damaged table at path, e.g. after a block failed its checksum: it reads
+// the data blocks one after the other, skipping those that are damaged, and rewrites every
+// kv-pair that can still be read, along with the range tombstones, to a fresh table replacing
+// the one at path. The damaged table is kept as path.damaged. Only the footer is needed to find
+// the data blocks; if the index is damaged too, they are found by their checksums.
+//
+// The options have to match the ones the table was written with, apart from the compression,
+// which is taken from its properties if they can be read. The repaired table is written with
+// them.
+func Repair(path string, opts Options) (RepairStats, error) {
+	var stats RepairStats
+	f, err := os.Open(path)
+	if err != nil {
+		return stats, err
+	}
+	defer f.Close()
+	// every block is verified against its checksum, whatever the options say
+	r := &Reader{file: f, opts: opts.ensureDefaults()}
+	r.opts.ParanoidChecks, r.opts.Mmap, r.opts.BlockCache = true, false, nil
+	if err = r.initFileSize(); err != nil {
+		return stats, err
+	}
+	if r.footer, err = r.readFooter(); err != nil {
+		return stats, fmt.Errorf("sstable: can't repair a table without a footer: %w", err)
+	}
+	if r.props, err = r.readProperties(); err != nil {
+		// checksums were added before the format version, so only legacy tables may lack them
+		r.props = Properties{Checksums: r.version != FormatLegacy}
+	}
+	if r.props.Comparer != "" && r.props.Comparer != r.opts.Comparer.Name {
+		return stats, fmt.Errorf("sstable: keys ordered by comparer %q, not %q", r.props.Comparer, r.opts.Comparer.Name)
+	}
+	if r.props.Compression != DefaultCompression {
+		r.opts.Compression = r.props.Compression
+	}
+	if r.props.CompressionDict != nil {
+		if r.dictDecoder, err = zstd.NewReader(nil, zstd.WithDecoderDictRaw(dictID, r.props.CompressionDict), zstd.WithDecoderMaxMemory(maxDecodedSize)); err != nil {
+			return stats, err
+		}
+		defer r.dictDecoder.Close()
+	}
+
+	handles, err := r.dataBlockHandles(&stats)
+	if err != nil {
+		return stats, err
+	}
+
+	tmpPath := path + ".repair"
+	out, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return stats, err
+	}
+	w := NewWriter(out, r.opts)
+	if err = r.salvage(w, handles, &stats); err == nil {
+		err = w.Finish()
+	}
+	if err == nil {
+		err = w.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return stats, err
+	}
+	if err = os.Rename(path, path+".damaged"); err != nil {
+		return stats, err
+	}
+	return stats, os.Rename(tmpPath, path)
+}
+
+// dataBlockHandles returns the handles of the data blocks of the table, from the index if it
+// can be read, otherwise by scanning the table for them.
+func (r *Reader) dataBlockHandles(stats *RepairStats) ([][]byte, error) {
+	var err error
+	if r.index, err = r.readIndex(); err == nil {
+		handles := make([][]byte, r.index.numOffsets)
+		for pos := range handles {
+			handles[pos] = r.index.readValAt(pos)
+		}
+		return handles, nil
+	}
+	r.index, stats.IndexLost = nil, true
+	if !r.props.Checksums {
+		return nil, fmt.Errorf("sstable: can't repair a table without checksums nor an index: %w", err)
+	}
+	return r.scanDataBlocks(stats)
+}
+
+// scanDataBlocks finds the data blocks of a table whose index is lost. The data blocks follow
+// each other from the start of the file up to the range deletion block, each followed by its
+// checksum, so a block ends where the bytes following it are the checksum of the bytes since
+// the end of the block before, and they decode to a block. Past a damaged block, every offset
+// is tried as the start of the next one, and the bytes skipped count as a dropped block. As that
+// takes a checksum per offset and length tried, the blocks tried there are only a few times
+// BlockSize long: a longer one right after a damaged block is dropped along with it.
+func (r *Reader) scanDataBlocks(stats *RepairStats) ([][]byte, error) {
+	end := int64(binary.LittleEndian.Uint32(r.footer[0:4]))
+	if end > r.fileSize-r.footerSize {
+		return nil, fmt.Errorf("%w: range deletion block at offset %d past the end of the file", ErrCorruption, end)
+	}
+	data := make([]byte, end)
+	if _, err := r.file.ReadAt(data, 0); err != nil {
+		return nil, err
+	}
+	var handles [][]byte
+	skipped := 0
+	for start := 0; start < len(data); {
+		limit := maxScannedBlockSize
+		if skipped > 0 {
+			limit = 4 * r.opts.BlockSize
+		}
+		length, ok := r.scanDataBlock(data[start:], limit)
+		if !ok {
+			start++
+			skipped++
+			continue
+		}
+		if skipped > 0 {
+			stats.DroppedBlocks++
+			stats.DroppedBytes += int64(skipped)
+			skipped = 0
+		}
+		handle := make([]byte, 8)
+		binary.LittleEndian.PutUint32(handle[:4], uint32(start))
+		binary.LittleEndian.PutUint32(handle[4:], uint32(length))
+		handles = append(handles, handle)
+		start += length + blockChecksumSize
+	}
+	if skipped > 0 {
+		stats.DroppedBlocks++
+		stats.DroppedBytes += int64(skipped)
+	}
+	return handles, nil
+}
+
+// scanDataBlock returns the length of the data block data starts with, if it starts with one
+// no longer than limit.
+func (r *Reader) scanDataBlock(data []byte, limit int) (int, bool) {
+	var sum uint32
+	for n := 1; n <= limit && n+blockChecksumSize <= len(data); n++ {
+		sum = crc32.Update(sum, crcTable, data[n-1:n])
+		if sum != binary.LittleEndian.Uint32(data[n:]) {
+			continue
+		}
+		if buf, err := r.decompress(data[:n]); err == nil {
+			if _, err = parseBlock(buf); err == nil {
+				return n, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// salvage writes the kv-pairs of the data blocks at handles that can be read to w, in strictly
+// increasing key order, followed by the range tombstones.
+func (r *Reader) salvage(w *Writer, handles [][]byte, stats *RepairStats) error {
+	cmp := r.opts.Comparer.Compare
+	var lastKey []byte
+	for _, handle := range handles {
+		entries, err := r.salvageBlock(handle)
+		if err != nil {
+			stats.DroppedBlocks++
+			stats.DroppedBytes += int64(binary.LittleEndian.Uint32(handle[4:8]))
+			continue
+		}
+		for _, e := range entries {
+			if !r.encoder.Parse(e.val).Valid() ||
+				(lastKey != nil && cmp(e.key, lastKey) <= 0) {
+				stats.DroppedEntries++
+				continue
+			}
+			if err = w.Add(e.key, e.val); err != nil {
+				return err
+			}
+			lastKey = e.key
+			stats.Entries++
+		}
+	}
+
+	b, err := r.readMetaBlock(r.footer[0:8])
+	if err == nil {
+		r.rangeDels, err = decodeRangeDels(b, r.encoder)
+	}
+	if err != nil {
+		stats.RangeDelsLost = true
+		return nil
+	}
+	for _, t := range r.rangeDels {
+		w.AddRangeTombstone(t)
+	}
+	stats.RangeTombstones = len(r.rangeDels)
+	return nil
+}
+
+// salvageBlock reads and decodes the data block at handle.
+func (r *Reader) salvageBlock(handle []byte) ([]blockEntry, error) {
+	buf, err := r.readBlockVerified(handle, r.props.Checksums)
+	if err != nil {
+		return nil, err
+	}
+	if buf, err = r.decompress(buf); err != nil {
+		return nil, err
+	}
+	data, err := parseBlock(buf)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := r.decodeEntries(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, errCorruptBlock
+	}
+	return entries, nil
+}
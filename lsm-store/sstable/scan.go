@@ -0,0 +1,136 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// scanReadAhead is how much ScanAll reads from disk at once: data blocks following each
+	// other are read with a single ReadAt up to that size.
+	scanReadAhead = 256 << 10
+	// scanQueueDepth is how many decoded data blocks the worker of ScanAll may be ahead of fn.
+	scanQueueDepth = 8
+)
+
+// scannedBlock is a data block decoded by the worker of ScanAll, or the error it stopped at.
+type scannedBlock struct {
+	entries []blockEntry
+	err     error
+}
+
+// ScanAll calls fn with every kv-pair of the table, in key order, stopping at the first error
+// fn returns, which ScanAll returns. Unlike an Iterator, it reads the table front to back in
+// large sequential reads, several data blocks at a time, and a worker reads and decompresses
+// the blocks ahead of fn, so that fn never waits for the disk once the worker is ahead. It is
+// meant for full-table passes like exports, where the lookups an Iterator is built for don't
+// pay off. The blocks bypass the block cache, so a scan doesn't evict the blocks of Gets.
+//
+// The key and the value are only valid until fn returns.
+func (r *Reader) ScanAll(fn func(key, val []byte) error) error {
+	blocks := make(chan scannedBlock, scanQueueDepth)
+	done := make(chan struct{})
+	go r.scanBlocks(blocks, done)
+	// the worker reads from the file, so it has to be done before the reader may be closed
+	defer func() {
+		close(done)
+		for range blocks {
+		}
+	}()
+	for b := range blocks {
+		if b.err != nil {
+			return b.err
+		}
+		for _, e := range b.entries {
+			if err := fn(e.key, e.val); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scanBlocks is the worker of ScanAll: it decodes the data blocks in order and sends them to
+// out, until it is done with them, runs into an error or done is closed.
+func (r *Reader) scanBlocks(out chan<- scannedBlock, done <-chan struct{}) {
+	defer close(out)
+	send := func(b scannedBlock) bool {
+		select {
+		case out <- b:
+			return b.err == nil
+		case <-done:
+			return false
+		}
+	}
+	for pos := 0; pos < r.index.numOffsets; {
+		bufs, err := r.readAhead(pos)
+		if err != nil {
+			send(scannedBlock{err: err})
+			return
+		}
+		for _, buf := range bufs {
+			var b scannedBlock
+			if buf, b.err = r.decompress(buf); b.err == nil {
+				var data *blockReader
+				if data, b.err = r.prepareBlockReader(buf); b.err == nil {
+					b.entries, b.err = r.decodeEntries(data)
+				}
+			}
+			if !send(b) {
+				return
+			}
+		}
+		pos += len(bufs)
+	}
+}
+
+// readAhead reads the data block at pos along with those following it on disk, up to
+// scanReadAhead bytes, with a single read, and returns them as stored (verified with
+// ParanoidChecks). A mapped file is already in memory, so only the block at pos is returned.
+func (r *Reader) readAhead(pos int) ([][]byte, error) {
+	handle := r.index.readValAt(pos)
+	if r.mapping != nil {
+		buf, err := r.readBlock(handle)
+		return [][]byte{buf}, err
+	}
+	var gap int64 // between the blocks
+	if r.props.Checksums {
+		gap = blockChecksumSize
+	}
+	// offsets and lengths are summed up as int64s, a corrupt length mustn't wrap around
+	start := int64(binary.LittleEndian.Uint32(handle[:4]))
+	end := start
+	var handles [][]byte
+	for ; pos < r.index.numOffsets; pos++ {
+		handle = r.index.readValAt(pos)
+		offset := int64(binary.LittleEndian.Uint32(handle[:4]))
+		length := int64(binary.LittleEndian.Uint32(handle[4:8]))
+		if offset != end || (len(handles) > 0 && end+length+gap-start > scanReadAhead) {
+			break
+		}
+		handles = append(handles, handle)
+		end += length + gap
+	}
+	if end > r.fileSize-r.footerSize {
+		return nil, fmt.Errorf("%w: block at offset %d runs past the end of the file", ErrCorruption, start)
+	}
+	buf := make([]byte, end-start)
+	if _, err := r.file.ReadAt(buf, start); err != nil {
+		return nil, err
+	}
+	bufs := make([][]byte, len(handles))
+	for i, handle := range handles {
+		offset := binary.LittleEndian.Uint32(handle[:4])
+		length := int64(binary.LittleEndian.Uint32(handle[4:8]))
+		b := buf[int64(offset)-start : int64(offset)-start+length+gap : int64(offset)-start+length+gap]
+		if !r.opts.ParanoidChecks || gap == 0 {
+			bufs[i] = b[:length]
+			continue
+		}
+		var err error
+		if bufs[i], err = r.verifyBlock(b, offset); err != nil {
+			return nil, err
+		}
+	}
+	return bufs, nil
+}
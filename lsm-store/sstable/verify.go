@@ -0,0 +1,159 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"lsm/encoder"
+)
+
+// Verify reads the whole table from disk, bypassing the block cache, and checks it for
+// corruption: the footer has to point to blocks lining up back to back, every block has to
+// match its checksum (if the table has checksums), the keys have to be in strictly increasing
+// order within and across data blocks and fall between the index keys of their data block and
+// the one before, every value has to be a valid encoded value, and the properties and the
+// filter have to agree with the entries. Returns the first problem found, wrapped in ErrCorruption.
+func (r *Reader) Verify() error {
+	if err := r.checkFooter(); err != nil {
+		return err
+	}
+	// the meta blocks have been loaded along with the reader, but not necessarily verified
+	for _, handle := range r.metaBlockHandles() {
+		if _, err := r.readBlockVerified(handle, r.props.Checksums); err != nil {
+			return err
+		}
+	}
+	if err := r.checkIndex(); err != nil {
+		return err
+	}
+
+	cmp := r.opts.Comparer.Compare
+	var firstKey, prevKey, prevIndexKey []byte
+	var numEntries uint64
+	for pos := 0; pos < r.index.numOffsets; pos++ {
+		_, indexKey, handle := r.index.fetchDataFor(pos)
+		buf, err := r.readBlockVerified(handle, r.props.Checksums)
+		if err != nil {
+			return err
+		}
+		if buf, err = r.decompress(buf); err != nil {
+			return fmt.Errorf("%w: data block %d: %v", ErrCorruption, pos, err)
+		}
+		data, err := parseBlock(buf)
+		if err != nil {
+			return fmt.Errorf("%w: data block %d: %v", ErrCorruption, pos, err)
+		}
+		entries, err := r.decodeEntries(data)
+		if err != nil || len(entries) == 0 {
+			return fmt.Errorf("%w: data block %d: malformed entries", ErrCorruption, pos)
+		}
+		for _, e := range entries {
+			switch {
+			case prevKey != nil && cmp(prevKey, e.key) >= 0:
+				return fmt.Errorf("%w: key %q after %q", ErrCorruption, e.key, prevKey)
+			case prevIndexKey != nil && cmp(e.key, prevIndexKey) <= 0:
+				return fmt.Errorf("%w: key %q before the index key %q of the previous data block", ErrCorruption, e.key, prevIndexKey)
+			case cmp(e.key, indexKey) > 0:
+				return fmt.Errorf("%w: key %q past the index key %q of its data block", ErrCorruption, e.key, indexKey)
+			case !r.encoder.Parse(e.val).Valid():
+				return fmt.Errorf("%w: malformed value of key %q", ErrCorruption, e.key)
+			case !r.MayContain(e.key):
+				return fmt.Errorf("%w: key %q missing from the filter", ErrCorruption, e.key)
+			}
+			if firstKey == nil {
+				firstKey = e.key
+			}
+			prevKey = e.key
+			numEntries++
+		}
+		prevIndexKey = indexKey
+	}
+
+	p := r.props
+	if p.NumEntries != 0 && p.NumEntries != numEntries {
+		return fmt.Errorf("%w: %d entries, properties say %d", ErrCorruption, numEntries, p.NumEntries)
+	}
+	if firstKey != nil && (cmp(firstKey, p.SmallestKey) < 0 || cmp(prevKey, p.LargestKey) > 0) {
+		return fmt.Errorf("%w: keys [%q, %q] outside of the key range [%q, %q] of the properties",
+			ErrCorruption, firstKey, prevKey, p.SmallestKey, p.LargestKey)
+	}
+	return nil
+}
+
+// metaBlockHandles returns the handles of the blocks following the data blocks, in the order
+// they are stored in: the range deletion block, the filter block (if the table has one), the
+// properties block, the partitions of the index (if it has any) and the index block.
+func (r *Reader) metaBlockHandles() [][]byte {
+	handles := [][]byte{r.footer[0:8]}
+	if r.props.filterHandle != nil {
+		handles = append(handles, r.props.filterHandle)
+	}
+	handles = append(handles, r.footer[8:16])
+	handles = append(handles, r.index.partitionHandles()...)
+	return append(handles, r.footer[16:24])
+}
+
+// checkFooter verifies that the blocks the footer (and the top-level index) point to follow
+// each other, from the end of the data blocks up to the footer.
+func (r *Reader) checkFooter() error {
+	var gap uint32
+	if r.props.Checksums {
+		gap = blockChecksumSize
+	}
+	expected := binary.LittleEndian.Uint32(r.footer[0:4])
+	for _, handle := range r.metaBlockHandles() {
+		if offset := binary.LittleEndian.Uint32(handle[:4]); offset != expected {
+			return fmt.Errorf("%w: footer points to a block at offset %d, expected %d", ErrCorruption, offset, expected)
+		}
+		expected += binary.LittleEndian.Uint32(handle[4:8]) + gap
+	}
+	if int64(expected) != r.fileSize-r.footerSize {
+		return fmt.Errorf("%w: blocks end at offset %d, the footer starts at %d", ErrCorruption, expected, r.fileSize-r.footerSize)
+	}
+	return nil
+}
+
+// parseBlock is prepareBlockReader for blocks that may be damaged: the trailer is validated
+// before it is trusted.
+func parseBlock(buf []byte) (*blockReader, error) {
+	if len(buf) < blockTrailerSizeInBytes {
+		return nil, errCorruptBlock
+	}
+	trailer := buf[len(buf)-blockTrailerSizeInBytes:]
+	numOffsets := uint64(binary.LittleEndian.Uint32(trailer[:4]))
+	blockLength := uint64(binary.LittleEndian.Uint32(trailer[4:]))
+	if blockLength != uint64(len(buf)) || (numOffsets+2)*4 > blockLength {
+		return nil, errCorruptBlock
+	}
+	b := &blockReader{
+		buf:        buf,
+		offsets:    buf[blockLength-(numOffsets+2)*4:],
+		numOffsets: int(numOffsets),
+	}
+	if err := b.validate(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// CheckBlock decodes buf as an uncompressed block of a table in the given format, the way
+// readers do: the trailer, the offsets, every entry, and a lookup of every key through the
+// offsets. It returns the number of entries, or ErrCorruption for a malformed block. The
+// lookups of a block that is well formed but out of order may miss keys, which isn't reported.
+func CheckBlock(buf []byte, version FormatVersion) (int, error) {
+	b, err := parseBlock(buf)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrCorruption, err)
+	}
+	r := &Reader{opts: Options{}.ensureDefaults(), encoder: encoder.NewEncoder(), version: version}
+	entries, err := r.decodeEntries(b)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrCorruption, err)
+	}
+	for _, e := range entries {
+		if _, err := r.searchDataBlock(b, e.key); err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return 0, fmt.Errorf("%w: %v", ErrCorruption, err)
+		}
+	}
+	return len(entries), nil
+}
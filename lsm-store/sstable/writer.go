@@ -2,23 +2,69 @@ package sstable
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"hash/crc32"
 	"io"
 	"lsm/encoder"
+	"lsm/filter"
 	"lsm/memtable"
+	"lsm/vlog"
 	"math"
 
-	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
 )
 
 const (
-	dataBlockChunkSize  = 16
 	indexBlockChunkSize = 1
+	// {offset (4B), length (4B)} of range deletion block + {offset (4B), length (4B)} of properties block
+	// + {offset (4B), length (4B)} of index block
+	footerHandlesSize = 24
+	// the block handles + format version (4B) + magic number (8B)
+	footerSizeInBytes = footerHandlesSize + 4 + 8
+	// tables written before the footer had a version and a magic number end with the block
+	// handles only
+	legacyFooterSizeInBytes = footerHandlesSize
+	// every block is followed by a CRC-32C (4B) of its bytes on disk, which the block handles
+	// pointing to it don't include
+	blockChecksumSize = 4
 )
 
+// FormatVersion is the version of the layout of a table, recorded in its footer so that
+// readers can tell the formats apart as the layout evolves.
+type FormatVersion uint32
+
+const (
+	// FormatLegacy is the layout of the tables written before the footer had a version, which
+	// are told apart from other files by their block handles lining up up to the footer.
+	FormatLegacy FormatVersion = iota
+	// FormatV1 adds the version and a magic number to the footer.
+	FormatV1
+	// FormatV2 tables have a two-level index: the index block in the footer points to the
+	// partitions of the index, which point to the data blocks. Only tables whose index
+	// outgrew a block were written in it.
+	FormatV2
+	// FormatV3 prefix-compresses every key of a data block against the key before it rather
+	// than against the first key of its chunk. Whether the index is two-level is recorded in
+	// the properties (Properties.TwoLevelIndex).
+	FormatV3
+	// FormatV4 tables hold values in the encoding starting with a format byte, with a varint
+	// sequence number, which readers of the versions before can't parse. The values of older
+	// tables are in the legacy encoding, which is still parsed. Every table is written in it.
+	FormatV4
+)
+
+// tableMagic ends every table from FormatV1 on.
+const tableMagic = "lsm\x00sst\x01"
+
+// CRC-32C of the blocks of a table, guards against bit rot and misdirected writes
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 // If we exceed 90% of the maximum acceptable data block size after adding a new data entry,
 // we consider the data block to be full and suitable for flushing.
-var blockFlushThreshold = int(math.Floor(maxBlockSize * 0.9))
+func blockFlushThreshold(blockSize int) int {
+	return int(math.Floor(float64(blockSize) * 0.9))
+}
 
 // 2 methods -- `Close() error` and `Sync() error`
 type syncCloser interface {
@@ -29,36 +75,117 @@ type syncCloser interface {
 type Writer struct {
 	file       syncCloser
 	bw         *bufio.Writer
-	buf        []byte
 	dataBlock  *blockWriter
 	indexBlock *blockWriter
 	encoder    *encoder.Encoder
+	opts       Options
 
 	offset       int    // offset of current data block.
 	bytesWritten int    // bytesWritten to current data block.
 	lastKey      []byte // lastKey (largest) in current data block
+	numEntries   int    // kv-pairs added to the table
+	props        Properties
+	rangeDels    []encoder.RangeTombstone
+
+	// once the index outgrows a block, it is partitioned: the full partitions are held back
+	// until Finish writes them out, followed by the top-level index pointing to them
+	indexPartitions []indexPartition
+	lastIndexKey    []byte
+
+	// the index entry of a flushed data block is only added once the next key is known,
+	// so that its index key can be shortened to a separator between the two blocks
+	pendingIndexEntry  bool
+	pendingBlockHandle [8]byte // {offset, length} of the flushed data block
 
 	compressionBuf []byte // stores compressed data block
+
+	// with Options.CompressionDictSize set, the first data blocks are held back until enough
+	// of them are known to train the compression dictionary of the table on
+	training     bool
+	held         []heldBlock
+	heldSize     int           // uncompressed size of the held back blocks
+	heldEstimate int           // their size compressed without a dictionary, for EstimatedSize
+	dictEncoder  *zstd.Encoder // zstd with the dictionary of the table (nil if it has none)
+
+	filter *filter.Builder // the keys of the table (nil without Options.FilterBitsPerKey)
+	// with a BlockFilter, the filter of every data block is finished along with the block
+	blockFilters    []byte
+	blockFilterEnds []uint32
 }
 
-func NewWriter(file io.Writer) *Writer {
-	w := &Writer{}
+// indexPartition is a finished block of a two-level index, with the last index key in it.
+type indexPartition struct {
+	block   []byte
+	lastKey []byte
+}
+
+// heldBlock is a finished, uncompressed data block that isn't written yet.
+type heldBlock struct {
+	raw      []byte
+	indexKey []byte // nil until the next key is known
+}
+
+func NewWriter(file io.Writer, opts Options) *Writer {
+	w := &Writer{opts: opts.ensureDefaults()}
+	w.props.Comparer = w.opts.Comparer.Name
+	w.props.Compression = w.opts.Compression
+	w.props.Checksums = true
 	bw := bufio.NewWriter(file)
-	w.buf = make([]byte, 0, 8)
 	w.file, w.bw = file.(syncCloser), bw
-	w.dataBlock, w.indexBlock = newBlockWriter(dataBlockChunkSize), newBlockWriter(indexBlockChunkSize)
+	w.dataBlock = newBlockWriter(w.opts.BlockChunkSize, w.opts.BlockSize)
+	w.indexBlock = newBlockWriter(indexBlockChunkSize, w.opts.BlockSize)
+	w.training = w.opts.CompressionDictSize > 0 && w.opts.Compression == ZstdCompression
+	if w.opts.FilterBitsPerKey > 0 {
+		w.filter = filter.NewBuilder(w.opts.FilterBitsPerKey)
+	}
 	return w
 }
 
-// add largest key -> {offset, length} of data block to indexBlock.
-func (w *Writer) addIndexEntry() error {
-	buf := w.buf[:8]
-	binary.LittleEndian.PutUint32(buf[:4], uint32(w.offset))              // data block offset
-	binary.LittleEndian.PutUint32(buf[4:], uint32(len(w.compressionBuf))) // data block length
-	_, err := w.indexBlock.add(w.lastKey, w.encoder.Encode(encoder.OpKindSet, buf))
+// add index key -> {offset, length} of the pending data block to indexBlock. The index key is
+// >= the largest key of the data block and < nextKey, the first key of the following data
+// block (nil if there is none).
+func (w *Writer) addIndexEntry(nextKey []byte) error {
+	var indexKey []byte
+	if nextKey != nil {
+		indexKey = w.opts.Comparer.Separator(nil, w.lastKey, nextKey)
+	} else {
+		indexKey = w.opts.Comparer.Successor(nil, w.lastKey)
+	}
+	if w.training {
+		w.held[len(w.held)-1].indexKey = indexKey
+		w.pendingIndexEntry = false
+		return nil
+	}
+	err := w.addToIndex(indexKey, w.pendingBlockHandle[:])
 	if err != nil {
 		return err
 	}
+	w.pendingIndexEntry = false
+	return nil
+}
+
+// addToIndex adds the index entry of a data block to the index, and starts a new partition of
+// the index once the current one is full.
+func (w *Writer) addToIndex(indexKey, handle []byte) error {
+	if _, err := w.indexBlock.add(indexKey, handle); err != nil {
+		return err
+	}
+	w.lastIndexKey = append(w.lastIndexKey[:0], indexKey...)
+	if w.indexBlock.buf.Len() > blockFlushThreshold(w.opts.BlockSize) {
+		return w.finishIndexPartition()
+	}
+	return nil
+}
+
+func (w *Writer) finishIndexPartition() error {
+	if err := w.indexBlock.finish(); err != nil {
+		return err
+	}
+	w.indexPartitions = append(w.indexPartitions, indexPartition{
+		block:   bytes.Clone(w.indexBlock.buf.Bytes()),
+		lastKey: bytes.Clone(w.lastIndexKey),
+	})
+	w.indexBlock.buf.Reset()
 	return nil
 }
 
@@ -71,67 +198,345 @@ func (w *Writer) flushDataBlock() error {
 	if err != nil {
 		return err
 	}
+	if w.filter != nil && w.opts.FilterType == BlockFilter {
+		w.blockFilters = w.filter.Finish(w.blockFilters)
+		w.blockFilterEnds = append(w.blockFilterEnds, uint32(len(w.blockFilters)))
+	}
 
-	// write dataBlock buffer to underlying *.sst file
-	w.compressionBuf = snappy.Encode(w.compressionBuf, w.dataBlock.buf.Bytes())
-	w.dataBlock.buf.Reset()
-	_, err = w.bw.Write(w.compressionBuf)
-	if err != nil {
-		return err
+	if w.training {
+		// the block can only be compressed once the dictionary is known
+		w.held = append(w.held, heldBlock{raw: bytes.Clone(w.dataBlock.buf.Bytes())})
+		w.heldSize += w.dataBlock.buf.Len()
+		w.compressionBuf = w.opts.Compression.compress(w.compressionBuf, w.dataBlock.buf.Bytes())
+		w.heldEstimate += len(w.compressionBuf)
+		w.dataBlock.buf.Reset()
+		w.pendingIndexEntry = true
+		w.bytesWritten = 0
+		if w.heldSize >= w.opts.CompressionDictSize*dictSampleFactor {
+			return w.trainDict(false)
+		}
+		return nil
 	}
+	err = w.writeDataBlock(w.dataBlock.buf.Bytes())
+	w.dataBlock.buf.Reset()
+	w.bytesWritten = 0
+	return err
+}
 
-	// add a corresponding data entry into the indexBlock buffer
-	err = w.addIndexEntry()
+// writeDataBlock compresses a finished data block and writes it to the underlying *.sst file.
+func (w *Writer) writeDataBlock(raw []byte) error {
+	if w.dictEncoder != nil {
+		w.compressionBuf = w.dictEncoder.EncodeAll(raw, w.compressionBuf[:0])
+	} else {
+		w.compressionBuf = w.opts.Compression.compress(w.compressionBuf, raw)
+	}
+	_, err := w.bw.Write(w.compressionBuf)
 	if err != nil {
 		return err
 	}
 
-	// updates the w.offset and w.bytesWritten for subsequent data blocks
+	// the corresponding data entry is added into the indexBlock buffer along with the next key
+	binary.LittleEndian.PutUint32(w.pendingBlockHandle[:4], uint32(w.offset))              // data block offset
+	binary.LittleEndian.PutUint32(w.pendingBlockHandle[4:], uint32(len(w.compressionBuf))) // data block length
+	w.pendingIndexEntry = true
+
+	// updates the w.offset for subsequent data blocks
 	w.offset += len(w.compressionBuf)
-	w.bytesWritten = 0
+	return w.writeChecksum(crc32.Checksum(w.compressionBuf, crcTable))
+}
+
+// writeChecksum writes the checksum of the block just written.
+func (w *Writer) writeChecksum(sum uint32) error {
+	var buf [blockChecksumSize]byte
+	binary.LittleEndian.PutUint32(buf[:], sum)
+	n, err := w.bw.Write(buf[:])
+	w.offset += n
+	return err
+}
+
+// trainDict trains the compression dictionary of the table on the held back data blocks and
+// writes them out. The dictionary is only used if it shrinks the sampled blocks. It is stored
+// in the properties of the table, so if the sampled blocks are all the table has (complete),
+// it has to save more space on them than it takes up itself.
+func (w *Writer) trainDict(complete bool) error {
+	w.training = false
+	held, pending := w.held, w.pendingIndexEntry
+	w.held, w.heldSize, w.heldEstimate = nil, 0, 0
+	samples := make([][]byte, len(held))
+	for i, b := range held {
+		samples[i] = b.raw
+	}
+	if dict := trainDict(samples, w.opts.CompressionDictSize); dict != nil {
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderDictRaw(dictID, dict), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		plain, withDict := 0, 0
+		if complete {
+			withDict = len(dict)
+		}
+		for _, s := range samples {
+			w.compressionBuf = w.opts.Compression.compress(w.compressionBuf, s)
+			plain += len(w.compressionBuf)
+			w.compressionBuf = enc.EncodeAll(s, w.compressionBuf[:0])
+			withDict += len(w.compressionBuf)
+		}
+		if withDict < plain {
+			w.dictEncoder = enc
+			w.props.CompressionDict = dict
+		} else {
+			enc.Close()
+		}
+	}
+
+	for i, b := range held {
+		if err := w.writeDataBlock(b.raw); err != nil {
+			return err
+		}
+		// the index entry of the last block may still wait for the next key
+		if i == len(held)-1 && pending {
+			continue
+		}
+		if err := w.addToIndex(b.indexKey, w.pendingBlockHandle[:]); err != nil {
+			return err
+		}
+		w.pendingIndexEntry = false
+	}
 	return nil
 }
 
 // iterate over level 1 of the memtable and write each kv-pair to .sst file
 func (w *Writer) ConvertMemtableToSST(m *memtable.Memtable) error {
-	iter := m.Iterator()
+	iter := m.Iterator(nil, nil)
 	for iter.HasNext() {
 		key, val := iter.Next()
-		n, err := w.dataBlock.add(key, val)
-		if err != nil {
+		if err := w.Add(key, val); err != nil {
 			return err
 		}
-		w.bytesWritten += n
-		w.lastKey = key
+	}
+	for _, t := range m.RangeTombstones() {
+		w.AddRangeTombstone(t)
+	}
+	return w.Finish()
+}
 
-		if w.bytesWritten > blockFlushThreshold {
-			err = w.flushDataBlock()
-			if err != nil {
-				return err
-			}
+// AddRangeTombstone adds a range tombstone to the table. Range tombstones are kept in
+// their own block and can be added in any order, interleaved with kv-pairs.
+func (w *Writer) AddRangeTombstone(t encoder.RangeTombstone) {
+	w.rangeDels = append(w.rangeDels, t)
+}
+
+// Add appends a kv-pair to the table. Keys must be added in strictly increasing order
+// and val must be an encoded value.
+func (w *Writer) Add(key, val []byte) error {
+	// the data block keeps referencing the key, so it must not change underneath it
+	key = append([]byte(nil), key...)
+	if w.pendingIndexEntry {
+		if err := w.addIndexEntry(key); err != nil {
+			return err
+		}
+	}
+	n, err := w.dataBlock.add(key, val)
+	if err != nil {
+		return err
+	}
+	w.bytesWritten += n
+	w.lastKey = key
+	w.numEntries++
+	w.props.NumEntries++
+	if w.filter != nil {
+		w.filter.Add(key)
+	}
+	if w.props.SmallestKey == nil {
+		w.props.SmallestKey = key
+	}
+	ev := w.encoder.Parse(val)
+	w.props.LargestSeqNum = max(w.props.LargestSeqNum, ev.SeqNum())
+	if ptr, ok := ev.ValueLogPointer(); ok {
+		p, err := vlog.DecodePointer(ptr)
+		if err != nil {
+			return err
+		}
+		if w.props.ValueLogRefs == nil {
+			w.props.ValueLogRefs = make(map[int]int64)
 		}
+		w.props.ValueLogRefs[p.FileNum] += int64(p.Length)
 	}
+
+	if w.bytesWritten > blockFlushThreshold(w.opts.BlockSize) {
+		return w.flushDataBlock()
+	}
+	return nil
+}
+
+// Finish writes any pending data block followed by the range deletion block, the filter block
+// (if the table has a filter), the properties block, the index block (preceded by its
+// partitions if it has any) and the footer. No more kv-pairs can be added afterwards.
+func (w *Writer) Finish() error {
 	// flush any pending data
 	err := w.flushDataBlock()
 	if err != nil {
 		return err
 	}
+	if w.training {
+		// the table is smaller than the sample the dictionary is trained on
+		if err = w.trainDict(true); err != nil {
+			return err
+		}
+	}
+	if w.pendingIndexEntry {
+		if err = w.addIndexEntry(nil); err != nil {
+			return err
+		}
+	}
+
+	// write range deletion block to underlying *.sst file
+	rangeDelBlock := newBlockWriter(indexBlockChunkSize, w.opts.BlockSize)
+	err = encodeRangeDels(rangeDelBlock, w.rangeDels, w.encoder, w.opts.Comparer.Compare)
+	if err != nil {
+		return err
+	}
+	rangeDelOffset, rangeDelLength, err := w.writeBlock(rangeDelBlock)
+	if err != nil {
+		return err
+	}
+
+	// the filter block is located through the properties, so it is written before them
+	if w.filter != nil {
+		offset, length, err := w.writeRawBlock(w.filterBlock())
+		if err != nil {
+			return err
+		}
+		w.props.FilterPolicy = bloomFilterPolicy
+		w.props.FilterType = w.opts.FilterType
+		w.props.filterHandle = binary.LittleEndian.AppendUint32(nil, uint32(offset))
+		w.props.filterHandle = binary.LittleEndian.AppendUint32(w.props.filterHandle, uint32(length))
+	}
+
+	// write properties block to underlying *.sst file
+	w.props.LargestKey = w.lastKey
+	w.props.TwoLevelIndex = len(w.indexPartitions) > 0
+	w.props.extendByRangeDels(w.opts.Comparer.Compare, w.rangeDels)
+	propsBlock := newBlockWriter(indexBlockChunkSize, w.opts.BlockSize)
+	err = w.props.encode(propsBlock)
+	if err != nil {
+		return err
+	}
+	propsOffset, propsLength, err := w.writeBlock(propsBlock)
+	if err != nil {
+		return err
+	}
+
+	// a partitioned index is written partition by partition, followed by the top-level index
+	// block, which takes the place of the index block in the footer
+	indexBlock := w.indexBlock
+	if w.props.TwoLevelIndex {
+		if w.indexBlock.buf.Len() > 0 {
+			if err = w.finishIndexPartition(); err != nil {
+				return err
+			}
+		}
+		indexBlock = newBlockWriter(indexBlockChunkSize, w.opts.BlockSize)
+		var handle [8]byte
+		for _, p := range w.indexPartitions {
+			offset, length, err := w.writeRawBlock(p.block)
+			if err != nil {
+				return err
+			}
+			binary.LittleEndian.PutUint32(handle[:4], uint32(offset))
+			binary.LittleEndian.PutUint32(handle[4:], uint32(length))
+			if _, err = indexBlock.add(p.lastKey, handle[:]); err != nil {
+				return err
+			}
+		}
+		w.indexPartitions = nil
+	}
 
 	// update index block
-	err = w.indexBlock.finish()
+	err = indexBlock.finish()
 	if err != nil {
 		return err
 	}
 
 	// write indexBlock buffer to underlying *.sst file
-	_, err = w.bw.ReadFrom(w.indexBlock.buf)
+	indexOffset, indexLength, err := w.writeBlock(indexBlock)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	return w.writeFooter(FormatV4, rangeDelOffset, rangeDelLength, propsOffset, propsLength, indexOffset, indexLength)
+}
+
+// filterBlock returns the filter block: the filter of the whole table with a TableFilter, or
+// those of the data blocks with a BlockFilter.
+//
+// block filters = {filter}...|{end offset of filter (4B)}...|numFilters (4B)
+func (w *Writer) filterBlock() []byte {
+	if w.opts.FilterType != BlockFilter {
+		return w.filter.Finish(nil)
+	}
+	buf := w.blockFilters
+	for _, end := range w.blockFilterEnds {
+		buf = binary.LittleEndian.AppendUint32(buf, end)
+	}
+	return binary.LittleEndian.AppendUint32(buf, uint32(len(w.blockFilterEnds)))
+}
+
+// NumEntries returns the number of kv-pairs added so far.
+func (w *Writer) NumEntries() int {
+	return w.numEntries
+}
+
+// EstimatedSize returns the approximate size of the table written so far (in bytes).
+// After Finish it is the exact size of the *.sst file.
+func (w *Writer) EstimatedSize() int {
+	return w.offset + w.heldEstimate + w.bytesWritten
+}
+
+// Properties returns the properties recorded for the table written so far.
+func (w *Writer) Properties() Properties {
+	return w.props
+}
+
+// writeBlock copies an already finished block to the underlying *.sst file and returns its location.
+func (w *Writer) writeBlock(b *blockWriter) (offset, length int, err error) {
+	offset, length, err = w.writeRawBlock(b.buf.Bytes())
+	b.buf.Reset()
+	return offset, length, err
+}
+
+// writeRawBlock writes a block followed by its checksum and returns its location.
+func (w *Writer) writeRawBlock(block []byte) (offset, length int, err error) {
+	offset = w.offset
+	n, err := w.bw.Write(block)
+	if err != nil {
+		return 0, 0, err
+	}
+	w.offset += n
+	return offset, n, w.writeChecksum(crc32.Checksum(block, crcTable))
+}
+
+// footer = {offset, length} of range deletion block|{offset, length} of properties block|
+// {offset, length} of index block|format version|magic number
+func (w *Writer) writeFooter(version FormatVersion, rangeDelOffset, rangeDelLength, propsOffset, propsLength, indexOffset, indexLength int) error {
+	buf := make([]byte, footerSizeInBytes)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(rangeDelOffset))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(rangeDelLength))
+	binary.LittleEndian.PutUint32(buf[8:12], uint32(propsOffset))
+	binary.LittleEndian.PutUint32(buf[12:16], uint32(propsLength))
+	binary.LittleEndian.PutUint32(buf[16:20], uint32(indexOffset))
+	binary.LittleEndian.PutUint32(buf[20:24], uint32(indexLength))
+	binary.LittleEndian.PutUint32(buf[24:28], uint32(version))
+	copy(buf[28:], tableMagic)
+	n, err := w.bw.Write(buf)
+	w.offset += n
+	return err
 }
 
 func (w *Writer) Close() error {
+	if w.dictEncoder != nil {
+		w.dictEncoder.Close()
+	}
 	// Flush any remaining data from the buffer.
 	err := w.bw.Flush()
 	if err != nil {
@@ -0,0 +1,306 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"math/rand"
+	"sync"
+)
+
+var (
+	// ErrInjected is returned by the operations a FaultFS makes fail on purpose.
+	ErrInjected = errors.New("storage: injected fault")
+	// ErrCrashed is returned by every operation of a FaultFS once it has crashed.
+	ErrCrashed = errors.New("storage: file system crashed")
+)
+
+// FaultFS wraps a VFS and injects faults into it, to test how the DB copes with failing
+// hardware and crashes: it can fail the Nth sync (of a file or a directory), return partial
+// reads, and crash, dropping every write that wasn't synced, on demand or right before the Nth
+// write or sync. Faults are picked with a seeded random number generator, so a failing run can
+// be replayed.
+type FaultFS struct {
+	fs VFS
+
+	// held (shared) by every operation while it runs, and exclusively by a crash, which waits
+	// for the operations running to be done: none of them can succeed after the crash
+	running sync.RWMutex
+
+	mu           sync.Mutex
+	rng          *rand.Rand
+	syncs        int     // syncs left until the one that fails, 0 if none is armed
+	mutations    int     // writes and syncs left until the one crashing, 0 if none is armed
+	partialReads float64 // probability of a read returning less than asked for
+	crashed      bool
+	crashState   *MemFS // what the crash left behind, if the wrapped VFS is a MemFS
+	injected     int    // number of faults injected so far
+}
+
+// opKind tells how an operation of a FaultFS may fail.
+type opKind int
+
+const (
+	opRead  opKind = iota // reads, and opening or listing files
+	opWrite               // writes of files, and changes of directories
+	opSync                // syncs of files and directories
+)
+
+// NewFaultFS wraps fs, without injecting any faults until they are armed.
+func NewFaultFS(fs VFS, seed int64) *FaultFS {
+	return &FaultFS{fs: fs, rng: rand.New(rand.NewSource(seed))}
+}
+
+// FailSync makes the nth sync from now on fail with ErrInjected (n = 1 is the next one), and
+// leaves what it should have synced unsynced. n <= 0 disarms it.
+func (f *FaultFS) FailSync(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.syncs = max(n, 0)
+}
+
+// CrashAt makes the file system crash (see Crash) right before the nth write or sync from now
+// on (n = 1 is the next one), which fails with ErrCrashed. Creating, renaming, linking and
+// removing files and creating directories are writes (of their directory). It lets a test
+// crash the DB in the middle of a write, a flush or a compaction, wherever the nth write
+// happens to be. n <= 0 disarms it.
+func (f *FaultFS) CrashAt(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mutations = max(n, 0)
+}
+
+// SetPartialReads makes reads return less than asked for with probability p. A partial Read
+// returns a shorter prefix without an error, which io.Reader allows. A partial ReadAt has to
+// come with an error, ErrInjected.
+func (f *FaultFS) SetPartialReads(p float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.partialReads = p
+}
+
+// Injected returns the number of faults injected so far.
+func (f *FaultFS) Injected() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.injected
+}
+
+// Crash simulates the process dying or the machine losing power: every operation fails with
+// ErrCrashed from now on, so whatever still uses the file system can't change it anymore.
+// If the wrapped VFS is a MemFS, Crash returns the state a restarted process would find, the
+// unsynced writes dropped (see MemFS.CrashClone); otherwise it returns nil. After a crash
+// armed by CrashAt, it returns the state the file system was left in then.
+func (f *FaultFS) Crash() *MemFS {
+	f.running.Lock()
+	defer f.running.Unlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.crashed {
+		return f.crashState
+	}
+	f.crashed = true
+	if m, ok := f.fs.(*MemFS); ok {
+		f.crashState = m.CrashClone()
+	}
+	return f.crashState
+}
+
+// Crashed reports whether the file system has crashed, by Crash or CrashAt.
+func (f *FaultFS) Crashed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.crashed
+}
+
+// enter starts an operation: it fails once the file system has crashed, for the write or sync
+// CrashAt armed, which crashes it, and for the sync FailSync armed. Unless it fails, the
+// operation has to call exit once it is done.
+func (f *FaultFS) enter(op opKind) error {
+	f.mu.Lock()
+	if f.crashed {
+		f.mu.Unlock()
+		return ErrCrashed
+	}
+	if op != opRead && f.mutations > 0 {
+		f.mutations--
+		if f.mutations == 0 {
+			f.injected++
+			f.mu.Unlock()
+			f.Crash()
+			return ErrCrashed
+		}
+	}
+	if op == opSync && f.syncs > 0 {
+		f.syncs--
+		if f.syncs == 0 {
+			f.injected++
+			f.mu.Unlock()
+			return ErrInjected
+		}
+	}
+	f.mu.Unlock()
+
+	f.running.RLock()
+	// the file system may have crashed while waiting for the crash to be done
+	if f.Crashed() {
+		f.running.RUnlock()
+		return ErrCrashed
+	}
+	return nil
+}
+
+func (f *FaultFS) exit() {
+	f.running.RUnlock()
+}
+
+// partialRead returns how many of the n bytes asked for a read should return.
+func (f *FaultFS) partialRead(n int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if n <= 1 || f.partialReads <= 0 || f.rng.Float64() >= f.partialReads {
+		return n
+	}
+	f.injected++
+	return 1 + f.rng.Intn(n-1)
+}
+
+func (f *FaultFS) Create(name string) (File, error) {
+	if err := f.enter(opWrite); err != nil {
+		return nil, err
+	}
+	defer f.exit()
+	file, err := f.fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f}, nil
+}
+
+func (f *FaultFS) Open(name string) (File, error) {
+	if err := f.enter(opRead); err != nil {
+		return nil, err
+	}
+	defer f.exit()
+	file, err := f.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f}, nil
+}
+
+func (f *FaultFS) List(dir string) ([]fs.FileInfo, error) {
+	if err := f.enter(opRead); err != nil {
+		return nil, err
+	}
+	defer f.exit()
+	return f.fs.List(dir)
+}
+
+func (f *FaultFS) Stat(name string) (fs.FileInfo, error) {
+	if err := f.enter(opRead); err != nil {
+		return nil, err
+	}
+	defer f.exit()
+	return f.fs.Stat(name)
+}
+
+func (f *FaultFS) Remove(name string) error {
+	if err := f.enter(opWrite); err != nil {
+		return err
+	}
+	defer f.exit()
+	return f.fs.Remove(name)
+}
+
+func (f *FaultFS) RemoveAll(name string) error {
+	if err := f.enter(opWrite); err != nil {
+		return err
+	}
+	defer f.exit()
+	return f.fs.RemoveAll(name)
+}
+
+func (f *FaultFS) Rename(oldname, newname string) error {
+	if err := f.enter(opWrite); err != nil {
+		return err
+	}
+	defer f.exit()
+	return f.fs.Rename(oldname, newname)
+}
+
+func (f *FaultFS) Link(oldname, newname string) error {
+	if err := f.enter(opWrite); err != nil {
+		return err
+	}
+	defer f.exit()
+	return f.fs.Link(oldname, newname)
+}
+
+func (f *FaultFS) Mkdir(dir string) error {
+	if err := f.enter(opWrite); err != nil {
+		return err
+	}
+	defer f.exit()
+	return f.fs.Mkdir(dir)
+}
+
+func (f *FaultFS) MkdirAll(dir string) error {
+	if err := f.enter(opWrite); err != nil {
+		return err
+	}
+	defer f.exit()
+	return f.fs.MkdirAll(dir)
+}
+
+func (f *FaultFS) Sync(dir string) error {
+	if err := f.enter(opSync); err != nil {
+		return err
+	}
+	defer f.exit()
+	return f.fs.Sync(dir)
+}
+
+// faultFile is a file of a FaultFS.
+type faultFile struct {
+	File
+	fs *FaultFS
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.fs.enter(opRead); err != nil {
+		return 0, err
+	}
+	defer f.fs.exit()
+	return f.File.Read(p[:f.fs.partialRead(len(p))])
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.fs.enter(opRead); err != nil {
+		return 0, err
+	}
+	defer f.fs.exit()
+	if n := f.fs.partialRead(len(p)); n < len(p) {
+		n, err := f.File.ReadAt(p[:n], off)
+		if err == nil {
+			err = ErrInjected
+		}
+		return n, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if err := f.fs.enter(opWrite); err != nil {
+		return 0, err
+	}
+	defer f.fs.exit()
+	return f.File.Write(p)
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.enter(opSync); err != nil {
+		return err
+	}
+	defer f.fs.exit()
+	return f.File.Sync()
+}
@@ -0,0 +1,422 @@
+package storage
+
+import (
+	"io"
+	"io/fs"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MemFS is a VFS keeping every file in memory, so that tests don't touch the disk. Paths are
+// cleaned with filepath.Clean; the root and the working directory always exist.
+//
+// It simulates what survives a crash, like the page cache of an OS would: written data only
+// becomes durable once its file is synced, and files created, renamed or deleted only once
+// their directory is synced. CrashClone returns the durable state. Directories themselves
+// are durable as soon as they are created.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode
+	dirs  map[string]time.Time // modification time of every directory
+	// the files as of the last sync of their directory
+	durable map[string]*memNode
+}
+
+// memNode is the contents of a file, shared by its hard links and open handles.
+type memNode struct {
+	mu      sync.RWMutex
+	data    []byte
+	synced  int // length of the prefix of data that has been synced
+	modTime time.Time
+}
+
+// NewMemFS returns an empty in-memory VFS.
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files:   make(map[string]*memNode),
+		dirs:    make(map[string]time.Time),
+		durable: make(map[string]*memNode),
+	}
+}
+
+// CrashClone returns a copy of the file system as it would be found after a crash: files hold
+// their synced data only, and directories the files they held when last synced. Files
+// created since then are missing, deleted ones are back and renames are undone. The
+// receiver is left as is.
+func (m *MemFS) CrashClone() *MemFS {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := NewMemFS()
+	maps.Copy(c.dirs, m.dirs)
+	// hard links keep sharing their contents
+	clones := make(map[*memNode]*memNode)
+	for name, n := range m.durable {
+		clone, ok := clones[n]
+		if !ok {
+			n.mu.RLock()
+			clone = &memNode{data: slices.Clone(n.data[:n.synced]), synced: n.synced, modTime: n.modTime}
+			n.mu.RUnlock()
+			clones[n] = clone
+		}
+		c.files[name] = clone
+		c.durable[name] = clone
+		// a directory removed without syncing its parent would still be there
+		for dir := filepath.Dir(name); !c.isDir(dir); dir = filepath.Dir(dir) {
+			c.dirs[dir] = clone.modTime
+		}
+	}
+	return c
+}
+
+// Size returns the number of bytes held by the files, and the number of them that are synced.
+func (m *MemFS) Size() (total, synced int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen := make(map[*memNode]bool)
+	for _, n := range m.files {
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+		n.mu.RLock()
+		total += int64(len(n.data))
+		synced += int64(n.synced)
+		n.mu.RUnlock()
+	}
+	return total, synced
+}
+
+func (m *MemFS) isDir(dir string) bool {
+	if dir == "." || dir == string(filepath.Separator) {
+		return true
+	}
+	_, ok := m.dirs[dir]
+	return ok
+}
+
+// checkParent fails unless the directory name is created in exists. Must be called with m.mu held.
+func (m *MemFS) checkParent(op, name string) error {
+	if !m.isDir(filepath.Dir(name)) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+// exists reports whether there is a file or directory at name. Must be called with m.mu held.
+func (m *MemFS) exists(name string) bool {
+	_, ok := m.files[name]
+	return ok || m.isDir(name)
+}
+
+func (m *MemFS) Create(name string) (File, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkParent("open", name); err != nil {
+		return nil, err
+	}
+	if m.exists(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	}
+	n := &memNode{modTime: time.Now()}
+	m.files[name] = n
+	return &memFile{name: name, node: n, writable: true}, nil
+}
+
+func (m *MemFS) Open(name string) (File, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memFile{name: name, node: n}, nil
+}
+
+func (m *MemFS) List(dir string) ([]fs.FileInfo, error) {
+	dir = filepath.Clean(dir)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isDir(dir) {
+		return nil, &fs.PathError{Op: "open", Path: dir, Err: fs.ErrNotExist}
+	}
+	var infos []fs.FileInfo
+	for name, n := range m.files {
+		if filepath.Dir(name) == dir {
+			infos = append(infos, n.info(name))
+		}
+	}
+	for name, modTime := range m.dirs {
+		if filepath.Dir(name) == dir && name != dir {
+			infos = append(infos, &fileInfo{name: filepath.Base(name), modTime: modTime, dir: true})
+		}
+	}
+	sortFileInfos(infos)
+	return infos, nil
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n, ok := m.files[name]; ok {
+		return n.info(name), nil
+	}
+	if m.isDir(name) {
+		return &fileInfo{name: filepath.Base(name), modTime: m.dirs[name], dir: true}, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if _, ok := m.dirs[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	for path := range m.files {
+		if filepath.Dir(path) == name {
+			return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrExist}
+		}
+	}
+	for path := range m.dirs {
+		if filepath.Dir(path) == name && path != name {
+			return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrExist}
+		}
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *MemFS) RemoveAll(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for path := range m.files {
+		if path == name || inDir(path, name) {
+			delete(m.files, path)
+		}
+	}
+	for path := range m.dirs {
+		if path == name || inDir(path, name) {
+			delete(m.dirs, path)
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) Rename(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkParent("rename", newname); err != nil {
+		return err
+	}
+	if n, ok := m.files[oldname]; ok {
+		if m.isDir(newname) {
+			return &fs.PathError{Op: "rename", Path: newname, Err: fs.ErrExist}
+		}
+		delete(m.files, oldname)
+		m.files[newname] = n
+		return nil
+	}
+	if _, ok := m.dirs[oldname]; !ok {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrNotExist}
+	}
+	if m.exists(newname) {
+		return &fs.PathError{Op: "rename", Path: newname, Err: fs.ErrExist}
+	}
+	for path, n := range m.files {
+		if inDir(path, oldname) {
+			delete(m.files, path)
+			m.files[newname+path[len(oldname):]] = n
+		}
+	}
+	for path, modTime := range m.dirs {
+		if path == oldname || inDir(path, oldname) {
+			delete(m.dirs, path)
+			m.dirs[newname+path[len(oldname):]] = modTime
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) Link(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.files[oldname]
+	if !ok {
+		return &fs.PathError{Op: "link", Path: oldname, Err: fs.ErrNotExist}
+	}
+	if err := m.checkParent("link", newname); err != nil {
+		return err
+	}
+	if m.exists(newname) {
+		return &fs.PathError{Op: "link", Path: newname, Err: fs.ErrExist}
+	}
+	m.files[newname] = n
+	return nil
+}
+
+func (m *MemFS) Mkdir(dir string) error {
+	dir = filepath.Clean(dir)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkParent("mkdir", dir); err != nil {
+		return err
+	}
+	if m.exists(dir) {
+		return &fs.PathError{Op: "mkdir", Path: dir, Err: fs.ErrExist}
+	}
+	m.dirs[dir] = time.Now()
+	return nil
+}
+
+func (m *MemFS) MkdirAll(dir string) error {
+	dir = filepath.Clean(dir)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for path := dir; !m.isDir(path); path = filepath.Dir(path) {
+		if _, ok := m.files[path]; ok {
+			return &fs.PathError{Op: "mkdir", Path: path, Err: fs.ErrExist}
+		}
+		m.dirs[path] = time.Now()
+	}
+	return nil
+}
+
+func (m *MemFS) Sync(dir string) error {
+	dir = filepath.Clean(dir)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isDir(dir) {
+		return &fs.PathError{Op: "sync", Path: dir, Err: fs.ErrNotExist}
+	}
+	for name := range m.durable {
+		// along with the files of the directories removed from it
+		if filepath.Dir(name) == dir || (inDir(name, dir) && !m.isDir(filepath.Dir(name))) {
+			delete(m.durable, name)
+		}
+	}
+	for name, n := range m.files {
+		if filepath.Dir(name) == dir {
+			m.durable[name] = n
+		}
+	}
+	return nil
+}
+
+// inDir reports whether path lies somewhere below dir.
+func inDir(path, dir string) bool {
+	return strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+func (n *memNode) info(name string) *fileInfo {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return &fileInfo{name: filepath.Base(name), size: int64(len(n.data)), modTime: n.modTime}
+}
+
+// memFile is an open handle of a MemFS file. Files are written sequentially, from the start.
+type memFile struct {
+	name     string
+	node     *memNode
+	writable bool
+	pos      int64       // offset of the next Read
+	closed   atomic.Bool // handles are read concurrently, like an *os.File
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed.Load() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.node.mu.RLock()
+	defer f.node.mu.RUnlock()
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.closed.Load() {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrClosed}
+	}
+	if !f.writable {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	f.node.data = append(f.node.data, p...)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed.Swap(true) {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed.Load() {
+		return &fs.PathError{Op: "sync", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	f.node.synced = len(f.node.data)
+	return nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	if f.closed.Load() {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: fs.ErrClosed}
+	}
+	return f.node.info(f.name), nil
+}
+
+// fileInfo describes the files of a MemFS, and the offloaded files of a TieredFS.
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) ModTime() time.Time { return i.modTime }
+func (i *fileInfo) IsDir() bool        { return i.dir }
+func (i *fileInfo) Sys() any           { return nil }
+func (i *fileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
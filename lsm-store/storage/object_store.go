@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ObjectStore is a flat key-value store of immutable objects, such as S3. Objects are
+// written at once and never appended to.
+type ObjectStore interface {
+	// Put stores the size bytes of r as the object key, replacing it if it exists.
+	Put(key string, r io.Reader, size int64) error
+	// Get returns the contents of the object key. A missing object fails with an error for
+	// which errors.Is(err, fs.ErrNotExist) holds.
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the object key. A missing object isn't an error.
+	Delete(key string) error
+	// List returns the objects whose keys start with prefix, sorted by key.
+	List(prefix string) ([]ObjectInfo, error)
+}
+
+// ObjectInfo describes an object of an ObjectStore.
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// MemObjectStore is an ObjectStore keeping its objects in memory, for tests.
+type MemObjectStore struct {
+	mu      sync.Mutex
+	objects map[string]memObject
+}
+
+type memObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemObjectStore returns an empty in-memory ObjectStore.
+func NewMemObjectStore() *MemObjectStore {
+	return &MemObjectStore{objects: make(map[string]memObject)}
+}
+
+func (s *MemObjectStore) Put(key string, r io.Reader, size int64) error {
+	data, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return io.ErrUnexpectedEOF
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = memObject{data: data, modTime: time.Now()}
+	return nil
+}
+
+func (s *MemObjectStore) Get(key string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.objects[key]
+	if !ok {
+		return nil, &fs.PathError{Op: "get", Path: key, Err: fs.ErrNotExist}
+	}
+	// objects are never modified in place, so the reader can share their data
+	return io.NopCloser(bytes.NewReader(o.data)), nil
+}
+
+func (s *MemObjectStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *MemObjectStore) List(prefix string) ([]ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var infos []ObjectInfo
+	for key, o := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			infos = append(infos, ObjectInfo{Key: key, Size: int64(len(o.data)), ModTime: o.modTime})
+		}
+	}
+	slices.SortFunc(infos, func(a, b ObjectInfo) int { return strings.Compare(a.Key, b.Key) })
+	return infos, nil
+}
@@ -1,15 +1,31 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"io/fs"
+	"lsm/comparer"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 )
 
+// the manifest records which SSTables are live and the level each of them belongs to
+const manifestFileName = "MANIFEST"
+
+// files are written under a temporary name (their final name + tmpSuffix) first, where
+// they have to be complete and durable before they are renamed
+const tmpSuffix = ".tmp"
+
 // directory-level
 type Provider struct {
+	fs      VFS
 	dataDir string
+	mu      sync.Mutex // file numbers are handed out to both writers and the flush worker
 	fileNum int
+	// skip syncing the data directory, for tests that don't need to survive a crash
+	noDirSync bool
 }
 
 type FileType int
@@ -19,12 +35,22 @@ const (
 	FileTypeUnknown FileType = iota
 	FileTypeSSTable
 	FileTypeWAL
+	FileTypeValueLog
 )
 
 // file-level
 type FileMetadata struct {
 	fileNum  int
 	fileType FileType
+	size     int64
+
+	// key range covered by an SSTable, used to skip tables that can't contain a key
+	smallestKey []byte
+	largestKey  []byte
+	// bytes of each value log file (by file number) the values of an SSTable point to
+	valueLogRefs map[int]int64
+	// number of kv-pairs in an SSTable
+	numEntries uint64
 }
 
 func (f *FileMetadata) IsSSTable() bool {
@@ -35,20 +61,89 @@ func (f *FileMetadata) IsWAL() bool {
 	return f.fileType == FileTypeWAL
 }
 
+func (f *FileMetadata) IsValueLog() bool {
+	return f.fileType == FileTypeValueLog
+}
+
 func (f *FileMetadata) FileNum() int {
 	return f.fileNum
 }
 
+// Size returns the size of the file (in bytes) at the time it was listed or written.
+func (f *FileMetadata) Size() int64 {
+	return f.size
+}
+
+func (f *FileMetadata) SetSize(size int64) {
+	f.size = size
+}
+
+func (f *FileMetadata) SetKeyRange(smallest, largest []byte) {
+	f.smallestKey, f.largestKey = smallest, largest
+}
+
+func (f *FileMetadata) SmallestKey() []byte {
+	return f.smallestKey
+}
+
+func (f *FileMetadata) LargestKey() []byte {
+	return f.largestKey
+}
+
+func (f *FileMetadata) SetValueLogRefs(refs map[int]int64) {
+	f.valueLogRefs = refs
+}
+
+// ValueLogRefs returns the number of bytes of each value log file referenced by the SSTable.
+func (f *FileMetadata) ValueLogRefs() map[int]int64 {
+	return f.valueLogRefs
+}
+
+func (f *FileMetadata) SetNumEntries(n uint64) {
+	f.numEntries = n
+}
+
+// NumEntries returns the number of kv-pairs (tombstones included) in the SSTable.
+func (f *FileMetadata) NumEntries() uint64 {
+	return f.numEntries
+}
+
+// MayContainKey reports whether key falls into the key range of the file.
+// Files without a recorded key range are empty and never contain any key.
+func (f *FileMetadata) MayContainKey(cmp comparer.Compare, key []byte) bool {
+	if f.smallestKey == nil || f.largestKey == nil {
+		return false
+	}
+	return cmp(key, f.smallestKey) >= 0 && cmp(key, f.largestKey) <= 0
+}
+
+// OverlapsRange reports whether the key range of the file intersects [start, end].
+// A nil start or end leaves that side of the range unbounded.
+func (f *FileMetadata) OverlapsRange(cmp comparer.Compare, start, end []byte) bool {
+	if f.smallestKey == nil || f.largestKey == nil {
+		return false
+	}
+	if start != nil && cmp(f.largestKey, start) < 0 {
+		return false
+	}
+	if end != nil && cmp(f.smallestKey, end) > 0 {
+		return false
+	}
+	return true
+}
+
 func (s *Provider) ensureDataDirExists() error {
-	err := os.MkdirAll(s.dataDir, 0755)
+	err := s.fs.MkdirAll(s.dataDir)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func NewProvider(dataDir string) (*Provider, error) {
-	s := &Provider{dataDir: dataDir}
+// NewProvider manages the files of the data directory dataDir on fs, creating the directory
+// if necessary.
+func NewProvider(fs VFS, dataDir string) (*Provider, error) {
+	s := &Provider{fs: fs, dataDir: dataDir}
 
 	err := s.ensureDataDirExists()
 	if err != nil {
@@ -58,8 +153,29 @@ func NewProvider(dataDir string) (*Provider, error) {
 	return s, nil
 }
 
+// DisableDirSync stops the provider from syncing the data directory after creating, renaming
+// and deleting files. Only meant for tests: a crash may lose these changes.
+func (s *Provider) DisableDirSync() {
+	s.noDirSync = true
+}
+
+// FS returns the VFS the data directory is on.
+func (s *Provider) FS() VFS {
+	return s.fs
+}
+
+// Dir returns the data directory.
+func (s *Provider) Dir() string {
+	return s.dataDir
+}
+
+// FilePath returns the path of a file in the data directory.
+func (s *Provider) FilePath(meta *FileMetadata) string {
+	return filepath.Join(s.dataDir, s.makeFileName(meta.fileNum, meta.fileType))
+}
+
 func (s *Provider) ListFiles() ([]*FileMetadata, error) {
-	files, err := os.ReadDir(s.dataDir)
+	files, err := s.fs.List(s.dataDir)
 	if err != nil {
 		return nil, err
 	}
@@ -69,7 +185,8 @@ func (s *Provider) ListFiles() ([]*FileMetadata, error) {
 	for _, f := range files {
 		_, err = fmt.Sscanf(f.Name(), "%06d.%s", &fileNumber, &fileExtension)
 		if err != nil {
-			return nil, err
+			// not a numbered file (e.g. the manifest)
+			continue
 		}
 		fileType := FileTypeUnknown
 		switch fileExtension {
@@ -77,16 +194,25 @@ func (s *Provider) ListFiles() ([]*FileMetadata, error) {
 			fileType = FileTypeSSTable
 		case "log":
 			fileType = FileTypeWAL
+		case "vlog":
+			fileType = FileTypeValueLog
 		}
 		meta = append(meta, &FileMetadata{
 			fileNum:  fileNumber,
 			fileType: fileType,
+			size:     f.Size(),
 		})
+		// never hand out a file number that is already taken
+		s.mu.Lock()
+		s.fileNum = max(s.fileNum, fileNumber)
+		s.mu.Unlock()
 	}
 	return meta, nil
 }
 
 func (s *Provider) nextFileNum() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.fileNum++
 	return s.fileNum
 }
@@ -106,43 +232,227 @@ func (s *Provider) PrepareNewWALFile() *FileMetadata {
 	return s.prepareNewFile(FileTypeWAL)
 }
 
+func (s *Provider) PrepareNewValueLogFile() *FileMetadata {
+	return s.prepareNewFile(FileTypeValueLog)
+}
+
 func (s *Provider) makeFileName(fileNumber int, fileType FileType) string {
 	switch fileType {
 	case FileTypeSSTable:
 		return fmt.Sprintf("%06d.sst", fileNumber)
 	case FileTypeWAL:
 		return fmt.Sprintf("%06d.log", fileNumber)
+	case FileTypeValueLog:
+		return fmt.Sprintf("%06d.vlog", fileNumber)
 	case FileTypeUnknown:
 	}
 	panic("unknown file type")
 }
 
-func (s *Provider) OpenFileForWriting(meta *FileMetadata) (*os.File, error) {
-	const openFlags = os.O_RDWR | os.O_CREATE | os.O_EXCL
+// OpenFileForWriting creates the file described by meta and syncs the data directory, so that
+// the file (e.g. a WAL) is still there after a crash once its contents are synced.
+func (s *Provider) OpenFileForWriting(meta *FileMetadata) (File, error) {
 	filename := s.makeFileName(meta.fileNum, meta.fileType)
-	file, err := os.OpenFile(filepath.Join(s.dataDir, filename), openFlags, 0644)
+	file, err := s.fs.Create(filepath.Join(s.dataDir, filename))
 	if err != nil {
 		return nil, err
 	}
+	if err = s.syncDir(s.dataDir); err != nil {
+		file.Close()
+		return nil, err
+	}
 	return file, nil
 }
 
-func (s *Provider) OpenFileForReading(meta *FileMetadata) (*os.File, error) {
-	const openFlags = os.O_RDONLY
+// CreateTempFile creates the file described by meta under a temporary name. Once it is
+// written and synced, CommitTempFile gives it its final name. A crash in between leaves a
+// temporary file behind, which RemoveTempFiles deletes, rather than a truncated file under
+// the final name.
+func (s *Provider) CreateTempFile(meta *FileMetadata) (File, error) {
+	filename := s.makeFileName(meta.fileNum, meta.fileType) + tmpSuffix
+	return s.fs.Create(filepath.Join(s.dataDir, filename))
+}
+
+// CommitTempFile renames a file created by CreateTempFile to its final name and syncs the data
+// directory, so that the rename survives a crash. The file has to be synced and closed already.
+func (s *Provider) CommitTempFile(meta *FileMetadata) error {
+	path := filepath.Join(s.dataDir, s.makeFileName(meta.fileNum, meta.fileType))
+	if err := s.fs.Rename(path+tmpSuffix, path); err != nil {
+		return err
+	}
+	return s.syncDir(s.dataDir)
+}
+
+// DeleteTempFile deletes a file created by CreateTempFile that won't be committed.
+func (s *Provider) DeleteTempFile(meta *FileMetadata) error {
+	path := filepath.Join(s.dataDir, s.makeFileName(meta.fileNum, meta.fileType)+tmpSuffix)
+	err := s.fs.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// DetachFile renames a file of the data directory to its temporary name and syncs the
+// directory: the file is no longer part of the data directory, e.g. a WAL that mustn't be
+// replayed anymore, but can still be read through OpenDetachedFile until DeleteTempFile
+// deletes it. A crash leaves it to RemoveTempFiles.
+func (s *Provider) DetachFile(meta *FileMetadata) error {
+	path := filepath.Join(s.dataDir, s.makeFileName(meta.fileNum, meta.fileType))
+	if err := s.fs.Rename(path, path+tmpSuffix); err != nil {
+		return err
+	}
+	return s.syncDir(s.dataDir)
+}
+
+// DetachedWALFiles returns the WAL files detached by DetachFile, e.g. left behind by a crash,
+// in the order of their file numbers. WAL files are never written under their temporary name.
+func (s *Provider) DetachedWALFiles() ([]*FileMetadata, error) {
+	files, err := s.fs.List(s.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	var meta []*FileMetadata
+	var fileNumber int
+	for _, f := range files {
+		if _, err := fmt.Sscanf(f.Name(), "%06d.log"+tmpSuffix, &fileNumber); err != nil {
+			continue
+		}
+		meta = append(meta, &FileMetadata{fileNum: fileNumber, fileType: FileTypeWAL, size: f.Size()})
+	}
+	slices.SortFunc(meta, func(a, b *FileMetadata) int { return a.fileNum - b.fileNum })
+	return meta, nil
+}
+
+// OpenDetachedFile opens a file detached by DetachFile for reading.
+func (s *Provider) OpenDetachedFile(meta *FileMetadata) (File, error) {
+	return s.fs.Open(filepath.Join(s.dataDir, s.makeFileName(meta.fileNum, meta.fileType)+tmpSuffix))
+}
+
+// RemoveTempFiles deletes the temporary files (and staging directories) left behind by writes
+// interrupted by a crash. It must not be called while files are being written.
+func (s *Provider) RemoveTempFiles() error {
+	files, err := s.fs.List(s.dataDir)
+	if err != nil {
+		return err
+	}
+	var fileNumber int
+	removed := false
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), tmpSuffix) {
+			continue
+		}
+		// the number of an interrupted write is never handed out again either
+		if _, err := fmt.Sscanf(f.Name(), "%06d.", &fileNumber); err == nil {
+			s.MarkFileNumUsed(fileNumber)
+		}
+		if err := s.fs.RemoveAll(filepath.Join(s.dataDir, f.Name())); err != nil {
+			return err
+		}
+		removed = true
+	}
+	if !removed {
+		return nil
+	}
+	return s.syncDir(s.dataDir)
+}
+
+// syncDir forces the entries of a directory (file creations, renames and deletions) to
+// stable storage, unless DisableDirSync has been called.
+func (s *Provider) syncDir(path string) error {
+	if s.noDirSync {
+		return nil
+	}
+	return s.fs.Sync(path)
+}
+
+func (s *Provider) OpenFileForReading(meta *FileMetadata) (File, error) {
 	filename := s.makeFileName(meta.fileNum, meta.fileType)
-	file, err := os.OpenFile(filepath.Join(s.dataDir, filename), openFlags, 0)
+	file, err := s.fs.Open(filepath.Join(s.dataDir, filename))
 	if err != nil {
 		return nil, err
 	}
 	return file, nil
 }
 
+// DeleteFile deletes a file from the data directory and syncs the directory, so that a
+// deleted file (e.g. an obsolete WAL) doesn't reappear after a crash.
 func (s *Provider) DeleteFile(meta *FileMetadata) error {
 	name := s.makeFileName(meta.fileNum, meta.fileType)
 	path := filepath.Join(s.dataDir, name)
-	err := os.Remove(path)
-	if os.IsNotExist(err) {
+	err := s.fs.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
 		return nil
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	return s.syncDir(s.dataDir)
+}
+
+// ArchiveFile moves a file from the data directory into dir, which has to be on the same
+// file system.
+func (s *Provider) ArchiveFile(meta *FileMetadata, dir string) error {
+	if err := s.fs.MkdirAll(dir); err != nil {
+		return err
+	}
+	name := s.makeFileName(meta.fileNum, meta.fileType)
+	err := s.fs.Rename(filepath.Join(s.dataDir, name), filepath.Join(dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// the file has to show up in the archive before it disappears from the data directory
+	if err = s.syncDir(dir); err != nil {
+		return err
+	}
+	return s.syncDir(s.dataDir)
+}
+
+// OffloadFile moves a file to the object store of a VFS implementing Offloader, such as
+// TieredFS. Reports false, doing nothing, if the VFS can't offload files.
+func (s *Provider) OffloadFile(meta *FileMetadata) (bool, error) {
+	o, ok := s.fs.(Offloader)
+	if !ok {
+		return false, nil
+	}
+	return true, o.Offload(s.FilePath(meta))
+}
+
+// MarkFileNumUsed makes sure fileNum and all numbers below it are never handed out.
+func (s *Provider) MarkFileNumUsed(fileNum int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fileNum = max(s.fileNum, fileNum)
+}
+
+// ReadManifest returns the contents of the manifest file, or nil if the data directory
+// doesn't have one yet.
+func (s *Provider) ReadManifest() ([]byte, error) {
+	data, err := ReadFile(s.fs, filepath.Join(s.dataDir, manifestFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// WriteManifest atomically replaces the manifest file. The contents are written to a
+// temporary file and synced to disk before it is renamed over the old manifest, so a
+// crash leaves either the old or the new manifest behind, never a partial one. The rename
+// is synced as well, so the new manifest is durable once WriteManifest returns.
+func (s *Provider) WriteManifest(data []byte) error {
+	tmpPath := filepath.Join(s.dataDir, manifestFileName+tmpSuffix)
+	// left behind by a failed attempt
+	if err := s.fs.RemoveAll(tmpPath); err != nil {
+		return err
+	}
+	if err := WriteFile(s.fs, tmpPath, data); err != nil {
+		return err
+	}
+	if err := s.fs.Rename(tmpPath, filepath.Join(s.dataDir, manifestFileName)); err != nil {
+		return err
+	}
+	return s.syncDir(s.dataDir)
 }
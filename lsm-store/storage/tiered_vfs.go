@@ -0,0 +1,417 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const defaultTieredCacheSize = 256 << 20 // 256 MiB
+
+// Offloader is implemented by a VFS that can move a file to cheaper, slower storage, where it
+// stays readable under the same name.
+type Offloader interface {
+	Offload(name string) error
+}
+
+// TieredConfig configures a TieredFS.
+type TieredConfig struct {
+	// Root is the directory whose files may be offloaded, usually the data directory. Objects
+	// are named after the path of their file relative to Root.
+	Root string
+	// CacheDir is the directory on the local VFS where offloaded files are kept once fetched.
+	// It is cleared when the TieredFS is created.
+	CacheDir string
+	// CacheSize bounds the bytes of the cached files, 256 MiB by default. The least recently
+	// opened files are evicted first.
+	CacheSize int64
+}
+
+// TieredFS is a VFS that keeps files on a local VFS until they are offloaded to an object
+// store, e.g. an S3 bucket. Offloaded files keep their name: they are listed along with the
+// local files of their directory, and opening one fetches it into a local cache. They are
+// immutable, so they can be removed or linked (which copies them back) but not renamed.
+//
+// The DB offloads the SSTables of the levels from Options.OffloadLevel on, which are cold and
+// immutable, while the WAL, the value log, the manifest and the upper levels stay local.
+type TieredFS struct {
+	local VFS
+	store ObjectStore
+	cfg   TieredConfig
+
+	mu       sync.Mutex
+	remote   map[string]ObjectInfo // offloaded files by name
+	cache    map[string]*cachedFile
+	fetching map[string]*fetch
+	used     int64  // bytes of the cached files
+	clock    uint64 // orders the uses of cached files
+}
+
+// cachedFile is an offloaded file fetched into the cache directory.
+type cachedFile struct {
+	path    string
+	size    int64
+	lastUse uint64
+}
+
+// fetch is a download in progress, which concurrent opens of the same file wait for.
+type fetch struct {
+	done chan struct{}
+	err  error
+}
+
+// NewTieredFS returns a TieredFS offloading the files of cfg.Root from local to store. The
+// files offloaded so far are listed from store.
+func NewTieredFS(local VFS, store ObjectStore, cfg TieredConfig) (*TieredFS, error) {
+	if cfg.CacheSize <= 0 {
+		cfg.CacheSize = defaultTieredCacheSize
+	}
+	cfg.Root, cfg.CacheDir = filepath.Clean(cfg.Root), filepath.Clean(cfg.CacheDir)
+	t := &TieredFS{
+		local:    local,
+		store:    store,
+		cfg:      cfg,
+		remote:   make(map[string]ObjectInfo),
+		cache:    make(map[string]*cachedFile),
+		fetching: make(map[string]*fetch),
+	}
+	// a cached file may be partial or stale after a crash
+	if err := local.RemoveAll(cfg.CacheDir); err != nil {
+		return nil, err
+	}
+	if err := local.MkdirAll(cfg.CacheDir); err != nil {
+		return nil, err
+	}
+	objects, err := store.List("")
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range objects {
+		t.remote[filepath.Join(cfg.Root, filepath.FromSlash(o.Key))] = o
+	}
+	return t, nil
+}
+
+// key returns the name of the object of the file name, which has to be below the root.
+func (t *TieredFS) key(name string) (string, error) {
+	rel, err := filepath.Rel(t.cfg.Root, name)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("storage: %s is outside of the tiered root %s", name, t.cfg.Root)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// Offload uploads the local file name to the object store and removes it from the local
+// VFS; it is still cached afterwards. The file must not be written anymore.
+func (t *TieredFS) Offload(name string) error {
+	name = filepath.Clean(name)
+	key, err := t.key(name)
+	if err != nil {
+		return err
+	}
+	f, err := t.local.Open(name)
+	if errors.Is(err, fs.ErrNotExist) && t.IsOffloaded(name) {
+		// offloaded already, e.g. a table moved down a level
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = t.store.Put(key, f, info.Size())
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remote[name] = ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}
+	// the local copy becomes the cached one
+	path := t.cachePath(key)
+	if err := t.local.Rename(name, path); err != nil {
+		return err
+	}
+	t.addToCache(name, path, info.Size())
+	return t.local.Sync(filepath.Dir(name))
+}
+
+// IsOffloaded reports whether the file name lives in the object store.
+func (t *TieredFS) IsOffloaded(name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.remote[filepath.Clean(name)]
+	return ok
+}
+
+func (t *TieredFS) cachePath(key string) string {
+	return filepath.Join(t.cfg.CacheDir, strings.ReplaceAll(key, "/", "_"))
+}
+
+// addToCache adds a file to the cache and evicts the least recently used ones beyond its
+// size. Must be called with t.mu held.
+func (t *TieredFS) addToCache(name, path string, size int64) {
+	t.clock++
+	t.cache[name] = &cachedFile{path: path, size: size, lastUse: t.clock}
+	t.used += size
+	for t.used > t.cfg.CacheSize && len(t.cache) > 1 {
+		var lru string
+		for n, c := range t.cache {
+			if lru == "" || c.lastUse < t.cache[lru].lastUse {
+				lru = n
+			}
+		}
+		t.evict(lru)
+	}
+}
+
+// evict removes a file from the cache. Handles opened on it stay readable. Must be called
+// with t.mu held.
+func (t *TieredFS) evict(name string) {
+	c, ok := t.cache[name]
+	if !ok {
+		return
+	}
+	delete(t.cache, name)
+	t.used -= c.size
+	t.local.Remove(c.path)
+}
+
+// openRemote opens the cached copy of an offloaded file, fetching it first if necessary.
+func (t *TieredFS) openRemote(name string) (File, error) {
+	t.mu.Lock()
+	for {
+		if c, ok := t.cache[name]; ok {
+			defer t.mu.Unlock()
+			t.clock++
+			c.lastUse = t.clock
+			return t.local.Open(c.path)
+		}
+		f, ok := t.fetching[name]
+		if !ok {
+			break
+		}
+		t.mu.Unlock()
+		<-f.done
+		if f.err != nil {
+			return nil, f.err
+		}
+		t.mu.Lock()
+	}
+	o, ok := t.remote[name]
+	if !ok {
+		t.mu.Unlock()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	f := &fetch{done: make(chan struct{})}
+	t.fetching[name] = f
+	t.mu.Unlock()
+
+	path := t.cachePath(o.Key)
+	f.err = t.download(o.Key, path)
+	t.mu.Lock()
+	delete(t.fetching, name)
+	close(f.done)
+	if f.err != nil {
+		t.mu.Unlock()
+		return nil, f.err
+	}
+	t.addToCache(name, path, o.Size)
+	t.mu.Unlock()
+	return t.openRemote(name)
+}
+
+// download copies the object key to the local file path.
+func (t *TieredFS) download(key, path string) error {
+	r, err := t.store.Get(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	tmp := path + tmpSuffix
+	if err := t.local.RemoveAll(tmp); err != nil {
+		return err
+	}
+	f, err := t.local.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return t.local.Rename(tmp, path)
+}
+
+// remoteInfo returns the FileInfo of an offloaded file. Must be called with t.mu held.
+func (t *TieredFS) remoteInfo(name string) (fs.FileInfo, bool) {
+	o, ok := t.remote[name]
+	if !ok {
+		return nil, false
+	}
+	return &fileInfo{name: filepath.Base(name), size: o.Size, modTime: o.ModTime}, true
+}
+
+func (t *TieredFS) Create(name string) (File, error) {
+	if t.IsOffloaded(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	}
+	return t.local.Create(name)
+}
+
+func (t *TieredFS) Open(name string) (File, error) {
+	f, err := t.local.Open(name)
+	if errors.Is(err, fs.ErrNotExist) && t.IsOffloaded(name) {
+		return t.openRemote(filepath.Clean(name))
+	}
+	return f, err
+}
+
+func (t *TieredFS) List(dir string) ([]fs.FileInfo, error) {
+	infos, err := t.local.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Clean(dir)
+	local := make(map[string]bool, len(infos))
+	for _, info := range infos {
+		local[info.Name()] = true
+	}
+	t.mu.Lock()
+	for name := range t.remote {
+		if filepath.Dir(name) == dir && !local[filepath.Base(name)] {
+			info, _ := t.remoteInfo(name)
+			infos = append(infos, info)
+		}
+	}
+	t.mu.Unlock()
+	sortFileInfos(infos)
+	return infos, nil
+}
+
+func (t *TieredFS) Stat(name string) (fs.FileInfo, error) {
+	info, err := t.local.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if info, ok := t.remoteInfo(filepath.Clean(name)); ok {
+			return info, nil
+		}
+	}
+	return info, err
+}
+
+// removeRemote deletes the object of an offloaded file, and reports whether there was one.
+func (t *TieredFS) removeRemote(name string) (bool, error) {
+	t.mu.Lock()
+	o, ok := t.remote[name]
+	t.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	if err := t.store.Delete(o.Key); err != nil {
+		return true, err
+	}
+	t.mu.Lock()
+	delete(t.remote, name)
+	t.evict(name)
+	t.mu.Unlock()
+	return true, nil
+}
+
+func (t *TieredFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	err := t.local.Remove(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	removed, rerr := t.removeRemote(name)
+	if rerr != nil || removed {
+		return rerr
+	}
+	return err
+}
+
+func (t *TieredFS) RemoveAll(name string) error {
+	name = filepath.Clean(name)
+	if err := t.local.RemoveAll(name); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	var names []string
+	for n := range t.remote {
+		if n == name || inDir(n, name) {
+			names = append(names, n)
+		}
+	}
+	t.mu.Unlock()
+	for _, n := range names {
+		if _, err := t.removeRemote(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TieredFS) Rename(oldname, newname string) error {
+	if t.IsOffloaded(oldname) {
+		if _, err := t.local.Stat(oldname); errors.Is(err, fs.ErrNotExist) {
+			return &fs.PathError{Op: "rename", Path: oldname, Err: errors.ErrUnsupported}
+		}
+	}
+	if err := t.local.Rename(oldname, newname); err != nil {
+		return err
+	}
+	// the renamed file replaces newname
+	_, err := t.removeRemote(filepath.Clean(newname))
+	return err
+}
+
+func (t *TieredFS) Link(oldname, newname string) error {
+	err := t.local.Link(oldname, newname)
+	if !errors.Is(err, fs.ErrNotExist) || !t.IsOffloaded(oldname) {
+		return err
+	}
+	// an offloaded file is copied back to the local VFS
+	in, err := t.openRemote(filepath.Clean(oldname))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := t.local.Create(newname)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (t *TieredFS) Mkdir(dir string) error {
+	return t.local.Mkdir(dir)
+}
+
+func (t *TieredFS) MkdirAll(dir string) error {
+	return t.local.MkdirAll(dir)
+}
+
+func (t *TieredFS) Sync(dir string) error {
+	return t.local.Sync(dir)
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+)
+
+// File is an open file of a VFS.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	// Sync forces the contents of the file to stable storage.
+	Sync() error
+	Stat() (fs.FileInfo, error)
+}
+
+// VFS is the file system the DB keeps its files on: the data directory, the WAL archive,
+// checkpoints and backups. Errors follow the os package, e.g. errors.Is(err, fs.ErrNotExist)
+// holds for a missing file.
+type VFS interface {
+	// Create creates a new file, open for reading and writing. It fails if the file exists.
+	Create(name string) (File, error)
+	// Open opens an existing file for reading.
+	Open(name string) (File, error)
+	// List returns the entries of the directory dir, sorted by name.
+	List(dir string) ([]fs.FileInfo, error)
+	Stat(name string) (fs.FileInfo, error)
+	// Remove deletes a file or an empty directory.
+	Remove(name string) error
+	// RemoveAll deletes a file or a directory with everything in it. A missing path isn't an error.
+	RemoveAll(name string) error
+	// Rename moves a file, replacing newname if it exists.
+	Rename(oldname, newname string) error
+	// Link makes newname a hard link to the file oldname.
+	Link(oldname, newname string) error
+	// Mkdir creates a directory. It fails if the directory exists.
+	Mkdir(dir string) error
+	// MkdirAll creates a directory along with its missing parents.
+	MkdirAll(dir string) error
+	// Sync forces the entries of the directory dir (files created, renamed or deleted in it)
+	// to stable storage.
+	Sync(dir string) error
+}
+
+// Default is the VFS of the local file system.
+var Default VFS = osFS{}
+
+type osFS struct{}
+
+func (osFS) Create(name string) (File, error) {
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+}
+
+func (osFS) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+func (osFS) List(dir string) ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if os.IsNotExist(err) {
+			// deleted since the directory was read
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (osFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (osFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (osFS) Mkdir(dir string) error {
+	return os.Mkdir(dir, 0755)
+}
+
+func (osFS) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, 0755)
+}
+
+func (osFS) Sync(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadFile returns the contents of the file name of vfs.
+func ReadFile(vfs VFS, name string) ([]byte, error) {
+	f, err := vfs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// WriteFile writes data to the new file name of vfs and syncs it.
+func WriteFile(vfs VFS, name string, data []byte) error {
+	f, err := vfs.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// sortFileInfos sorts the entries of a directory by name.
+func sortFileInfos(infos []fs.FileInfo) {
+	slices.SortFunc(infos, func(a, b fs.FileInfo) int { return strings.Compare(a.Name(), b.Name()) })
+}
@@ -0,0 +1,130 @@
+package typed
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec converts values of type T to and from bytes. A Codec of keys should keep their order:
+// a < b must encode to bytes sorting before those of b, so that scans and ranges of the Store
+// follow the order of T.
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(b []byte) (T, error)
+}
+
+// Bytes stores byte slices as they are.
+type Bytes struct{}
+
+func (Bytes) Encode(v []byte) ([]byte, error) { return v, nil }
+func (Bytes) Decode(b []byte) ([]byte, error) { return b, nil }
+
+// String stores strings as their bytes, which keeps their order.
+type String struct{}
+
+func (String) Encode(v string) ([]byte, error) { return []byte(v), nil }
+func (String) Decode(b []byte) (string, error) { return string(b), nil }
+
+// Uint64 stores integers as 8 bytes big-endian, which keeps their numeric order: 2 sorts before
+// 10, unlike with the "2" and "10" of fmt.Sprint.
+type Uint64 struct{}
+
+func (Uint64) Encode(v uint64) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, v), nil
+}
+
+func (Uint64) Decode(b []byte) (uint64, error) {
+	if len(b) != 8 {
+		return 0, fmt.Errorf("typed: uint64 of %d bytes", len(b))
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// Int64 stores integers as 8 bytes big-endian with the sign bit flipped, which keeps their
+// numeric order, negative numbers included.
+type Int64 struct{}
+
+func (Int64) Encode(v int64) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, uint64(v)^(1<<63)), nil
+}
+
+func (Int64) Decode(b []byte) (int64, error) {
+	if len(b) != 8 {
+		return 0, fmt.Errorf("typed: int64 of %d bytes", len(b))
+	}
+	return int64(binary.BigEndian.Uint64(b) ^ (1 << 63)), nil
+}
+
+// Float64 stores floats as 8 bytes big-endian, the sign bit flipped for positive numbers and
+// all bits for negative ones, which keeps their numeric order (with -0 before +0, and NaNs at
+// both ends depending on their sign).
+type Float64 struct{}
+
+func (Float64) Encode(v float64) ([]byte, error) {
+	bits := math.Float64bits(v)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return binary.BigEndian.AppendUint64(nil, bits), nil
+}
+
+func (Float64) Decode(b []byte) (float64, error) {
+	if len(b) != 8 {
+		return 0, fmt.Errorf("typed: float64 of %d bytes", len(b))
+	}
+	bits := binary.BigEndian.Uint64(b)
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits), nil
+}
+
+// JSON stores values as JSON, e.g. structs. Its bytes don't follow any order of T, so it is
+// meant for values rather than keys.
+type JSON[T any] struct{}
+
+func (JSON[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSON[T]) Decode(b []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(b, &v)
+	return v, err
+}
+
+// Proto returns the Codec storing protobuf messages in their binary wire format, e.g.
+// Proto[lsmpb.KeyValue]() for values of type *lsmpb.KeyValue. Like JSON, it is meant for
+// values. Messages are marshaled deterministically, so equal messages are stored as equal bytes
+// (see DB.CAS).
+func Proto[M any, PM interface {
+	*M
+	proto.Message
+}]() Codec[PM] {
+	return protoCodec[M, PM]{}
+}
+
+type protoCodec[M any, PM interface {
+	*M
+	proto.Message
+}] struct{}
+
+func (protoCodec[M, PM]) Encode(v PM) ([]byte, error) {
+	return proto.MarshalOptions{Deterministic: true}.Marshal(v)
+}
+
+func (protoCodec[M, PM]) Decode(b []byte) (PM, error) {
+	v := PM(new(M))
+	if err := proto.Unmarshal(b, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,220 @@
+// Package typed wraps a DB into a Store of keys of type K and values of type V, converted by
+// Codecs, rather than byte slices. Building keys by hand with []byte(fmt.Sprint(n)) sorts 10
+// before 2; the Uint64 and Int64 codecs keep the numeric order, so that scans and ranges of
+// numeric keys come out in order.
+//
+//	users := typed.New(d, typed.Uint64{}, typed.JSON[User]{})
+//	err := users.Set(42, User{Name: "ada"}, nil)
+//	u, err := users.Get(42)
+package typed
+
+import (
+	"lsm/db"
+)
+
+// Store is a typed view of a DB. Other Stores and untyped writes can share the DB, as long as
+// they don't write keys the codecs of this one can't decode within its ranges.
+type Store[K, V any] struct {
+	d    *db.DB
+	keys Codec[K]
+	vals Codec[V]
+}
+
+// New returns a Store of d encoding keys with keys and values with vals.
+func New[K, V any](d *db.DB, keys Codec[K], vals Codec[V]) *Store[K, V] {
+	return &Store[K, V]{d: d, keys: keys, vals: vals}
+}
+
+// DB returns the underlying DB.
+func (s *Store[K, V]) DB() *db.DB {
+	return s.d
+}
+
+// Get returns the value of key, or db.ErrKeyNotFound.
+func (s *Store[K, V]) Get(key K) (V, error) {
+	var val V
+	k, err := s.keys.Encode(key)
+	if err != nil {
+		return val, err
+	}
+	b, err := s.d.Get(k)
+	if err != nil {
+		return val, err
+	}
+	return s.vals.Decode(b)
+}
+
+func (s *Store[K, V]) Set(key K, val V, opts *db.WriteOptions) error {
+	k, err := s.keys.Encode(key)
+	if err != nil {
+		return err
+	}
+	v, err := s.vals.Encode(val)
+	if err != nil {
+		return err
+	}
+	return s.d.Set(k, v, opts)
+}
+
+func (s *Store[K, V]) Delete(key K, opts *db.WriteOptions) error {
+	k, err := s.keys.Encode(key)
+	if err != nil {
+		return err
+	}
+	return s.d.Delete(k, opts)
+}
+
+// DeleteRange deletes the keys in [start, end).
+func (s *Store[K, V]) DeleteRange(start, end K, opts *db.WriteOptions) error {
+	lo, hi, err := s.encodeBounds(&start, &end)
+	if err != nil {
+		return err
+	}
+	return s.d.DeleteRange(lo, hi, opts)
+}
+
+// CAS sets key to new if it holds expectedOld (see DB.CAS). The values are compared encoded,
+// so the value codec has to encode equal values to equal bytes. A nil expectedOld expects the
+// key not to exist, and a nil new deletes it.
+func (s *Store[K, V]) CAS(key K, expectedOld, new *V, opts *db.WriteOptions) error {
+	k, err := s.keys.Encode(key)
+	if err != nil {
+		return err
+	}
+	var old, val []byte
+	if expectedOld != nil {
+		if old, err = s.encodeValue(*expectedOld); err != nil {
+			return err
+		}
+	}
+	if new != nil {
+		if val, err = s.encodeValue(*new); err != nil {
+			return err
+		}
+	}
+	return s.d.CAS(k, old, val, opts)
+}
+
+// encodeValue encodes val to a non-nil slice, nil meaning no value to DB.CAS.
+func (s *Store[K, V]) encodeValue(val V) ([]byte, error) {
+	b, err := s.vals.Encode(val)
+	if b == nil && err == nil {
+		b = []byte{}
+	}
+	return b, err
+}
+
+// NewIter returns an iterator over the keys in [lower, upper). A nil bound leaves that side of
+// the range open. As with db.Iterator, it has to be positioned before use.
+func (s *Store[K, V]) NewIter(lower, upper *K) (*Iterator[K, V], error) {
+	lo, hi, err := s.encodeBounds(lower, upper)
+	if err != nil {
+		return nil, err
+	}
+	it, err := s.d.NewIter(&db.IterOptions{LowerBound: lo, UpperBound: hi})
+	if err != nil {
+		return nil, err
+	}
+	return &Iterator[K, V]{s: s, it: it}, nil
+}
+
+func (s *Store[K, V]) encodeBounds(lower, upper *K) (lo, hi []byte, err error) {
+	if lower != nil {
+		if lo, err = s.keys.Encode(*lower); err != nil {
+			return nil, nil, err
+		}
+	}
+	if upper != nil {
+		if hi, err = s.keys.Encode(*upper); err != nil {
+			return nil, nil, err
+		}
+	}
+	return lo, hi, nil
+}
+
+// Iterator walks the kv-pairs of a Store in key order, decoded. A kv-pair that fails to decode
+// stops it, with the error in Error.
+type Iterator[K, V any] struct {
+	s   *Store[K, V]
+	it  *db.Iterator
+	key K
+	val V
+	err error
+}
+
+func (i *Iterator[K, V]) First() bool {
+	return i.decode(i.it.First())
+}
+
+func (i *Iterator[K, V]) Last() bool {
+	return i.decode(i.it.Last())
+}
+
+// Seek positions the iterator at the smallest key >= key.
+func (i *Iterator[K, V]) Seek(key K) bool {
+	k, err := i.s.keys.Encode(key)
+	if err != nil {
+		i.err = err
+		return false
+	}
+	return i.decode(i.it.Seek(k))
+}
+
+// SeekLT positions the iterator at the largest key < key.
+func (i *Iterator[K, V]) SeekLT(key K) bool {
+	k, err := i.s.keys.Encode(key)
+	if err != nil {
+		i.err = err
+		return false
+	}
+	return i.decode(i.it.SeekLT(k))
+}
+
+func (i *Iterator[K, V]) Next() bool {
+	return i.Valid() && i.decode(i.it.Next())
+}
+
+func (i *Iterator[K, V]) Prev() bool {
+	return i.Valid() && i.decode(i.it.Prev())
+}
+
+func (i *Iterator[K, V]) Valid() bool {
+	return i.err == nil && i.it.Valid()
+}
+
+func (i *Iterator[K, V]) Key() K {
+	return i.key
+}
+
+func (i *Iterator[K, V]) Value() V {
+	return i.val
+}
+
+// Error returns the error, if any, that stopped the iteration: of the DB, or of a codec.
+func (i *Iterator[K, V]) Error() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.it.Error()
+}
+
+func (i *Iterator[K, V]) Close() error {
+	return i.it.Close()
+}
+
+// decode decodes the kv-pair the DB iterator moved to, if valid.
+func (i *Iterator[K, V]) decode(valid bool) bool {
+	var zeroK K
+	var zeroV V
+	i.key, i.val = zeroK, zeroV
+	if !valid || i.err != nil {
+		return false
+	}
+	if i.key, i.err = i.s.keys.Decode(i.it.Key()); i.err != nil {
+		return false
+	}
+	if i.val, i.err = i.s.vals.Decode(i.it.Value()); i.err != nil {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,44 @@
+package vlog
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// MaxPointerSize is the largest size of an encoded Pointer.
+const MaxPointerSize = 3 * binary.MaxVarintLen64
+
+var errCorruptPointer = errors.New("vlog: corrupt value pointer")
+
+// Pointer locates a record in a value log file. It is stored in the memtables and SSTables
+// in place of a value that was separated from its key.
+type Pointer struct {
+	FileNum int
+	Offset  uint32 // offset of the record in the value log file
+	Length  uint32 // length of the whole record
+}
+
+// pointer = fileNum|offset|length
+// All fields are uvarints.
+func (p Pointer) Encode() []byte {
+	buf := make([]byte, 0, MaxPointerSize)
+	buf = binary.AppendUvarint(buf, uint64(p.FileNum))
+	buf = binary.AppendUvarint(buf, uint64(p.Offset))
+	return binary.AppendUvarint(buf, uint64(p.Length))
+}
+
+func DecodePointer(buf []byte) (Pointer, error) {
+	var fields [3]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return Pointer{}, errCorruptPointer
+		}
+		fields[i] = v
+		buf = buf[n:]
+	}
+	if len(buf) != 0 || fields[1] > 1<<32-1 || fields[2] > 1<<32-1 {
+		return Pointer{}, errCorruptPointer
+	}
+	return Pointer{FileNum: int(fields[0]), Offset: uint32(fields[1]), Length: uint32(fields[2])}, nil
+}
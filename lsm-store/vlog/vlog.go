@@ -0,0 +1,109 @@
+package vlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// record header = checksum (4B)|keyLen|valLen
+// The checksum is a CRC-32C of everything following it.
+const maxHeaderSize = 4 + 2*binary.MaxVarintLen64
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruptRecord is returned for a record that fails its checksum or doesn't match its pointer.
+var ErrCorruptRecord = errors.New("vlog: corrupt record")
+
+type syncWriteCloser interface {
+	io.WriteCloser
+	Sync() error
+}
+
+// Writer appends records (key|val) to a value log file. The key is kept next to the value so
+// that a record can be told apart from others when the value log is rewritten.
+type Writer struct {
+	file          syncWriteCloser
+	fileNum       int
+	offset        int
+	syncPerAppend bool
+	buf           []byte
+}
+
+// NewWriter returns a writer appending to the (empty) value log file fileNum. With syncPerAppend,
+// every record is forced to stable storage before Append returns.
+func NewWriter(file syncWriteCloser, fileNum int, syncPerAppend bool) *Writer {
+	return &Writer{file: file, fileNum: fileNum, syncPerAppend: syncPerAppend}
+}
+
+// Append writes a record holding key and val and returns its location.
+func (w *Writer) Append(key, val []byte) (Pointer, error) {
+	if w.offset+maxHeaderSize+len(key)+len(val) > math.MaxUint32 {
+		return Pointer{}, errors.New("vlog: value log file full")
+	}
+	buf := append(w.buf[:0], 0, 0, 0, 0)
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = binary.AppendUvarint(buf, uint64(len(val)))
+	buf = append(buf, key...)
+	buf = append(buf, val...)
+	binary.LittleEndian.PutUint32(buf[:4], crc32.Checksum(buf[4:], crcTable))
+	w.buf = buf
+
+	if _, err := w.file.Write(buf); err != nil {
+		return Pointer{}, err
+	}
+	p := Pointer{FileNum: w.fileNum, Offset: uint32(w.offset), Length: uint32(len(buf))}
+	w.offset += len(buf)
+	if w.syncPerAppend {
+		if err := w.Sync(); err != nil {
+			return Pointer{}, err
+		}
+	}
+	return p, nil
+}
+
+// Size returns the number of bytes written to the value log file so far.
+func (w *Writer) Size() int {
+	return w.offset
+}
+
+// Sync forces the contents of the value log file to stable storage.
+func (w *Writer) Sync() error {
+	return w.file.Sync()
+}
+
+// Close syncs and closes the value log file.
+func (w *Writer) Close() error {
+	if err := w.Sync(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+// Read loads the record p points to from a value log file and returns its key and value.
+func Read(f io.ReaderAt, p Pointer) (key, val []byte, err error) {
+	buf := make([]byte, p.Length)
+	if _, err = f.ReadAt(buf, int64(p.Offset)); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil, ErrCorruptRecord
+		}
+		return nil, nil, err
+	}
+	if len(buf) < 4 || binary.LittleEndian.Uint32(buf[:4]) != crc32.Checksum(buf[4:], crcTable) {
+		return nil, nil, ErrCorruptRecord
+	}
+	data := buf[4:]
+	keyLen, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, nil, ErrCorruptRecord
+	}
+	data = data[n:]
+	valLen, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) != keyLen+valLen {
+		return nil, nil, ErrCorruptRecord
+	}
+	data = data[n:]
+	return data[:keyLen], data[keyLen:], nil
+}
@@ -0,0 +1,83 @@
+package wal
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression selects the codec applied to the payload of a record before it is split into
+// chunks. The codec is recorded in the type of every chunk of the record, so a reader decodes
+// every record with the codec it was written with, and the codec can change between records.
+type Compression uint8
+
+const (
+	NoCompression Compression = iota
+	SnappyCompression
+	ZstdCompression
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case SnappyCompression:
+		return "snappy"
+	case ZstdCompression:
+		return "zstd"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(c))
+}
+
+// zstd encoders and decoders are expensive to create, but safe for concurrent use through
+// EncodeAll and DecodeAll, so all writers and readers share one of each
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		e, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		return e
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		d, _ := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecodedSize))
+		return d
+	})
+)
+
+const (
+	// maxDecodedSize bounds the size of a decompressed record: a length read from a corrupt
+	// header mustn't be allocated before decoding fails.
+	maxDecodedSize = 1 << 30
+	// maxSnappyExpansion bounds how much larger than its encoding a snappy record can be, the
+	// longest copy (64 bytes) taking 3 bytes to encode.
+	maxSnappyExpansion = 32
+)
+
+// compress encodes src using the codec, reusing dst where possible.
+func (c Compression) compress(dst, src []byte) []byte {
+	switch c {
+	case SnappyCompression:
+		return snappy.Encode(dst[:cap(dst)], src)
+	case ZstdCompression:
+		return zstdEncoder().EncodeAll(src, dst[:0])
+	default:
+		return append(dst[:0], src...)
+	}
+}
+
+// decompress decodes src using the codec, reusing dst where possible.
+func (c Compression) decompress(dst, src []byte) ([]byte, error) {
+	switch c {
+	case NoCompression:
+		return append(dst[:0], src...), nil
+	case SnappyCompression:
+		if n, err := snappy.DecodedLen(src); err != nil || n > len(src)*maxSnappyExpansion {
+			return nil, snappy.ErrCorrupt
+		}
+		return snappy.Decode(dst[:cap(dst)], src)
+	case ZstdCompression:
+		return zstdDecoder().DecodeAll(src, dst[:0])
+	default:
+		return nil, fmt.Errorf("wal: unknown compression %d", uint8(c))
+	}
+}
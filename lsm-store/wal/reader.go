@@ -4,17 +4,78 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"lsm/encoder"
+	"math"
 )
 
+// ErrCorruptChunk is returned by Reader.Next for a chunk that fails its checksum or doesn't
+// fit the surrounding chunks.
+var ErrCorruptChunk = errors.New("wal: corrupt chunk")
+
+// RecoveryMode determines how the replay of a WAL file reacts to a chunk that can't be read.
+type RecoveryMode uint8
+
+const (
+	TolerateCorruptedTail RecoveryMode = iota // stop at the corrupt chunk, keeping the records before it
+	AbsoluteConsistency                       // fail the replay, even for a write torn by a crash
+	SkipAnyCorruptRecord                      // skip the records that can't be read, replay all others
+)
+
+func (m RecoveryMode) String() string {
+	switch m {
+	case TolerateCorruptedTail:
+		return "tolerate-corrupted-tail"
+	case AbsoluteConsistency:
+		return "absolute-consistency"
+	case SkipAnyCorruptRecord:
+		return "skip-any-corrupt-record"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(m))
+}
+
 // retrieve records from a log file, one block at a time
 type Reader struct {
 	file     io.Reader
-	blockNum int //-1 -> no blocks loaded yet
+	blockNum int  // of the loaded block, the one before the first block to load until then
+	started  bool // whether the first block has been loaded
+	skip     int  // bytes of the first block before the record to start at
 	block    *block
 	encoder  *encoder.Encoder
 	buf      *bytes.Buffer
+	payload  []byte  // the decompressed payload of a compressed record
+	chunks   []Chunk // of the record returned (or failed on) by the last call to Next
+	record   int64   // where the last record returned by Next starts
+	offset   int64   // right after the last record returned by Next
+}
+
+// ChunkType tells which part of a record a chunk holds.
+type ChunkType uint8
+
+func (t ChunkType) String() string {
+	switch t {
+	case chunkTypePadding:
+		return "padding"
+	case chunkTypeFull:
+		return "full"
+	case chunkTypeFirst:
+		return "first"
+	case chunkTypeMiddle:
+		return "middle"
+	case chunkTypeLast:
+		return "last"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(t))
+}
+
+// Chunk describes a chunk of a log file, as read from its header.
+type Chunk struct {
+	Offset      int64 // of the chunk header in the file
+	Type        ChunkType
+	Compression Compression // of the record the chunk belongs to
+	Length      int         // of the payload
 }
 
 func NewReader(logFile io.ReadCloser) *Reader {
@@ -27,6 +88,23 @@ func NewReader(logFile io.ReadCloser) *Reader {
 	}
 }
 
+// NewReaderAt returns a reader resuming at offset, which has to be where a record starts, e.g.
+// one returned by Offset or RecordOffset: a replica or a replay continues from the offset it
+// last recorded, without reading the log from the start. Only the block offset is in is read.
+func NewReaderAt(logFile io.ReaderAt, offset int64) *Reader {
+	first := offset / blockSize
+	return &Reader{
+		file:     io.NewSectionReader(logFile, first*blockSize, math.MaxInt64-first*blockSize),
+		blockNum: int(first) - 1,
+		skip:     int(offset % blockSize),
+		block:    &block{},
+		encoder:  encoder.NewEncoder(),
+		buf:      &bytes.Buffer{},
+		record:   offset,
+		offset:   offset,
+	}
+}
+
 // sequentially load data blocks (4 KB each) from a WAL file into memory
 func (r *Reader) loadNextBlock() (err error) {
 	b := r.block
@@ -50,53 +128,147 @@ func (r *Reader) loadNextBlock() (err error) {
 // Next goes through the WAL file block by block and chunk by chunk to reconstruct the full
 // representation of each record stored inside the write-ahead log and pass it for insertion
 // into a memtable.
-func (r *Reader) Next() (key []byte, val *encoder.EncodedValue, err error) {
-	b := r.block
+// Every chunk is verified against its checksum. Next returns ErrCorruptChunk when it runs into
+// a damaged chunk (e.g. a torn write at the tail of the log), io.ErrUnexpectedEOF when the log
+// ends in the middle of a record, and io.EOF once the log is exhausted.
+// After ErrCorruptChunk, Next can be called again to continue with the next record that can be
+// read: a chunk failing its checksum can't be trusted with its length, so the rest of its block
+// is skipped along with it, while a chunk that doesn't fit the chunks before it is skipped alone.
+// Alongside the kv-pair, it returns the ID of the column family the record belongs to.
+func (r *Reader) Next() (cfID uint32, key []byte, val *encoder.EncodedValue, err error) {
 	// load the very first WAL block into memory
-	if r.blockNum == -1 {
-		if err = r.loadNextBlock(); err != nil {
-			return
-		}
-	}
-	// check if EOF reached (when last block in WAL is not properly sealed)
-	if b.offset >= b.len {
-		err = io.EOF
-		return
-	}
-	// check if last record in block reached (when last block in WAL is properly sealed)
-	if b.len-b.offset <= headerSize {
+	if !r.started {
 		if err = r.loadNextBlock(); err != nil {
 			return
 		}
+		r.started = true
+		r.block.offset = r.skip
 	}
 	// start with a clean scratch buffer
 	r.buf.Reset()
+	r.chunks = r.chunks[:0]
 	// recover all chunks to form the full payload
 	for {
+		b := r.block
+		// check if last record in block reached (the rest of the block is too small to hold
+		// a chunk or has been zero padded)
+		if b.len-b.offset <= headerSize || b.buf[b.offset+6] == chunkTypePadding {
+			// check if EOF reached (when last block in WAL is not properly sealed)
+			if b.len < blockSize {
+				err = r.eof()
+				return
+			}
+			if err = r.loadNextBlock(); err != nil {
+				if err == io.EOF {
+					err = r.eof()
+				}
+				return
+			}
+			continue
+		}
 		start := b.offset
-		// extract data from chunk header (payload length and chunk type)
-		dataLen := int(binary.LittleEndian.Uint16(b.buf[start : start+2]))
-		chunkType := b.buf[start+2]
+		// extract data from chunk header (checksum, payload length and chunk type)
+		checksum := binary.LittleEndian.Uint32(b.buf[start : start+4])
+		dataLen := int(binary.LittleEndian.Uint16(b.buf[start+4 : start+6]))
+		chunkType := b.buf[start+6] & chunkTypeMask
+		codec := Compression(b.buf[start+6] >> compressionShift)
+		end := start + headerSize + dataLen
+		r.chunks = append(r.chunks, Chunk{
+			Offset:      int64(r.blockNum)*blockSize + int64(start),
+			Type:        ChunkType(chunkType),
+			Compression: codec,
+			Length:      dataLen,
+		})
+		if end > b.len || crc32.Checksum(b.buf[start+6:end], crcTable) != checksum {
+			b.offset = b.len
+			err = ErrCorruptChunk
+			return
+		}
+		// a record either starts with a full/first chunk or continues with a middle/last one
+		inRecord := r.buf.Len() > 0
+		startsRecord := chunkType == chunkTypeFull || chunkType == chunkTypeFirst
+		if inRecord == startsRecord {
+			// the record before a chunk starting a new one is incomplete, but that chunk may
+			// well start the next record read
+			if !inRecord {
+				b.offset = end
+			}
+			err = ErrCorruptChunk
+			return
+		}
+		// every chunk of a record is compressed with the codec of the record
+		if codec != r.chunks[0].Compression {
+			b.offset = end
+			err = ErrCorruptChunk
+			return
+		}
 		// copy recovered payload to scratch buffer
-		r.buf.Write(b.buf[start+headerSize : start+headerSize+dataLen])
+		r.buf.Write(b.buf[start+headerSize : end])
 		// advance the data block offset
-		b.offset += headerSize + dataLen
+		b.offset = end
 		// check if there are no chunks left to process for this record
 		if chunkType == chunkTypeFull || chunkType == chunkTypeLast {
 			break
 		}
-		// load next block to retrieve the subsequent chunk
-		if err = r.loadNextBlock(); err != nil {
-			return
-		}
 	}
 	// retrieve scratch buffer contents (i.e., the payload)
 	scratch := r.buf.Bytes()
+	if codec := r.chunks[0].Compression; codec != NoCompression {
+		if r.payload, err = codec.decompress(r.payload, scratch); err != nil {
+			err = ErrCorruptChunk
+			return
+		}
+		scratch = r.payload
+	}
 	// parse the WAL record
-	keyLen, n := binary.Uvarint(scratch[:])
+	id, n := binary.Uvarint(scratch)
+	if n <= 0 || id > math.MaxUint32 {
+		err = ErrCorruptChunk
+		return
+	}
+	cfID, scratch = uint32(id), scratch[n:]
+	keyLen, n := binary.Uvarint(scratch)
+	if n <= 0 {
+		err = ErrCorruptChunk
+		return
+	}
 	_, m := binary.Uvarint(scratch[n:])
+	if m <= 0 || uint64(len(scratch)-n-m) < keyLen {
+		err = ErrCorruptChunk
+		return
+	}
 	key = make([]byte, keyLen)
 	copy(key, scratch[n+m:n+m+int(keyLen)])
 	val = r.encoder.Parse(scratch[n+m+int(keyLen):])
+	r.record = r.chunks[0].Offset
+	r.offset = int64(r.blockNum)*blockSize + int64(r.block.offset)
 	return
 }
+
+// eof returns the error for the end of the log: io.EOF, unless it cuts a record short.
+func (r *Reader) eof() error {
+	if r.buf.Len() > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return io.EOF
+}
+
+// Offset returns the offset right after the last record returned by Next: a log truncated to
+// it keeps every record read so far, and nothing that failed to be read, and a reader created
+// by NewReaderAt at it continues with the record after it.
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// RecordOffset returns the offset the last record returned by Next starts at, i.e. of the
+// header of its first chunk: a reader created by NewReaderAt at it reads that record again.
+func (r *Reader) RecordOffset() int64 {
+	return r.record
+}
+
+// Chunks returns the chunks of the record returned by the last call to Next, or those read
+// before it failed, the last one being the corrupt chunk for ErrCorruptChunk. The slice is
+// only valid until the next call to Next.
+func (r *Reader) Chunks() []Chunk {
+	return r.chunks
+}
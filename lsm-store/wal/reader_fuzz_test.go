@@ -0,0 +1,144 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"lsm/encoder"
+	"testing"
+)
+
+// memFile is a WAL file held in memory.
+type memFile struct {
+	bytes.Buffer
+}
+
+func (f *memFile) Sync() error  { return nil }
+func (f *memFile) Close() error { return nil }
+
+// fuzzRecord is a record read from or written to a WAL file.
+type fuzzRecord struct {
+	cfID      uint32
+	key       []byte
+	kind      encoder.OpKind
+	seqNum    uint64
+	timestamp int64
+	val       []byte
+}
+
+func newFuzzRecord(cfID uint32, key []byte, ev *encoder.EncodedValue) (fuzzRecord, bool) {
+	rec := fuzzRecord{
+		cfID:      cfID,
+		key:       bytes.Clone(key),
+		seqNum:    ev.SeqNum(),
+		timestamp: ev.Timestamp(),
+		val:       bytes.Clone(ev.Value()),
+	}
+	switch {
+	case !ev.Valid():
+		return rec, false
+	case ev.IsTombstone():
+		rec.kind = encoder.OpKindDelete
+	case ev.IsRangeTombstone():
+		rec.kind = encoder.OpKindRangeDelete
+	case ev.IsValuePointer():
+		rec.kind = encoder.OpKindValuePointer
+	case ev.IsMerge():
+		rec.kind = encoder.OpKindMerge
+	default:
+		rec.kind = encoder.OpKindSet
+	}
+	return rec, true
+}
+
+func (rec fuzzRecord) equal(other fuzzRecord) bool {
+	return rec.cfID == other.cfID && bytes.Equal(rec.key, other.key) && rec.kind == other.kind &&
+		rec.seqNum == other.seqNum && rec.timestamp == other.timestamp && bytes.Equal(rec.val, other.val)
+}
+
+// writeWAL writes records to a WAL file, switching compression every record.
+func writeWAL(t testing.TB, records []fuzzRecord) []byte {
+	f := &memFile{}
+	w := NewWriter(f, SyncNever)
+	e := encoder.NewEncoder()
+	for i, rec := range records {
+		w.SetCompression(Compression(i % 3))
+		if err := w.record(rec.cfID, rec.key, e.EncodeTimestamped(rec.kind, rec.seqNum, rec.timestamp, rec.val)); err != nil {
+			t.Fatalf("writing record %d: %v", i, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f.Bytes()
+}
+
+// readWAL reads data as a WAL file, skipping the corrupt records, and reads the last record
+// found again from its offset. It reports whether the file read without corruption, every
+// record being one the writer may write.
+func readWAL(t *testing.T, data []byte) (records []fuzzRecord, valid bool) {
+	r := NewReader(io.NopCloser(bytes.NewReader(data)))
+	last, valid := int64(-1), true
+	for calls := 0; ; calls++ {
+		// every call to Next has to consume some of the file
+		if calls > len(data)+1 {
+			t.Fatalf("%d calls to Next on a file of %d bytes", calls, len(data))
+		}
+		cfID, key, ev, err := r.Next()
+		if errors.Is(err, ErrCorruptChunk) {
+			valid = false
+			continue
+		}
+		if err != nil {
+			valid = valid && err == io.EOF
+			break
+		}
+		last = r.RecordOffset()
+		rec, ok := newFuzzRecord(cfID, key, ev)
+		valid = valid && ok
+		records = append(records, rec)
+	}
+	if last >= 0 {
+		r = NewReaderAt(bytes.NewReader(data), last)
+		if _, _, _, err := r.Next(); err != nil {
+			t.Fatalf("reading the record at offset %d again: %v", last, err)
+		}
+	}
+	return records, valid
+}
+
+// FuzzWALReader feeds arbitrary files to the WAL reader, which has to reject damaged records
+// with an error rather than panic or loop forever. The records of a file read without
+// corruption are written to a new file, which has to read back the same records.
+func FuzzWALReader(f *testing.F) {
+	large := bytes.Repeat([]byte("value spanning blocks "), 3*blockSize/22)
+	seeds := [][]fuzzRecord{
+		nil,
+		{{cfID: 0, key: []byte("key"), kind: encoder.OpKindSet, seqNum: 1, val: []byte("value")}},
+		{
+			{cfID: 1, key: []byte("a"), kind: encoder.OpKindSet, seqNum: 1, timestamp: 42, val: []byte("1")},
+			{cfID: 1, key: []byte("a"), kind: encoder.OpKindDelete, seqNum: 2, timestamp: 43},
+			{cfID: 2, key: []byte("a"), kind: encoder.OpKindRangeDelete, seqNum: 3, val: []byte("z")},
+			{cfID: 0, key: []byte("big"), kind: encoder.OpKindSet, seqNum: 4, val: large},
+			{cfID: 0, key: []byte("empty"), kind: encoder.OpKindSet, seqNum: 5, val: []byte{}},
+		},
+	}
+	for _, records := range seeds {
+		f.Add(writeWAL(f, records))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		records, valid := readWAL(t, data)
+		if !valid {
+			return
+		}
+		again, valid := readWAL(t, writeWAL(t, records))
+		if !valid || len(again) != len(records) {
+			t.Fatalf("%d records written, %d read back (valid: %t)", len(records), len(again), valid)
+		}
+		for i := range records {
+			if !records[i].equal(again[i]) {
+				t.Fatalf("record %d read back as %+v, written as %+v", i, again[i], records[i])
+			}
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package wal
+
+import (
+	"io"
+	"lsm/encoder"
+	"lsm/storage"
+	"sync"
+)
+
+// SegmentState is what a Tailer needs to know about the WAL segment it follows.
+type SegmentState struct {
+	Synced  int64                 // bytes of the segment that may be read, all of them once it is sealed
+	Next    *storage.FileMetadata // the segment written after it, nil until it is sealed
+	Changed <-chan struct{}       // closed once Synced or Next change, nil once they can't anymore
+}
+
+// TailSource gives a Tailer access to the WAL segments it follows, e.g. those of a DB.
+type TailSource interface {
+	// OpenSegment opens the segment fm for reading. The tailer is done with the segments
+	// before it, which the source may delete from now on.
+	OpenSegment(fm *storage.FileMetadata) (storage.File, error)
+	// SegmentState tells how far the segment fm may be read, and which one follows it.
+	SegmentState(fm *storage.FileMetadata) (SegmentState, error)
+	// Close is called once the tailer is closed, which is done with every segment.
+	Close() error
+}
+
+// Tailer follows a WAL as it grows: it returns the records of a segment as soon as they are
+// synced, and carries on with the next segment once the one it follows is sealed. It is meant
+// for replication and changefeeds, which need every write in the order it was made.
+type Tailer struct {
+	src     TailSource
+	mu      sync.Mutex // held by Next, but while it waits for more records
+	fm      *storage.FileMetadata
+	file    storage.File // of fm, nil until it is opened
+	r       *Reader      // reading file up to limit
+	limit   int64
+	offset  int64 // right after the last record returned by Next
+	closing chan struct{}
+	once    sync.Once
+}
+
+// NewTailer returns a tailer following the WAL from offset (where a record starts, e.g. one
+// returned by Position) of the segment fm on.
+func NewTailer(src TailSource, fm *storage.FileMetadata, offset int64) *Tailer {
+	return &Tailer{
+		src:     src,
+		fm:      fm,
+		offset:  offset,
+		closing: make(chan struct{}),
+	}
+}
+
+// Next returns the next record, blocking until it is synced. It returns ErrCorruptChunk (or
+// io.ErrUnexpectedEOF) for a record that can't be read, ErrClosed once the tailer is closed,
+// and the errors of the source, e.g. once the DB is closed.
+func (t *Tailer) Next() (cfID uint32, key []byte, val *encoder.EncodedValue, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		select {
+		case <-t.closing:
+			err = ErrClosed
+			return
+		default:
+		}
+		if t.r != nil {
+			cfID, key, val, err = t.r.Next()
+			if err != io.EOF {
+				if err == nil {
+					t.offset = t.r.Offset()
+				}
+				return
+			}
+		}
+		// every record synced so far has been read
+		if t.file == nil {
+			if t.file, err = t.src.OpenSegment(t.fm); err != nil {
+				return
+			}
+		}
+		var state SegmentState
+		if state, err = t.src.SegmentState(t.fm); err != nil {
+			return
+		}
+		switch {
+		case state.Synced > t.limit:
+			t.r = NewReaderAt(io.NewSectionReader(t.file, 0, state.Synced), t.offset)
+			t.limit = state.Synced
+		case state.Next != nil:
+			t.file.Close()
+			t.fm, t.file, t.r = state.Next, nil, nil
+			t.limit, t.offset = 0, 0
+		default:
+			t.mu.Unlock()
+			select {
+			case <-state.Changed:
+			case <-t.closing:
+			}
+			t.mu.Lock()
+		}
+	}
+}
+
+// Position returns the segment followed and the offset right after the last record returned
+// by Next: a tailer created there continues with the record after it.
+func (t *Tailer) Position() (*storage.FileMetadata, int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.fm, t.offset
+}
+
+// Close stops the tailer, making a pending call to Next return ErrClosed.
+func (t *Tailer) Close() error {
+	err := ErrClosed
+	t.once.Do(func() {
+		close(t.closing)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.file != nil {
+			t.file.Close()
+			t.file, t.r = nil, nil
+		}
+		err = t.src.Close()
+	})
+	return err
+}
@@ -3,27 +3,67 @@ package wal
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"lsm/encoder"
 )
 
-const headerSize = 3
+// chunk header = checksum (4B)|payload length (2B)|chunk type (1B)
+// The chunk type byte holds the type in its low 4 bits and the Compression of the record the
+// chunk belongs to in its high 4 bits.
+const headerSize = 7
 
 const (
-	chunkTypeFull   = 1
-	chunkTypeFirst  = 2
-	chunkTypeMiddle = 3
-	chunkTypeLast   = 4
+	chunkTypeMask    = 0x0f
+	compressionShift = 4
+)
+
+// CRC-32C of the chunk type and payload, guards against torn writes and bit rot
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+const (
+	chunkTypePadding = 0 // zeroed space at the end of a block, never an actual chunk
+	chunkTypeFull    = 1
+	chunkTypeFirst   = 2
+	chunkTypeMiddle  = 3
+	chunkTypeLast    = 4
 )
 
 const blockSize = 4 << 10 // 4 KiB
 
+// ErrClosed is returned by Close for a writer or tailer that has been closed already, and by
+// Tailer.Next once the tailer is closed.
+var ErrClosed = errors.New("wal: closed")
+
 type block struct {
 	buf    [blockSize]byte // used as a scratch space for writing records in memory
 	offset int             // current position within the block that data should be written to or read from
 	len    int             // total size of the data block (can be <blockSize for last block)
 }
 
+// SyncPolicy determines when WAL writes are forced to stable storage.
+type SyncPolicy uint8
+
+const (
+	SyncPerCommit SyncPolicy = iota // fsync once every record (all of its chunks) has been written
+	SyncPeriodic                    // the owner of the writer calls Sync at regular intervals
+	SyncNever                       // leave it to the OS to flush its page cache
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncPerCommit:
+		return "per-commit"
+	case SyncPeriodic:
+		return "periodic"
+	case SyncNever:
+		return "never"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(p))
+}
+
 type syncWriteCloser interface {
 	io.WriteCloser
 	Sync() error
@@ -35,14 +75,25 @@ type Writer struct {
 	file    syncWriteCloser
 	encoder *encoder.Encoder
 	buf     *bytes.Buffer // staging area for splitting the full payload into chunks that fit into the fixed-size block buffer
+	sync    SyncPolicy
+	size    int64 // bytes written to the WAL file so far
+	// codec of the records written from now on, and the buffer they are compressed into
+	compression Compression
+	compressed  []byte
+	// records aren't synced on their own while their owner commits a group of them
+	deferSync bool
+	// bytes synced so far (see Synced), and the channel closed once more are
+	synced  int64
+	changed chan struct{}
 }
 
-func NewWriter(logFile syncWriteCloser) *Writer {
+func NewWriter(logFile syncWriteCloser, sync SyncPolicy) *Writer {
 	w := &Writer{
 		block:   &block{},
 		file:    logFile,
 		encoder: encoder.NewEncoder(),
 		buf:     &bytes.Buffer{},
+		sync:    sync,
 	}
 	return w
 }
@@ -57,23 +108,59 @@ func (w *Writer) scratchBuf(needed int) []byte {
 	return buf[:needed]
 }
 
-// writeAndSync writes to the underlying WAL file and forces a sync of its contents to stable storage
-func (w *Writer) writeAndSync(p []byte) (err error) {
-	if _, err = w.file.Write(p); err != nil {
-		return err
-	}
-	// data is immediately written to disk rather than stuck in the Linux page cache.
-	if err = w.file.Sync(); err != nil {
+// Sync forces the contents of the WAL file to stable storage, so data is written to disk
+// rather than stuck in the Linux page cache.
+func (w *Writer) Sync() error {
+	if err := w.file.Sync(); err != nil {
 		return err
 	}
+	w.publish()
 	return nil
 }
 
-// sealBlock applies zero padding to the current block and calls writeAndSync to persist it to stable storage
+// Synced returns the number of bytes of the WAL file synced so far (written so far with
+// SyncNever), i.e. the records a Tailer may read, and a channel closed once more are, or the
+// writer is closed.
+func (w *Writer) Synced() (int64, <-chan struct{}) {
+	if w.changed == nil {
+		w.changed = make(chan struct{})
+	}
+	return w.synced, w.changed
+}
+
+// publish makes the records written so far visible to Synced.
+func (w *Writer) publish() {
+	w.synced = w.size
+	if w.changed != nil {
+		close(w.changed)
+		w.changed = nil
+	}
+}
+
+// DeferSync suspends the syncing of every record (SyncPerCommit) while the owner of the
+// writer commits a group of records, which it syncs at once afterwards (group commit).
+func (w *Writer) DeferSync(deferSync bool) {
+	w.deferSync = deferSync
+}
+
+// SetCompression sets the codec the payload of the records written from now on is compressed
+// with. A record that doesn't get any smaller is written uncompressed.
+func (w *Writer) SetCompression(c Compression) {
+	w.compression = c
+}
+
+// Size returns the number of bytes written to the WAL file so far.
+func (w *Writer) Size() int64 {
+	return w.size
+}
+
+// sealBlock applies zero padding to the current block and writes it to the WAL file
 func (w *Writer) sealBlock() error {
 	b := w.block
 	clear(b.buf[b.offset:])
-	if err := w.writeAndSync(b.buf[b.offset:]); err != nil {
+	n, err := w.file.Write(b.buf[b.offset:])
+	w.size += int64(n)
+	if err != nil {
 		return err
 	}
 	// prepare data block for new iteration.
@@ -84,14 +171,15 @@ func (w *Writer) sealBlock() error {
 	return nil
 }
 
-func (w *Writer) record(key, val []byte) error {
+func (w *Writer) record(cfID uint32, key, val []byte) error {
 	// determine the maximum possible payload length
 	keyLen, valLen := len(key), len(val)
-	maxLen := 2*binary.MaxVarintLen64 + keyLen + valLen
+	maxLen := 3*binary.MaxVarintLen64 + keyLen + valLen
 	// initialize a scratch buffer capable of fitting the entire payload
 	scratch := w.scratchBuf(maxLen)
 	// place the entire payload into the scratch buffer
-	n := binary.PutUvarint(scratch[:], uint64(keyLen))
+	n := binary.PutUvarint(scratch[:], uint64(cfID))
+	n += binary.PutUvarint(scratch[n:], uint64(keyLen))
 	n += binary.PutUvarint(scratch[n:], uint64(valLen))
 	copy(scratch[n:], key)
 	copy(scratch[n+keyLen:], val)
@@ -99,6 +187,12 @@ func (w *Writer) record(key, val []byte) error {
 	dataLen := n + keyLen + valLen
 	// discard the unused portion
 	scratch = scratch[:dataLen]
+	codec := NoCompression
+	if w.compression != NoCompression {
+		if c := w.compression.compress(w.compressed, scratch); len(c) < len(scratch) {
+			w.compressed, scratch, codec = c, c, w.compression
+		}
+	}
 
 	// start splitting the payload into chunks
 	for chunk := 0; len(scratch) > 0; chunk++ {
@@ -114,53 +208,96 @@ func (w *Writer) record(key, val []byte) error {
 		buf := b.buf[b.offset:]
 		dataLen = copy(buf[headerSize:], scratch)
 		// write the payload length to the chunk header
-		binary.LittleEndian.PutUint16(buf, uint16(dataLen))
+		binary.LittleEndian.PutUint16(buf[4:6], uint16(dataLen))
 		// advance the scratch buffer and data block offsets
 		scratch = scratch[dataLen:]
 		b.offset += dataLen + headerSize
 
-		// determine the chunk type and write it to the chunk header
-		if b.offset < blockSize {
+		// determine the chunk type and write it to the chunk header, along with the codec
+		if len(scratch) == 0 {
 			if chunk == 0 {
-				buf[2] = chunkTypeFull
+				buf[6] = chunkTypeFull
 			} else {
-				buf[2] = chunkTypeLast
+				buf[6] = chunkTypeLast
 			}
 		} else {
 			if chunk == 0 {
-				buf[2] = chunkTypeFirst
+				buf[6] = chunkTypeFirst
 			} else {
-				buf[2] = chunkTypeMiddle
+				buf[6] = chunkTypeMiddle
 			}
 		}
+		buf[6] |= byte(codec) << compressionShift
+		// checksum the chunk type and payload
+		binary.LittleEndian.PutUint32(buf[0:4], crc32.Checksum(buf[6:dataLen+headerSize], crcTable))
 
-		// flush updated data block portion to disk
-		if err := w.writeAndSync(buf[:dataLen+headerSize]); err != nil {
+		// write updated data block portion to the WAL file
+		n, err := w.file.Write(buf[:dataLen+headerSize])
+		w.size += int64(n)
+		if err != nil {
 			return err
 		}
 	}
+	if w.sync == SyncPerCommit && !w.deferSync {
+		return w.Sync()
+	}
+	if w.sync == SyncNever {
+		w.publish()
+	}
 	return nil
 }
 
-func (w *Writer) RecordInsertion(key, val []byte) error {
-	val = w.encoder.Encode(encoder.OpKindSet, val)
-	return w.record(key, val)
+// RecordInsertion logs a write of key to the column family cfID. A timestamp other than 0 is
+// recorded along with it (see encoder.EncodeTimestamped), as with the other writes.
+func (w *Writer) RecordInsertion(cfID uint32, seqNum uint64, timestamp int64, key, val []byte) error {
+	val = w.encoder.EncodeTimestamped(encoder.OpKindSet, seqNum, timestamp, val)
+	return w.record(cfID, key, val)
 }
 
-func (w *Writer) RecordDeletion(key []byte) error {
-	val := w.encoder.Encode(encoder.OpKindDelete, nil)
-	return w.record(key, val)
+// RecordValuePointer logs a write of key to the column family cfID whose value was appended
+// to the value log, ptr being the encoded vlog.Pointer to it.
+func (w *Writer) RecordValuePointer(cfID uint32, seqNum uint64, timestamp int64, key, ptr []byte) error {
+	val := w.encoder.EncodeTimestamped(encoder.OpKindValuePointer, seqNum, timestamp, ptr)
+	return w.record(cfID, key, val)
+}
+
+// RecordDeletion logs a deletion of key from the column family cfID.
+func (w *Writer) RecordDeletion(cfID uint32, seqNum uint64, timestamp int64, key []byte) error {
+	return w.RecordSoftDeletion(cfID, seqNum, timestamp, key, nil)
+}
+
+// RecordSoftDeletion logs a deletion of key from the column family cfID whose tombstone
+// carries payload, e.g. the deleted value so that the deletion can be undone.
+func (w *Writer) RecordSoftDeletion(cfID uint32, seqNum uint64, timestamp int64, key, payload []byte) error {
+	val := w.encoder.EncodeTimestamped(encoder.OpKindDelete, seqNum, timestamp, payload)
+	return w.record(cfID, key, val)
+}
+
+// RecordRangeDeletion logs the deletion of every key in [start, end) from the column family cfID.
+func (w *Writer) RecordRangeDeletion(cfID uint32, seqNum uint64, start, end []byte) error {
+	val := w.encoder.Encode(encoder.OpKindRangeDelete, seqNum, end)
+	return w.record(cfID, start, val)
 }
 
 func (w *Writer) Close() (err error) {
+	if w.file == nil {
+		return ErrClosed
+	}
 	// seal remaining portion of data block's buffer in memory
 	if err = w.sealBlock(); err != nil {
 		return err
 	}
+	// a sealed WAL file is never written again, make sure it is durable
+	if w.sync != SyncNever {
+		if err = w.Sync(); err != nil {
+			return err
+		}
+	}
 	err = w.file.Close()
 	w.file = nil
 	if err != nil {
 		return err
 	}
+	w.publish()
 	return nil
 }